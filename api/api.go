@@ -0,0 +1,1494 @@
+// Package api is the JSON management API. Every resource lives under a
+// provisioning domain, so a caller working on one domain never touches
+// another's hosts, profiles or leases.
+package api
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ars1364/go-pxe/assets"
+	"github.com/ars1364/go-pxe/attest"
+	"github.com/ars1364/go-pxe/audit"
+	"github.com/ars1364/go-pxe/bmc"
+	"github.com/ars1364/go-pxe/bootlog"
+	"github.com/ars1364/go-pxe/cluster"
+	"github.com/ars1364/go-pxe/console"
+	"github.com/ars1364/go-pxe/dhcp"
+	"github.com/ars1364/go-pxe/enroll"
+	"github.com/ars1364/go-pxe/events"
+	"github.com/ars1364/go-pxe/fetch"
+	"github.com/ars1364/go-pxe/hardware"
+	"github.com/ars1364/go-pxe/inspect"
+	"github.com/ars1364/go-pxe/inventory"
+	"github.com/ars1364/go-pxe/mcast"
+	"github.com/ars1364/go-pxe/pki"
+	"github.com/ars1364/go-pxe/recording"
+	"github.com/ars1364/go-pxe/sessions"
+	"github.com/ars1364/go-pxe/sshkeys"
+	"github.com/ars1364/go-pxe/syslog"
+	"github.com/ars1364/go-pxe/transfers"
+)
+
+// Domain is the per-domain state the API operates on
+type Domain struct {
+	Name        string
+	Store       *inventory.Store
+	Leases      func() []dhcp.Lease
+	Revoke      func(mac net.HardwareAddr) bool
+	Logs        *syslog.Store
+	Sessions    *sessions.Tracker
+	Transfers   *transfers.Table
+	Inspections *inspect.Store
+	Hardware    *hardware.Store
+	Pending     *enroll.Store
+	Consoles    *console.Store
+	Attestation *attest.Store
+
+	Certificates *pki.Store
+
+	// HostKeys, if set, holds the hosts' pre-generated SSH host keys;
+	// known_hosts lists them under the host name, its name in DNSDomain
+	// and its address
+	HostKeys  *sshkeys.Store
+	DNSDomain string
+
+	// Multicast, if set, sends disk images to many hosts at once
+	Multicast *mcast.Server
+
+	// Clusters are the Kubernetes clusters being formed from hosts
+	Clusters *cluster.Store
+
+	// Assets lists the files in the domain's roots: their hashes, how
+	// they were downloaded, the profiles using them and when they were
+	// last served; with a profile, only the files it boots with
+	Assets func(profile string) ([]assets.Item, error)
+
+	// AssetIndex tells how current the listing Assets answers from is
+	AssetIndex func() assets.IndexStatus
+
+	// GC removes boot images nothing references that are older than
+	// minAge, and links identical ones together; with dryRun it only
+	// reports what it would do
+	GC func(minAge time.Duration, dryRun bool) (assets.Report, error)
+
+	// Recordings records single machines for debugging, into bundles of
+	// their packets, requests, rendered files and the server's log lines
+	Recordings *recording.Recorder
+}
+
+// Server serves the management API
+type Server struct {
+	// Audit, if set, records every successful mutation
+	Audit *audit.Log
+
+	// Boots, if set, serves the persistent boot history
+	Boots *bootlog.Log
+
+	// History, if set, serves recent events
+	History *events.History
+
+	// CA, if set, is the provisioning CA served for export
+	CA *pki.CA
+
+	domains map[string]*Domain
+	auth    *Auth
+	mux     *http.ServeMux
+}
+
+// NewServer creates an API server over the given domains. With a nil auth
+// every request is allowed.
+func NewServer(domains []*Domain, auth *Auth) *Server {
+	s := &Server{domains: make(map[string]*Domain), auth: auth, mux: http.NewServeMux()}
+	for _, d := range domains {
+		s.domains[d.Name] = d
+	}
+
+	s.mux.HandleFunc("GET /api/v1/domains", s.require(Viewer, s.listDomains))
+	s.mux.HandleFunc("GET /api/v1/ca", s.require(Viewer, s.getCA))
+	s.mux.HandleFunc("GET /api/v1/ca/bundle", s.require(Admin, s.exportCA))
+	s.mux.HandleFunc("GET /api/v1/domains/{domain}/hosts", s.require(Viewer, s.domain(s.listHosts)))
+	s.mux.HandleFunc("GET /api/v1/domains/{domain}/hosts/{name}", s.require(Viewer, s.domain(s.getHost)))
+	s.mux.HandleFunc("PUT /api/v1/domains/{domain}/hosts/{name}", s.require(Admin, s.domain(s.putHost)))
+	s.mux.HandleFunc("DELETE /api/v1/domains/{domain}/hosts/{name}", s.require(Admin, s.domain(s.deleteHost)))
+	s.mux.HandleFunc("GET /api/v1/domains/{domain}/hosts/{name}/power", s.require(Viewer, s.domain(s.getPower)))
+	s.mux.HandleFunc("POST /api/v1/domains/{domain}/hosts/{name}/power/{action}", s.require(Operator, s.domain(s.setPower)))
+	s.mux.HandleFunc("POST /api/v1/domains/{domain}/hosts/{name}/pxe", s.require(Operator, s.domain(s.bootPXE)))
+	s.mux.HandleFunc("POST /api/v1/domains/{domain}/hosts/{name}/reprovision", s.require(Operator, s.domain(s.reprovision)))
+	s.mux.HandleFunc("DELETE /api/v1/domains/{domain}/hosts/{name}/installed", s.require(Operator, s.domain(s.rearm)))
+	s.mux.HandleFunc("POST /api/v1/domains/{domain}/hosts/{name}/reinstall", s.require(Operator, s.domain(s.reinstall)))
+	s.mux.HandleFunc("DELETE /api/v1/domains/{domain}/hosts/{name}/reinstall", s.require(Operator, s.domain(s.cancelReinstall)))
+	s.mux.HandleFunc("GET /api/v1/domains/{domain}/hosts/{name}/ssh-keys", s.require(Viewer, s.domain(s.getHostKeys)))
+	s.mux.HandleFunc("DELETE /api/v1/domains/{domain}/hosts/{name}/ssh-keys", s.require(Admin, s.domain(s.deleteHostKeys)))
+	s.mux.HandleFunc("DELETE /api/v1/domains/{domain}/hosts/{name}/health", s.require(Operator, s.domain(s.resetHealth)))
+	s.mux.HandleFunc("DELETE /api/v1/domains/{domain}/hosts/{name}/firmware", s.require(Operator, s.domain(s.resetFirmware)))
+	s.mux.HandleFunc("GET /api/v1/domains/{domain}/known_hosts", s.require(Viewer, s.domain(s.knownHosts)))
+	s.mux.HandleFunc("GET /api/v1/domains/{domain}/ansible", s.require(Viewer, s.domain(s.ansibleInventory)))
+	s.mux.HandleFunc("GET /api/v1/domains/{domain}/profiles", s.require(Viewer, s.domain(s.listProfiles)))
+	s.mux.HandleFunc("GET /api/v1/domains/{domain}/profiles/{name}", s.require(Viewer, s.domain(s.getProfile)))
+	s.mux.HandleFunc("PUT /api/v1/domains/{domain}/profiles/{name}", s.require(Admin, s.domain(s.putProfile)))
+	s.mux.HandleFunc("DELETE /api/v1/domains/{domain}/profiles/{name}", s.require(Admin, s.domain(s.deleteProfile)))
+	s.mux.HandleFunc("GET /api/v1/domains/{domain}/rollouts", s.require(Viewer, s.domain(s.listRollouts)))
+	s.mux.HandleFunc("GET /api/v1/domains/{domain}/rollouts/{profile}", s.require(Viewer, s.domain(s.getRollout)))
+	s.mux.HandleFunc("PUT /api/v1/domains/{domain}/rollouts/{profile}", s.require(Admin, s.domain(s.putRollout)))
+	s.mux.HandleFunc("DELETE /api/v1/domains/{domain}/rollouts/{profile}", s.require(Admin, s.domain(s.abortRollout)))
+	s.mux.HandleFunc("POST /api/v1/domains/{domain}/rollouts/{profile}/promote", s.require(Admin, s.domain(s.promoteRollout)))
+	s.mux.HandleFunc("GET /api/v1/domains/{domain}/clusters", s.require(Viewer, s.domain(s.listClusters)))
+	s.mux.HandleFunc("GET /api/v1/domains/{domain}/clusters/{name}", s.require(Viewer, s.domain(s.getCluster)))
+	s.mux.HandleFunc("PUT /api/v1/domains/{domain}/clusters/{name}", s.require(Admin, s.domain(s.putCluster)))
+	s.mux.HandleFunc("DELETE /api/v1/domains/{domain}/clusters/{name}", s.require(Admin, s.domain(s.deleteCluster)))
+	s.mux.HandleFunc("GET /api/v1/domains/{domain}/leases", s.require(Viewer, s.domain(s.listLeases)))
+	s.mux.HandleFunc("DELETE /api/v1/domains/{domain}/leases/{mac}", s.require(Operator, s.domain(s.revokeLease)))
+	s.mux.HandleFunc("GET /api/v1/domains/{domain}/logs", s.require(Viewer, s.domain(s.listLogs)))
+	s.mux.HandleFunc("GET /api/v1/domains/{domain}/logs/{client}", s.require(Viewer, s.domain(s.getLogs)))
+	s.mux.HandleFunc("DELETE /api/v1/domains/{domain}/logs/{client}", s.require(Operator, s.domain(s.deleteLogs)))
+	s.mux.HandleFunc("GET /api/v1/domains/{domain}/consoles", s.require(Viewer, s.domain(s.listConsoles)))
+	s.mux.HandleFunc("GET /api/v1/domains/{domain}/consoles/{client}", s.require(Viewer, s.domain(s.getConsole)))
+	s.mux.HandleFunc("DELETE /api/v1/domains/{domain}/consoles/{client}", s.require(Operator, s.domain(s.deleteConsole)))
+	s.mux.HandleFunc("GET /api/v1/domains/{domain}/inspections", s.require(Viewer, s.domain(s.listInspections)))
+	s.mux.HandleFunc("GET /api/v1/domains/{domain}/inspections/{client}", s.require(Viewer, s.domain(s.getInspection)))
+	s.mux.HandleFunc("DELETE /api/v1/domains/{domain}/inspections/{client}", s.require(Operator, s.domain(s.deleteInspection)))
+	s.mux.HandleFunc("GET /api/v1/domains/{domain}/hardware", s.require(Viewer, s.domain(s.listHardware)))
+	s.mux.HandleFunc("GET /api/v1/domains/{domain}/hardware/{client}", s.require(Viewer, s.domain(s.getHardware)))
+	s.mux.HandleFunc("GET /api/v1/domains/{domain}/hardware/{client}/{kind}", s.require(Viewer, s.domain(s.getHardwareDocument)))
+	s.mux.HandleFunc("DELETE /api/v1/domains/{domain}/hardware/{client}", s.require(Operator, s.domain(s.deleteHardware)))
+	s.mux.HandleFunc("GET /api/v1/domains/{domain}/attestations", s.require(Viewer, s.domain(s.listAttestations)))
+	s.mux.HandleFunc("GET /api/v1/domains/{domain}/attestations/{client}", s.require(Viewer, s.domain(s.getAttestation)))
+	s.mux.HandleFunc("DELETE /api/v1/domains/{domain}/attestations/{client}", s.require(Admin, s.domain(s.deleteAttestation)))
+	s.mux.HandleFunc("GET /api/v1/domains/{domain}/certificates", s.require(Viewer, s.domain(s.listCertificates)))
+	s.mux.HandleFunc("GET /api/v1/domains/{domain}/certificates/{client}", s.require(Viewer, s.domain(s.getCertificate)))
+	s.mux.HandleFunc("DELETE /api/v1/domains/{domain}/certificates/{client}", s.require(Admin, s.domain(s.deleteCertificate)))
+	s.mux.HandleFunc("GET /api/v1/domains/{domain}/pending", s.require(Viewer, s.domain(s.listPending)))
+	s.mux.HandleFunc("GET /api/v1/domains/{domain}/pending/{mac}", s.require(Viewer, s.domain(s.getPending)))
+	s.mux.HandleFunc("POST /api/v1/domains/{domain}/pending/{mac}/approve", s.require(Admin, s.domain(s.approvePending)))
+	s.mux.HandleFunc("DELETE /api/v1/domains/{domain}/pending/{mac}", s.require(Operator, s.domain(s.rejectPending)))
+	s.mux.HandleFunc("GET /api/v1/domains/{domain}/sessions", s.require(Viewer, s.domain(s.listSessions)))
+	s.mux.HandleFunc("GET /api/v1/domains/{domain}/sessions/{id}", s.require(Viewer, s.domain(s.getSession)))
+	s.mux.HandleFunc("GET /api/v1/domains/{domain}/transfers", s.require(Viewer, s.domain(s.listTransfers)))
+	s.mux.HandleFunc("GET /api/v1/domains/{domain}/multicast", s.require(Viewer, s.domain(s.listMulticast)))
+	s.mux.HandleFunc("POST /api/v1/domains/{domain}/multicast", s.require(Operator, s.domain(s.startMulticast)))
+	s.mux.HandleFunc("GET /api/v1/domains/{domain}/multicast/{id}", s.require(Viewer, s.domain(s.getMulticast)))
+	s.mux.HandleFunc("DELETE /api/v1/domains/{domain}/multicast/{id}", s.require(Operator, s.domain(s.abortMulticast)))
+	s.mux.HandleFunc("GET /api/v1/domains/{domain}/assets", s.require(Viewer, s.domain(s.listAssets)))
+	s.mux.HandleFunc("GET /api/v1/domains/{domain}/assets/index", s.require(Viewer, s.domain(s.assetIndex)))
+	s.mux.HandleFunc("GET /api/v1/domains/{domain}/gc", s.require(Viewer, s.domain(s.planGC)))
+	s.mux.HandleFunc("POST /api/v1/domains/{domain}/gc", s.require(Admin, s.domain(s.runGC)))
+	s.mux.HandleFunc("GET /api/v1/domains/{domain}/recordings", s.require(Viewer, s.domain(s.listRecordings)))
+	s.mux.HandleFunc("GET /api/v1/domains/{domain}/recordings/{mac}", s.require(Viewer, s.domain(s.getRecording)))
+	s.mux.HandleFunc("POST /api/v1/domains/{domain}/recordings/{mac}", s.require(Operator, s.domain(s.startRecording)))
+	s.mux.HandleFunc("DELETE /api/v1/domains/{domain}/recordings/{mac}", s.require(Operator, s.domain(s.stopRecording)))
+	s.mux.HandleFunc("GET /api/v1/domains/{domain}/recordings/{mac}/bundle", s.require(Admin, s.domain(s.recordingBundle)))
+	s.mux.HandleFunc("GET /api/v1/domains/{domain}/events", s.require(Viewer, s.domain(s.recentEvents)))
+	s.mux.HandleFunc("GET /api/v1/domains/{domain}/boots", s.require(Viewer, s.domain(s.queryBoots)))
+	s.mux.HandleFunc("GET /api/v1/domains/{domain}/report", s.require(Viewer, s.domain(s.bootReport)))
+	s.mux.HandleFunc("GET /api/v1/domains/{domain}/audit", s.require(Operator, s.domain(s.queryAudit)))
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// ListenAndServe serves the API on addr
+func (s *Server) ListenAndServe(addr string) error {
+	if s.auth == nil {
+		log.Printf("[API] WARNING: no users configured, anyone who can reach %s has full access", addr)
+		log.Printf("[API] Listening on %s (%d domains)", addr, len(s.domains))
+		return http.ListenAndServe(addr, s)
+	}
+	var providers []string
+	if s.auth.OIDC != nil {
+		providers = append(providers, "OIDC "+s.auth.OIDC.Issuer)
+	}
+	if s.auth.LDAP != nil {
+		providers = append(providers, "LDAP "+s.auth.LDAP.URL)
+	}
+	if len(providers) > 0 {
+		log.Printf("[API] Authenticating via %s (%d group mappings)", strings.Join(providers, " and "), len(s.auth.Groups))
+	}
+	log.Printf("[API] Listening on %s (%d domains, %d users)", addr, len(s.domains), len(s.auth.Users))
+	return http.ListenAndServe(addr, s)
+}
+
+// domain resolves the {domain} path segment before calling h
+func (s *Server) domain(h func(http.ResponseWriter, *http.Request, *Domain)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		d, ok := s.domains[r.PathValue("domain")]
+		if !ok {
+			writeError(w, http.StatusNotFound, fmt.Errorf("no such domain %q", r.PathValue("domain")))
+			return
+		}
+		h(w, r, d)
+	}
+}
+
+func (s *Server) listDomains(w http.ResponseWriter, r *http.Request) {
+	names := make([]string, 0, len(s.domains))
+	for name := range s.domains {
+		if u := UserFrom(r.Context()); u == nil || u.CanAccess(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	writeJSON(w, http.StatusOK, names)
+}
+
+// getCA returns the provisioning CA certificate, for other systems to
+// trust the hosts' certificates
+func (s *Server) getCA(w http.ResponseWriter, r *http.Request) {
+	if s.CA == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no provisioning CA configured (-ca-dir)"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Write(s.CA.CertPEM())
+}
+
+// exportCA returns the provisioning CA certificate and private key, to
+// bootstrap the fleet's PKI from it
+func (s *Server) exportCA(w http.ResponseWriter, r *http.Request) {
+	if s.CA == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no provisioning CA configured (-ca-dir)"))
+		return
+	}
+	log.Printf("[API] Provisioning CA exported by %s", actor(r))
+	// The key signs every domain's certificates, so the export shows in
+	// each domain's audit trail
+	for _, name := range slices.Sorted(maps.Keys(s.domains)) {
+		s.Audit.Record(actor(r), name, "ca.export", s.CA.Fingerprint(), nil, nil)
+	}
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(s.CA.Bundle())
+}
+
+func (s *Server) listHosts(w http.ResponseWriter, r *http.Request, d *Domain) {
+	hosts := d.Store.Hosts()
+	for i := range hosts {
+		hosts[i] = hosts[i].Redacted()
+	}
+	writeJSON(w, http.StatusOK, hosts)
+}
+
+func (s *Server) getHost(w http.ResponseWriter, r *http.Request, d *Domain) {
+	h, ok := d.Store.Host(r.PathValue("name"))
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no such host %q", r.PathValue("name")))
+		return
+	}
+	writeJSON(w, http.StatusOK, h.Redacted())
+}
+
+func (s *Server) putHost(w http.ResponseWriter, r *http.Request, d *Domain) {
+	var h inventory.Host
+	if err := json.NewDecoder(r.Body).Decode(&h); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	h.Name = r.PathValue("name")
+	before, existed := d.Store.Host(h.Name)
+	// A host read back from the API carries the masked password; keep
+	// the stored one
+	if h.BMC != nil && h.BMC.Password == inventory.Redacted && existed && before.BMC != nil {
+		h.BMC.Password = before.BMC.Password
+	}
+	// Only attestation itself sets the outcome
+	h.Attestation = before.Attestation
+	if err := d.Store.PutHost(h); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	h, _ = d.Store.Host(h.Name)
+	log.Printf("[API] %s: put host %s", d.Name, h.Name)
+	s.Audit.Record(actor(r), d.Name, "host.put", h.Name, orNil(before.Redacted(), existed), h.Redacted())
+	writeJSON(w, http.StatusOK, h.Redacted())
+}
+
+func (s *Server) deleteHost(w http.ResponseWriter, r *http.Request, d *Domain) {
+	name := r.PathValue("name")
+	if before, ok := d.Store.Host(name); ok {
+		d.Store.DeleteHost(name)
+		log.Printf("[API] %s: deleted host %s", d.Name, name)
+		s.Audit.Record(actor(r), d.Name, "host.delete", name, before.Redacted(), nil)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ansibleInventory serves the domain's hosts as an Ansible dynamic
+// inventory, reachable at their leased addresses
+func (s *Server) ansibleInventory(w http.ResponseWriter, r *http.Request, d *Domain) {
+	addr := make(map[string]string)
+	for _, l := range d.Leases() {
+		addr[l.MAC] = l.IP
+	}
+	writeJSON(w, http.StatusOK, inventory.Ansible(d.Store.Hosts(), addr))
+}
+
+// getHostKeys returns the public SSH host keys of a host, generating them
+// if it has none yet
+func (s *Server) getHostKeys(w http.ResponseWriter, r *http.Request, d *Domain) {
+	if d.HostKeys == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no SSH key directory configured (-ssh-key-dir)"))
+		return
+	}
+	h, ok := d.Store.Host(r.PathValue("name"))
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no such host %q", r.PathValue("name")))
+		return
+	}
+	keys, err := d.HostKeys.Keys(h.Name)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, keys)
+}
+
+// deleteHostKeys discards a host's SSH host keys; it gets new ones on its
+// next install
+func (s *Server) deleteHostKeys(w http.ResponseWriter, r *http.Request, d *Domain) {
+	name := r.PathValue("name")
+	if d.HostKeys != nil && d.HostKeys.Delete(name) {
+		log.Printf("[API] %s: deleted SSH host keys of %s", d.Name, name)
+		s.Audit.Record(actor(r), d.Name, "sshkeys.delete", name, nil, nil)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// resetHealth forgets the profile versions a host booted, including any
+// marked bad, so it boots its profile as defined again
+func (s *Server) resetHealth(w http.ResponseWriter, r *http.Request, d *Domain) {
+	name := r.PathValue("name")
+	before, _ := d.Store.Host(name)
+	if d.Store.ResetHealth(name) {
+		log.Printf("[API] %s: reset health of %s", d.Name, name)
+		s.Audit.Record(actor(r), d.Name, "health.reset", name, before.Health, nil)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// resetFirmware forgets the firmware a host reported, so a host given up
+// on is given its profile's firmware update again
+func (s *Server) resetFirmware(w http.ResponseWriter, r *http.Request, d *Domain) {
+	name := r.PathValue("name")
+	before, _ := d.Store.Host(name)
+	if d.Store.ResetFirmware(name) {
+		log.Printf("[API] %s: reset firmware of %s", d.Name, name)
+		s.Audit.Record(actor(r), d.Name, "firmware.reset", name, before.Firmware, nil)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// knownHosts returns an ssh_known_hosts file for every inventory host,
+// generating keys for hosts that have none yet
+func (s *Server) knownHosts(w http.ResponseWriter, r *http.Request, d *Domain) {
+	if d.HostKeys == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no SSH key directory configured (-ssh-key-dir)"))
+		return
+	}
+	addr := make(map[string]string)
+	for _, l := range d.Leases() {
+		addr[l.MAC] = l.IP
+	}
+	var out strings.Builder
+	for _, h := range d.Store.Hosts() {
+		keys, err := d.HostKeys.Keys(h.Name)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		names := []string{strings.ToLower(h.Name)}
+		if d.DNSDomain != "" {
+			names = append(names, strings.ToLower(h.Name)+"."+d.DNSDomain)
+		}
+		if ip := cmp.Or(h.IP, addr[h.MAC]); ip != "" {
+			names = append(names, ip)
+		}
+		for _, k := range keys {
+			fmt.Fprintf(&out, "%s %s\n", strings.Join(names, ","), k.Public)
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, out.String())
+}
+
+// bmcTimeout bounds one power request; BMCs are slow but should not hang
+// an API call forever
+const bmcTimeout = 90 * time.Second
+
+// controller returns the BMC of the host named in the path, or writes the
+// error
+func (s *Server) controller(w http.ResponseWriter, r *http.Request, d *Domain) (bmc.Controller, bool) {
+	h, ok := d.Store.Host(r.PathValue("name"))
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no such host %q", r.PathValue("name")))
+		return nil, false
+	}
+	c, err := bmc.New(h.BMC)
+	if err != nil {
+		writeError(w, http.StatusConflict, fmt.Errorf("host %s: %w", h.Name, err))
+		return nil, false
+	}
+	return c, true
+}
+
+func (s *Server) getPower(w http.ResponseWriter, r *http.Request, d *Domain) {
+	c, ok := s.controller(w, r, d)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), bmcTimeout)
+	defer cancel()
+	state, err := c.PowerState(ctx)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"state": state})
+}
+
+// setPower turns a host on or off, or power-cycles it (cycle)
+func (s *Server) setPower(w http.ResponseWriter, r *http.Request, d *Domain) {
+	action := r.PathValue("action")
+	if action != bmc.On && action != bmc.Off && action != "cycle" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("unknown power action %q (want on, off or cycle)", action))
+		return
+	}
+	s.bmcAction(w, r, d, "host.power."+action, func(ctx context.Context, c bmc.Controller) error {
+		if action == "cycle" {
+			return bmc.Cycle(ctx, c)
+		}
+		return c.SetPower(ctx, action)
+	})
+}
+
+// bootPXE makes a host's next boot a network boot without rebooting it
+func (s *Server) bootPXE(w http.ResponseWriter, r *http.Request, d *Domain) {
+	s.bmcAction(w, r, d, "host.pxe", func(ctx context.Context, c bmc.Controller) error {
+		return c.BootPXEOnce(ctx)
+	})
+}
+
+// reprovision flags a host for reinstallation and reboots it into the
+// installer through its BMC
+func (s *Server) reprovision(w http.ResponseWriter, r *http.Request, d *Domain) {
+	name := r.PathValue("name")
+	h, _ := d.Store.Host(name)
+	s.bmcAction(w, r, d, "host.reprovision", func(ctx context.Context, c bmc.Controller) error {
+		d.Store.SetReinstall(name, time.Now())
+		err := bmc.Reprovision(ctx, c)
+		if err != nil {
+			d.Store.SetReinstall(name, h.Reinstall)
+		}
+		return err
+	})
+}
+
+// reinstall flags a host for reinstallation on its next network boot, until
+// it reports the install complete
+func (s *Server) reinstall(w http.ResponseWriter, r *http.Request, d *Domain) {
+	name := r.PathValue("name")
+	if !d.Store.SetReinstall(name, time.Now()) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no such host %q", name))
+		return
+	}
+	log.Printf("[API] %s: %s will be reinstalled", d.Name, name)
+	s.Audit.Record(actor(r), d.Name, "host.reinstall", name, nil, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// cancelReinstall clears a host's reinstallation flag
+func (s *Server) cancelReinstall(w http.ResponseWriter, r *http.Request, d *Domain) {
+	name := r.PathValue("name")
+	if h, ok := d.Store.Host(name); ok && !h.Reinstall.IsZero() && d.Store.SetReinstall(name, time.Time{}) {
+		log.Printf("[API] %s: %s will not be reinstalled", d.Name, name)
+		s.Audit.Record(actor(r), d.Name, "host.reinstall.cancel", name, h.Reinstall, nil)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// rearm lets a host to be installed once be installed on its next network
+// boot
+func (s *Server) rearm(w http.ResponseWriter, r *http.Request, d *Domain) {
+	name := r.PathValue("name")
+	if h, ok := d.Store.Host(name); ok && !h.Installed.IsZero() && d.Store.SetInstalled(name, time.Time{}) {
+		log.Printf("[API] %s: %s will be installed again", d.Name, name)
+		s.Audit.Record(actor(r), d.Name, "host.rearm", name, h.Installed, nil)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) bmcAction(w http.ResponseWriter, r *http.Request, d *Domain, action string, fn func(context.Context, bmc.Controller) error) {
+	c, ok := s.controller(w, r, d)
+	if !ok {
+		return
+	}
+	name := r.PathValue("name")
+	ctx, cancel := context.WithTimeout(r.Context(), bmcTimeout)
+	defer cancel()
+	if err := fn(ctx, c); err != nil {
+		log.Printf("[API] %s: %s %s failed: %v", d.Name, action, name, err)
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	log.Printf("[API] %s: %s %s", d.Name, action, name)
+	s.Audit.Record(actor(r), d.Name, action, name, nil, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) listProfiles(w http.ResponseWriter, r *http.Request, d *Domain) {
+	writeJSON(w, http.StatusOK, d.Store.Profiles())
+}
+
+func (s *Server) getProfile(w http.ResponseWriter, r *http.Request, d *Domain) {
+	p, ok := d.Store.Profile(r.PathValue("name"))
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no such profile %q", r.PathValue("name")))
+		return
+	}
+	writeJSON(w, http.StatusOK, p)
+}
+
+func (s *Server) putProfile(w http.ResponseWriter, r *http.Request, d *Domain) {
+	var p inventory.Profile
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	p.Name = r.PathValue("name")
+	before, existed := d.Store.Profile(p.Name)
+	if err := d.Store.PutProfile(p); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	log.Printf("[API] %s: put profile %s", d.Name, p.Name)
+	s.Audit.Record(actor(r), d.Name, "profile.put", p.Name, orNil(before, existed), p)
+	writeJSON(w, http.StatusOK, p)
+}
+
+func (s *Server) deleteProfile(w http.ResponseWriter, r *http.Request, d *Domain) {
+	name := r.PathValue("name")
+	if before, ok := d.Store.Profile(name); ok {
+		d.Store.DeleteProfile(name)
+		log.Printf("[API] %s: deleted profile %s", d.Name, name)
+		s.Audit.Record(actor(r), d.Name, "profile.delete", name, before, nil)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) listRollouts(w http.ResponseWriter, r *http.Request, d *Domain) {
+	writeJSON(w, http.StatusOK, d.Store.Rollouts())
+}
+
+func (s *Server) getRollout(w http.ResponseWriter, r *http.Request, d *Domain) {
+	ro, ok := d.Store.Rollout(r.PathValue("profile"))
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("profile %q has no rollout", r.PathValue("profile")))
+		return
+	}
+	writeJSON(w, http.StatusOK, ro)
+}
+
+// putRollout starts or adjusts a canary rollout of a profile:
+// {"canary": "almalinux-9.5", "percent": 10, "hosts": ["node42"]}
+func (s *Server) putRollout(w http.ResponseWriter, r *http.Request, d *Domain) {
+	var ro inventory.Rollout
+	if err := json.NewDecoder(r.Body).Decode(&ro); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	ro.Profile, ro.Started = r.PathValue("profile"), time.Time{}
+	for _, name := range []string{ro.Profile, ro.Canary} {
+		if _, ok := d.Store.Profile(name); !ok {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("no such profile %q", name))
+			return
+		}
+	}
+	before, existed := d.Store.Rollout(ro.Profile)
+	if err := d.Store.PutRollout(ro); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	ro, _ = d.Store.Rollout(ro.Profile)
+	log.Printf("[API] %s: rolling out %s to %d hosts of %s", d.Name, ro.Canary, len(ro.Canaries), ro.Profile)
+	s.Audit.Record(actor(r), d.Name, "rollout.put", ro.Profile, orNil(before, existed), ro)
+	writeJSON(w, http.StatusOK, ro)
+}
+
+// abortRollout returns every host to the stable profile
+func (s *Server) abortRollout(w http.ResponseWriter, r *http.Request, d *Domain) {
+	name := r.PathValue("profile")
+	if before, ok := d.Store.Rollout(name); ok && d.Store.DeleteRollout(name) {
+		log.Printf("[API] %s: aborted rollout of %s to %s", d.Name, before.Canary, name)
+		s.Audit.Record(actor(r), d.Name, "rollout.abort", name, before, nil)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// promoteRollout makes the canary profile the stable one for every host
+func (s *Server) promoteRollout(w http.ResponseWriter, r *http.Request, d *Domain) {
+	name := r.PathValue("profile")
+	before, _ := d.Store.Profile(name)
+	p, err := d.Store.PromoteRollout(name)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	log.Printf("[API] %s: promoted rollout of profile %s", d.Name, name)
+	s.Audit.Record(actor(r), d.Name, "rollout.promote", name, before, p)
+	writeJSON(w, http.StatusOK, p)
+}
+
+func (s *Server) listClusters(w http.ResponseWriter, r *http.Request, d *Domain) {
+	list := d.Clusters.List()
+	for i := range list {
+		list[i] = list[i].Redacted()
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (s *Server) getCluster(w http.ResponseWriter, r *http.Request, d *Domain) {
+	c, ok := d.Clusters.Get(r.PathValue("name"))
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no such cluster %q", r.PathValue("name")))
+		return
+	}
+	writeJSON(w, http.StatusOK, c.Redacted())
+}
+
+// putCluster defines a Kubernetes cluster to form from hosts:
+// {"kind": "kubeadm", "controlPlanes": ["cp1", "cp2", "cp3"], "workers": ["w1"]}
+func (s *Server) putCluster(w http.ResponseWriter, r *http.Request, d *Domain) {
+	var c cluster.Cluster
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	c.Name = r.PathValue("name")
+	for _, h := range c.Hosts() {
+		if _, ok := d.Store.Host(h); !ok {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("no such host %q", h))
+			return
+		}
+	}
+	before, existed := d.Clusters.Get(c.Name)
+	c, err := d.Clusters.Put(c)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	log.Printf("[API] %s: %s cluster %s with %d control planes and %d workers", d.Name, c.Kind, c.Name, len(c.ControlPlanes), len(c.Workers))
+	s.Audit.Record(actor(r), d.Name, "cluster.put", c.Name, orNil(before.Redacted(), existed), c.Redacted())
+	writeJSON(w, http.StatusOK, c.Redacted())
+}
+
+// deleteCluster stops tracking a cluster; its hosts keep running
+func (s *Server) deleteCluster(w http.ResponseWriter, r *http.Request, d *Domain) {
+	name := r.PathValue("name")
+	if before, ok := d.Clusters.Get(name); ok && d.Clusters.Delete(name) {
+		log.Printf("[API] %s: deleted cluster %s", d.Name, name)
+		s.Audit.Record(actor(r), d.Name, "cluster.delete", name, before.Redacted(), nil)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listLeases returns the lease table by address, as JSON or CSV (see
+// export), with only the leases seen between ?since= and ?until= if given
+func (s *Server) listLeases(w http.ResponseWriter, r *http.Request, d *Domain) {
+	q := r.URL.Query()
+	var since, until time.Time
+	var err error
+	if v := q.Get("since"); v != "" {
+		if since, err = time.Parse(time.RFC3339, v); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("since: %w", err))
+			return
+		}
+	}
+	if v := q.Get("until"); v != "" {
+		if until, err = time.Parse(time.RFC3339, v); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("until: %w", err))
+			return
+		}
+	}
+	leases := slices.DeleteFunc(d.Leases(), func(l dhcp.Lease) bool {
+		return !since.IsZero() && l.Seen.Before(since) || !until.IsZero() && !l.Seen.Before(until)
+	})
+	slices.SortFunc(leases, func(a, b dhcp.Lease) int {
+		return bytes.Compare(net.ParseIP(a.IP).To16(), net.ParseIP(b.IP).To16())
+	})
+
+	// The inventory entry each lease belongs to, for the host and profile
+	// columns
+	hosts := make(map[string][2]string)
+	owner := func(l dhcp.Lease) [2]string {
+		if o, ok := hosts[l.MAC]; ok {
+			return o
+		}
+		var o [2]string
+		if mac, err := net.ParseMAC(l.MAC); err == nil {
+			h, p, _ := d.Store.ProfileFor(mac)
+			o = [2]string{h.Name, p.Name}
+		}
+		hosts[l.MAC] = o
+		return o
+	}
+	columns := []column[dhcp.Lease]{
+		{"mac", func(l dhcp.Lease) any { return l.MAC }},
+		{"ip", func(l dhcp.Lease) any { return l.IP }},
+		{"uuid", func(l dhcp.Lease) any { return l.UUID }},
+		{"arch", func(l dhcp.Lease) any { return l.Arch }},
+		{"circuit", func(l dhcp.Lease) any { return l.CircuitID }},
+		{"remote", func(l dhcp.Lease) any { return l.RemoteID }},
+		{"seen", func(l dhcp.Lease) any { return l.Seen }},
+		{"expires", func(l dhcp.Lease) any { return l.Expires }},
+		{"host", func(l dhcp.Lease) any { return owner(l)[0] }},
+		{"profile", func(l dhcp.Lease) any { return owner(l)[1] }},
+	}
+	export(w, r, "leases-"+d.Name, leases, columns, []string{"mac", "ip", "uuid", "arch", "circuit", "remote", "seen", "expires", "host", "profile"})
+}
+
+func (s *Server) revokeLease(w http.ResponseWriter, r *http.Request, d *Domain) {
+	mac, err := net.ParseMAC(r.PathValue("mac"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if !d.Revoke(mac) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no lease for %s", mac))
+		return
+	}
+	log.Printf("[API] %s: revoked lease of %s", d.Name, mac)
+	s.Audit.Record(actor(r), d.Name, "lease.revoke", mac.String(), nil, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) listLogs(w http.ResponseWriter, r *http.Request, d *Domain) {
+	writeJSON(w, http.StatusOK, d.Logs.Clients())
+}
+
+// getLogs returns a client's installer log, optionally only the messages
+// after ?since= so a caller can tail it
+func (s *Server) getLogs(w http.ResponseWriter, r *http.Request, d *Domain) {
+	var since time.Time
+	if v := r.URL.Query().Get("since"); v != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339Nano, v); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("since: %w", err))
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, d.Logs.Messages(r.PathValue("client"), since))
+}
+
+func (s *Server) deleteLogs(w http.ResponseWriter, r *http.Request, d *Domain) {
+	client := r.PathValue("client")
+	if d.Logs.Delete(client) {
+		log.Printf("[API] %s: cleared logs of %s", d.Name, client)
+		s.Audit.Record(actor(r), d.Name, "logs.delete", client, nil, nil)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listInspections returns the latest hardware report of every client,
+// without the raw agent data
+func (s *Server) listConsoles(w http.ResponseWriter, r *http.Request, d *Domain) {
+	writeJSON(w, http.StatusOK, d.Consoles.Clients())
+}
+
+// getConsole returns a client's captured console output as text. With
+// ?follow=true it keeps streaming new output until the caller hangs up.
+func (s *Server) getConsole(w http.ResponseWriter, r *http.Request, d *Domain) {
+	client := r.PathValue("client")
+	data, next, more, ok := d.Consoles.Read(client, -1)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no console output from %q", client))
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(data)
+	if follow, _ := strconv.ParseBool(r.URL.Query().Get("follow")); !follow {
+		return
+	}
+	rc := http.NewResponseController(w)
+	for {
+		if rc.Flush() != nil {
+			return
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-more:
+		}
+		if data, next, more, ok = d.Consoles.Read(client, next); !ok {
+			return
+		}
+		if _, err := w.Write(data); err != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) deleteConsole(w http.ResponseWriter, r *http.Request, d *Domain) {
+	client := r.PathValue("client")
+	if d.Consoles.Delete(client) {
+		log.Printf("[API] %s: cleared console of %s", d.Name, client)
+		s.Audit.Record(actor(r), d.Name, "console.delete", client, nil, nil)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) listInspections(w http.ResponseWriter, r *http.Request, d *Domain) {
+	writeJSON(w, http.StatusOK, d.Inspections.List())
+}
+
+func (s *Server) getInspection(w http.ResponseWriter, r *http.Request, d *Domain) {
+	rep, ok := d.Inspections.Get(r.PathValue("client"))
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no inspection of %q", r.PathValue("client")))
+		return
+	}
+	writeJSON(w, http.StatusOK, rep)
+}
+
+func (s *Server) deleteInspection(w http.ResponseWriter, r *http.Request, d *Domain) {
+	client := r.PathValue("client")
+	if d.Inspections.Delete(client) {
+		log.Printf("[API] %s: deleted inspection of %s", d.Name, client)
+		s.Audit.Record(actor(r), d.Name, "inspection.delete", client, nil, nil)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listHardware returns the hardware summary of every client that posted
+// documents, optionally filtered by ?vendor=, ?product=, ?serial= and
+// ?minMemoryMiB=
+func (s *Server) listHardware(w http.ResponseWriter, r *http.Request, d *Domain) {
+	q := r.URL.Query()
+	f := hardware.Filter{Vendor: q.Get("vendor"), Product: q.Get("product"), Serial: q.Get("serial")}
+	if v := q.Get("minMemoryMiB"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid minMemoryMiB %q", v))
+			return
+		}
+		f.MinMemoryMiB = n
+	}
+	writeJSON(w, http.StatusOK, d.Hardware.List(f))
+}
+
+func (s *Server) getHardware(w http.ResponseWriter, r *http.Request, d *Domain) {
+	rec, ok := d.Hardware.Get(r.PathValue("client"))
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no hardware reported by %q", r.PathValue("client")))
+		return
+	}
+	writeJSON(w, http.StatusOK, rec)
+}
+
+// getHardwareDocument returns one document as the client posted it
+func (s *Server) getHardwareDocument(w http.ResponseWriter, r *http.Request, d *Domain) {
+	rec, _ := d.Hardware.Get(r.PathValue("client"))
+	doc, ok := rec.Documents[r.PathValue("kind")]
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no %s document from %q", r.PathValue("kind"), r.PathValue("client")))
+		return
+	}
+	var text string
+	if json.Unmarshal(doc, &text) == nil {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		io.WriteString(w, text)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(doc)
+}
+
+func (s *Server) deleteHardware(w http.ResponseWriter, r *http.Request, d *Domain) {
+	client := r.PathValue("client")
+	if d.Hardware.Delete(client) {
+		log.Printf("[API] %s: deleted hardware of %s", d.Name, client)
+		s.Audit.Record(actor(r), d.Name, "hardware.delete", client, nil, nil)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) listAttestations(w http.ResponseWriter, r *http.Request, d *Domain) {
+	writeJSON(w, http.StatusOK, d.Attestation.List())
+}
+
+// getAttestation returns a client's latest attestation, including the
+// event log it sent
+func (s *Server) getAttestation(w http.ResponseWriter, r *http.Request, d *Domain) {
+	rep, ok := d.Attestation.Get(r.PathValue("client"))
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no attestation from %q", r.PathValue("client")))
+		return
+	}
+	writeJSON(w, http.StatusOK, rep)
+}
+
+// deleteAttestation forgets a client's attestation and its pinned key,
+// e.g. after replacing its mainboard
+func (s *Server) deleteAttestation(w http.ResponseWriter, r *http.Request, d *Domain) {
+	client := r.PathValue("client")
+	if d.Attestation.Delete(client) {
+		log.Printf("[API] %s: deleted attestation of %s", d.Name, client)
+		s.Audit.Record(actor(r), d.Name, "attestation.delete", client, nil, nil)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) listCertificates(w http.ResponseWriter, r *http.Request, d *Domain) {
+	writeJSON(w, http.StatusOK, d.Certificates.List())
+}
+
+func (s *Server) getCertificate(w http.ResponseWriter, r *http.Request, d *Domain) {
+	c, ok := d.Certificates.Get(r.PathValue("client"))
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no certificate issued to %q", r.PathValue("client")))
+		return
+	}
+	writeJSON(w, http.StatusOK, c)
+}
+
+// deleteCertificate revokes a host's certificate for mutual TLS and lets
+// its next install fetch a new one
+func (s *Server) deleteCertificate(w http.ResponseWriter, r *http.Request, d *Domain) {
+	client := r.PathValue("client")
+	c, ok := d.Certificates.Get(client)
+	if ok && d.Certificates.Delete(client) {
+		log.Printf("[API] %s: deleted certificate %s of %s", d.Name, c.Serial, client)
+		s.Audit.Record(actor(r), d.Name, "certificate.delete", client, c, nil)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) listPending(w http.ResponseWriter, r *http.Request, d *Domain) {
+	writeJSON(w, http.StatusOK, d.Pending.List())
+}
+
+func (s *Server) getPending(w http.ResponseWriter, r *http.Request, d *Domain) {
+	mac, err := net.ParseMAC(r.PathValue("mac"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	p, ok := d.Pending.Get(mac.String())
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no pending host %s", mac))
+		return
+	}
+	writeJSON(w, http.StatusOK, p)
+}
+
+// approvePending adds a pending machine to the inventory as the host in
+// the body, which needs at least a name and usually a profile
+func (s *Server) approvePending(w http.ResponseWriter, r *http.Request, d *Domain) {
+	mac, err := net.ParseMAC(r.PathValue("mac"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	p, ok := d.Pending.Get(mac.String())
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no pending host %s", mac))
+		return
+	}
+	var h inventory.Host
+	if err := json.NewDecoder(r.Body).Decode(&h); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	h.MAC, h.Attestation = mac.String(), nil
+	if _, exists := d.Store.Host(h.Name); exists {
+		writeError(w, http.StatusConflict, fmt.Errorf("host %s already exists", h.Name))
+		return
+	}
+	if _, ok := d.Store.Profile(h.Profile); h.Profile != "" && !ok {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("no such profile %q", h.Profile))
+		return
+	}
+	if err := d.Store.PutHost(h); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	d.Pending.Delete(p.MAC)
+	h, _ = d.Store.Host(h.Name)
+	log.Printf("[API] %s: approved %s as host %s (profile %s)", d.Name, p.MAC, h.Name, h.Profile)
+	s.Audit.Record(actor(r), d.Name, "pending.approve", h.Name, p, h.Redacted())
+	writeJSON(w, http.StatusOK, h.Redacted())
+}
+
+// rejectPending drops a machine from the pending list. It reappears if it
+// boots again.
+func (s *Server) rejectPending(w http.ResponseWriter, r *http.Request, d *Domain) {
+	mac, err := net.ParseMAC(r.PathValue("mac"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if p, ok := d.Pending.Get(mac.String()); ok {
+		d.Pending.Delete(p.MAC)
+		log.Printf("[API] %s: rejected pending host %s", d.Name, p.MAC)
+		s.Audit.Record(actor(r), d.Name, "pending.reject", p.MAC, p, nil)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listSessions returns the domain's boot sessions, newest first, optionally
+// only those of ?mac= or with ?outcome=
+func (s *Server) listSessions(w http.ResponseWriter, r *http.Request, d *Domain) {
+	q := r.URL.Query()
+	var mac string
+	if v := q.Get("mac"); v != "" {
+		m, err := net.ParseMAC(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("mac: %w", err))
+			return
+		}
+		mac = m.String()
+	}
+	list := []sessions.Session{}
+	for _, sess := range d.Sessions.List(d.Name) {
+		if (mac == "" || sess.MAC == mac) && (q.Get("outcome") == "" || sess.Outcome == q.Get("outcome")) {
+			list = append(list, sess)
+		}
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (s *Server) getSession(w http.ResponseWriter, r *http.Request, d *Domain) {
+	sess, ok := d.Sessions.Get(d.Name, r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no such session %q", r.PathValue("id")))
+		return
+	}
+	writeJSON(w, http.StatusOK, sess)
+}
+
+func (s *Server) listTransfers(w http.ResponseWriter, r *http.Request, d *Domain) {
+	writeJSON(w, http.StatusOK, d.Transfers.List())
+}
+
+var errNoMulticast = errors.New("no multicast image directory configured (-multicast-root)")
+
+func (s *Server) listMulticast(w http.ResponseWriter, r *http.Request, d *Domain) {
+	if d.Multicast == nil {
+		writeError(w, http.StatusNotFound, errNoMulticast)
+		return
+	}
+	writeJSON(w, http.StatusOK, d.Multicast.List())
+}
+
+// startMulticast schedules a transfer: {"image": "rhel9.raw", "receivers":
+// 12, "wait": "10m", "rate": "100M"}. It starts once that many receivers
+// have joined, or after wait with whoever has.
+func (s *Server) startMulticast(w http.ResponseWriter, r *http.Request, d *Domain) {
+	if d.Multicast == nil {
+		writeError(w, http.StatusNotFound, errNoMulticast)
+		return
+	}
+	var req struct {
+		Image     string `json:"image"`
+		Receivers int    `json:"receivers"`
+		Wait      string `json:"wait"`
+		Rate      string `json:"rate"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	opts := mcast.Options{Receivers: req.Receivers}
+	var err error
+	if req.Wait != "" {
+		if opts.Wait, err = time.ParseDuration(req.Wait); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	if req.Rate != "" {
+		if opts.Rate, err = fetch.ParseRate(req.Rate); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	t, err := d.Multicast.Start(req.Image, opts)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	log.Printf("[API] %s: started multicast transfer %d of %s", d.Name, t.ID, t.Image)
+	s.Audit.Record(actor(r), d.Name, "multicast.start", t.Image, nil, t)
+	writeJSON(w, http.StatusCreated, t)
+}
+
+func (s *Server) getMulticast(w http.ResponseWriter, r *http.Request, d *Domain) {
+	if d.Multicast == nil {
+		writeError(w, http.StatusNotFound, errNoMulticast)
+		return
+	}
+	id, _ := strconv.ParseUint(r.PathValue("id"), 10, 32)
+	t, ok := d.Multicast.Get(uint32(id))
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no such transfer %q", r.PathValue("id")))
+		return
+	}
+	writeJSON(w, http.StatusOK, t)
+}
+
+// abortMulticast stops a transfer; its receivers fail
+func (s *Server) abortMulticast(w http.ResponseWriter, r *http.Request, d *Domain) {
+	id, _ := strconv.ParseUint(r.PathValue("id"), 10, 32)
+	if d.Multicast != nil && d.Multicast.Abort(uint32(id)) {
+		log.Printf("[API] %s: aborted multicast transfer %d", d.Name, id)
+		s.Audit.Record(actor(r), d.Name, "multicast.abort", r.PathValue("id"), nil, nil)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listAssets returns the asset catalog, or with ?profile= what that
+// profile's menu entry serves
+func (s *Server) listAssets(w http.ResponseWriter, r *http.Request, d *Domain) {
+	profile := r.URL.Query().Get("profile")
+	if _, ok := d.Store.Profile(profile); profile != "" && !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no such profile %q", profile))
+		return
+	}
+	if d.Assets == nil {
+		writeJSON(w, http.StatusOK, []assets.Item{})
+		return
+	}
+	items, err := d.Assets(profile)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, items)
+}
+
+// assetIndex tells whether the roots are still being indexed, so the
+// asset catalog may be incomplete
+func (s *Server) assetIndex(w http.ResponseWriter, r *http.Request, d *Domain) {
+	if d.AssetIndex == nil {
+		writeJSON(w, http.StatusOK, assets.IndexStatus{})
+		return
+	}
+	writeJSON(w, http.StatusOK, d.AssetIndex())
+}
+
+// planGC reports the boot images a collection would remove and link,
+// without touching them
+func (s *Server) planGC(w http.ResponseWriter, r *http.Request, d *Domain) {
+	s.gc(w, r, d, true)
+}
+
+// runGC removes the boot images nothing references and links identical
+// ones together
+func (s *Server) runGC(w http.ResponseWriter, r *http.Request, d *Domain) {
+	s.gc(w, r, d, false)
+}
+
+// gc collects the domain's roots, sparing images modified within ?minAge=
+// (24h by default)
+func (s *Server) gc(w http.ResponseWriter, r *http.Request, d *Domain, dryRun bool) {
+	if d.GC == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no image collection in domain %q", d.Name))
+		return
+	}
+	minAge := 24 * time.Hour
+	if v := r.URL.Query().Get("minAge"); v != "" {
+		var err error
+		if minAge, err = time.ParseDuration(v); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("minAge: %w", err))
+			return
+		}
+	}
+	report, err := d.GC(minAge, dryRun)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !dryRun {
+		log.Printf("[API] %s: collected %d orphaned and %d duplicate images", d.Name, len(report.Orphans), len(report.Duplicates))
+		s.Audit.Record(actor(r), d.Name, "assets.gc", minAge.String(), nil, report)
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+func (s *Server) listRecordings(w http.ResponseWriter, r *http.Request, d *Domain) {
+	writeJSON(w, http.StatusOK, d.Recordings.List())
+}
+
+func (s *Server) getRecording(w http.ResponseWriter, r *http.Request, d *Domain) {
+	mac, err := net.ParseMAC(r.PathValue("mac"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	info, ok := d.Recordings.Get(mac.String())
+	if !ok {
+		writeError(w, http.StatusNotFound, recording.ErrNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+// startRecording records a machine for ?duration= (30m by default)
+func (s *Server) startRecording(w http.ResponseWriter, r *http.Request, d *Domain) {
+	mac, err := net.ParseMAC(r.PathValue("mac"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	var dur time.Duration
+	if v := r.URL.Query().Get("duration"); v != "" {
+		if dur, err = time.ParseDuration(v); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("duration: %w", err))
+			return
+		}
+	}
+	info, err := d.Recordings.Start(mac, dur)
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	log.Printf("[API] %s: recording %s until %s", d.Name, mac, info.Until.Format(time.TimeOnly))
+	s.Audit.Record(actor(r), d.Name, "recording.start", mac.String(), nil, info)
+	writeJSON(w, http.StatusCreated, info)
+}
+
+// stopRecording ends a machine's recording early, keeping it for download
+func (s *Server) stopRecording(w http.ResponseWriter, r *http.Request, d *Domain) {
+	mac, err := net.ParseMAC(r.PathValue("mac"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	info, ok := d.Recordings.Stop(mac.String())
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("%s isn't being recorded", mac))
+		return
+	}
+	log.Printf("[API] %s: stopped recording %s", d.Name, mac)
+	s.Audit.Record(actor(r), d.Name, "recording.stop", mac.String(), nil, nil)
+	writeJSON(w, http.StatusOK, info)
+}
+
+// recordingBundle downloads a machine's latest recording as a gzipped tar.
+// It holds the files rendered for the machine, secrets included, so it
+// takes an admin.
+func (s *Server) recordingBundle(w http.ResponseWriter, r *http.Request, d *Domain) {
+	mac, err := net.ParseMAC(r.PathValue("mac"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	info, ok := d.Recordings.Get(mac.String())
+	if !ok {
+		writeError(w, http.StatusNotFound, recording.ErrNotFound)
+		return
+	}
+	name := "gopxe-" + strings.ReplaceAll(info.MAC, ":", "") + ".tar.gz"
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	if err := d.Recordings.Bundle(w, info.MAC); err != nil {
+		log.Printf("[API] %s: bundle of %s: %v", d.Name, mac, err)
+	}
+}
+
+// recentEvents returns the domain's most recent events, newest first, at
+// most ?limit= (default 100)
+func (s *Server) recentEvents(w http.ResponseWriter, r *http.Request, d *Domain) {
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("limit: %w", err))
+			return
+		}
+	}
+	if s.History == nil {
+		writeError(w, http.StatusServiceUnavailable, fmt.Errorf("event history disabled"))
+		return
+	}
+	all := s.History.Events()
+	list := []events.Event{}
+	for i := len(all) - 1; i >= 0 && len(list) < limit; i-- {
+		if all[i].Domain == d.Name {
+			list = append(list, all[i])
+		}
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// queryBoots exports the domain's boot history as JSON, or as CSV with
+// ?format=csv
+func (s *Server) queryBoots(w http.ResponseWriter, r *http.Request, d *Domain) {
+	q := r.URL.Query()
+	f := bootlog.Filter{Domain: d.Name, Host: q.Get("host"), Outcome: q.Get("outcome")}
+	var err error
+	if v := q.Get("mac"); v != "" {
+		mac, err := net.ParseMAC(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("mac: %w", err))
+			return
+		}
+		f.MAC = mac.String()
+	}
+	if v := q.Get("since"); v != "" {
+		if f.Since, err = time.Parse(time.RFC3339, v); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("since: %w", err))
+			return
+		}
+	}
+	if v := q.Get("until"); v != "" {
+		if f.Until, err = time.Parse(time.RFC3339, v); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("until: %w", err))
+			return
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if f.Limit, err = strconv.Atoi(v); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("limit: %w", err))
+			return
+		}
+	}
+
+	records, err := s.Boots.Query(f)
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	columns := []column[bootlog.Record]{
+		{"session", func(b bootlog.Record) any { return b.Session }},
+		{"start", func(b bootlog.Record) any { return b.Start }},
+		{"end", func(b bootlog.Record) any { return b.End }},
+		{"domain", func(b bootlog.Record) any { return b.Domain }},
+		{"mac", func(b bootlog.Record) any { return b.MAC }},
+		{"ip", func(b bootlog.Record) any { return b.IP }},
+		{"host", func(b bootlog.Record) any { return b.Host }},
+		{"profile", func(b bootlog.Record) any { return b.Profile }},
+		{"revision", func(b bootlog.Record) any { return b.Revision }},
+		{"stage", func(b bootlog.Record) any { return b.Stage }},
+		{"outcome", func(b bootlog.Record) any { return b.Outcome }},
+		{"panic", func(b bootlog.Record) any { return b.Panic }},
+		{"installed", func(b bootlog.Record) any { return b.Installed }},
+		{"files", func(b bootlog.Record) any {
+			files := []string{}
+			for _, f := range b.Files {
+				files = append(files, f.Path)
+			}
+			return files
+		}},
+		{"omitted", func(b bootlog.Record) any { return b.Omitted }},
+	}
+	export(w, r, "boots-"+d.Name, records, columns,
+		[]string{"session", "start", "end", "mac", "ip", "host", "profile", "revision", "stage", "outcome", "files"})
+}
+
+// bootReport summarizes the domain's boot history between ?since and
+// ?until, listing the ?top failing hosts and served files (default 10)
+func (s *Server) bootReport(w http.ResponseWriter, r *http.Request, d *Domain) {
+	q := r.URL.Query()
+	f := bootlog.Filter{Domain: d.Name}
+	top := 10
+	var err error
+	if v := q.Get("since"); v != "" {
+		if f.Since, err = time.Parse(time.RFC3339, v); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("since: %w", err))
+			return
+		}
+	}
+	if v := q.Get("until"); v != "" {
+		if f.Until, err = time.Parse(time.RFC3339, v); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("until: %w", err))
+			return
+		}
+	}
+	if v := q.Get("top"); v != "" {
+		if top, err = strconv.Atoi(v); err != nil || top < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("top: want a count, got %q", v))
+			return
+		}
+	}
+
+	records, err := s.Boots.Query(f)
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	rep := bootlog.Summarize(records, top)
+	rep.Since, rep.Until = f.Since, f.Until
+	writeJSON(w, http.StatusOK, rep)
+}
+
+func (s *Server) queryAudit(w http.ResponseWriter, r *http.Request, d *Domain) {
+	q := r.URL.Query()
+	f := audit.Filter{Domain: d.Name, Actor: q.Get("actor"), Action: q.Get("action")}
+	var err error
+	if v := q.Get("since"); v != "" {
+		if f.Since, err = time.Parse(time.RFC3339, v); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("since: %w", err))
+			return
+		}
+	}
+	if v := q.Get("until"); v != "" {
+		if f.Until, err = time.Parse(time.RFC3339, v); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("until: %w", err))
+			return
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if f.Limit, err = strconv.Atoi(v); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("limit: %w", err))
+			return
+		}
+	}
+
+	entries, err := s.Audit.Query(f)
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// actor names the caller for the audit log
+func actor(r *http.Request) string {
+	if u := UserFrom(r.Context()); u != nil {
+		return u.Name
+	}
+	return "anonymous@" + r.RemoteAddr
+}
+
+// orNil returns v if ok, else an untyped nil so the audit entry has no side
+func orNil[T any](v T, ok bool) any {
+	if !ok {
+		return nil
+	}
+	return v
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
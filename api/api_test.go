@@ -0,0 +1,66 @@
+package api
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/ars1364/go-pxe/audit"
+	"github.com/ars1364/go-pxe/pki"
+)
+
+func TestExportCA(t *testing.T) {
+	ca, err := pki.LoadCA(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	trail, err := audit.Open(filepath.Join(t.TempDir(), "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := &Auth{Users: []*User{
+		{Name: "root", Role: Admin, tokenHash: sha256.Sum256([]byte("root"))},
+		{Name: "qa-admin", Role: Admin, Domains: []string{"qa"}, tokenHash: sha256.Sum256([]byte("qa-admin"))},
+		{Name: "viewer", Role: Viewer, tokenHash: sha256.Sum256([]byte("viewer"))},
+	}}
+	s := NewServer([]*Domain{{Name: "qa"}, {Name: "prod"}}, auth)
+	s.CA, s.Audit = ca, trail
+
+	tests := []struct {
+		token  string
+		path   string
+		status int
+	}{
+		{"root", "/api/v1/ca/bundle", http.StatusOK},
+		{"qa-admin", "/api/v1/ca/bundle", http.StatusForbidden},
+		{"viewer", "/api/v1/ca/bundle", http.StatusForbidden},
+		{"", "/api/v1/ca/bundle", http.StatusUnauthorized},
+		{"qa-admin", "/api/v1/ca", http.StatusOK},
+		{"qa-admin", "/api/v1/domains", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.token+" "+tt.path, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Errorf("status %d, want %d (%s)", rec.Code, tt.status, rec.Body)
+			}
+		})
+	}
+
+	for _, domain := range []string{"qa", "prod"} {
+		entries, err := trail.Query(audit.Filter{Domain: domain, Action: "ca.export"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 || entries[0].Actor != "root" {
+			t.Errorf("%s audit trail has %v, want one export by root", domain, entries)
+		}
+	}
+}
@@ -0,0 +1,350 @@
+package api
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ars1364/go-pxe/ldap"
+	"github.com/ars1364/go-pxe/oidc"
+	"gopkg.in/yaml.v3"
+)
+
+// Role grants a set of API operations. Each role includes the ones below it.
+type Role int
+
+const (
+	Viewer   Role = iota + 1 // read hosts, profiles, leases
+	Operator                 // + revoke leases
+	Admin                    // + change hosts and boot profiles
+)
+
+func (r Role) String() string {
+	switch r {
+	case Viewer:
+		return "viewer"
+	case Operator:
+		return "operator"
+	case Admin:
+		return "admin"
+	}
+	return fmt.Sprintf("role(%d)", int(r))
+}
+
+func parseRole(s string) (Role, error) {
+	switch strings.ToLower(s) {
+	case "viewer":
+		return Viewer, nil
+	case "operator":
+		return Operator, nil
+	case "admin":
+		return Admin, nil
+	}
+	return 0, fmt.Errorf("unknown role %q (want viewer, operator or admin)", s)
+}
+
+// User is an API identity authenticated by a static bearer token, or by
+// an OIDC token or LDAP login with a role from its groups
+type User struct {
+	Name    string
+	Role    Role
+	Domains []string // domains the user may access; empty means all
+
+	tokenHash [sha256.Size]byte
+}
+
+// CanAccess reports whether u may operate on domain
+func (u *User) CanAccess(domain string) bool {
+	return len(u.Domains) == 0 || slices.Contains(u.Domains, domain)
+}
+
+// GroupRole grants a role to the members of a directory or OIDC group
+type GroupRole struct {
+	Group   string // group name, or for LDAP also its DN
+	Role    Role
+	Domains []string // empty means all
+}
+
+// Auth says who may use the API: users with static tokens, and users of an
+// OIDC provider or LDAP directory whose groups map to roles
+type Auth struct {
+	Users  []*User
+	Groups []GroupRole
+
+	OIDC          *oidc.Verifier
+	UsernameClaim string // "preferred_username" by default, falling back to "sub"
+	GroupsClaim   string // "groups" by default; dots reach nested claims
+
+	LDAP *ldap.Directory
+
+	mu     sync.Mutex
+	logins map[[sha256.Size]byte]login // recent LDAP logins
+}
+
+// login is a cached LDAP login, so API clients sending basic auth on every
+// request don't bind to the directory each time
+type login struct {
+	groups  []string
+	expires time.Time
+}
+
+const loginTTL = time.Minute
+
+// LoadAuth reads API users and identity providers from a YAML file:
+//
+//	users:
+//	  - name: alice
+//	    role: admin
+//	    token: <secret>            # or tokenSHA256: <hex digest>
+//	    domains: [qa]              # optional, default all
+//	oidc:                          # accept bearer tokens from a provider
+//	  issuer: https://sso.example.com/realms/ops
+//	  audience: go-pxe
+//	ldap:                          # accept basic auth checked by a directory
+//	  url: ldaps://ldap.example.com
+//	  userDN: uid={username},ou=people,dc=example,dc=com
+//	groups:                        # roles of provider users by group
+//	  - group: pxe-admins
+//	    role: admin
+//	    domains: [qa]              # optional, default all
+func LoadAuth(file string) (*Auth, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var doc struct {
+		Users []struct {
+			Name        string   `yaml:"name"`
+			Role        string   `yaml:"role"`
+			Token       string   `yaml:"token"`
+			TokenSHA256 string   `yaml:"tokenSHA256"`
+			Domains     []string `yaml:"domains"`
+		} `yaml:"users"`
+		OIDC *struct {
+			Issuer        string `yaml:"issuer"`
+			Audience      string `yaml:"audience"`
+			UsernameClaim string `yaml:"usernameClaim"`
+			GroupsClaim   string `yaml:"groupsClaim"`
+		} `yaml:"oidc"`
+		LDAP *struct {
+			URL             string `yaml:"url"`
+			Insecure        bool   `yaml:"insecure"`
+			UserDN          string `yaml:"userDN"`
+			BindDN          string `yaml:"bindDN"`
+			BindPassword    string `yaml:"bindPassword"`
+			BindPasswordEnv string `yaml:"bindPasswordEnv"`
+			BaseDN          string `yaml:"baseDN"`
+			UserAttr        string `yaml:"userAttr"`
+			GroupAttr       string `yaml:"groupAttr"`
+		} `yaml:"ldap"`
+		Groups []struct {
+			Group   string   `yaml:"group"`
+			Role    string   `yaml:"role"`
+			Domains []string `yaml:"domains"`
+		} `yaml:"groups"`
+	}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+
+	auth := &Auth{Users: []*User{}, logins: make(map[[sha256.Size]byte]login)}
+	for _, u := range doc.Users {
+		role, err := parseRole(u.Role)
+		if err != nil {
+			return nil, fmt.Errorf("%s: user %s: %w", file, u.Name, err)
+		}
+		user := &User{Name: u.Name, Role: role, Domains: u.Domains}
+		switch {
+		case u.TokenSHA256 != "":
+			sum, err := hex.DecodeString(u.TokenSHA256)
+			if err != nil || len(sum) != sha256.Size {
+				return nil, fmt.Errorf("%s: user %s: invalid tokenSHA256", file, u.Name)
+			}
+			copy(user.tokenHash[:], sum)
+		case u.Token != "":
+			user.tokenHash = sha256.Sum256([]byte(u.Token))
+		default:
+			return nil, fmt.Errorf("%s: user %s has no token", file, u.Name)
+		}
+		auth.Users = append(auth.Users, user)
+	}
+
+	if o := doc.OIDC; o != nil {
+		if o.Issuer == "" {
+			return nil, fmt.Errorf("%s: oidc: issuer is required", file)
+		}
+		auth.OIDC = oidc.NewVerifier(o.Issuer, o.Audience)
+		auth.UsernameClaim, auth.GroupsClaim = o.UsernameClaim, o.GroupsClaim
+	}
+	if l := doc.LDAP; l != nil {
+		if l.URL == "" || (l.UserDN == "" && l.BaseDN == "") {
+			return nil, fmt.Errorf("%s: ldap: url and userDN or baseDN are required", file)
+		}
+		auth.LDAP = &ldap.Directory{URL: l.URL, Insecure: l.Insecure, UserDN: l.UserDN,
+			BindDN: l.BindDN, BindPassword: l.BindPassword, BaseDN: l.BaseDN,
+			UserAttr: l.UserAttr, GroupAttr: l.GroupAttr}
+		if l.BindPasswordEnv != "" {
+			auth.LDAP.BindPassword = os.Getenv(l.BindPasswordEnv)
+		}
+	}
+	for _, g := range doc.Groups {
+		role, err := parseRole(g.Role)
+		if err != nil {
+			return nil, fmt.Errorf("%s: group %s: %w", file, g.Group, err)
+		}
+		auth.Groups = append(auth.Groups, GroupRole{Group: g.Group, Role: role, Domains: g.Domains})
+	}
+	if len(auth.Groups) > 0 && auth.OIDC == nil && auth.LDAP == nil {
+		return nil, fmt.Errorf("%s: groups need an oidc or ldap provider", file)
+	}
+	return auth, nil
+}
+
+// groupUser builds the user for a provider login. Its role is the highest
+// any of its groups grants on domain; with no domain, as on routes that act
+// on every domain, only groups not limited to some domains count. Domains
+// lists every domain a group grants.
+func (a *Auth) groupUser(name string, groups []string, domain string) *User {
+	u := &User{Name: name}
+	all := false
+	for _, g := range a.Groups {
+		if !slices.ContainsFunc(groups, func(s string) bool { return strings.EqualFold(s, g.Group) }) {
+			continue
+		}
+		if len(g.Domains) == 0 {
+			all = true
+		}
+		u.Domains = append(u.Domains, g.Domains...)
+		if g.Role > u.Role && (len(g.Domains) == 0 || domain != "" && slices.Contains(g.Domains, domain)) {
+			u.Role = g.Role
+		}
+	}
+	if all {
+		u.Domains = nil
+	} else if len(u.Domains) == 0 {
+		// No group matched; a nil list would mean every domain
+		u.Domains = []string{}
+	}
+	return u
+}
+
+// tokenUser verifies an OIDC bearer token
+func (a *Auth) tokenUser(token, domain string) *User {
+	claims, err := a.OIDC.Verify(token)
+	if err != nil {
+		log.Printf("[API] Rejected OIDC token: %v", err)
+		return nil
+	}
+	name := claims.String(cmp.Or(a.UsernameClaim, "preferred_username"))
+	if name == "" {
+		name = claims.String("sub")
+	}
+	return a.groupUser(name, claims.Strings(cmp.Or(a.GroupsClaim, "groups")), domain)
+}
+
+// basicUser checks a user name and password against the LDAP directory
+func (a *Auth) basicUser(username, password, domain string) *User {
+	key := sha256.Sum256([]byte(username + "\x00" + password))
+	a.mu.Lock()
+	l, ok := a.logins[key]
+	a.mu.Unlock()
+	if !ok || time.Now().After(l.expires) {
+		groups, err := a.LDAP.Authenticate(username, password)
+		if err != nil {
+			if !errors.Is(err, ldap.ErrInvalidCredentials) {
+				log.Printf("[API] LDAP login of %s failed: %v", username, err)
+			}
+			return nil
+		}
+		l = login{groups: groups, expires: time.Now().Add(loginTTL)}
+		a.mu.Lock()
+		for k, old := range a.logins {
+			if time.Now().After(old.expires) {
+				delete(a.logins, k)
+			}
+		}
+		a.logins[key] = l
+		a.mu.Unlock()
+	}
+	return a.groupUser(username, l.groups, domain)
+}
+
+type userKey struct{}
+
+// UserFrom returns the authenticated user of a request, or nil when the API
+// runs without authentication
+func UserFrom(ctx context.Context) *User {
+	u, _ := ctx.Value(userKey{}).(*User)
+	return u
+}
+
+// authenticate matches the request's bearer token against the known users,
+// then tries the identity providers
+func (s *Server) authenticate(r *http.Request) *User {
+	a := s.auth
+	if username, password, ok := r.BasicAuth(); ok && a.LDAP != nil {
+		return a.basicUser(username, password, r.PathValue("domain"))
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return nil
+	}
+	token = strings.TrimSpace(token)
+	sum := sha256.Sum256([]byte(token))
+	for _, u := range a.Users {
+		if subtle.ConstantTimeCompare(sum[:], u.tokenHash[:]) == 1 {
+			return u
+		}
+	}
+	if a.OIDC != nil && oidc.LooksLikeJWT(token) {
+		return a.tokenUser(token, r.PathValue("domain"))
+	}
+	return nil
+}
+
+// require wraps h so it only runs for users holding at least role, and, for
+// domain-scoped routes, with access to the requested domain. Routes outside
+// any domain, such as the CA export, reach every domain, so beyond reading
+// they take a user not limited to some domains.
+func (s *Server) require(role Role, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.auth == nil {
+			h(w, r)
+			return
+		}
+		u := s.authenticate(r)
+		if u == nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="go-pxe"`)
+			if s.auth.LDAP != nil {
+				w.Header().Add("WWW-Authenticate", `Basic realm="go-pxe"`)
+			}
+			writeError(w, http.StatusUnauthorized, fmt.Errorf("missing or invalid credentials"))
+			return
+		}
+		d := r.PathValue("domain")
+		if d != "" && !u.CanAccess(d) {
+			writeError(w, http.StatusForbidden, fmt.Errorf("no access to domain %q", d))
+			return
+		}
+		if d == "" && role > Viewer && len(u.Domains) > 0 {
+			writeError(w, http.StatusForbidden, fmt.Errorf("%s role on every domain required", role))
+			return
+		}
+		if u.Role < role {
+			writeError(w, http.StatusForbidden, fmt.Errorf("%s role required", role))
+			return
+		}
+		h(w, r.WithContext(context.WithValue(r.Context(), userKey{}, u)))
+	}
+}
@@ -0,0 +1,40 @@
+package api
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestGroupUser(t *testing.T) {
+	a := &Auth{Groups: []GroupRole{
+		{Group: "pxe-viewers", Role: Viewer},
+		{Group: "qa-admins", Role: Admin, Domains: []string{"qa"}},
+		{Group: "ops", Role: Operator, Domains: []string{"qa", "prod"}},
+	}}
+	tests := []struct {
+		name    string
+		groups  []string
+		domain  string
+		role    Role
+		domains []string // nil for every domain
+	}{
+		{"domain admin in its domain", []string{"QA-Admins"}, "qa", Admin, []string{"qa"}},
+		{"domain admin elsewhere", []string{"qa-admins"}, "prod", 0, []string{"qa"}},
+		{"domain admin outside domains", []string{"qa-admins"}, "", 0, []string{"qa"}},
+		{"domain admin and viewer outside domains", []string{"qa-admins", "pxe-viewers"}, "", Viewer, nil},
+		{"domain admin and viewer in its domain", []string{"qa-admins", "pxe-viewers"}, "qa", Admin, nil},
+		{"operator of two domains", []string{"ops"}, "prod", Operator, []string{"qa", "prod"}},
+		{"no mapped group", []string{"staff"}, "qa", 0, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := a.groupUser("alice", tt.groups, tt.domain)
+			if u.Role != tt.role {
+				t.Errorf("role %s, want %s", u.Role, tt.role)
+			}
+			if (u.Domains == nil) != (tt.domains == nil) || !slices.Equal(u.Domains, tt.domains) {
+				t.Errorf("domains %q, want %q", u.Domains, tt.domains)
+			}
+		})
+	}
+}
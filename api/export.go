@@ -0,0 +1,98 @@
+package api
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// column is one field of an exported table
+type column[T any] struct {
+	name  string
+	value func(T) any
+}
+
+// export writes rows as JSON, or as CSV with ?format=csv, named name.csv.
+// ?columns= picks the columns, comma-separated, in that order; without it
+// CSV has defaults and JSON the rows as they are. Times are RFC 3339 and
+// lists are space-separated in CSV.
+func export[T any](w http.ResponseWriter, r *http.Request, name string, rows []T, columns []column[T], defaults []string) {
+	q := r.URL.Query()
+	format := q.Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("format must be json or csv"))
+		return
+	}
+	names := defaults
+	if v := q.Get("columns"); v != "" {
+		names = strings.Split(v, ",")
+	}
+	var picked []column[T]
+	for _, n := range names {
+		i := slices.IndexFunc(columns, func(c column[T]) bool { return c.name == strings.TrimSpace(n) })
+		if i < 0 {
+			var all []string
+			for _, c := range columns {
+				all = append(all, c.name)
+			}
+			writeError(w, http.StatusBadRequest, fmt.Errorf("unknown column %q, want some of %s", n, strings.Join(all, ",")))
+			return
+		}
+		picked = append(picked, columns[i])
+	}
+
+	if format != "csv" {
+		if q.Get("columns") == "" {
+			writeJSON(w, http.StatusOK, rows)
+			return
+		}
+		out := make([]map[string]any, 0, len(rows))
+		for _, row := range rows {
+			m := make(map[string]any, len(picked))
+			for _, c := range picked {
+				m[c.name] = c.value(row)
+			}
+			out = append(out, m)
+		}
+		writeJSON(w, http.StatusOK, out)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".csv"))
+	cw := csv.NewWriter(w)
+	header := make([]string, len(picked))
+	for i, c := range picked {
+		header[i] = c.name
+	}
+	cw.Write(header)
+	for _, row := range rows {
+		record := make([]string, len(picked))
+		for i, c := range picked {
+			record[i] = csvValue(c.value(row))
+		}
+		cw.Write(record)
+	}
+	cw.Flush()
+}
+
+// csvValue formats one field for CSV
+func csvValue(v any) string {
+	switch v := v.(type) {
+	case time.Time:
+		if v.IsZero() {
+			return ""
+		}
+		return v.Format(time.RFC3339)
+	case []string:
+		return strings.Join(v, " ")
+	case int:
+		if v == 0 {
+			return ""
+		}
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,79 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type exportRow struct {
+	MAC     string    `json:"mac"`
+	Seen    time.Time `json:"seen"`
+	Initrd  []string  `json:"initrd"`
+	Retries int       `json:"retries"`
+}
+
+var (
+	exportRows = []exportRow{
+		{MAC: "52:54:00:00:00:01", Seen: time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC), Initrd: []string{"a.img", "b.img"}, Retries: 2},
+		{MAC: "52:54:00:00:00:02, \"quoted\""},
+	}
+	exportColumns = []column[exportRow]{
+		{"mac", func(r exportRow) any { return r.MAC }},
+		{"seen", func(r exportRow) any { return r.Seen }},
+		{"initrd", func(r exportRow) any { return r.Initrd }},
+		{"retries", func(r exportRow) any { return r.Retries }},
+	}
+)
+
+func exportQuery(query string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	export(w, httptest.NewRequest("GET", "/leases?"+query, nil), "rows", exportRows, exportColumns, []string{"mac", "seen"})
+	return w
+}
+
+func TestExportCSV(t *testing.T) {
+	tests := []struct {
+		query, want string
+	}{
+		{"format=csv", "mac,seen\n52:54:00:00:00:01,2026-05-01T12:00:00Z\n\"52:54:00:00:00:02, \"\"quoted\"\"\",\n"},
+		{"format=csv&columns=retries,%20initrd", "retries,initrd\n2,a.img b.img\n,\n"},
+	}
+	for _, tt := range tests {
+		w := exportQuery(tt.query)
+		if w.Code != http.StatusOK || w.Body.String() != tt.want {
+			t.Errorf("%s = %d\n%s\nwant\n%s", tt.query, w.Code, w.Body, tt.want)
+		}
+		if w.Header().Get("Content-Type") != "text/csv" || w.Header().Get("Content-Disposition") != `attachment; filename="rows.csv"` {
+			t.Errorf("%s headers %v", tt.query, w.Header())
+		}
+	}
+}
+
+func TestExportJSON(t *testing.T) {
+	var rows []exportRow
+	if w := exportQuery(""); json.Unmarshal(w.Body.Bytes(), &rows) != nil || len(rows) != 2 || rows[0].Retries != 2 {
+		t.Errorf("JSON = %s", w.Body)
+	}
+
+	var picked []map[string]any
+	w := exportQuery("format=json&columns=mac,retries")
+	if err := json.Unmarshal(w.Body.Bytes(), &picked); err != nil || len(picked) != 2 || len(picked[0]) != 2 || picked[0]["retries"] != 2.0 {
+		t.Errorf("picked columns = %s", w.Body)
+	}
+}
+
+func TestExportBadQuery(t *testing.T) {
+	for query, want := range map[string]string{
+		"format=xml":            "format must be json or csv",
+		"format=csv&columns=ip": `unknown column \"ip\", want some of mac,seen,initrd,retries`,
+		"columns=mac,,retries":  `unknown column \"\"`,
+	} {
+		if w := exportQuery(query); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), want) {
+			t.Errorf("%s = %d %s", query, w.Code, w.Body)
+		}
+	}
+}
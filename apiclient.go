@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// apiClient talks to one domain of a running server's management API
+type apiClient struct {
+	base   string
+	token  string
+	client *http.Client
+}
+
+func newAPIClient(apiURL, domain, token string, timeout time.Duration) *apiClient {
+	return &apiClient{
+		base:   strings.TrimSuffix(apiURL, "/") + "/api/v1/domains/" + domain,
+		token:  token,
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+func (c *apiClient) get(path string, v any) error {
+	return c.do("GET", path, v)
+}
+
+func (c *apiClient) post(path string, v any) error {
+	return c.do("POST", path, v)
+}
+
+// do sends a bodiless request and decodes the JSON answer into v, if any
+func (c *apiClient) do(method, path string, v any) error {
+	resp, err := c.send(method, path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if v == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// download copies the answer to a GET of path, such as an archive, to w
+func (c *apiClient) download(path string, w io.Writer) error {
+	resp, err := c.send("GET", path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// send sends a bodiless request, and fails unless it succeeds
+func (c *apiClient) send(method, path string) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.base+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		var e struct{ Error string }
+		json.NewDecoder(resp.Body).Decode(&e)
+		return nil, fmt.Errorf("%s: %s %s", path, resp.Status, e.Error)
+	}
+	return resp, nil
+}
@@ -0,0 +1,240 @@
+// Package assets keeps track of the boot roots' contents: it catalogs how
+// the files go-pxe downloaded were verified, removes the kernels, initrds
+// and disk images nothing references any more, and hard-links identical
+// copies of those still in use together.
+package assets
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// imageExts and imagePrefixes tell boot images from the rest of a root:
+// bootloaders, their configurations, templates and scripts are never
+// collected
+var (
+	imageExts     = []string{".iso", ".img", ".squashfs", ".wim", ".qcow2", ".raw", ".kernel", ".initramfs", ".cpio", ".cap"}
+	imagePrefixes = []string{"vmlinuz", "vmlinux", "bzImage", "Image", "initrd", "initramfs"}
+)
+
+// IsImage reports whether name is a boot image by its name
+func IsImage(name string) bool {
+	base := path.Base(name)
+	if slices.Contains(imageExts, strings.ToLower(path.Ext(base))) {
+		return true
+	}
+	for _, p := range imagePrefixes {
+		if strings.HasPrefix(base, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Options say what a collection may touch
+type Options struct {
+	// Roots are the directories served, such as the TFTP and HTTP roots
+	Roots []string
+
+	// Files and Dirs are referenced paths, relative to any root and
+	// cleaned, as by inventory.Profile.Files; images under a referenced
+	// directory are kept too
+	Files, Dirs []string
+
+	// Skip are directories never looked into, such as a root's oci/ or
+	// an NBD root inside one
+	Skip []string
+
+	// MinAge spares images modified more recently, such as one copied in
+	// before the profile naming it
+	MinAge time.Duration
+
+	// DryRun only reports what would be done
+	DryRun bool
+}
+
+// Report is the outcome of a collection
+type Report struct {
+	// Orphans are the images nothing references, removed unless DryRun
+	Orphans []File `json:"orphans"`
+
+	// Duplicates are images identical to another, Of, and linked to it
+	// unless DryRun
+	Duplicates []File `json:"duplicates"`
+
+	// Freed is the space reclaimed, or to be
+	Freed  int64 `json:"freed"`
+	DryRun bool  `json:"dryRun,omitempty"`
+}
+
+// File is an image in a root
+type File struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	Of   string `json:"of,omitempty"`
+
+	info fs.FileInfo
+}
+
+// Collect removes unreferenced images from the roots and links identical
+// ones together
+func Collect(o Options) (Report, error) {
+	r := Report{Orphans: []File{}, Duplicates: []File{}, DryRun: o.DryRun}
+	var kept []File
+	for _, root := range o.Roots {
+		err := filepath.WalkDir(root, func(full string, e fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if e.IsDir() {
+				if full != root && (strings.HasPrefix(e.Name(), ".") || skipped(o.Skip, full)) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			rel, _ := filepath.Rel(root, full)
+			rel = filepath.ToSlash(rel)
+			if !e.Type().IsRegular() || strings.HasPrefix(e.Name(), ".") || !IsImage(rel) {
+				return nil
+			}
+			info, err := e.Info()
+			if err != nil {
+				return err
+			}
+			f := File{Path: full, Size: info.Size(), info: info}
+			if referenced(o, rel) || time.Since(info.ModTime()) < o.MinAge {
+				kept = append(kept, f)
+			} else {
+				r.Orphans = append(r.Orphans, f)
+			}
+			return nil
+		})
+		if err != nil {
+			return r, err
+		}
+	}
+
+	for _, f := range r.Orphans {
+		// Space only comes back with the last link
+		if !slices.ContainsFunc(kept, f.same) {
+			r.Freed += f.Size
+		}
+		if !o.DryRun {
+			if err := os.Remove(f.Path); err != nil {
+				return r, err
+			}
+		}
+	}
+
+	dups, err := duplicates(kept)
+	if err != nil {
+		return r, err
+	}
+	for _, f := range dups {
+		// Copies on different filesystems can't be linked, and stay
+		if !o.DryRun && relink(f.Of, f.Path) != nil {
+			continue
+		}
+		r.Duplicates = append(r.Duplicates, f)
+		r.Freed += f.Size
+	}
+	return r, nil
+}
+
+func (f File) same(g File) bool {
+	return f.Path != g.Path && os.SameFile(f.info, g.info)
+}
+
+// duplicates finds the files with the same contents as an earlier one,
+// which isn't a link to them already
+func duplicates(files []File) ([]File, error) {
+	bySize := make(map[int64][]File)
+	for _, f := range files {
+		if f.Size > 0 {
+			bySize[f.Size] = append(bySize[f.Size], f)
+		}
+	}
+	var dups []File
+	for _, group := range bySize {
+		if len(group) < 2 {
+			continue
+		}
+		first := make(map[string]File)
+		for _, f := range group {
+			sum, err := hash(f.Path)
+			if err != nil {
+				return nil, err
+			}
+			orig, ok := first[sum]
+			switch {
+			case !ok:
+				first[sum] = f
+			case !os.SameFile(orig.info, f.info):
+				f.Of = orig.Path
+				dups = append(dups, f)
+			}
+		}
+	}
+	slices.SortFunc(dups, func(a, b File) int { return strings.Compare(a.Path, b.Path) })
+	return dups, nil
+}
+
+func hash(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// relink replaces dst with a hard link to src, atomically
+func relink(src, dst string) error {
+	tmp := filepath.Join(filepath.Dir(dst), ".gc-"+filepath.Base(dst))
+	os.Remove(tmp)
+	if err := os.Link(src, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func referenced(o Options, rel string) bool {
+	if slices.Contains(o.Files, rel) {
+		return true
+	}
+	for _, d := range o.Dirs {
+		if d == "" || strings.HasPrefix(rel, d+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func skipped(skip []string, dir string) bool {
+	dir, _ = filepath.Abs(dir)
+	for _, s := range skip {
+		if s == "" {
+			continue
+		}
+		if s, _ := filepath.Abs(s); s == dir {
+			return true
+		}
+	}
+	return false
+}
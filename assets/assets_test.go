@@ -0,0 +1,151 @@
+package assets
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// tree writes files, relative to dir, with the given contents
+func tree(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, data := range files {
+		full := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(full, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func exists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
+
+func TestIsImage(t *testing.T) {
+	for name, want := range map[string]bool{
+		"alma/vmlinuz":             true,
+		"alma/initrd.img":          true,
+		"win/boot.WIM":             true,
+		"live/filesystem.squashfs": true,
+		"pxelinux.0":               false,
+		"pxelinux.cfg/default":     false,
+		"ks.cfg.tmpl":              false,
+		"ipxe.efi":                 false,
+		"images/x/initramfs":       true,
+	} {
+		if got := IsImage(name); got != want {
+			t.Errorf("IsImage(%q) = %v", name, got)
+		}
+	}
+}
+
+func TestCollect(t *testing.T) {
+	root := t.TempDir()
+	tree(t, root, map[string]string{
+		"pxelinux.0":            "loader",
+		"alma/vmlinuz":          "alma kernel",
+		"alma/initrd.img":       "alma initrd",
+		"old/vmlinuz":           "old kernel",
+		"old/initrd.img":        "old initrd!",
+		"ubuntu/casper/vmlinuz": "alma kernel", // a copy
+		"ubuntu/casper/initrd":  "ubuntu initrd",
+		".hidden/vmlinuz":       "hidden",
+		"oci/x/vmlinuz":         "oci",
+	})
+	o := Options{
+		Roots:  []string{root},
+		Files:  []string{"alma/vmlinuz", "alma/initrd.img"},
+		Dirs:   []string{"ubuntu"},
+		Skip:   []string{filepath.Join(root, "oci")},
+		DryRun: true,
+	}
+
+	r, err := Collect(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Orphans) != 2 || r.Orphans[0].Path != filepath.Join(root, "old/initrd.img") || r.Orphans[1].Path != filepath.Join(root, "old/vmlinuz") {
+		t.Errorf("orphans = %+v", r.Orphans)
+	}
+	if len(r.Duplicates) != 1 || r.Duplicates[0].Size != int64(len("alma kernel")) {
+		t.Errorf("duplicates = %+v", r.Duplicates)
+	}
+	if r.Freed != int64(len("old kernel")+len("old initrd!")+len("alma kernel")) || !r.DryRun {
+		t.Errorf("report = %+v", r)
+	}
+	if !exists(filepath.Join(root, "old/vmlinuz")) {
+		t.Fatal("dry run removed an orphan")
+	}
+
+	o.DryRun = false
+	if r, err = Collect(o); err != nil {
+		t.Fatal(err)
+	}
+	if exists(filepath.Join(root, "old/vmlinuz")) || exists(filepath.Join(root, "old/initrd.img")) {
+		t.Error("orphans kept")
+	}
+	for _, name := range []string{"pxelinux.0", "alma/initrd.img", "ubuntu/casper/initrd", ".hidden/vmlinuz", "oci/x/vmlinuz"} {
+		if !exists(filepath.Join(root, name)) {
+			t.Errorf("%s removed", name)
+		}
+	}
+	a, _ := os.Stat(filepath.Join(root, "alma/vmlinuz"))
+	b, _ := os.Stat(filepath.Join(root, "ubuntu/casper/vmlinuz"))
+	if !os.SameFile(a, b) {
+		t.Error("copies not linked")
+	}
+
+	// Linked already, nothing left to do
+	if r, err = Collect(o); err != nil || len(r.Orphans) != 0 || len(r.Duplicates) != 0 || r.Freed != 0 {
+		t.Errorf("second collection = %+v, %v", r, err)
+	}
+}
+
+func TestCollectLinkedOrphan(t *testing.T) {
+	root := t.TempDir()
+	tree(t, root, map[string]string{"new/vmlinuz": "kernel"})
+	os.MkdirAll(filepath.Join(root, "old"), 0755)
+	os.Link(filepath.Join(root, "new/vmlinuz"), filepath.Join(root, "old/vmlinuz"))
+
+	r, err := Collect(Options{Roots: []string{root}, Files: []string{"new/vmlinuz"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Removing a second link frees nothing
+	if len(r.Orphans) != 1 || r.Freed != 0 {
+		t.Errorf("report = %+v", r)
+	}
+}
+
+func TestCollectMinAge(t *testing.T) {
+	root := t.TempDir()
+	tree(t, root, map[string]string{"new/vmlinuz": "new", "old/vmlinuz": "old"})
+	past := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(filepath.Join(root, "old/vmlinuz"), past, past)
+
+	r, err := Collect(Options{Roots: []string{root}, MinAge: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Orphans) != 1 || r.Orphans[0].Path != filepath.Join(root, "old/vmlinuz") || !exists(filepath.Join(root, "new/vmlinuz")) {
+		t.Errorf("orphans = %+v", r.Orphans)
+	}
+}
+
+func TestCollectMissingRoot(t *testing.T) {
+	if _, err := Collect(Options{Roots: []string{filepath.Join(t.TempDir(), "missing")}}); err == nil {
+		t.Error("missing root accepted")
+	}
+}
+
+func sha(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
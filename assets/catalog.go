@@ -0,0 +1,93 @@
+package assets
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/ars1364/go-pxe/fetch"
+)
+
+// Entry is a downloaded file and how it was verified
+type Entry struct {
+	Path string `json:"path"`
+	fetch.Verification
+}
+
+// Catalog records the verification of the files go-pxe downloads into the
+// roots, in a JSON file if it has one
+type Catalog struct {
+	file string
+
+	mu      sync.Mutex
+	entries map[string]Entry // by absolute path
+}
+
+// OpenCatalog loads the catalog kept in file, or starts it; with no file
+// it is only kept in memory
+func OpenCatalog(file string) (*Catalog, error) {
+	c := &Catalog{file: file, entries: make(map[string]Entry)}
+	if file == "" {
+		return c, nil
+	}
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []Entry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		c.entries[e.Path] = e
+	}
+	return c, nil
+}
+
+// Record notes that dest was downloaded and verified as v
+func (c *Catalog) Record(dest string, v fetch.Verification) {
+	dest, _ = filepath.Abs(dest)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[dest] = Entry{Path: dest, Verification: v}
+	c.save()
+}
+
+// Lookup returns how the file at path, of size, was downloaded, unless it
+// was replaced since
+func (c *Catalog) Lookup(path string, size int64) (fetch.Verification, bool) {
+	if c == nil {
+		return fetch.Verification{}, false
+	}
+	path, _ = filepath.Abs(path)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[path]
+	if !ok || e.Size != size {
+		return fetch.Verification{}, false
+	}
+	return e.Verification, true
+}
+
+// save writes the catalog out, atomically; c.mu is held
+func (c *Catalog) save() {
+	if c.file == "" {
+		return
+	}
+	entries := make([]Entry, 0, len(c.entries))
+	for _, e := range c.entries {
+		entries = append(entries, e)
+	}
+	slices.SortFunc(entries, func(a, b Entry) int { return strings.Compare(a.Path, b.Path) })
+	data, _ := json.MarshalIndent(entries, "", "  ")
+	tmp := c.file + ".tmp"
+	if os.WriteFile(tmp, data, 0o644) == nil {
+		os.Rename(tmp, c.file)
+	}
+}
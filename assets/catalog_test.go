@@ -0,0 +1,66 @@
+package assets
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ars1364/go-pxe/fetch"
+)
+
+func TestCatalog(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "catalog.json")
+	c, err := OpenCatalog(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := fetch.Verification{URL: "http://mirror/vmlinuz", Size: 6, SHA256: "abc", Level: fetch.Checksum}
+	dest := filepath.Join(dir, "alma", "vmlinuz")
+	c.Record(dest, v)
+
+	// Reopened from the file, and relative paths resolved
+	c, err = OpenCatalog(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := c.Lookup(dest, 6); !ok || got.URL != v.URL || got.Level != fetch.Checksum {
+		t.Errorf("Lookup = %+v, %v", got, ok)
+	}
+	if _, ok := c.Lookup(dest, 7); ok {
+		t.Error("a replaced file is still cataloged")
+	}
+	if _, ok := c.Lookup(filepath.Join(dir, "other"), 6); ok {
+		t.Error("found an uncataloged file")
+	}
+	if left, _ := filepath.Glob(filepath.Join(dir, "*.tmp")); len(left) != 0 {
+		t.Errorf("left %v", left)
+	}
+
+	var none *Catalog
+	if _, ok := none.Lookup(dest, 6); ok {
+		t.Error("nil catalog found a file")
+	}
+}
+
+func TestOpenCatalog(t *testing.T) {
+	c, err := OpenCatalog("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Record("vmlinuz", fetch.Verification{Size: 1})
+	if _, ok := c.Lookup("vmlinuz", 1); !ok {
+		t.Error("in-memory catalog lost a record")
+	}
+
+	file := filepath.Join(t.TempDir(), "catalog.json")
+	if _, err := OpenCatalog(file); err != nil {
+		t.Errorf("missing file: %v", err)
+	}
+	for _, data := range []string{"", "{", `{"path": "x"}`, `[{"size": "big"}]`} {
+		os.WriteFile(file, []byte(data), 0644)
+		if _, err := OpenCatalog(file); err == nil {
+			t.Errorf("%q accepted", data)
+		}
+	}
+}
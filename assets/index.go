@@ -0,0 +1,347 @@
+package assets
+
+import (
+	"cmp"
+	"errors"
+	"io/fs"
+	"log"
+	"net/http"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ars1364/go-pxe/events"
+	"github.com/ars1364/go-pxe/fetch"
+)
+
+// Item is a file in a root, or one a profile names that is missing
+type Item struct {
+	// Root is "tftp", "http" or "tftp,http" when both are one directory
+	Root     string    `json:"root,omitempty"`
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	SHA256   string    `json:"sha256,omitempty"`
+	Modified time.Time `json:"modified,omitzero"`
+	Missing  bool      `json:"missing,omitempty"`
+
+	// Source is how the file was downloaded and verified, if go-pxe
+	// downloaded it
+	Source *fetch.Verification `json:"source,omitempty"`
+
+	// Profiles are the profiles booting with the file
+	Profiles []string `json:"profiles"`
+
+	// Served is when the file was last served, since go-pxe started
+	Served time.Time `json:"served,omitzero"`
+
+	full string // absolute path
+}
+
+// Refs are the files and directories each profile boots from, relative
+// to the roots as by inventory.Profile.Files
+type Refs struct {
+	Files, Dirs map[string][]string // profile names by path
+}
+
+// Profiles are the profiles referencing rel
+func (r Refs) Profiles(rel string) []string {
+	names := slices.Clone(r.Files[rel])
+	for dir, profiles := range r.Dirs {
+		if dir == "" || strings.HasPrefix(rel, dir+"/") {
+			names = append(names, profiles...)
+		}
+	}
+	slices.Sort(names)
+	return slices.Compact(names)
+}
+
+// Index lists the roots' contents with what is known of each file. File
+// hashes are kept while the file's size and modification time stay the
+// same, so only new and changed files are read again.
+type Index struct {
+	TFTPRoot, HTTPRoot string
+
+	// Catalog, if set, tells how downloaded files were verified
+	Catalog *Catalog
+
+	mu     sync.Mutex
+	sums   map[string]hashed    // by absolute path
+	served map[string]time.Time // by absolute path
+
+	// The listing walked in the background, once started
+	started  bool
+	files    []Item // without profiles; those found so far until the first walk ends
+	scanned  time.Time
+	scanning bool
+	again    bool // walk again when the one in progress ends
+	err      error
+}
+
+// IndexStatus tells how current an Index's listing is
+type IndexStatus struct {
+	Files    int       `json:"files"`
+	Scanned  time.Time `json:"scanned,omitzero"` // when the last walk ended, zero until the first has
+	Scanning bool      `json:"scanning"`
+	Error    string    `json:"error,omitempty"` // of the last walk
+}
+
+// RescanAfter is how old a listing may be before List has the roots
+// walked again, in the background
+const RescanAfter = time.Minute
+
+type hashed struct {
+	size int64
+	mod  time.Time
+	sum  string
+}
+
+// NewIndex creates an index of the two roots
+func NewIndex(tftpRoot, httpRoot string) *Index {
+	return &Index{TFTPRoot: tftpRoot, HTTPRoot: httpRoot, sums: make(map[string]hashed), served: make(map[string]time.Time)}
+}
+
+// Follow notes the files served, by TFTP or successful HTTP requests, as
+// published on bus
+func (x *Index) Follow(bus *events.Bus) {
+	ch, _ := bus.Subscribe(1024)
+	go func() {
+		for e := range ch {
+			x.Record(e)
+		}
+	}()
+}
+
+// Record notes the file e served, if it served one
+func (x *Index) Record(e events.Event) {
+	var root string
+	switch {
+	case e.Type == events.TFTPComplete:
+		root = x.TFTPRoot
+	case e.Type == events.HTTPRequest && (e.Status == http.StatusOK || e.Status == http.StatusPartialContent):
+		root = x.HTTPRoot
+	default:
+		return
+	}
+	full, _ := filepath.Abs(filepath.Join(root, filepath.FromSlash(path.Clean("/"+e.Path))))
+	x.mu.Lock()
+	x.served[full] = e.Time
+	x.mu.Unlock()
+}
+
+// Start has the roots walked and hashed in the background, for List to
+// answer from at once however many files they hold, such as full
+// mirrors. Until the first walk ends, List returns the files found so
+// far. Without Start, List walks the roots itself.
+func (x *Index) Start() {
+	x.mu.Lock()
+	x.started = true
+	x.mu.Unlock()
+	x.Rescan()
+}
+
+// Rescan walks the roots again in the background, such as after files
+// were removed from them, or once more after the walk in progress
+func (x *Index) Rescan() {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if !x.started {
+		return
+	}
+	if x.scanning {
+		x.again = true
+		return
+	}
+	x.scanning = true
+	go x.scan()
+}
+
+// scan walks the roots until no walk is asked for any more
+func (x *Index) scan() {
+	for {
+		x.mu.Lock()
+		first := x.scanned.IsZero()
+		x.mu.Unlock()
+		start := time.Now()
+		var items []Item
+		err := x.walk(nil, func(it Item) {
+			if first {
+				// Answer from what is found so far
+				x.mu.Lock()
+				x.files = append(x.files, it)
+				x.mu.Unlock()
+				return
+			}
+			items = append(items, it)
+		})
+
+		x.mu.Lock()
+		if err != nil {
+			log.Printf("[ASSETS] Indexing %s and %s: %v", x.TFTPRoot, x.HTTPRoot, err)
+		} else {
+			if !first {
+				x.files = items
+			}
+			if first || time.Since(start) > 10*time.Second {
+				log.Printf("[ASSETS] Indexed %d files in %s and %s in %s", len(x.files), x.TFTPRoot, x.HTTPRoot, time.Since(start).Round(time.Millisecond))
+			}
+		}
+		x.err, x.scanned = err, time.Now()
+		if !x.again {
+			x.scanning = false
+			x.mu.Unlock()
+			return
+		}
+		x.again = false
+		x.mu.Unlock()
+	}
+}
+
+// Status tells how current the listing is
+func (x *Index) Status() IndexStatus {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	st := IndexStatus{Files: len(x.files), Scanned: x.scanned, Scanning: x.scanning}
+	if x.err != nil {
+		st.Error = x.err.Error()
+	}
+	return st
+}
+
+// List returns the files in the roots, skipping hidden ones, and those
+// refs names that are missing. With match, only the paths it accepts are
+// listed and hashed. Once started, it answers from the listing walked in
+// the background, which it has walked again if it is older than
+// RescanAfter, and lists no missing files until the first walk ends.
+func (x *Index) List(refs Refs, match func(rel string) bool) ([]Item, error) {
+	items := []Item{}
+	x.mu.Lock()
+	started := x.started
+	if started {
+		for _, it := range x.files {
+			if match == nil || match(it.Path) || match(strings.TrimSuffix(it.Path, ".tmpl")) {
+				items = append(items, it)
+			}
+		}
+	}
+	stale := started && !x.scanning && time.Since(x.scanned) > RescanAfter
+	partial := started && x.scanned.IsZero()
+	x.mu.Unlock()
+	if stale {
+		x.Rescan()
+	}
+	if !started {
+		if err := x.walk(match, func(it Item) { items = append(items, it) }); err != nil {
+			return nil, err
+		}
+	}
+
+	seen := make(map[string]bool)
+	for i, it := range items {
+		// Templates are served rendered, under their name without .tmpl
+		name := strings.TrimSuffix(it.Path, ".tmpl")
+		seen[name] = true
+		items[i].Profiles = refs.Profiles(name)
+		x.mu.Lock()
+		items[i].Served = x.served[it.full]
+		x.mu.Unlock()
+		if v, ok := x.Catalog.Lookup(it.full, it.Size); ok {
+			items[i].Source = &v
+		}
+	}
+	for rel, profiles := range refs.Files {
+		// Until the first walk ends, files not found yet aren't missing
+		if !partial && !seen[rel] && (match == nil || match(rel)) {
+			items = append(items, Item{Path: rel, Missing: true, Profiles: slices.Sorted(slices.Values(profiles))})
+		}
+	}
+	slices.SortFunc(items, func(a, b Item) int {
+		return cmp.Or(strings.Compare(a.Path, b.Path), strings.Compare(a.Root, b.Root))
+	})
+	return items, nil
+}
+
+// walk hashes and passes found the files in the roots, skipping hidden
+// ones; with match, only the paths it accepts. A full walk forgets the
+// hashes of files that are gone.
+func (x *Index) walk(match func(rel string) bool, found func(Item)) error {
+	roots := []struct{ name, dir string }{{"tftp", x.TFTPRoot}, {"http", x.HTTPRoot}}
+	tftpDir, _ := filepath.Abs(x.TFTPRoot)
+	if httpDir, _ := filepath.Abs(x.HTTPRoot); tftpDir == httpDir {
+		roots = roots[:1]
+		roots[0].name = "tftp,http"
+	}
+	walked := make(map[string]bool)
+	for _, root := range roots {
+		err := filepath.WalkDir(root.dir, func(full string, e fs.DirEntry, err error) error {
+			if err != nil {
+				if full == root.dir && errors.Is(err, fs.ErrNotExist) {
+					return filepath.SkipDir
+				}
+				return err
+			}
+			if full != root.dir && strings.HasPrefix(e.Name(), ".") {
+				if e.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !e.Type().IsRegular() {
+				return nil
+			}
+			rel, _ := filepath.Rel(root.dir, full)
+			rel = filepath.ToSlash(rel)
+			if match != nil && !match(rel) && !match(strings.TrimSuffix(rel, ".tmpl")) {
+				return nil
+			}
+			it, err := x.item(full, e)
+			if err != nil {
+				return err
+			}
+			walked[it.full] = true
+			it.Root, it.Path = root.name, rel
+			found(it)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if match == nil {
+		x.mu.Lock()
+		for full := range x.sums {
+			if !walked[full] {
+				delete(x.sums, full)
+			}
+		}
+		x.mu.Unlock()
+	}
+	return nil
+}
+
+// item describes one file, hashing it unless its hash is known
+func (x *Index) item(full string, e fs.DirEntry) (Item, error) {
+	info, err := e.Info()
+	if err != nil {
+		return Item{}, err
+	}
+	full, _ = filepath.Abs(full)
+	it := Item{Size: info.Size(), Modified: info.ModTime(), full: full}
+	x.mu.Lock()
+	h, ok := x.sums[full]
+	x.mu.Unlock()
+	if !ok || h.size != it.Size || !h.mod.Equal(it.Modified) {
+		sum, err := hash(full)
+		if err != nil {
+			return Item{}, err
+		}
+		h = hashed{size: it.Size, mod: it.Modified, sum: sum}
+		x.mu.Lock()
+		x.sums[full] = h
+		x.mu.Unlock()
+	}
+	it.SHA256 = h.sum
+	return it, nil
+}
@@ -0,0 +1,128 @@
+package assets
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ars1364/go-pxe/events"
+	"github.com/ars1364/go-pxe/fetch"
+)
+
+func TestRefsProfiles(t *testing.T) {
+	r := Refs{
+		Files: map[string][]string{"alma/vmlinuz": {"web", "db"}},
+		Dirs:  map[string][]string{"alma": {"db", "cache"}, "": {"rescue"}, "al": {"x"}},
+	}
+	got := strings.Join(r.Profiles("alma/vmlinuz"), ",")
+	if got != "cache,db,rescue,web" {
+		t.Errorf("Profiles = %s", got)
+	}
+}
+
+func TestList(t *testing.T) {
+	tftp, web := t.TempDir(), t.TempDir()
+	tree(t, tftp, map[string]string{"pxelinux.0": "loader", "alma/vmlinuz": "kernel", ".git/x": "hidden"})
+	tree(t, web, map[string]string{"ks.cfg.tmpl": "template"})
+	x := NewIndex(tftp, web)
+	cat, _ := OpenCatalog("")
+	cat.Record(filepath.Join(tftp, "alma/vmlinuz"), fetch.Verification{Size: 6, Level: fetch.Signed})
+	x.Catalog = cat
+	served := time.Now()
+	x.Record(events.Event{Type: events.TFTPComplete, Time: served, Path: "/alma/../alma/vmlinuz"})
+	x.Record(events.Event{Type: events.HTTPRequest, Time: served, Path: "ks.cfg.tmpl", Status: 404})
+
+	refs := Refs{Files: map[string][]string{"alma/vmlinuz": {"web"}, "alma/initrd.img": {"web"}, "ks.cfg": {"web"}}}
+	items, err := x.List(refs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, it := range items {
+		paths = append(paths, it.Root+":"+it.Path)
+	}
+	if strings.Join(paths, " ") != ":alma/initrd.img tftp:alma/vmlinuz http:ks.cfg.tmpl tftp:pxelinux.0" {
+		t.Fatalf("listed %v", paths)
+	}
+	missing, kernel, tmpl, loader := items[0], items[1], items[2], items[3]
+	if !missing.Missing || len(missing.Profiles) != 1 {
+		t.Errorf("missing = %+v", missing)
+	}
+	if kernel.SHA256 != sha("kernel") || kernel.Source == nil || kernel.Source.Level != fetch.Signed || !kernel.Served.Equal(served) || len(kernel.Profiles) != 1 {
+		t.Errorf("kernel = %+v", kernel)
+	}
+	if len(tmpl.Profiles) != 1 || !tmpl.Served.IsZero() {
+		t.Errorf("template = %+v", tmpl)
+	}
+	if loader.Source != nil || len(loader.Profiles) != 0 {
+		t.Errorf("loader = %+v", loader)
+	}
+
+	// Matching only some paths
+	items, err = x.List(refs, func(rel string) bool { return strings.HasPrefix(rel, "alma/") })
+	if err != nil || len(items) != 2 {
+		t.Errorf("matched %+v, %v", items, err)
+	}
+
+	// A changed file is hashed again
+	past := time.Now().Add(-time.Hour)
+	os.WriteFile(filepath.Join(tftp, "alma/vmlinuz"), []byte("kernel2"), 0644)
+	os.Chtimes(filepath.Join(tftp, "alma/vmlinuz"), past, past)
+	items, _ = x.List(Refs{}, nil)
+	if items[0].SHA256 != sha("kernel2") || items[0].Source != nil {
+		t.Errorf("changed kernel = %+v", items[0])
+	}
+}
+
+func TestListSameRoot(t *testing.T) {
+	root := t.TempDir()
+	tree(t, root, map[string]string{"vmlinuz": "kernel"})
+	items, err := NewIndex(root, root+"/.").List(Refs{}, nil)
+	if err != nil || len(items) != 1 || items[0].Root != "tftp,http" {
+		t.Errorf("List = %+v, %v", items, err)
+	}
+	items, err = NewIndex(filepath.Join(root, "missing"), root).List(Refs{}, nil)
+	if err != nil || len(items) != 1 {
+		t.Errorf("missing root: %+v, %v", items, err)
+	}
+}
+
+func TestStart(t *testing.T) {
+	root := t.TempDir()
+	tree(t, root, map[string]string{"vmlinuz": "kernel", "initrd.img": "initrd"})
+	x := NewIndex(root, root)
+	x.Start()
+	deadline := time.Now().Add(5 * time.Second)
+	for x.Status().Scanned.IsZero() {
+		if time.Now().After(deadline) {
+			t.Fatal("first walk didn't end")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if st := x.Status(); st.Files != 2 || st.Error != "" {
+		t.Errorf("Status = %+v", st)
+	}
+
+	// Answered from the listing, even once a file is gone
+	os.Remove(filepath.Join(root, "initrd.img"))
+	if items, _ := x.List(Refs{}, nil); len(items) != 2 {
+		t.Errorf("listed %d files", len(items))
+	}
+	x.Rescan()
+	for {
+		if st := x.Status(); !st.Scanning && st.Files == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("rescan didn't drop the file: %+v", x.Status())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if len(x.sums) != 1 {
+		t.Errorf("%d hashes kept", len(x.sums))
+	}
+}
@@ -0,0 +1,273 @@
+// Package attest records the TPM 2.0 attestation provisioned hosts submit
+// after first boot: a quote over their PCRs signed by an attestation key,
+// usually with the firmware event log. Quotes are checked for freshness,
+// signature and consistency with the event log, and the PCRs compared to
+// the values the host's profile expects.
+package attest
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// nonceTTL bounds the time between fetching a nonce and quoting with it
+const nonceTTL = 5 * time.Minute
+
+// Evidence is what a host submits, as produced by tpm2-tools
+type Evidence struct {
+	AK        string `json:"ak"`        // attestation public key, PEM (tpm2_createak -f pem)
+	Quote     []byte `json:"quote"`     // TPMS_ATTEST (tpm2_quote -m), base64
+	Signature []byte `json:"signature"` // TPMT_SIGNATURE (tpm2_quote -s), base64
+
+	// PCRs are the quoted SHA-256 values, hex. Without them they are
+	// recomputed from EventLog.
+	PCRs map[int]string `json:"pcrs,omitempty"`
+
+	// EventLog is the binary firmware event log, base64
+	EventLog []byte `json:"eventLog,omitempty"`
+}
+
+// Report is the outcome of one attestation
+type Report struct {
+	Client string    `json:"client"` // inventory host name, else dashed MAC, else IP
+	IP     string    `json:"ip,omitempty"`
+	Time   time.Time `json:"time"`
+
+	// AK is the fingerprint of the key that signed the quote; Pinned is
+	// the one trusted for the client, its first verified key
+	AK     string `json:"ak,omitempty"`
+	Pinned string `json:"pinned,omitempty"`
+
+	PCRs   map[int]string `json:"pcrs,omitempty"`   // quoted values
+	Policy map[int]string `json:"policy,omitempty"` // expected values
+	Events int            `json:"events,omitempty"` // event log entries replayed
+
+	// Verified is set when the evidence is authentic and every PCR in the
+	// policy matches. Mismatch lists the PCRs that don't; Error says why
+	// the evidence itself could not be trusted.
+	Verified bool   `json:"verified"`
+	Mismatch []int  `json:"mismatch,omitempty"`
+	Error    string `json:"error,omitempty"`
+
+	EventLog []byte `json:"eventLog,omitempty"`
+}
+
+// Check verifies ev against nonce, the client's pinned key (empty on
+// first contact) and the expected PCR values
+func Check(ev Evidence, nonce []byte, pinned string, policy map[int]string) Report {
+	r := Report{Pinned: pinned, Policy: policy, EventLog: ev.EventLog}
+	if err := r.check(ev, nonce); err != nil {
+		r.Error = err.Error()
+		return r
+	}
+	for i, want := range policy {
+		if got, ok := r.PCRs[i]; !ok || got != want {
+			r.Mismatch = append(r.Mismatch, i)
+		}
+	}
+	sort.Ints(r.Mismatch)
+	r.Verified = len(r.Mismatch) == 0
+	return r
+}
+
+func (r *Report) check(ev Evidence, nonce []byte) error {
+	block, _ := pem.Decode([]byte(ev.AK))
+	if block == nil {
+		return fmt.Errorf("ak: no PEM public key")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("ak: %w", err)
+	}
+	r.AK = fingerprint(block.Bytes)
+	if r.Pinned != "" && r.AK != r.Pinned {
+		return fmt.Errorf("attestation key %s differs from the one pinned for this host", r.AK)
+	}
+
+	q, err := parseQuote(ev.Quote)
+	if err != nil {
+		return err
+	}
+	if err := verifySignature(pub, ev.Signature, ev.Quote); err != nil {
+		return err
+	}
+	if !bytes.Equal(q.nonce, nonce) {
+		return fmt.Errorf("quote: stale or foreign nonce")
+	}
+
+	values := make(map[int][]byte)
+	if len(ev.EventLog) > 0 {
+		replayed, n, err := replay(ev.EventLog)
+		if err != nil {
+			return err
+		}
+		r.Events = n
+		for _, i := range q.pcrs {
+			values[i] = initialPCR(i)
+			if v, ok := replayed[i]; ok {
+				values[i] = v
+			}
+		}
+	}
+	for i, v := range ev.PCRs {
+		b, err := hex.DecodeString(v)
+		if err != nil || len(b) != 32 {
+			return fmt.Errorf("pcrs: PCR %d: not a SHA-256 value", i)
+		}
+		if logged, ok := values[i]; ok && !bytes.Equal(logged, b) {
+			return fmt.Errorf("event log does not replay to PCR %d", i)
+		}
+		values[i] = b
+	}
+	if len(values) == 0 {
+		return fmt.Errorf("need pcrs or an eventLog to check the quote against")
+	}
+	digest, err := pcrDigest(q.pcrs, values)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(digest, q.digest) {
+		if len(ev.EventLog) > 0 {
+			return fmt.Errorf("quoted PCRs do not match the event log")
+		}
+		return fmt.Errorf("quoted PCRs do not match the values sent")
+	}
+
+	r.PCRs = make(map[int]string, len(q.pcrs))
+	for _, i := range q.pcrs {
+		r.PCRs[i] = hex.EncodeToString(values[i])
+	}
+	return nil
+}
+
+type nonce struct {
+	value   []byte
+	expires time.Time
+}
+
+// Store keeps the latest report and the pinned attestation key of every
+// client, and the nonces handed out
+type Store struct {
+	mu      sync.Mutex
+	reports map[string]Report
+	keys    map[string]string
+	nonces  map[string]nonce // by IP
+}
+
+// NewStore creates an empty store
+func NewStore() *Store {
+	return &Store{reports: make(map[string]Report), keys: make(map[string]string), nonces: make(map[string]nonce)}
+}
+
+// Nonce issues a fresh nonce for the client at ip, replacing any earlier
+// one
+func (s *Store) Nonce(ip string) []byte {
+	b := make([]byte, 20)
+	rand.Read(b)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for k, n := range s.nonces {
+		if now.After(n.expires) {
+			delete(s.nonces, k)
+		}
+	}
+	s.nonces[ip] = nonce{value: b, expires: now.Add(nonceTTL)}
+	return b
+}
+
+// TakeNonce returns and forgets the unexpired nonce issued to ip
+func (s *Store) TakeNonce(ip string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n, ok := s.nonces[ip]
+	delete(s.nonces, ip)
+	return n.value, ok && time.Now().Before(n.expires)
+}
+
+// Pinned returns the attestation key trusted for client, if any
+func (s *Store) Pinned(client string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.keys[client]
+}
+
+// Put stores r as the client's latest report, pinning its key if the
+// evidence was authentic and none is pinned yet
+func (s *Store) Put(r Report) Report {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r.Error == "" && s.keys[r.Client] == "" {
+		s.keys[r.Client] = r.AK
+		r.Pinned = r.AK
+	}
+	s.reports[r.Client] = r
+	return r
+}
+
+// Get returns the client's latest report
+func (s *Store) Get(client string) (Report, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.reports[client]
+	return r, ok
+}
+
+// List returns every report without its event log, by client
+func (s *Store) List() []Report {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]Report, 0, len(s.reports))
+	for _, r := range s.reports {
+		r.EventLog = nil
+		list = append(list, r)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Client < list[j].Client })
+	return list
+}
+
+// Delete forgets the client's report and pinned key, so a host with a new
+// TPM can enrol again. It reports whether there was either.
+func (s *Store) Delete(client string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.reports[client]
+	_, pinned := s.keys[client]
+	delete(s.reports, client)
+	delete(s.keys, client)
+	return ok || pinned
+}
+
+// Snapshot returns every report for backups
+func (s *Store) Snapshot() []Report {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]Report, 0, len(s.reports))
+	for _, r := range s.reports {
+		list = append(list, r)
+	}
+	return list
+}
+
+// Load replaces the reports with list, as a backup restores them, and pins
+// the attestation keys they record again, so a restored host must still
+// quote with the key it first used
+func (s *Store) Load(list []Report) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reports = make(map[string]Report, len(list))
+	s.keys = make(map[string]string, len(list))
+	for _, r := range list {
+		s.reports[r.Client] = r
+		if r.Pinned != "" {
+			s.keys[r.Client] = r.Pinned
+		}
+	}
+}
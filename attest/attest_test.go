@@ -0,0 +1,291 @@
+package attest
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+const evAction = 5
+
+// host is a TPM's view of a boot: its attestation key and event log
+type host struct {
+	key *ecdsa.PrivateKey
+	ak  string
+	log []byte
+	// values the log extends PCRs 0 and 4 to
+	pcrs map[int][]byte
+}
+
+func newHost(t *testing.T) *host {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	zero := make([]byte, 32)
+	return &host{
+		key: key,
+		ak:  string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+		log: makeLog(event{0, evAction, []byte("firmware")}, event{4, evAction, []byte("shim")}),
+		pcrs: map[int][]byte{
+			0: extend(zero, "firmware"),
+			4: extend(zero, "shim"),
+			7: zero,
+		},
+	}
+}
+
+// evidence quotes PCRs 0, 4 and 7 with values over nonce
+func (h *host) evidence(t *testing.T, nonce []byte, values map[int][]byte) Evidence {
+	t.Helper()
+	digest := sha256.New()
+	for _, i := range []int{0, 4, 7} {
+		digest.Write(values[i])
+	}
+	quote := makeQuote(nonce, []int{0, 4, 7}, digest.Sum(nil))
+	return Evidence{AK: h.ak, Quote: quote, Signature: sign(t, h.key, algECDSA, quote)}
+}
+
+func hexPCRs(values map[int][]byte) map[int]string {
+	out := make(map[int]string)
+	for i, v := range values {
+		out[i] = hex.EncodeToString(v)
+	}
+	return out
+}
+
+func TestCheck(t *testing.T) {
+	h := newHost(t)
+	other := newHost(t)
+	nonce := []byte("0123456789abcdefghij")
+	policy := map[int]string{0: hex.EncodeToString(h.pcrs[0]), 4: hex.EncodeToString(h.pcrs[4])}
+	tampered := map[int][]byte{0: h.pcrs[0], 4: extend(make([]byte, 32), "evil shim"), 7: h.pcrs[7]}
+
+	tests := []struct {
+		name         string
+		ev           func() Evidence
+		pinned       string
+		wantErr      string
+		wantMismatch []int
+	}{
+		{"event log", func() Evidence {
+			ev := h.evidence(t, nonce, h.pcrs)
+			ev.EventLog = h.log
+			return ev
+		}, "", "", nil},
+		{"PCR values", func() Evidence {
+			ev := h.evidence(t, nonce, h.pcrs)
+			ev.PCRs = hexPCRs(h.pcrs)
+			return ev
+		}, "", "", nil},
+		{"event log and matching values", func() Evidence {
+			ev := h.evidence(t, nonce, h.pcrs)
+			ev.EventLog, ev.PCRs = h.log, hexPCRs(h.pcrs)
+			return ev
+		}, "", "", nil},
+		{"pinned key", func() Evidence {
+			ev := h.evidence(t, nonce, h.pcrs)
+			ev.EventLog = h.log
+			return ev
+		}, fingerprintPEM(h.ak), "", nil},
+		{"policy mismatch", func() Evidence {
+			ev := h.evidence(t, nonce, tampered)
+			ev.PCRs = hexPCRs(tampered)
+			return ev
+		}, "", "", []int{4}},
+		{"another host's key", func() Evidence {
+			ev := other.evidence(t, nonce, h.pcrs)
+			ev.EventLog = h.log
+			return ev
+		}, fingerprintPEM(h.ak), "differs from the one pinned", nil},
+		{"stale nonce", func() Evidence {
+			ev := h.evidence(t, []byte("old"), h.pcrs)
+			ev.EventLog = h.log
+			return ev
+		}, "", "nonce", nil},
+		{"forged signature", func() Evidence {
+			ev := h.evidence(t, nonce, h.pcrs)
+			ev.EventLog, ev.AK = h.log, other.ak
+			return ev
+		}, "", "verification failed", nil},
+		{"no PEM", func() Evidence { return Evidence{AK: "key"} }, "", "no PEM", nil},
+		{"log does not match values", func() Evidence {
+			ev := h.evidence(t, nonce, tampered)
+			ev.EventLog, ev.PCRs = h.log, hexPCRs(tampered)
+			return ev
+		}, "", "does not replay to PCR 4", nil},
+		{"quote does not match log", func() Evidence {
+			ev := h.evidence(t, nonce, tampered)
+			ev.EventLog = h.log
+			return ev
+		}, "", "do not match the event log", nil},
+		{"quote does not match values", func() Evidence {
+			ev := h.evidence(t, nonce, tampered)
+			ev.PCRs = hexPCRs(h.pcrs)
+			return ev
+		}, "", "do not match the values sent", nil},
+		{"value missing", func() Evidence {
+			ev := h.evidence(t, nonce, h.pcrs)
+			ev.PCRs = hexPCRs(map[int][]byte{0: h.pcrs[0]})
+			return ev
+		}, "", "no value for quoted PCR 4", nil},
+		{"short value", func() Evidence {
+			ev := h.evidence(t, nonce, h.pcrs)
+			ev.PCRs = map[int]string{0: "abcd"}
+			return ev
+		}, "", "not a SHA-256 value", nil},
+		{"nothing to check against", func() Evidence { return h.evidence(t, nonce, h.pcrs) }, "", "need pcrs or an eventLog", nil},
+		{"corrupt log", func() Evidence {
+			ev := h.evidence(t, nonce, h.pcrs)
+			ev.EventLog = h.log[:len(h.log)-1]
+			return ev
+		}, "", "event log", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := Check(tt.ev(), nonce, tt.pinned, policy)
+			if tt.wantErr != "" {
+				if !strings.Contains(r.Error, tt.wantErr) || r.Verified {
+					t.Errorf("error %q, want %q", r.Error, tt.wantErr)
+				}
+				return
+			}
+			if r.Error != "" {
+				t.Fatalf("error %q", r.Error)
+			}
+			if r.Verified != (tt.wantMismatch == nil) || !slices.Equal(r.Mismatch, tt.wantMismatch) {
+				t.Errorf("verified %v, mismatch %v, want %v", r.Verified, r.Mismatch, tt.wantMismatch)
+			}
+			if len(r.PCRs) != 3 || r.AK != fingerprintPEM(h.ak) {
+				t.Errorf("report %+v", r)
+			}
+		})
+	}
+}
+
+func fingerprintPEM(ak string) string {
+	block, _ := pem.Decode([]byte(ak))
+	return fingerprint(block.Bytes)
+}
+
+func TestStore(t *testing.T) {
+	s := NewStore()
+	n := s.Nonce("192.0.2.10")
+	if len(n) != 20 || bytes.Equal(n, s.Nonce("192.0.2.11")) {
+		t.Errorf("nonce %x", n)
+	}
+	if got, ok := s.TakeNonce("192.0.2.10"); !ok || !bytes.Equal(got, n) {
+		t.Error("nonce not taken")
+	}
+	if _, ok := s.TakeNonce("192.0.2.10"); ok {
+		t.Error("nonce taken twice")
+	}
+
+	// Only authentic evidence pins its key
+	if r := s.Put(Report{Client: "web01", AK: "SHA256:aa", Error: "bad"}); r.Pinned != "" || s.Pinned("web01") != "" {
+		t.Error("rejected evidence pinned its key")
+	}
+	if r := s.Put(Report{Client: "web01", AK: "SHA256:bb", EventLog: []byte("log")}); r.Pinned != "SHA256:bb" {
+		t.Errorf("pinned %q", r.Pinned)
+	}
+	if r := s.Put(Report{Client: "web01", AK: "SHA256:cc"}); r.Pinned != "" || s.Pinned("web01") != "SHA256:bb" {
+		t.Error("a later key replaced the pinned one")
+	}
+	s.Put(Report{Client: "db01", AK: "SHA256:dd"})
+	if list := s.List(); len(list) != 2 || list[0].Client != "db01" || list[1].EventLog != nil {
+		t.Errorf("List = %+v", list)
+	}
+
+	restored := NewStore()
+	restored.Load([]Report{{Client: "web01", AK: "SHA256:bb", Pinned: "SHA256:bb"}, {Client: "db01", AK: "SHA256:dd", Error: "bad"}})
+	if restored.Pinned("web01") != "SHA256:bb" || restored.Pinned("db01") != "" {
+		t.Error("Load does not pin the recorded keys")
+	}
+	if !restored.Delete("web01") || restored.Pinned("web01") != "" || restored.Delete("web01") {
+		t.Error("Delete does not forget exactly once")
+	}
+	if len(restored.Snapshot()) != 1 {
+		t.Errorf("snapshot %+v", restored.Snapshot())
+	}
+}
+
+func TestHandler(t *testing.T) {
+	h := newHost(t)
+	store := NewStore()
+	handler := NewHandler(store)
+	handler.ClientID = func(ip net.IP) string { return "web01" }
+	handler.Policy = func(ip net.IP) map[int]string { return map[int]string{4: hex.EncodeToString(h.pcrs[4])} }
+	var results []Report
+	handler.Result = func(ip net.IP, r Report) { results = append(results, r) }
+
+	do := func(method, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/attest", strings.NewReader(body))
+		req.RemoteAddr = "192.0.2.10:40000"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	submit := func(ev Evidence) *httptest.ResponseRecorder {
+		b, _ := json.Marshal(ev)
+		return do(http.MethodPost, string(b))
+	}
+
+	if w := submit(Evidence{}); w.Code != http.StatusConflict {
+		t.Errorf("evidence without a nonce: %d", w.Code)
+	}
+
+	w := do(http.MethodGet, "")
+	nonce, err := hex.DecodeString(strings.TrimSpace(w.Body.String()))
+	if w.Code != http.StatusOK || err != nil || len(nonce) != 20 {
+		t.Fatalf("nonce %d %q", w.Code, w.Body)
+	}
+	ev := h.evidence(t, nonce, h.pcrs)
+	ev.EventLog = h.log
+	w = submit(ev)
+	var r Report
+	if err := json.NewDecoder(w.Body).Decode(&r); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("submit: %d %v", w.Code, err)
+	}
+	if !r.Verified || r.Client != "web01" || r.IP != "192.0.2.10" || r.Pinned != r.AK || r.Events != 2 || r.EventLog != nil {
+		t.Errorf("report %+v", r)
+	}
+	if stored, ok := store.Get("web01"); !ok || stored.EventLog == nil || len(results) != 1 {
+		t.Error("report not stored with its event log and passed on")
+	}
+
+	// The nonce is used up
+	if w := submit(ev); w.Code != http.StatusConflict {
+		t.Errorf("replayed evidence: %d", w.Code)
+	}
+	do(http.MethodGet, "")
+	if w := do(http.MethodPost, "{"); w.Code != http.StatusBadRequest {
+		t.Errorf("malformed evidence: %d", w.Code)
+	}
+	if _, ok := store.TakeNonce("192.0.2.10"); ok {
+		t.Error("malformed evidence left the nonce usable")
+	}
+
+	// A different TPM is not trusted until the host is deleted
+	other := newHost(t)
+	nonce, _ = hex.DecodeString(strings.TrimSpace(do(http.MethodGet, "").Body.String()))
+	ev = other.evidence(t, nonce, h.pcrs)
+	ev.EventLog = h.log
+	json.NewDecoder(submit(ev).Body).Decode(&r)
+	if r.Verified || !strings.Contains(r.Error, "pinned") || store.Pinned("web01") != fingerprintPEM(h.ak) {
+		t.Errorf("report with another key %+v", r)
+	}
+}
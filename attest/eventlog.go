@@ -0,0 +1,99 @@
+package attest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	evNoAction    = 0x00000003
+	numPCRs       = 24
+	specIDEvent   = "Spec ID Event03\x00"
+	startupLocal  = "StartupLocality\x00"
+	maxEventCount = 1 << 16
+)
+
+// replay recomputes the SHA-256 PCR values a TCG crypto-agile event log
+// (/sys/kernel/security/tpm0/binary_bios_measurements) extends into, and
+// reports how many measurements it holds. Only PCRs the log touches are
+// returned.
+func replay(log []byte) (map[int][]byte, int, error) {
+	w := &wire{data: log, order: binary.LittleEndian}
+
+	// The first event is in the SHA-1 format and describes the digests
+	// every later one carries
+	w.u32() // PCR index
+	if typ := w.u32(); w.err == nil && typ != evNoAction {
+		return nil, 0, errors.New("event log: does not start with a Spec ID event")
+	}
+	w.bytes(20)
+	spec := &wire{data: w.bytes(int(w.u32())), order: binary.LittleEndian}
+	if w.err != nil {
+		return nil, 0, fmt.Errorf("event log: %w", w.err)
+	}
+	if string(spec.bytes(len(specIDEvent))) != specIDEvent {
+		return nil, 0, errors.New("event log: SHA-1 only (pre-crypto-agile) logs are not supported")
+	}
+	spec.bytes(8) // platform class, spec version, errata, uintn size
+	sizes := make(map[uint16]int)
+	for n := spec.u32(); n > 0 && spec.err == nil; n-- {
+		alg, size := spec.u16(), spec.u16()
+		sizes[alg] = int(size)
+	}
+	if spec.err != nil {
+		return nil, 0, fmt.Errorf("event log: Spec ID event: %w", spec.err)
+	}
+	if sizes[algSHA256] != sha256.Size {
+		return nil, 0, errors.New("event log: has no SHA-256 digests")
+	}
+
+	pcrs := make(map[int][]byte)
+	count := 0
+	for len(w.data) > 0 {
+		pcr, typ := int(w.u32()), w.u32()
+		var digest []byte
+		for n := w.u32(); n > 0 && w.err == nil; n-- {
+			alg := w.u16()
+			size, ok := sizes[alg]
+			if !ok && w.err == nil {
+				return nil, 0, fmt.Errorf("event log: event %d: digest algorithm %#04x not announced", count, alg)
+			}
+			if d := w.bytes(size); alg == algSHA256 {
+				digest = d
+			}
+		}
+		data := w.bytes(int(w.u32()))
+		if w.err != nil {
+			return nil, 0, fmt.Errorf("event log: event %d: %w", count, w.err)
+		}
+		if count++; count > maxEventCount {
+			return nil, 0, errors.New("event log: too many events")
+		}
+		if pcr < 0 || pcr >= numPCRs {
+			return nil, 0, fmt.Errorf("event log: event %d: PCR %d out of range", count, pcr)
+		}
+		if typ == evNoAction {
+			// Not measured; the startup locality event sets PCR 0's
+			// initial value when the TPM was started from locality 3
+			if pcr == 0 && bytes.HasPrefix(data, []byte(startupLocal)) && len(data) > len(startupLocal) && pcrs[0] == nil {
+				v := initialPCR(0)
+				v[len(v)-1] = data[len(startupLocal)]
+				pcrs[0] = v
+			}
+			continue
+		}
+		if digest == nil {
+			return nil, 0, fmt.Errorf("event log: event %d: no SHA-256 digest", count)
+		}
+		cur, ok := pcrs[pcr]
+		if !ok {
+			cur = initialPCR(pcr)
+		}
+		sum := sha256.Sum256(append(append([]byte(nil), cur...), digest...))
+		pcrs[pcr] = sum[:]
+	}
+	return pcrs, count, nil
+}
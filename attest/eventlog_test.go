@@ -0,0 +1,138 @@
+package attest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+type event struct {
+	pcr  uint32
+	typ  uint32
+	data []byte
+}
+
+// makeLog encodes a crypto-agile event log carrying SHA-1 and SHA-256
+// digests of each event's data
+func makeLog(events ...event) []byte {
+	le := binary.LittleEndian
+	spec := []byte(specIDEvent)
+	spec = append(spec, make([]byte, 8)...)
+	spec = le.AppendUint32(spec, 2)
+	spec = le.AppendUint16(spec, algSHA1)
+	spec = le.AppendUint16(spec, 20)
+	spec = le.AppendUint16(spec, algSHA256)
+	spec = le.AppendUint16(spec, 32)
+	spec = append(spec, 0) // vendor info
+
+	b := le.AppendUint32(nil, 0)
+	b = le.AppendUint32(b, evNoAction)
+	b = append(b, make([]byte, 20)...)
+	b = le.AppendUint32(b, uint32(len(spec)))
+	b = append(b, spec...)
+	for _, e := range events {
+		b = le.AppendUint32(b, e.pcr)
+		b = le.AppendUint32(b, e.typ)
+		b = le.AppendUint32(b, 2)
+		b = le.AppendUint16(b, algSHA1)
+		b = append(b, make([]byte, 20)...)
+		b = le.AppendUint16(b, algSHA256)
+		sum := sha256.Sum256(e.data)
+		b = append(b, sum[:]...)
+		b = le.AppendUint32(b, uint32(len(e.data)))
+		b = append(b, e.data...)
+	}
+	return b
+}
+
+// extend is PCR extension done independently of replay
+func extend(v []byte, data ...string) []byte {
+	for _, d := range data {
+		m := sha256.Sum256([]byte(d))
+		sum := sha256.Sum256(append(append([]byte(nil), v...), m[:]...))
+		v = sum[:]
+	}
+	return v
+}
+
+func TestReplay(t *testing.T) {
+	log := makeLog(
+		event{0, evAction, []byte("firmware")},
+		event{0, evAction, []byte("config")},
+		event{4, evAction, []byte("shim")},
+		event{17, evAction, []byte("drtm")},
+		event{1, evNoAction, []byte("not measured")},
+	)
+	pcrs, n, err := replay(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 5 || len(pcrs) != 3 {
+		t.Errorf("%d events, %d PCRs", n, len(pcrs))
+	}
+	zero := make([]byte, 32)
+	for i, want := range map[int][]byte{
+		0:  extend(zero, "firmware", "config"),
+		4:  extend(zero, "shim"),
+		17: extend(bytes.Repeat([]byte{0xff}, 32), "drtm"),
+	} {
+		if !bytes.Equal(pcrs[i], want) {
+			t.Errorf("PCR %d = %x, want %x", i, pcrs[i], want)
+		}
+	}
+
+	// Started from locality 3
+	pcrs, _, err = replay(makeLog(
+		event{0, evNoAction, append([]byte(startupLocal), 3)},
+		event{0, evAction, []byte("firmware")},
+	))
+	locality3 := make([]byte, 32)
+	locality3[31] = 3
+	if err != nil || !bytes.Equal(pcrs[0], extend(locality3, "firmware")) {
+		t.Errorf("PCR 0 after locality 3 startup = %x, %v", pcrs[0], err)
+	}
+
+	for n := range len(log) {
+		if _, count, err := replay(log[:n]); err == nil && count == 5 {
+			t.Errorf("replayed every event from %d of %d bytes", n, len(log))
+		}
+	}
+}
+
+func TestReplayMalformed(t *testing.T) {
+	le := binary.LittleEndian
+	good := makeLog(event{0, evAction, []byte("firmware")})
+	specAt := 32 // the Spec ID event's data
+
+	tests := []struct {
+		name    string
+		mangle  func(b []byte) []byte
+		wantErr string
+	}{
+		{"empty", func(b []byte) []byte { return nil }, "truncated"},
+		{"no Spec ID event", func(b []byte) []byte { le.PutUint32(b[4:], 1); return b }, "Spec ID"},
+		{"SHA-1 only log", func(b []byte) []byte { copy(b[specAt:], "Spec ID Event00"); return b }, "SHA-1 only"},
+		{"no SHA-256", func(b []byte) []byte { le.PutUint16(b[specAt+16+8+4+4:], algSHA384); return b }, "no SHA-256 digests"},
+		{"algorithm count past the end", func(b []byte) []byte { le.PutUint32(b[specAt+16+8:], 1<<31); return b }, "truncated"},
+		{"Spec ID size past the end", func(b []byte) []byte { le.PutUint32(b[28:], 1<<31); return b }, "truncated"},
+		{"PCR out of range", func(b []byte) []byte { le.PutUint32(b[len(b)-4-8-32-2-20-2-4-4-4:], 24); return b }, "out of range"},
+		{"PCR negative", func(b []byte) []byte { le.PutUint32(b[len(b)-4-8-32-2-20-2-4-4-4:], 1<<32-1); return b }, "out of range"},
+		{"unannounced algorithm", func(b []byte) []byte { le.PutUint16(b[len(b)-4-8-32-2-20-2:], algSHA384); return b }, "not announced"},
+		{"digest count past the end", func(b []byte) []byte { le.PutUint32(b[len(b)-4-8-32-2-20-2-4:], 1<<32-1); return b }, "event 0:"},
+		{"no SHA-256 digest", func(b []byte) []byte {
+			le.PutUint32(b[len(b)-4-8-32-2-20-2-4:], 1)
+			return append(b[:len(b)-4-8-32-2:len(b)-4-8-32-2], b[len(b)-4-8:]...)
+		}, "no SHA-256 digest"},
+		{"event size past the end", func(b []byte) []byte { le.PutUint32(b[len(b)-4-8:], 9); return b }, "truncated"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := replay(tt.mangle(bytes.Clone(good)))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package attest
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// maxEvidence bounds a submission; event logs are tens of KiB
+const maxEvidence = 4 << 20
+
+// Handler serves GET /attest/nonce and accepts evidence at POST /attest:
+//
+//	nonce=$(curl -sf http://10.0.0.1:8080/attest/nonce)
+//	tpm2_quote -c ak.ctx -l sha256:0,1,2,3,4,5,6,7 -q $nonce -m quote.msg -s quote.sig
+type Handler struct {
+	// Domain labels log lines
+	Domain string
+
+	// ClientID, if set, names the client a report is filed and its key
+	// pinned under. Defaults to its IP address.
+	ClientID func(ip net.IP) string
+
+	// Policy, if set, returns the PCR values expected of the client at ip
+	Policy func(ip net.IP) map[int]string
+
+	// Result, if set, is told about every report stored
+	Result func(ip net.IP, r Report)
+
+	store *Store
+}
+
+// NewHandler creates a handler filing reports in store
+func NewHandler(store *Store) *Handler {
+	return &Handler{store: store}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	ip := net.ParseIP(host)
+	if r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		io.WriteString(w, hex.EncodeToString(h.store.Nonce(ip.String()))+"\n")
+		return
+	}
+
+	nonce, ok := h.store.TakeNonce(ip.String())
+	if !ok {
+		http.Error(w, "no current nonce for this address; GET /attest/nonce and quote with it first", http.StatusConflict)
+		return
+	}
+	var ev Evidence
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxEvidence)).Decode(&ev); err != nil {
+		http.Error(w, "invalid evidence: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	client := ip.String()
+	if h.ClientID != nil {
+		client = h.ClientID(ip)
+	}
+	var policy map[int]string
+	if h.Policy != nil {
+		policy = h.Policy(ip)
+	}
+	rep := Check(ev, nonce, h.store.Pinned(client), policy)
+	rep.Client, rep.IP, rep.Time = client, ip.String(), time.Now()
+	rep = h.store.Put(rep)
+	switch {
+	case rep.Error != "":
+		log.Printf("[ATTEST] %s: %s: evidence rejected: %s", h.Domain, client, rep.Error)
+	case !rep.Verified:
+		log.Printf("[ATTEST] %s: %s: PCRs %v differ from policy", h.Domain, client, rep.Mismatch)
+	default:
+		log.Printf("[ATTEST] %s: %s: verified %d PCRs (%d in policy)", h.Domain, client, len(rep.PCRs), len(policy))
+	}
+	if h.Result != nil {
+		h.Result(ip, rep)
+	}
+
+	rep.EventLog = nil
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rep)
+}
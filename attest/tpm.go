@@ -0,0 +1,205 @@
+package attest
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	_ "crypto/sha1" // registers the hashes quotes may be signed with
+	"crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+)
+
+// TPM 2.0 constants (TCG TPM 2.0 Library, Part 2: Structures)
+const (
+	generatedValue = 0xff544347 // TPM_GENERATED_VALUE
+	stAttestQuote  = 0x8018     // TPM_ST_ATTEST_QUOTE
+
+	algSHA1   = 0x0004
+	algSHA256 = 0x000b
+	algSHA384 = 0x000c
+	algSHA512 = 0x000d
+	algRSASSA = 0x0014
+	algRSAPSS = 0x0016
+	algECDSA  = 0x0018
+)
+
+var hashes = map[uint16]crypto.Hash{
+	algSHA1:   crypto.SHA1,
+	algSHA256: crypto.SHA256,
+	algSHA384: crypto.SHA384,
+	algSHA512: crypto.SHA512,
+}
+
+// wire reads fixed-size fields, remembering the first short read
+type wire struct {
+	data  []byte
+	order binary.ByteOrder
+	err   error
+}
+
+func (w *wire) bytes(n int) []byte {
+	if w.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(w.data) {
+		w.err = errors.New("truncated")
+		return nil
+	}
+	b := w.data[:n]
+	w.data = w.data[n:]
+	return b
+}
+
+func (w *wire) u8() uint8 {
+	if b := w.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (w *wire) u16() uint16 {
+	if b := w.bytes(2); b != nil {
+		return w.order.Uint16(b)
+	}
+	return 0
+}
+
+func (w *wire) u32() uint32 {
+	if b := w.bytes(4); b != nil {
+		return w.order.Uint32(b)
+	}
+	return 0
+}
+
+// sized reads a TPM2B: a 16-bit length and that many bytes
+func (w *wire) sized() []byte {
+	return w.bytes(int(w.u16()))
+}
+
+// quote is the part of a TPMS_ATTEST from TPM2_Quote that matters here
+type quote struct {
+	nonce  []byte // extraData
+	pcrs   []int  // selected SHA-256 PCRs, ascending
+	digest []byte // of the selected PCR values
+}
+
+// parseQuote decodes a TPMS_ATTEST as written by tpm2_quote -m
+func parseQuote(data []byte) (*quote, error) {
+	w := &wire{data: data, order: binary.BigEndian}
+	magic, typ := w.u32(), w.u16()
+	if w.err == nil && (magic != generatedValue || typ != stAttestQuote) {
+		return nil, fmt.Errorf("quote: not a TPM-generated quote (magic %#x, type %#x)", magic, typ)
+	}
+	w.sized() // qualifiedSigner
+	q := &quote{nonce: w.sized()}
+	w.bytes(17) // clockInfo
+	w.bytes(8)  // firmwareVersion
+	for n := w.u32(); n > 0 && w.err == nil; n-- {
+		alg, sel := w.u16(), w.bytes(int(w.u8()))
+		if alg != algSHA256 {
+			return nil, fmt.Errorf("quote: PCR bank %#04x selected, only sha256 is supported", alg)
+		}
+		for i, b := range sel {
+			for bit := range 8 {
+				if b&(1<<bit) != 0 {
+					q.pcrs = append(q.pcrs, i*8+bit)
+				}
+			}
+		}
+	}
+	q.digest = w.sized()
+	if w.err != nil {
+		return nil, fmt.Errorf("quote: %w", w.err)
+	}
+	slices.Sort(q.pcrs)
+	q.pcrs = slices.Compact(q.pcrs)
+	return q, nil
+}
+
+// verifySignature checks a TPMT_SIGNATURE (tpm2_quote -s) over msg
+func verifySignature(pub crypto.PublicKey, sig, msg []byte) error {
+	w := &wire{data: sig, order: binary.BigEndian}
+	scheme, alg := w.u16(), w.u16()
+	h, ok := hashes[alg]
+	if w.err == nil && !ok {
+		return fmt.Errorf("signature: unsupported hash %#04x", alg)
+	}
+	var digest []byte
+	if ok {
+		hw := h.New()
+		hw.Write(msg)
+		digest = hw.Sum(nil)
+	}
+	switch scheme {
+	case algRSASSA, algRSAPSS:
+		key, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("signature: RSA signature but the key is not RSA")
+		}
+		s := w.sized()
+		if w.err != nil {
+			return fmt.Errorf("signature: %w", w.err)
+		}
+		var err error
+		if scheme == algRSASSA {
+			err = rsa.VerifyPKCS1v15(key, h, digest, s)
+		} else {
+			err = rsa.VerifyPSS(key, h, digest, s, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto})
+		}
+		if err != nil {
+			return errors.New("signature: verification failed")
+		}
+		return nil
+	case algECDSA:
+		key, ok := pub.(*ecdsa.PublicKey)
+		if !ok {
+			return errors.New("signature: ECDSA signature but the key is not ECDSA")
+		}
+		r, s := w.sized(), w.sized()
+		if w.err != nil {
+			return fmt.Errorf("signature: %w", w.err)
+		}
+		if !ecdsa.Verify(key, digest, new(big.Int).SetBytes(r), new(big.Int).SetBytes(s)) {
+			return errors.New("signature: verification failed")
+		}
+		return nil
+	}
+	if w.err != nil {
+		return fmt.Errorf("signature: %w", w.err)
+	}
+	return fmt.Errorf("signature: unsupported scheme %#04x", scheme)
+}
+
+// pcrDigest is the digest a quote over pcrs carries: SHA-256 of their
+// values concatenated in index order
+func pcrDigest(pcrs []int, values map[int][]byte) ([]byte, error) {
+	h := sha256.New()
+	for _, i := range pcrs {
+		v, ok := values[i]
+		if !ok {
+			return nil, fmt.Errorf("no value for quoted PCR %d", i)
+		}
+		h.Write(v)
+	}
+	return h.Sum(nil), nil
+}
+
+// initialPCR is a PCR's value at reset: 0xff... for the dynamic-launch
+// PCRs 17-22, zeros for the rest
+func initialPCR(i int) []byte {
+	if i >= 17 && i <= 22 {
+		return bytes.Repeat([]byte{0xff}, sha256.Size)
+	}
+	return make([]byte, sha256.Size)
+}
+
+// fingerprint names a public key: the SHA-256 of its DER encoding
+func fingerprint(der []byte) string {
+	return fmt.Sprintf("SHA256:%x", sha256.Sum256(der))
+}
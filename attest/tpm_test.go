@@ -0,0 +1,135 @@
+package attest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"slices"
+	"testing"
+)
+
+// tpm2b appends a TPM2B: a 16-bit length and b
+func tpm2b(out, b []byte) []byte {
+	out = binary.BigEndian.AppendUint16(out, uint16(len(b)))
+	return append(out, b...)
+}
+
+// makeQuote encodes a TPMS_ATTEST quoting the SHA-256 PCRs pcrs
+func makeQuote(nonce []byte, pcrs []int, digest []byte) []byte {
+	b := binary.BigEndian.AppendUint32(nil, generatedValue)
+	b = binary.BigEndian.AppendUint16(b, stAttestQuote)
+	b = tpm2b(b, []byte("signer"))
+	b = tpm2b(b, nonce)
+	b = append(b, make([]byte, 17+8)...) // clockInfo, firmwareVersion
+	b = binary.BigEndian.AppendUint32(b, 1)
+	b = binary.BigEndian.AppendUint16(b, algSHA256)
+	sel := make([]byte, 3)
+	for _, i := range pcrs {
+		sel[i/8] |= 1 << (i % 8)
+	}
+	b = append(b, byte(len(sel)))
+	b = append(b, sel...)
+	return tpm2b(b, digest)
+}
+
+// sign encodes a TPMT_SIGNATURE over msg
+func sign(t *testing.T, key crypto.Signer, scheme uint16, msg []byte) []byte {
+	t.Helper()
+	sum := sha256.Sum256(msg)
+	b := binary.BigEndian.AppendUint16(nil, scheme)
+	b = binary.BigEndian.AppendUint16(b, algSHA256)
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, sum[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tpm2b(tpm2b(b, r.Bytes()), s.Bytes())
+	case *rsa.PrivateKey:
+		var sig []byte
+		var err error
+		if scheme == algRSAPSS {
+			sig, err = rsa.SignPSS(rand.Reader, k, crypto.SHA256, sum[:], nil)
+		} else {
+			sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, sum[:])
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tpm2b(b, sig)
+	}
+	t.Fatalf("unsupported key %T", key)
+	return nil
+}
+
+func TestParseQuote(t *testing.T) {
+	digest := make([]byte, 32)
+	msg := makeQuote([]byte("nonce"), []int{7, 0, 23}, digest)
+	q, err := parseQuote(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(q.nonce) != "nonce" || !slices.Equal(q.pcrs, []int{0, 7, 23}) || len(q.digest) != 32 {
+		t.Errorf("quote %+v", q)
+	}
+
+	for n := range len(msg) {
+		if _, err := parseQuote(msg[:n]); err == nil {
+			t.Errorf("parsed %d of %d bytes", n, len(msg))
+		}
+	}
+	notQuote := slices.Clone(msg)
+	notQuote[5] = 0x17 // TPM_ST_ATTEST_CERTIFY
+	if _, err := parseQuote(notQuote); err == nil {
+		t.Error("parsed a certification")
+	}
+	sha1Bank := slices.Clone(msg)
+	i := len(msg) - 2 - 32 - 3 - 1 - 2
+	binary.BigEndian.PutUint16(sha1Bank[i:], algSHA1)
+	if _, err := parseQuote(sha1Bank); err == nil {
+		t.Error("accepted a SHA-1 bank")
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	ec, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rk, _ := rsa.GenerateKey(rand.Reader, 2048)
+	msg := []byte("attested")
+
+	tests := []struct {
+		name    string
+		pub     crypto.PublicKey
+		sig     []byte
+		wantErr bool
+	}{
+		{"ECDSA", &ec.PublicKey, sign(t, ec, algECDSA, msg), false},
+		{"RSASSA", &rk.PublicKey, sign(t, rk, algRSASSA, msg), false},
+		{"RSAPSS", &rk.PublicKey, sign(t, rk, algRSAPSS, msg), false},
+		{"other key", &other.PublicKey, sign(t, ec, algECDSA, msg), true},
+		{"ECDSA signature, RSA key", &rk.PublicKey, sign(t, ec, algECDSA, msg), true},
+		{"RSA signature, ECDSA key", &ec.PublicKey, sign(t, rk, algRSASSA, msg), true},
+		{"other message", &ec.PublicKey, sign(t, ec, algECDSA, []byte("forged")), true},
+		{"unknown hash", &ec.PublicKey, []byte{0, algECDSA, 0, 0x99, 0, 0, 0, 0}, true},
+		{"unknown scheme", &ec.PublicKey, []byte{0, 0x99, 0, algSHA256}, true},
+		{"empty", &ec.PublicKey, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := verifySignature(tt.pub, tt.sig, msg); (err != nil) != tt.wantErr {
+				t.Errorf("error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	sig := sign(t, ec, algECDSA, msg)
+	for n := range len(sig) {
+		if err := verifySignature(&ec.PublicKey, sig[:n], msg); err == nil {
+			t.Errorf("verified %d of %d bytes", n, len(sig))
+		}
+	}
+}
@@ -0,0 +1,126 @@
+// Package audit records management mutations (who changed what, when) in an
+// append-only JSON-lines file, kept separate from boot events.
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Entry is one recorded mutation
+type Entry struct {
+	Time   time.Time       `json:"time"`
+	Actor  string          `json:"actor"`
+	Domain string          `json:"domain,omitempty"`
+	Action string          `json:"action"` // e.g. "host.put", "lease.revoke"
+	Target string          `json:"target"`
+	Before json.RawMessage `json:"before,omitempty"`
+	After  json.RawMessage `json:"after,omitempty"`
+}
+
+// Filter selects entries in Query. Zero fields match everything.
+type Filter struct {
+	Domain string
+	Actor  string
+	Action string
+	Since  time.Time
+	Until  time.Time
+	Limit  int // newest N entries
+}
+
+func (f Filter) match(e Entry) bool {
+	return (f.Domain == "" || e.Domain == f.Domain) &&
+		(f.Actor == "" || e.Actor == f.Actor) &&
+		(f.Action == "" || e.Action == f.Action) &&
+		(f.Since.IsZero() || !e.Time.Before(f.Since)) &&
+		(f.Until.IsZero() || e.Time.Before(f.Until))
+}
+
+// Log is an append-only audit file. A nil *Log records nothing.
+type Log struct {
+	path string
+	mu   sync.Mutex
+	f    *os.File
+}
+
+// Open opens (creating if needed) the audit file at path for appending
+func Open(path string) (*Log, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("audit log: %w", err)
+	}
+	return &Log{path: path, f: f}, nil
+}
+
+// Record appends a mutation. before and after are marshaled as JSON; pass
+// nil for whichever side doesn't exist.
+func (l *Log) Record(actor, domain, action, target string, before, after any) {
+	if l == nil {
+		return
+	}
+	e := Entry{
+		Time:   time.Now().UTC(),
+		Actor:  actor,
+		Domain: domain,
+		Action: action,
+		Target: target,
+		Before: marshal(before),
+		After:  marshal(after),
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("[AUDIT] %v", err)
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.f.Write(append(line, '\n')); err != nil {
+		log.Printf("[AUDIT] Write failed: %v", err)
+	}
+}
+
+func marshal(v any) json.RawMessage {
+	if v == nil {
+		return nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// Query returns matching entries, oldest first
+func (l *Log) Query(f Filter) ([]Entry, error) {
+	if l == nil {
+		return nil, fmt.Errorf("audit log disabled")
+	}
+	file, err := os.Open(l.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	entries := []Entry{}
+	sc := bufio.NewScanner(file)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for sc.Scan() {
+		var e Entry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			continue
+		}
+		if f.match(e) {
+			entries = append(entries, e)
+		}
+	}
+	if f.Limit > 0 && len(entries) > f.Limit {
+		entries = entries[len(entries)-f.Limit:]
+	}
+	return entries, sc.Err()
+}
@@ -0,0 +1,176 @@
+// Package backup periodically snapshots server state (leases, inventory,
+// boot history, installer logs, consoles, hardware reports, attestations,
+// host certificates, pending hosts) to a directory and/or S3, and reads
+// snapshots back.
+package backup
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ars1364/go-pxe/attest"
+	"github.com/ars1364/go-pxe/cluster"
+	"github.com/ars1364/go-pxe/dhcp"
+	"github.com/ars1364/go-pxe/enroll"
+	"github.com/ars1364/go-pxe/events"
+	"github.com/ars1364/go-pxe/hardware"
+	"github.com/ars1364/go-pxe/inspect"
+	"github.com/ars1364/go-pxe/inventory"
+	"github.com/ars1364/go-pxe/pki"
+	"github.com/ars1364/go-pxe/syslog"
+)
+
+// Snapshot is everything needed to bring a server back to a known state
+type Snapshot struct {
+	Time    time.Time        `json:"time"`
+	Domains []DomainSnapshot `json:"domains"`
+	History []events.Event   `json:"history"`
+}
+
+// DomainSnapshot is the state of one provisioning domain
+type DomainSnapshot struct {
+	Name     string              `json:"name"`
+	Revision string              `json:"revision,omitempty"`
+	Leases   []dhcp.Lease        `json:"leases"`
+	Hosts    []inventory.Host    `json:"hosts"`
+	Profiles []inventory.Profile `json:"profiles"`
+
+	// Canary rollouts of profiles in progress
+	Rollouts []inventory.Rollout `json:"rollouts,omitempty"`
+
+	// Installer syslog per client
+	Logs map[string][]syslog.Message `json:"logs,omitempty"`
+
+	// Serial console output per client
+	Consoles map[string][]byte `json:"consoles,omitempty"`
+
+	// Hardware introspection reports
+	Inspections []inspect.Report `json:"inspections,omitempty"`
+
+	// Hardware inventory documents clients posted
+	Hardware []hardware.Record `json:"hardware,omitempty"`
+
+	// TPM attestations, with the keys pinned for each client
+	Attestations []attest.Report `json:"attestations,omitempty"`
+
+	// Client certificates issued to hosts (without their keys)
+	Certificates []pki.Certificate `json:"certificates,omitempty"`
+
+	// Unknown machines awaiting approval
+	Pending []enroll.Pending `json:"pending,omitempty"`
+
+	// Kubernetes clusters being formed, with their join secrets
+	Clusters []cluster.Cluster `json:"clusters,omitempty"`
+}
+
+// Domain returns the snapshot of the named domain, if present
+func (s *Snapshot) Domain(name string) (DomainSnapshot, bool) {
+	for _, d := range s.Domains {
+		if d.Name == name {
+			return d, true
+		}
+	}
+	return DomainSnapshot{}, false
+}
+
+const filePrefix = "go-pxe-"
+
+// Scheduler writes a snapshot every Interval
+type Scheduler struct {
+	Dir      string // local backup directory, may be empty if S3 is set
+	Keep     int    // local snapshots to retain, 0 keeps all
+	S3       *S3    // optional remote copy
+	Interval time.Duration
+
+	// Collect gathers the current state
+	Collect func() Snapshot
+}
+
+// Run takes a snapshot every Interval, forever
+func (s *Scheduler) Run() {
+	log.Printf("[BACKUP] Snapshotting every %s", s.Interval)
+	for {
+		time.Sleep(s.Interval)
+		if err := s.Backup(); err != nil {
+			log.Printf("[BACKUP] %v", err)
+		}
+	}
+}
+
+// Backup takes one snapshot now
+func (s *Scheduler) Backup() error {
+	snap := s.Collect()
+	snap.Time = time.Now().UTC()
+	data, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return err
+	}
+	name := filePrefix + snap.Time.Format("20060102T150405Z") + ".json"
+
+	if s.Dir != "" {
+		if err := os.MkdirAll(s.Dir, 0700); err != nil {
+			return err
+		}
+		path := filepath.Join(s.Dir, name)
+		tmp := path + ".tmp"
+		if err := os.WriteFile(tmp, data, 0600); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			return err
+		}
+		log.Printf("[BACKUP] Wrote %s (%d domains, %d events)", path, len(snap.Domains), len(snap.History))
+		s.prune()
+	}
+
+	if s.S3 != nil {
+		if err := s.S3.Put(name, data); err != nil {
+			return fmt.Errorf("S3 upload: %w", err)
+		}
+		log.Printf("[BACKUP] Uploaded %s to %s", name, s.S3)
+	}
+	return nil
+}
+
+func (s *Scheduler) prune() {
+	if s.Keep <= 0 {
+		return
+	}
+	files, _ := filepath.Glob(filepath.Join(s.Dir, filePrefix+"*.json"))
+	sort.Strings(files) // timestamped names sort chronologically
+	for len(files) > s.Keep {
+		os.Remove(files[0])
+		files = files[1:]
+	}
+}
+
+// Load reads a snapshot from a local path or an s3://bucket/key URL
+func Load(src string) (*Snapshot, error) {
+	var data []byte
+	var err error
+	if strings.HasPrefix(src, "s3://") {
+		var s3 *S3
+		var key string
+		if s3, key, err = ParseS3URL(src); err == nil {
+			data, err = s3.Get(key)
+		}
+	} else {
+		data, err = os.ReadFile(src)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var snap Snapshot
+	if err := json.NewDecoder(bytes.NewReader(data)).Decode(&snap); err != nil {
+		return nil, fmt.Errorf("%s: %w", src, err)
+	}
+	return &snap, nil
+}
@@ -0,0 +1,104 @@
+package backup
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ars1364/go-pxe/events"
+)
+
+func TestBackup(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "backups")
+	s := &Scheduler{Dir: dir, Keep: 2, Collect: func() Snapshot {
+		return Snapshot{
+			Domains: []DomainSnapshot{{Name: "lab", Revision: "abc123"}},
+			History: []events.Event{{Type: events.DHCPAck}},
+		}
+	}}
+	// Older snapshots, one past Keep
+	os.MkdirAll(dir, 0700)
+	for _, old := range []string{"go-pxe-20200101T000000Z.json", "go-pxe-20210101T000000Z.json"} {
+		os.WriteFile(filepath.Join(dir, old), []byte("{}"), 0600)
+	}
+	if err := s.Backup(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(files) != 2 || filepath.Base(files[0]) != "go-pxe-20210101T000000Z.json" {
+		t.Fatalf("files = %v", files)
+	}
+	latest := files[1]
+	if fi, _ := os.Stat(latest); fi.Mode().Perm() != 0600 {
+		t.Errorf("mode = %v", fi.Mode())
+	}
+	snap, err := Load(latest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(snap.Time) > time.Minute || len(snap.History) != 1 {
+		t.Errorf("snapshot = %+v", snap)
+	}
+	if d, ok := snap.Domain("lab"); !ok || d.Revision != "abc123" {
+		t.Errorf("Domain(lab) = %+v, %v", d, ok)
+	}
+	if _, ok := snap.Domain("other"); ok {
+		t.Error("found a missing domain")
+	}
+}
+
+func TestBackupS3(t *testing.T) {
+	store := &fakeS3{objects: make(map[string][]byte)}
+	srv := httptest.NewServer(store)
+	defer srv.Close()
+	t.Setenv("AWS_ACCESS_KEY_ID", "id")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_ENDPOINT_URL", srv.URL)
+
+	remote, prefix, err := ParseS3URL("s3://bucket/go-pxe/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote.Prefix = prefix
+	s := &Scheduler{S3: remote, Collect: func() Snapshot {
+		return Snapshot{Domains: []DomainSnapshot{{Name: "lab"}}}
+	}}
+	if err := s.Backup(); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.objects) != 1 {
+		t.Fatalf("objects = %v", store.objects)
+	}
+	for path := range store.objects {
+		snap, err := Load("s3:/" + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := snap.Domain("lab"); !ok {
+			t.Errorf("loaded %+v", snap)
+		}
+	}
+
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+	if _, err := Load("s3://bucket/missing.json"); err == nil {
+		t.Error("loaded without credentials")
+	}
+}
+
+func TestLoadMalformed(t *testing.T) {
+	dir := t.TempDir()
+	for _, data := range []string{"", "not json", `{"domains": "lab"}`, `{"time": 5}`} {
+		path := filepath.Join(dir, "snap.json")
+		os.WriteFile(path, []byte(data), 0600)
+		if _, err := Load(path); err == nil || !strings.Contains(err.Error(), path) {
+			t.Errorf("%q: error = %v", data, err)
+		}
+	}
+	if _, err := Load(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("loaded a missing file")
+	}
+}
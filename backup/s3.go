@@ -0,0 +1,176 @@
+package backup
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3 is a minimal S3 client (PUT/GET with SigV4) for backup uploads.
+// Credentials come from the standard AWS_* environment variables;
+// AWS_ENDPOINT_URL selects an S3-compatible store such as MinIO.
+type S3 struct {
+	Bucket       string
+	Prefix       string
+	Region       string
+	Endpoint     string
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+}
+
+// ParseS3URL parses s3://bucket/path and returns a client for the bucket
+// together with the path part.
+func ParseS3URL(raw string) (*S3, string, error) {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "s3" || u.Host == "" {
+		return nil, "", fmt.Errorf("invalid S3 URL %q (want s3://bucket/path)", raw)
+	}
+	s := &S3{
+		Bucket:       u.Host,
+		Region:       os.Getenv("AWS_REGION"),
+		Endpoint:     os.Getenv("AWS_ENDPOINT_URL"),
+		AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if s.Region == "" {
+		s.Region = "us-east-1"
+	}
+	if s.AccessKey == "" || s.SecretKey == "" {
+		return nil, "", fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set for S3")
+	}
+	return s, strings.TrimPrefix(u.Path, "/"), nil
+}
+
+func (s *S3) String() string {
+	return "s3://" + s.Bucket + "/" + s.Prefix
+}
+
+// Put uploads data as Prefix/name
+func (s *S3) Put(name string, data []byte) error {
+	key := strings.TrimSuffix(s.Prefix, "/")
+	if key != "" {
+		key += "/"
+	}
+	_, err := s.do(http.MethodPut, key+name, data)
+	return err
+}
+
+// Get downloads the object at key
+func (s *S3) Get(key string) ([]byte, error) {
+	return s.do(http.MethodGet, key, nil)
+}
+
+func (s *S3) do(method, key string, body []byte) ([]byte, error) {
+	var u string
+	if s.Endpoint != "" {
+		u = strings.TrimSuffix(s.Endpoint, "/") + "/" + s.Bucket + "/" + uriEncode(key)
+	} else {
+		u = fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", s.Bucket, s.Region, uriEncode(key))
+	}
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	s.sign(req, body, time.Now().UTC())
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("%s %s: %s: %s", method, key, resp.Status, bytes.TrimSpace(data))
+	}
+	return data, nil
+}
+
+// sign adds an AWS Signature Version 4 Authorization header
+func (s *S3) sign(req *http.Request, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	if s.SessionToken != "" {
+		req.Header.Set("x-amz-security-token", s.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k := range req.Header {
+		if lk := strings.ToLower(k); strings.HasPrefix(lk, "x-amz-") {
+			headers[lk] = strings.TrimSpace(req.Header.Get(k))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonHeaders strings.Builder
+	for _, k := range names {
+		canonHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonHeaders.String(),
+		signed,
+		payloadHash,
+	}, "\n")
+
+	scope := day + "/" + s.Region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonical))
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), day)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, scope, signed, sig))
+}
+
+func sha256Hex(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// uriEncode escapes everything but RFC 3986 unreserved characters and '/'
+func uriEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,67 @@
+// Package bmc powers hosts and sets their next boot device through their
+// baseboard management controller, over Redfish or IPMI.
+package bmc
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ars1364/go-pxe/inventory"
+)
+
+// Power states and actions
+const (
+	On      = "on"
+	Off     = "off"
+	Restart = "restart" // hard reset of a running machine
+)
+
+// Controller is one host's BMC
+type Controller interface {
+	// PowerState returns On or Off
+	PowerState(ctx context.Context) (string, error)
+
+	// SetPower turns the machine On or Off, or does a hard Restart
+	SetPower(ctx context.Context, action string) error
+
+	// BootPXEOnce makes the next boot, and only that one, a network boot
+	BootPXEOnce(ctx context.Context) error
+}
+
+// New returns a controller for b
+func New(b *inventory.BMC) (Controller, error) {
+	if b == nil || b.Address == "" {
+		return nil, fmt.Errorf("no BMC configured")
+	}
+	switch b.Type {
+	case "", "redfish":
+		return newRedfish(b), nil
+	case "ipmi":
+		return &ipmi{address: b.Address, username: b.Username, password: b.Secret(), uefi: b.UEFI}, nil
+	}
+	return nil, fmt.Errorf("unknown BMC type %q (want redfish or ipmi)", b.Type)
+}
+
+// Cycle restarts the machine, powering it on if it is off
+func Cycle(ctx context.Context, c Controller) error {
+	state, err := c.PowerState(ctx)
+	if err != nil {
+		return err
+	}
+	if state == Off {
+		return c.SetPower(ctx, On)
+	}
+	return c.SetPower(ctx, Restart)
+}
+
+// Reprovision network-boots the machine once, restarting or powering it
+// on as needed
+func Reprovision(ctx context.Context, c Controller) error {
+	if err := c.BootPXEOnce(ctx); err != nil {
+		return fmt.Errorf("set PXE boot: %w", err)
+	}
+	if err := Cycle(ctx, c); err != nil {
+		return fmt.Errorf("power cycle: %w", err)
+	}
+	return nil
+}
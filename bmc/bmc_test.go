@@ -0,0 +1,218 @@
+package bmc
+
+import (
+	"context"
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ars1364/go-pxe/inventory"
+)
+
+// fakeRedfish is a BMC with one system, recording the requests it gets
+type fakeRedfish struct {
+	mu       sync.Mutex
+	power    string
+	boot     map[string]string
+	requests []string
+}
+
+func (f *fakeRedfish) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+	if user, pass, _ := r.BasicAuth(); user != "admin" || pass != "calvin" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]any{"error": map[string]any{
+			"message":               "generic",
+			"@Message.ExtendedInfo": []map[string]string{{"Message": "Invalid username or password"}},
+		}})
+		return
+	}
+	switch r.Method + " " + r.URL.Path {
+	case "GET /redfish/v1/Systems":
+		json.NewEncoder(w).Encode(map[string]any{"Members": []map[string]string{{"@odata.id": "/redfish/v1/Systems/1"}}})
+	case "GET /redfish/v1/Systems/1":
+		json.NewEncoder(w).Encode(map[string]string{"PowerState": f.power})
+	case "PATCH /redfish/v1/Systems/1":
+		var body struct{ Boot map[string]string }
+		json.NewDecoder(r.Body).Decode(&body)
+		f.boot = body.Boot
+		w.WriteHeader(http.StatusNoContent)
+	case "POST /redfish/v1/Systems/1/Actions/ComputerSystem.Reset":
+		var body struct{ ResetType string }
+		json.NewDecoder(r.Body).Decode(&body)
+		switch body.ResetType {
+		case "On", "ForceRestart":
+			f.power = "On"
+		case "ForceOff":
+			f.power = "Off"
+		default:
+			http.Error(w, `{"error":{"message":"bad reset type"}}`, http.StatusBadRequest)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestRedfish(t *testing.T) {
+	tests := []struct {
+		name         string
+		power        string
+		uefi         bool
+		wantRequests []string
+		wantBoot     map[string]string
+	}{
+		{"running machine", "On", false, []string{
+			"PATCH /redfish/v1/Systems/1",
+			"GET /redfish/v1/Systems/1",
+			"POST /redfish/v1/Systems/1/Actions/ComputerSystem.Reset",
+		}, map[string]string{"BootSourceOverrideEnabled": "Once", "BootSourceOverrideTarget": "Pxe"}},
+		{"machine powering off, UEFI", "PoweringOff", true, []string{
+			"PATCH /redfish/v1/Systems/1",
+			"GET /redfish/v1/Systems/1",
+			"POST /redfish/v1/Systems/1/Actions/ComputerSystem.Reset",
+		}, map[string]string{"BootSourceOverrideEnabled": "Once", "BootSourceOverrideTarget": "Pxe", "BootSourceOverrideMode": "UEFI"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeRedfish{power: tt.power}
+			srv := httptest.NewServer(f)
+			defer srv.Close()
+			c, err := New(&inventory.BMC{Address: srv.URL + "/", Username: "admin", Password: "calvin", UEFI: tt.uefi})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := Reprovision(context.Background(), c); err != nil {
+				t.Fatal(err)
+			}
+			// The system is looked up once
+			if f.requests[0] != "GET /redfish/v1/Systems" || !slices.Equal(f.requests[1:], tt.wantRequests) {
+				t.Errorf("requests %q", f.requests)
+			}
+			if !maps.Equal(f.boot, tt.wantBoot) {
+				t.Errorf("boot override %v, want %v", f.boot, tt.wantBoot)
+			}
+			if state, err := c.PowerState(context.Background()); err != nil || state != On {
+				t.Errorf("power after reprovisioning %q, %v", state, err)
+			}
+		})
+	}
+
+	f := &fakeRedfish{power: "On"}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+	c, _ := New(&inventory.BMC{Type: "redfish", Address: srv.URL, Username: "admin", Password: "calvin"})
+	if err := c.SetPower(context.Background(), Off); err != nil {
+		t.Fatal(err)
+	}
+	if state, _ := c.PowerState(context.Background()); state != Off {
+		t.Errorf("power after Off %q", state)
+	}
+	if err := c.SetPower(context.Background(), "sleep"); err == nil {
+		t.Error("accepted an unknown action")
+	}
+
+	c, _ = New(&inventory.BMC{Address: srv.URL, Username: "admin", Password: "wrong"})
+	if _, err := c.PowerState(context.Background()); err == nil || !strings.Contains(err.Error(), "401 Unauthorized: Invalid username or password") {
+		t.Errorf("error %v, want the extended message", err)
+	}
+}
+
+func TestNew(t *testing.T) {
+	for _, b := range []*inventory.BMC{nil, {}, {Type: "amt", Address: "10.0.0.5"}} {
+		if _, err := New(b); err == nil {
+			t.Errorf("New(%+v) succeeded", b)
+		}
+	}
+	t.Setenv("GOPXE_TEST_BMC_PASSWORD", "from-env")
+	c, err := New(&inventory.BMC{Address: "10.0.0.5", Password: "from-file", PasswordEnv: "GOPXE_TEST_BMC_PASSWORD"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := c.(*redfish); r.base != "https://10.0.0.5" || r.password != "from-env" {
+		t.Errorf("redfish %+v", r)
+	}
+}
+
+// fakeIPMITool puts an ipmitool on PATH that logs its arguments and
+// password and reports the power state in the file state
+func fakeIPMITool(t *testing.T, state string) (logFile string) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a shell")
+	}
+	dir := t.TempDir()
+	logFile = filepath.Join(dir, "log")
+	os.WriteFile(filepath.Join(dir, "state"), []byte(state), 0644)
+	script := `#!/bin/sh
+echo "$* $IPMI_PASSWORD" >> ` + logFile + `
+case "$*" in
+*"power status") echo "Chassis Power is $(cat ` + filepath.Join(dir, "state") + `)" ;;
+*"power on"|*"power reset") echo on > ` + filepath.Join(dir, "state") + ` ;;
+*fail*) echo "Error: Unable to establish IPMI v2 / RMCP+ session" >&2; exit 1 ;;
+esac
+`
+	if err := os.WriteFile(filepath.Join(dir, "ipmitool"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return logFile
+}
+
+func TestIPMI(t *testing.T) {
+	tests := []struct {
+		name    string
+		address string
+		state   string
+		uefi    bool
+		want    []string
+	}{
+		{"running machine", "10.0.0.5", "on", false, []string{
+			"-I lanplus -H 10.0.0.5 -p 623 -U admin -E chassis bootdev pxe secret",
+			"-I lanplus -H 10.0.0.5 -p 623 -U admin -E chassis power status secret",
+			"-I lanplus -H 10.0.0.5 -p 623 -U admin -E chassis power reset secret",
+		}},
+		{"machine off, UEFI, own port", "10.0.0.5:6230", "off", true, []string{
+			"-I lanplus -H 10.0.0.5 -p 6230 -U admin -E chassis bootdev pxe options=efiboot secret",
+			"-I lanplus -H 10.0.0.5 -p 6230 -U admin -E chassis power status secret",
+			"-I lanplus -H 10.0.0.5 -p 6230 -U admin -E chassis power on secret",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logFile := fakeIPMITool(t, tt.state)
+			c, err := New(&inventory.BMC{Type: "ipmi", Address: tt.address, Username: "admin", Password: "secret", UEFI: tt.uefi})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := Reprovision(context.Background(), c); err != nil {
+				t.Fatal(err)
+			}
+			b, _ := os.ReadFile(logFile)
+			if got := strings.Split(strings.TrimSpace(string(b)), "\n"); !slices.Equal(got, tt.want) {
+				t.Errorf("ran\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+			if state, err := c.PowerState(context.Background()); err != nil || state != On {
+				t.Errorf("power after reprovisioning %q, %v", state, err)
+			}
+		})
+	}
+
+	fakeIPMITool(t, "off")
+	c, _ := New(&inventory.BMC{Type: "ipmi", Address: "fail", Username: "admin"})
+	if err := c.SetPower(context.Background(), Off); err == nil || !strings.Contains(err.Error(), "RMCP+ session") {
+		t.Errorf("error %v, want ipmitool's message", err)
+	}
+	if err := c.SetPower(context.Background(), "sleep"); err == nil {
+		t.Error("accepted an unknown action")
+	}
+}
@@ -0,0 +1,63 @@
+package bmc
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// ipmi drives a BMC over IPMI v2.0 (lanplus) with ipmitool
+type ipmi struct {
+	address  string
+	username string
+	password string
+	uefi     bool
+}
+
+func (i *ipmi) run(ctx context.Context, args ...string) (string, error) {
+	host, port, err := net.SplitHostPort(i.address)
+	if err != nil {
+		host, port = i.address, "623"
+	}
+	// -E reads the password from IPMI_PASSWORD, keeping it out of ps
+	cmd := exec.CommandContext(ctx, "ipmitool", append([]string{"-I", "lanplus", "-H", host, "-p", port, "-U", i.username, "-E"}, args...)...)
+	cmd.Env = append(os.Environ(), "IPMI_PASSWORD="+i.password)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("ipmitool %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
+
+func (i *ipmi) PowerState(ctx context.Context) (string, error) {
+	out, err := i.run(ctx, "chassis", "power", "status")
+	if err != nil {
+		return "", err
+	}
+	// "Chassis Power is on"
+	if strings.HasSuffix(strings.TrimSpace(out), " on") {
+		return On, nil
+	}
+	return Off, nil
+}
+
+func (i *ipmi) SetPower(ctx context.Context, action string) error {
+	arg, ok := map[string]string{On: "on", Off: "off", Restart: "reset"}[action]
+	if !ok {
+		return fmt.Errorf("unknown power action %q", action)
+	}
+	_, err := i.run(ctx, "chassis", "power", arg)
+	return err
+}
+
+func (i *ipmi) BootPXEOnce(ctx context.Context) error {
+	args := []string{"chassis", "bootdev", "pxe"}
+	if i.uefi {
+		args = append(args, "options=efiboot")
+	}
+	_, err := i.run(ctx, args...)
+	return err
+}
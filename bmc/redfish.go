@@ -0,0 +1,165 @@
+package bmc
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ars1364/go-pxe/inventory"
+)
+
+// redfish drives a BMC through the DMTF Redfish REST API
+type redfish struct {
+	base     string
+	username string
+	password string
+	uefi     bool
+	client   *http.Client
+
+	mu     sync.Mutex
+	system string // @odata.id of the computer system, found on first use
+}
+
+func newRedfish(b *inventory.BMC) *redfish {
+	base := b.Address
+	if !strings.Contains(base, "://") {
+		base = "https://" + base
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if b.Insecure {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	return &redfish{
+		base:     strings.TrimSuffix(base, "/"),
+		username: b.Username,
+		password: b.Secret(),
+		uefi:     b.UEFI,
+		client:   &http.Client{Timeout: 30 * time.Second, Transport: transport},
+	}
+}
+
+func (r *redfish) do(ctx context.Context, method, path string, body, out any) error {
+	var rd io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		rd = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, r.base+path, rd)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(r.username, r.password)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s %s: %s", method, path, redfishError(resp))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// redfishError extracts the message of a Redfish error response
+func redfishError(resp *http.Response) string {
+	var e struct {
+		Error struct {
+			Message  string `json:"message"`
+			Extended []struct {
+				Message string `json:"Message"`
+			} `json:"@Message.ExtendedInfo"`
+		} `json:"error"`
+	}
+	json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&e)
+	msg := e.Error.Message
+	if len(e.Error.Extended) > 0 {
+		msg = e.Error.Extended[0].Message
+	}
+	if msg == "" {
+		return resp.Status
+	}
+	return resp.Status + ": " + msg
+}
+
+// systemPath finds the machine's ComputerSystem resource. BMCs managing a
+// single server expose exactly one.
+func (r *redfish) systemPath(ctx context.Context) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.system != "" {
+		return r.system, nil
+	}
+	var coll struct {
+		Members []struct {
+			ID string `json:"@odata.id"`
+		} `json:"Members"`
+	}
+	if err := r.do(ctx, "GET", "/redfish/v1/Systems", nil, &coll); err != nil {
+		return "", err
+	}
+	if len(coll.Members) == 0 {
+		return "", fmt.Errorf("BMC reports no systems")
+	}
+	r.system = coll.Members[0].ID
+	return r.system, nil
+}
+
+func (r *redfish) PowerState(ctx context.Context) (string, error) {
+	sys, err := r.systemPath(ctx)
+	if err != nil {
+		return "", err
+	}
+	var s struct {
+		PowerState string `json:"PowerState"`
+	}
+	if err := r.do(ctx, "GET", sys, nil, &s); err != nil {
+		return "", err
+	}
+	// PoweringOn counts as on and PoweringOff as off: the state being
+	// reached is the one that matters for the next action
+	if strings.HasSuffix(s.PowerState, "On") {
+		return On, nil
+	}
+	return Off, nil
+}
+
+func (r *redfish) SetPower(ctx context.Context, action string) error {
+	resetType, ok := map[string]string{On: "On", Off: "ForceOff", Restart: "ForceRestart"}[action]
+	if !ok {
+		return fmt.Errorf("unknown power action %q", action)
+	}
+	sys, err := r.systemPath(ctx)
+	if err != nil {
+		return err
+	}
+	return r.do(ctx, "POST", sys+"/Actions/ComputerSystem.Reset", map[string]string{"ResetType": resetType}, nil)
+}
+
+func (r *redfish) BootPXEOnce(ctx context.Context) error {
+	sys, err := r.systemPath(ctx)
+	if err != nil {
+		return err
+	}
+	boot := map[string]string{"BootSourceOverrideEnabled": "Once", "BootSourceOverrideTarget": "Pxe"}
+	if r.uefi {
+		boot["BootSourceOverrideMode"] = "UEFI"
+	}
+	return r.do(ctx, "PATCH", sys, map[string]any{"Boot": boot}, nil)
+}
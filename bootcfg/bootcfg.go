@@ -0,0 +1,266 @@
+// Package bootcfg writes bootloader configurations that boot a profile's
+// kernel or hand the machine back to its local disk, so nobody has to keep
+// a directory of menus in step with the inventory.
+package bootcfg
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Entry boots a kernel, or the local disk if Local; paths are relative to
+// the boot server's root. FDT is a device tree blob to boot it with, and
+// FDTDir a directory of them U-Boot picks its board's from; GRUB only
+// loads FDT, and iPXE neither. With SAN, the URL of a disk image, iPXE
+// sanboots that instead; GRUB and PXELINUX can't, and leave the entry out.
+type Entry struct {
+	Title   string
+	Kernel  string
+	Initrd  []string
+	Cmdline string
+	FDT     string
+	FDTDir  string
+	SAN     string
+	Local   bool
+}
+
+// Menu is what one client boots: Entry, or its local disk if Entry is nil.
+// Comment heads the file, naming the host and why.
+//
+// With Choices, the menu is interactive instead: headed by Title, it waits
+// Timeout for a choice, or for good if Timeout is 0, and then boots
+// Choices[Default].
+type Menu struct {
+	Comment string
+	Entry   *Entry
+
+	Title   string
+	Choices []Entry
+	Default int
+	Timeout time.Duration
+}
+
+// GRUB renders m as a grub.cfg for GRUB 2 loaded over the network, whose
+// root is the boot server
+func GRUB(m Menu) []byte {
+	var b bytes.Buffer
+	comment(&b, "#", m.Comment)
+	if len(m.Choices) > 0 {
+		timeout := -1
+		if m.Timeout > 0 {
+			timeout = int((m.Timeout + time.Second - 1) / time.Second)
+		}
+		choices, def := withoutSAN(m)
+		fmt.Fprintf(&b, "set default=%d\nset timeout=%d\n", def, timeout)
+		for _, e := range choices {
+			b.WriteString("\n")
+			grubEntry(&b, e)
+		}
+		return b.Bytes()
+	}
+	b.WriteString("set timeout=0\n\n")
+	if m.Entry == nil || m.Entry.SAN != "" {
+		grubEntry(&b, Entry{Title: "Local disk", Local: true})
+	} else {
+		grubEntry(&b, *m.Entry)
+	}
+	return b.Bytes()
+}
+
+func grubEntry(b *bytes.Buffer, e Entry) {
+	fmt.Fprintf(b, "menuentry '%s' {\n", strings.ReplaceAll(e.Title, "'", ""))
+	if e.Local {
+		b.WriteString("\texit\n}\n")
+		return
+	}
+	fmt.Fprintf(b, "\tlinux %s", grubPath(e.Kernel))
+	for _, arg := range strings.Fields(e.Cmdline) {
+		fmt.Fprintf(b, " %s", grubQuote(arg))
+	}
+	b.WriteString("\n")
+	if len(e.Initrd) > 0 {
+		b.WriteString("\tinitrd")
+		for _, f := range e.Initrd {
+			fmt.Fprintf(b, " %s", grubPath(f))
+		}
+		b.WriteString("\n")
+	}
+	if e.FDT != "" {
+		fmt.Fprintf(b, "\tdevicetree %s\n", grubPath(e.FDT))
+	}
+	b.WriteString("}\n")
+}
+
+// PXELinux renders m as a pxelinux.cfg file, which U-Boot reads too (as it
+// does extlinux.conf). Paths are relative to the TFTP root; lpxelinux.0
+// also takes http:// URLs. Interactive menus are shown by menu.c32, which
+// has to be in the TFTP root.
+func PXELinux(m Menu) []byte {
+	var b bytes.Buffer
+	comment(&b, "#", m.Comment)
+	if len(m.Choices) > 0 {
+		// TIMEOUT is in tenths of a second, 0 waiting for good
+		timeout := (m.Timeout + 100*time.Millisecond - 1) / (100 * time.Millisecond)
+		fmt.Fprintf(&b, "UI menu.c32\nMENU TITLE %s\nPROMPT 0\nTIMEOUT %d\n", m.Title, timeout)
+		choices, def := withoutSAN(m)
+		for i, e := range choices {
+			b.WriteString("\n")
+			pxelinuxEntry(&b, fmt.Sprintf("entry%d", i+1), e, i == def)
+		}
+		return b.Bytes()
+	}
+	b.WriteString("PROMPT 0\nTIMEOUT 0\n")
+	if m.Entry == nil || m.Entry.SAN != "" {
+		b.WriteString("DEFAULT local\n\n")
+		pxelinuxEntry(&b, "local", Entry{Local: true}, false)
+		return b.Bytes()
+	}
+	b.WriteString("DEFAULT linux\n\n")
+	pxelinuxEntry(&b, "linux", *m.Entry, false)
+	return b.Bytes()
+}
+
+func pxelinuxEntry(b *bytes.Buffer, label string, e Entry, isDefault bool) {
+	fmt.Fprintf(b, "LABEL %s\n", label)
+	if e.Title != "" {
+		fmt.Fprintf(b, "  MENU LABEL %s\n", e.Title)
+	}
+	if isDefault {
+		b.WriteString("  MENU DEFAULT\n")
+	}
+	if e.Local {
+		b.WriteString("  LOCALBOOT 0\n")
+		return
+	}
+	fmt.Fprintf(b, "  KERNEL %s\n", root(e.Kernel))
+	if len(e.Initrd) > 0 {
+		var initrds []string
+		for _, f := range e.Initrd {
+			initrds = append(initrds, root(f))
+		}
+		fmt.Fprintf(b, "  INITRD %s\n", strings.Join(initrds, ","))
+	}
+	if e.Cmdline != "" {
+		fmt.Fprintf(b, "  APPEND %s\n", e.Cmdline)
+	}
+	if e.FDT != "" {
+		fmt.Fprintf(b, "  FDT %s\n", root(e.FDT))
+	} else if e.FDTDir != "" {
+		fmt.Fprintf(b, "  FDTDIR %s\n", root(e.FDTDir))
+	}
+}
+
+// IPXE renders m as an iPXE script. Relative paths are resolved against
+// the script's own URL, so a script fetched over HTTP loads them from the
+// HTTP root.
+func IPXE(m Menu) []byte {
+	var b bytes.Buffer
+	b.WriteString("#!ipxe\n")
+	comment(&b, "#", m.Comment)
+	if len(m.Choices) > 0 {
+		fmt.Fprintf(&b, ":menu\nmenu %s\n", m.Title)
+		for i, e := range m.Choices {
+			fmt.Fprintf(&b, "item entry%d %s\n", i+1, e.Title)
+		}
+		fmt.Fprintf(&b, "choose --default entry%d", m.Default+1)
+		if m.Timeout > 0 {
+			fmt.Fprintf(&b, " --timeout %d", m.Timeout.Milliseconds())
+		}
+		// Escape leaves for the next boot device
+		b.WriteString(" target || exit\ngoto ${target}\n")
+		for i, e := range m.Choices {
+			fmt.Fprintf(&b, "\n:entry%d\n", i+1)
+			if e.Local {
+				b.WriteString("exit\n")
+				continue
+			}
+			// Images of a choice that failed to boot go first
+			b.WriteString("imgfree\n")
+			ipxeEntry(&b, e)
+			b.WriteString(" || goto menu\n")
+		}
+		return b.Bytes()
+	}
+	if m.Entry == nil {
+		b.WriteString("exit\n")
+		return b.Bytes()
+	}
+	ipxeEntry(&b, *m.Entry)
+	b.WriteString("\n")
+	return b.Bytes()
+}
+
+// ipxeEntry loads e's kernel and initrds, up to the boot command, or
+// sanboots e's image without describing it to the OS (as in iBFT), which
+// would take the ISO for its boot disk
+func ipxeEntry(b *bytes.Buffer, e Entry) {
+	if e.SAN != "" {
+		fmt.Fprintf(b, "sanboot --no-describe %s", e.SAN)
+		return
+	}
+	fmt.Fprintf(b, "kernel %s", e.Kernel)
+	if e.Cmdline != "" {
+		fmt.Fprintf(b, " %s", e.Cmdline)
+	}
+	b.WriteString("\n")
+	for _, f := range e.Initrd {
+		fmt.Fprintf(b, "initrd %s\n", f)
+	}
+	b.WriteString("boot")
+}
+
+// withoutSAN are m's choices but those only iPXE boots, and the index of
+// the default among them
+func withoutSAN(m Menu) ([]Entry, int) {
+	var choices []Entry
+	def := 0
+	for i, e := range m.Choices {
+		if e.SAN != "" {
+			continue
+		}
+		if i == m.Default {
+			def = len(choices)
+		}
+		choices = append(choices, e)
+	}
+	return choices, def
+}
+
+func comment(b *bytes.Buffer, mark, text string) {
+	for _, line := range strings.Split(text, "\n") {
+		fmt.Fprintf(b, "%s %s\n", mark, line)
+	}
+}
+
+// grubPath roots a server path for GRUB, which names HTTP servers as
+// devices: http://10.0.0.1/vmlinuz becomes (http,10.0.0.1)/vmlinuz
+func grubPath(p string) string {
+	if rest, ok := strings.CutPrefix(p, "http://"); ok {
+		host, path, _ := strings.Cut(rest, "/")
+		return "(http," + host + ")/" + path
+	}
+	if strings.HasPrefix(p, "(") {
+		return p
+	}
+	return root(p)
+}
+
+// grubQuote quotes a kernel argument GRUB would otherwise take apart, such
+// as ds=nocloud-net;s=http://... whose ; ends the linux command. Arguments
+// with variables or quotes are left to their author.
+func grubQuote(arg string) string {
+	if !strings.ContainsAny(arg, ";&|<>") || strings.ContainsAny(arg, "'$") {
+		return arg
+	}
+	return "'" + arg + "'"
+}
+
+// root makes a server path absolute; URLs are left alone
+func root(p string) string {
+	if strings.HasPrefix(p, "/") || strings.Contains(p, "://") {
+		return p
+	}
+	return "/" + p
+}
@@ -0,0 +1,199 @@
+package bootcfg
+
+import (
+	"testing"
+	"time"
+)
+
+var alma = &Entry{
+	Title:   "Alma's 9",
+	Kernel:  "alma/vmlinuz",
+	Initrd:  []string{"alma/initrd.img", "http://10.0.0.1/extra.img"},
+	Cmdline: "ip=dhcp ds=nocloud-net;s=http://10.0.0.1/ci/ x='a;b'",
+}
+
+func TestGRUB(t *testing.T) {
+	tests := []struct {
+		name string
+		m    Menu
+		want string
+	}{
+		{"entry", Menu{Comment: "node1: alma", Entry: alma}, `# node1: alma
+set timeout=0
+
+menuentry 'Almas 9' {
+	linux /alma/vmlinuz ip=dhcp 'ds=nocloud-net;s=http://10.0.0.1/ci/' x='a;b'
+	initrd /alma/initrd.img (http,10.0.0.1)/extra.img
+}
+`},
+		{"local", Menu{Comment: "node1: installed"}, `# node1: installed
+set timeout=0
+
+menuentry 'Local disk' {
+	exit
+}
+`},
+		{"san", Menu{Comment: "x", Entry: &Entry{SAN: "http://10.0.0.1/rescue.iso"}}, `# x
+set timeout=0
+
+menuentry 'Local disk' {
+	exit
+}
+`},
+		{"fdt", Menu{Comment: "pi", Entry: &Entry{Title: "Pi", Kernel: "(tftp)/Image", FDT: "bcm.dtb", FDTDir: "dtbs"}}, `# pi
+set timeout=0
+
+menuentry 'Pi' {
+	linux (tftp)/Image
+	devicetree /bcm.dtb
+}
+`},
+		{"menu", Menu{Comment: "menu", Title: "Boot", Default: 2, Timeout: 1500 * time.Millisecond, Choices: []Entry{
+			{Title: "Rescue", SAN: "http://x/rescue.iso"}, {Title: "Disk", Local: true}, {Title: "Alma", Kernel: "/k"},
+		}}, `# menu
+set default=1
+set timeout=2
+
+menuentry 'Disk' {
+	exit
+}
+
+menuentry 'Alma' {
+	linux /k
+}
+`},
+		{"menu without timeout", Menu{Comment: "menu", Choices: []Entry{{Title: "Disk", Local: true}}}, `# menu
+set default=0
+set timeout=-1
+
+menuentry 'Disk' {
+	exit
+}
+`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(GRUB(tt.m)); got != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPXELinux(t *testing.T) {
+	tests := []struct {
+		name string
+		m    Menu
+		want string
+	}{
+		{"entry", Menu{Comment: "node1: alma", Entry: alma}, `# node1: alma
+PROMPT 0
+TIMEOUT 0
+DEFAULT linux
+
+LABEL linux
+  MENU LABEL Alma's 9
+  KERNEL /alma/vmlinuz
+  INITRD /alma/initrd.img,http://10.0.0.1/extra.img
+  APPEND ip=dhcp ds=nocloud-net;s=http://10.0.0.1/ci/ x='a;b'
+`},
+		{"local", Menu{Comment: "two\nlines"}, `# two
+# lines
+PROMPT 0
+TIMEOUT 0
+DEFAULT local
+
+LABEL local
+  LOCALBOOT 0
+`},
+		{"fdtdir", Menu{Comment: "pi", Entry: &Entry{Kernel: "Image", FDTDir: "dtbs"}}, `# pi
+PROMPT 0
+TIMEOUT 0
+DEFAULT linux
+
+LABEL linux
+  KERNEL /Image
+  FDTDIR /dtbs
+`},
+		{"menu", Menu{Comment: "menu", Title: "Boot", Default: 2, Timeout: 1550 * time.Millisecond, Choices: []Entry{
+			{Title: "Rescue", SAN: "http://x/rescue.iso"}, {Title: "Disk", Local: true}, {Title: "Alma", Kernel: "/k", FDT: "a.dtb"},
+		}}, `# menu
+UI menu.c32
+MENU TITLE Boot
+PROMPT 0
+TIMEOUT 16
+
+LABEL entry1
+  MENU LABEL Disk
+  LOCALBOOT 0
+
+LABEL entry2
+  MENU LABEL Alma
+  MENU DEFAULT
+  KERNEL /k
+  FDT /a.dtb
+`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(PXELinux(tt.m)); got != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIPXE(t *testing.T) {
+	tests := []struct {
+		name string
+		m    Menu
+		want string
+	}{
+		{"entry", Menu{Comment: "node1: alma", Entry: alma}, `#!ipxe
+# node1: alma
+kernel alma/vmlinuz ip=dhcp ds=nocloud-net;s=http://10.0.0.1/ci/ x='a;b'
+initrd alma/initrd.img
+initrd http://10.0.0.1/extra.img
+boot
+`},
+		{"local", Menu{Comment: "node1"}, `#!ipxe
+# node1
+exit
+`},
+		{"san", Menu{Comment: "x", Entry: &Entry{SAN: "http://x/rescue.iso"}}, `#!ipxe
+# x
+sanboot --no-describe http://x/rescue.iso
+`},
+		{"menu", Menu{Comment: "menu", Title: "Boot", Default: 1, Timeout: 5 * time.Second, Choices: []Entry{
+			{Title: "Rescue", SAN: "http://x/rescue.iso"}, {Title: "Disk", Local: true}, {Title: "Alma", Kernel: "/k"},
+		}}, `#!ipxe
+# menu
+:menu
+menu Boot
+item entry1 Rescue
+item entry2 Disk
+item entry3 Alma
+choose --default entry2 --timeout 5000 target || exit
+goto ${target}
+
+:entry1
+imgfree
+sanboot --no-describe http://x/rescue.iso || goto menu
+
+:entry2
+exit
+
+:entry3
+imgfree
+kernel /k
+boot || goto menu
+`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(IPXE(tt.m)); got != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
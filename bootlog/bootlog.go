@@ -0,0 +1,266 @@
+// Package bootlog keeps a persistent history of boot attempts: who booted,
+// when, with which profile and files, and how it ended. Records are
+// appended to one JSON-lines file per day so retention can drop whole days
+// without ever rewriting a record.
+package bootlog
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ars1364/go-pxe/events"
+	"github.com/ars1364/go-pxe/sessions"
+)
+
+const dayFormat = "2006-01-02"
+
+// Record is one boot attempt
+type Record struct {
+	Session   string    `json:"session"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	Domain    string    `json:"domain"`
+	Revision  string    `json:"revision,omitempty"` // definitions revision at the DHCP exchange
+	MAC       string    `json:"mac"`
+	IP        string    `json:"ip,omitempty"`
+	Host      string    `json:"host,omitempty"`
+	Profile   string    `json:"profile,omitempty"`
+	Stage     string    `json:"stage"`
+	Outcome   string    `json:"outcome"`
+	Panic     string    `json:"panic,omitempty"`    // kernel panic seen over netconsole
+	Installed time.Time `json:"installed,omitzero"` // installer's completion report
+	Files     []File    `json:"files,omitempty"`
+	Omitted   int       `json:"omitted,omitempty"` // transfers not recorded
+}
+
+// File is one TFTP transfer or HTTP request of a boot
+type File struct {
+	Time   time.Time `json:"time"`
+	Proto  string    `json:"proto"` // "tftp" or "http"
+	Path   string    `json:"path"`
+	Bytes  int64     `json:"bytes,omitempty"`
+	Status int       `json:"status,omitempty"` // HTTP only
+	Err    string    `json:"error,omitempty"`
+}
+
+// FromSession converts a finished boot session into a record
+func FromSession(s sessions.Session) Record {
+	r := Record{
+		Session: s.ID,
+		Start:   s.Start.UTC(),
+		End:     s.Last.UTC(),
+		Domain:  s.Domain,
+		MAC:     s.MAC,
+		IP:      s.IP,
+		Host:    s.Host,
+		Profile: s.Profile,
+		Stage:   s.Stage,
+		Outcome: s.Outcome,
+		Panic:   s.Panic,
+		Omitted: s.Omitted,
+	}
+	if !s.Installed.IsZero() {
+		r.Installed = s.Installed.UTC()
+	}
+	for _, e := range s.Timeline {
+		switch e.Type {
+		case events.DHCPAck:
+			r.Revision = e.Revision
+		case events.TFTPComplete, events.TFTPFailed:
+			r.Files = append(r.Files, File{Time: e.Time.UTC(), Proto: "tftp", Path: e.Path, Bytes: e.Bytes, Err: e.Err})
+		case events.HTTPRequest:
+			r.Files = append(r.Files, File{Time: e.Time.UTC(), Proto: "http", Path: e.Path, Bytes: e.Bytes, Status: e.Status})
+		}
+	}
+	return r
+}
+
+// Filter selects records in Query. Zero fields match everything.
+type Filter struct {
+	Domain  string
+	MAC     string
+	Host    string
+	Outcome string
+	Since   time.Time
+	Until   time.Time
+	Limit   int // newest N records
+}
+
+func (f Filter) match(r Record) bool {
+	return (f.Domain == "" || r.Domain == f.Domain) &&
+		(f.MAC == "" || r.MAC == f.MAC) &&
+		(f.Host == "" || r.Host == f.Host) &&
+		(f.Outcome == "" || r.Outcome == f.Outcome) &&
+		(f.Since.IsZero() || !r.Start.Before(f.Since)) &&
+		(f.Until.IsZero() || r.Start.Before(f.Until))
+}
+
+// Log is a directory of daily boot files. A nil *Log records nothing.
+type Log struct {
+	dir string
+
+	// Retention drops days older than this; zero keeps everything
+	Retention time.Duration
+
+	mu  sync.Mutex
+	day string
+	f   *os.File
+}
+
+// Open opens (creating if needed) the boot log in dir and applies
+// retention
+func Open(dir string, retention time.Duration) (*Log, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("boot log: %w", err)
+	}
+	l := &Log{dir: dir, Retention: retention}
+	l.prune(time.Now())
+	return l, nil
+}
+
+// Add appends a record to the file of the day it ends on
+func (l *Log) Add(r Record) {
+	if l == nil {
+		return
+	}
+	line, err := json.Marshal(r)
+	if err != nil {
+		log.Printf("[BOOTLOG] %v", err)
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if day := r.End.UTC().Format(dayFormat); day != l.day || l.f == nil {
+		if l.f != nil {
+			l.f.Close()
+		}
+		if l.f, err = os.OpenFile(l.file(day), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600); err != nil {
+			log.Printf("[BOOTLOG] %v", err)
+			return
+		}
+		l.day = day
+		l.prune(r.End)
+	}
+	if _, err := l.f.Write(append(line, '\n')); err != nil {
+		log.Printf("[BOOTLOG] Write failed: %v", err)
+	}
+}
+
+func (l *Log) file(day string) string {
+	return filepath.Join(l.dir, "boots-"+day+".jsonl")
+}
+
+// days lists the dates of the log's files, oldest first
+func (l *Log) days() ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(l.dir, "boots-*.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	var days []string
+	for _, m := range matches {
+		day := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(m), "boots-"), ".jsonl")
+		if _, err := time.Parse(dayFormat, day); err == nil {
+			days = append(days, day)
+		}
+	}
+	sort.Strings(days)
+	return days, nil
+}
+
+// prune deletes the files of days that ended before now-Retention
+func (l *Log) prune(now time.Time) {
+	if l.Retention <= 0 {
+		return
+	}
+	days, err := l.days()
+	if err != nil {
+		log.Printf("[BOOTLOG] %v", err)
+		return
+	}
+	cutoff := now.Add(-l.Retention).UTC()
+	for _, day := range days {
+		t, _ := time.Parse(dayFormat, day)
+		if !t.AddDate(0, 0, 1).Before(cutoff) {
+			break
+		}
+		if err := os.Remove(l.file(day)); err != nil {
+			log.Printf("[BOOTLOG] %v", err)
+			continue
+		}
+		log.Printf("[BOOTLOG] Removed %s (older than %s)", l.file(day), l.Retention)
+	}
+}
+
+// Query returns matching records, oldest first
+func (l *Log) Query(f Filter) ([]Record, error) {
+	if l == nil {
+		return nil, fmt.Errorf("boot log disabled")
+	}
+	days, err := l.days()
+	if err != nil {
+		return nil, err
+	}
+
+	records := []Record{}
+	for _, day := range days {
+		// Records are filed by the day they end, so a boot that started
+		// in range can only be in the files from Since onwards
+		if !f.Since.IsZero() && day < f.Since.UTC().Format(dayFormat) {
+			continue
+		}
+		if err := l.scan(day, f, &records); err != nil {
+			return nil, err
+		}
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Start.Before(records[j].Start) })
+	if f.Limit > 0 && len(records) > f.Limit {
+		records = records[len(records)-f.Limit:]
+	}
+	return records, nil
+}
+
+func (l *Log) scan(day string, f Filter, records *[]Record) error {
+	file, err := os.Open(l.file(day))
+	if os.IsNotExist(err) {
+		return nil // pruned meanwhile
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	sc := bufio.NewScanner(file)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for sc.Scan() {
+		var r Record
+		if err := json.Unmarshal(sc.Bytes(), &r); err != nil {
+			continue
+		}
+		if f.match(r) {
+			*records = append(*records, r)
+		}
+	}
+	return sc.Err()
+}
+
+// Close closes the current day's file
+func (l *Log) Close() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f != nil {
+		l.f.Close()
+		l.f = nil
+	}
+}
@@ -0,0 +1,119 @@
+package bootlog
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ars1364/go-pxe/events"
+	"github.com/ars1364/go-pxe/sessions"
+)
+
+func TestFromSession(t *testing.T) {
+	start := time.Date(2024, 5, 1, 10, 0, 0, 0, time.FixedZone("CEST", 2*3600))
+	r := FromSession(sessions.Session{
+		ID: "s1", Domain: "lab", MAC: "aa:bb:cc:dd:ee:01", Host: "node1", Start: start, Last: start.Add(time.Minute),
+		Stage: sessions.StageInitrd, Outcome: sessions.Succeeded, Installed: start.Add(10 * time.Minute),
+		Timeline: []events.Event{
+			{Type: events.DHCPAck, Time: start, Revision: "abc123"},
+			{Type: events.TFTPComplete, Time: start, Path: "pxelinux.0", Bytes: 42},
+			{Type: events.TFTPFailed, Time: start, Path: "ldlinux.c32", Err: "not found"},
+			{Type: events.HTTPRequest, Time: start, Path: "/vmlinuz", Bytes: 7, Status: 200},
+			{Type: events.MulticastJoin, Time: start},
+		},
+	})
+	if r.Session != "s1" || r.Revision != "abc123" || r.Start.Location() != time.UTC || r.Installed.Location() != time.UTC ||
+		!r.End.Equal(start.Add(time.Minute)) {
+		t.Errorf("record = %+v", r)
+	}
+	if len(r.Files) != 3 || r.Files[0].Proto != "tftp" || r.Files[1].Err != "not found" || r.Files[2].Proto != "http" || r.Files[2].Status != 200 {
+		t.Errorf("files = %+v", r.Files)
+	}
+	if r := FromSession(sessions.Session{}); !r.Installed.IsZero() {
+		t.Errorf("installed = %v", r.Installed)
+	}
+}
+
+func day(d int, hour int) time.Time {
+	return time.Date(2024, 5, d, hour, 0, 0, 0, time.UTC)
+}
+
+func TestLog(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	// A boot across midnight is filed by the day it ends
+	l.Add(Record{Session: "a", Domain: "lab", MAC: "m1", Host: "node1", Outcome: sessions.Succeeded, Start: day(1, 23), End: day(2, 1)})
+	l.Add(Record{Session: "b", Domain: "lab", MAC: "m2", Outcome: sessions.StalledKernel, Start: day(2, 2), End: day(2, 3)})
+	l.Add(Record{Session: "c", Domain: "other", MAC: "m1", Outcome: sessions.Succeeded, Start: day(3, 5), End: day(3, 6)})
+	l.Add(Record{Session: "d", Domain: "lab", MAC: "m1", Host: "node1", Outcome: sessions.Panicked, Start: day(1, 12), End: day(3, 7)})
+
+	if files, _ := filepath.Glob(filepath.Join(dir, "boots-*.jsonl")); len(files) != 2 {
+		t.Fatalf("files = %v", files)
+	}
+	// Other files in the directory, and torn lines, are passed over
+	os.WriteFile(filepath.Join(dir, "boots-notes.jsonl"), []byte("x"), 0600)
+	f, _ := os.OpenFile(l.file("2024-05-02"), os.O_WRONLY|os.O_APPEND, 0600)
+	f.WriteString("{\"session\": \"torn\n")
+	f.Close()
+
+	tests := []struct {
+		name string
+		f    Filter
+		want string
+	}{
+		{"all", Filter{}, "dabc"},
+		{"domain", Filter{Domain: "lab"}, "dab"},
+		{"mac", Filter{MAC: "m1"}, "dac"},
+		{"host", Filter{Host: "node1"}, "da"},
+		{"outcome", Filter{Outcome: sessions.Succeeded}, "ac"},
+		{"since", Filter{Since: day(2, 0)}, "bc"},
+		{"until", Filter{Until: day(2, 2)}, "da"},
+		{"limit", Filter{Limit: 2}, "bc"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records, err := l.Query(tt.f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := ""
+			for _, r := range records {
+				got += r.Session
+			}
+			if got != tt.want {
+				t.Errorf("Query = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetention(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now().UTC()
+	for _, age := range []int{10, 3, 1, 0} {
+		name := "boots-" + now.AddDate(0, 0, -age).Format(dayFormat) + ".jsonl"
+		os.WriteFile(filepath.Join(dir, name), nil, 0600)
+	}
+	l, err := Open(dir, 48*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	days, _ := l.days()
+	if len(days) != 2 || days[0] != now.AddDate(0, 0, -1).Format(dayFormat) {
+		t.Errorf("days kept = %v", days)
+	}
+}
+
+func TestNilLog(t *testing.T) {
+	var l *Log
+	l.Add(Record{})
+	l.Close()
+	if _, err := l.Query(Filter{}); err == nil {
+		t.Error("disabled log queried")
+	}
+}
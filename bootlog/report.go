@@ -0,0 +1,160 @@
+package bootlog
+
+import (
+	"cmp"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/ars1364/go-pxe/sessions"
+)
+
+// Report summarizes boot records: how many succeeded and failed, how long
+// installs took, which hosts failed most and which files were served most
+type Report struct {
+	Since time.Time `json:"since,omitzero"`
+	Until time.Time `json:"until,omitzero"`
+
+	Boots     int            `json:"boots"`
+	Outcomes  map[string]int `json:"outcomes"`
+	Succeeded int            `json:"succeeded"`
+	Failed    int            `json:"failed"`
+	// SuccessRate is the share of finished boots that succeeded, 0 to 1;
+	// interrupted and unfinished ones count for neither
+	SuccessRate float64 `json:"success_rate"`
+
+	// Installs are the boots whose installer reported completion, and
+	// the median and 90th percentile time from DHCP to the report
+	Installs      int           `json:"installs"`
+	InstallMedian time.Duration `json:"install_median,omitempty"`
+	InstallP90    time.Duration `json:"install_p90,omitempty"`
+
+	FailingHosts []HostFailures `json:"failing_hosts"`
+	Assets       []AssetCount   `json:"assets"`
+	Days         []DayCount     `json:"days"`
+}
+
+// HostFailures is how often one host, or MAC address outside the
+// inventory, failed to boot
+type HostFailures struct {
+	Host     string    `json:"host,omitempty"`
+	MAC      string    `json:"mac"`
+	Boots    int       `json:"boots"`
+	Failures int       `json:"failures"`
+	Last     string    `json:"last"` // outcome of the last failure
+	LastTime time.Time `json:"last_time"`
+}
+
+// AssetCount is how often a file was served
+type AssetCount struct {
+	Proto string `json:"proto"`
+	Path  string `json:"path"`
+	Count int    `json:"count"`
+	Bytes int64  `json:"bytes"`
+}
+
+// DayCount is the boots started on one day, in UTC
+type DayCount struct {
+	Day       string `json:"day"`
+	Boots     int    `json:"boots"`
+	Succeeded int    `json:"succeeded"`
+	Failed    int    `json:"failed"`
+}
+
+// Failed reports whether the outcome is a failed boot, rather than a
+// success or one that didn't finish
+func Failed(outcome string) bool {
+	switch outcome {
+	case sessions.Succeeded, sessions.InProgress, sessions.Interrupted:
+		return false
+	}
+	return true
+}
+
+// Summarize reports on records, keeping the top hosts and files of each
+// list
+func Summarize(records []Record, top int) Report {
+	rep := Report{Outcomes: make(map[string]int), FailingHosts: []HostFailures{}, Assets: []AssetCount{}, Days: []DayCount{}}
+	hosts := make(map[string]*HostFailures)
+	assets := make(map[[2]string]*AssetCount)
+	days := make(map[string]*DayCount)
+	var installs []time.Duration
+	for _, r := range records {
+		rep.Boots++
+		rep.Outcomes[r.Outcome]++
+		day := days[r.Start.UTC().Format(dayFormat)]
+		if day == nil {
+			day = &DayCount{Day: r.Start.UTC().Format(dayFormat)}
+			days[day.Day] = day
+		}
+		day.Boots++
+
+		key := cmp.Or(r.Host, r.MAC)
+		h := hosts[key]
+		if h == nil {
+			h = &HostFailures{Host: r.Host, MAC: r.MAC}
+			hosts[key] = h
+		}
+		h.Boots++
+		switch {
+		case r.Outcome == sessions.Succeeded:
+			rep.Succeeded++
+			day.Succeeded++
+		case Failed(r.Outcome):
+			rep.Failed++
+			day.Failed++
+			h.Failures++
+			if !r.Start.Before(h.LastTime) {
+				h.Last, h.LastTime, h.MAC = r.Outcome, r.Start, r.MAC
+			}
+		}
+
+		if !r.Installed.IsZero() {
+			installs = append(installs, r.Installed.Sub(r.Start))
+		}
+		for _, f := range r.Files {
+			if f.Err != "" || (f.Proto == "http" && f.Status != http.StatusOK && f.Status != http.StatusPartialContent) {
+				continue
+			}
+			a := assets[[2]string{f.Proto, f.Path}]
+			if a == nil {
+				a = &AssetCount{Proto: f.Proto, Path: f.Path}
+				assets[[2]string{f.Proto, f.Path}] = a
+			}
+			a.Count++
+			a.Bytes += f.Bytes
+		}
+	}
+	if n := rep.Succeeded + rep.Failed; n > 0 {
+		rep.SuccessRate = float64(rep.Succeeded) / float64(n)
+	}
+	if rep.Installs = len(installs); rep.Installs > 0 {
+		slices.Sort(installs)
+		rep.InstallMedian = installs[len(installs)/2]
+		rep.InstallP90 = installs[len(installs)*9/10]
+	}
+
+	for _, h := range hosts {
+		if h.Failures > 0 {
+			rep.FailingHosts = append(rep.FailingHosts, *h)
+		}
+	}
+	slices.SortFunc(rep.FailingHosts, func(a, b HostFailures) int {
+		return cmp.Or(cmp.Compare(b.Failures, a.Failures), b.LastTime.Compare(a.LastTime))
+	})
+	for _, a := range assets {
+		rep.Assets = append(rep.Assets, *a)
+	}
+	slices.SortFunc(rep.Assets, func(a, b AssetCount) int {
+		return cmp.Or(cmp.Compare(b.Count, a.Count), cmp.Compare(b.Bytes, a.Bytes), cmp.Compare(a.Path, b.Path))
+	})
+	if top > 0 {
+		rep.FailingHosts = rep.FailingHosts[:min(top, len(rep.FailingHosts))]
+		rep.Assets = rep.Assets[:min(top, len(rep.Assets))]
+	}
+	for _, d := range days {
+		rep.Days = append(rep.Days, *d)
+	}
+	slices.SortFunc(rep.Days, func(a, b DayCount) int { return cmp.Compare(a.Day, b.Day) })
+	return rep
+}
@@ -0,0 +1,73 @@
+package bootlog
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ars1364/go-pxe/sessions"
+)
+
+func TestFailed(t *testing.T) {
+	for outcome, want := range map[string]bool{
+		sessions.Succeeded:     false,
+		sessions.InProgress:    false,
+		sessions.Interrupted:   false,
+		sessions.StalledKernel: true,
+		sessions.Panicked:      true,
+	} {
+		if Failed(outcome) != want {
+			t.Errorf("Failed(%s) = %v", outcome, !want)
+		}
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	kernel := File{Proto: "tftp", Path: "vmlinuz", Bytes: 100}
+	records := []Record{
+		{MAC: "m1", Host: "node1", Outcome: sessions.Succeeded, Start: day(1, 10), Installed: day(1, 10).Add(10 * time.Minute),
+			Files: []File{kernel, {Proto: "http", Path: "/ks.cfg", Bytes: 5, Status: 200}}},
+		{MAC: "m1", Host: "node1", Outcome: sessions.StalledInitrd, Start: day(1, 11), Files: []File{kernel}},
+		{MAC: "m9", Host: "node1", Outcome: sessions.Panicked, Start: day(2, 9),
+			Files: []File{kernel, {Proto: "http", Path: "/missing", Status: 404}, {Proto: "tftp", Path: "x", Err: "timeout"}}},
+		{MAC: "m2", Outcome: sessions.NoBootloader, Start: day(2, 12)},
+		{MAC: "m3", Host: "node3", Outcome: sessions.Succeeded, Start: day(2, 13), Installed: day(2, 13).Add(20 * time.Minute)},
+		{MAC: "m3", Host: "node3", Outcome: sessions.Interrupted, Start: day(2, 14)},
+	}
+	rep := Summarize(records, 0)
+	if rep.Boots != 6 || rep.Succeeded != 2 || rep.Failed != 3 || rep.SuccessRate != 0.4 || rep.Outcomes[sessions.Succeeded] != 2 {
+		t.Errorf("report = %+v", rep)
+	}
+	if rep.Installs != 2 || rep.InstallMedian != 20*time.Minute || rep.InstallP90 != 20*time.Minute {
+		t.Errorf("installs %d, median %s, p90 %s", rep.Installs, rep.InstallMedian, rep.InstallP90)
+	}
+
+	if len(rep.FailingHosts) != 2 {
+		t.Fatalf("failing hosts = %+v", rep.FailingHosts)
+	}
+	if h := rep.FailingHosts[0]; h.Host != "node1" || h.MAC != "m9" || h.Boots != 3 || h.Failures != 2 || h.Last != sessions.Panicked {
+		t.Errorf("worst host = %+v", h)
+	}
+	if h := rep.FailingHosts[1]; h.Host != "" || h.MAC != "m2" || h.Failures != 1 {
+		t.Errorf("second host = %+v", h)
+	}
+
+	if len(rep.Assets) != 2 || rep.Assets[0] != (AssetCount{Proto: "tftp", Path: "vmlinuz", Count: 3, Bytes: 300}) || rep.Assets[1].Path != "/ks.cfg" {
+		t.Errorf("assets = %+v", rep.Assets)
+	}
+	if len(rep.Days) != 2 || rep.Days[0] != (DayCount{Day: "2024-05-01", Boots: 2, Succeeded: 1, Failed: 1}) ||
+		rep.Days[1] != (DayCount{Day: "2024-05-02", Boots: 4, Succeeded: 1, Failed: 2}) {
+		t.Errorf("days = %+v", rep.Days)
+	}
+
+	top := Summarize(records, 1)
+	if len(top.FailingHosts) != 1 || len(top.Assets) != 1 {
+		t.Errorf("top 1 = %+v, %+v", top.FailingHosts, top.Assets)
+	}
+}
+
+func TestSummarizeNothing(t *testing.T) {
+	rep := Summarize(nil, 5)
+	if rep.Boots != 0 || rep.SuccessRate != 0 || rep.FailingHosts == nil || rep.Assets == nil || rep.Days == nil {
+		t.Errorf("report = %+v", rep)
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"log"
+	"maps"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/ars1364/go-pxe/bootcfg"
+	"github.com/ars1364/go-pxe/dhcp"
+	"github.com/ars1364/go-pxe/inventory"
+)
+
+// efiArch names the Secure Boot chain for a UEFI client architecture
+// (DHCP option 93), as in shimx64.efi and grubaa64.efi
+var efiArch = map[uint16]string{7: "x64", 9: "x64", 11: "aa64"}
+
+// checkSecureBoot finds the architectures the domain's Secure Boot
+// directory has a signed shim and GRUB for
+func (d *domain) checkSecureBoot() error {
+	d.secureBoot = make(map[string]bool)
+	var found []string
+	for _, arch := range []string{"x64", "aa64"} {
+		ok := true
+		for _, f := range []string{"shim" + arch + ".efi", "grub" + arch + ".efi"} {
+			if _, err := os.Stat(filepath.Join(d.cfg.SecureBoot, arch, f)); err != nil {
+				ok = false
+			}
+		}
+		if ok {
+			d.secureBoot[arch] = true
+			found = append(found, arch)
+		}
+	}
+	if len(found) == 0 {
+		return fmt.Errorf("secure boot: %s has neither x64/shimx64.efi and x64/grubx64.efi nor aa64/shimaa64.efi and aa64/grubaa64.efi", d.cfg.SecureBoot)
+	}
+	log.Printf("[TFTP] %s: Secure Boot chain for %s from %s", d.cfg.Name, strings.Join(found, ", "), d.cfg.SecureBoot)
+	return nil
+}
+
+// secureBootFile is the shim UEFI clients of arch start from, if the
+// domain has a Secure Boot chain for it. Shim loads GRUB from the same
+// directory, and GRUB its grub.cfg from there.
+func (d *domain) secureBootFile(arch uint16) string {
+	a := efiArch[arch]
+	if !d.secureBoot[a] {
+		return ""
+	}
+	return "secureboot/" + a + "/shim" + a + ".efi"
+}
+
+// archBootFile is the default boot file of the client with mac and arch:
+// the Secure Boot shim, iPXE with go-pxe's script embedded, netboot.xyz's
+// iPXE if it has nothing to boot, or the architecture's boot file
+func (d *domain) archBootFile(mac net.HardwareAddr, arch uint16) string {
+	if f := d.secureBootFile(arch); f != "" {
+		return f
+	}
+	if d.cfg.IPXE {
+		if f := ipxeBuild(d.cfg.TFTPRoot, arch); f != "" {
+			return f
+		}
+	}
+	if d.netbootxyz != nil && d.profileless(mac) {
+		if f := d.netbootxyz.BootFile(arch); f != "" {
+			return f
+		}
+	}
+	return d.defaultBootFile(dhcp.ArchName(arch))
+}
+
+// defaultBootFile is the domain's boot file for clients of arch, such as
+// efi-arm64 (see dhcp.ArchName)
+func (d *domain) defaultBootFile(arch string) string {
+	return cmp.Or(dhcp.ArchBootFile(d.cfg.bootFiles(), arch), d.cfg.BootFile)
+}
+
+// bootFiles are the domain's boot files by architecture: those of
+// BootFileARM64 and BootFileRISCV64, replaced by BootFiles' own
+func (c domainConfig) bootFiles() map[string]string {
+	files := map[string]string{"efi-arm64": c.BootFileARM64, "efi-riscv64": c.BootFileRISCV64}
+	maps.Copy(files, c.BootFiles)
+	maps.DeleteFunc(files, func(_, f string) bool { return f == "" })
+	return files
+}
+
+// parseBootFiles reads -boot-files, such as
+// "bios=undionly.kpxe,efi-ia32=ipxe32.efi"
+func parseBootFiles(s string) (map[string]string, error) {
+	files := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		if kv = strings.TrimSpace(kv); kv == "" {
+			continue
+		}
+		arch, file, ok := strings.Cut(kv, "=")
+		if !ok || file == "" {
+			return nil, fmt.Errorf("%q is not arch=file", kv)
+		}
+		files[arch] = file
+	}
+	return files, checkBootFiles(files)
+}
+
+// checkBootFiles checks that files are for known architectures
+func checkBootFiles(files map[string]string) error {
+	for arch := range files {
+		if !slices.Contains(inventory.Arches, arch) {
+			return fmt.Errorf("unknown architecture %q (known: %s)", arch, strings.Join(inventory.Arches, ", "))
+		}
+	}
+	return nil
+}
+
+// menuItem is a choice of the domain's firmware boot menu
+type menuItem struct {
+	Label    string `yaml:"label"`
+	BootFile string `yaml:"bootFile"` // empty boots from the local disk
+}
+
+// bootMenu is the domain's firmware boot menu as the DHCP server takes it
+func (c domainConfig) bootMenu() []dhcp.MenuItem {
+	var items []dhcp.MenuItem
+	for _, m := range c.BootMenu {
+		items = append(items, dhcp.MenuItem{Label: m.Label, BootFile: m.BootFile})
+	}
+	return items
+}
+
+// checkBootMenu checks that the domain's boot menu fits in a DHCP reply
+func (c domainConfig) checkBootMenu() error {
+	for _, m := range c.BootMenu {
+		if m.Label == "" {
+			return fmt.Errorf("boot menu item without a label")
+		}
+	}
+	return dhcp.CheckMenu(c.bootMenu(), cmp.Or(c.MenuPrompt, dhcp.DefaultMenuPrompt))
+}
+
+// parseBootMenu reads -boot-menu, such as
+// "Install Ubuntu=ubuntu/lpxelinux.0,Rescue=rescue.0,Local boot="
+func parseBootMenu(s string) ([]menuItem, error) {
+	var items []menuItem
+	for _, kv := range strings.Split(s, ",") {
+		if kv = strings.TrimSpace(kv); kv == "" {
+			continue
+		}
+		label, file, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q is not label=file (or label= to boot from disk)", kv)
+		}
+		items = append(items, menuItem{Label: label, BootFile: file})
+	}
+	return items, nil
+}
+
+// profileless reports whether the client with mac has no profile to boot,
+// not even the discovery profile
+func (d *domain) profileless(mac net.HardwareAddr) bool {
+	h, p, _ := d.store.ProfileFor(mac)
+	return p.Name == "" && (h.Name != "" || d.cfg.Discovery == "")
+}
+
+// generate backs the TFTP and HTTP servers' missing files: the Secure Boot
+// chain, a grub.cfg in any directory, for whichever prefix the client's
+// GRUB was built with, pxelinux.cfg and extlinux.conf files, boot.ipxe and
+// the files of Windows, ESXi, firmware update, ISO and Raspberry Pi boots
+func (d *domain) generate(name string, ip net.IP) ([]byte, bool) {
+	if rest, ok := strings.CutPrefix(name, "secureboot/"); ok && d.cfg.SecureBoot != "" {
+		data, err := os.ReadFile(filepath.Join(d.cfg.SecureBoot, filepath.FromSlash(rest)))
+		return data, err == nil
+	}
+	switch {
+	case path.Base(name) == "grub.cfg":
+		if m, ok := d.bootMenu(d.leaseMAC(ip), ip.String()); ok {
+			return bootcfg.GRUB(m), true
+		}
+	case path.Base(name) == "extlinux.conf" || pxelinuxDefault(name):
+		if m, ok := d.bootMenu(d.leaseMAC(ip), ip.String()); ok {
+			return bootcfg.PXELinux(m), true
+		}
+	case name == "boot.ipxe":
+		mac := d.leaseMAC(ip)
+		if m, ok := d.bootMenu(mac, ip.String()); ok {
+			return bootcfg.IPXE(m), true
+		}
+		if d.netbootxyz != nil && d.profileless(mac) {
+			return d.netbootxyz.Script(fmt.Sprintf("%s, netboot.xyz (generated by go-pxe)", ip)), true
+		}
+	case strings.HasPrefix(name, "windows/"):
+		return d.generateWindows(name, ip)
+	case strings.HasPrefix(name, "esxi/"):
+		return d.generateESXi(name, ip)
+	case strings.HasPrefix(name, "firmware/"):
+		return d.generateFirmware(name, ip)
+	case strings.HasPrefix(name, "media/"):
+		return d.generateMedia(name)
+	case path.Base(path.Dir(name)) == "pxelinux.cfg" && strings.HasPrefix(path.Base(name), "01-"):
+		// Only for hosts; pxelinux falls back to default for the rest
+		mac, err := net.ParseMAC(strings.ReplaceAll(strings.TrimPrefix(path.Base(name), "01-"), "-", ":"))
+		if _, known := d.store.HostByMAC(mac); err != nil || !known {
+			return nil, false
+		}
+		if m, ok := d.bootMenu(mac, ""); ok {
+			return bootcfg.PXELinux(m), true
+		}
+	case piDir.MatchString(name):
+		return d.generateRaspberryPi(name, ip)
+	}
+	return nil, false
+}
+
+// pxelinuxDefault reports whether name is a pxelinux.cfg file every client
+// may ask for: default or, from U-Boot, default-<arch>[-<soc>], in any
+// directory, as U-Boot looks beside its boot file
+func pxelinuxDefault(name string) bool {
+	base := path.Base(name)
+	return path.Base(path.Dir(name)) == "pxelinux.cfg" && (base == "default" || strings.HasPrefix(base, "default-"))
+}
+
+// profileAt is the profile the client at ip boots, the discovery profile
+// if it is unknown, and who it is for comments and logs
+func (d *domain) profileAt(ip net.IP) (string, inventory.Profile) {
+	h, p, _ := d.store.ProfileFor(d.leaseMAC(ip))
+	if h.Name == "" {
+		p, _ = d.store.Profile(d.cfg.Discovery)
+		return "unknown client " + ip.String(), p
+	}
+	return h.Name, p
+}
+
+// leaseMAC is the hardware address leased ip, if any
+func (d *domain) leaseMAC(ip net.IP) net.HardwareAddr {
+	for _, l := range d.dhcp.Leases() {
+		if ip.Equal(net.ParseIP(l.IP)) {
+			mac, _ := net.ParseMAC(l.MAC)
+			return mac
+		}
+	}
+	return nil
+}
+
+// leaseIP is the address leased to mac, if any
+func (d *domain) leaseIP(mac net.HardwareAddr) net.IP {
+	for _, l := range d.dhcp.Leases() {
+		if l.MAC == mac.String() {
+			return net.ParseIP(l.IP)
+		}
+	}
+	return nil
+}
+
+// cmdline renders the kernel command line c for the client with mac. It
+// is a template like those in the HTTP root, as in
+// inst.ks=http://10.0.0.1:8080/ks.cfg?token={{ .Token }}.
+func (d *domain) cmdline(mac net.HardwareAddr, c string) string {
+	if !strings.Contains(c, "{{") {
+		return c
+	}
+	out, err := d.render("cmdline", []byte(c), d.leaseIP(mac))
+	if err != nil {
+		log.Printf("[TFTP] %s: Kernel command line for %s: %v", d.cfg.Name, mac, err)
+		return c
+	}
+	return strings.Join(strings.Fields(string(out)), " ")
+}
+
+// clientArch is the architecture the client with mac last reported to
+// DHCP, such as efi-x64, or "" if it is unknown
+func (d *domain) clientArch(mac net.HardwareAddr) string {
+	for _, l := range d.dhcp.Leases() {
+		if l.MAC == mac.String() {
+			return l.Arch
+		}
+	}
+	return ""
+}
+
+// bootMenu is what the client with mac, at addr if known, boots: its local
+// disk if it is kept from being provisioned, else its profile's or the
+// discovery profile's kernel, or ISO to sanboot. It reports false if there
+// is neither.
+func (d *domain) bootMenu(mac net.HardwareAddr, addr string) (bootcfg.Menu, bool) {
+	h, p, _ := d.store.ProfileFor(mac)
+	if why := diskBoot(h, p); why != "" {
+		return bootcfg.Menu{Comment: h.Name + " " + why}, true
+	}
+	who := h.Name
+	if h.Name == "" {
+		p, _ = d.store.Profile(d.cfg.Discovery)
+		who = strings.TrimSpace("unknown client " + addr)
+	}
+	comment := fmt.Sprintf("%s, profile %s (generated by go-pxe)", who, p.Name)
+	arch := d.clientArch(mac)
+	if p.Menu != nil {
+		return d.choiceMenu(comment, mac, h, p, arch), true
+	}
+	p = p.ForArch(arch).Booted(d.cfg.httpURL())
+	if san := p.SAN(d.cfg.httpURL()); san != "" {
+		return bootcfg.Menu{Comment: comment, Entry: &bootcfg.Entry{Title: p.Name, SAN: san}}, true
+	}
+	if p.Kernel == "" {
+		return bootcfg.Menu{}, false
+	}
+	initrd := p.Initrd
+	if p.WinPE != nil {
+		initrd = append(slices.Clip(initrd), winpeFiles...)
+		if p.WinPE.Unattend != "" {
+			initrd = append(initrd, "windows/unattend.xml")
+		}
+	}
+	return bootcfg.Menu{
+		Comment: comment,
+		Entry:   &bootcfg.Entry{Title: p.Name, Kernel: p.Kernel, Initrd: initrd, Cmdline: d.cmdline(mac, p.Cmdline), FDT: cmp.Or(h.FDT, p.FDT), FDTDir: p.FDTDir},
+	}, true
+}
+
+// choiceMenu is the interactive menu of profile p for host h, with mac and
+// of arch. Entries without a profile for arch are left out, as are those
+// whose profile is missing or boots neither a kernel nor an ISO, and
+// Windows installations, whose files are generated for the host's own
+// profile.
+func (d *domain) choiceMenu(comment string, mac net.HardwareAddr, h inventory.Host, p inventory.Profile, arch string) bootcfg.Menu {
+	m := bootcfg.Menu{Comment: comment, Title: cmp.Or(p.Menu.Title, p.Name)}
+	m.Timeout, _ = p.Menu.Wait()
+	for _, e := range p.Menu.Entries {
+		name := e.ProfileFor(arch)
+		switch {
+		case e.LocalBoot:
+			m.Choices = append(m.Choices, bootcfg.Entry{Title: e.Title, Local: true})
+		case name == "":
+			continue
+		default:
+			ep, ok := d.store.Profile(name)
+			ep = ep.ForArch(arch).Booted(d.cfg.httpURL())
+			san := ep.SAN(d.cfg.httpURL())
+			if !ok || (ep.Kernel == "" && san == "") || ep.WinPE != nil || ep.Menu != nil {
+				log.Printf("[TFTP] %s: Menu %s: profile %s of %q boots no kernel", d.cfg.Name, p.Name, name, e.Title)
+				continue
+			}
+			m.Choices = append(m.Choices, bootcfg.Entry{Title: e.Title, Kernel: ep.Kernel, Initrd: ep.Initrd, Cmdline: d.cmdline(mac, ep.Cmdline), FDT: cmp.Or(h.FDT, ep.FDT), FDTDir: ep.FDTDir, SAN: san})
+		}
+		if e.Title == p.Menu.Default {
+			m.Default = len(m.Choices) - 1
+		}
+	}
+	return m
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ars1364/go-pxe/assets"
+)
+
+// assetRefs maps the files and directories the profiles boot from to the
+// profiles
+func (d *domain) assetRefs() assets.Refs {
+	refs := assets.Refs{Files: make(map[string][]string), Dirs: make(map[string][]string)}
+	for _, p := range d.store.Profiles() {
+		files, dirs := p.Files()
+		for _, f := range files {
+			refs.Files[f] = append(refs.Files[f], p.Name)
+		}
+		for _, dir := range dirs {
+			refs.Dirs[dir] = append(refs.Dirs[dir], p.Name)
+		}
+	}
+	return refs
+}
+
+// listAssets lists the files in the domain's roots, or with a profile only
+// those it boots with, missing ones included
+func (d *domain) listAssets(profile string) ([]assets.Item, error) {
+	refs := d.assetRefs()
+	var match func(string) bool
+	if profile != "" {
+		match = func(rel string) bool { return slices.Contains(refs.Profiles(rel), profile) }
+	}
+	return d.index.List(refs, match)
+}
+
+// runAssets lists what a running server's boot roots hold through its
+// management API:
+//
+//	go-pxe assets [-api http://127.0.0.1:9090] [-domain default] [-profile name] [-json]
+//
+// With -profile it shows what that profile's menu entry serves, and which
+// of its files are missing.
+func runAssets(args []string) {
+	fs := flag.NewFlagSet("assets", flag.ExitOnError)
+	apiURL := fs.String("api", "http://127.0.0.1:9090", "Management API of the server")
+	token := fs.String("token", os.Getenv("GOPXE_API_TOKEN"), "API bearer token (default from GOPXE_API_TOKEN)")
+	domain := fs.String("domain", "default", "Provisioning domain whose roots to list")
+	profile := fs.String("profile", "", "Only list the files this profile boots with")
+	asJSON := fs.Bool("json", false, "Print the catalog as JSON")
+	fs.Parse(args)
+
+	c := newAPIClient(*apiURL, *domain, *token, time.Minute)
+	path := "/assets"
+	if *profile != "" {
+		path += "?profile=" + url.QueryEscape(*profile)
+	}
+	var items []assets.Item
+	if err := c.get(path, &items); err != nil {
+		log.Fatal(err)
+	}
+	var index assets.IndexStatus
+	if err := c.get("/assets/index", &index); err == nil && index.Scanned.IsZero() {
+		fmt.Fprintf(os.Stderr, "Still indexing the roots: %d files so far, missing files not listed yet\n", index.Files)
+	}
+	if *asJSON {
+		json.NewEncoder(os.Stdout).Encode(items)
+		return
+	}
+	for _, it := range items {
+		if it.Missing {
+			fmt.Printf("%-9s  %-48s  missing, used by %s\n", "", it.Path, strings.Join(it.Profiles, ","))
+			continue
+		}
+		verified, served := "local", "never served"
+		if it.Source != nil {
+			verified = it.Source.Level
+		}
+		if !it.Served.IsZero() {
+			served = "served " + it.Served.Local().Format(time.DateTime)
+		}
+		used := "unused"
+		if len(it.Profiles) > 0 {
+			used = "used by " + strings.Join(it.Profiles, ",")
+		}
+		fmt.Printf("%-9s  %-48s  %8d KiB  %.12s  %-10s  %s, %s\n", it.Root, it.Path, it.Size>>10, it.SHA256, verified, served, used)
+	}
+}
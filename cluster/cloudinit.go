@@ -0,0 +1,98 @@
+package cluster
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// k3sInstall fetches and runs the k3s installer
+const k3sInstall = "curl -sfL https://get.k3s.io |"
+
+// MetaData is the NoCloud meta-data for host
+func MetaData(c Cluster, host string) []byte {
+	return fmt.Appendf(nil, "instance-id: go-pxe-%s-%s\nlocal-hostname: %s\n", c.Name, host, host)
+}
+
+// UserData is the cloud-config for host, one of c's members, talking back
+// to go-pxe at server (http://host:port). The first control plane runs its
+// script right away; the others poll for theirs until it is their turn.
+// Either way the outcome is reported back.
+func UserData(c Cluster, host, server string) []byte {
+	m := c.Members[host]
+	fetch := fmt.Sprintf("until curl -sf -o /run/go-pxe-join.sh %s/cluster/join; do sleep 15; done", server)
+	if m.Role == Init {
+		fetch = fmt.Sprintf("cat > /run/go-pxe-join.sh <<'EOF'\n%sEOF", Script(c, host, server))
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "#cloud-config\n# %s of %s cluster %s (generated by go-pxe)\n", m.Role, c.Kind, c.Name)
+	b.WriteString("write_files:\n  - path: /usr/local/sbin/go-pxe-join\n    permissions: '0700'\n    content: |\n")
+	for _, line := range []string{
+		"#!/bin/sh",
+		fetch,
+		"if ! sh -e /run/go-pxe-join.sh > /var/log/go-pxe-join.log 2>&1; then",
+		fmt.Sprintf("  tail -c 2000 /var/log/go-pxe-join.log | curl -sf --data-urlencode error@- %s/cluster/failed", server),
+		"  exit 1",
+		"fi",
+	} {
+		for _, l := range strings.Split(line, "\n") {
+			b.WriteString("      " + l + "\n")
+		}
+	}
+	b.WriteString("runcmd:\n  - [/usr/local/sbin/go-pxe-join]\n")
+	return []byte(b.String())
+}
+
+// Script is the shell script with which host creates or joins c, ending
+// with its report to go-pxe at server
+func Script(c Cluster, host, server string) string {
+	m := c.Members[host]
+	var cmd, report string
+	switch {
+	case c.Kind == Kubeadm && m.Role == Init:
+		// A stable endpoint lets further control planes join
+		cmd = "kubeadm init --upload-certs --control-plane-endpoint " + c.APIServer() +
+			" --token " + c.Token + " --certificate-key " + c.CertificateKey
+		if c.Version != "" {
+			cmd += " --kubernetes-version " + c.Version
+		}
+		cmd += args(c) + "\n" +
+			"hash=$(openssl x509 -pubkey -noout -in /etc/kubernetes/pki/ca.crt | openssl pkey -pubin -outform der | sha256sum | cut -d' ' -f1)"
+		report = "-d caCertHash=sha256:$hash "
+	case c.Kind == Kubeadm:
+		cmd = "kubeadm join " + c.APIServer() + " --token " + c.Token + " --discovery-token-ca-cert-hash " + c.CACertHash
+		if m.Role == ControlPlane {
+			cmd += " --control-plane --certificate-key " + c.CertificateKey
+		}
+	case m.Role == Worker:
+		cmd = k3sInstall + k3sEnv(c) + " K3S_URL=https://" + c.APIServer() + " sh -s - agent"
+	default:
+		cmd = k3sInstall + k3sEnv(c) + " sh -s - server"
+		if m.Role == Init {
+			cmd += " --cluster-init"
+			if host, _, err := net.SplitHostPort(c.APIServer()); err == nil && c.Endpoint != "" {
+				cmd += " --tls-san " + host
+			}
+		} else {
+			cmd += " --server https://" + c.APIServer()
+		}
+		cmd += args(c) + "\n" +
+			"until k3s kubectl get --raw /readyz; do sleep 5; done"
+	}
+	return fmt.Sprintf("# %s of cluster %s\n%s\ncurl -sf %s-X POST %s/cluster/ready\n", m.Role, c.Name, cmd, report, server)
+}
+
+func k3sEnv(c Cluster) string {
+	env := " K3S_TOKEN=" + c.Token
+	if c.Version != "" {
+		env = " INSTALL_K3S_VERSION=" + c.Version + env
+	}
+	return env
+}
+
+func args(c Cluster) string {
+	if c.Args == "" {
+		return ""
+	}
+	return " " + c.Args
+}
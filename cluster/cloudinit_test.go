@@ -0,0 +1,105 @@
+package cluster
+
+import (
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func formed(t *testing.T, c Cluster) Cluster {
+	t.Helper()
+	s := NewStore()
+	c, err := s.Put(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, _, _ = s.Provisioned(c.ControlPlanes[0], "10.0.0.1")
+	return c
+}
+
+func TestScript(t *testing.T) {
+	kubeadm := formed(t, Cluster{Name: "prod", Kind: Kubeadm, Version: "v1.30.0", Args: "--pod-network-cidr=10.244.0.0/16",
+		ControlPlanes: []string{"cp1", "cp2"}, Workers: []string{"w1"}})
+	kubeadm.CACertHash = caHash
+	k3s := formed(t, Cluster{Name: "edge", Kind: K3s, Endpoint: "lb:7443", ControlPlanes: []string{"cp1", "cp2"}, Workers: []string{"w1"}})
+
+	tests := []struct {
+		name string
+		c    Cluster
+		host string
+		want []string
+	}{
+		{"kubeadm init", kubeadm, "cp1", []string{
+			"kubeadm init --upload-certs --control-plane-endpoint 10.0.0.1:6443 --token " + kubeadm.Token + " --certificate-key " + kubeadm.CertificateKey +
+				" --kubernetes-version v1.30.0 --pod-network-cidr=10.244.0.0/16\n",
+			"curl -sf -d caCertHash=sha256:$hash -X POST http://pxe/cluster/ready\n",
+		}},
+		{"kubeadm control plane", kubeadm, "cp2", []string{
+			"kubeadm join 10.0.0.1:6443 --token " + kubeadm.Token + " --discovery-token-ca-cert-hash " + caHash +
+				" --control-plane --certificate-key " + kubeadm.CertificateKey + "\n",
+		}},
+		{"kubeadm worker", kubeadm, "w1", []string{
+			"kubeadm join 10.0.0.1:6443 --token " + kubeadm.Token + " --discovery-token-ca-cert-hash " + caHash + "\n",
+			"curl -sf -X POST http://pxe/cluster/ready\n",
+		}},
+		{"k3s init", k3s, "cp1", []string{
+			"K3S_TOKEN=" + k3s.Token + " sh -s - server --cluster-init --tls-san lb\n",
+			"until k3s kubectl get --raw /readyz",
+		}},
+		{"k3s server", k3s, "cp2", []string{"sh -s - server --server https://lb:7443\n"}},
+		{"k3s agent", k3s, "w1", []string{"K3S_TOKEN=" + k3s.Token + " K3S_URL=https://lb:7443 sh -s - agent\n"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Script(tt.c, tt.host, "http://pxe")
+			for _, want := range tt.want {
+				if !strings.Contains(got, want) {
+					t.Errorf("script lacks %q:\n%s", want, got)
+				}
+			}
+			if tt.host != "cp1" && strings.Contains(got, "--kubernetes-version") {
+				t.Error("joining member given the init flags")
+			}
+		})
+	}
+}
+
+func TestUserData(t *testing.T) {
+	c := formed(t, Cluster{Name: "prod", Kind: K3s, Version: "v1.30.0+k3s1", ControlPlanes: []string{"cp1"}, Workers: []string{"w1"}})
+	for _, host := range []string{"cp1", "w1"} {
+		t.Run(host, func(t *testing.T) {
+			data := UserData(c, host, "http://pxe")
+			if !strings.HasPrefix(string(data), "#cloud-config\n") {
+				t.Errorf("user-data = %s", data)
+			}
+			var doc struct {
+				WriteFiles []struct {
+					Path, Permissions, Content string
+				} `yaml:"write_files"`
+				RunCmd [][]string `yaml:"runcmd"`
+			}
+			if err := yaml.Unmarshal(data, &doc); err != nil {
+				t.Fatalf("%v\n%s", err, data)
+			}
+			if len(doc.WriteFiles) != 1 || len(doc.RunCmd) != 1 || doc.RunCmd[0][0] != doc.WriteFiles[0].Path {
+				t.Fatalf("cloud-config = %+v", doc)
+			}
+			content := doc.WriteFiles[0].Content
+			if host == "cp1" {
+				// The first control plane carries its script
+				if !strings.Contains(content, "<<'EOF'\n"+Script(c, host, "http://pxe")+"EOF\n") {
+					t.Errorf("script not embedded:\n%s", content)
+				}
+			} else if !strings.Contains(content, "curl -sf -o /run/go-pxe-join.sh http://pxe/cluster/join") {
+				t.Errorf("worker doesn't poll:\n%s", content)
+			}
+			if !strings.Contains(content, "http://pxe/cluster/failed") {
+				t.Errorf("failures not reported:\n%s", content)
+			}
+		})
+	}
+	if got := string(MetaData(c, "w1")); got != "instance-id: go-pxe-prod-w1\nlocal-hostname: w1\n" {
+		t.Errorf("meta-data = %q", got)
+	}
+}
@@ -0,0 +1,375 @@
+// Package cluster bootstraps Kubernetes clusters from inventory hosts with
+// kubeadm or k3s. It generates the join secrets, hands each member a
+// cloud-init for its role, holds further control planes until the first has
+// created the cluster and workers until every control plane has joined, and
+// follows the members through their callbacks.
+package cluster
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"maps"
+	"net"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of clusters
+const (
+	Kubeadm = "kubeadm"
+	K3s     = "k3s"
+)
+
+// Roles of members
+const (
+	Init         = "init" // the first control plane, which creates the cluster
+	ControlPlane = "control-plane"
+	Worker       = "worker"
+)
+
+// Phases of members
+const (
+	Pending = "pending" // not provisioned yet
+	Waiting = "waiting" // provisioned, waiting for its turn to join
+	Joining = "joining" // given its join command
+	Ready   = "ready"
+	Failed  = "failed"
+)
+
+// Redacted is shown in place of the join secrets
+const Redacted = "********"
+
+var (
+	namePattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+	hashPattern = regexp.MustCompile(`^sha256:[0-9a-f]{64}$`)
+)
+
+// Cluster is a Kubernetes cluster formed from inventory hosts
+type Cluster struct {
+	Name    string `json:"name"`
+	Kind    string `json:"kind"`              // kubeadm or k3s
+	Version string `json:"version,omitempty"` // of Kubernetes or k3s, default the image's or the latest
+
+	// Endpoint is the API server address members join through, such as a
+	// load balancer; by default the first control plane's
+	Endpoint string `json:"endpoint,omitempty"`
+
+	// ControlPlanes and Workers are inventory host names. The first
+	// control plane creates the cluster.
+	ControlPlanes []string `json:"controlPlanes"`
+	Workers       []string `json:"workers,omitempty"`
+
+	// Args are added to kubeadm init or k3s server, e.g. the pod CIDR
+	Args string `json:"args,omitempty"`
+
+	// Join secrets, generated when the cluster is created. CACertHash
+	// pins the kubeadm cluster CA; the first control plane reports it.
+	Token          string `json:"token,omitempty"`
+	CertificateKey string `json:"certificateKey,omitempty"`
+	CACertHash     string `json:"caCertHash,omitempty"`
+
+	Created time.Time         `json:"created"`
+	Members map[string]Member `json:"members"`
+	Status  string            `json:"status"` // forming, ready or failed, set when reading
+}
+
+// Member is the progress of one host
+type Member struct {
+	Role    string    `json:"role"`
+	Phase   string    `json:"phase"`
+	IP      string    `json:"ip,omitempty"`
+	Updated time.Time `json:"updated,omitzero"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// Redacted returns a copy of c safe to show or log: its secrets masked
+func (c Cluster) Redacted() Cluster {
+	for _, s := range []*string{&c.Token, &c.CertificateKey} {
+		if *s != "" {
+			*s = Redacted
+		}
+	}
+	return c
+}
+
+// Hosts lists the members in the order they join
+func (c Cluster) Hosts() []string {
+	return append(slices.Clone(c.ControlPlanes), c.Workers...)
+}
+
+// status summarises the members
+func (c Cluster) status() string {
+	status := Ready
+	for _, m := range c.Members {
+		switch m.Phase {
+		case Failed:
+			return Failed
+		case Ready:
+		default:
+			status = "forming"
+		}
+	}
+	return status
+}
+
+// turn reports whether a member with the given role may join yet: the
+// first control plane right away, the others once it is ready, and
+// workers once every control plane is
+func (c Cluster) turn(role string) bool {
+	if role == Init {
+		return true
+	}
+	if c.Kind == Kubeadm && c.CACertHash == "" {
+		return false
+	}
+	hosts := c.ControlPlanes[:1]
+	if role == Worker {
+		hosts = c.ControlPlanes
+	}
+	for _, h := range hosts {
+		if c.Members[h].Phase != Ready {
+			return false
+		}
+	}
+	return true
+}
+
+// APIServer is the host:port members join through
+func (c Cluster) APIServer() string {
+	addr := c.Endpoint
+	if addr == "" {
+		addr = c.Members[c.ControlPlanes[0]].IP
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "6443")
+	}
+	return addr
+}
+
+// Store is the domain's clusters
+type Store struct {
+	mu       sync.Mutex
+	clusters map[string]Cluster
+}
+
+// NewStore creates an empty store
+func NewStore() *Store {
+	return &Store{clusters: make(map[string]Cluster)}
+}
+
+// Put creates or redefines a cluster and returns it as stored. A new
+// cluster gets fresh secrets; a redefined one keeps them, and the progress
+// of the hosts still in it in the same role.
+func (s *Store) Put(c Cluster) (Cluster, error) {
+	if !namePattern.MatchString(c.Name) {
+		return Cluster{}, fmt.Errorf("invalid cluster name %q", c.Name)
+	}
+	if c.Kind != Kubeadm && c.Kind != K3s {
+		return Cluster{}, fmt.Errorf("cluster %s: kind must be %s or %s", c.Name, Kubeadm, K3s)
+	}
+	if len(c.ControlPlanes) == 0 {
+		return Cluster{}, fmt.Errorf("cluster %s needs a control plane", c.Name)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	members := make(map[string]Member)
+	for i, h := range c.Hosts() {
+		if _, dup := members[h]; dup {
+			return Cluster{}, fmt.Errorf("cluster %s: host %s is listed twice", c.Name, h)
+		}
+		if other, ok := s.find(h); ok && other.Name != c.Name {
+			return Cluster{}, fmt.Errorf("cluster %s: host %s is in cluster %s", c.Name, h, other.Name)
+		}
+		role := Worker
+		switch {
+		case i == 0:
+			role = Init
+		case i < len(c.ControlPlanes):
+			role = ControlPlane
+		}
+		members[h] = Member{Role: role, Phase: Pending}
+	}
+
+	old, ok := s.clusters[c.Name]
+	if ok && old.Kind == c.Kind {
+		c.Token, c.CertificateKey, c.CACertHash, c.Created = old.Token, old.CertificateKey, old.CACertHash, old.Created
+		for h, m := range old.Members {
+			if n, ok := members[h]; ok && n.Role == m.Role {
+				members[h] = m
+			}
+		}
+	} else {
+		c.Token, c.CertificateKey, c.CACertHash, c.Created = token(c.Kind), "", "", time.Now()
+		if c.Kind == Kubeadm {
+			c.CertificateKey = randomHex(32)
+		}
+	}
+	c.Members = members
+	s.clusters[c.Name] = c
+	c.Status = c.status()
+	return c, nil
+}
+
+// token generates a join token. Kubeadm wants a bootstrap token,
+// [a-z0-9]{6}.[a-z0-9]{16}; k3s takes any string.
+func token(kind string) string {
+	if kind != Kubeadm {
+		return randomHex(32)
+	}
+	t := strings.ToLower(rand.Text()) // 26 of [a-z2-7]
+	return t[:6] + "." + t[6:22]
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Get looks up a cluster
+func (s *Store) Get(name string) (Cluster, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.clusters[name]
+	c.Status = c.status()
+	return c, ok
+}
+
+// List returns every cluster sorted by name
+func (s *Store) List() []Cluster {
+	list := s.Snapshot()
+	for i := range list {
+		list[i].Status = list[i].status()
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// Delete forgets a cluster, reporting whether there was one. Its hosts are
+// left as they are.
+func (s *Store) Delete(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.clusters[name]
+	delete(s.clusters, name)
+	return ok
+}
+
+// Of returns the cluster host is a member of, and its membership
+func (s *Store) Of(host string) (Cluster, Member, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.find(host)
+	return c, c.Members[host], ok
+}
+
+func (s *Store) find(host string) (Cluster, bool) {
+	for _, c := range s.clusters {
+		if _, ok := c.Members[host]; ok {
+			return c, true
+		}
+	}
+	return Cluster{}, false
+}
+
+// update applies f to host's membership, if it is a member
+func (s *Store) update(host string, f func(*Cluster, *Member)) (Cluster, Member, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.find(host)
+	if !ok {
+		return Cluster{}, Member{}, false
+	}
+	m := c.Members[host]
+	f(&c, &m)
+	m.Updated = time.Now()
+	// A copy, so clusters already handed out don't change under readers
+	c.Members = maps.Clone(c.Members)
+	c.Members[host] = m
+	s.clusters[c.Name] = c
+	return c, m, true
+}
+
+// Provisioned notes that host, at ip, fetched its cloud-init: it is being
+// installed and will join, starting over if it had joined before. The
+// first control plane gets its script with it.
+func (s *Store) Provisioned(host, ip string) (Cluster, Member, bool) {
+	return s.update(host, func(c *Cluster, m *Member) {
+		m.Phase, m.IP, m.Error = Waiting, ip, ""
+		if m.Role == Init {
+			m.Phase = Joining
+		}
+	})
+}
+
+// Join hands host its turn to join: it reports false, leaving the host
+// waiting, until the members it depends on are ready
+func (s *Store) Join(host, ip string) (Cluster, Member, bool) {
+	var turn bool
+	c, m, ok := s.update(host, func(c *Cluster, m *Member) {
+		m.IP = ip
+		if turn = c.turn(m.Role); turn {
+			m.Phase, m.Error = Joining, ""
+		} else {
+			m.Phase = Waiting
+		}
+	})
+	return c, m, ok && turn
+}
+
+// Report records that host joined, or failed to with the given error. The
+// first control plane of a kubeadm cluster reports the CA's hash with it.
+func (s *Store) Report(host, ip, caCertHash, failure string) (Cluster, Member, error) {
+	if caCertHash != "" && !hashPattern.MatchString(caCertHash) {
+		return Cluster{}, Member{}, fmt.Errorf("invalid CA certificate hash %q (want sha256:<64 hex digits>)", caCertHash)
+	}
+	var err error
+	c, m, ok := s.update(host, func(c *Cluster, m *Member) {
+		m.IP = ip
+		if failure != "" {
+			m.Phase, m.Error = Failed, failure
+			return
+		}
+		if c.Kind == Kubeadm && m.Role == Init {
+			if caCertHash == "" {
+				err = fmt.Errorf("the first control plane must report the CA certificate hash")
+				return
+			}
+			c.CACertHash = caCertHash
+		}
+		m.Phase, m.Error = Ready, ""
+	})
+	if !ok {
+		return Cluster{}, Member{}, fmt.Errorf("%s is not in a cluster", host)
+	}
+	c.Status = c.status()
+	return c, m, err
+}
+
+// Snapshot returns every cluster for backups
+func (s *Store) Snapshot() []Cluster {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]Cluster, 0, len(s.clusters))
+	for _, c := range s.clusters {
+		list = append(list, c)
+	}
+	return list
+}
+
+// Load replaces the clusters with list, as a backup restores them, without
+// the checks Put makes
+func (s *Store) Load(list []Cluster) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clusters = make(map[string]Cluster, len(list))
+	for _, c := range list {
+		s.clusters[c.Name] = c
+	}
+}
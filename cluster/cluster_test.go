@@ -0,0 +1,160 @@
+package cluster
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var caHash = "sha256:" + strings.Repeat("ab", 32)
+
+func TestPut(t *testing.T) {
+	s := NewStore()
+	tests := []struct {
+		name string
+		c    Cluster
+		err  string
+	}{
+		{"bad name", Cluster{Name: "Prod_1", Kind: K3s, ControlPlanes: []string{"a"}}, "invalid cluster name"},
+		{"bad kind", Cluster{Name: "prod", Kind: "rke", ControlPlanes: []string{"a"}}, "kind must be"},
+		{"no control plane", Cluster{Name: "prod", Kind: K3s, Workers: []string{"a"}}, "needs a control plane"},
+		{"twice", Cluster{Name: "prod", Kind: K3s, ControlPlanes: []string{"a"}, Workers: []string{"a"}}, "listed twice"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := s.Put(tt.c); err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+	if len(s.List()) != 0 {
+		t.Error("rejected cluster stored")
+	}
+
+	c, err := s.Put(Cluster{Name: "prod", Kind: Kubeadm, ControlPlanes: []string{"cp1", "cp2"}, Workers: []string{"w1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !regexp.MustCompile(`^[a-z0-9]{6}\.[a-z0-9]{16}$`).MatchString(c.Token) || len(c.CertificateKey) != 64 || c.Created.IsZero() {
+		t.Errorf("secrets = %q, %q", c.Token, c.CertificateKey)
+	}
+	if c.Members["cp1"].Role != Init || c.Members["cp2"].Role != ControlPlane || c.Members["w1"].Role != Worker || c.Status != "forming" {
+		t.Errorf("cluster = %+v", c)
+	}
+	if r := c.Redacted(); r.Token != Redacted || r.CertificateKey != Redacted || c.Token == Redacted {
+		t.Errorf("redacted = %+v", r)
+	}
+	if _, err := s.Put(Cluster{Name: "dev", Kind: K3s, ControlPlanes: []string{"w1"}}); err == nil || !strings.Contains(err.Error(), "in cluster prod") {
+		t.Errorf("host in two clusters: %v", err)
+	}
+
+	// Redefined, the secrets and the progress of unchanged members stay
+	s.Provisioned("cp1", "10.0.0.1")
+	s.Report("cp1", "10.0.0.1", caHash, "")
+	s.Provisioned("w1", "10.0.0.3")
+	again, err := s.Put(Cluster{Name: "prod", Kind: Kubeadm, ControlPlanes: []string{"cp1", "w1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Token != c.Token || again.CACertHash != caHash || again.Members["cp1"].Phase != Ready || again.Members["w1"].Phase != Pending {
+		t.Errorf("redefined = %+v", again)
+	}
+	if _, _, ok := s.Of("cp2"); ok {
+		t.Error("removed host still a member")
+	}
+
+	// Another kind starts over
+	k3s, _ := s.Put(Cluster{Name: "prod", Kind: K3s, ControlPlanes: []string{"cp1"}})
+	if k3s.Token == c.Token || len(k3s.Token) != 64 || k3s.CertificateKey != "" || k3s.CACertHash != "" || k3s.Members["cp1"].Phase != Pending {
+		t.Errorf("new kind = %+v", k3s)
+	}
+
+	if !s.Delete("prod") || s.Delete("prod") {
+		t.Error("Delete reported wrongly")
+	}
+}
+
+func TestSequence(t *testing.T) {
+	s := NewStore()
+	s.Put(Cluster{Name: "prod", Kind: Kubeadm, ControlPlanes: []string{"cp1", "cp2"}, Workers: []string{"w1"}})
+
+	if _, m, _ := s.Provisioned("cp1", "10.0.0.1"); m.Phase != Joining || m.IP != "10.0.0.1" {
+		t.Errorf("first control plane = %+v", m)
+	}
+	if _, m, _ := s.Provisioned("w1", "10.0.0.3"); m.Phase != Waiting {
+		t.Errorf("worker = %+v", m)
+	}
+	if _, _, ok := s.Join("w1", "10.0.0.3"); ok {
+		t.Error("worker joined before the control planes")
+	}
+	if _, _, ok := s.Join("cp2", "10.0.0.2"); ok {
+		t.Error("second control plane joined before the first")
+	}
+
+	// The CA hash is required from the first control plane, and checked
+	if _, _, err := s.Report("cp1", "10.0.0.1", "", ""); err == nil {
+		t.Error("ready without a CA hash")
+	}
+	if _, _, err := s.Report("cp1", "10.0.0.1", "sha256:xyz", ""); err == nil {
+		t.Error("malformed CA hash accepted")
+	}
+	if _, _, err := s.Report("nobody", "10.0.0.9", "", ""); err == nil {
+		t.Error("report from a non-member accepted")
+	}
+	c, _, err := s.Report("cp1", "10.0.0.1", caHash, "")
+	if err != nil || c.CACertHash != caHash || c.APIServer() != "10.0.0.1:6443" {
+		t.Fatalf("report = %+v, %v", c, err)
+	}
+
+	if _, m, ok := s.Join("cp2", "10.0.0.2"); !ok || m.Phase != Joining {
+		t.Errorf("second control plane = %+v, %v", m, ok)
+	}
+	if _, _, ok := s.Join("w1", "10.0.0.3"); ok {
+		t.Error("worker joined before every control plane")
+	}
+	if c, m, _ := s.Report("cp2", "10.0.0.2", "", "kubeadm: timeout"); m.Phase != Failed || m.Error != "kubeadm: timeout" || c.Status != Failed {
+		t.Errorf("failure = %+v, %s", m, c.Status)
+	}
+	s.Report("cp2", "10.0.0.2", "", "")
+	if _, m, ok := s.Join("w1", "10.0.0.3"); !ok || m.Phase != Joining {
+		t.Errorf("worker = %+v, %v", m, ok)
+	}
+	if c, _, _ := s.Report("w1", "10.0.0.3", "", ""); c.Status != Ready {
+		t.Errorf("status = %s", c.Status)
+	}
+}
+
+func TestK3sTurn(t *testing.T) {
+	s := NewStore()
+	s.Put(Cluster{Name: "edge", Kind: K3s, Endpoint: "lb.example", ControlPlanes: []string{"cp1"}, Workers: []string{"w1"}})
+	s.Provisioned("cp1", "10.0.0.1")
+	// No CA hash for k3s
+	if _, _, err := s.Report("cp1", "10.0.0.1", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	c, _, ok := s.Join("w1", "10.0.0.3")
+	if !ok || c.APIServer() != "lb.example:6443" {
+		t.Errorf("join = %v, %s", ok, c.APIServer())
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	s := NewStore()
+	s.Put(Cluster{Name: "b", Kind: K3s, ControlPlanes: []string{"b1"}})
+	s.Put(Cluster{Name: "a", Kind: K3s, ControlPlanes: []string{"a1"}})
+	before, _ := s.Get("a")
+	s.Provisioned("a1", "10.0.0.1")
+	if before.Members["a1"].Phase != Pending {
+		t.Error("a cluster handed out changed")
+	}
+
+	restored := NewStore()
+	restored.Load(s.Snapshot())
+	list := restored.List()
+	if len(list) != 2 || list[0].Name != "a" || list[0].Members["a1"].Phase != Joining || list[0].Token == "" {
+		t.Errorf("restored %+v", list)
+	}
+	if _, ok := restored.Get("c"); ok {
+		t.Error("found a missing cluster")
+	}
+}
@@ -0,0 +1,115 @@
+package cluster
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// maxError bounds the log tail a failed member posts: 2000 bytes, up to
+// three times that once URL-encoded
+const maxError = 8 << 10
+
+// Handler serves cluster members their NoCloud data at /cluster/meta-data
+// and /cluster/user-data, their join scripts at /cluster/join, and takes
+// their reports at /cluster/ready and /cluster/failed. Point cloud-init at
+// it from the profile's kernel command line:
+//
+//	ds=nocloud;s=http://10.0.0.1:8080/cluster/
+type Handler struct {
+	// Domain labels log lines
+	Domain string
+
+	// Host names the inventory host at an address
+	Host func(ip net.IP) (string, bool)
+
+	// Server is go-pxe's HTTP URL, for the members to report back to
+	Server string
+
+	store *Store
+}
+
+// NewHandler creates a handler for the clusters in store
+func NewHandler(store *Store) *Handler {
+	return &Handler{store: store}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	addr, _, _ := net.SplitHostPort(r.RemoteAddr)
+	host, ok := h.Host(net.ParseIP(addr))
+	if !ok {
+		http.Error(w, "not an inventory host", http.StatusNotFound)
+		return
+	}
+	c, m, ok := h.store.Of(host)
+	if !ok {
+		http.Error(w, host+" is not in a cluster", http.StatusNotFound)
+		return
+	}
+
+	var out []byte
+	switch r.PathValue("file") {
+	case "meta-data":
+		out = MetaData(c, host)
+	case "user-data":
+		c, m, _ = h.store.Provisioned(host, addr)
+		log.Printf("[K8S] %s: %s is being provisioned as %s of cluster %s", h.Domain, host, m.Role, c.Name)
+		out = UserData(c, host, h.Server)
+	case "vendor-data":
+	case "join":
+		c, m, ok = h.store.Join(host, addr)
+		if !ok {
+			// curl -f retries until it is the host's turn
+			w.Header().Set("Retry-After", "15")
+			http.Error(w, host+" waits for the control plane of cluster "+c.Name, http.StatusServiceUnavailable)
+			return
+		}
+		log.Printf("[K8S] %s: %s is joining cluster %s as %s", h.Domain, host, c.Name, m.Role)
+		out = []byte(Script(c, host, h.Server))
+	case "ready", "failed":
+		h.report(w, r, host, addr)
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	// Carries the join secrets
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(out)
+}
+
+// report takes a member's outcome:
+//
+//	curl -sf -X POST -d caCertHash=sha256:... http://10.0.0.1:8080/cluster/ready
+//	curl -sf --data-urlencode error@- http://10.0.0.1:8080/cluster/failed
+func (h *Handler) report(w http.ResponseWriter, r *http.Request, host, addr string) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxError)
+	failure := r.PostFormValue("error")
+	if r.PathValue("file") == "failed" && failure == "" {
+		failure = "failed without a message"
+	}
+	c, m, err := h.store.Report(host, addr, r.PostFormValue("caCertHash"), failure)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if m.Phase == Failed {
+		log.Printf("[K8S] %s: %s failed to join cluster %s: %s", h.Domain, host, c.Name, lastLine(failure))
+	} else {
+		log.Printf("[K8S] %s: %s is ready in cluster %s (%s)", h.Domain, host, c.Name, c.Status)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// lastLine is the last non-empty line of a log tail
+func lastLine(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	return lines[len(lines)-1]
+}
@@ -0,0 +1,111 @@
+package cluster
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// serve makes a request to h from ip, routed as go-pxe routes it
+func serve(h *Handler, ip, method, file string, form url.Values) *httptest.ResponseRecorder {
+	mux := http.NewServeMux()
+	mux.Handle("/cluster/{file}", h)
+	var body *strings.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	} else {
+		body = strings.NewReader("")
+	}
+	r := httptest.NewRequest(method, "/cluster/"+file, body)
+	r.RemoteAddr = ip + ":4000"
+	if form != nil {
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	return w
+}
+
+func TestHandler(t *testing.T) {
+	s := NewStore()
+	s.Put(Cluster{Name: "prod", Kind: Kubeadm, ControlPlanes: []string{"cp1"}, Workers: []string{"w1"}})
+	hosts := map[string]string{"10.0.0.1": "cp1", "10.0.0.3": "w1", "10.0.0.9": "spare"}
+	h := NewHandler(s)
+	h.Domain, h.Server = "lab", "http://pxe"
+	h.Host = func(ip net.IP) (string, bool) {
+		name, ok := hosts[ip.String()]
+		return name, ok
+	}
+
+	if w := serve(h, "10.0.0.99", "GET", "user-data", nil); w.Code != http.StatusNotFound {
+		t.Errorf("unknown client: %d", w.Code)
+	}
+	if w := serve(h, "10.0.0.9", "GET", "user-data", nil); w.Code != http.StatusNotFound {
+		t.Errorf("host outside clusters: %d", w.Code)
+	}
+	if w := serve(h, "10.0.0.1", "GET", "bogus", nil); w.Code != http.StatusNotFound {
+		t.Errorf("unknown file: %d", w.Code)
+	}
+	if w := serve(h, "10.0.0.1", "GET", "meta-data", nil); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "local-hostname: cp1") {
+		t.Errorf("meta-data = %d %s", w.Code, w.Body)
+	}
+	if w := serve(h, "10.0.0.1", "GET", "vendor-data", nil); w.Code != http.StatusOK || w.Body.Len() != 0 {
+		t.Errorf("vendor-data = %d %q", w.Code, w.Body)
+	}
+
+	w := serve(h, "10.0.0.1", "GET", "user-data", nil)
+	if w.Code != http.StatusOK || w.Header().Get("Cache-Control") != "no-store" || !strings.Contains(w.Body.String(), "kubeadm init") {
+		t.Errorf("user-data = %d %v\n%s", w.Code, w.Header(), w.Body)
+	}
+	if _, m, _ := s.Of("cp1"); m.Phase != Joining || m.IP != "10.0.0.1" {
+		t.Errorf("cp1 = %+v", m)
+	}
+
+	serve(h, "10.0.0.3", "GET", "user-data", nil)
+	if w := serve(h, "10.0.0.3", "GET", "join", nil); w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("early join = %d %v", w.Code, w.Header())
+	}
+
+	if w := serve(h, "10.0.0.1", "GET", "ready", nil); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET ready = %d", w.Code)
+	}
+	if w := serve(h, "10.0.0.1", "POST", "ready", url.Values{"caCertHash": {"md5:x"}}); w.Code != http.StatusBadRequest {
+		t.Errorf("bad hash = %d", w.Code)
+	}
+	if w := serve(h, "10.0.0.1", "POST", "ready", url.Values{"caCertHash": {caHash}}); w.Code != http.StatusNoContent {
+		t.Errorf("ready = %d %s", w.Code, w.Body)
+	}
+
+	w = serve(h, "10.0.0.3", "GET", "join", nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "--discovery-token-ca-cert-hash "+caHash) {
+		t.Errorf("join = %d %s", w.Code, w.Body)
+	}
+	if w := serve(h, "10.0.0.3", "POST", "failed", nil); w.Code != http.StatusNoContent {
+		t.Errorf("failed = %d", w.Code)
+	}
+	if _, m, _ := s.Of("w1"); m.Phase != Failed || m.Error != "failed without a message" {
+		t.Errorf("w1 = %+v", m)
+	}
+}
+
+func TestHandlerFailureTail(t *testing.T) {
+	s := NewStore()
+	s.Put(Cluster{Name: "prod", Kind: K3s, ControlPlanes: []string{"cp1"}})
+	h := NewHandler(s)
+	h.Host = func(net.IP) (string, bool) { return "cp1", true }
+
+	// A 2000-byte tail of box drawing is 6000 bytes URL-encoded
+	tail := strings.Repeat("═", 650) + "\nlast line"
+	if w := serve(h, "10.0.0.1", "POST", "failed", url.Values{"error": {tail}}); w.Code != http.StatusNoContent {
+		t.Fatalf("failed = %d", w.Code)
+	}
+	if _, m, _ := s.Of("cp1"); m.Error != tail {
+		t.Errorf("error = %.40q", m.Error)
+	}
+	if lastLine(tail+"\n\n") != "last line" {
+		t.Errorf("lastLine = %q", lastLine(tail))
+	}
+}
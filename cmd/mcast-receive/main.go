@@ -0,0 +1,64 @@
+// mcast-receive is the receiving end of go-pxe's multicast image
+// deployment, small enough to ship in an installer initrd:
+//
+//	mcast-receive -server 10.0.0.1 -image rhel9.raw -o /dev/sda
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"github.com/ars1364/go-pxe/mcast"
+)
+
+func main() {
+	server := flag.String("server", "", "go-pxe server address, host or host:port of its multicast control port (9000)")
+	image := flag.String("image", "", "Image to receive, as scheduled through the API")
+	output := flag.String("o", "", "File or block device to write the image to")
+	iface := flag.String("iface", "", "Interface to receive multicast on (default route if empty)")
+	wait := flag.Duration("wait", time.Hour, "How long to wait for the transfer to be scheduled")
+	flag.Parse()
+	if *server == "" || *image == "" || *output == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	addr := *server
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "9000")
+	}
+
+	var ifi *net.Interface
+	if *iface != "" {
+		var err error
+		if ifi, err = net.InterfaceByName(*iface); err != nil {
+			log.Fatal(err)
+		}
+	}
+	out, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	start := time.Now()
+	last := time.Time{}
+	err = mcast.Receive(addr, *image, out, ifi, *wait, func(held, size int64) {
+		if time.Since(last) >= 5*time.Second || held == size {
+			last = time.Now()
+			fmt.Fprintf(os.Stderr, "%s: %d/%d MiB (%d%%)\n", *image, held>>20, size>>20, held*100/size)
+		}
+	})
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Fprintf(os.Stderr, "%s: received in %s\n", *image, time.Since(start).Round(time.Second))
+}
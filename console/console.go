@@ -0,0 +1,101 @@
+// Package console captures serial console output that clients send over
+// TCP (console=ttyS0 piped through socat, or an IPMI SOL session relayed by
+// a bridge) and keeps the tail of it per client, so an installer crash on a
+// headless machine can be read, or watched live, from the API.
+package console
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// helloPrefix starts the optional first line naming the client whose
+// console follows, for bridges relaying someone else's output
+const helloPrefix = "@client "
+
+var clientPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._:-]{0,63}$`)
+
+// Server files console streams in Store
+type Server struct {
+	Store *Store
+
+	// ClientID, if set, names the client at an address. Defaults to its
+	// IP address.
+	ClientID func(net.IP) string
+
+	// Domain labels log lines
+	Domain string
+}
+
+// NewServer creates a server filing output in store
+func NewServer(store *Store) *Server {
+	return &Server{Store: store}
+}
+
+// ListenAndServe accepts console streams on addr (normally <ip>:5515)
+func (s *Server) ListenAndServe(addr string) error {
+	ln, err := net.Listen("tcp4", addr)
+	if err != nil {
+		return fmt.Errorf("console listen: %w", err)
+	}
+	defer ln.Close()
+	log.Printf("[CONSOLE] Listening on %s", addr)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Printf("[CONSOLE] Accept error: %v", err)
+			continue
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// serveConn copies one stream into the store until the sender hangs up
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+	remote := conn.RemoteAddr().(*net.TCPAddr).IP
+	client := remote.String()
+	if s.ClientID != nil {
+		client = s.ClientID(remote)
+	}
+
+	r := bufio.NewReader(conn)
+	if b, err := r.Peek(len(helloPrefix)); err == nil && string(b) == helloPrefix {
+		// ReadSlice stops at the buffer size, so a sender can't grow the
+		// line without bound
+		b, err := r.ReadSlice('\n')
+		line := string(b)
+		name := strings.TrimSpace(strings.TrimPrefix(line, helloPrefix))
+		if err != nil || !clientPattern.MatchString(name) {
+			log.Printf("[CONSOLE] %s: %s: invalid %q line", s.Domain, remote, strings.TrimSpace(line))
+			return
+		}
+		client = name
+	}
+
+	log.Printf("[CONSOLE] %s: capturing console of %s (%s)", s.Domain, client, remote)
+	start := time.Now()
+	var n int64
+	buf := make([]byte, 4096)
+	for {
+		m, err := r.Read(buf)
+		if m > 0 {
+			s.Store.Write(client, buf[:m])
+			n += int64(m)
+		}
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				log.Printf("[CONSOLE] %s: %s: %v", s.Domain, client, err)
+			}
+			break
+		}
+	}
+	log.Printf("[CONSOLE] %s: console of %s closed after %s (%d bytes)", s.Domain, client, time.Since(start).Round(time.Second), n)
+}
@@ -0,0 +1,78 @@
+package console
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+// stream sends data as one console stream and waits for the server to
+// finish with it
+func stream(t *testing.T, s *Server, data string) {
+	t.Helper()
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		s.serveConn(conn)
+	}()
+	conn, err := net.Dial("tcp4", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte(data))
+	conn.Close()
+	<-done
+}
+
+func TestServeConn(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   string
+		client string
+		want   string
+	}{
+		{"plain", "Booting Linux\n", "127.0.0.1", "Booting Linux\n"},
+		{"hello", "@client node1\nanaconda started\n", "node1", "anaconda started\n"},
+		{"hello only", "@client node1\n", "", ""},
+		{"bad name", "@client ../etc\nx\n", "", ""},
+		{"unterminated hello", "@client node1", "", ""},
+		{"endless hello", "@client " + strings.Repeat("a", 10000), "", ""},
+		{"short", "@cli", "127.0.0.1", "@cli"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewStore(1024)
+			stream(t, NewServer(store), tt.data)
+			clients := store.Clients()
+			if tt.client == "" {
+				if len(clients) != 0 {
+					t.Errorf("stored %+v", clients)
+				}
+				return
+			}
+			data, _, _, ok := store.Read(tt.client, 0)
+			if !ok || string(data) != tt.want {
+				t.Errorf("%s: %q, %v; want %q", tt.client, data, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientID(t *testing.T) {
+	store := NewStore(1024)
+	s := NewServer(store)
+	s.ClientID = func(ip net.IP) string { return "host-" + ip.String() }
+	stream(t, s, "x")
+	if _, _, _, ok := store.Read("host-127.0.0.1", 0); !ok {
+		t.Errorf("clients = %+v", store.Clients())
+	}
+}
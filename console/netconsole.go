@@ -0,0 +1,112 @@
+package console
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// extendedHeader prefixes messages from netconsole configured with "+":
+// level, sequence number, timestamp and flags
+var extendedHeader = regexp.MustCompile(`^\d+,\d+,\d+,[^;]*;`)
+
+// maxPartial bounds an unterminated line before it is stored anyway
+const maxPartial = 4096
+
+// Netconsole receives kernel messages sent by Linux netconsole over UDP
+// and files them, one line at a time, with the serial console output in
+// Store
+type Netconsole struct {
+	Store *Store
+
+	// ClientID, if set, names the client at an address. Defaults to its
+	// IP address.
+	ClientID func(net.IP) string
+
+	// Attach, if set, is called with every message line, e.g. to add it
+	// to the sender's boot session
+	Attach func(ip net.IP, line string)
+
+	// Domain labels log lines
+	Domain string
+
+	mu      sync.Mutex
+	seen    map[string]bool
+	partial map[string][]byte // unterminated line per client
+}
+
+// NewNetconsole creates a receiver filing messages in store
+func NewNetconsole(store *Store) *Netconsole {
+	return &Netconsole{Store: store, seen: make(map[string]bool), partial: make(map[string][]byte)}
+}
+
+// ListenAndServe receives netconsole messages on addr (normally
+// <ip>:6666, the netconsole default)
+func (n *Netconsole) ListenAndServe(addr string) error {
+	udpAddr, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp4", udpAddr)
+	if err != nil {
+		return fmt.Errorf("netconsole listen: %w", err)
+	}
+	defer conn.Close()
+	log.Printf("[NETCONSOLE] Listening on %s", addr)
+
+	buf := make([]byte, 65536)
+	for {
+		size, remote, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			log.Printf("[NETCONSOLE] Read error: %v", err)
+			continue
+		}
+		n.receive(remote.IP, buf[:size])
+	}
+}
+
+// receive handles one datagram. Plain netconsole splits lines across
+// datagrams as printk writes them, so a trailing partial line waits for
+// the rest; extended netconsole sends one whole record per datagram.
+func (n *Netconsole) receive(ip net.IP, data []byte) {
+	client := ip.String()
+	if n.ClientID != nil {
+		client = n.ClientID(ip)
+	}
+	if loc := extendedHeader.FindIndex(data); loc != nil {
+		// The text is followed by " KEY=value" dictionary lines
+		text, _, _ := bytes.Cut(data[loc[1]:], []byte("\n"))
+		data = append(text, '\n')
+	}
+
+	n.mu.Lock()
+	if !n.seen[client] {
+		n.seen[client] = true
+		log.Printf("[NETCONSOLE] %s: receiving kernel messages from %s (%s)", n.Domain, client, ip)
+	}
+	data = append(n.partial[client], data...)
+	end := bytes.LastIndexByte(data, '\n') + 1
+	if len(data)-end > maxPartial {
+		end = len(data)
+	}
+	n.partial[client] = append([]byte(nil), data[end:]...)
+	n.mu.Unlock()
+	if end == 0 {
+		return
+	}
+
+	n.Store.Write(client, data[:end])
+	for _, line := range strings.Split(strings.TrimSuffix(string(data[:end]), "\n"), "\n") {
+		line = strings.TrimRight(line, "\r\x00")
+		if n.Attach != nil && line != "" {
+			n.Attach(ip, line)
+		}
+		if strings.Contains(line, "Kernel panic") {
+			log.Printf("[NETCONSOLE] %s: %s: %s", n.Domain, client, line)
+		}
+	}
+}
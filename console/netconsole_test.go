@@ -0,0 +1,63 @@
+package console
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestNetconsole(t *testing.T) {
+	ip := net.IPv4(192, 168, 1, 10)
+	tests := []struct {
+		name     string
+		packets  []string
+		want     string
+		attached []string
+	}{
+		{"lines", []string{"one\ntwo\n"}, "one\ntwo\n", []string{"one", "two"}},
+		{"split line", []string{"[ 1.0] Kern", "el panic\n"}, "[ 1.0] Kernel panic\n", []string{"[ 1.0] Kernel panic"}},
+		{"partial kept back", []string{"one\ntw"}, "one\n", []string{"one"}},
+		{"extended", []string{"6,123,4567,-;usb 1-1: new device\n SUBSYSTEM=usb\n DEVICE=c189:1\n"}, "usb 1-1: new device\n", []string{"usb 1-1: new device"}},
+		{"extended without newline", []string{"6,1,2,-;text"}, "text\n", []string{"text"}},
+		{"blank and crlf", []string{"a\r\n\nb\x00\n"}, "a\r\n\nb\x00\n", []string{"a", "b"}},
+		{"empty", []string{""}, "", nil},
+		{"long partial", []string{strings.Repeat("x", maxPartial+1)}, strings.Repeat("x", maxPartial+1), []string{strings.Repeat("x", maxPartial+1)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewStore(1 << 16)
+			n := NewNetconsole(store)
+			var attached []string
+			n.Attach = func(from net.IP, line string) {
+				if !from.Equal(ip) {
+					t.Errorf("attached from %s", from)
+				}
+				attached = append(attached, line)
+			}
+			for _, p := range tt.packets {
+				n.receive(ip, []byte(p))
+			}
+			data, _, _, _ := store.Read(ip.String(), 0)
+			if string(data) != tt.want {
+				t.Errorf("stored %q, want %q", data, tt.want)
+			}
+			if strings.Join(attached, "|") != strings.Join(tt.attached, "|") {
+				t.Errorf("attached %q, want %q", attached, tt.attached)
+			}
+		})
+	}
+}
+
+func TestNetconsolePartialPerClient(t *testing.T) {
+	store := NewStore(1024)
+	n := NewNetconsole(store)
+	a, b := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)
+	n.receive(a, []byte("from "))
+	n.receive(b, []byte("other\n"))
+	n.receive(a, []byte("a\n"))
+	for ip, want := range map[string]string{a.String(): "from a\n", b.String(): "other\n"} {
+		if data, _, _, _ := store.Read(ip, 0); string(data) != want {
+			t.Errorf("%s: %q, want %q", ip, data, want)
+		}
+	}
+}
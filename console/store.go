@@ -0,0 +1,118 @@
+package console
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Store keeps the most recent output of every client, keyed by client ID
+type Store struct {
+	mu       sync.Mutex
+	keep     int
+	consoles map[string]*buffer
+}
+
+// buffer is the tail of one client's output
+type buffer struct {
+	data []byte
+	end  int64 // bytes ever written; data holds the last len(data) of them
+	last time.Time
+
+	// changed is closed, and replaced, on every write
+	changed chan struct{}
+}
+
+// Client summarises one client's stored output
+type Client struct {
+	Client string    `json:"client"`
+	Bytes  int64     `json:"bytes"` // received in total, more than is kept
+	Last   time.Time `json:"last"`
+}
+
+// NewStore creates a store holding up to keep bytes per client
+func NewStore(keep int) *Store {
+	return &Store{keep: keep, consoles: make(map[string]*buffer)}
+}
+
+// Write appends p to client's output, dropping the oldest bytes when full
+func (s *Store) Write(client string, p []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.consoles[client]
+	if !ok {
+		b = &buffer{changed: make(chan struct{})}
+		s.consoles[client] = b
+	}
+	b.data = append(b.data, p...)
+	if len(b.data) > s.keep {
+		b.data = append([]byte(nil), b.data[len(b.data)-s.keep:]...)
+	}
+	b.end += int64(len(p))
+	b.last = time.Now()
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// Read returns client's output from offset from on, or from the oldest
+// byte kept if that is later, together with the offset to continue at and
+// a channel closed once there is more. A negative from reads everything
+// kept. Read reports false if the client sent nothing.
+func (s *Store) Read(client string, from int64) (data []byte, next int64, more <-chan struct{}, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.consoles[client]
+	if !ok {
+		return nil, 0, nil, false
+	}
+	start := b.end - int64(len(b.data))
+	from = min(max(from, start), b.end)
+	return append([]byte(nil), b.data[from-start:]...), b.end, b.changed, true
+}
+
+// Clients lists every client with stored output, most recently heard first
+func (s *Store) Clients() []Client {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]Client, 0, len(s.consoles))
+	for c, b := range s.consoles {
+		list = append(list, Client{Client: c, Bytes: b.end, Last: b.last})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Last.After(list[j].Last) })
+	return list
+}
+
+// Delete forgets client's output, reporting whether there was any
+func (s *Store) Delete(client string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.consoles[client]
+	if ok {
+		close(b.changed) // let followers notice
+		delete(s.consoles, client)
+	}
+	return ok
+}
+
+// Snapshot returns a copy of every client's kept output for backups
+func (s *Store) Snapshot() map[string][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snap := make(map[string][]byte, len(s.consoles))
+	for c, b := range s.consoles {
+		snap[c] = append([]byte(nil), b.data...)
+	}
+	return snap
+}
+
+// Load replaces every client's console output with snap, as a backup
+// restores it, keeping the newest bytes of output longer than the store
+// holds. Offsets start over from the restored output.
+func (s *Store) Load(snap map[string][]byte) {
+	s.mu.Lock()
+	s.consoles = make(map[string]*buffer, len(snap))
+	s.mu.Unlock()
+	for c, data := range snap {
+		s.Write(c, data)
+	}
+}
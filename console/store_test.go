@@ -0,0 +1,77 @@
+package console
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestStore(t *testing.T) {
+	s := NewStore(8)
+	if _, _, _, ok := s.Read("node1", 0); ok {
+		t.Fatal("read from a client that sent nothing")
+	}
+
+	s.Write("node1", []byte("hello"))
+	_, _, more, _ := s.Read("node1", 0)
+	s.Write("node1", []byte(" world"))
+	select {
+	case <-more:
+	default:
+		t.Error("write did not signal followers")
+	}
+
+	tests := []struct {
+		from int64
+		want string
+	}{
+		{-1, "lo world"},
+		{0, "lo world"},
+		{3, "lo world"},
+		{6, "world"},
+		{11, ""},
+		{100, ""},
+	}
+	for _, tt := range tests {
+		data, next, _, ok := s.Read("node1", tt.from)
+		if !ok || string(data) != tt.want || next != 11 {
+			t.Errorf("Read(%d) = %q, %d, %v; want %q, 11", tt.from, data, next, ok, tt.want)
+		}
+	}
+
+	time.Sleep(time.Millisecond)
+	s.Write("node2", []byte("x"))
+	clients := s.Clients()
+	if len(clients) != 2 || clients[0].Client != "node2" || clients[1].Bytes != 11 {
+		t.Errorf("Clients = %+v", clients)
+	}
+
+	_, _, more, _ = s.Read("node2", 0)
+	if !s.Delete("node2") || s.Delete("node2") {
+		t.Error("Delete reported wrongly")
+	}
+	select {
+	case <-more:
+	default:
+		t.Error("delete did not release followers")
+	}
+}
+
+func TestStoreSnapshot(t *testing.T) {
+	s := NewStore(4)
+	s.Write("node1", []byte("abcdef"))
+	snap := s.Snapshot()
+	if !bytes.Equal(snap["node1"], []byte("cdef")) {
+		t.Fatalf("snapshot = %q", snap)
+	}
+
+	s.Write("node2", []byte("gone"))
+	s.Load(map[string][]byte{"node1": []byte("0123456789")})
+	if _, _, _, ok := s.Read("node2", 0); ok {
+		t.Error("Load kept a client missing from the snapshot")
+	}
+	data, next, _, _ := s.Read("node1", 0)
+	if string(data) != "6789" || next != 10 {
+		t.Errorf("after Load: %q, %d", data, next)
+	}
+}
@@ -1,12 +1,21 @@
 package dhcp
 
 import (
+	"cmp"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
+	"time"
+
+	"github.com/ars1364/go-pxe/events"
+	"github.com/ars1364/go-pxe/quirks"
 )
 
 // DHCP message types
@@ -14,24 +23,34 @@ const (
 	DISCOVER = 1
 	OFFER    = 2
 	REQUEST  = 3
+	DECLINE  = 4
 	ACK      = 5
 	NAK      = 6
+	RELEASE  = 7
+	INFORM   = 8
 )
 
 // DHCP options
 const (
-	OptSubnetMask   = 1
-	OptRouter       = 3
-	OptDNS          = 6
-	OptBroadcast    = 28
-	OptRequestedIP  = 50
-	OptLeaseTime    = 51
-	OptMessageType  = 53
-	OptServerID     = 54
-	OptTFTPServer   = 66
-	OptBootFile     = 67
-	OptClientArch   = 93
-	OptEnd          = 255
+	OptSubnetMask  = 1
+	OptRouter      = 3
+	OptDNS         = 6
+	OptHostName    = 12
+	OptDomainName  = 15
+	OptBroadcast   = 28
+	OptNTPServers  = 42
+	OptRequestedIP = 50
+	OptLeaseTime   = 51
+	OptMessageType = 53
+	OptServerID    = 54
+	OptMessage     = 56
+	OptTFTPServer  = 66
+	OptBootFile    = 67
+	OptUserClass   = 77
+	OptRelayInfo   = 82
+	OptClientArch  = 93
+	OptIPXE        = 175
+	OptEnd         = 255
 )
 
 // Packet represents a BOOTP/DHCP packet
@@ -51,6 +70,8 @@ type Packet struct {
 	SName   [64]byte
 	File    [128]byte
 	Options map[byte][]byte
+
+	iface string // the interface it was received on, "" if unknown
 }
 
 // Config holds DHCP server configuration
@@ -62,11 +83,358 @@ type Config struct {
 	SubnetMask net.IPMask
 	BootFile   string
 	TFTPServer string
+	Router     net.IP   // advertised in option 3, ServerIP if nil
+	DNSServers []net.IP // advertised in option 6, ServerIP if empty
+	DomainName string   // advertised in option 15 if set
+	NTPServers []net.IP // advertised in option 42 if set
+	Events     *events.Bus
+	Domain     string // labels this server's metrics
+
+	// BootFiles, if set, replace BootFile for clients by architecture
+	// (see ArchBootFile), such as "bios": "undionly.kpxe"
+	BootFiles map[string]string
+
+	// BootFileFor, if set, may return the boot file of the client with
+	// mac, given its architecture name (see ArchName), "" if it sent
+	// none, and whether the file is the client's own rather than a
+	// default for its architecture. An empty result keeps the default.
+	//
+	// A client is offered, each replacing the one before: BootFile, or
+	// BootFiles' for its architecture; a default from BootFileFor; its
+	// relay pool's (see Pool); its own from BootFileFor; its
+	// reservation's; the BootMenu item it chose, without one of its own;
+	// IPXEBootFile once it runs iPXE; LocalBootFile if LocalBoot; and
+	// finally Decide's.
+	BootFileFor func(mac net.HardwareAddr, arch string) (file string, own bool)
+
+	// LocalBoot, if set, reports clients that must boot from their own
+	// disk. They are offered LocalBootFile instead, or no boot file at
+	// all, so PXE firmware moves on to the next boot device.
+	LocalBoot     func(mac net.HardwareAddr) bool
+	LocalBootFile string
+
+	// RaspberryPi, if set, reports clients that are Raspberry Pis, whose
+	// bootloader only boots from replies whose PXE options offer
+	// "Raspberry Pi Boot"
+	RaspberryPi func(mac net.HardwareAddr) bool
+
+	// BootMenu, if set, is offered to BIOS PXE clients without a boot
+	// file of their own (from BootFileFor or a reservation) in place of
+	// BootFile: the firmware shows MenuPrompt for MenuTimeout, then the
+	// menu if the user presses F8, and asks the boot server (ProxyPort)
+	// for the chosen item's boot file. See CheckMenu.
+	BootMenu    []MenuItem
+	MenuPrompt  string        // DefaultMenuPrompt if ""
+	MenuTimeout time.Duration // DefaultMenuTimeout if 0, at most 255s
+
+	// HTTPBootURL, if set, is the base URL relative boot files are
+	// offered under to UEFI HTTP boot clients, such as
+	// http://10.0.0.1:8080, which fetch them from there instead of TFTP
+	HTTPBootURL string
+
+	// IPXEBootFile, if set, is offered to iPXE (user class "iPXE" or
+	// option 175), such as the URL of a boot script, instead of the boot
+	// file that loaded it again
+	IPXEBootFile string
+
+	// AddressFor, if set, may return a fixed address for a client that
+	// replaces its pool address. Reserved reports addresses the pool must
+	// skip because they are fixed for someone else.
+	AddressFor func(mac net.HardwareAddr) net.IP
+	Reserved   func(ip net.IP) bool
+
+	// Reservations, by MAC address as net.HardwareAddr.String() gives
+	// it, always give those clients the same address, ahead of
+	// AddressFor, and the pool skips the addresses. A reservation's boot
+	// file, if set, replaces the one BootFileFor gives, and its host
+	// name is sent in option 12.
+	Reservations map[string]Reservation
+
+	// Observe, if set, is told about every client offered an address,
+	// with what it said about itself
+	Observe func(c Client)
+
+	// Workers is how many packets are handled at once, DefaultWorkers if
+	// 0, so a slow lease or inventory lookup for one client doesn't hold
+	// up the others
+	Workers int
+
+	// Decide, if set, may deny a DISCOVER, REQUEST or INFORM or change
+	// the reply, such as with a Hook, once everything above is applied.
+	// If it fails the request is denied, so a broken policy doesn't let
+	// through the clients it denies. A client denied the address it was
+	// just given from the pool gives it back.
+	Decide func(r Request) (Decision, error)
+
+	// Capture, if set, is given every packet received and sent, such as
+	// to record one client's; data is only valid during the call
+	Capture func(src, dst *net.UDPAddr, data []byte)
+
+	// Offered, if set, is told about every address offered or
+	// acknowledged, just before the reply goes out, such as to install an
+	// ARP entry for it
+	Offered func(ip net.IP, mac net.HardwareAddr)
+
+	// Dropped, if set, is told about every lease its client gave up
+	// before it expired, by releasing or declining it, such as to remove
+	// the ARP entry installed when it was offered
+	Dropped func(ip net.IP, mac net.HardwareAddr)
+
+	// DeclineHold is how long an address a client declined, having found
+	// another machine using it, is kept out of the pool
+	// (DefaultDeclineHold if 0)
+	DeclineHold time.Duration
+
+	// Probe, if set, is asked whether an address is in use before it is
+	// first offered, such as by a host configured statically inside the
+	// range. Addresses in use are kept out of the pool for DeclineHold,
+	// as if declined, and the client is offered the next one.
+	Probe func(ip net.IP) bool
+
+	// RelayPools, if set, serve clients on routed subnets whose requests
+	// a relay agent forwards, by the subnet its address (giaddr) is in.
+	// Replies go back to the relay agent; requests relayed from subnets
+	// without a pool are not answered.
+	RelayPools []Pool
+
+	// RawSocket sends replies to clients without an address as Ethernet
+	// frames to their MAC address, through AF_PACKET on Linux and BPF on
+	// macOS, rather than as UDP broadcasts, which some hosts and
+	// containers don't deliver
+	RawSocket bool
+
+	// LeaseTime is how long leases run from their last ACK, such as a few
+	// minutes on short-lived provisioning networks or days in a lab
+	// (DefaultLeaseTime if 0)
+	LeaseTime time.Duration
+
+	// AllowMACs, if set, are the only clients answered, by MAC address
+	// or OUI, such as on a switch shared with production hosts. Clients in
+	// DenyMACs are never answered.
+	AllowMACs MACList
+	DenyMACs  MACList
+
+	// Proxy makes the server a proxyDHCP server, for networks whose own
+	// DHCP server hands out addresses: PXE clients are offered their boot
+	// options only. The address a client takes from the other server is
+	// learned from its REQUEST and kept as its lease.
+	Proxy bool
+
+	// LeaseFile, if set, keeps the lease table on disk, so clients keep
+	// their addresses across restarts (see LoadLeaseFile)
+	LeaseFile string
+}
+
+// ProxyPort is the PXE boot server port, where PXE clients send a REQUEST
+// for their boot file once they have an address, such as after an offer
+// from a proxyDHCP server. It is answered in either mode.
+const ProxyPort = 4011
+
+// DefaultWorkers is how many packets a server handles at once unless
+// configured otherwise
+const DefaultWorkers = 32
+
+// DefaultLeaseTime is the lease time offered to clients unless configured
+// otherwise
+const DefaultLeaseTime = time.Hour
+
+// offerHold is how long an offered address is kept for the client before
+// it goes back to the pool, unless the client requests it or the lease
+// time is shorter
+const offerHold = time.Minute
+
+// DefaultDeclineHold is how long a declined address is kept out of the
+// pool unless configured otherwise
+const DefaultDeclineHold = 10 * time.Minute
+
+// probeAttempts is how many addresses in use a client may be passed over
+// for before it gets no offer this time, so probing never delays an
+// offer past the client's retransmission
+const probeAttempts = 3
+
+// reclaimInterval is how often expired leases are dropped and their
+// addresses reclaimed
+const reclaimInterval = time.Minute
+
+// queuePerWorker is how many received packets may wait per worker before
+// more are dropped; clients retransmit them
+const queuePerWorker = 8
+
+// Client is what a client's DISCOVER reveals about it
+type Client struct {
+	MAC    net.HardwareAddr
+	IP     net.IP // address offered
+	Arch   string // from option 93, "" if not sent
+	UUID   string // machine UUID from option 97
+	Vendor string // vendor class, option 60
+
+	// Relay is where its relay agent says it is attached, from option 82
+	Relay RelayInfo
+}
+
+// raspberryPiOpts are the PXE vendor options (option 43) a Raspberry Pi's
+// bootloader looks for, as dnsmasq sends them for pxe-service=0,"Raspberry
+// Pi Boot": discovery control, a menu prompt and the one boot menu item
+var raspberryPiOpts = append(append([]byte{
+	6, 1, 0x03,
+	10, 4, 0, 'P', 'X', 'E',
+	9, 20, 0, 0, 17}, "Raspberry Pi Boot"...), 255)
+
+// archNames are the RFC 4578 / IANA client system architecture types
+var archNames = map[uint16]string{
+	0:  "bios",
+	6:  "efi-ia32",
+	7:  "efi-x64",
+	9:  "efi-x64",
+	10: "efi-arm32",
+	11: "efi-arm64",
+	15: "efi-ia32-http",
+	16: "efi-x64-http",
+	18: "efi-arm32-http",
+	19: "efi-arm64-http",
+	21: "uboot-arm32",
+	22: "uboot-arm64",
+	25: "efi-riscv32",
+	26: "efi-riscv32-http",
+	27: "efi-riscv64",
+	28: "efi-riscv64-http",
+}
+
+// ArchName names a client system architecture type
+func ArchName(arch uint16) string {
+	if name, ok := archNames[arch]; ok {
+		return name
+	}
+	return fmt.Sprintf("arch-%d", arch)
+}
+
+// ArchCode is the client system architecture type name names, the lowest
+// of those sharing it, and whether there is one
+func ArchCode(name string) (uint16, bool) {
+	var code uint16
+	found := false
+	for c, n := range archNames {
+		if n == name && (!found || c < code) {
+			code, found = c, true
+		}
+	}
+	if rest, ok := strings.CutPrefix(name, "arch-"); ok && !found {
+		n, err := strconv.ParseUint(rest, 10, 16)
+		return uint16(n), err == nil
+	}
+	return code, found
+}
+
+// ArchBootFile is the boot file files names for clients of arch (see
+// ArchName), "" if none. UEFI HTTP boot clients, such as efi-x64-http, get
+// that of their architecture, and U-Boot ones that of UEFI on the same CPU
+// unless they have their own.
+func ArchBootFile(files map[string]string, arch string) string {
+	arch = strings.TrimSuffix(arch, "-http")
+	if f, ok := files[arch]; ok {
+		return f
+	}
+	if cpu, ok := strings.CutPrefix(arch, "uboot-"); ok {
+		return files["efi-"+cpu]
+	}
+	return ""
+}
+
+// ipv4s is ips as an option's list of IPv4 addresses
+func ipv4s(ips []net.IP) []byte {
+	var b []byte
+	for _, ip := range ips {
+		b = append(b, ip.To4()...)
+	}
+	return b
+}
+
+// isHTTPBoot reports whether req comes from UEFI HTTP boot firmware,
+// which identifies itself with vendor class HTTPClient and an HTTP
+// architecture type (16 for x64, 19 for ARM64, ...)
+func isHTTPBoot(req *Packet) bool {
+	if strings.HasPrefix(string(req.Options[60]), "HTTPClient") {
+		return true
+	}
+	arch := req.Options[OptClientArch]
+	return len(arch) >= 2 && strings.HasSuffix(ArchName(binary.BigEndian.Uint16(arch)), "-http")
+}
+
+// isIPXE reports whether req comes from iPXE, which sends its user class
+// as a bare string rather than an RFC 3004 length-prefixed list; either is
+// accepted. Builds without the user class still send their encapsulated
+// options (175), which the firmware's own PXE ROM never does.
+func isIPXE(req *Packet) bool {
+	if _, ok := req.Options[OptIPXE]; ok {
+		return true
+	}
+	uc := req.Options[OptUserClass]
+	return string(uc) == "iPXE" || len(uc) > 0 && int(uc[0]) == len(uc)-1 && string(uc[1:]) == "iPXE"
+}
+
+// clientInfo reads the PXE options of req
+func clientInfo(req *Packet, ip net.IP) Client {
+	c := Client{MAC: req.CHAddr, IP: ip, Vendor: string(req.Options[60]), Relay: relayInfo(req)}
+	if arch := req.Options[OptClientArch]; len(arch) >= 2 {
+		c.Arch = ArchName(binary.BigEndian.Uint16(arch))
+	}
+	// Type 0 and a GUID whose first three fields are little-endian, the
+	// same order dmidecode prints the SMBIOS UUID in
+	if g := req.Options[97]; len(g) == 17 && g[0] == 0 {
+		g = g[1:]
+		c.UUID = fmt.Sprintf("%02x%02x%02x%02x-%02x%02x-%02x%02x-%x-%x",
+			g[3], g[2], g[1], g[0], g[5], g[4], g[7], g[6], g[8:10], g[10:])
+	}
+	return c
 }
 
 type lease struct {
-	IP  net.IP
-	MAC net.HardwareAddr
+	IP   net.IP
+	MAC  net.HardwareAddr
+	UUID string
+	Arch string
+	Seen time.Time
+
+	// CircuitID and RemoteID are where the client's relay agent last said
+	// it is attached (option 82)
+	CircuitID string
+	RemoteID  string
+
+	// Issued is when the lease was last acknowledged, and Expires when
+	// its address goes back to the pool: the lease time after that, or
+	// offerHold after an offer the client hasn't taken yet
+	Issued  time.Time
+	Expires time.Time
+}
+
+// export is the snapshot of l
+func (l lease) export() Lease {
+	return Lease{MAC: l.MAC.String(), IP: l.IP.String(), UUID: l.UUID, Arch: l.Arch, Seen: l.Seen, Issued: l.Issued, Expires: l.Expires,
+		CircuitID: l.CircuitID, RemoteID: l.RemoteID}
+}
+
+// Reservation fixes a client's address, and optionally its boot file and
+// host name
+type Reservation struct {
+	IP       net.IP
+	BootFile string
+	HostName string
+}
+
+// Lease is an exported snapshot of one address assignment, with the
+// machine UUID and architecture the client's firmware last sent, when it
+// was last offered or acknowledged, and when it was issued and expires
+type Lease struct {
+	MAC     string    `json:"mac"`
+	IP      string    `json:"ip"`
+	UUID    string    `json:"uuid,omitempty"`
+	Arch    string    `json:"arch,omitempty"`
+	Seen    time.Time `json:"seen,omitzero"`
+	Issued  time.Time `json:"issued,omitzero"`
+	Expires time.Time `json:"expires,omitzero"`
+
+	CircuitID string `json:"circuitId,omitempty"`
+	RemoteID  string `json:"remoteId,omitempty"`
 }
 
 // Server is a minimal DHCP server for PXE booting
@@ -74,16 +442,59 @@ type Server struct {
 	config Config
 	leases map[string]lease
 	nextIP net.IP
+	dirty  bool // the lease table changed since it was last saved
 	mu     sync.Mutex
+
+	// relayNext are the allocation cursors of RelayPools, and poolAddrs
+	// the server's addresses on the interfaces of those that have one
+	relayNext []net.IP
+	poolAddrs []net.IP
+
+	// raw, if set, sends broadcast replies as frames to the client's MAC
+	// address from hwAddr, the interface's
+	raw    rawSender
+	hwAddr net.HardwareAddr
+
+	// quarantine holds addresses clients declined, until when they are
+	// kept out of the pool
+	quarantine map[uint32]time.Time
+
+	// inflight are the transactions being handled; a client's
+	// retransmission of one is dropped rather than answered twice
+	inflightMu sync.Mutex
+	inflight   map[transaction]bool
+}
+
+// transaction identifies one message of a client's exchange
+type transaction struct {
+	xid     uint32
+	mac     string
+	msgType byte
+}
+
+// job is a received packet waiting for a worker
+type job struct {
+	conn   *net.UDPConn
+	pkt    *Packet
+	remote *net.UDPAddr
+	tx     transaction
 }
 
 // NewServer creates a new DHCP server
 func NewServer(cfg Config) *Server {
-	return &Server{
-		config: cfg,
-		leases: make(map[string]lease),
-		nextIP: dupIP(cfg.RangeStart),
+	s := &Server{
+		config:     cfg,
+		leases:     make(map[string]lease),
+		quarantine: make(map[uint32]time.Time),
+		nextIP:     dupIP(cfg.RangeStart),
+		inflight:   make(map[transaction]bool),
+	}
+	for _, p := range cfg.RelayPools {
+		s.relayNext = append(s.relayNext, dupIP(p.RangeStart.To4()))
 	}
+	s.poolAddrs = make([]net.IP, len(cfg.RelayPools))
+	s.instrument()
+	return s
 }
 
 func dupIP(ip net.IP) net.IP {
@@ -92,140 +503,882 @@ func dupIP(ip net.IP) net.IP {
 	return dup
 }
 
-func (s *Server) allocateIP(mac net.HardwareAddr) net.IP {
+// allocateIP returns mac's address: its fixed one, the one it holds, or
+// the next free one in the pool, held for it for offerHold, and whether it
+// is that, fresh from the pool. Clients of a relay agent get theirs from
+// its pool. It is nil if the pool is exhausted, or the relay agent has
+// none.
+func (s *Server) allocateIP(req *Packet) (net.IP, bool) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	start, end, cursor, ok := s.poolRange(req)
+	if !ok {
+		return nil, false
+	}
+	mac := req.CHAddr
 	macStr := mac.String()
-	if l, ok := s.leases[macStr]; ok {
-		return l.IP
+	if ip := s.fixedIP(mac); ip != nil {
+		l := s.leases[macStr]
+		s.dirty = s.dirty || !l.IP.Equal(ip)
+		l.IP, l.MAC = ip, mac
+		if l.Expires.IsZero() {
+			l.Expires = time.Now().Add(min(offerHold, s.leaseTime()))
+		}
+		s.leases[macStr] = l
+		return ip, false
+	}
+	if l, ok := s.leases[macStr]; ok && inRange(l.IP, start, end) {
+		return l.IP, false
 	}
 
-	ip := dupIP(s.nextIP)
-	s.leases[macStr] = lease{IP: ip, MAC: mac}
+	ip := s.freeIP(start, end, cursor)
+	if ip == nil {
+		return nil, false
+	}
+	s.leases[macStr] = lease{IP: ip, MAC: mac, Expires: time.Now().Add(min(offerHold, s.leaseTime()))}
+	s.dirty = true
+	return ip, true
+}
 
-	ipv4 := s.nextIP.To4()
-	val := binary.BigEndian.Uint32(ipv4)
-	val++
-	binary.BigEndian.PutUint32(ipv4, val)
-	s.nextIP = ipv4
+// offerIP allocates req's client the address to offer, probing one fresh
+// from the pool first if Probe is set and passing over those in use. It
+// is nil, and logged why, if there is none.
+func (s *Server) offerIP(req *Packet) net.IP {
+	for range probeAttempts {
+		ip, fresh := s.allocateIP(req)
+		if ip == nil {
+			s.noAddress(req)
+			return nil
+		}
+		if !fresh || s.config.Probe == nil || !s.config.Probe(ip) {
+			return ip
+		}
+		s.conflict(req.CHAddr, ip)
+	}
+	log.Printf("[DHCP] %d addresses in a row in use, no offer for %s this time", probeAttempts, req.CHAddr)
+	return nil
+}
+
+// holds reports whether mac holds a lease or an offer
+func (s *Server) holds(mac net.HardwareAddr) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.leases[mac.String()]
+	return ok
+}
+
+// fixedIP is mac's reserved or otherwise fixed address, nil if it has
+// none
+func (s *Server) fixedIP(mac net.HardwareAddr) net.IP {
+	if r, ok := s.config.Reservations[mac.String()]; ok && r.IP != nil {
+		return r.IP.To4()
+	}
+	if s.config.AddressFor != nil {
+		return s.config.AddressFor(mac)
+	}
+	return nil
+}
 
+// reserved reports whether ip is a reservation's or otherwise fixed for
+// someone
+func (s *Server) reserved(ip net.IP) bool {
+	for _, r := range s.config.Reservations {
+		if ip.Equal(r.IP) {
+			return true
+		}
+	}
+	return s.config.Reserved != nil && s.config.Reserved(ip)
+}
+
+// inRange reports whether ip is between start and end
+func inRange(ip, start, end net.IP) bool {
+	return ip.To4() != nil && ipToUint(ip) >= ipToUint(start) && ipToUint(ip) <= ipToUint(end)
+}
+
+// freeIP finds the next address from start to end after the cursor,
+// wrapping around once, that is neither reserved nor leased, reclaiming it
+// from an expired lease, and moves the cursor past it; s.mu is held
+func (s *Server) freeIP(rangeStart, rangeEnd net.IP, cursor *net.IP) net.IP {
+	held := make(map[uint32]string, len(s.leases))
+	for key, l := range s.leases {
+		held[ipToUint(l.IP)] = key
+	}
+	start, end := ipToUint(rangeStart), ipToUint(rangeEnd)
+	next := ipToUint(*cursor)
+	for range end - start + 1 {
+		if next < start || next > end {
+			next = start
+		}
+		ip := uintToIP(next)
+		next++
+		if s.reserved(ip) {
+			continue
+		}
+		if until, ok := s.quarantine[ipToUint(ip)]; ok {
+			if time.Now().Before(until) {
+				continue
+			}
+			delete(s.quarantine, ipToUint(ip))
+		}
+		if key, ok := held[ipToUint(ip)]; ok {
+			if time.Now().Before(s.leases[key].Expires) {
+				continue
+			}
+			s.expire(key)
+		}
+		*cursor = uintToIP(next)
+		return ip
+	}
+	return nil
+}
+
+// expire drops the lease stored under key, its time being up; s.mu is
+// held
+func (s *Server) expire(key string) {
+	l := s.leases[key]
+	delete(s.leases, key)
+	s.dirty = true
+	mExpired.With(s.config.Domain).Inc()
+	log.Printf("[DHCP] Lease of %s to %s expired, address reclaimed", l.IP, l.MAC)
+}
+
+// reclaim drops expired leases every reclaimInterval, until the process
+// exits
+func (s *Server) reclaim() {
+	for range time.Tick(reclaimInterval) {
+		s.mu.Lock()
+		for key, l := range s.leases {
+			if !l.Expires.IsZero() && time.Now().After(l.Expires) {
+				s.expire(key)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// leaseTime is how long leases run
+func (s *Server) leaseTime() time.Duration {
+	return cmp.Or(s.config.LeaseTime, DefaultLeaseTime)
+}
+
+// renew starts mac's lease over, for the lease time from now
+func (s *Server) renew(mac net.HardwareAddr) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.leases[mac.String()]
+	if !ok {
+		return
+	}
+	l.Issued = time.Now()
+	l.Expires = l.Issued.Add(s.leaseTime())
+	s.leases[mac.String()] = l
+	s.dirty = true
+}
+
+// release ends mac's lease of ip early, as the client asked
+func (s *Server) release(mac net.HardwareAddr, ip net.IP) {
+	if !s.drop(mac, ip) {
+		return
+	}
+	log.Printf("[DHCP] RELEASE %s from %s", ip, mac)
+}
+
+// decline ends mac's lease of ip, which the client found another machine
+// using, and keeps ip out of the pool for DeclineHold so nobody else is
+// offered it meanwhile
+func (s *Server) decline(mac net.HardwareAddr, ip net.IP) {
+	if !s.drop(mac, ip) {
+		return
+	}
+	until := s.hold(ip)
+	mDeclined.With(s.config.Domain).Inc()
+	log.Printf("[DHCP] DECLINE %s from %s: address in use by another machine, quarantined until %s", ip, mac, until.Format(time.TimeOnly))
+}
+
+// conflict ends mac's lease of ip, just taken from the pool, which a probe
+// found another machine using, and keeps ip out of the pool for
+// DeclineHold like a declined address
+func (s *Server) conflict(mac net.HardwareAddr, ip net.IP) {
+	s.drop(mac, ip)
+	until := s.hold(ip)
+	mConflicts.With(s.config.Domain).Inc()
+	log.Printf("[DHCP] Probe of %s for %s answered: address in use by another machine, quarantined until %s", ip, mac, until.Format(time.TimeOnly))
+}
+
+// hold keeps ip out of the pool for DeclineHold, and returns until when
+func (s *Server) hold(ip net.IP) time.Time {
+	until := time.Now().Add(cmp.Or(s.config.DeclineHold, DefaultDeclineHold))
+	s.mu.Lock()
+	s.quarantine[ipToUint(ip)] = until
+	s.mu.Unlock()
+	return until
+}
+
+// drop deletes mac's lease if it is of ip, and reports whether it was
+func (s *Server) drop(mac net.HardwareAddr, ip net.IP) bool {
+	s.mu.Lock()
+	l, ok := s.leases[mac.String()]
+	ok = ok && ip != nil && l.IP.Equal(ip)
+	if ok {
+		delete(s.leases, mac.String())
+		s.dirty = true
+	}
+	s.mu.Unlock()
+	if ok && s.config.Dropped != nil {
+		s.config.Dropped(ip, mac)
+	}
+	return ok
+}
+
+// learn keeps the UUID, architecture and relay agent information of the
+// client's lease, and when it was seen. Requests without them, like those
+// of the installed OS or renewals bypassing the relay agent, leave them as
+// they were.
+func (s *Server) learn(c Client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.leases[c.MAC.String()]
+	if !ok {
+		return
+	}
+	l.UUID, l.Arch = cmp.Or(c.UUID, l.UUID), cmp.Or(c.Arch, l.Arch)
+	if c.Relay != (RelayInfo{}) {
+		l.CircuitID, l.RemoteID = c.Relay.CircuitID, c.Relay.RemoteID
+	}
+	l.Seen = time.Now()
+	s.leases[c.MAC.String()] = l
+	s.dirty = true
+}
+
+// Leases returns a snapshot of the current lease table
+func (s *Server) Leases() []Lease {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]Lease, 0, len(s.leases))
+	for _, l := range s.leases {
+		list = append(list, l.export())
+	}
+	return list
+}
+
+// LeaseFor returns the address leased to mac
+func (s *Server) LeaseFor(mac net.HardwareAddr) (net.IP, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.leases[mac.String()]
+	return l.IP, ok
+}
+
+// Revoke drops the lease held by mac. The address is not reused until the
+// allocation cursor wraps around the pool; the client gets a fresh address
+// on its next DORA.
+func (s *Server) Revoke(mac net.HardwareAddr) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.leases[mac.String()]; !ok {
+		return false
+	}
+	delete(s.leases, mac.String())
+	s.dirty = true
+	return true
+}
+
+// LoadLeases seeds the lease table, e.g. from a backup, and moves the
+// allocation cursor past every restored address in the range. Leases
+// without an expiry, from before they had one, run for the lease time
+// more.
+func (s *Server) LoadLeases(list []Lease) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, l := range list {
+		mac, err := net.ParseMAC(l.MAC)
+		ip := net.ParseIP(l.IP).To4()
+		if err != nil || ip == nil {
+			log.Printf("[DHCP] Skipping invalid lease %s -> %s", l.MAC, l.IP)
+			continue
+		}
+		expires := l.Expires
+		if expires.IsZero() {
+			expires = time.Now().Add(s.leaseTime())
+		}
+		s.leases[mac.String()] = lease{IP: ip, MAC: mac, UUID: l.UUID, Arch: l.Arch, Seen: l.Seen, Issued: l.Issued, Expires: expires,
+			CircuitID: l.CircuitID, RemoteID: l.RemoteID}
+		if !s.config.Proxy && ipToUint(ip) >= ipToUint(s.nextIP) && ipToUint(ip) <= ipToUint(s.config.RangeEnd) {
+			s.nextIP = uintToIP(ipToUint(ip) + 1)
+		}
+	}
+	s.dirty = true
+	log.Printf("[DHCP] Loaded %d leases", len(list))
+}
+
+func ipToUint(ip net.IP) uint32 {
+	return binary.BigEndian.Uint32(ip.To4())
+}
+
+func uintToIP(v uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, v)
 	return ip
 }
 
 // ListenAndServe starts the DHCP server on port 67
 func (s *Server) ListenAndServe() error {
-	// Listen on 0.0.0.0:67 to receive broadcast DISCOVERs.
-	// Replies go out from port 67 (same socket) — PXE clients reject non-67 source.
-	addr := &net.UDPAddr{IP: net.IPv4zero, Port: 67}
-	conn, err := net.ListenUDP("udp4", addr)
-	if err != nil {
-		return fmt.Errorf("DHCP listen: %w", err)
-	}
-	defer conn.Close()
-
 	ifi, err := net.InterfaceByName(s.config.Interface)
 	if err != nil {
 		return fmt.Errorf("interface lookup %s: %w", s.config.Interface, err)
 	}
 
-	// Pin the socket to the PXE interface and enable broadcast.
-	rawConn, err := conn.SyscallConn()
+	conn, err := listen(ifi)
 	if err != nil {
-		return fmt.Errorf("syscall conn: %w", err)
+		return fmt.Errorf("DHCP listen: %w", err)
 	}
-	var sockErr error
-	rawConn.Control(func(fd uintptr) {
-		// SO_BROADCAST: allow sending to broadcast addresses
-		if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1); err != nil {
-			sockErr = fmt.Errorf("SO_BROADCAST: %w", err)
-			return
+	defer conn.Close()
+
+	log.Printf("[DHCP] Listening on %s:67 (interface %s, pinned via %s index %d)", s.config.ServerIP, ifi.Name, pinMethod, ifi.Index)
+	poolConns := make(map[string]*net.UDPConn)
+	for i, p := range s.config.RelayPools {
+		if p.Interface == "" {
+			continue
 		}
-		// IP_BOUND_IF (25 on Darwin): pin socket to interface by index
-		const IP_BOUND_IF = 25
-		if err := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, IP_BOUND_IF, ifi.Index); err != nil {
-			sockErr = fmt.Errorf("IP_BOUND_IF: %w", err)
-			return
+		pconn, addr, err := s.listenPool(p)
+		if err != nil {
+			return fmt.Errorf("pool %s: %w", p.Subnet, err)
+		}
+		defer pconn.Close()
+		s.poolAddrs[i], poolConns[p.Interface] = addr, pconn
+		log.Printf("[DHCP] Listening on %s:67 for pool %s", p.Interface, p.Subnet)
+	}
+	if s.config.LeaseFile != "" {
+		go s.persist()
+	}
+	go s.reclaim()
+	if s.config.RawSocket {
+		if raw, err := openRaw(ifi); err != nil {
+			log.Printf("[DHCP] Raw socket unavailable, broadcasting replies: %v", err)
+		} else {
+			defer raw.Close()
+			s.raw, s.hwAddr = raw, ifi.HardwareAddr
+			log.Printf("[DHCP] Sending replies as frames to client MAC addresses via %s", rawMethod)
 		}
-	})
-	if sockErr != nil {
-		return fmt.Errorf("send socket options: %w", sockErr)
 	}
 
-	log.Printf("[DHCP] Listening on %s:67 (interface %s, pinned via IP_BOUND_IF index %d)", s.config.ServerIP, ifi.Name, ifi.Index)
+	workers := cmp.Or(s.config.Workers, DefaultWorkers)
+	jobs := make(chan job, workers*queuePerWorker)
+	defer close(jobs)
+	for range workers {
+		go func() {
+			for j := range jobs {
+				s.handle(j.conn, j.pkt, j.remote)
+				s.inflightMu.Lock()
+				delete(s.inflight, j.tx)
+				s.inflightMu.Unlock()
+			}
+		}()
+	}
+
+	for name, pconn := range poolConns {
+		go s.receive(pconn, name, jobs)
+	}
+	if s.config.Proxy {
+		log.Printf("[DHCP] proxyDHCP: answering PXE clients only, addresses come from the network's DHCP server")
+	}
+	pconn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: s.config.ServerIP, Port: ProxyPort})
+	switch {
+	case err != nil && s.config.Proxy:
+		return fmt.Errorf("PXE boot server listen: %w", err)
+	case err != nil:
+		log.Printf("[DHCP] Not answering PXE boot server requests: %v", err)
+	default:
+		defer pconn.Close()
+		log.Printf("[DHCP] PXE boot server listening on %s:%d", s.config.ServerIP, ProxyPort)
+		go s.receive(pconn, "", jobs)
+	}
+	s.receive(conn, ifi.Name, jobs)
+	return nil
+}
+
+// listen opens 0.0.0.0:67 on ifi, to receive broadcast DISCOVERs. Replies
+// go out from port 67 (same socket) — PXE clients reject non-67 source.
+// Socket options must be set before bind so the port can be shared
+// between servers pinned to different interfaces.
+func listen(ifi *net.Interface) (*net.UDPConn, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			if err := c.Control(func(fd uintptr) { sockErr = setSocketOptions(fd, ifi) }); err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+	pc, err := lc.ListenPacket(context.Background(), "udp4", "0.0.0.0:67")
+	if err != nil {
+		return nil, err
+	}
+	return pc.(*net.UDPConn), nil
+}
 
+// receive reads packets from conn, received on the interface iface ("" if
+// it isn't pinned to one), and queues them for the workers
+func (s *Server) receive(conn *net.UDPConn, iface string, jobs chan<- job) {
+	port := conn.LocalAddr().(*net.UDPAddr).Port
 	buf := make([]byte, 1500)
 	for {
 		n, remote, err := conn.ReadFromUDP(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
 			log.Printf("[DHCP] Read error: %v", err)
 			continue
 		}
 
-		pkt, err := parsePacket(buf[:n])
+		if s.config.Capture != nil {
+			dst := &net.UDPAddr{IP: net.IPv4bcast, Port: port}
+			if !remote.IP.IsUnspecified() || port == ProxyPort {
+				// From a relay agent, a client renewing or one asking the proxy
+				dst.IP = s.config.ServerIP
+			}
+			s.config.Capture(remote, dst, buf[:n])
+		}
+
+		// The packet is parsed into copies, so buf can be reused at once
+		pkt, found, err := parsePacket(buf[:n])
 		if err != nil {
 			log.Printf("[DHCP] Parse error: %v", err)
+			mInvalid.With(s.config.Domain).Inc()
+			continue
+		}
+		pkt.iface = iface
+		if !s.tolerate(pkt, found) {
+			mInvalid.With(s.config.Domain).Inc()
 			continue
 		}
 
 		msgType := pkt.Options[OptMessageType]
 		if len(msgType) == 0 {
+			mInvalid.With(s.config.Domain).Inc()
+			continue
+		}
+		mReceived.With(s.config.Domain, msgTypeName(msgType[0])).Inc()
+		if s.filtered(pkt.CHAddr) {
+			log.Printf("[DHCP] Ignoring %s from %s (not allowed)", msgTypeName(msgType[0]), pkt.CHAddr)
+			mDropped.With(s.config.Domain, "filtered").Inc()
 			continue
 		}
 
-		// Log PXE-specific options for diagnostics
-		isPXE := false
-		if vc, ok := pkt.Options[60]; ok {
-			log.Printf("[DHCP] Vendor Class (opt60): %q from %s", string(vc), pkt.CHAddr)
-			if len(vc) >= 9 && string(vc[:9]) == "PXEClient" {
-				isPXE = true
-			}
+		tx := transaction{xid: pkt.XID, mac: pkt.CHAddr.String(), msgType: msgType[0]}
+		s.inflightMu.Lock()
+		busy := s.inflight[tx]
+		s.inflight[tx] = true
+		s.inflightMu.Unlock()
+		if busy {
+			mDropped.With(s.config.Domain, "duplicate").Inc()
+			continue
 		}
-		if arch, ok := pkt.Options[OptClientArch]; ok {
-			if len(arch) >= 2 {
-				archVal := binary.BigEndian.Uint16(arch)
-				log.Printf("[DHCP] Client Arch (opt93): %d from %s", archVal, pkt.CHAddr)
-			}
+		select {
+		case jobs <- job{conn: conn, pkt: pkt, remote: remote, tx: tx}:
+		default:
+			s.inflightMu.Lock()
+			delete(s.inflight, tx)
+			s.inflightMu.Unlock()
+			log.Printf("[DHCP] Busy, dropping %s from %s", msgTypeName(msgType[0]), pkt.CHAddr)
+			mDropped.With(s.config.Domain, "busy").Inc()
+		}
+	}
+}
+
+// handle answers one packet
+func (s *Server) handle(conn *net.UDPConn, pkt *Packet, remote *net.UDPAddr) {
+	msgType := pkt.Options[OptMessageType]
+
+	// Log PXE-specific options for diagnostics
+	isPXE := false
+	if vc, ok := pkt.Options[60]; ok {
+		log.Printf("[DHCP] Vendor Class (opt60): %q from %s", string(vc), pkt.CHAddr)
+		if len(vc) >= 9 && string(vc[:9]) == "PXEClient" || len(vc) >= 10 && string(vc[:10]) == "HTTPClient" {
+			isPXE = true
 		}
-		if uuid, ok := pkt.Options[97]; ok {
-			log.Printf("[DHCP] Client UUID (opt97): %x from %s", uuid, pkt.CHAddr)
+	}
+	if arch, ok := pkt.Options[OptClientArch]; ok {
+		if len(arch) >= 2 {
+			archVal := binary.BigEndian.Uint16(arch)
+			log.Printf("[DHCP] Client Arch (opt93): %d from %s", archVal, pkt.CHAddr)
 		}
+	}
+	if uuid, ok := pkt.Options[97]; ok {
+		log.Printf("[DHCP] Client UUID (opt97): %x from %s", uuid, pkt.CHAddr)
+	}
+	if info := relayInfo(pkt); info != (RelayInfo{}) {
+		log.Printf("[DHCP] Relay Agent Info (opt82): circuit-id %q remote-id %q from %s via %s", info.CircuitID, info.RemoteID, pkt.CHAddr, pkt.GIAddr)
+	}
 
-		switch msgType[0] {
-		case DISCOVER:
-			if isPXE {
-				log.Printf("[DHCP] >>> PXE DISCOVER from %s <<<", pkt.CHAddr)
-			} else {
-				log.Printf("[DHCP] DISCOVER from %s (non-PXE)", pkt.CHAddr)
-			}
-			s.sendOffer(conn, pkt, remote)
-		case REQUEST:
-			log.Printf("[DHCP] REQUEST from %s (PXE=%v)", pkt.CHAddr, isPXE)
-			s.sendACK(conn, pkt, remote)
-		default:
-			log.Printf("[DHCP] Type %d from %s", msgType[0], pkt.CHAddr)
+	switch {
+	case conn.LocalAddr().(*net.UDPAddr).Port == ProxyPort:
+		s.bootServer(conn, pkt, remote, isPXE)
+		return
+	case s.config.Proxy:
+		s.proxy(conn, pkt, isPXE)
+		return
+	}
+	switch msgType[0] {
+	case DISCOVER:
+		if isPXE {
+			log.Printf("[DHCP] >>> PXE DISCOVER from %s <<<", pkt.CHAddr)
+		} else {
+			log.Printf("[DHCP] DISCOVER from %s (non-PXE)", pkt.CHAddr)
+		}
+		s.sendOffer(conn, pkt, remote)
+	case REQUEST:
+		log.Printf("[DHCP] REQUEST from %s (PXE=%v)", pkt.CHAddr, isPXE)
+		s.sendACK(conn, pkt, remote)
+	case INFORM:
+		log.Printf("[DHCP] INFORM from %s at %s", pkt.CHAddr, pkt.CIAddr)
+		if _, ok := s.clientPool(pkt); !ok {
+			s.noAddress(pkt)
+			return
+		}
+		if s.sendReply(conn, pkt, ACK, pkt.CIAddr, nil) {
+			log.Printf("[DHCP] INFORM ACK -> %s", pkt.CHAddr)
+		}
+	case RELEASE, DECLINE:
+		if id := pkt.Options[OptServerID]; id != nil && !net.IP(id).Equal(s.config.ServerIP) {
+			return // for another server
 		}
+		if msgType[0] == RELEASE {
+			s.release(pkt.CHAddr, pkt.CIAddr)
+		} else {
+			s.decline(pkt.CHAddr, net.IP(pkt.Options[OptRequestedIP]).To4())
+		}
+	default:
+		log.Printf("[DHCP] Type %d from %s", msgType[0], pkt.CHAddr)
 	}
 }
 
 func (s *Server) sendOffer(conn *net.UDPConn, req *Packet, remote *net.UDPAddr) {
-	ip := s.allocateIP(req.CHAddr)
+	held := s.holds(req.CHAddr)
+	ip := s.offerIP(req)
+	if ip == nil {
+		return
+	}
+	c := clientInfo(req, ip)
+	s.learn(c)
+	if !s.sendReply(conn, req, OFFER, ip, nil) {
+		if !held {
+			s.drop(req.CHAddr, ip)
+		}
+		return
+	}
 	log.Printf("[DHCP] OFFER %s -> %s", ip, req.CHAddr)
-	s.sendReply(conn, req, OFFER, ip)
+	s.config.Events.Publish(events.Event{Type: events.DHCPOffer, MAC: req.CHAddr, IP: ip})
+	if s.config.Observe != nil {
+		s.config.Observe(c)
+	}
 }
 
 func (s *Server) sendACK(conn *net.UDPConn, req *Packet, remote *net.UDPAddr) {
-	ip := s.allocateIP(req.CHAddr)
+	if id := req.Options[OptServerID]; id != nil && !net.IP(id).Equal(s.config.ServerIP) {
+		log.Printf("[DHCP] %s took the offer of server %s", req.CHAddr, net.IP(id))
+		return
+	}
+	held := s.holds(req.CHAddr)
+	ip, nak := s.requestedIP(req)
+	if nak != "" {
+		s.sendNAK(conn, req, nak)
+		return
+	}
+	if ip == nil {
+		s.noAddress(req)
+		return
+	}
+	s.learn(clientInfo(req, ip))
+	if !s.sendReply(conn, req, ACK, ip, nil) {
+		if !held {
+			s.drop(req.CHAddr, ip)
+		}
+		return
+	}
+	s.renew(req.CHAddr)
 	log.Printf("[DHCP] ACK %s -> %s", ip, req.CHAddr)
-	s.sendReply(conn, req, ACK, ip)
+	s.config.Events.Publish(events.Event{Type: events.DHCPAck, MAC: req.CHAddr, IP: ip})
+}
+
+// requested is the address req asks for: option 50 when selecting an
+// offer or rebooting, ciaddr when renewing. It is nil if neither is set.
+func requested(req *Packet) net.IP {
+	if ip := net.IP(req.Options[OptRequestedIP]).To4(); ip != nil {
+		return ip
+	}
+	if req.CIAddr != nil && !req.CIAddr.IsUnspecified() {
+		return req.CIAddr.To4()
+	}
+	return nil
+}
+
+// requestedIP is the address to acknowledge for req, the one its client
+// asks for, or why its client may not have that, so it is sent a NAK and
+// starts over. A client without a lease, such as after a restart without
+// a lease file, is given the address it asks for if that is free.
+func (s *Server) requestedIP(req *Packet) (net.IP, string) {
+	want := requested(req)
+	if want == nil {
+		ip, _ := s.allocateIP(req)
+		return ip, ""
+	}
+	if nak := s.claim(req, want); nak != "" {
+		return nil, nak
+	}
+	ip, _ := s.allocateIP(req)
+	return ip, ""
+}
+
+// claim checks that req's client may have want: on its subnet, within its
+// pool, its fixed address if it has one, its lease if it holds one, and
+// free otherwise, in which case want becomes its lease. It returns why
+// not, "" if it may.
+func (s *Server) claim(req *Packet, want net.IP) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	start, end, _, ok := s.poolRange(req)
+	if !ok {
+		return "" // no address at all
+	}
+	mask, _ := s.subnet(req)
+	mac := req.CHAddr
+	if !want.Mask(mask).Equal(start.Mask(mask)) {
+		return fmt.Sprintf("%s is not on this subnet", want)
+	}
+	if ip := s.fixedIP(mac); ip != nil {
+		if !ip.Equal(want) {
+			return fmt.Sprintf("%s is not its address %s", want, ip)
+		}
+		return ""
+	}
+	if !inRange(want, start, end) {
+		return fmt.Sprintf("%s is outside the range %s - %s", want, start, end)
+	}
+	if l, ok := s.leases[mac.String()]; ok && inRange(l.IP, start, end) {
+		if !l.IP.Equal(want) {
+			return fmt.Sprintf("%s is not its lease %s", want, l.IP)
+		}
+		return ""
+	}
+
+	if s.reserved(want) {
+		return fmt.Sprintf("%s is reserved", want)
+	}
+	if until, ok := s.quarantine[ipToUint(want)]; ok && time.Now().Before(until) {
+		return fmt.Sprintf("%s is in use by another machine", want)
+	}
+	for key, l := range s.leases {
+		if !l.IP.Equal(want) {
+			continue
+		}
+		if time.Now().Before(l.Expires) {
+			return fmt.Sprintf("%s is leased to %s", want, l.MAC)
+		}
+		s.expire(key)
+	}
+	s.leases[mac.String()] = lease{IP: want, MAC: mac, Expires: time.Now().Add(min(offerHold, s.leaseTime()))}
+	s.dirty = true
+	return ""
 }
 
-func (s *Server) sendReply(conn *net.UDPConn, req *Packet, msgType byte, clientIP net.IP) {
+// sendNAK refuses req, whose client may not have the address it asks for,
+// so it starts over with a DISCOVER. The reason goes in option 56.
+func (s *Server) sendNAK(conn *net.UDPConn, req *Packet, reason string) {
+	reply := &Packet{
+		Op:     2, // BOOTREPLY
+		HType:  1,
+		HLen:   6,
+		XID:    req.XID,
+		Flags:  req.Flags,
+		GIAddr: req.GIAddr,
+		CHAddr: req.CHAddr,
+		Options: map[byte][]byte{
+			OptMessageType: {NAK},
+			OptServerID:    s.config.ServerIP.To4(),
+			OptMessage:     []byte(reason),
+		},
+	}
+	// Broadcast, as the client may not have the address it thinks it has,
+	// or through the relay agent with the broadcast bit set (RFC 2131)
+	dst, via := &net.UDPAddr{IP: net.IPv4bcast, Port: 68}, viaBroadcast
+	if relayed(req) {
+		reply.Flags |= 0x8000
+		dst, via = &net.UDPAddr{IP: req.GIAddr.To4(), Port: 67}, viaUDP
+	}
+	s.send(conn, req, NAK, s.pad(req, NAK, serializePacket(reply)), dst, via, s.broadcast(req))
+	log.Printf("[DHCP] NAK %s: %s", req.CHAddr, reason)
+}
+
+// noAddress logs why req's client got no address
+func (s *Server) noAddress(req *Packet) {
+	switch {
+	case !relayed(req):
+		log.Printf("[DHCP] Pool exhausted, no address for %s", req.CHAddr)
+	case s.relayPool(req.GIAddr) < 0:
+		log.Printf("[DHCP] No pool for relay agent %s, ignoring %s", req.GIAddr, req.CHAddr)
+	default:
+		log.Printf("[DHCP] Pool of relay agent %s exhausted, no address for %s", req.GIAddr, req.CHAddr)
+	}
+}
+
+// proxy answers pkt as a proxyDHCP server. PXE DISCOVERs are offered the
+// boot options, and REQUESTs naming this server acknowledged with them;
+// the others are for the network's DHCP server, and tell which address
+// the client takes. Clients that booted by PXE are followed when they ask
+// again without it, such as from an installer.
+func (s *Server) proxy(conn *net.UDPConn, pkt *Packet, isPXE bool) {
+	msgType := pkt.Options[OptMessageType][0]
+	var ip net.IP
+	if msgType == REQUEST {
+		if ip = pkt.CIAddr; ip.IsUnspecified() {
+			ip = net.IP(pkt.Options[OptRequestedIP]).To4()
+		}
+		if _, booted := s.LeaseFor(pkt.CHAddr); ip != nil && (isPXE || booted) {
+			s.taken(clientInfo(pkt, ip))
+		}
+	}
+	if !isPXE {
+		log.Printf("[DHCP] Ignoring %s from %s (non-PXE, left to the network's DHCP server)", msgTypeName(msgType), pkt.CHAddr)
+		return
+	}
+	switch msgType {
+	case DISCOVER:
+		log.Printf("[DHCP] >>> PXE DISCOVER from %s (proxyDHCP) <<<", pkt.CHAddr)
+		if s.sendReply(conn, pkt, OFFER, nil, nil) {
+			log.Printf("[DHCP] Proxy OFFER -> %s", pkt.CHAddr)
+		}
+	case REQUEST:
+		if !net.IP(pkt.Options[OptServerID]).Equal(s.config.ServerIP.To4()) {
+			return
+		}
+		log.Printf("[DHCP] REQUEST from %s to proxyDHCP", pkt.CHAddr)
+		if s.sendReply(conn, pkt, ACK, ip, nil) {
+			log.Printf("[DHCP] Proxy ACK -> %s", pkt.CHAddr)
+		}
+	case INFORM:
+		log.Printf("[DHCP] INFORM from %s at %s to proxyDHCP", pkt.CHAddr, pkt.CIAddr)
+		if s.sendReply(conn, pkt, ACK, pkt.CIAddr, nil) {
+			log.Printf("[DHCP] Proxy INFORM ACK -> %s", pkt.CHAddr)
+		}
+	default:
+		log.Printf("[DHCP] Type %d from %s", msgType, pkt.CHAddr)
+	}
+}
+
+// bootServer answers a PXE client's REQUEST to ProxyPort, sent once it
+// has an address, with the boot options. Without an answer some firmware
+// stalls with PXE-E53.
+func (s *Server) bootServer(conn *net.UDPConn, pkt *Packet, remote *net.UDPAddr, isPXE bool) {
+	msgType := pkt.Options[OptMessageType][0]
+	if msgType != REQUEST || !isPXE {
+		log.Printf("[DHCP] Ignoring %s from %s on the PXE boot server port", msgTypeName(msgType), pkt.CHAddr)
+		return
+	}
+	ip := pkt.CIAddr
+	if ip.IsUnspecified() {
+		ip = remote.IP.To4()
+	}
+	if s.config.Proxy {
+		s.taken(clientInfo(pkt, ip))
+	}
+	log.Printf("[DHCP] Boot server REQUEST from %s at %s", pkt.CHAddr, ip)
+	if s.sendReply(conn, pkt, ACK, ip, remote) {
+		log.Printf("[DHCP] Boot server ACK -> %s at %s", pkt.CHAddr, remote)
+	}
+}
+
+// bootItem is the PXE boot item (sub-option 71 of option 43) a boot
+// server REQUEST asks for, nil if none; the ACK must name the same type
+// and layer
+func bootItem(opts []byte) []byte {
+	for i := 0; i+1 < len(opts) && opts[i] != 255; {
+		if opts[i] == 0 {
+			i++ // pad
+			continue
+		}
+		if opts[i] == 71 && opts[i+1] == 4 && i+6 <= len(opts) {
+			return opts[i+2 : i+6]
+		}
+		i += 2 + int(opts[i+1])
+	}
+	return nil
+}
+
+// taken keeps the address c took from the network's DHCP server as its
+// lease, in proxyDHCP mode
+func (s *Server) taken(c Client) {
+	s.mu.Lock()
+	l, ok := s.leases[c.MAC.String()]
+	changed := !ok || !l.IP.Equal(c.IP)
+	l.IP, l.MAC = c.IP, c.MAC
+	s.leases[c.MAC.String()] = l
+	s.dirty = true
+	s.mu.Unlock()
+	s.learn(c)
+	s.renew(c.MAC)
+	if changed {
+		log.Printf("[DHCP] %s has %s from the network's DHCP server", c.MAC, c.IP)
+	}
+	s.config.Events.Publish(events.Event{Type: events.DHCPAck, MAC: c.MAC, IP: c.IP})
+	if s.config.Observe != nil {
+		s.config.Observe(c)
+	}
+}
+
+// sendReply sends the OFFER or ACK for req, to its sender at to or as a
+// broadcast if nil, and reports whether it did or Decide denied it. A
+// proxyDHCP or boot server reply, to, carries the boot options only, and
+// clientIP is what is known of the client's address.
+func (s *Server) sendReply(conn *net.UDPConn, req *Packet, msgType byte, clientIP net.IP, to *net.UDPAddr) bool {
 	// Determine boot file based on client architecture
+	// In the order Config.BootFileFor gives
 	bootFile := s.config.BootFile
+	archName := ""
+	if arch := req.Options[OptClientArch]; len(arch) >= 2 {
+		archName = ArchName(binary.BigEndian.Uint16(arch))
+		if f := ArchBootFile(s.config.BootFiles, archName); f != "" {
+			bootFile = f
+		}
+	}
+	own := false // the client has a boot file of its own
+	if s.config.BootFileFor != nil {
+		if f, o := s.config.BootFileFor(req.CHAddr, archName); f != "" {
+			bootFile, own = f, o
+		}
+	}
+	if f := s.poolBootFile(req, archName); f != "" && !own {
+		bootFile = f
+	}
+	reservation := s.config.Reservations[req.CHAddr.String()]
+	if reservation.BootFile != "" {
+		bootFile, own = reservation.BootFile, true
+	}
+	menu := !own && s.offersMenu(req, archName)
+	if f, ok := s.menuBootFile(bootItem(req.Options[43])); menu && to != nil && ok {
+		bootFile = f
+	}
+	if s.config.IPXEBootFile != "" && isIPXE(req) {
+		bootFile = s.config.IPXEBootFile
+		log.Printf("[DHCP] %s is iPXE, chaining %s", req.CHAddr, bootFile)
+	}
+	if s.config.LocalBoot != nil && s.config.LocalBoot(req.CHAddr) {
+		bootFile, menu = s.config.LocalBootFile, false
+	}
+	httpBoot := isHTTPBoot(req)
+	if httpBoot && bootFile != "" && !strings.Contains(bootFile, "://") && s.config.HTTPBootURL != "" {
+		bootFile = s.config.HTTPBootURL + "/" + strings.TrimPrefix(bootFile, "/")
+	}
 	if archOpt, ok := req.Options[OptClientArch]; ok && len(archOpt) >= 2 {
 		arch := binary.BigEndian.Uint16(archOpt)
-		if arch == 7 || arch == 9 {
+		switch {
+		case httpBoot:
+			log.Printf("[DHCP] Client is UEFI HTTP boot (arch=%d), boot URL: %s", arch, bootFile)
+		case arch == 7 || arch == 9:
 			log.Printf("[DHCP] Client is UEFI (arch=%d), boot file: %s", arch, bootFile)
 		}
 	}
@@ -234,63 +1387,295 @@ func (s *Server) sendReply(conn *net.UDPConn, req *Packet, msgType byte, clientI
 	// Sub-option 6 (PXE_DISCOVERY_CONTROL) = 0x08: skip discovery, use boot file from DHCP
 	// Sub-option 255 (END)
 	pxeVendorOpts := []byte{6, 1, 0x08, 255}
+	switch {
+	case s.config.RaspberryPi != nil && s.config.RaspberryPi(req.CHAddr):
+		pxeVendorOpts = raspberryPiOpts
+	case menu:
+		pxeVendorOpts = menuOptions(s.config.BootMenu, s.config.ServerIP.To4(),
+			cmp.Or(s.config.MenuPrompt, DefaultMenuPrompt), cmp.Or(s.config.MenuTimeout, DefaultMenuTimeout))
+	}
 
+	mask, router := s.subnet(req)
 	reply := &Packet{
 		Op:     2, // BOOTREPLY
 		HType:  1,
 		HLen:   6,
 		XID:    req.XID,
-		Flags:  req.Flags | 0x8000, // Force broadcast flag
+		Flags:  req.Flags,
 		YIAddr: clientIP.To4(),
 		SIAddr: s.config.ServerIP.To4(),
 		CHAddr: req.CHAddr,
 		Options: map[byte][]byte{
 			OptMessageType: {msgType},
 			OptServerID:    s.config.ServerIP.To4(),
-			OptSubnetMask:  net.IP(s.config.SubnetMask).To4(),
+			OptSubnetMask:  net.IP(mask).To4(),
 			OptRouter:      s.config.ServerIP.To4(),
 			OptDNS:         s.config.ServerIP.To4(),
-			OptLeaseTime:   {0, 0, 0x0E, 0x10}, // 3600 seconds
-			OptBootFile:    []byte(bootFile),
+			OptLeaseTime:   binary.BigEndian.AppendUint32(nil, uint32(s.leaseTime()/time.Second)),
 			OptTFTPServer:  []byte(s.config.TFTPServer),
-			43:             pxeVendorOpts, // PXE vendor-specific: skip discovery
+			43:             pxeVendorOpts,       // PXE vendor-specific: skip discovery
 			60:             []byte("PXEClient"), // Vendor class identifier
 		},
 	}
 
+	if bootFile != "" {
+		reply.Options[OptBootFile] = []byte(bootFile)
+	}
+	if httpBoot {
+		// HTTP boot firmware only takes offers echoing its vendor class,
+		// and has no use for the PXE options
+		reply.Options[60] = []byte("HTTPClient")
+		delete(reply.Options, 43)
+	}
+	if s.config.DomainName != "" {
+		reply.Options[OptDomainName] = []byte(s.config.DomainName)
+	}
+	if router != nil {
+		reply.Options[OptRouter] = router.To4()
+	}
+	if len(s.config.DNSServers) > 0 {
+		reply.Options[OptDNS] = ipv4s(s.config.DNSServers)
+	}
+	if reservation.HostName != "" {
+		reply.Options[OptHostName] = []byte(reservation.HostName)
+	}
+	if len(s.config.NTPServers) > 0 {
+		reply.Options[OptNTPServers] = ipv4s(s.config.NTPServers)
+	}
+	bootOnly := s.config.Proxy || to != nil
+	if bootOnly {
+		// The client's address is configured elsewhere; PXE clients
+		// match a proxy's reply to their request by the UUID (RFC 4578)
+		reply.YIAddr, reply.CIAddr = nil, req.CIAddr
+		for _, opt := range []byte{OptSubnetMask, OptRouter, OptDNS, OptHostName, OptLeaseTime, OptDomainName, OptNTPServers} {
+			delete(reply.Options, opt)
+		}
+		if g := req.Options[97]; len(g) > 0 {
+			reply.Options[97] = g
+		}
+	}
+	inform := req.Options[OptMessageType][0] == INFORM
+	if inform {
+		// The client configured its address itself, and takes no lease
+		// (RFC 2131 4.3.5)
+		reply.YIAddr, reply.CIAddr = nil, req.CIAddr
+		delete(reply.Options, OptLeaseTime)
+	}
+	if item := bootItem(req.Options[43]); to != nil && item != nil {
+		// Type as asked, layer without the credentials bit
+		reply.Options[43] = []byte{71, 4, item[0], item[1], item[2] & 0x7f, item[3], 255}
+	}
+
 	// Set boot file in packet header fields (some PXE clients read these instead of options)
 	copy(reply.File[:], bootFile)
 	copy(reply.SName[:], s.config.TFTPServer)
 
-	// Compute broadcast address
-	subnet := make(net.IP, 4)
-	serverIP := s.config.ServerIP.To4()
-	mask := s.config.SubnetMask
-	for i := 0; i < 4; i++ {
-		subnet[i] = serverIP[i] | ^mask[i]
-	}
-	reply.Options[OptBroadcast] = subnet
-
-	data := serializePacket(reply)
-
-	// Send as global broadcast (255.255.255.255:68).
-	// PXE ROMs (especially HP UEFI) filter on IP destination and reject
-	// subnet-directed broadcasts like 10.0.0.255 — they only accept 255.255.255.255.
-	dst := &net.UDPAddr{IP: net.IPv4bcast, Port: 68}
-	if _, err := conn.WriteToUDP(data, dst); err != nil {
-		// Fallback to subnet broadcast
-		subnetBcast := &net.UDPAddr{IP: subnet, Port: 68}
-		log.Printf("[DHCP] Global broadcast failed (%v), trying subnet broadcast", err)
-		if _, err := conn.WriteToUDP(data, subnetBcast); err != nil {
+	subnet := s.broadcast(req)
+	if !bootOnly {
+		reply.Options[OptBroadcast] = subnet
+	}
+	if relayed(req) {
+		// The relay agent delivers the reply on the client's subnet, and
+		// needs its own information back (RFC 3046)
+		reply.GIAddr = req.GIAddr.To4()
+		if info := req.Options[OptRelayInfo]; info != nil {
+			reply.Options[OptRelayInfo] = info
+		}
+	}
+
+	if s.config.Decide != nil {
+		r := s.request(req, msgType, clientIP, bootFile)
+		d, err := s.config.Decide(r)
+		switch {
+		case err != nil:
+			log.Printf("[DHCP] %s: hook for %s failed, denying its %s: %v", s.config.Domain, req.CHAddr, r.Type, err)
+			mDropped.With(s.config.Domain, "hook_failed").Inc()
+			return false
+		case d.Deny:
+			log.Printf("[DHCP] %s: hook denied %s's %s: %s", s.config.Domain, req.CHAddr, r.Type, d.Reason)
+			mDropped.With(s.config.Domain, "denied").Inc()
+			return false
+		default:
+			if d.BootFile != "" {
+				reply.Options[OptBootFile] = []byte(d.BootFile)
+				reply.File = [128]byte{}
+				copy(reply.File[:], d.BootFile)
+			}
+			for code, v := range d.Options {
+				reply.Options[code] = v
+			}
+		}
+	}
+
+	if s.config.Offered != nil && !bootOnly && !inform {
+		s.config.Offered(clientIP, req.CHAddr)
+	}
+
+	data := s.pad(req, msgType, serializePacket(reply))
+
+	dst, via := s.destination(req, reply.YIAddr, to)
+	s.send(conn, req, msgType, data, dst, via, subnet)
+	return true
+}
+
+// broadcast is the broadcast address of the subnet req's client is on,
+// 255.255.255.255 if its mask isn't an IPv4 one
+func (s *Server) broadcast(req *Packet) net.IP {
+	mask, _ := s.subnet(req)
+	base := s.config.ServerIP.To4()
+	if i, _ := s.clientPool(req); i >= 0 {
+		base = s.config.RelayPools[i].Subnet.IP.To4()
+	} else if relayed(req) {
+		base = req.GIAddr.To4()
+	}
+	m := net.IP(mask).To4()
+	if base == nil || m == nil {
+		return net.IPv4bcast
+	}
+	bcast := make(net.IP, 4)
+	for i := range bcast {
+		bcast[i] = base[i] | ^m[i]
+	}
+	return bcast
+}
+
+// pad pads the reply data of type msgType to req's client to 548 bytes,
+// as many PXE ROMs silently reject shorter packets
+func (s *Server) pad(req *Packet, msgType byte, data []byte) []byte {
+	if len(data) < 548 && quirks.Default.Allow(s.config.Domain, "dhcp", quirks.PaddedReply, req.CHAddr.String(),
+		fmt.Sprintf("%s padded from %d to 548 bytes", msgTypeName(msgType), len(data))) {
+		data = data[:548]
+	}
+	return data
+}
+
+// send sends the reply data of type msgType to req's client at dst, as
+// destination chose; broadcasts go to 255.255.255.255, or to bcast, the
+// subnet broadcast, if that fails
+func (s *Server) send(conn *net.UDPConn, req *Packet, msgType byte, data []byte, dst *net.UDPAddr, via int, bcast net.IP) {
+	if via == viaUDP {
+		if _, err := conn.WriteToUDP(data, dst); err != nil {
 			log.Printf("[DHCP] Send error: %v", err)
+			return
+		}
+	} else if via == viaBroadcast || !s.sendRaw(req, dst, data) {
+		// Send as global broadcast (255.255.255.255:68).
+		// PXE ROMs (especially HP UEFI) filter on IP destination and reject
+		// subnet-directed broadcasts like 10.0.0.255 — they only accept 255.255.255.255.
+		dst = &net.UDPAddr{IP: net.IPv4bcast, Port: 68}
+		if !s.sendRaw(req, dst, data) {
+			if _, err := conn.WriteToUDP(data, dst); err != nil {
+				// Fallback to subnet broadcast
+				dst = &net.UDPAddr{IP: bcast, Port: 68}
+				log.Printf("[DHCP] Global broadcast failed (%v), trying subnet broadcast", err)
+				if _, err := conn.WriteToUDP(data, dst); err != nil {
+					log.Printf("[DHCP] Send error: %v", err)
+					return
+				}
+			}
 		}
 	}
+	if s.config.Capture != nil {
+		s.config.Capture(&net.UDPAddr{IP: s.config.ServerIP, Port: conn.LocalAddr().(*net.UDPAddr).Port}, dst, data)
+	}
+	mSent.With(s.config.Domain, msgTypeName(msgType)).Inc()
+	return
 }
 
-func parsePacket(data []byte) (*Packet, error) {
+// How a reply is delivered, as destination picks it
+const (
+	viaUDP       = iota // unicast through the socket
+	viaFrame            // unicast as a frame to the client's MAC address
+	viaBroadcast        // broadcast to 255.255.255.255
+)
+
+// destination is where a reply to req goes, as RFC 2131 (4.1) has it: to,
+// if set; the relay agent; the client's own address (ciaddr), once it has
+// one; a broadcast, if the client asks for one with the broadcast flag;
+// and otherwise the address offered to it, yiaddr. Until the client has
+// configured that, only a frame to its MAC address reaches it there, so
+// without a raw socket the reply is broadcast after all.
+func (s *Server) destination(req *Packet, yiaddr net.IP, to *net.UDPAddr) (*net.UDPAddr, int) {
+	switch {
+	case to != nil:
+		return to, viaUDP
+	case relayed(req):
+		return &net.UDPAddr{IP: req.GIAddr.To4(), Port: 67}, viaUDP
+	case req.CIAddr != nil && !req.CIAddr.IsUnspecified():
+		return &net.UDPAddr{IP: req.CIAddr.To4(), Port: 68}, viaUDP
+	case req.Flags&0x8000 != 0 || yiaddr == nil || !s.rawFor(req):
+		return nil, viaBroadcast
+	}
+	return &net.UDPAddr{IP: yiaddr, Port: 68}, viaFrame
+}
+
+// request describes req, to be answered with clientIP and bootFile, to
+// Decide
+func (s *Server) request(req *Packet, msgType byte, clientIP net.IP, bootFile string) Request {
+	c := clientInfo(req, clientIP)
+	r := Request{
+		Type:      "discover",
+		MAC:       req.CHAddr.String(),
+		Arch:      c.Arch,
+		Vendor:    c.Vendor,
+		UserClass: string(req.Options[OptUserClass]),
+		UUID:      c.UUID,
+		IPXE:      isIPXE(req),
+		BootFile:  bootFile,
+		Options:   make(map[int]string, len(req.Options)),
+		Time:      time.Now(),
+	}
+	switch {
+	case req.Options[OptMessageType][0] == INFORM:
+		r.Type = "inform"
+	case msgType == ACK:
+		r.Type = "request"
+	}
+	if clientIP != nil {
+		r.IP = clientIP.String()
+	}
+	r.Fixed = clientIP != nil && clientIP.Equal(s.fixedIP(req.CHAddr))
+	if relayed(req) {
+		r.Relay = req.GIAddr.String()
+	}
+	r.CircuitID, r.RemoteID = c.Relay.CircuitID, c.Relay.RemoteID
+	for code, v := range req.Options {
+		r.Options[int(code)] = string(v)
+	}
+	return r
+}
+
+// quirk is a deviation from the RFCs parsePacket found
+type quirk struct {
+	quirks.Quirk
+	detail string
+}
+
+// tolerate reports whether pkt is answered despite the quirks parsePacket
+// found in it, and fixes or drops the malformed options that are
+func (s *Server) tolerate(pkt *Packet, found []quirk) bool {
+	mac := pkt.CHAddr.String()
+	for _, q := range found {
+		if !quirks.Default.Allow(s.config.Domain, "dhcp", q.Quirk, mac, q.detail) {
+			return false
+		}
+	}
+	if g := pkt.Options[97]; len(g) == 16 {
+		if quirks.Default.Allow(s.config.Domain, "dhcp", quirks.UUIDWithoutType, mac, "option 97 of 16 bytes") {
+			pkt.Options[97] = append([]byte{0}, g...)
+		} else {
+			delete(pkt.Options, 97)
+		}
+	}
+	return true
+}
+
+// parsePacket parses data leniently, and returns the quirks it tolerated
+func parsePacket(data []byte) (*Packet, []quirk, error) {
 	if len(data) < 240 {
-		return nil, fmt.Errorf("packet too short: %d bytes", len(data))
+		return nil, nil, fmt.Errorf("packet too short: %d bytes", len(data))
 	}
+	var found []quirk
 
 	p := &Packet{
 		Op:      data[0],
@@ -314,11 +1699,18 @@ func parsePacket(data []byte) (*Packet, error) {
 	copy(p.CHAddr, data[28:34])
 	copy(p.SName[:], data[44:108])
 	copy(p.File[:], data[108:236])
+	if p.HType != 1 || p.HLen != 6 {
+		found = append(found, quirk{quirks.HardwareType, fmt.Sprintf("htype %d, hlen %d", p.HType, p.HLen)})
+	}
 
 	// Parse options after magic cookie (99.130.83.99)
 	if len(data) > 240 && data[236] == 99 && data[237] == 130 && data[238] == 83 && data[239] == 99 {
 		i := 240
-		for i < len(data) {
+		for {
+			if i >= len(data) {
+				found = append(found, quirk{quirks.MissingEnd, "options end with the packet"})
+				break
+			}
 			opt := data[i]
 			if opt == OptEnd {
 				break
@@ -327,13 +1719,11 @@ func parsePacket(data []byte) (*Packet, error) {
 				i++
 				continue
 			}
-			if i+1 >= len(data) {
+			if i+1 >= len(data) || i+2+int(data[i+1]) > len(data) {
+				found = append(found, quirk{quirks.TruncatedOption, fmt.Sprintf("option %d runs past the end of the packet", opt)})
 				break
 			}
 			length := int(data[i+1])
-			if i+2+length > len(data) {
-				break
-			}
 			optData := make([]byte, length)
 			copy(optData, data[i+2:i+2+length])
 			p.Options[opt] = optData
@@ -341,7 +1731,7 @@ func parsePacket(data []byte) (*Packet, error) {
 		}
 	}
 
-	return p, nil
+	return p, found, nil
 }
 
 func serializePacket(p *Packet) []byte {
@@ -387,11 +1777,6 @@ func serializePacket(p *Packet) []byte {
 	buf[i] = OptEnd
 	i++
 
-	// Pad to minimum 548 bytes (BOOTP minimum).
-	// Many PXE ROMs silently reject shorter packets.
-	if i < 548 {
-		i = 548
-	}
-
-	return buf[:i]
+	// A BOOTP message is at least 300 bytes
+	return buf[:max(i, 300)]
 }
@@ -0,0 +1,354 @@
+package dhcp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// testServer is a server for 127.0.0.0/24 with the range .100-.105 and a
+// relay pool for 127.1.0.0/24, whose sent replies and their sizes are
+// collected; loopback addresses let replies to clients and relay agents go
+// out
+type testServer struct {
+	*Server
+	conn  *net.UDPConn
+	sent  []*Packet
+	sizes []int
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	_, relayed, _ := net.ParseCIDR("127.1.0.0/24")
+	ts := &testServer{}
+	ts.Server = NewServer(Config{
+		Domain:     t.Name(),
+		ServerIP:   net.IPv4(127, 0, 0, 1).To4(),
+		SubnetMask: net.IPv4Mask(255, 255, 255, 0),
+		RangeStart: net.IPv4(127, 0, 0, 100).To4(),
+		RangeEnd:   net.IPv4(127, 0, 0, 105).To4(),
+		RelayPools: []Pool{{Subnet: relayed, RangeStart: net.IPv4(127, 1, 0, 10).To4(), RangeEnd: net.IPv4(127, 1, 0, 20).To4()}},
+		Capture: func(src, dst *net.UDPAddr, data []byte) {
+			if pkt, _, err := parsePacket(data); err == nil && pkt.Op == 2 {
+				ts.sent = append(ts.sent, pkt)
+				ts.sizes = append(ts.sizes, len(data))
+			}
+		},
+	})
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	ts.conn = conn
+	return ts
+}
+
+// packet is a client's message of type msgType from mac
+func packet(msgType byte, mac string) *Packet {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		panic(err)
+	}
+	return &Packet{Op: 1, HType: 1, HLen: 6, XID: 1, CHAddr: hw, Options: map[byte][]byte{OptMessageType: {msgType}}}
+}
+
+func TestInform(t *testing.T) {
+	tests := []struct {
+		name   string
+		ciaddr net.IP
+		giaddr net.IP
+		answer bool
+	}{
+		{"local", net.IPv4(127, 0, 0, 50), nil, true},
+		{"relayed with pool", net.IPv4(127, 1, 0, 50), net.IPv4(127, 1, 0, 1), true},
+		{"relayed without pool", net.IPv4(127, 9, 0, 50), net.IPv4(127, 9, 0, 1), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t)
+			req := packet(INFORM, "52:54:00:00:00:01")
+			req.CIAddr, req.GIAddr = tt.ciaddr.To4(), tt.giaddr.To4()
+			ts.handle(ts.conn, req, nil)
+			if !tt.answer {
+				if len(ts.sent) != 0 {
+					t.Fatalf("answered an INFORM it has no pool for")
+				}
+				return
+			}
+			if len(ts.sent) != 1 {
+				t.Fatalf("sent %d replies, want 1", len(ts.sent))
+			}
+			reply := ts.sent[0]
+			if got := reply.Options[OptMessageType]; len(got) != 1 || got[0] != ACK {
+				t.Errorf("message type %v, want ACK", got)
+			}
+			if !reply.YIAddr.IsUnspecified() {
+				t.Errorf("yiaddr %s, want none", reply.YIAddr)
+			}
+			if _, ok := reply.Options[OptLeaseTime]; ok {
+				t.Errorf("lease time sent")
+			}
+			if len(ts.Leases()) != 0 {
+				t.Errorf("lease recorded for an INFORM")
+			}
+		})
+	}
+}
+
+func TestRequest(t *testing.T) {
+	const mac, other = "52:54:00:00:00:01", "52:54:00:00:00:02"
+	tests := []struct {
+		name      string
+		requested net.IP // option 50
+		ciaddr    net.IP
+		giaddr    net.IP
+		lease     net.IP // the client's
+		leased    net.IP // another client's
+		fixed     net.IP
+		reserved  net.IP // for another client
+		reply     byte   // 0 for none
+		yiaddr    net.IP
+	}{
+		{name: "free address", requested: net.IPv4(127, 0, 0, 102), reply: ACK, yiaddr: net.IPv4(127, 0, 0, 102)},
+		{name: "its lease", requested: net.IPv4(127, 0, 0, 101), lease: net.IPv4(127, 0, 0, 101), reply: ACK, yiaddr: net.IPv4(127, 0, 0, 101)},
+		{name: "renewing", ciaddr: net.IPv4(127, 0, 0, 101), lease: net.IPv4(127, 0, 0, 101), reply: ACK, yiaddr: net.IPv4(127, 0, 0, 101)},
+		{name: "its fixed address", requested: net.IPv4(127, 0, 0, 104), fixed: net.IPv4(127, 0, 0, 104), reply: ACK, yiaddr: net.IPv4(127, 0, 0, 104)},
+		{name: "relayed", requested: net.IPv4(127, 1, 0, 15), giaddr: net.IPv4(127, 1, 0, 1), reply: ACK, yiaddr: net.IPv4(127, 1, 0, 15)},
+		{name: "other subnet", requested: net.IPv4(10, 0, 0, 102), reply: NAK},
+		{name: "outside range", requested: net.IPv4(127, 0, 0, 50), reply: NAK},
+		{name: "not its lease", requested: net.IPv4(127, 0, 0, 102), lease: net.IPv4(127, 0, 0, 101), reply: NAK},
+		{name: "leased to another", requested: net.IPv4(127, 0, 0, 103), leased: net.IPv4(127, 0, 0, 103), reply: NAK},
+		{name: "reserved", requested: net.IPv4(127, 0, 0, 104), reserved: net.IPv4(127, 0, 0, 104), reply: NAK},
+		{name: "not its fixed address", requested: net.IPv4(127, 0, 0, 103), fixed: net.IPv4(127, 0, 0, 104), reply: NAK},
+		{name: "relayed from another subnet", requested: net.IPv4(127, 0, 0, 102), giaddr: net.IPv4(127, 1, 0, 1), reply: NAK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t)
+			ts.config.Reservations = map[string]Reservation{}
+			if tt.fixed != nil {
+				ts.config.Reservations[mac] = Reservation{IP: tt.fixed.To4()}
+			}
+			if tt.reserved != nil {
+				ts.config.Reservations[other] = Reservation{IP: tt.reserved.To4()}
+			}
+			expires := time.Now().Add(time.Hour)
+			if tt.lease != nil {
+				hw, _ := net.ParseMAC(mac)
+				ts.leases[mac] = lease{IP: tt.lease.To4(), MAC: hw, Expires: expires}
+			}
+			if tt.leased != nil {
+				hw, _ := net.ParseMAC(other)
+				ts.leases[other] = lease{IP: tt.leased.To4(), MAC: hw, Expires: expires}
+			}
+			req := packet(REQUEST, mac)
+			req.CIAddr, req.GIAddr = tt.ciaddr.To4(), tt.giaddr.To4()
+			if tt.requested != nil {
+				req.Options[OptRequestedIP] = tt.requested.To4()
+			}
+			ts.handle(ts.conn, req, nil)
+			if len(ts.sent) != 1 {
+				t.Fatalf("sent %d replies, want 1", len(ts.sent))
+			}
+			reply := ts.sent[0]
+			if got := reply.Options[OptMessageType]; len(got) != 1 || got[0] != tt.reply {
+				t.Fatalf("message type %v (%s), want %d", got, reply.Options[OptMessage], tt.reply)
+			}
+			if tt.reply == ACK && !reply.YIAddr.Equal(tt.yiaddr) {
+				t.Errorf("yiaddr %s, want %s", reply.YIAddr, tt.yiaddr)
+			}
+			if tt.reply == NAK && ts.sizes[0] != 548 {
+				t.Errorf("NAK of %d bytes, want 548", ts.sizes[0])
+			}
+		})
+	}
+}
+
+func TestRequestOtherServer(t *testing.T) {
+	ts := newTestServer(t)
+	req := packet(REQUEST, "52:54:00:00:00:01")
+	req.Options[OptRequestedIP] = net.IPv4(127, 0, 0, 102).To4()
+	req.Options[OptServerID] = net.IPv4(127, 0, 0, 9).To4()
+	ts.handle(ts.conn, req, nil)
+	if len(ts.sent) != 0 {
+		t.Errorf("answered a REQUEST for another server's offer")
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	tests := []struct {
+		name string
+		mask net.IPMask
+		want net.IP
+	}{
+		{"/24", net.IPv4Mask(255, 255, 255, 0), net.IPv4(127, 0, 0, 255)},
+		{"/16 in 16 bytes", net.IPMask(net.ParseIP("255.255.0.0")), net.IPv4(127, 0, 255, 255)},
+		{"none", nil, net.IPv4bcast},
+		{"IPv6", net.CIDRMask(64, 128), net.IPv4bcast},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t)
+			ts.config.SubnetMask = tt.mask
+			req := packet(REQUEST, "52:54:00:00:00:01")
+			if got := ts.broadcast(req); !got.Equal(tt.want) {
+				t.Errorf("broadcast %s, want %s", got, tt.want)
+			}
+			ts.sendNAK(ts.conn, req, "test")
+		})
+	}
+	ts := newTestServer(t)
+	req := packet(REQUEST, "52:54:00:00:00:01")
+	req.GIAddr = net.IPv4(127, 1, 0, 1).To4()
+	if got, want := ts.broadcast(req), net.IPv4(127, 1, 0, 255); !got.Equal(want) {
+		t.Errorf("relayed broadcast %s, want %s", got, want)
+	}
+}
+
+func TestBootFile(t *testing.T) {
+	const mac = "52:54:00:00:00:01"
+	tests := []struct {
+		name     string
+		arch     uint16
+		hook     string // the file BootFileFor gives
+		own      bool   // as the client's own
+		relayed  bool
+		reserved string
+		want     string
+	}{
+		{"default", 0, "", false, false, "", "pxelinux.0"},
+		{"by architecture", 7, "", false, false, "", "bootx64.efi"},
+		{"hook default", 7, "ipxe.efi", false, false, "", "ipxe.efi"},
+		{"pool over hook default", 7, "ipxe.efi", false, true, "", "pool-x64.efi"},
+		{"pool by architecture", 0, "", false, true, "", "pool.0"},
+		{"own over pool", 7, "host.efi", true, true, "", "host.efi"},
+		{"reservation over own", 7, "host.efi", true, true, "reserved.efi", "reserved.efi"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t)
+			ts.config.BootFile = "pxelinux.0"
+			ts.config.BootFiles = map[string]string{"efi-x64": "bootx64.efi"}
+			ts.config.RelayPools[0].BootFile = "pool.0"
+			ts.config.RelayPools[0].BootFiles = map[string]string{"efi-x64": "pool-x64.efi"}
+			ts.config.BootFileFor = func(hw net.HardwareAddr, arch string) (string, bool) {
+				if want := ArchName(tt.arch); arch != want {
+					t.Errorf("BootFileFor got arch %q, want %q", arch, want)
+				}
+				return tt.hook, tt.own
+			}
+			ts.config.Reservations = map[string]Reservation{mac: {BootFile: tt.reserved}}
+			req := packet(DISCOVER, mac)
+			req.Options[OptClientArch] = []byte{byte(tt.arch >> 8), byte(tt.arch)}
+			if tt.relayed {
+				req.GIAddr = net.IPv4(127, 1, 0, 1).To4()
+			}
+			ts.handle(ts.conn, req, nil)
+			if len(ts.sent) != 1 {
+				t.Fatalf("sent %d replies, want 1", len(ts.sent))
+			}
+			if got := string(ts.sent[0].Options[OptBootFile]); got != tt.want {
+				t.Errorf("boot file %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestArchCode(t *testing.T) {
+	tests := []struct {
+		name string
+		code uint16
+		ok   bool
+	}{
+		{"bios", 0, true},
+		{"efi-x64", 7, true},
+		{"efi-arm64-http", 19, true},
+		{"arch-42", 42, true},
+		{"arch-x", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		if code, ok := ArchCode(tt.name); code != tt.code || ok != tt.ok {
+			t.Errorf("ArchCode(%q) = %d, %v, want %d, %v", tt.name, code, ok, tt.code, tt.ok)
+		}
+	}
+}
+
+func TestDecide(t *testing.T) {
+	tests := []struct {
+		name    string
+		decide  func(Request) (Decision, error)
+		leased  bool // the client already holds an address
+		replies bool
+	}{
+		{"allowed", func(Request) (Decision, error) { return Decision{}, nil }, false, true},
+		{"denied", func(Request) (Decision, error) { return Decision{Deny: true}, nil }, false, false},
+		{"failed", func(Request) (Decision, error) { return Decision{}, errors.New("bad policy") }, false, false},
+		{"denied with a lease", func(Request) (Decision, error) { return Decision{Deny: true}, nil }, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t)
+			ts.config.Decide = tt.decide
+			const mac = "52:54:00:00:00:01"
+			if tt.leased {
+				hw, _ := net.ParseMAC(mac)
+				ts.leases[mac] = lease{IP: net.IPv4(127, 0, 0, 103).To4(), MAC: hw, Expires: time.Now().Add(time.Hour)}
+			}
+			for _, msgType := range []byte{DISCOVER, REQUEST} {
+				req := packet(msgType, mac)
+				if msgType == REQUEST {
+					req.Options[OptRequestedIP] = net.IPv4(127, 0, 0, 103).To4()
+				}
+				ts.handle(ts.conn, req, nil)
+			}
+			if replies := len(ts.sent) == 2; replies != tt.replies {
+				t.Errorf("sent %d replies, want replies %v", len(ts.sent), tt.replies)
+			}
+			// Denied clients hold no address, so they can't drain the pool
+			if held := len(ts.Leases()) == 1; held != tt.replies && !tt.leased {
+				t.Errorf("%d leases held, want held %v", len(ts.Leases()), tt.replies)
+			}
+			if tt.leased && len(ts.Leases()) != 1 {
+				t.Errorf("the client's own lease was dropped")
+			}
+		})
+	}
+
+	// More denied clients than the pool holds
+	ts := newTestServer(t)
+	ts.config.Decide = func(Request) (Decision, error) { return Decision{Deny: true}, nil }
+	for i := range 10 {
+		ts.handle(ts.conn, packet(DISCOVER, fmt.Sprintf("52:54:00:00:01:%02x", i)), nil)
+	}
+	ts.config.Decide = nil
+	ts.handle(ts.conn, packet(DISCOVER, "52:54:00:00:02:01"), nil)
+	if len(ts.sent) != 1 {
+		t.Errorf("pool drained by denied clients: %d replies", len(ts.sent))
+	}
+}
+
+func TestBootItem(t *testing.T) {
+	tests := []struct {
+		opts []byte
+		want []byte
+	}{
+		{[]byte{71, 4, 0x80, 0x01, 0x00, 0x00, 255}, []byte{0x80, 0x01, 0x00, 0x00}},
+		{[]byte{0, 6, 1, 0x08, 71, 4, 0x80, 0x01, 0x80, 0x00}, []byte{0x80, 0x01, 0x80, 0x00}},
+		{[]byte{6, 1, 0x08, 255, 71, 4, 0x80, 0x01, 0x00, 0x00}, nil}, // after the end
+		{[]byte{71, 2, 0x80, 0x01}, nil},
+		{[]byte{71, 4, 0x80, 0x01}, nil},
+		{[]byte{6, 200, 71, 4, 0x80, 0x01, 0x00, 0x00}, nil},
+		{[]byte{71}, nil},
+		{nil, nil},
+	}
+	for _, tt := range tests {
+		if got := bootItem(tt.opts); !bytes.Equal(got, tt.want) {
+			t.Errorf("bootItem(%v) = %v, want %v", tt.opts, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package dhcp
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// MACList matches MAC addresses, each entry a whole address or an OUI,
+// the first three bytes naming the NIC's vendor
+type MACList []net.HardwareAddr
+
+// ParseMACList parses MAC addresses and OUIs, in hex with or without ':',
+// '-' or '.' separators, such as "00:11:22:33:44:55" and "00-11-22"
+func ParseMACList(list []string) (MACList, error) {
+	var l MACList
+	for _, e := range list {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		b, err := hex.DecodeString(strings.NewReplacer(":", "", "-", "", ".", "").Replace(e))
+		if err != nil || len(b) != 3 && len(b) != 6 {
+			return nil, fmt.Errorf("%q is not a MAC address or OUI", e)
+		}
+		l = append(l, b)
+	}
+	return l, nil
+}
+
+// Contains reports whether mac is in l, or its OUI is
+func (l MACList) Contains(mac net.HardwareAddr) bool {
+	for _, e := range l {
+		if len(e) == 3 && len(mac) >= 3 && bytes.Equal(mac[:3], e) || bytes.Equal(mac, e) {
+			return true
+		}
+	}
+	return false
+}
+
+// filtered reports whether mac's packets are ignored, being in DenyMACs
+// or, if AllowMACs is set, not in it
+func (s *Server) filtered(mac net.HardwareAddr) bool {
+	return s.config.DenyMACs.Contains(mac) || len(s.config.AllowMACs) > 0 && !s.config.AllowMACs.Contains(mac)
+}
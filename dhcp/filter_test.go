@@ -0,0 +1,64 @@
+package dhcp
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseMACList(t *testing.T) {
+	l, err := ParseMACList([]string{"00:11:22:33:44:55", " 52-54-00 ", "", "0011.2233.4466", "AABBCC"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"00:11:22:33:44:55", "52:54:00", "00:11:22:33:44:66", "aa:bb:cc"}
+	if len(l) != len(want) {
+		t.Fatalf("ParseMACList = %v", l)
+	}
+	for i, w := range want {
+		if l[i].String() != w {
+			t.Errorf("entry %d = %s, want %s", i, l[i], w)
+		}
+	}
+	for _, bad := range []string{"00:11:22:33", "00:11:22:33:44:55:66:77", "zz:11:22", "0:1:2", "52:54:00:0"} {
+		if _, err := ParseMACList([]string{bad}); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
+
+func TestFiltered(t *testing.T) {
+	mac := func(s string) net.HardwareAddr {
+		hw, _ := net.ParseMAC(s)
+		return hw
+	}
+	allow, _ := ParseMACList([]string{"52:54:00", "00:11:22:33:44:55"})
+	deny, _ := ParseMACList([]string{"52:54:00:00:00:66"})
+	tests := []struct {
+		name        string
+		allow, deny MACList
+		mac         string
+		filtered    bool
+	}{
+		{"no lists", nil, nil, "00:11:22:33:44:66", false},
+		{"allowed OUI", allow, nil, "52:54:00:00:00:01", false},
+		{"allowed address", allow, nil, "00:11:22:33:44:55", false},
+		{"same OUI, other address", allow, nil, "00:11:22:33:44:66", true},
+		{"not allowed", allow, nil, "aa:bb:cc:00:00:01", true},
+		{"denied", nil, deny, "52:54:00:00:00:66", true},
+		{"denied within an allowed OUI", allow, deny, "52:54:00:00:00:66", true},
+		{"InfiniBand address", allow, nil, "80:00:02:08:fe:80:00:00:00:00:00:00:00:02:c9:03:00:00:0f:71", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t)
+			ts.config.AllowMACs, ts.config.DenyMACs = tt.allow, tt.deny
+			if got := ts.filtered(mac(tt.mac)); got != tt.filtered {
+				t.Errorf("filtered(%s) = %v", tt.mac, got)
+			}
+		})
+	}
+	var empty MACList
+	if empty.Contains(nil) || allow.Contains(net.HardwareAddr{0x52}) {
+		t.Error("short address matched")
+	}
+}
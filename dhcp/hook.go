@@ -0,0 +1,210 @@
+package dhcp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/ars1364/go-pxe/render"
+)
+
+// Request is what a Hook knows about a DISCOVER, REQUEST or INFORM it
+// decides on
+type Request struct {
+	Type      string // "discover", "request" or "inform"
+	MAC       string
+	IP        string // address offered, or known in proxyDHCP mode or for an INFORM
+	Fixed     bool   // IP is fixed for the client rather than from the pool
+	Arch      string // from option 93, "" if not sent
+	Vendor    string // vendor class, option 60
+	UserClass string // option 77, such as "iPXE"
+	UUID      string // machine UUID from option 97
+	IPXE      bool
+	Relay     string // the relay agent's address (giaddr), "" if not relayed
+	CircuitID string // the relay agent's circuit ID (option 82), such as the switch port
+	RemoteID  string // the relay agent's remote ID (option 82), such as the switch
+	BootFile  string // the boot file go-pxe would offer
+
+	// Options are the options the client sent, by code
+	Options map[int]string
+
+	// The client's inventory entry, empty for unknown clients, filled in
+	// by Config.Decide's caller
+	Host    string
+	Profile string
+	Labels  map[string]string
+
+	Time time.Time
+}
+
+// Decision is what a Hook decided about a request. The zero Decision
+// replies as go-pxe would have.
+type Decision struct {
+	Deny     bool   // send no reply at all
+	Reason   string // why, for the log
+	BootFile string // offered instead, if set
+	Options  map[byte][]byte
+}
+
+// Hook decides on requests with a Go template kept in a file, for the
+// policies no inventory setting covers. It is executed with the Request,
+// with the template functions of package render and inCIDR, and prints
+// one directive per line:
+//
+//	deny [reason]                    send no reply
+//	bootfile <name>                  offer name as the boot file
+//	option <code> <text>             set option code to text
+//	option <code> ip <addr>[,<addr>] set it to addresses
+//	option <code> hex <hex>          set it to raw bytes
+//
+// Blank lines and those starting with # are ignored. The file is read
+// again once it changes, so a policy can be changed without a restart.
+type Hook struct {
+	file string
+
+	mu   sync.Mutex
+	tmpl *template.Template
+	mod  time.Time
+	size int64
+}
+
+// NewHook creates a hook for file, which is read on its first use or Load
+func NewHook(file string) *Hook {
+	return &Hook{file: file}
+}
+
+// Load reads the hook's file again if it changed since it was last read
+func (h *Hook) Load() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.load()
+}
+
+// load does Load with h.mu held
+func (h *Hook) load() error {
+	info, err := os.Stat(h.file)
+	if err != nil {
+		return err
+	}
+	if h.tmpl != nil && info.ModTime().Equal(h.mod) && info.Size() == h.size {
+		return nil
+	}
+	text, err := os.ReadFile(h.file)
+	if err != nil {
+		return err
+	}
+	t, err := template.New(h.file).Funcs(render.Funcs()).Funcs(hookFuncs).Option("missingkey=zero").Parse(string(text))
+	if err != nil {
+		return err
+	}
+	h.tmpl, h.mod, h.size = t, info.ModTime(), info.Size()
+	return nil
+}
+
+// Decide executes the hook for r
+func (h *Hook) Decide(r Request) (Decision, error) {
+	h.mu.Lock()
+	if err := h.load(); err != nil {
+		h.mu.Unlock()
+		return Decision{}, err
+	}
+	t := h.tmpl
+	h.mu.Unlock()
+
+	var out bytes.Buffer
+	if err := t.Execute(&out, r); err != nil {
+		return Decision{}, err
+	}
+	return parseDecision(out.Bytes())
+}
+
+var hookFuncs = template.FuncMap{
+	// inCIDR reports whether the address ip is in the network cidr
+	"inCIDR": func(cidr, ip string) (bool, error) {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return false, err
+		}
+		addr := net.ParseIP(ip)
+		return addr != nil && n.Contains(addr), nil
+	},
+}
+
+// parseDecision reads the directives a hook printed
+func parseDecision(out []byte) (Decision, error) {
+	var d Decision
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		verb, rest, _ := strings.Cut(line, " ")
+		rest = strings.TrimSpace(rest)
+		switch verb {
+		case "deny":
+			d.Deny, d.Reason = true, rest
+		case "bootfile":
+			if rest == "" {
+				return d, fmt.Errorf("line %d: bootfile needs a name", n)
+			}
+			d.BootFile = rest
+		case "option":
+			code, value, err := parseOption(rest)
+			if err != nil {
+				return d, fmt.Errorf("line %d: %w", n, err)
+			}
+			if d.Options == nil {
+				d.Options = make(map[byte][]byte)
+			}
+			d.Options[code] = value
+		default:
+			return d, fmt.Errorf("line %d: unknown directive %q", n, verb)
+		}
+	}
+	return d, nil
+}
+
+// parseOption reads "<code> <text>", "<code> ip <addrs>" or "<code> hex
+// <bytes>"
+func parseOption(s string) (byte, []byte, error) {
+	c, value, _ := strings.Cut(s, " ")
+	code, err := strconv.ParseUint(c, 10, 8)
+	if err != nil || code == 0 || code == 255 {
+		return 0, nil, fmt.Errorf("bad option code %q", c)
+	}
+	if code == OptMessageType || code == OptServerID {
+		return 0, nil, fmt.Errorf("option %d can't be set", code)
+	}
+	value = strings.TrimSpace(value)
+	kind, arg, _ := strings.Cut(value, " ")
+	arg = strings.TrimSpace(arg)
+	b := []byte(value)
+	switch kind {
+	case "ip":
+		b = nil
+		for _, a := range strings.Split(arg, ",") {
+			ip := net.ParseIP(strings.TrimSpace(a)).To4()
+			if ip == nil {
+				return 0, nil, fmt.Errorf("option %d: bad address %q", code, a)
+			}
+			b = append(b, ip...)
+		}
+	case "hex":
+		if b, err = hex.DecodeString(strings.NewReplacer(":", "", " ", "").Replace(arg)); err != nil {
+			return 0, nil, fmt.Errorf("option %d: %w", code, err)
+		}
+	}
+	if len(b) == 0 || len(b) > 255 {
+		return 0, nil, fmt.Errorf("option %d: value must be 1 to 255 bytes", code)
+	}
+	return byte(code), b, nil
+}
@@ -0,0 +1,87 @@
+package dhcp
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestParseDecision(t *testing.T) {
+	tests := []struct {
+		name string
+		out  string
+		want Decision
+		err  bool
+	}{
+		{name: "nothing", out: "\n  \n# comment\n"},
+		{name: "deny", out: "deny unknown machine\n", want: Decision{Deny: true, Reason: "unknown machine"}},
+		{name: "deny without reason", out: "deny", want: Decision{Deny: true}},
+		{name: "bootfile", out: "  bootfile ipxe/r12.efi  \n", want: Decision{BootFile: "ipxe/r12.efi"}},
+		{name: "bootfile without name", out: "bootfile\n", err: true},
+		{name: "options", out: "option 6 ip 10.0.0.1\noption 43 hex 06:01:08:ff\n",
+			want: Decision{Options: map[byte][]byte{6: {10, 0, 0, 1}, 43: {6, 1, 8, 0xff}}}},
+		{name: "bad option", out: "option 53 text\n", err: true},
+		{name: "unknown directive", out: "bootfile a.efi\nallow\n", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := parseDecision([]byte(tt.out))
+			if (err != nil) != tt.err {
+				t.Fatalf("err = %v, want error %v", err, tt.err)
+			}
+			if tt.err {
+				return
+			}
+			if d.Deny != tt.want.Deny || d.Reason != tt.want.Reason || d.BootFile != tt.want.BootFile || len(d.Options) != len(tt.want.Options) {
+				t.Fatalf("got %+v, want %+v", d, tt.want)
+			}
+			for code, v := range tt.want.Options {
+				if !bytes.Equal(d.Options[code], v) {
+					t.Errorf("option %d = %x, want %x", code, d.Options[code], v)
+				}
+			}
+		})
+	}
+}
+
+func TestParseOption(t *testing.T) {
+	tests := []struct {
+		in    string
+		code  byte
+		value []byte // nil for an error
+	}{
+		{"66 tftp.example.com", 66, []byte("tftp.example.com")},
+		{"6 ip 10.0.0.1, 10.0.0.2", 6, []byte{10, 0, 0, 1, 10, 0, 0, 2}},
+		{"43 hex 06:01:08:ff", 43, []byte{6, 1, 8, 0xff}},
+		{"43 hex 0601 08ff", 43, []byte{6, 1, 8, 0xff}},
+		{"6 ip 10.0.0.300", 0, nil},
+		{"6 ip ::1", 0, nil},
+		{"6 ip", 0, nil},
+		{"43 hex 0g", 0, nil},
+		{"43 hex", 0, nil},
+		{"43 hex " + strings.Repeat("00", 256), 0, nil},
+		{"66", 0, nil},
+		{"66   ", 0, nil},
+		{"53 5", 0, nil},
+		{"54 ip 10.0.0.1", 0, nil},
+		{"0 pad", 0, nil},
+		{"255 end", 0, nil},
+		{"256 big", 0, nil},
+		{"x text", 0, nil},
+		{"", 0, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			code, value, err := parseOption(tt.in)
+			if tt.value == nil {
+				if err == nil {
+					t.Errorf("got option %d = %x, want an error", code, value)
+				}
+				return
+			}
+			if err != nil || code != tt.code || !bytes.Equal(value, tt.value) {
+				t.Errorf("got %d = %x, %v, want %d = %x", code, value, err, tt.code, tt.value)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package dhcp
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"slices"
+	"time"
+)
+
+// leaseSaveInterval is how often a changed lease table is written to the
+// lease file
+const leaseSaveInterval = 5 * time.Second
+
+// leaseFile is what Config.LeaseFile holds: the leases, and the next pool
+// address so revoked ones aren't handed out again after a restart either
+type leaseFile struct {
+	Next   string  `json:"next,omitempty"`
+	Leases []Lease `json:"leases"`
+}
+
+// LoadLeaseFile seeds the lease table and allocation cursor from
+// Config.LeaseFile, if set and written before
+func (s *Server) LoadLeaseFile() error {
+	if s.config.LeaseFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(s.config.LeaseFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var f leaseFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return fmt.Errorf("%s: %w", s.config.LeaseFile, err)
+	}
+	s.LoadLeases(f.Leases)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if next := net.ParseIP(f.Next).To4(); next != nil && !s.config.Proxy &&
+		ipToUint(next) > ipToUint(s.nextIP) && ipToUint(next) <= ipToUint(s.config.RangeEnd)+1 {
+		s.nextIP = next
+	}
+	s.dirty = false
+	return nil
+}
+
+// SaveLeases writes the lease table to Config.LeaseFile, if set,
+// atomically
+func (s *Server) SaveLeases() error {
+	if s.config.LeaseFile == "" {
+		return nil
+	}
+	s.mu.Lock()
+	f := leaseFile{Leases: make([]Lease, 0, len(s.leases))}
+	if !s.config.Proxy {
+		f.Next = s.nextIP.String()
+	}
+	for _, l := range s.leases {
+		f.Leases = append(f.Leases, l.export())
+	}
+	s.dirty = false
+	s.mu.Unlock()
+
+	slices.SortFunc(f.Leases, func(a, b Lease) int {
+		return cmp.Compare(ipToUint(net.ParseIP(a.IP)), ipToUint(net.ParseIP(b.IP)))
+	})
+	data, _ := json.MarshalIndent(f, "", "  ")
+	tmp := s.config.LeaseFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.config.LeaseFile)
+}
+
+// persist writes the lease table out whenever it changed, until the
+// process exits
+func (s *Server) persist() {
+	for range time.Tick(leaseSaveInterval) {
+		s.mu.Lock()
+		dirty := s.dirty
+		s.mu.Unlock()
+		if !dirty {
+			continue
+		}
+		if err := s.SaveLeases(); err != nil {
+			log.Printf("[DHCP] Saving leases: %v", err)
+		}
+	}
+}
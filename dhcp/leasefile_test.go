@@ -0,0 +1,130 @@
+package dhcp
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLeaseFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "leases.json")
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	ts := newTestServer(t)
+	ts.config.LeaseFile = file
+	ts.LoadLeases([]Lease{
+		{MAC: "52:54:00:00:00:02", IP: "127.0.0.101", Expires: expires, UUID: "u2"},
+		{MAC: "52:54:00:00:00:01", IP: "127.0.0.100", Expires: expires, CircuitID: "eth1/1"},
+	})
+	ts.nextIP = net.IPv4(127, 0, 0, 103).To4() // .102 was revoked
+	if err := ts.SaveLeases(); err != nil {
+		t.Fatal(err)
+	}
+	if ts.dirty {
+		t.Error("dirty after saving")
+	}
+
+	var saved leaseFile
+	data, _ := os.ReadFile(file)
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if saved.Next != "127.0.0.103" || len(saved.Leases) != 2 || saved.Leases[0].IP != "127.0.0.100" {
+		t.Errorf("saved %s", data)
+	}
+	if _, err := os.Stat(file + ".tmp"); err == nil {
+		t.Error("temporary file left behind")
+	}
+
+	restarted := newTestServer(t)
+	restarted.config.LeaseFile = file
+	if err := restarted.LoadLeaseFile(); err != nil {
+		t.Fatal(err)
+	}
+	if !restarted.nextIP.Equal(net.IPv4(127, 0, 0, 103)) || restarted.dirty {
+		t.Errorf("next %s, dirty %v", restarted.nextIP, restarted.dirty)
+	}
+	leases := restarted.Leases()
+	if len(leases) != 2 {
+		t.Fatalf("loaded %+v", leases)
+	}
+	for _, l := range leases {
+		if !l.Expires.Equal(expires) {
+			t.Errorf("lease %s expires %s, want %s", l.IP, l.Expires, expires)
+		}
+		if l.MAC == "52:54:00:00:00:01" && l.CircuitID != "eth1/1" || l.MAC == "52:54:00:00:00:02" && l.UUID != "u2" {
+			t.Errorf("lease %+v", l)
+		}
+	}
+}
+
+func TestLeaseFileNext(t *testing.T) {
+	tests := []struct {
+		next string
+		want net.IP
+	}{
+		{"127.0.0.103", net.IPv4(127, 0, 0, 103)},
+		{"127.0.0.106", net.IPv4(127, 0, 0, 106)}, // the range is used up
+		{"127.0.0.107", net.IPv4(127, 0, 0, 101)}, // past the range
+		{"127.0.0.100", net.IPv4(127, 0, 0, 101)}, // behind the leases
+		{"fe80::1", net.IPv4(127, 0, 0, 101)},
+		{"", net.IPv4(127, 0, 0, 101)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.next, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "leases.json")
+			os.WriteFile(file, []byte(`{"next": "`+tt.next+`", "leases": [{"mac": "52:54:00:00:00:01", "ip": "127.0.0.100"}]}`), 0o644)
+			ts := newTestServer(t)
+			ts.config.LeaseFile = file
+			if err := ts.LoadLeaseFile(); err != nil {
+				t.Fatal(err)
+			}
+			if !ts.nextIP.Equal(tt.want) {
+				t.Errorf("next %s, want %s", ts.nextIP, tt.want)
+			}
+		})
+	}
+}
+
+func TestLeaseFileMalformed(t *testing.T) {
+	dir := t.TempDir()
+	ts := newTestServer(t)
+	if err := ts.LoadLeaseFile(); err != nil {
+		t.Errorf("without a lease file: %v", err)
+	}
+	ts.config.LeaseFile = filepath.Join(dir, "missing.json")
+	if err := ts.LoadLeaseFile(); err != nil {
+		t.Errorf("lease file not written yet: %v", err)
+	}
+
+	for _, data := range []string{"", "{", `{"leases": {}}`, `{"next": 5}`, `[]`} {
+		file := filepath.Join(dir, "leases.json")
+		os.WriteFile(file, []byte(data), 0o644)
+		ts.config.LeaseFile = file
+		if err := ts.LoadLeaseFile(); err == nil || !strings.Contains(err.Error(), file) {
+			t.Errorf("%q: %v", data, err)
+		}
+	}
+
+	// Unreadable leases are skipped, the others kept
+	file := filepath.Join(dir, "leases.json")
+	os.WriteFile(file, []byte(`{"leases": [{"mac": "x", "ip": "127.0.0.100"}, {"mac": "52:54:00:00:00:01", "ip": "::1"}, {"mac": "52:54:00:00:00:02", "ip": "127.0.0.101"}]}`), 0o644)
+	if err := ts.LoadLeaseFile(); err != nil || len(ts.Leases()) != 1 {
+		t.Errorf("loaded %+v, %v", ts.Leases(), err)
+	}
+}
+
+func TestLeaseFileProxy(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "leases.json")
+	ts := newTestServer(t)
+	ts.config.LeaseFile, ts.config.Proxy = file, true
+	if err := ts.SaveLeases(); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(file); strings.Contains(string(data), "next") {
+		t.Errorf("proxy saved a cursor: %s", data)
+	}
+}
@@ -0,0 +1,92 @@
+package dhcp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// MenuItem is one choice of the boot menu PXE firmware shows
+type MenuItem struct {
+	Label    string
+	BootFile string // "" boots from the local disk
+}
+
+// DefaultMenuPrompt and DefaultMenuTimeout are the boot menu prompt, and
+// how long it waits before booting the first item, unless configured
+// otherwise
+const (
+	DefaultMenuPrompt  = "Press F8 for the boot menu"
+	DefaultMenuTimeout = 10 * time.Second
+)
+
+// PXE boot server types (PXE 2.1 table 2-19): 0 boots from the local disk,
+// vendor types from 0x8000 are ours
+const (
+	bootTypeLocal  = 0
+	bootTypeVendor = 0x8000
+)
+
+// bootType is the boot server type of the menu's item i
+func bootType(i int, item MenuItem) uint16 {
+	if item.BootFile == "" {
+		return bootTypeLocal
+	}
+	return bootTypeVendor + uint16(i)
+}
+
+// CheckMenu checks that a boot menu with items and prompt fits in option
+// 43
+func CheckMenu(items []MenuItem, prompt string) error {
+	if n := len(menuOptions(items, make([]byte, 4), prompt, 0)); n > 255 {
+		return fmt.Errorf("boot menu takes %d bytes of vendor options, at most 255 fit: shorten the labels or prompt", n)
+	}
+	return nil
+}
+
+// menuOptions are the PXE vendor options (option 43) offering items,
+// from the boot server at server, after prompt for timeout: discovery
+// control unicasting to the boot servers (sub-option 6), this server for
+// each type (8), the menu (9) and its prompt (10)
+func menuOptions(items []MenuItem, server []byte, prompt string, timeout time.Duration) []byte {
+	var servers, menu []byte
+	for i, item := range items {
+		t := bootType(i, item)
+		menu = binary.BigEndian.AppendUint16(menu, t)
+		menu = append(append(menu, byte(len(item.Label))), item.Label...)
+		if t != bootTypeLocal {
+			servers = binary.BigEndian.AppendUint16(servers, t)
+			servers = append(append(servers, 1), server...)
+		}
+	}
+	b := []byte{6, 1, 0x03}
+	if len(servers) > 0 {
+		b = append(append(b, 8, byte(len(servers))), servers...)
+	}
+	b = append(append(b, 9, byte(len(menu))), menu...)
+	secs := byte(min(timeout/time.Second, 255))
+	b = append(append(b, 10, byte(1+len(prompt)), secs), prompt...)
+	return append(b, 255)
+}
+
+// offersMenu reports whether req gets the boot menu rather than a boot
+// file: BIOS PXE ROMs, but not iPXE, whose own menus go-pxe serves
+func (s *Server) offersMenu(req *Packet, archName string) bool {
+	return len(s.config.BootMenu) > 0 && (archName == "" || archName == "bios") &&
+		strings.HasPrefix(string(req.Options[60]), "PXEClient") && !isIPXE(req)
+}
+
+// menuBootFile is the boot file of the menu item a boot server REQUEST
+// asks for with item (see bootItem), if it is one
+func (s *Server) menuBootFile(item []byte) (string, bool) {
+	if len(item) < 2 {
+		return "", false
+	}
+	for i, it := range s.config.BootMenu {
+		if t := bootType(i, it); t != bootTypeLocal && t == binary.BigEndian.Uint16(item) {
+			return it.BootFile, true
+		}
+	}
+	return "", false
+}
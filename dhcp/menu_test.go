@@ -0,0 +1,125 @@
+package dhcp
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+var menu = []MenuItem{
+	{Label: "Install", BootFile: "pxelinux.0"},
+	{Label: "Local disk"},
+	{Label: "Rescue", BootFile: "rescue.0"},
+}
+
+func TestMenuOptions(t *testing.T) {
+	got := menuOptions(menu, []byte{10, 0, 0, 1}, "P", 10*time.Second)
+	want := []byte{
+		6, 1, 0x03,
+		8, 14, 0x80, 0x00, 1, 10, 0, 0, 1, 0x80, 0x02, 1, 10, 0, 0, 1,
+		9, 32, 0x80, 0x00, 7, 'I', 'n', 's', 't', 'a', 'l', 'l',
+		0x00, 0x00, 10, 'L', 'o', 'c', 'a', 'l', ' ', 'd', 'i', 's', 'k',
+		0x80, 0x02, 6, 'R', 'e', 's', 'c', 'u', 'e',
+		10, 2, 10, 'P',
+		255,
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("menuOptions = %v\nwant %v", got, want)
+	}
+
+	// Only the local disk: no boot servers; the timeout is capped
+	got = menuOptions(menu[1:2], []byte{10, 0, 0, 1}, "", time.Hour)
+	want = []byte{6, 1, 0x03, 9, 13, 0, 0, 10, 'L', 'o', 'c', 'a', 'l', ' ', 'd', 'i', 's', 'k', 10, 1, 255, 255}
+	if !bytes.Equal(got, want) {
+		t.Errorf("menuOptions = %v\nwant %v", got, want)
+	}
+}
+
+func TestCheckMenu(t *testing.T) {
+	if err := CheckMenu(menu, DefaultMenuPrompt); err != nil {
+		t.Error(err)
+	}
+	long := []MenuItem{{Label: strings.Repeat("x", 120), BootFile: "a"}, {Label: strings.Repeat("y", 120), BootFile: "b"}}
+	if err := CheckMenu(long, DefaultMenuPrompt); err == nil {
+		t.Error("oversized menu accepted")
+	}
+	if err := CheckMenu(menu[:1], strings.Repeat("p", 255)); err == nil {
+		t.Error("oversized prompt accepted")
+	}
+}
+
+// pxeClient is a DISCOVER from a PXE ROM of architecture arch
+func pxeClient(arch byte) *Packet {
+	req := packet(DISCOVER, "52:54:00:00:00:01")
+	req.Options[60] = []byte("PXEClient:Arch:00000:UNDI:002001")
+	req.Options[OptClientArch] = []byte{0, arch}
+	return req
+}
+
+func TestMenuOffer(t *testing.T) {
+	tests := []struct {
+		name  string
+		req   func() *Packet
+		offer bool
+	}{
+		{"BIOS", func() *Packet { return pxeClient(0) }, true},
+		{"UEFI", func() *Packet { return pxeClient(7) }, false},
+		{"iPXE", func() *Packet { req := pxeClient(0); req.Options[OptUserClass] = []byte("iPXE"); return req }, false},
+		{"not PXE", func() *Packet { req := pxeClient(0); delete(req.Options, 60); return req }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t)
+			ts.config.BootMenu = menu
+			ts.handle(ts.conn, tt.req(), nil)
+			if len(ts.sent) != 1 {
+				t.Fatalf("sent %d replies", len(ts.sent))
+			}
+			want := menuOptions(menu, []byte{127, 0, 0, 1}, DefaultMenuPrompt, DefaultMenuTimeout)
+			if got := ts.sent[0].Options[43]; bytes.Equal(got, want) != tt.offer {
+				t.Errorf("option 43 = %v", got)
+			}
+		})
+	}
+}
+
+func TestMenuBootFile(t *testing.T) {
+	ts := newTestServer(t)
+	ts.config.BootMenu = menu
+	ts.config.BootFile = "default.0"
+	to := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: ts.conn.LocalAddr().(*net.UDPAddr).Port}
+	tests := []struct {
+		item []byte
+		file string
+	}{
+		{[]byte{0x80, 0x02, 0x80, 0x00}, "rescue.0"},
+		{[]byte{0x80, 0x00, 0x00, 0x00}, "pxelinux.0"},
+		{[]byte{0x80, 0x01, 0x00, 0x00}, "default.0"}, // item 1, the local disk, is type 0
+		{[]byte{0x80, 0x07, 0x00, 0x00}, "default.0"},
+	}
+	for _, tt := range tests {
+		ts.sent = nil
+		req := pxeClient(0)
+		req.Options[OptMessageType] = []byte{REQUEST}
+		req.Options[43] = append([]byte{71, 4}, append(tt.item, 255)...)
+		ts.sendReply(ts.conn, req, ACK, net.IPv4(127, 0, 0, 50), to)
+		if len(ts.sent) != 1 {
+			t.Fatalf("item %x: sent %d replies", tt.item, len(ts.sent))
+		}
+		file := string(bytes.TrimRight(ts.sent[0].File[:], "\x00"))
+		if file != tt.file {
+			t.Errorf("item %x boots %q, want %q", tt.item, file, tt.file)
+		}
+		if opt := ts.sent[0].Options[43]; !bytes.Equal(opt, []byte{71, 4, tt.item[0], tt.item[1], 0, 0, 255}) {
+			t.Errorf("item %x: option 43 = %v", tt.item, opt)
+		}
+	}
+
+	for _, item := range [][]byte{nil, {0x80}} {
+		if f, ok := ts.menuBootFile(item); ok {
+			t.Errorf("menuBootFile(%x) = %q", item, f)
+		}
+	}
+}
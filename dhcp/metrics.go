@@ -0,0 +1,74 @@
+package dhcp
+
+import (
+	"time"
+
+	"github.com/ars1364/go-pxe/metrics"
+)
+
+var (
+	mReceived  = metrics.Default.Counter("gopxe_dhcp_received_total", "DHCP messages received, by message type.", "domain", "type")
+	mSent      = metrics.Default.Counter("gopxe_dhcp_sent_total", "DHCP replies sent, by message type.", "domain", "type")
+	mInvalid   = metrics.Default.Counter("gopxe_dhcp_invalid_total", "Malformed DHCP packets dropped.", "domain")
+	mExpired   = metrics.Default.Counter("gopxe_dhcp_leases_expired_total", "Leases that expired, their addresses going back to the pool.", "domain")
+	mDeclined  = metrics.Default.Counter("gopxe_dhcp_declined_total", "Addresses clients declined as in use by another machine, and quarantined.", "domain")
+	mConflicts = metrics.Default.Counter("gopxe_dhcp_conflicts_total", "Addresses a probe found in use by another machine before they were offered, and quarantined.", "domain")
+	mDropped   = metrics.Default.Counter("gopxe_dhcp_dropped_total", "DHCP packets dropped unanswered, as retransmissions of one being handled (duplicate) with every worker busy (busy) or as denied by a hook (denied), or from clients not allowed (filtered).", "domain", "reason")
+
+	mPoolSize   = metrics.Default.Gauge("gopxe_dhcp_pool_size", "Addresses in the DHCP range.", "domain")
+	mPoolLeased = metrics.Default.Gauge("gopxe_dhcp_pool_leased", "Addresses in the DHCP range currently leased.", "domain")
+	mPoolUsage  = metrics.Default.Gauge("gopxe_dhcp_pool_utilization", "Fraction of the DHCP range currently leased.", "domain")
+)
+
+// msgTypeNames label DHCP message types (RFC 2132 option 53)
+var msgTypeNames = map[byte]string{
+	1: "discover", 2: "offer", 3: "request", 4: "decline",
+	5: "ack", 6: "nak", 7: "release", 8: "inform",
+}
+
+func msgTypeName(t byte) string {
+	if name, ok := msgTypeNames[t]; ok {
+		return name
+	}
+	return "other"
+}
+
+// instrument starts the server's series at zero and wires the pool gauges
+func (s *Server) instrument() {
+	d := s.config.Domain
+	for _, t := range []byte{DISCOVER, REQUEST} {
+		mReceived.With(d, msgTypeName(t))
+	}
+	for _, t := range []byte{OFFER, ACK, NAK} {
+		mSent.With(d, msgTypeName(t))
+	}
+	mInvalid.With(d)
+	mExpired.With(d)
+	mDeclined.With(d)
+	mConflicts.With(d)
+	for _, r := range []string{"duplicate", "busy", "denied", "filtered"} {
+		mDropped.With(d, r)
+	}
+
+	if s.config.Proxy {
+		return // no pool
+	}
+	size := float64(ipToUint(s.config.RangeEnd) - ipToUint(s.config.RangeStart) + 1)
+	mPoolSize.With(d).Set(size)
+	mPoolLeased.With(d).SetFunc(func() float64 { return float64(s.leasedInRange()) })
+	mPoolUsage.With(d).SetFunc(func() float64 { return float64(s.leasedInRange()) / size })
+}
+
+// leasedInRange counts unexpired leases inside the configured range
+func (s *Server) leasedInRange() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	start, end := ipToUint(s.config.RangeStart), ipToUint(s.config.RangeEnd)
+	n := 0
+	for _, l := range s.leases {
+		if v := ipToUint(l.IP); v >= start && v <= end && time.Now().Before(l.Expires) {
+			n++
+		}
+	}
+	return n
+}
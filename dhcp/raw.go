@@ -0,0 +1,89 @@
+package dhcp
+
+import (
+	"encoding/binary"
+	"log"
+	"net"
+)
+
+// rawSender sends whole Ethernet frames out of an interface, so a reply
+// reaches its client's MAC address while the client has no IP address
+// yet, without relying on the broadcast routing of the host or container
+type rawSender interface {
+	send(frame []byte, dst net.HardwareAddr) error
+	Close() error
+}
+
+// rawFor reports whether replies to req can be sent as frames: the raw
+// sender is on the server's interface, not those of its pools
+func (s *Server) rawFor(req *Packet) bool {
+	return s.raw != nil && (req.iface == "" || req.iface == s.config.Interface)
+}
+
+// sendRaw sends the reply data to dst as a frame to the MAC address of
+// req's client, and reports whether it did; without a raw sender, or if
+// it fails, the reply is broadcast as usual
+func (s *Server) sendRaw(req *Packet, dst *net.UDPAddr, data []byte) bool {
+	mac := req.CHAddr
+	if !s.rawFor(req) || len(mac) != 6 {
+		return false
+	}
+	src := &net.UDPAddr{IP: s.config.ServerIP, Port: 67}
+	if err := s.raw.send(udpFrame(s.hwAddr, mac, src, dst, data), mac); err != nil {
+		log.Printf("[DHCP] Raw send to %s failed, broadcasting: %v", mac, err)
+		return false
+	}
+	return true
+}
+
+// udpFrame builds the Ethernet frame of a UDP datagram with payload from
+// src to dst, addressed to the MAC address dstMAC
+func udpFrame(srcMAC, dstMAC net.HardwareAddr, src, dst *net.UDPAddr, payload []byte) []byte {
+	const ethLen, ipLen, udpLen = 14, 20, 8
+	frame := make([]byte, ethLen+ipLen+udpLen+len(payload))
+
+	eth := frame[:ethLen]
+	copy(eth[0:6], dstMAC)
+	copy(eth[6:12], srcMAC)
+	binary.BigEndian.PutUint16(eth[12:14], 0x0800) // IPv4
+
+	ip := frame[ethLen : ethLen+ipLen]
+	ip[0] = 0x45 // version 4, 5 words
+	binary.BigEndian.PutUint16(ip[2:4], uint16(ipLen+udpLen+len(payload)))
+	ip[8] = 64 // TTL
+	ip[9] = 17 // UDP
+	copy(ip[12:16], src.IP.To4())
+	copy(ip[16:20], dst.IP.To4())
+	binary.BigEndian.PutUint16(ip[10:12], ^checksum(0, ip))
+
+	udp := frame[ethLen+ipLen:]
+	binary.BigEndian.PutUint16(udp[0:2], uint16(src.Port))
+	binary.BigEndian.PutUint16(udp[2:4], uint16(dst.Port))
+	binary.BigEndian.PutUint16(udp[4:6], uint16(udpLen+len(payload)))
+	copy(udp[udpLen:], payload)
+	// Over the pseudo-header of addresses, protocol and length
+	sum := checksum(0, ip[12:20])
+	sum = checksum(sum, []byte{0, 17})
+	sum = checksum(sum, udp[4:6])
+	cs := ^checksum(sum, udp)
+	if cs == 0 {
+		cs = 0xffff // 0 would mean no checksum
+	}
+	binary.BigEndian.PutUint16(udp[6:8], cs)
+	return frame
+}
+
+// checksum adds b to the running ones' complement sum
+func checksum(sum uint16, b []byte) uint16 {
+	s := uint32(sum)
+	for i := 0; i+1 < len(b); i += 2 {
+		s += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		s += uint32(b[len(b)-1]) << 8
+	}
+	for s > 0xffff {
+		s = s>>16 + s&0xffff
+	}
+	return uint16(s)
+}
@@ -0,0 +1,60 @@
+package dhcp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// bpfDevice sends frames by writing them to a BPF device attached to an
+// interface
+type bpfDevice struct {
+	f *os.File
+}
+
+// openRaw opens the first free BPF device and attaches it to ifi, with
+// the source MAC addresses of frames left as written
+func openRaw(ifi *net.Interface) (rawSender, error) {
+	var f *os.File
+	for i := 0; f == nil; i++ {
+		var err error
+		f, err = os.OpenFile(fmt.Sprintf("/dev/bpf%d", i), os.O_WRONLY, 0)
+		switch {
+		case errors.Is(err, syscall.EBUSY):
+			continue
+		case err != nil:
+			return nil, err
+		}
+	}
+	var ifr [32]byte // struct ifreq
+	copy(ifr[:16], ifi.Name)
+	one := uint32(1)
+	for _, req := range []struct {
+		name string
+		op   uintptr
+		arg  unsafe.Pointer
+	}{
+		{"BIOCSETIF", syscall.BIOCSETIF, unsafe.Pointer(&ifr)},
+		{"BIOCSHDRCMPLT", syscall.BIOCSHDRCMPLT, unsafe.Pointer(&one)},
+	} {
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), req.op, uintptr(req.arg)); errno != 0 {
+			f.Close()
+			return nil, os.NewSyscallError(req.name, errno)
+		}
+	}
+	return &bpfDevice{f: f}, nil
+}
+
+func (b *bpfDevice) send(frame []byte, dst net.HardwareAddr) error {
+	_, err := b.f.Write(frame)
+	return err
+}
+
+func (b *bpfDevice) Close() error {
+	return b.f.Close()
+}
+
+const rawMethod = "BPF"
@@ -0,0 +1,44 @@
+package dhcp
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"syscall"
+)
+
+// packetSocket sends frames through an AF_PACKET socket bound to an
+// interface
+type packetSocket struct {
+	fd    int
+	index int
+}
+
+// openRaw opens an AF_PACKET socket on ifi; it receives nothing
+func openRaw(ifi *net.Interface) (rawSender, error) {
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, 0)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrLinklayer{Ifindex: ifi.Index}); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+	return &packetSocket{fd: fd, index: ifi.Index}, nil
+}
+
+func (p *packetSocket) send(frame []byte, dst net.HardwareAddr) error {
+	sa := &syscall.SockaddrLinklayer{Protocol: ethIP, Ifindex: p.index, Halen: uint8(len(dst))}
+	copy(sa.Addr[:], dst)
+	return os.NewSyscallError("sendto", syscall.Sendto(p.fd, frame, 0, sa))
+}
+
+func (p *packetSocket) Close() error {
+	return syscall.Close(p.fd)
+}
+
+const rawMethod = "AF_PACKET"
+
+// ethIP is the EtherType of IPv4 in network byte order, as sockaddr_ll
+// takes it
+var ethIP = binary.NativeEndian.Uint16(binary.BigEndian.AppendUint16(nil, syscall.ETH_P_IP))
@@ -0,0 +1,114 @@
+package dhcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+)
+
+// fakeRaw records the frames sent, or fails
+type fakeRaw struct {
+	frames [][]byte
+	err    error
+}
+
+func (f *fakeRaw) send(frame []byte, dst net.HardwareAddr) error {
+	if f.err != nil {
+		return f.err
+	}
+	if !bytes.Equal(frame[:6], dst) {
+		return errors.New("frame not addressed to dst")
+	}
+	f.frames = append(f.frames, frame)
+	return nil
+}
+
+func (f *fakeRaw) Close() error { return nil }
+
+// sum16 is the ones' complement sum of the 16-bit words of the parts
+// together, as RFC 1071 computes it
+func sum16(parts ...[]byte) uint16 {
+	var b []byte
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	if len(b)%2 == 1 {
+		b = append(b, 0)
+	}
+	var s uint32
+	for i := 0; i < len(b); i += 2 {
+		s += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	for s > 0xffff {
+		s = s>>16 + s&0xffff
+	}
+	return uint16(s)
+}
+
+func TestUDPFrame(t *testing.T) {
+	srcMAC, _ := net.ParseMAC("02:00:00:00:00:01")
+	dstMAC, _ := net.ParseMAC("52:54:00:00:00:01")
+	src := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 67}
+	dst := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 100), Port: 68}
+	for _, payload := range [][]byte{[]byte("reply"), []byte("even"), nil, bytes.Repeat([]byte{0xff}, 301)} {
+		frame := udpFrame(srcMAC, dstMAC, src, dst, payload)
+		if len(frame) != 14+20+8+len(payload) {
+			t.Fatalf("%d byte frame for %d bytes", len(frame), len(payload))
+		}
+		if !bytes.Equal(frame[0:6], dstMAC) || !bytes.Equal(frame[6:12], srcMAC) || frame[12] != 0x08 || frame[13] != 0 {
+			t.Errorf("Ethernet header %x", frame[:14])
+		}
+		ip, udp := frame[14:34], frame[34:]
+		if ip[0] != 0x45 || ip[9] != 17 || int(binary.BigEndian.Uint16(ip[2:])) != 28+len(payload) ||
+			!net.IP(ip[12:16]).Equal(src.IP) || !net.IP(ip[16:20]).Equal(dst.IP) {
+			t.Errorf("IP header %x", ip)
+		}
+		if sum16(ip) != 0xffff {
+			t.Errorf("IP header checksum %x doesn't verify", ip[10:12])
+		}
+		if binary.BigEndian.Uint16(udp[0:]) != 67 || binary.BigEndian.Uint16(udp[2:]) != 68 || !bytes.Equal(udp[8:], payload) {
+			t.Errorf("UDP header %x", udp[:8])
+		}
+		pseudo := append(append(append([]byte{}, ip[12:20]...), 0, 17), udp[4:6]...)
+		if sum16(pseudo, udp) != 0xffff {
+			t.Errorf("%d bytes: UDP checksum %x doesn't verify", len(payload), udp[6:8])
+		}
+	}
+}
+
+func TestSendRaw(t *testing.T) {
+	ts := newTestServer(t)
+	raw := &fakeRaw{}
+	ts.raw, ts.hwAddr = raw, net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	ts.config.Interface = "eth0"
+	dst := &net.UDPAddr{IP: net.IPv4bcast, Port: 68}
+
+	req := packet(OFFER, "52:54:00:00:00:01")
+	if !ts.sendRaw(req, dst, []byte("reply")) || len(raw.frames) != 1 {
+		t.Fatal("not sent as a frame")
+	}
+	if udp := raw.frames[0][34:]; binary.BigEndian.Uint16(udp[0:]) != 67 || !bytes.Equal(udp[8:], []byte("reply")) {
+		t.Errorf("frame %x", raw.frames[0])
+	}
+
+	// Frames can't reach clients of other interfaces or hardware types
+	req.iface = "eth1"
+	if ts.sendRaw(req, dst, []byte("reply")) {
+		t.Error("sent on another interface's pool")
+	}
+	req = packet(OFFER, "52:54:00:00:00:01")
+	req.CHAddr = make(net.HardwareAddr, 20)
+	if ts.sendRaw(req, dst, []byte("reply")) {
+		t.Error("sent to an InfiniBand address")
+	}
+	raw.err = errors.New("ENETDOWN")
+	if ts.sendRaw(packet(OFFER, "52:54:00:00:00:01"), dst, []byte("reply")) {
+		t.Error("failed send reported as sent")
+	}
+	ts.raw = nil
+	if ts.sendRaw(packet(OFFER, "52:54:00:00:00:01"), dst, []byte("reply")) {
+		t.Error("sent without a raw sender")
+	}
+}
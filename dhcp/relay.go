@@ -0,0 +1,196 @@
+package dhcp
+
+import (
+	"cmp"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"unicode"
+)
+
+// Pool is an address range for clients on a routed subnet, whose DHCP
+// relay agent (IP helper) forwards their requests with its address on
+// that subnet as giaddr, or for those on another interface of the server
+type Pool struct {
+	Subnet     *net.IPNet
+	RangeStart net.IP
+	RangeEnd   net.IP
+	Router     net.IP // advertised in option 3, the relay agent or the server's address on Interface if nil
+
+	// Interface, if set, is an interface the server has an address in
+	// Subnet on, such as a VLAN sub-interface; clients broadcasting on it
+	// are served from the pool as well as relayed ones
+	Interface string
+
+	// BootFile and BootFiles, if set, replace the server's default boot
+	// files for the pool's clients, such as a BIOS and a UEFI VLAN each
+	// getting their own; a client's own file from BootFileFor still wins
+	BootFile  string
+	BootFiles map[string]string
+}
+
+// CheckPool checks that p's range is IPv4 and lies in its subnet
+func CheckPool(p Pool) error {
+	start, end := p.RangeStart.To4(), p.RangeEnd.To4()
+	switch {
+	case p.Subnet == nil || p.Subnet.IP.To4() == nil:
+		return fmt.Errorf("no IPv4 subnet")
+	case start == nil || end == nil || ipToUint(start) > ipToUint(end):
+		return fmt.Errorf("invalid range %s - %s", p.RangeStart, p.RangeEnd)
+	case !p.Subnet.Contains(start) || !p.Subnet.Contains(end):
+		return fmt.Errorf("range %s - %s is not in %s", start, end, p.Subnet)
+	case p.Router != nil && !p.Subnet.Contains(p.Router):
+		return fmt.Errorf("router %s is not in %s", p.Router, p.Subnet)
+	}
+	return nil
+}
+
+// relayed reports whether req came through a relay agent
+func relayed(req *Packet) bool {
+	return req.GIAddr != nil && !req.GIAddr.IsUnspecified()
+}
+
+// RelayInfo is what a relay agent tells about where a client is attached
+// in option 82 (RFC 3046), such as its switch port
+type RelayInfo struct {
+	CircuitID string // sub-option 1, such as the port and VLAN
+	RemoteID  string // sub-option 2, such as the switch
+}
+
+// relayInfo parses req's option 82; IDs that aren't printable text, such
+// as the binary ones of many switches, are in hex
+func relayInfo(req *Packet) RelayInfo {
+	var info RelayInfo
+	opt := req.Options[OptRelayInfo]
+	for len(opt) >= 2 && len(opt) >= 2+int(opt[1]) {
+		v := opt[2 : 2+opt[1]]
+		switch opt[0] {
+		case 1:
+			info.CircuitID = agentID(v)
+		case 2:
+			info.RemoteID = agentID(v)
+		}
+		opt = opt[2+opt[1]:]
+	}
+	return info
+}
+
+// agentID is a circuit or remote ID as text, or in hex unless it is
+// printable
+func agentID(b []byte) string {
+	if s := string(b); s != "" && strings.IndexFunc(s, func(r rune) bool { return r > unicode.MaxASCII || !unicode.IsPrint(r) }) < 0 {
+		return s
+	}
+	return hex.EncodeToString(b)
+}
+
+// relayPool is the index in RelayPools of the pool for clients of the
+// relay agent at giaddr, -1 if there is none
+func (s *Server) relayPool(giaddr net.IP) int {
+	for i, p := range s.config.RelayPools {
+		if p.Subnet.Contains(giaddr) {
+			return i
+		}
+	}
+	return -1
+}
+
+// clientPool is the index in RelayPools of the pool of req's client: that
+// of its relay agent, that of the interface it was received on, or the
+// one holding its address when it asks this server directly, such as to
+// renew it or for its boot file. It is -1 for clients of the server's own
+// range, and ok is false for those of a relay agent without a pool.
+func (s *Server) clientPool(req *Packet) (i int, ok bool) {
+	if relayed(req) {
+		i = s.relayPool(req.GIAddr)
+		return i, i >= 0
+	}
+	if req.iface != "" {
+		for i, p := range s.config.RelayPools {
+			if p.Interface == req.iface {
+				return i, true
+			}
+		}
+	}
+	if req.CIAddr != nil && !req.CIAddr.IsUnspecified() {
+		return s.relayPool(req.CIAddr), true
+	}
+	return -1, true
+}
+
+// listenPool listens on the interface of p, and returns the server's
+// address in p's subnet there
+func (s *Server) listenPool(p Pool) (*net.UDPConn, net.IP, error) {
+	if p.Interface == s.config.Interface {
+		return nil, nil, fmt.Errorf("interface %s is the server's own", p.Interface)
+	}
+	ifi, err := net.InterfaceByName(p.Interface)
+	if err != nil {
+		return nil, nil, err
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, nil, err
+	}
+	var addr net.IP
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && p.Subnet.Contains(ipnet.IP) {
+			addr = ipnet.IP.To4()
+			break
+		}
+	}
+	if addr == nil {
+		return nil, nil, fmt.Errorf("%s has no address in %s", p.Interface, p.Subnet)
+	}
+	conn, err := listen(ifi)
+	return conn, addr, err
+}
+
+// poolBootFile is the boot file the pool of req's client has for clients
+// of arch, "" if none
+func (s *Server) poolBootFile(req *Packet, arch string) string {
+	i, _ := s.clientPool(req)
+	if i < 0 {
+		return ""
+	}
+	p := s.config.RelayPools[i]
+	return cmp.Or(ArchBootFile(p.BootFiles, arch), p.BootFile)
+}
+
+// subnet is the mask and router of the subnet req's client is on: the
+// server's own, or that of its pool. The router of a pool that names none
+// is its relay agent, or the server's address on its interface; a client
+// renewing an address of a relay agent's pool directly gets none, its
+// relay agent being unknown then.
+func (s *Server) subnet(req *Packet) (net.IPMask, net.IP) {
+	i, ok := s.clientPool(req)
+	switch {
+	case !ok:
+		return net.CIDRMask(24, 32), req.GIAddr.To4()
+	case i < 0:
+		return s.config.SubnetMask, s.config.Router
+	}
+	p := s.config.RelayPools[i]
+	switch {
+	case p.Router != nil:
+		return p.Subnet.Mask, p.Router
+	case relayed(req):
+		return p.Subnet.Mask, req.GIAddr.To4()
+	}
+	return p.Subnet.Mask, s.poolAddrs[i]
+}
+
+// poolRange is the range and allocation cursor of the pool of req's
+// client, ok false if there is none
+func (s *Server) poolRange(req *Packet) (start, end net.IP, cursor *net.IP, ok bool) {
+	i, ok := s.clientPool(req)
+	switch {
+	case !ok:
+		return nil, nil, nil, false
+	case i < 0:
+		return s.config.RangeStart, s.config.RangeEnd, &s.nextIP, true
+	}
+	p := s.config.RelayPools[i]
+	return p.RangeStart, p.RangeEnd, &s.relayNext[i], true
+}
@@ -0,0 +1,87 @@
+package dhcp
+
+import (
+	"net"
+	"testing"
+)
+
+func TestClientPool(t *testing.T) {
+	_, routed, _ := net.ParseCIDR("10.1.0.0/24")
+	_, vlan, _ := net.ParseCIDR("10.2.0.0/24")
+	s := NewServer(Config{
+		Interface:  "eth0",
+		ServerIP:   net.IPv4(10, 0, 0, 1).To4(),
+		SubnetMask: net.IPv4Mask(255, 255, 255, 0),
+		Router:     net.IPv4(10, 0, 0, 254).To4(),
+		RangeStart: net.IPv4(10, 0, 0, 100).To4(),
+		RangeEnd:   net.IPv4(10, 0, 0, 200).To4(),
+		RelayPools: []Pool{
+			{Subnet: routed, RangeStart: net.IPv4(10, 1, 0, 100).To4(), RangeEnd: net.IPv4(10, 1, 0, 200).To4()},
+			{Subnet: vlan, RangeStart: net.IPv4(10, 2, 0, 100).To4(), RangeEnd: net.IPv4(10, 2, 0, 200).To4(), Interface: "eth0.20"},
+		},
+	})
+	s.poolAddrs[1] = net.IPv4(10, 2, 0, 1).To4() // as listenPool finds it
+
+	tests := []struct {
+		name   string
+		iface  string
+		ciaddr net.IP
+		giaddr net.IP
+		pool   int
+		ok     bool
+		mask   net.IPMask
+		router net.IP
+	}{
+		{"own interface", "eth0", nil, nil, -1, true, net.CIDRMask(24, 32), net.IPv4(10, 0, 0, 254)},
+		{"unknown interface", "", nil, nil, -1, true, net.CIDRMask(24, 32), net.IPv4(10, 0, 0, 254)},
+		{"relayed", "eth0", nil, net.IPv4(10, 1, 0, 1), 0, true, net.CIDRMask(24, 32), net.IPv4(10, 1, 0, 1)},
+		{"relayed without pool", "eth0", nil, net.IPv4(10, 9, 0, 1), -1, false, net.CIDRMask(24, 32), net.IPv4(10, 9, 0, 1)},
+		{"relayed on pool interface", "eth0.20", nil, net.IPv4(10, 1, 0, 1), 0, true, net.CIDRMask(24, 32), net.IPv4(10, 1, 0, 1)},
+		{"pool interface", "eth0.20", nil, nil, 1, true, net.CIDRMask(24, 32), net.IPv4(10, 2, 0, 1)},
+		{"renewing on pool interface", "eth0.20", net.IPv4(10, 2, 0, 150), nil, 1, true, net.CIDRMask(24, 32), net.IPv4(10, 2, 0, 1)},
+		{"renewing relayed address", "eth0", net.IPv4(10, 1, 0, 150), nil, 0, true, net.CIDRMask(24, 32), nil},
+		{"renewing own address", "eth0", net.IPv4(10, 0, 0, 150), nil, -1, true, net.CIDRMask(24, 32), net.IPv4(10, 0, 0, 254)},
+		{"boot server", "", net.IPv4(10, 2, 0, 150), nil, 1, true, net.CIDRMask(24, 32), net.IPv4(10, 2, 0, 1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := packet(DISCOVER, "52:54:00:00:00:01")
+			req.iface, req.CIAddr, req.GIAddr = tt.iface, tt.ciaddr.To4(), tt.giaddr.To4()
+			if i, ok := s.clientPool(req); i != tt.pool || ok != tt.ok {
+				t.Errorf("clientPool = %d, %v, want %d, %v", i, ok, tt.pool, tt.ok)
+			}
+			mask, router := s.subnet(req)
+			if mask.String() != tt.mask.String() || !router.Equal(tt.router) {
+				t.Errorf("subnet = %s, %s, want %s, %s", net.IP(mask), router, net.IP(tt.mask), tt.router)
+			}
+		})
+	}
+}
+
+func TestPoolAllocation(t *testing.T) {
+	_, vlan, _ := net.ParseCIDR("10.2.0.0/24")
+	s := NewServer(Config{
+		Interface:  "eth0",
+		ServerIP:   net.IPv4(10, 0, 0, 1).To4(),
+		SubnetMask: net.IPv4Mask(255, 255, 255, 0),
+		RangeStart: net.IPv4(10, 0, 0, 100).To4(),
+		RangeEnd:   net.IPv4(10, 0, 0, 200).To4(),
+		RelayPools: []Pool{{Subnet: vlan, RangeStart: net.IPv4(10, 2, 0, 100).To4(), RangeEnd: net.IPv4(10, 2, 0, 200).To4(), Interface: "eth0.20"}},
+	})
+	for _, tt := range []struct {
+		mac, iface string
+		want       net.IP
+	}{
+		{"52:54:00:00:00:01", "eth0", net.IPv4(10, 0, 0, 100)},
+		{"52:54:00:00:00:02", "eth0.20", net.IPv4(10, 2, 0, 100)},
+		{"52:54:00:00:00:03", "eth0.20", net.IPv4(10, 2, 0, 101)},
+		// A client moved to the VLAN gets an address there
+		{"52:54:00:00:00:01", "eth0.20", net.IPv4(10, 2, 0, 102)},
+	} {
+		req := packet(DISCOVER, tt.mac)
+		req.iface = tt.iface
+		if ip, _ := s.allocateIP(req); !ip.Equal(tt.want) {
+			t.Errorf("%s on %s got %s, want %s", tt.mac, tt.iface, ip, tt.want)
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package dhcp
+
+import (
+	"net"
+	"syscall"
+)
+
+// setSocketOptions enables broadcast and address sharing, and pins the socket
+// to ifi so several servers can each own :67 on a different interface.
+func setSocketOptions(fd uintptr, ifi *net.Interface) error {
+	// SO_BROADCAST: allow sending to broadcast addresses
+	if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1); err != nil {
+		return &net.OpError{Op: "SO_BROADCAST", Err: err}
+	}
+	if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEPORT, 1); err != nil {
+		return &net.OpError{Op: "SO_REUSEPORT", Err: err}
+	}
+	// IP_BOUND_IF: pin socket to interface by index
+	if err := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_BOUND_IF, ifi.Index); err != nil {
+		return &net.OpError{Op: "IP_BOUND_IF", Err: err}
+	}
+	return nil
+}
+
+const pinMethod = "IP_BOUND_IF"
@@ -0,0 +1,527 @@
+// Package dhcpv6 answers DHCPv6 (RFC 8415) on the provisioning segment:
+// addresses in the prefix router advertisements announce, resolvers, and
+// the boot file URL (RFC 5970) UEFI clients netboot from over IPv6.
+package dhcpv6
+
+import (
+	"cmp"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ars1364/go-pxe/dhcp"
+	"github.com/ars1364/go-pxe/events"
+)
+
+// Message types
+const (
+	msgSolicit     = 1
+	msgAdvertise   = 2
+	msgRequest     = 3
+	msgConfirm     = 4
+	msgRenew       = 5
+	msgRebind      = 6
+	msgReply       = 7
+	msgRelease     = 8
+	msgDecline     = 9
+	msgInformation = 11
+	msgRelayForw   = 12
+)
+
+// Options
+const (
+	optClientID    = 1
+	optServerID    = 2
+	optIANA        = 3
+	optIAAddr      = 5
+	optORO         = 6
+	optPreference  = 7
+	optStatus      = 13
+	optRapidCommit = 14
+	optVendorClass = 16
+	optDNS         = 23
+	optBootFileURL = 59
+	optClientArch  = 61
+)
+
+// Status codes
+const (
+	statusSuccess   = 0
+	statusNotOnLink = 4
+)
+
+// LeaseTime is the valid lifetime of the addresses handed out; they are
+// preferred for half of it, and renewed after a quarter
+const LeaseTime = 2 * time.Hour
+
+// firstHost is the interface identifier of the first address handed out,
+// clear of the low ones usually configured by hand
+const firstHost = 0x1000
+
+var allServers = net.ParseIP("ff02::1:2")
+
+// enterpriseUEFI is the enterprise number UEFI clients send their vendor
+// class under, "HTTPClient" for HTTP boot
+const enterpriseUEFI = 343
+
+// Lease is one address assignment
+type Lease struct {
+	MAC  string    `json:"mac,omitempty"` // if the client's DUID or address tells
+	DUID string    `json:"duid"`
+	IP   string    `json:"ip"`
+	Arch string    `json:"arch,omitempty"`
+	Seen time.Time `json:"seen,omitzero"`
+}
+
+type lease struct {
+	ip   net.IP
+	mac  net.HardwareAddr
+	arch string
+	seen time.Time
+}
+
+// Server answers DHCPv6 on Interface, handing out addresses in Prefix
+type Server struct {
+	Interface string
+	Prefix    *net.IPNet
+
+	// Addr is the server's own address in Prefix, which is never handed
+	// out
+	Addr net.IP
+
+	// DNS servers offered, if set
+	DNS []net.IP
+
+	// BootURL, if set, returns the boot file URL of the client with mac,
+	// nil if unknown, and architecture (option 61, as DHCPv4's option 93
+	// names them); "" offers none
+	BootURL func(mac net.HardwareAddr, arch uint16) string
+
+	Events *events.Bus
+
+	mu     sync.Mutex
+	leases map[string]*lease // by DUID and IAID
+	next   uint64
+	duid   []byte
+}
+
+func NewServer(iface string, prefix *net.IPNet, addr net.IP) *Server {
+	return &Server{Interface: iface, Prefix: prefix, Addr: addr, leases: make(map[string]*lease), next: firstHost}
+}
+
+// ListenAndServe answers the clients on the interface
+func (s *Server) ListenAndServe() error {
+	if ones, bits := s.Prefix.Mask.Size(); ones > 64 || bits != 128 {
+		return fmt.Errorf("prefix %s must be IPv6, /64 or shorter", s.Prefix)
+	}
+	ifi, err := net.InterfaceByName(s.Interface)
+	if err != nil {
+		return fmt.Errorf("interface lookup %s: %w", s.Interface, err)
+	}
+	if len(ifi.HardwareAddr) == 0 {
+		return fmt.Errorf("interface %s has no link-layer address for the server DUID", ifi.Name)
+	}
+	// DUID-LL: type 3, hardware type Ethernet
+	s.duid = append([]byte{0, 3, 0, 1}, ifi.HardwareAddr...)
+
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			if err := c.Control(func(fd uintptr) { sockErr = setSocketOptions(int(fd), ifi) }); err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+	pc, err := lc.ListenPacket(context.Background(), "udp6", "[::]:547")
+	if err != nil {
+		return fmt.Errorf("DHCPv6 listen: %w", err)
+	}
+	conn := pc.(*net.UDPConn)
+	defer conn.Close()
+
+	log.Printf("[DHCPv6] Listening on %s port 547, addresses in %s, booting from %s", ifi.Name, s.Prefix, s.Addr)
+
+	buf := make([]byte, 1500)
+	for {
+		n, remote, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			log.Printf("[DHCPv6] Read error: %v", err)
+			continue
+		}
+		msg, err := parse(buf[:n])
+		if err != nil {
+			log.Printf("[DHCPv6] Parse error from %s: %v", remote, err)
+			continue
+		}
+		reply := s.handle(msg, remote)
+		if reply == nil {
+			continue
+		}
+		if _, err := conn.WriteToUDP(reply.marshal(), remote); err != nil {
+			log.Printf("[DHCPv6] Send error: %v", err)
+		}
+	}
+}
+
+// handle answers msg from remote, nil if it is left unanswered
+func (s *Server) handle(msg *message, remote *net.UDPAddr) *message {
+	if msg.typ == msgRelayForw {
+		log.Printf("[DHCPv6] Ignoring relayed message from %s", remote)
+		return nil
+	}
+	clientID := msg.get(optClientID)
+	if len(clientID) == 0 {
+		return nil
+	}
+	// Messages for another server, or that must have none, are not ours
+	serverID := msg.get(optServerID)
+	switch msg.typ {
+	case msgSolicit, msgRebind, msgConfirm:
+		if serverID != nil {
+			return nil
+		}
+	case msgRequest, msgRenew, msgRelease, msgDecline:
+		if !slices.Equal(serverID, s.duid) {
+			return nil
+		}
+	case msgInformation:
+		if serverID != nil && !slices.Equal(serverID, s.duid) {
+			return nil
+		}
+	default:
+		return nil
+	}
+
+	mac := clientMAC(clientID, remote.IP)
+	var arch uint16
+	archName := ""
+	if a := msg.get(optClientArch); len(a) >= 2 {
+		arch = binary.BigEndian.Uint16(a)
+		archName = dhcp.ArchName(arch)
+	}
+	who := hex.EncodeToString(clientID)
+	if mac != nil {
+		who = mac.String()
+	}
+
+	reply := &message{typ: msgReply, xid: msg.xid}
+	reply.add(optServerID, s.duid)
+	reply.add(optClientID, clientID)
+	commit := msg.typ != msgSolicit
+	if msg.typ == msgSolicit {
+		if msg.get(optRapidCommit) != nil {
+			reply.add(optRapidCommit, nil)
+		} else {
+			reply.typ = msgAdvertise
+			reply.add(optPreference, []byte{255})
+		}
+		commit = msg.get(optRapidCommit) != nil
+	}
+
+	var addrs []net.IP
+	switch msg.typ {
+	case msgSolicit, msgRequest, msgRenew, msgRebind:
+		for _, ia := range msg.all(optIANA) {
+			if len(ia) < 12 {
+				continue
+			}
+			iaid := binary.BigEndian.Uint32(ia)
+			ip := s.address(clientID, iaid, mac, archName, commit)
+			addrs = append(addrs, ip)
+			reply.add(optIANA, iaNA(iaid, ip))
+		}
+	case msgConfirm:
+		status := uint16(statusSuccess)
+		for _, ia := range msg.all(optIANA) {
+			for _, a := range addresses(ia) {
+				if !s.Prefix.Contains(a) {
+					status = statusNotOnLink
+				}
+			}
+		}
+		reply.add(optStatus, statusOption(status, ""))
+	case msgRelease, msgDecline:
+		for _, ia := range msg.all(optIANA) {
+			if len(ia) >= 4 {
+				s.release(clientID, binary.BigEndian.Uint32(ia))
+			}
+		}
+		reply.add(optStatus, statusOption(statusSuccess, ""))
+		log.Printf("[DHCPv6] %s from %s", msgName(msg.typ), who)
+		return reply
+	}
+
+	if len(s.DNS) > 0 {
+		var dns []byte
+		for _, ip := range s.DNS {
+			dns = append(dns, ip.To16()...)
+		}
+		reply.add(optDNS, dns)
+	}
+	if s.BootURL != nil && (msg.requested(optBootFileURL) || msg.get(optClientArch) != nil) {
+		if url := s.BootURL(mac, arch); url != "" {
+			reply.add(optBootFileURL, []byte(url))
+		}
+	}
+	if vc := msg.get(optVendorClass); strings.Contains(string(vc), "HTTPClient") {
+		// UEFI HTTP boot only takes answers naming themselves for it
+		vendor := binary.BigEndian.AppendUint32(nil, enterpriseUEFI)
+		vendor = binary.BigEndian.AppendUint16(vendor, uint16(len("HTTPClient")))
+		reply.add(optVendorClass, append(vendor, "HTTPClient"...))
+	}
+
+	if len(addrs) > 0 {
+		log.Printf("[DHCPv6] %s from %s (%s) -> %s %s", msgName(msg.typ), who, cmp.Or(archName, "arch unknown"), msgName(reply.typ), addrs[0])
+		typ := events.DHCPAck
+		if reply.typ == msgAdvertise {
+			typ = events.DHCPOffer
+		}
+		s.Events.Publish(events.Event{Type: typ, MAC: mac, IP: addrs[0]})
+	} else {
+		log.Printf("[DHCPv6] %s from %s -> %s", msgName(msg.typ), who, msgName(reply.typ))
+	}
+	return reply
+}
+
+// address is the address of the client's IA, a new one if it has none,
+// and its lease from now if commit; offered ones are held for the client
+// until then
+func (s *Server) address(duid []byte, iaid uint32, mac net.HardwareAddr, arch string, commit bool) net.IP {
+	key := fmt.Sprintf("%x/%d", duid, iaid)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.leases[key]
+	if !ok {
+		l = &lease{ip: s.nextAddr()}
+		s.leases[key] = l
+	}
+	if mac != nil {
+		l.mac = mac
+	}
+	l.arch = cmp.Or(arch, l.arch)
+	if commit {
+		l.seen = time.Now()
+	}
+	return l.ip
+}
+
+// nextAddr is the next free address in the prefix
+func (s *Server) nextAddr() net.IP {
+	for {
+		ip := slices.Clone(s.Prefix.IP.To16())
+		binary.BigEndian.PutUint64(ip[8:], binary.BigEndian.Uint64(ip[8:])|s.next)
+		s.next++
+		if ip.Equal(s.Addr) {
+			continue
+		}
+		taken := false
+		for _, l := range s.leases {
+			taken = taken || l.ip.Equal(ip)
+		}
+		if !taken {
+			return ip
+		}
+	}
+}
+
+func (s *Server) release(duid []byte, iaid uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.leases, fmt.Sprintf("%x/%d", duid, iaid))
+}
+
+// Leases returns a snapshot of the lease table, without the addresses
+// only offered
+func (s *Server) Leases() []Lease {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]Lease, 0, len(s.leases))
+	for key, l := range s.leases {
+		if l.seen.IsZero() {
+			continue
+		}
+		duid, _, _ := strings.Cut(key, "/")
+		ls := Lease{DUID: duid, IP: l.ip.String(), Arch: l.arch, Seen: l.seen}
+		if l.mac != nil {
+			ls.MAC = l.mac.String()
+		}
+		list = append(list, ls)
+	}
+	return list
+}
+
+// clientMAC is the client's MAC address as its DUID tells it, for DUID-LLT
+// and DUID-LL, or else as its EUI-64 link-local address does
+func clientMAC(duid []byte, src net.IP) net.HardwareAddr {
+	switch {
+	case len(duid) == 14 && duid[1] == 1 && duid[3] == 1: // DUID-LLT, Ethernet
+		return net.HardwareAddr(slices.Clone(duid[8:]))
+	case len(duid) == 10 && duid[1] == 3 && duid[3] == 1: // DUID-LL, Ethernet
+		return net.HardwareAddr(slices.Clone(duid[4:]))
+	}
+	if src.To4() == nil && src.IsLinkLocalUnicast() && src[11] == 0xff && src[12] == 0xfe {
+		return net.HardwareAddr{src[8] ^ 0x02, src[9], src[10], src[13], src[14], src[15]}
+	}
+	return nil
+}
+
+func joinServers(fd int, ifi *net.Interface) error {
+	mreq := &syscall.IPv6Mreq{Interface: uint32(ifi.Index)}
+	copy(mreq.Multiaddr[:], allServers)
+	if err := syscall.SetsockoptIPv6Mreq(fd, syscall.IPPROTO_IPV6, syscall.IPV6_JOIN_GROUP, mreq); err != nil {
+		return &net.OpError{Op: "IPV6_JOIN_GROUP", Err: err}
+	}
+	return nil
+}
+
+// iaNA is an IA_NA holding ip
+func iaNA(iaid uint32, ip net.IP) []byte {
+	b := binary.BigEndian.AppendUint32(nil, iaid)
+	b = binary.BigEndian.AppendUint32(b, uint32(LeaseTime/4/time.Second))
+	b = binary.BigEndian.AppendUint32(b, uint32(LeaseTime*2/5/time.Second))
+	addr := append(ip.To16(), binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(nil,
+		uint32(LeaseTime/2/time.Second)), uint32(LeaseTime/time.Second))...)
+	b = binary.BigEndian.AppendUint16(b, optIAAddr)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(addr)))
+	return append(b, addr...)
+}
+
+// addresses are the addresses in an IA_NA
+func addresses(ia []byte) []net.IP {
+	if len(ia) < 12 {
+		return nil
+	}
+	var ips []net.IP
+	for _, o := range parseOptions(ia[12:]) {
+		if o.code == optIAAddr && len(o.data) >= 16 {
+			ips = append(ips, net.IP(o.data[:16]))
+		}
+	}
+	return ips
+}
+
+func statusOption(code uint16, msg string) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, code), msg...)
+}
+
+func msgName(t byte) string {
+	switch t {
+	case msgSolicit:
+		return "SOLICIT"
+	case msgAdvertise:
+		return "ADVERTISE"
+	case msgRequest:
+		return "REQUEST"
+	case msgConfirm:
+		return "CONFIRM"
+	case msgRenew:
+		return "RENEW"
+	case msgRebind:
+		return "REBIND"
+	case msgReply:
+		return "REPLY"
+	case msgRelease:
+		return "RELEASE"
+	case msgDecline:
+		return "DECLINE"
+	case msgInformation:
+		return "INFORMATION-REQUEST"
+	}
+	return fmt.Sprintf("type %d", t)
+}
+
+// message is a DHCPv6 client/server message
+type message struct {
+	typ     byte
+	xid     [3]byte
+	options []option
+}
+
+type option struct {
+	code uint16
+	data []byte
+}
+
+func parse(b []byte) (*message, error) {
+	if len(b) < 4 {
+		return nil, fmt.Errorf("message too short: %d bytes", len(b))
+	}
+	m := &message{typ: b[0]}
+	copy(m.xid[:], b[1:4])
+	if m.typ != msgRelayForw {
+		m.options = parseOptions(b[4:])
+	}
+	return m, nil
+}
+
+// parseOptions reads options up to the first that runs past the end
+func parseOptions(b []byte) []option {
+	var opts []option
+	for len(b) >= 4 {
+		code, n := binary.BigEndian.Uint16(b), int(binary.BigEndian.Uint16(b[2:]))
+		if 4+n > len(b) {
+			break
+		}
+		opts = append(opts, option{code, slices.Clone(b[4 : 4+n])})
+		b = b[4+n:]
+	}
+	return opts
+}
+
+// get is the first option code, nil if absent and empty if without data
+func (m *message) get(code uint16) []byte {
+	for _, o := range m.options {
+		if o.code == code {
+			if o.data == nil {
+				return []byte{}
+			}
+			return o.data
+		}
+	}
+	return nil
+}
+
+func (m *message) all(code uint16) [][]byte {
+	var list [][]byte
+	for _, o := range m.options {
+		if o.code == code {
+			list = append(list, o.data)
+		}
+	}
+	return list
+}
+
+// requested reports whether the client asked for code in its option
+// request option
+func (m *message) requested(code uint16) bool {
+	oro := m.get(optORO)
+	for i := 0; i+1 < len(oro); i += 2 {
+		if binary.BigEndian.Uint16(oro[i:]) == code {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *message) add(code uint16, data []byte) {
+	m.options = append(m.options, option{code, data})
+}
+
+func (m *message) marshal() []byte {
+	b := append([]byte{m.typ}, m.xid[:]...)
+	for _, o := range m.options {
+		b = binary.BigEndian.AppendUint16(b, o.code)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(o.data)))
+		b = append(b, o.data...)
+	}
+	return b
+}
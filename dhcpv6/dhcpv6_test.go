@@ -0,0 +1,244 @@
+package dhcpv6
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"reflect"
+	"testing"
+)
+
+var (
+	serverDUID = []byte{0, 3, 0, 1, 2, 0, 0, 0, 0, 1}
+	clientDUID = []byte{0, 3, 0, 1, 0x52, 0x54, 0, 0, 0, 7} // DUID-LL of 52:54:00:00:00:07
+	clientAddr = &net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 546}
+)
+
+// newTestServer hands out addresses in 2001:db8::/64, booting clients
+// that send an architecture from boot.efi
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	_, prefix, _ := net.ParseCIDR("2001:db8::/64")
+	s := NewServer("lo", prefix, net.ParseIP("2001:db8::1000"))
+	s.duid = serverDUID
+	s.DNS = []net.IP{net.ParseIP("2001:db8::1")}
+	s.BootURL = func(mac net.HardwareAddr, arch uint16) string {
+		if mac.String() != "52:54:00:00:00:07" {
+			t.Errorf("BootURL got MAC %s", mac)
+		}
+		return "tftp://[2001:db8::1]/boot.efi"
+	}
+	return s
+}
+
+// request is a client message of typ with opts
+func request(typ byte, opts ...option) *message {
+	return &message{typ: typ, xid: [3]byte{1, 2, 3}, options: append([]option{{optClientID, clientDUID}}, opts...)}
+}
+
+func ia(iaid uint32) option {
+	return option{optIANA, binary.BigEndian.AppendUint32(nil, iaid)[:4:4]}
+}
+
+func iaWith(iaid uint32) option {
+	return option{optIANA, append(binary.BigEndian.AppendUint32(nil, iaid), make([]byte, 8)...)}
+}
+
+func TestParse(t *testing.T) {
+	msg := request(msgSolicit, iaWith(1), option{optRapidCommit, nil}).marshal()
+	m, err := parse(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.typ != msgSolicit || m.xid != [3]byte{1, 2, 3} || len(m.options) != 3 {
+		t.Fatalf("parsed %+v", m)
+	}
+	if m.get(optRapidCommit) == nil || len(m.get(optRapidCommit)) != 0 {
+		t.Error("rapid commit option lost")
+	}
+	if !bytes.Equal(m.marshal(), msg) {
+		t.Error("message does not marshal back")
+	}
+	for i := range len(msg) {
+		m, err := parse(msg[:i])
+		if i < 4 {
+			if err == nil {
+				t.Errorf("parsed %d bytes", i)
+			}
+			continue
+		}
+		s := newTestServer(t)
+		s.handle(m, clientAddr) // must not panic
+	}
+}
+
+func TestParseOptions(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want []option
+	}{
+		{"one", []byte{0, 14, 0, 0}, []option{{14, []byte{}}}},
+		{"two", []byte{0, 7, 0, 1, 9, 0, 13, 0, 2, 0, 4}, []option{{7, []byte{9}}, {13, []byte{0, 4}}}},
+		{"runs past the end", []byte{0, 7, 0, 1, 9, 0, 1, 0, 9, 1}, []option{{7, []byte{9}}}},
+		{"partial header", []byte{0, 7, 0}, nil},
+		{"empty", nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseOptions(tt.data); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseOptions = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandle(t *testing.T) {
+	oro := option{optORO, []byte{0, optBootFileURL}}
+	tests := []struct {
+		name    string
+		msg     *message
+		reply   byte // 0 for none
+		address bool
+		boot    bool
+		status  int // -1 for no status
+	}{
+		{"solicit", request(msgSolicit, iaWith(1)), msgAdvertise, true, false, -1},
+		{"rapid commit", request(msgSolicit, iaWith(1), option{optRapidCommit, nil}), msgReply, true, false, -1},
+		{"boot file requested", request(msgSolicit, iaWith(1), oro), msgAdvertise, true, true, -1},
+		{"architecture sent", request(msgSolicit, iaWith(1), option{optClientArch, []byte{0, 7}}), msgAdvertise, true, true, -1},
+		{"short IA_NA", request(msgSolicit, ia(1)), msgAdvertise, false, false, -1},
+		{"solicit for a server", request(msgSolicit, iaWith(1), option{optServerID, serverDUID}), 0, false, false, -1},
+		{"request", request(msgRequest, iaWith(1), option{optServerID, serverDUID}), msgReply, true, false, -1},
+		{"request for another server", request(msgRequest, iaWith(1), option{optServerID, []byte{0, 3, 0, 1, 9}}), 0, false, false, -1},
+		{"request without a server", request(msgRequest, iaWith(1)), 0, false, false, -1},
+		{"information request", request(msgInformation, oro), msgReply, false, true, -1},
+		{"confirm on link", request(msgConfirm, option{optIANA, append(make([]byte, 12), iaNA(1, net.ParseIP("2001:db8::1001"))[12:]...)}), msgReply, false, false, statusSuccess},
+		{"confirm off link", request(msgConfirm, option{optIANA, append(make([]byte, 12), iaNA(1, net.ParseIP("2001:db9::1"))[12:]...)}), msgReply, false, false, statusNotOnLink},
+		{"release", request(msgRelease, ia(1), option{optServerID, serverDUID}), msgReply, false, false, statusSuccess},
+		{"relayed", &message{typ: msgRelayForw}, 0, false, false, -1},
+		{"no client ID", &message{typ: msgSolicit, options: []option{iaWith(1)}}, 0, false, false, -1},
+		{"advertise", request(msgAdvertise), 0, false, false, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reply := newTestServer(t).handle(tt.msg, clientAddr)
+			if tt.reply == 0 {
+				if reply != nil {
+					t.Fatalf("answered with type %d", reply.typ)
+				}
+				return
+			}
+			if reply == nil || reply.typ != tt.reply {
+				t.Fatalf("reply %+v, want type %d", reply, tt.reply)
+			}
+			if reply.xid != tt.msg.xid || !bytes.Equal(reply.get(optServerID), serverDUID) || !bytes.Equal(reply.get(optClientID), clientDUID) {
+				t.Errorf("reply header %x %x %x", reply.xid, reply.get(optServerID), reply.get(optClientID))
+			}
+			var addrs []net.IP
+			for _, ia := range reply.all(optIANA) {
+				addrs = append(addrs, addresses(ia)...)
+			}
+			if tt.address != (len(addrs) == 1) {
+				t.Errorf("addresses %v, want one %v", addrs, tt.address)
+			}
+			if len(addrs) == 1 && !addrs[0].Equal(net.ParseIP("2001:db8::1001")) {
+				t.Errorf("address %s, want 2001:db8::1001", addrs[0])
+			}
+			if boot := reply.get(optBootFileURL) != nil; boot != tt.boot {
+				t.Errorf("boot file URL %q, want one %v", reply.get(optBootFileURL), tt.boot)
+			}
+			status := -1
+			if st := reply.get(optStatus); len(st) >= 2 {
+				status = int(binary.BigEndian.Uint16(st))
+			}
+			if status != tt.status {
+				t.Errorf("status %d, want %d", status, tt.status)
+			}
+		})
+	}
+}
+
+func TestLeases(t *testing.T) {
+	s := newTestServer(t)
+	s.handle(request(msgSolicit, iaWith(1)), clientAddr)
+	if leases := s.Leases(); len(leases) != 0 {
+		t.Fatalf("offered address leased: %v", leases)
+	}
+	s.handle(request(msgRequest, iaWith(1), option{optServerID, serverDUID}, option{optClientArch, []byte{0, 16}}), clientAddr)
+	leases := s.Leases()
+	if len(leases) != 1 || leases[0].IP != "2001:db8::1001" || leases[0].MAC != "52:54:00:00:00:07" || leases[0].Arch != "efi-x64-http" {
+		t.Fatalf("leases %+v", leases)
+	}
+	other := request(msgSolicit, iaWith(2), option{optRapidCommit, nil})
+	if reply := s.handle(other, clientAddr); addresses(reply.get(optIANA))[0].Equal(net.ParseIP("2001:db8::1001")) {
+		t.Error("second IA got the first's address")
+	}
+	s.handle(request(msgRelease, ia(1), option{optServerID, serverDUID}), clientAddr)
+	if leases := s.Leases(); len(leases) != 1 || leases[0].IP == "2001:db8::1001" {
+		t.Errorf("leases after release %+v", leases)
+	}
+}
+
+func TestClientMAC(t *testing.T) {
+	tests := []struct {
+		name string
+		duid []byte
+		src  net.IP
+		want string
+	}{
+		{"DUID-LL", clientDUID, net.ParseIP("2001:db8::9"), "52:54:00:00:00:07"},
+		{"DUID-LLT", []byte{0, 1, 0, 1, 1, 2, 3, 4, 0x52, 0x54, 0, 0, 0, 8}, net.ParseIP("2001:db8::9"), "52:54:00:00:00:08"},
+		{"EUI-64 link-local", []byte{0, 4, 1, 2}, net.ParseIP("fe80::5054:ff:fe00:9"), "52:54:00:00:00:09"},
+		{"random link-local", []byte{0, 4, 1, 2}, net.ParseIP("fe80::1234:5678:9abc:def0"), ""},
+		{"IPv4 link-local", []byte{0, 4, 1, 2}, net.IPv4(169, 254, 0, 1).To4(), ""},
+		{"DUID-LL of another hardware type", []byte{0, 3, 0, 6, 1, 2, 3, 4, 5, 6}, net.ParseIP("2001:db8::9"), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := clientMAC(tt.duid, tt.src); got.String() != tt.want {
+				t.Errorf("clientMAC = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleMalformed(t *testing.T) {
+	oro := option{optORO, []byte{0, optBootFileURL}}
+	onLink := option{optIANA, append(make([]byte, 12), iaNA(1, net.ParseIP("2001:db8::1001"))[12:]...)}
+	server := option{optServerID, serverDUID}
+	for _, msg := range []*message{
+		request(msgSolicit, iaWith(1), oro, option{optClientArch, []byte{0, 7}}, option{optVendorClass, []byte("HTTPClient")}),
+		request(msgRequest, iaWith(1), server, option{optRapidCommit, nil}),
+		request(msgRenew, iaWith(1), server),
+		request(msgRebind, iaWith(1)),
+		request(msgConfirm, onLink),
+		request(msgRelease, ia(1), server),
+		request(msgDecline, ia(1), server),
+		request(msgInformation, oro, server),
+	} {
+		b := msg.marshal()
+		var inputs [][]byte
+		for n := 4; n < len(b); n++ {
+			inputs = append(inputs, b[:n])
+		}
+		for i := range b {
+			bad := bytes.Clone(b)
+			bad[i] ^= 0xff
+			inputs = append(inputs, bad)
+		}
+		s := newTestServer(t)
+		s.BootURL = func(net.HardwareAddr, uint16) string { return "boot.efi" }
+		for _, in := range inputs {
+			m, err := parse(in)
+			if err != nil {
+				t.Fatalf("parse %x: %v", in, err)
+			}
+			if reply := s.handle(m, clientAddr); reply != nil {
+				if _, err := parse(reply.marshal()); err != nil {
+					t.Errorf("reply to %x doesn't parse: %v", in, err)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,18 @@
+package dhcpv6
+
+import (
+	"net"
+	"syscall"
+)
+
+// setSocketOptions shares :547 with other servers, pins the socket to ifi
+// and joins All_DHCP_Relay_Agents_and_Servers there to hear clients
+func setSocketOptions(fd int, ifi *net.Interface) error {
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEPORT, 1); err != nil {
+		return &net.OpError{Op: "SO_REUSEPORT", Err: err}
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_BOUND_IF, ifi.Index); err != nil {
+		return &net.OpError{Op: "IPV6_BOUND_IF", Err: err}
+	}
+	return joinServers(fd, ifi)
+}
@@ -0,0 +1,18 @@
+package dhcpv6
+
+import (
+	"net"
+	"syscall"
+)
+
+// setSocketOptions shares :547 with other servers, pins the socket to ifi
+// and joins All_DHCP_Relay_Agents_and_Servers there to hear clients
+func setSocketOptions(fd int, ifi *net.Interface) error {
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+		return &net.OpError{Op: "SO_REUSEADDR", Err: err}
+	}
+	if err := syscall.BindToDevice(fd, ifi.Name); err != nil {
+		return &net.OpError{Op: "SO_BINDTODEVICE", Err: err}
+	}
+	return joinServers(fd, ifi)
+}
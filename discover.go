@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/ars1364/go-pxe/mdns"
+)
+
+// runDiscover lists the go-pxe servers advertising themselves via mDNS
+// (-mdns) on the local networks:
+//
+//	go-pxe discover [-wait 2s] [-json]
+func runDiscover(args []string) {
+	fs := flag.NewFlagSet("discover", flag.ExitOnError)
+	wait := fs.Duration("wait", 2*time.Second, "How long to collect answers")
+	service := fs.String("service", mdnsAPIService, "DNS-SD service type to browse, e.g. _http._tcp for boot file roots")
+	asJSON := fs.Bool("json", false, "Print the instances as JSON")
+	fs.Parse(args)
+
+	found, err := mdns.Browse(*service, *wait)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *asJSON {
+		json.NewEncoder(os.Stdout).Encode(found)
+		return
+	}
+	if len(found) == 0 {
+		fmt.Fprintf(os.Stderr, "No %s instances answered within %s\n", *service, *wait)
+		os.Exit(1)
+	}
+	for _, in := range found {
+		url := "(no address)"
+		if len(in.Addrs) > 0 {
+			url = "http://" + net.JoinHostPort(in.Addrs[0].String(), strconv.Itoa(in.Port)) + in.Lookup("path")
+		}
+		fmt.Printf("%-40s  %-12s  %s\n", in.Name, in.Lookup("domain"), url)
+	}
+}
@@ -0,0 +1,79 @@
+// Package disk opens the raw and qcow2 images served to diskless clients.
+package disk
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Image is a block device backing an export
+type Image interface {
+	io.ReaderAt
+	io.Closer
+	Size() int64
+}
+
+// WritableImage is an Image that also accepts writes
+type WritableImage interface {
+	Image
+	io.WriterAt
+	Sync() error
+}
+
+// Open opens a raw or qcow2 image read-only, detecting the format from the
+// file header. The image is not a WritableImage.
+func Open(path string) (Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	magic := make([]byte, 4)
+	if _, err := f.ReadAt(magic, 0); err == nil && bytes.Equal(magic, qcow2Magic) {
+		img, err := openQcow2(f)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		return img, nil
+	}
+	img, err := newRaw(f)
+	if err != nil {
+		return nil, err
+	}
+	return readOnly{img}, nil
+}
+
+// OpenWritable opens a raw image for reading and writing
+func OpenWritable(path string) (WritableImage, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	magic := make([]byte, 4)
+	if _, err := f.ReadAt(magic, 0); err == nil && bytes.Equal(magic, qcow2Magic) {
+		f.Close()
+		return nil, fmt.Errorf("%s: qcow2 images can only be served read-only", path)
+	}
+	return newRaw(f)
+}
+
+func newRaw(f *os.File) (*rawImage, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &rawImage{File: f, size: fi.Size()}, nil
+}
+
+// readOnly hides the write methods of a raw image opened read-only
+type readOnly struct{ Image }
+
+type rawImage struct {
+	*os.File
+	size int64
+}
+
+func (r *rawImage) Size() int64 { return r.size }
@@ -0,0 +1,46 @@
+package disk
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "raw.img")
+	if err := os.WriteFile(path, []byte("raw image data"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	img, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	if img.Size() != 14 {
+		t.Errorf("size %d, want 14", img.Size())
+	}
+	if _, ok := img.(WritableImage); ok {
+		t.Error("Open returned a writable image")
+	}
+
+	rw, err := OpenWritable(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rw.WriteAt([]byte("RAW"), 0); err != nil {
+		t.Fatal(err)
+	}
+	rw.Close()
+	buf := make([]byte, 3)
+	if _, err := img.ReadAt(buf, 0); err != nil || string(buf) != "RAW" {
+		t.Errorf("read %q, %v after writing RAW", buf, err)
+	}
+
+	qcow := filepath.Join(t.TempDir(), "disk.qcow2")
+	if err := os.WriteFile(qcow, qcow2Header(3, 9, 2048, 512, 1), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenWritable(qcow); err == nil {
+		t.Error("OpenWritable opened a qcow2 image")
+	}
+}
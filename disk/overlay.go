@@ -0,0 +1,181 @@
+package disk
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const overlayBlock = 4096
+
+// Overlay is a copy-on-write layer over a shared base image. Written blocks
+// live in a sparse file the size of the base; a bitmap in <path>.map records
+// which blocks it holds.
+type Overlay struct {
+	base Image
+	data *os.File
+	path string
+
+	mu     sync.RWMutex
+	bitmap []byte
+	dirty  bool
+}
+
+// OpenOverlay opens or creates the overlay at path on top of base. The
+// overlay owns base and closes it.
+func OpenOverlay(base Image, path string) (*Overlay, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	data, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := data.Stat()
+	if err != nil {
+		data.Close()
+		return nil, err
+	}
+	switch {
+	case fi.Size() == 0:
+		err = data.Truncate(base.Size())
+	case fi.Size() != base.Size():
+		err = fmt.Errorf("%s: base image changed size (%d -> %d); delete the overlay to start over", path, fi.Size(), base.Size())
+	}
+	if err != nil {
+		data.Close()
+		return nil, err
+	}
+
+	blocks := (base.Size() + overlayBlock - 1) / overlayBlock
+	bitmap, err := os.ReadFile(path + ".map")
+	if os.IsNotExist(err) {
+		bitmap, err = make([]byte, (blocks+7)/8), nil
+	}
+	if err == nil && int64(len(bitmap)) != (blocks+7)/8 {
+		err = fmt.Errorf("%s.map: wrong size", path)
+	}
+	if err != nil {
+		data.Close()
+		return nil, err
+	}
+	return &Overlay{base: base, data: data, path: path, bitmap: bitmap}, nil
+}
+
+func (o *Overlay) Size() int64 { return o.base.Size() }
+
+func (o *Overlay) has(block int64) bool {
+	return o.bitmap[block/8]&(1<<(block%8)) != 0
+}
+
+func (o *Overlay) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("read at negative offset %d", off)
+	}
+	if off >= o.Size() {
+		return 0, io.EOF
+	}
+	short := off > o.Size()-int64(len(p))
+	if short {
+		p = p[:o.Size()-off]
+	}
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	n := 0
+	for n < len(p) {
+		block := (off + int64(n)) / overlayBlock
+		within := (off + int64(n)) % overlayBlock
+		chunk := p[n:min(len(p), n+int(overlayBlock-within))]
+		var src io.ReaderAt = o.base
+		if o.has(block) {
+			src = o.data
+		}
+		m, err := src.ReadAt(chunk, off+int64(n))
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	if short {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (o *Overlay) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || off > o.Size()-int64(len(p)) {
+		return 0, fmt.Errorf("write beyond end of image")
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	n := 0
+	for n < len(p) {
+		block := (off + int64(n)) / overlayBlock
+		within := (off + int64(n)) % overlayBlock
+		chunk := p[n:min(len(p), n+int(overlayBlock-within))]
+		if !o.has(block) && len(chunk) < overlayBlock {
+			// Partial write: copy the rest of the block up first
+			buf := make([]byte, min(overlayBlock, o.Size()-block*overlayBlock))
+			if _, err := o.base.ReadAt(buf, block*overlayBlock); err != nil {
+				return n, err
+			}
+			if _, err := o.data.WriteAt(buf, block*overlayBlock); err != nil {
+				return n, err
+			}
+		}
+		m, err := o.data.WriteAt(chunk, off+int64(n))
+		n += m
+		if err != nil {
+			return n, err
+		}
+		o.bitmap[block/8] |= 1 << (block % 8)
+		o.dirty = true
+	}
+	return n, nil
+}
+
+// Sync flushes written data, then the bitmap that makes it visible
+func (o *Overlay) Sync() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err := o.data.Sync(); err != nil {
+		return err
+	}
+	if !o.dirty {
+		return nil
+	}
+	tmp := o.path + ".map.tmp"
+	if err := os.WriteFile(tmp, o.bitmap, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, o.path+".map"); err != nil {
+		return err
+	}
+	o.dirty = false
+	return nil
+}
+
+func (o *Overlay) Close() error {
+	err := o.Sync()
+	o.data.Close()
+	o.base.Close()
+	return err
+}
+
+// ClientDir returns the directory holding a client's overlays under root,
+// keeping odd client IDs from escaping it
+func ClientDir(root, id string) string {
+	id = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == 0 {
+			return '-'
+		}
+		return r
+	}, id)
+	if id == "" || id == "." || id == ".." {
+		id = "unknown"
+	}
+	return filepath.Join(root, id)
+}
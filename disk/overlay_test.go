@@ -0,0 +1,128 @@
+package disk
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOverlay(t *testing.T) {
+	dir := t.TempDir()
+	basePath := filepath.Join(dir, "base.img")
+	base := bytes.Repeat([]byte("b"), 3*overlayBlock+100)
+	if err := os.WriteFile(basePath, base, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	open := func() *Overlay {
+		t.Helper()
+		img, err := Open(basePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		o, err := OpenOverlay(img, filepath.Join(dir, "client", "base.img.overlay"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return o
+	}
+
+	o := open()
+	writes := []struct {
+		off  int64
+		data string
+	}{
+		{10, "partial"},
+		{overlayBlock - 2, "across"},
+		{int64(len(base)) - 4, "tail"},
+	}
+	want := append([]byte(nil), base...)
+	for _, w := range writes {
+		if _, err := o.WriteAt([]byte(w.data), w.off); err != nil {
+			t.Fatalf("WriteAt(%q, %d): %v", w.data, w.off, err)
+		}
+		copy(want[w.off:], w.data)
+	}
+	for _, off := range []int64{-1, int64(len(base)) - 3, math.MaxInt64 - 2} {
+		if _, err := o.WriteAt([]byte("oops"), off); err == nil {
+			t.Errorf("WriteAt at %d succeeded", off)
+		}
+	}
+	if err := o.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(basePath); !bytes.Equal(got, base) {
+		t.Error("writes reached the base image")
+	}
+
+	o = open()
+	defer o.Close()
+	got := make([]byte, len(base))
+	if _, err := o.ReadAt(got, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("reopened overlay lost writes")
+	}
+
+	reads := []struct {
+		name string
+		off  int64
+		n    int
+		err  error
+	}{
+		{"past the end", int64(len(base)) - 4, 10, io.EOF},
+		{"at the end", int64(len(base)), 1, io.EOF},
+		{"far past the end", math.MaxInt64, 1, io.EOF},
+	}
+	for _, r := range reads {
+		buf := make([]byte, r.n)
+		n, err := o.ReadAt(buf, r.off)
+		if err != r.err || !bytes.Equal(buf[:n], want[min(r.off, int64(len(want))):min(r.off+int64(n), int64(len(want)))]) {
+			t.Errorf("%s: ReadAt = %d, %v", r.name, n, err)
+		}
+	}
+	if _, err := o.ReadAt(make([]byte, 1), -1); err == nil {
+		t.Error("ReadAt at a negative offset succeeded")
+	}
+}
+
+func TestOverlayBaseResized(t *testing.T) {
+	dir := t.TempDir()
+	basePath := filepath.Join(dir, "base.img")
+	os.WriteFile(basePath, make([]byte, overlayBlock), 0o644)
+	img, _ := Open(basePath)
+	o, err := OpenOverlay(img, filepath.Join(dir, "base.img.overlay"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.Close()
+
+	os.WriteFile(basePath, make([]byte, 2*overlayBlock), 0o644)
+	img, _ = Open(basePath)
+	if o, err := OpenOverlay(img, filepath.Join(dir, "base.img.overlay")); err == nil {
+		o.Close()
+		t.Error("OpenOverlay accepted a resized base")
+	}
+}
+
+func TestClientDir(t *testing.T) {
+	tests := []struct {
+		id   string
+		want string
+	}{
+		{"web01", "/o/web01"},
+		{"10.0.0.5", "/o/10.0.0.5"},
+		{"../etc", "/o/..-etc"},
+		{"a/b\\c", "/o/a-b-c"},
+		{"..", "/o/unknown"},
+		{"", "/o/unknown"},
+	}
+	for _, tt := range tests {
+		if got := ClientDir("/o", tt.id); got != filepath.FromSlash(tt.want) {
+			t.Errorf("ClientDir(%q) = %q, want %q", tt.id, got, tt.want)
+		}
+	}
+}
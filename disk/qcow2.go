@@ -0,0 +1,183 @@
+package disk
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+var qcow2Magic = []byte{'Q', 'F', 'I', 0xfb}
+
+const (
+	qcowOffsetMask = 0x00fffffffffffe00 // bits 9-55
+	qcowCompressed = 1 << 62
+	qcowZero       = 1 // v3: cluster reads as zeros
+
+	// v3 incompatible features we can read despite
+	qcowIncompatDirty = 1 << 0
+
+	qcowMaxL1 = 4 << 20 // entries, as QEMU's 32 MiB L1 table limit
+)
+
+// qcow2Image reads a qcow2 image. Backing files, encryption and extended L2
+// entries are not supported.
+type qcow2Image struct {
+	f           *os.File
+	size        int64
+	clusterBits uint32
+	l1          []uint64
+
+	mu sync.Mutex
+	l2 map[uint64][]uint64 // L2 table offset -> entries
+}
+
+func openQcow2(f *os.File) (*qcow2Image, error) {
+	hdr := make([]byte, 104)
+	if _, err := f.ReadAt(hdr, 0); err != nil {
+		return nil, fmt.Errorf("qcow2 header: %w", err)
+	}
+	be := binary.BigEndian
+	version := be.Uint32(hdr[4:])
+	if version != 2 && version != 3 {
+		return nil, fmt.Errorf("unsupported qcow2 version %d", version)
+	}
+	if be.Uint64(hdr[8:]) != 0 {
+		return nil, fmt.Errorf("qcow2 backing files are not supported")
+	}
+	if be.Uint32(hdr[32:]) != 0 {
+		return nil, fmt.Errorf("encrypted qcow2 images are not supported")
+	}
+	if version == 3 {
+		if incompat := be.Uint64(hdr[72:]); incompat&^qcowIncompatDirty != 0 {
+			return nil, fmt.Errorf("unsupported qcow2 features %#x", incompat)
+		}
+	}
+
+	img := &qcow2Image{
+		f:           f,
+		clusterBits: be.Uint32(hdr[20:]),
+		size:        int64(be.Uint64(hdr[24:])),
+		l2:          make(map[uint64][]uint64),
+	}
+	if img.clusterBits < 9 || img.clusterBits > 21 {
+		return nil, fmt.Errorf("invalid qcow2 cluster bits %d", img.clusterBits)
+	}
+	l1Size := be.Uint32(hdr[36:])
+	if l1Size > qcowMaxL1 {
+		return nil, fmt.Errorf("qcow2 L1 table of %d entries is too large", l1Size)
+	}
+	l1, err := img.readTable(int64(be.Uint64(hdr[40:])), int(l1Size))
+	if err != nil {
+		return nil, fmt.Errorf("qcow2 L1 table: %w", err)
+	}
+	img.l1 = l1
+	return img, nil
+}
+
+func (q *qcow2Image) Size() int64  { return q.size }
+func (q *qcow2Image) Close() error { return q.f.Close() }
+
+func (q *qcow2Image) readTable(off int64, n int) ([]uint64, error) {
+	buf := make([]byte, n*8)
+	if _, err := q.f.ReadAt(buf, off); err != nil {
+		return nil, err
+	}
+	t := make([]uint64, n)
+	for i := range t {
+		t[i] = binary.BigEndian.Uint64(buf[i*8:])
+	}
+	return t, nil
+}
+
+// l2Entry returns the L2 entry for the guest cluster containing off, or 0
+// if it is unallocated
+func (q *qcow2Image) l2Entry(off int64) (uint64, error) {
+	clusterSize := int64(1) << q.clusterBits
+	l2Entries := clusterSize / 8
+	cluster := off >> q.clusterBits
+	l1Index := cluster / l2Entries
+	if l1Index >= int64(len(q.l1)) {
+		return 0, nil
+	}
+	l2Off := q.l1[l1Index] & qcowOffsetMask
+	if l2Off == 0 {
+		return 0, nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	table, ok := q.l2[l2Off]
+	if !ok {
+		var err error
+		if table, err = q.readTable(int64(l2Off), int(l2Entries)); err != nil {
+			return 0, fmt.Errorf("qcow2 L2 table: %w", err)
+		}
+		q.l2[l2Off] = table
+	}
+	return table[cluster%l2Entries], nil
+}
+
+func (q *qcow2Image) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("qcow2: negative offset %d", off)
+	}
+	if off >= q.size {
+		return 0, io.EOF
+	}
+	clusterSize := int64(1) << q.clusterBits
+	n := 0
+	for n < len(p) && off < q.size {
+		within := off & (clusterSize - 1)
+		chunk := min(int64(len(p)-n), clusterSize-within, q.size-off)
+		dst := p[n : n+int(chunk)]
+
+		entry, err := q.l2Entry(off)
+		if err != nil {
+			return n, err
+		}
+		switch {
+		case entry&qcowCompressed != 0:
+			data, err := q.readCompressed(entry)
+			if err != nil {
+				return n, err
+			}
+			copy(dst, data[within:])
+		case entry&qcowOffsetMask == 0 || entry&qcowZero != 0:
+			clear(dst)
+		default:
+			if _, err := q.f.ReadAt(dst, int64(entry&qcowOffsetMask)+within); err != nil {
+				return n, err
+			}
+		}
+		n += int(chunk)
+		off += chunk
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// readCompressed inflates a whole compressed cluster
+func (q *qcow2Image) readCompressed(entry uint64) ([]byte, error) {
+	x := 62 - (q.clusterBits - 8)
+	hostOff := int64(entry & (1<<x - 1))
+	sectors := int64((entry>>x)&(1<<(62-x)-1)) + 1
+	compressed := make([]byte, sectors*512-hostOff%512)
+	n, err := q.f.ReadAt(compressed, hostOff)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	out := make([]byte, 1<<q.clusterBits)
+	r := flate.NewReader(bytes.NewReader(compressed[:n]))
+	defer r.Close()
+	if _, err := io.ReadFull(r, out); err != nil {
+		return nil, fmt.Errorf("qcow2 compressed cluster: %w", err)
+	}
+	return out, nil
+}
@@ -0,0 +1,140 @@
+package disk
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// qcow2Header is a qcow2 header of version with clusters of 1<<bits
+// bytes, the virtual size size and an L1 table of l1Size entries at l1Off
+func qcow2Header(version, bits uint32, size, l1Off uint64, l1Size uint32) []byte {
+	hdr := make([]byte, 104)
+	be := binary.BigEndian
+	copy(hdr, qcow2Magic)
+	be.PutUint32(hdr[4:], version)
+	be.PutUint32(hdr[20:], bits)
+	be.PutUint64(hdr[24:], size)
+	be.PutUint32(hdr[36:], l1Size)
+	be.PutUint64(hdr[40:], l1Off)
+	return hdr
+}
+
+// qcow2File builds a 2 KiB image of 512-byte clusters: the first holds
+// 'A's, the second is a v3 zero cluster, the third unallocated and the
+// fourth compressed 'C's
+func qcow2File(t *testing.T) []byte {
+	t.Helper()
+	be := binary.BigEndian
+	f := make([]byte, 2048)
+	copy(f, qcow2Header(3, 9, 2048, 512, 1))
+	be.PutUint64(f[512:], 1024)                    // L1: the L2 table
+	be.PutUint64(f[1024:], 1536)                   // L2: cluster 0
+	be.PutUint64(f[1032:], qcowZero)               // cluster 1
+	be.PutUint64(f[1048:], qcowCompressed|2048)    // cluster 3, one sector
+	copy(f[1536:], bytes.Repeat([]byte("A"), 512)) // cluster 0's data
+	var compressed bytes.Buffer
+	w, _ := flate.NewWriter(&compressed, flate.BestCompression)
+	w.Write(bytes.Repeat([]byte("C"), 512))
+	w.Close()
+	return append(f, compressed.Bytes()...)
+}
+
+func TestQcow2(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "disk.qcow2")
+	if err := os.WriteFile(path, qcow2File(t), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	img, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	if img.Size() != 2048 {
+		t.Fatalf("size %d, want 2048", img.Size())
+	}
+	want := append(bytes.Repeat([]byte("A"), 512), make([]byte, 1024)...)
+	want = append(want, bytes.Repeat([]byte("C"), 512)...)
+
+	tests := []struct {
+		name string
+		off  int64
+		n    int
+		read int // bytes read
+		err  bool
+	}{
+		{"whole", 0, 2048, 2048, false},
+		{"across clusters", 500, 600, 600, false},
+		{"compressed", 1600, 100, 100, false},
+		{"past the end", 2000, 100, 48, true},
+		{"at the end", 2048, 1, 0, true},
+		{"negative offset", -512, 10, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := make([]byte, tt.n)
+			n, err := img.ReadAt(buf, tt.off)
+			if n != tt.read || (err != nil) != tt.err {
+				t.Fatalf("ReadAt = %d, %v, want %d bytes", n, err, tt.read)
+			}
+			if !bytes.Equal(buf[:n], want[max(tt.off, 0):max(tt.off, 0)+int64(n)]) {
+				t.Errorf("read %q", buf[:n])
+			}
+		})
+	}
+}
+
+func TestQcow2Malformed(t *testing.T) {
+	incompat := qcow2Header(3, 9, 2048, 512, 1)
+	binary.BigEndian.PutUint64(incompat[72:], 1<<1)
+	backing := qcow2Header(3, 9, 2048, 512, 1)
+	binary.BigEndian.PutUint64(backing[8:], 600)
+	encrypted := qcow2Header(2, 9, 2048, 512, 1)
+	binary.BigEndian.PutUint32(encrypted[32:], 1)
+	corruptL2 := qcow2File(t)
+	binary.BigEndian.PutUint64(corruptL2[512:], 1<<40)
+
+	tests := []struct {
+		name string
+		data []byte
+		open bool // opens, failing on read instead
+	}{
+		{"truncated header", qcow2Header(3, 9, 2048, 512, 1)[:50], false},
+		{"version 1", qcow2Header(1, 9, 2048, 512, 1), false},
+		{"backing file", backing, false},
+		{"encrypted", encrypted, false},
+		{"unknown feature", incompat, false},
+		{"tiny clusters", qcow2Header(3, 8, 2048, 512, 1), false},
+		{"huge clusters", qcow2Header(3, 30, 2048, 512, 1), false},
+		{"huge L1 table", qcow2Header(3, 9, 2048, 512, 1<<31), false},
+		{"L1 table past the end", qcow2Header(3, 9, 2048, 1<<20, 1), false},
+		{"L2 table past the end", corruptL2, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "disk.qcow2")
+			if err := os.WriteFile(path, tt.data, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			img, err := Open(path)
+			if !tt.open {
+				if err == nil {
+					img.Close()
+					t.Fatal("Open succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer img.Close()
+			if _, err := img.ReadAt(make([]byte, 512), 0); err == nil || err == io.EOF {
+				t.Errorf("ReadAt = %v, want an error", err)
+			}
+		})
+	}
+}
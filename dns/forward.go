@@ -0,0 +1,190 @@
+package dns
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Forwarder relays out-of-zone queries to upstream resolvers and caches the
+// answers for their TTL
+type Forwarder struct {
+	Upstreams  []string // host:port
+	Timeout    time.Duration
+	MaxEntries int
+
+	mu    sync.Mutex
+	cache map[Question]cacheEntry
+}
+
+type cacheEntry struct {
+	msg     []byte
+	expires time.Time
+}
+
+// Negative and TTL-less answers are cached this long
+const negativeTTL = 30 * time.Second
+
+// NewForwarder creates a forwarder over the given upstreams; a missing
+// port defaults to 53
+func NewForwarder(upstreams []string) *Forwarder {
+	f := &Forwarder{Timeout: 3 * time.Second, MaxEntries: 10000, cache: make(map[Question]cacheEntry)}
+	for _, u := range upstreams {
+		if _, _, err := net.SplitHostPort(u); err != nil {
+			u = net.JoinHostPort(u, "53")
+		}
+		f.Upstreams = append(f.Upstreams, u)
+	}
+	return f
+}
+
+// Exchange answers msg (whose first question is q) from cache or upstream
+func (f *Forwarder) Exchange(msg []byte, q Question, tcp bool) ([]byte, error) {
+	id := binary.BigEndian.Uint16(msg[0:2])
+
+	f.mu.Lock()
+	e, ok := f.cache[q]
+	f.mu.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		resp := append([]byte(nil), e.msg...)
+		binary.BigEndian.PutUint16(resp[0:2], id)
+		return resp, nil
+	}
+
+	var lastErr error
+	for _, up := range f.Upstreams {
+		resp, err := f.query(up, msg, tcp)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		f.store(q, resp)
+		return resp, nil
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no upstreams configured")
+	}
+	return nil, lastErr
+}
+
+func (f *Forwarder) query(upstream string, msg []byte, tcp bool) ([]byte, error) {
+	network := "udp"
+	if tcp {
+		network = "tcp"
+	}
+	conn, err := net.DialTimeout(network, upstream, f.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(f.Timeout))
+
+	var resp []byte
+	if tcp {
+		resp, err = exchangeTCP(conn, msg)
+	} else {
+		resp, err = exchangeUDP(conn, msg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) < 12 || binary.BigEndian.Uint16(resp[0:2]) != binary.BigEndian.Uint16(msg[0:2]) {
+		return nil, fmt.Errorf("%s: mismatched response", upstream)
+	}
+	return resp, nil
+}
+
+// exchangeUDP sends msg in a datagram and reads one reply
+func exchangeUDP(conn net.Conn, msg []byte) ([]byte, error) {
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// exchangeTCP sends msg with a length prefix and reads one framed reply
+func exchangeTCP(conn net.Conn, msg []byte) ([]byte, error) {
+	frame := binary.BigEndian.AppendUint16(nil, uint16(len(msg)))
+	if _, err := conn.Write(append(frame, msg...)); err != nil {
+		return nil, err
+	}
+	var l [2]byte
+	if _, err := io.ReadFull(conn, l[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (f *Forwarder) store(q Question, resp []byte) {
+	// Never cache truncated or failed answers
+	flags := binary.BigEndian.Uint16(resp[2:4])
+	rcode := flags & 0xF
+	if flags&flagTC != 0 || (rcode != RcodeSuccess && rcode != RcodeNXDomain) {
+		return
+	}
+	ttl, ok := minTTL(resp)
+	if !ok {
+		ttl = negativeTTL
+	}
+	if ttl == 0 {
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.cache) >= f.MaxEntries {
+		now := time.Now()
+		for k, e := range f.cache {
+			if now.After(e.expires) {
+				delete(f.cache, k)
+			}
+		}
+		if len(f.cache) >= f.MaxEntries {
+			f.cache = make(map[Question]cacheEntry)
+		}
+	}
+	f.cache[q] = cacheEntry{msg: append([]byte(nil), resp...), expires: time.Now().Add(ttl)}
+}
+
+// minTTL returns the smallest TTL among the answer and authority records
+func minTTL(msg []byte) (time.Duration, bool) {
+	qd := int(binary.BigEndian.Uint16(msg[4:6]))
+	rrs := int(binary.BigEndian.Uint16(msg[6:8])) + int(binary.BigEndian.Uint16(msg[8:10]))
+
+	off := 12
+	for i := 0; i < qd; i++ {
+		_, next, err := readName(msg, off)
+		if err != nil {
+			return 0, false
+		}
+		off = next + 4
+	}
+
+	var min uint32
+	found := false
+	for i := 0; i < rrs; i++ {
+		_, next, err := readName(msg, off)
+		if err != nil || next+10 > len(msg) {
+			return 0, false
+		}
+		ttl := binary.BigEndian.Uint32(msg[next+4 : next+8])
+		rdlen := int(binary.BigEndian.Uint16(msg[next+8 : next+10]))
+		if !found || ttl < min {
+			min, found = ttl, true
+		}
+		off = next + 10 + rdlen
+	}
+	return time.Duration(min) * time.Second, found
+}
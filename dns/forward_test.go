@@ -0,0 +1,104 @@
+package dns
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// upstream answers UDP queries with an A record of TTL ttl, counting them
+func upstream(t *testing.T, ttl uint32, count *atomic.Int32) string {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			count.Add(1)
+			id, flags, q, err := parseQuery(buf[:n])
+			if err != nil {
+				continue
+			}
+			conn.WriteToUDP(buildResponse(id, flags, q, RcodeSuccess, false, []Answer{{Type: TypeA, TTL: ttl, Data: []byte{192, 0, 2, 1}}}), from)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestForwarder(t *testing.T) {
+	var count atomic.Int32
+	f := NewForwarder([]string{upstream(t, 300, &count)})
+	f.Timeout = time.Second
+	q := Question{"example.com", TypeA, ClassIN}
+
+	for i, id := range []uint16{1, 2} {
+		resp, err := f.Exchange(query(id, q.Name, TypeA), q, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := binary.BigEndian.Uint16(resp); got != id {
+			t.Errorf("answer %d has id %d, want %d", i, got, id)
+		}
+	}
+	if n := count.Load(); n != 1 {
+		t.Errorf("upstream asked %d times, want once", n)
+	}
+
+	var uncached atomic.Int32
+	f = NewForwarder([]string{upstream(t, 0, &uncached)})
+	for range 2 {
+		if _, err := f.Exchange(query(1, q.Name, TypeA), q, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := uncached.Load(); n != 2 {
+		t.Errorf("upstream of a zero TTL asked %d times, want twice", n)
+	}
+}
+
+func TestForwarderBadUpstream(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	replies := [][]byte{
+		{0, 2, 0, 1}, // shorter than a header
+		{0, 12, 0, 9, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, // another ID
+		{0, 12, 0, 1}, // truncated
+	}
+	go func() {
+		for _, reply := range replies {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			io.ReadFull(c, make([]byte, 2+len(query(1, "example.com", TypeA))))
+			c.Write(reply)
+			c.Close()
+		}
+	}()
+
+	f := NewForwarder([]string{ln.Addr().String()})
+	f.Timeout = time.Second
+	q := Question{"example.com", TypeA, ClassIN}
+	for i := range replies {
+		if resp, err := f.Exchange(query(1, q.Name, TypeA), q, true); err == nil {
+			t.Errorf("reply %d: accepted %x", i, resp)
+		}
+	}
+
+	if _, err := NewForwarder(nil).Exchange(query(1, q.Name, TypeA), q, false); err == nil {
+		t.Error("forwarder without upstreams answered")
+	}
+}
@@ -0,0 +1,152 @@
+package dns
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// Record types and classes
+const (
+	TypeA    = 1
+	TypeNS   = 2
+	TypePTR  = 12
+	TypeAAAA = 28
+	TypeANY  = 255
+
+	ClassIN = 1
+)
+
+// Response codes
+const (
+	RcodeSuccess  = 0
+	RcodeFormErr  = 1
+	RcodeServFail = 2
+	RcodeNXDomain = 3
+	RcodeRefused  = 5
+)
+
+// Question is the single question of a query
+type Question struct {
+	Name  string // lowercase, without trailing dot
+	Type  uint16
+	Class uint16
+}
+
+// Answer is a resource record in a response
+type Answer struct {
+	Type uint16
+	TTL  uint32
+	Data []byte // already-encoded RDATA
+}
+
+// header flag bits
+const (
+	flagQR = 1 << 15
+	flagAA = 1 << 10
+	flagTC = 1 << 9
+	flagRD = 1 << 8
+	flagRA = 1 << 7
+)
+
+// parseQuery extracts the ID, flags and first question of a query
+func parseQuery(msg []byte) (id, flags uint16, q Question, err error) {
+	if len(msg) < 12 {
+		return 0, 0, q, fmt.Errorf("message too short: %d bytes", len(msg))
+	}
+	id = binary.BigEndian.Uint16(msg[0:2])
+	flags = binary.BigEndian.Uint16(msg[2:4])
+	if flags&flagQR != 0 {
+		return id, flags, q, fmt.Errorf("not a query")
+	}
+	if binary.BigEndian.Uint16(msg[4:6]) < 1 {
+		return id, flags, q, fmt.Errorf("no question")
+	}
+	name, off, err := readName(msg, 12)
+	if err != nil {
+		return id, flags, q, err
+	}
+	if off+4 > len(msg) {
+		return id, flags, q, fmt.Errorf("truncated question")
+	}
+	q = Question{
+		Name:  name,
+		Type:  binary.BigEndian.Uint16(msg[off : off+2]),
+		Class: binary.BigEndian.Uint16(msg[off+2 : off+4]),
+	}
+	return id, flags, q, nil
+}
+
+// readName decodes a possibly compressed domain name starting at off and
+// returns it with the offset just past it
+func readName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	for hops := 0; ; hops++ {
+		if off >= len(msg) || hops > 64 {
+			return "", 0, fmt.Errorf("bad name")
+		}
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.ToLower(strings.Join(labels, ".")), end, nil
+		case l&0xC0 == 0xC0:
+			if off+1 >= len(msg) {
+				return "", 0, fmt.Errorf("bad pointer")
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:off+2]) & 0x3FFF)
+		default:
+			if off+1+l > len(msg) {
+				return "", 0, fmt.Errorf("bad label")
+			}
+			labels = append(labels, string(msg[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+}
+
+// appendName encodes name as uncompressed labels
+func appendName(b []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" {
+			continue
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+// buildResponse answers q. All answers use the question name (via a
+// compression pointer to offset 12).
+func buildResponse(id, qflags uint16, q Question, rcode int, authoritative bool, answers []Answer) []byte {
+	flags := uint16(flagQR) | qflags&(0x7800|flagRD) | uint16(rcode)
+	if authoritative {
+		flags |= flagAA
+	}
+	b := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(b[0:2], id)
+	binary.BigEndian.PutUint16(b[2:4], flags)
+	binary.BigEndian.PutUint16(b[4:6], 1)
+	binary.BigEndian.PutUint16(b[6:8], uint16(len(answers)))
+
+	b = appendName(b, q.Name)
+	b = binary.BigEndian.AppendUint16(b, q.Type)
+	b = binary.BigEndian.AppendUint16(b, q.Class)
+
+	for _, a := range answers {
+		b = append(b, 0xC0, 12)
+		b = binary.BigEndian.AppendUint16(b, a.Type)
+		b = binary.BigEndian.AppendUint16(b, ClassIN)
+		b = binary.BigEndian.AppendUint32(b, a.TTL)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(a.Data)))
+		b = append(b, a.Data...)
+	}
+	return b
+}
@@ -0,0 +1,91 @@
+package dns
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// query is a recursive query for name of type qtype with ID id
+func query(id uint16, name string, qtype uint16) []byte {
+	b := binary.BigEndian.AppendUint16(nil, id)
+	b = binary.BigEndian.AppendUint16(b, flagRD)
+	b = append(b, 0, 1, 0, 0, 0, 0, 0, 0)
+	b = appendName(b, name)
+	b = binary.BigEndian.AppendUint16(b, qtype)
+	return binary.BigEndian.AppendUint16(b, ClassIN)
+}
+
+func TestParseQuery(t *testing.T) {
+	header := []byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	with := func(rest ...byte) []byte { return append(append([]byte(nil), header...), rest...) }
+	response := query(1, "a.lan", TypeA)
+	response[2] |= 0x80
+	noQuestion := query(1, "a.lan", TypeA)
+	noQuestion[5] = 0
+
+	tests := []struct {
+		name string
+		msg  []byte
+		want Question // if valid
+		ok   bool
+	}{
+		{"query", query(0x1234, "Node1.PXE.lan", TypeA), Question{"node1.pxe.lan", TypeA, ClassIN}, true},
+		{"root", query(1, ".", TypeNS), Question{"", TypeNS, ClassIN}, true},
+		{"compressed", with(0xc0, 18, 0, 1, 0, 1, 1, 'A', 0), Question{"a", 1, 1}, true},
+		{"short", header[:11], Question{}, false},
+		{"response", response, Question{}, false},
+		{"no question", noQuestion, Question{}, false},
+		{"truncated name", with(3, 'a', 'b'), Question{}, false},
+		{"unterminated name", with(1, 'a'), Question{}, false},
+		{"truncated question", with(1, 'a', 0, 0, 1), Question{}, false},
+		{"pointer loop", with(0xc0, 12, 0, 1, 0, 1), Question{}, false},
+		{"pointer past the end", with(0xc0, 0xff, 0, 1, 0, 1), Question{}, false},
+		{"truncated pointer", with(0xc0), Question{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, q, err := parseQuery(tt.msg)
+			if (err == nil) != tt.ok {
+				t.Fatalf("parseQuery error %v, want ok %v", err, tt.ok)
+			}
+			if tt.ok && q != tt.want {
+				t.Errorf("question %+v, want %+v", q, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildResponse(t *testing.T) {
+	q := Question{"node1.pxe.lan", TypeA, ClassIN}
+	resp := buildResponse(0x1234, flagRD, q, RcodeSuccess, true, []Answer{
+		{Type: TypeA, TTL: 300, Data: []byte{10, 0, 0, 5}},
+		{Type: TypeA, TTL: 60, Data: []byte{10, 0, 0, 6}},
+	})
+	if id := binary.BigEndian.Uint16(resp); id != 0x1234 {
+		t.Errorf("id %#x", id)
+	}
+	flags := binary.BigEndian.Uint16(resp[2:])
+	if flags&(flagQR|flagAA|flagRD) != flagQR|flagAA|flagRD || flags&0xf != RcodeSuccess {
+		t.Errorf("flags %#x", flags)
+	}
+	if ttl, ok := minTTL(resp); !ok || ttl != time.Minute {
+		t.Errorf("minTTL = %v, %v, want 1m", ttl, ok)
+	}
+	resp[2] &^= 0x80 // parse it back as a query
+	if _, _, got, err := parseQuery(resp); err != nil || got != q {
+		t.Errorf("question %+v, %v, want %+v", got, err, q)
+	}
+}
+
+func TestMinTTL(t *testing.T) {
+	resp := buildResponse(1, 0, Question{"a.lan", TypeA, ClassIN}, RcodeSuccess, true, []Answer{{Type: TypeA, TTL: 30, Data: []byte{10, 0, 0, 1}}})
+	for i := range len(resp) {
+		minTTL(resp[:max(i, 12)]) // must not panic
+	}
+	lying := append([]byte(nil), resp...)
+	binary.BigEndian.PutUint16(lying[6:], 0xffff) // more answers than there are
+	if _, ok := minTTL(lying); ok {
+		t.Error("minTTL found a TTL in a message claiming missing answers")
+	}
+}
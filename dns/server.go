@@ -0,0 +1,227 @@
+// Package dns is a small DNS server for the provisioning network: it
+// answers A and PTR queries for names derived from the host inventory and
+// active leases, and optionally forwards everything else to upstream
+// resolvers.
+package dns
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Records resolves names inside the zone. Names are single lowercase labels
+// relative to the zone (e.g. "node42" for node42.pxe.lan).
+type Records interface {
+	LookupHost(label string) net.IP
+	LookupAddr(ip net.IP) string
+}
+
+// Server answers queries for one zone
+type Server struct {
+	zone    string
+	records Records
+	TTL     uint32
+
+	// Forwarder, if set, resolves names outside the zone
+	Forwarder *Forwarder
+	// BlockExternal answers NXDOMAIN for names outside the zone instead of
+	// forwarding them
+	BlockExternal bool
+}
+
+// NewServer creates a server authoritative for zone
+func NewServer(zone string, records Records) *Server {
+	return &Server{zone: strings.ToLower(strings.Trim(zone, ".")), records: records, TTL: 60}
+}
+
+// ListenAndServe answers queries on addr over UDP and TCP
+func (s *Server) ListenAndServe(addr string) error {
+	udpAddr, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp4", udpAddr)
+	if err != nil {
+		return fmt.Errorf("DNS listen: %w", err)
+	}
+	defer conn.Close()
+
+	ln, err := net.Listen("tcp4", addr)
+	if err != nil {
+		return fmt.Errorf("DNS listen: %w", err)
+	}
+	defer ln.Close()
+	go s.serveTCP(ln)
+
+	forwarding := "off"
+	if s.BlockExternal {
+		forwarding = "blocked"
+	} else if s.Forwarder != nil {
+		forwarding = fmt.Sprint(s.Forwarder.Upstreams)
+	}
+	log.Printf("[DNS] Listening on %s, zone %q, forwarding %s", addr, s.zone, forwarding)
+
+	buf := make([]byte, 1500)
+	for {
+		n, remote, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			log.Printf("[DNS] Read error: %v", err)
+			continue
+		}
+		msg := append([]byte(nil), buf[:n]...)
+		go func() {
+			if resp := s.handle(msg, remote.IP, false); resp != nil {
+				conn.WriteToUDP(resp, remote)
+			}
+		}()
+	}
+}
+
+func (s *Server) serveTCP(ln net.Listener) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			log.Printf("[DNS] Accept error: %v", err)
+			return
+		}
+		go func() {
+			defer c.Close()
+			remote := c.RemoteAddr().(*net.TCPAddr).IP
+			for {
+				c.SetDeadline(time.Now().Add(10 * time.Second))
+				var l [2]byte
+				if _, err := io.ReadFull(c, l[:]); err != nil {
+					return
+				}
+				msg := make([]byte, binary.BigEndian.Uint16(l[:]))
+				if _, err := io.ReadFull(c, msg); err != nil {
+					return
+				}
+				resp := s.handle(msg, remote, true)
+				if resp == nil {
+					return
+				}
+				if _, err := c.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(resp))), resp...)); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+func (s *Server) handle(msg []byte, remote net.IP, tcp bool) []byte {
+	id, flags, q, err := parseQuery(msg)
+	if err != nil {
+		log.Printf("[DNS] Bad query from %s: %v", remote, err)
+		return nil
+	}
+
+	rcode, aa, answers := s.answer(q)
+	if rcode == RcodeRefused && q.Class == ClassIN {
+		switch {
+		case s.BlockExternal:
+			rcode = RcodeNXDomain
+		case s.Forwarder != nil:
+			resp, err := s.Forwarder.Exchange(msg, q, tcp)
+			if err == nil {
+				log.Printf("[DNS] %s %s from %s -> forwarded", typeName(q.Type), q.Name, remote)
+				return resp
+			}
+			log.Printf("[DNS] Forwarding %s failed: %v", q.Name, err)
+			rcode = RcodeServFail
+		}
+	}
+
+	log.Printf("[DNS] %s %s from %s -> rcode %d, %d answers", typeName(q.Type), q.Name, remote, rcode, len(answers))
+	resp := buildResponse(id, flags, q, rcode, aa, answers)
+	if s.Forwarder != nil && !s.BlockExternal {
+		resp[3] |= flagRA
+	}
+	return resp
+}
+
+// answer resolves q against the zone and reverse zone
+func (s *Server) answer(q Question) (rcode int, authoritative bool, answers []Answer) {
+	if q.Class != ClassIN {
+		return RcodeRefused, false, nil
+	}
+
+	if label, ok := s.inZone(q.Name); ok && s.zone != "" {
+		if label == "" {
+			return RcodeSuccess, true, nil
+		}
+		ip := s.records.LookupHost(label)
+		if ip == nil {
+			return RcodeNXDomain, true, nil
+		}
+		if q.Type == TypeA || q.Type == TypeANY {
+			answers = append(answers, Answer{Type: TypeA, TTL: s.TTL, Data: ip.To4()})
+		}
+		return RcodeSuccess, true, answers
+	}
+
+	if ip := parseReverse(q.Name); ip != nil {
+		label := s.records.LookupAddr(ip)
+		if label == "" {
+			// Not one of ours; the forwarder may know it
+			return RcodeRefused, false, nil
+		}
+		if q.Type == TypePTR || q.Type == TypeANY {
+			answers = append(answers, Answer{Type: TypePTR, TTL: s.TTL, Data: appendName(nil, label+"."+s.zone)})
+		}
+		return RcodeSuccess, true, answers
+	}
+
+	return RcodeRefused, false, nil
+}
+
+// inZone returns the label of name relative to the zone
+func (s *Server) inZone(name string) (string, bool) {
+	if name == s.zone {
+		return "", true
+	}
+	return strings.CutSuffix(name, "."+s.zone)
+}
+
+// parseReverse turns d.c.b.a.in-addr.arpa into a.b.c.d
+func parseReverse(name string) net.IP {
+	rest, ok := strings.CutSuffix(name, ".in-addr.arpa")
+	if !ok {
+		return nil
+	}
+	parts := strings.Split(rest, ".")
+	if len(parts) != 4 {
+		return nil
+	}
+	ip := make(net.IP, 4)
+	for i, p := range parts {
+		v, err := strconv.Atoi(p)
+		if err != nil || v < 0 || v > 255 {
+			return nil
+		}
+		ip[3-i] = byte(v)
+	}
+	return ip
+}
+
+func typeName(t uint16) string {
+	switch t {
+	case TypeA:
+		return "A"
+	case TypeNS:
+		return "NS"
+	case TypePTR:
+		return "PTR"
+	case TypeAAAA:
+		return "AAAA"
+	case TypeANY:
+		return "ANY"
+	}
+	return fmt.Sprintf("TYPE%d", t)
+}
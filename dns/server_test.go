@@ -0,0 +1,136 @@
+package dns
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// records is an inventory of one host, node1 at 10.0.0.5
+type records struct{}
+
+func (records) LookupHost(label string) net.IP {
+	if label == "node1" {
+		return net.IPv4(10, 0, 0, 5)
+	}
+	return nil
+}
+
+func (records) LookupAddr(ip net.IP) string {
+	if ip.Equal(net.IPv4(10, 0, 0, 5)) {
+		return "node1"
+	}
+	return ""
+}
+
+func TestAnswer(t *testing.T) {
+	s := NewServer("pxe.lan.", records{})
+	tests := []struct {
+		name    string
+		q       Question
+		rcode   int
+		answers int
+	}{
+		{"A", Question{"node1.pxe.lan", TypeA, ClassIN}, RcodeSuccess, 1},
+		{"ANY", Question{"node1.pxe.lan", TypeANY, ClassIN}, RcodeSuccess, 1},
+		{"AAAA", Question{"node1.pxe.lan", TypeAAAA, ClassIN}, RcodeSuccess, 0},
+		{"unknown host", Question{"node2.pxe.lan", TypeA, ClassIN}, RcodeNXDomain, 0},
+		{"zone apex", Question{"pxe.lan", TypeA, ClassIN}, RcodeSuccess, 0},
+		{"PTR", Question{"5.0.0.10.in-addr.arpa", TypePTR, ClassIN}, RcodeSuccess, 1},
+		{"PTR of another address", Question{"6.0.0.10.in-addr.arpa", TypePTR, ClassIN}, RcodeRefused, 0},
+		{"bad reverse name", Question{"300.0.0.10.in-addr.arpa", TypePTR, ClassIN}, RcodeRefused, 0},
+		{"outside the zone", Question{"example.com", TypeA, ClassIN}, RcodeRefused, 0},
+		{"suffix of another zone", Question{"node1.notpxe.lan", TypeA, ClassIN}, RcodeRefused, 0},
+		{"class CH", Question{"node1.pxe.lan", TypeA, 3}, RcodeRefused, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rcode, _, answers := s.answer(tt.q)
+			if rcode != tt.rcode || len(answers) != tt.answers {
+				t.Errorf("answer = rcode %d, %d answers, want rcode %d, %d answers", rcode, len(answers), tt.rcode, tt.answers)
+			}
+		})
+	}
+}
+
+func TestHandle(t *testing.T) {
+	s := NewServer("pxe.lan", records{})
+	msg := query(0xbeef, "node1.pxe.lan", TypeA)
+	for i := range len(msg) {
+		if resp := s.handle(msg[:i], net.IPv4(10, 0, 0, 9), false); resp != nil {
+			t.Errorf("answered a query truncated to %d bytes", i)
+		}
+	}
+	resp := s.handle(msg, net.IPv4(10, 0, 0, 9), false)
+	if len(resp) < 12 || binary.BigEndian.Uint16(resp) != 0xbeef || binary.BigEndian.Uint16(resp[6:]) != 1 {
+		t.Fatalf("response %x", resp)
+	}
+	if got := resp[len(resp)-4:]; !net.IP(got).Equal(net.IPv4(10, 0, 0, 5)) {
+		t.Errorf("address %v, want 10.0.0.5", net.IP(got))
+	}
+
+	s.BlockExternal = true
+	resp = s.handle(query(1, "example.com", TypeA), net.IPv4(10, 0, 0, 9), false)
+	if rcode := resp[3] & 0xf; rcode != RcodeNXDomain {
+		t.Errorf("blocked name answered rcode %d, want %d", rcode, RcodeNXDomain)
+	}
+}
+
+func TestHandleMalformed(t *testing.T) {
+	s := NewServer("pxe.lan", records{})
+	s.BlockExternal = true
+	for _, msg := range [][]byte{
+		query(1, "node1.pxe.lan", TypeA),
+		query(2, "5.0.0.10.in-addr.arpa", TypePTR),
+		query(3, "example.com", TypeANY),
+	} {
+		for i := range msg {
+			for _, b := range []byte{0x00, 0x3f, 0xc0, 0xff} {
+				bad := append([]byte(nil), msg...)
+				bad[i] = b
+				s.handle(bad, net.IPv4(10, 0, 0, 9), i%2 == 0)
+			}
+		}
+	}
+}
+
+func TestServeTCP(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go NewServer("pxe.lan", records{}).serveTCP(ln)
+
+	conn, err := net.Dial("tcp4", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	send := func(msg []byte) {
+		conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(msg))), msg...))
+	}
+	// Two queries on one connection
+	for id := range uint16(2) {
+		send(query(id, "node1.pxe.lan", TypeA))
+		var l [2]byte
+		if _, err := io.ReadFull(conn, l[:]); err != nil {
+			t.Fatal(err)
+		}
+		resp := make([]byte, binary.BigEndian.Uint16(l[:]))
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			t.Fatal(err)
+		}
+		if binary.BigEndian.Uint16(resp) != id || !net.IP(resp[len(resp)-4:]).Equal(net.IPv4(10, 0, 0, 5)) {
+			t.Errorf("response %x", resp)
+		}
+	}
+	// A bad query closes the connection
+	send([]byte{0, 1, 2})
+	if n, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read %d, %v after a bad query", n, err)
+	}
+}
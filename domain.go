@@ -0,0 +1,1395 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log"
+	"maps"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/ars1364/go-pxe/assets"
+	"github.com/ars1364/go-pxe/attest"
+	"github.com/ars1364/go-pxe/audit"
+	"github.com/ars1364/go-pxe/cluster"
+	"github.com/ars1364/go-pxe/console"
+	"github.com/ars1364/go-pxe/dhcp"
+	"github.com/ars1364/go-pxe/dhcpv6"
+	"github.com/ars1364/go-pxe/dns"
+	"github.com/ars1364/go-pxe/enroll"
+	"github.com/ars1364/go-pxe/events"
+	"github.com/ars1364/go-pxe/foreman"
+	"github.com/ars1364/go-pxe/hardware"
+	"github.com/ars1364/go-pxe/httpserver"
+	"github.com/ars1364/go-pxe/inspect"
+	"github.com/ars1364/go-pxe/inventory"
+	"github.com/ars1364/go-pxe/iscsi"
+	"github.com/ars1364/go-pxe/mcast"
+	"github.com/ars1364/go-pxe/mdns"
+	"github.com/ars1364/go-pxe/memory"
+	"github.com/ars1364/go-pxe/nbd"
+	"github.com/ars1364/go-pxe/netbootxyz"
+	"github.com/ars1364/go-pxe/netsetup"
+	"github.com/ars1364/go-pxe/nfs"
+	"github.com/ars1364/go-pxe/ntp"
+	"github.com/ars1364/go-pxe/oci"
+	"github.com/ars1364/go-pxe/pki"
+	"github.com/ars1364/go-pxe/qos"
+	"github.com/ars1364/go-pxe/ra"
+	"github.com/ars1364/go-pxe/recording"
+	"github.com/ars1364/go-pxe/render"
+	"github.com/ars1364/go-pxe/sessions"
+	"github.com/ars1364/go-pxe/sshkeys"
+	"github.com/ars1364/go-pxe/syslog"
+	"github.com/ars1364/go-pxe/tftp"
+	"github.com/ars1364/go-pxe/tokens"
+	"github.com/ars1364/go-pxe/transfers"
+	"github.com/ars1364/go-pxe/vault"
+)
+
+// domainConfig describes one isolated provisioning domain: an interface with
+// its own address pool, roots and host/profile definitions.
+type domainConfig struct {
+	Name       string `yaml:"name"`
+	Iface      string `yaml:"iface"`
+	IP         string `yaml:"ip"`
+	DHCPStart  string `yaml:"dhcpStart"`
+	DHCPEnd    string `yaml:"dhcpEnd"`
+	TFTPRoot   string `yaml:"tftpRoot"`
+	HTTPRoot   string `yaml:"httpRoot"`
+	HTTPPort   int    `yaml:"httpPort"`
+	BootFile   string `yaml:"bootFile"`
+	LocalBoot  string `yaml:"localBoot"`  // for hosts that must boot from disk
+	SecureBoot string `yaml:"secureBoot"` // signed shim and GRUB by architecture
+	NAT        string `yaml:"nat"`
+	DNSDomain  string `yaml:"dnsDomain"`
+
+	// Gateway, DNSServers, NTPServers and DomainName replace the router,
+	// resolvers, time servers and domain name DHCP advertises: the
+	// server's own address, its NTP server if it runs one, and dnsDomain
+	Gateway    string   `yaml:"gateway"`
+	DNSServers []string `yaml:"dnsServers"`
+	NTPServers []string `yaml:"ntpServers"`
+	DomainName string   `yaml:"domainName"`
+
+	// VLAN, if set, serves the 802.1Q sub-interface of Iface with this ID
+	// instead of Iface itself; VLANCreate creates it when missing
+	VLAN       int  `yaml:"vlan"`
+	VLANCreate bool `yaml:"vlanCreate"`
+
+	DNSUpstreams     []string `yaml:"dnsUpstreams"`
+	DNSBlockExternal bool     `yaml:"dnsBlockExternal"`
+
+	NTP         bool     `yaml:"ntp"`
+	IPv6Prefix  string   `yaml:"ipv6Prefix"`
+	IPv6Managed bool     `yaml:"ipv6Managed"`
+	IPv6Other   bool     `yaml:"ipv6Other"`
+	IPv6DNS     []string `yaml:"ipv6DNS"`
+
+	// DHCPv6 answers DHCPv6 clients with addresses in IPv6Prefix and
+	// their boot file URL, and sets the RA managed flag
+	DHCPv6 bool `yaml:"dhcpv6"`
+
+	NBDRoot       string `yaml:"nbdRoot"`
+	ISCSIRoot     string `yaml:"iscsiRoot"`
+	ISCSIWritable bool   `yaml:"iscsiWritable"`
+	NFSRoot       string `yaml:"nfsRoot"`
+	OverlayDir    string `yaml:"overlayDir"`
+	MulticastRoot string `yaml:"multicastRoot"`
+	Syslog        bool   `yaml:"syslog"`
+	Console       bool   `yaml:"console"`
+	Netconsole    bool   `yaml:"netconsole"`
+	MDNS          bool   `yaml:"mdns"`
+	Inspector     bool   `yaml:"inspector"`
+	Hardware      bool   `yaml:"hardware"`
+	Attest        bool   `yaml:"attest"`
+
+	// PKI issues inventory hosts a client certificate from the
+	// provisioning CA and serves HTTPS on HTTPSPort to clients presenting
+	// one
+	PKI       bool `yaml:"pki"`
+	HTTPSPort int  `yaml:"httpsPort"`
+
+	// Enroll files machines booting without an inventory entry as
+	// pending hosts for an operator to approve; Discovery names a
+	// profile such machines boot meanwhile, e.g. an inspection ramdisk
+	Enroll    bool   `yaml:"enroll"`
+	Discovery string `yaml:"discovery"`
+
+	// ForemanAddr, if set, serves a Foreman smart-proxy API for the
+	// domain there; ForemanTrusted limits who may call it
+	ForemanAddr    string   `yaml:"foremanAddr"`
+	ForemanTrusted []string `yaml:"foremanTrusted"`
+
+	// NetbootXYZ, if set to remote or mirror, boots machines with nothing
+	// else to boot into netboot.xyz (see package netbootxyz);
+	// NetbootXYZAssets caches what its mirrored menus boot
+	NetbootXYZ       string `yaml:"netbootxyz"`
+	NetbootXYZAssets bool   `yaml:"netbootxyzAssets"`
+
+	// BootFileARM64 and BootFileRISCV64 replace BootFile for ARM64
+	// (UEFI and U-Boot) and RISC-V 64 UEFI clients
+	BootFileARM64   string `yaml:"bootFileArm64"`
+	BootFileRISCV64 string `yaml:"bootFileRiscv64"`
+
+	// BootFiles replace BootFile, BootFileARM64 and BootFileRISCV64 for
+	// clients by architecture, as in inventory.Arches
+	BootFiles map[string]string `yaml:"bootFiles"`
+
+	// BootMenu, if set, is offered to BIOS PXE firmware of machines
+	// without a boot file of their own, such as install, rescue and
+	// local boot, after MenuPrompt for MenuTimeout
+	BootMenu    []menuItem    `yaml:"bootMenu"`
+	MenuPrompt  string        `yaml:"menuPrompt"`
+	MenuTimeout time.Duration `yaml:"menuTimeout"`
+
+	// IPXE offers the iPXE builds go-pxe ipxe-build put in the TFTP root,
+	// which chain boot.ipxe without asking DHCP again
+	IPXE bool `yaml:"ipxe"`
+
+	// DHCPWorkers is how many DHCP packets are handled at once
+	// (dhcp.DefaultWorkers if 0)
+	DHCPWorkers int `yaml:"dhcpWorkers"`
+
+	// BootToken, if set, requires clients to present a provisioning token
+	// for their templates over HTTP, valid this long after it was rendered
+	// into their kernel command line or another template
+	BootToken time.Duration `yaml:"bootToken"`
+
+	// DHCPHook, if set, is a template deciding on each DISCOVER and
+	// REQUEST (see dhcp.Hook)
+	DHCPHook string `yaml:"dhcpHook"`
+
+	// StaticARP installs an ARP entry for each address offered, for as
+	// long as its lease, so unicast reaches clients that haven't answered
+	// ARP yet
+	StaticARP bool `yaml:"staticArp"`
+
+	// RawSocket sends DHCP replies as Ethernet frames to the client's
+	// MAC address instead of UDP broadcasts
+	RawSocket bool `yaml:"rawSocket"`
+
+	// Reservations give machines by MAC address a fixed address, and
+	// optionally their boot file and host name, without an inventory
+	// entry
+	Reservations []reservation `yaml:"reservations"`
+
+	// RelayPools serve clients on routed subnets, whose requests a DHCP
+	// relay agent (IP helper) forwards, by the subnet of the relay's
+	// address, each with its own range, router and boot files
+	RelayPools []relayPool `yaml:"relayPools"`
+
+	// AllowMACs, if set, are the MAC addresses and OUIs of the only
+	// clients DHCP answers; those in DenyMACs it never answers
+	AllowMACs []string `yaml:"allowMacs"`
+	DenyMACs  []string `yaml:"denyMacs"`
+
+	// DeclineHold is how long an address a client declined is kept out
+	// of the pool (dhcp.DefaultDeclineHold if 0)
+	DeclineHold time.Duration `yaml:"declineHold"`
+
+	// ConflictProbe, if set, is how long an address is pinged for before
+	// it is first offered; those a host answers for, by ICMP or ARP, are
+	// passed over and quarantined like declined ones
+	ConflictProbe time.Duration `yaml:"conflictProbe"`
+
+	// LeaseTime is how long DHCP leases run (dhcp.DefaultLeaseTime if 0)
+	LeaseTime time.Duration `yaml:"leaseTime"`
+
+	// ProxyDHCP leaves addresses to the network's own DHCP server and
+	// answers PXE clients with their boot options only; dhcpStart and
+	// dhcpEnd are then unused
+	ProxyDHCP bool `yaml:"proxyDhcp"`
+
+	// LeaseFile, if set, keeps the DHCP leases there across restarts;
+	// -lease-dir gives every domain one by default
+	LeaseFile string `yaml:"leaseFile"`
+
+	Defs    string `yaml:"defs"`
+	DefsGit struct {
+		URL    string `yaml:"url"`
+		Branch string `yaml:"branch"`
+		Path   string `yaml:"path"`
+		Dir    string `yaml:"dir"`
+	} `yaml:"defsGit"`
+}
+
+// loadDomains reads a YAML file of the form
+//
+//	domains:
+//	  - name: qa
+//	    iface: en7
+//	    ...
+func loadDomains(file string) ([]domainConfig, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var doc struct {
+		Domains []domainConfig `yaml:"domains"`
+	}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+
+	seen := make(map[string]bool)
+	for i := range doc.Domains {
+		d := &doc.Domains[i]
+		if d.Name == "" || d.Iface == "" || d.IP == "" || d.TFTPRoot == "" || d.HTTPRoot == "" ||
+			!d.ProxyDHCP && (d.DHCPStart == "" || d.DHCPEnd == "") {
+			return nil, fmt.Errorf("%s: domain #%d needs name, iface, ip, dhcpStart and dhcpEnd (unless proxyDhcp), tftpRoot and httpRoot", file, i+1)
+		}
+		if seen[d.Name] {
+			return nil, fmt.Errorf("%s: duplicate domain %q", file, d.Name)
+		}
+		seen[d.Name] = true
+		if d.HTTPPort == 0 {
+			d.HTTPPort = 8080
+		}
+		if d.HTTPSPort == 0 {
+			d.HTTPSPort = 8443
+		}
+		if d.BootFile == "" {
+			d.BootFile = "bootx64.efi"
+		}
+		if d.BootFileARM64 == "" {
+			d.BootFileARM64 = "bootaa64.efi"
+		}
+		if d.BootFileRISCV64 == "" {
+			d.BootFileRISCV64 = "bootriscv64.efi"
+		}
+		if d.DHCPv6 && d.IPv6Prefix == "" {
+			return nil, fmt.Errorf("%s: domain %s: dhcpv6 needs ipv6Prefix", file, d.Name)
+		}
+		if err := d.checkNetOptions(); err != nil {
+			return nil, fmt.Errorf("%s: domain %s: %w", file, d.Name, err)
+		}
+		if _, err := dhcpPools(d.RelayPools); err != nil {
+			return nil, fmt.Errorf("%s: domain %s: %w", file, d.Name, err)
+		}
+		if err := d.checkMACFilters(); err != nil {
+			return nil, fmt.Errorf("%s: domain %s: %w", file, d.Name, err)
+		}
+		if err := checkReservations(d.Reservations); err != nil {
+			return nil, fmt.Errorf("%s: domain %s: %w", file, d.Name, err)
+		}
+		if err := d.checkBootMenu(); err != nil {
+			return nil, fmt.Errorf("%s: domain %s: bootMenu: %w", file, d.Name, err)
+		}
+		if err := checkBootFiles(d.BootFiles); err != nil {
+			return nil, fmt.Errorf("%s: domain %s: bootFiles: %w", file, d.Name, err)
+		}
+		if d.DefsGit.Branch == "" {
+			d.DefsGit.Branch = "main"
+		}
+		if d.DefsGit.Path == "" {
+			d.DefsGit.Path = "."
+		}
+		if d.DefsGit.Dir == "" {
+			d.DefsGit.Dir = "./defs-git-" + d.Name
+		}
+	}
+	if len(doc.Domains) == 0 {
+		return nil, fmt.Errorf("%s: no domains defined", file)
+	}
+	return doc.Domains, nil
+}
+
+// netIface is the interface the domain serves on: Iface, or its VLAN
+// sub-interface
+func (c domainConfig) netIface() string {
+	if c.VLAN == 0 {
+		return c.Iface
+	}
+	return netsetup.VLANName(c.Iface, c.VLAN)
+}
+
+// httpURL is the base URL of the domain's HTTP server, as clients reach it
+func (c domainConfig) httpURL() string {
+	return "http://" + net.JoinHostPort(c.IP, fmt.Sprint(c.HTTPPort))
+}
+
+// domain is a running provisioning domain
+type domain struct {
+	cfg        domainConfig
+	bus        *events.Bus
+	store      *inventory.Store
+	dhcp       *dhcp.Server
+	dhcpv6     *dhcpv6.Server // if enabled
+	audit      *audit.Log
+	vault      *vault.Client  // resolves secrets in templates, if configured
+	oci        *oci.Client    // pulls profile artifacts
+	ca         *pki.CA        // issues host certificates, if configured
+	hostKeys   *sshkeys.Store // SSH host keys for templates, if configured
+	sessions   *sessions.Tracker
+	logs       *syslog.Store
+	consoles   *console.Store
+	inspected  *inspect.Store
+	hardware   *hardware.Store
+	attested   *attest.Store
+	certs      *pki.Store
+	pending    *enroll.Store
+	clusters   *cluster.Store
+	transfers  *transfers.Table
+	index      *assets.Index       // what the roots hold
+	multicast  *mcast.Server       // multicast image sender, if configured
+	netbootxyz *netbootxyz.Service // netboot.xyz for machines without a profile, if configured
+	tokens     *tokens.Issuer      // provisioning tokens, if required
+	hook       *dhcp.Hook          // DHCP policy hook, if configured
+	qos        *qos.Shaper         // per-client limits shared by all domains, if set
+	files      *memory.Files       // TFTP file cache shared by all domains
+	recorder   *recording.Recorder // machines being recorded for debugging
+	arp        *netsetup.Neighbors // static ARP entries for offered addresses, if enabled
+	secureBoot map[string]bool     // architectures with a Secure Boot chain
+	apiPort    int                 // management API port reachable on the domain address, 0 if none
+	gcMu       sync.Mutex          // serializes collections of the roots
+}
+
+// newDomain prepares a domain whose events are tagged with its name and
+// forwarded to global
+func newDomain(cfg domainConfig, global *events.Bus) *domain {
+	d := &domain{
+		cfg:       cfg,
+		bus:       events.NewBus(),
+		store:     inventory.NewStore(),
+		logs:      syslog.NewStore(logsPerClient),
+		consoles:  console.NewStore(consolePerClient),
+		inspected: inspect.NewStore(),
+		hardware:  hardware.NewStore(),
+		attested:  attest.NewStore(),
+		certs:     pki.NewStore(),
+		pending:   enroll.NewStore(),
+		clusters:  cluster.NewStore(),
+		transfers: transfers.NewTable(),
+		index:     assets.NewIndex(cfg.TFTPRoot, cfg.HTTPRoot),
+		recorder:  recording.NewRecorder(),
+	}
+	if cfg.BootToken > 0 {
+		d.tokens = tokens.NewIssuer(cfg.BootToken)
+	}
+	d.bus.Annotate = func(e *events.Event) {
+		e.Domain = cfg.Name
+		e.Revision = d.store.Revision()
+	}
+	d.bus.Forward(global)
+	d.index.Follow(d.bus)
+	d.recorder.Addresses, d.recorder.Extra = d.recordingAddrs, d.recordingExtra
+	d.recorder.Follow(d.bus)
+
+	var observe func(dhcp.Client)
+	if cfg.Enroll {
+		observe = d.observe
+	}
+	var probe func(net.IP) bool
+	if cfg.ConflictProbe > 0 {
+		probe = d.probe
+	}
+	var decide func(dhcp.Request) (dhcp.Decision, error)
+	if cfg.DHCPHook != "" {
+		d.hook = dhcp.NewHook(cfg.DHCPHook)
+		decide = d.dhcpDecide
+	}
+
+	d.dhcp = dhcp.NewServer(dhcp.Config{
+		Interface:     cfg.netIface(),
+		ServerIP:      net.ParseIP(cfg.IP),
+		RangeStart:    net.ParseIP(cfg.DHCPStart),
+		RangeEnd:      net.ParseIP(cfg.DHCPEnd),
+		SubnetMask:    net.IPv4Mask(255, 255, 255, 0),
+		BootFile:      cfg.BootFile,
+		BootFiles:     cfg.bootFiles(),
+		TFTPServer:    cfg.IP,
+		Router:        cfg.gateway(),
+		DNSServers:    cfg.dnsServers(),
+		DomainName:    cfg.domainName(),
+		NTPServers:    cfg.ntpServers(),
+		Events:        d.bus,
+		Domain:        cfg.Name,
+		BootFileFor:   d.bootFileFor,
+		LocalBoot:     d.localBoot,
+		LocalBootFile: cfg.LocalBoot,
+		RaspberryPi:   d.raspberryPi,
+		IPXEBootFile:  cfg.httpURL() + "/boot.ipxe",
+		HTTPBootURL:   cfg.httpURL(),
+		AddressFor:    d.store.AddressFor,
+		Reserved:      d.store.Reserved,
+		Reservations:  cfg.reservations(),
+		RelayPools:    cfg.relayPools(),
+		AllowMACs:     macList(cfg.AllowMACs),
+		DenyMACs:      macList(cfg.DenyMACs),
+		BootMenu:      cfg.bootMenu(),
+		MenuPrompt:    cfg.MenuPrompt,
+		MenuTimeout:   cfg.MenuTimeout,
+		Observe:       observe,
+		Workers:       cfg.DHCPWorkers,
+		Decide:        decide,
+		Capture:       d.recorder.Packet,
+		Offered:       d.offered,
+		Dropped:       d.dropped,
+		DeclineHold:   cfg.DeclineHold,
+		Probe:         probe,
+		LeaseTime:     cfg.LeaseTime,
+		RawSocket:     cfg.RawSocket,
+		Proxy:         cfg.ProxyDHCP,
+		LeaseFile:     cfg.LeaseFile,
+	})
+	return d
+}
+
+func (d *domain) printConfig() {
+	fmt.Printf("--- Domain %s ---\n", d.cfg.Name)
+	if d.cfg.VLAN != 0 {
+		fmt.Printf("Interface:  %s (VLAN %d on %s)\n", d.cfg.netIface(), d.cfg.VLAN, d.cfg.Iface)
+	} else {
+		fmt.Printf("Interface:  %s\n", d.cfg.Iface)
+	}
+	fmt.Printf("Server IP:  %s\n", d.cfg.IP)
+	if d.cfg.ProxyDHCP {
+		fmt.Printf("DHCP Range: none, proxyDHCP (addresses from the network's DHCP server)\n")
+	} else {
+		fmt.Printf("DHCP Range: %s - %s\n", d.cfg.DHCPStart, d.cfg.DHCPEnd)
+	}
+	if d.cfg.LeaseTime != 0 && d.cfg.LeaseTime != dhcp.DefaultLeaseTime {
+		fmt.Printf("Lease Time: %s\n", d.cfg.LeaseTime)
+	}
+	if d.cfg.ConflictProbe > 0 {
+		fmt.Printf("Probe:      %s, ICMP and ARP before offering\n", d.cfg.ConflictProbe)
+	}
+	if d.cfg.LeaseFile != "" {
+		fmt.Printf("Lease File: %s\n", d.cfg.LeaseFile)
+	}
+	if d.cfg.Gateway != "" {
+		fmt.Printf("Gateway:    %s\n", d.cfg.Gateway)
+	}
+	if len(d.cfg.DNSServers) > 0 {
+		fmt.Printf("DNS:        %s\n", strings.Join(d.cfg.DNSServers, ", "))
+	}
+	if len(d.cfg.NTPServers) > 0 {
+		fmt.Printf("NTP:        %s\n", strings.Join(d.cfg.NTPServers, ", "))
+	}
+	if n := len(d.cfg.RelayPools); n > 0 {
+		fmt.Printf("Relayed:    %d pools for subnets behind relay agents or on other interfaces\n", n)
+		for _, p := range d.cfg.RelayPools {
+			if p.Interface != "" {
+				fmt.Printf("            %s on %s: %s - %s\n", p.Subnet, p.Interface, p.Start, p.End)
+			} else {
+				fmt.Printf("            %s: %s - %s\n", p.Subnet, p.Start, p.End)
+			}
+		}
+	}
+	if n := len(d.cfg.AllowMACs); n > 0 {
+		fmt.Printf("Allowed:    %d MAC addresses and OUIs only\n", n)
+	}
+	if n := len(d.cfg.DenyMACs); n > 0 {
+		fmt.Printf("Denied:     %d MAC addresses and OUIs\n", n)
+	}
+	if n := len(d.cfg.Reservations); n > 0 {
+		fmt.Printf("Reserved:   %d addresses\n", n)
+	}
+	if n := len(d.cfg.BootMenu); n > 0 {
+		fmt.Printf("Boot Menu:  %d items for BIOS PXE firmware\n", n)
+	}
+	fmt.Printf("TFTP Root:  %s\n", d.cfg.TFTPRoot)
+	fmt.Printf("HTTP Root:  %s\n", d.cfg.HTTPRoot)
+	files := d.cfg.bootFiles()
+	var arches []string
+	for _, arch := range slices.Sorted(maps.Keys(files)) {
+		arches = append(arches, arch+" "+files[arch])
+	}
+	fmt.Printf("Boot File:  %s (%s)\n", d.cfg.BootFile, strings.Join(arches, ", "))
+	if d.cfg.Discovery != "" {
+		fmt.Printf("Discovery:  profile %s for unknown hosts\n", d.cfg.Discovery)
+	}
+	if d.cfg.DHCPHook != "" {
+		fmt.Printf("DHCP Hook:  %s\n", d.cfg.DHCPHook)
+	}
+	fmt.Println()
+}
+
+// start brings up the domain's definitions source, NAT, its DHCP, TFTP and
+// HTTP servers, and whichever optional services its config enables. With
+// bindIP the TFTP and HTTP servers listen on the domain's address only, so
+// several domains can share the well-known ports. undo receives teardown
+// steps for any host configuration made.
+func (d *domain) start(bindIP bool, undo *[]func()) error {
+	cfg := d.cfg
+
+	if cfg.VLAN != 0 {
+		if err := d.setupVLAN(undo); err != nil {
+			return err
+		}
+	}
+
+	ifi, err := net.InterfaceByName(cfg.netIface())
+	if err != nil {
+		return fmt.Errorf("Interface %s not found: %v", cfg.netIface(), err)
+	}
+	fmt.Printf("Interface %s MAC: %s\n", ifi.Name, ifi.HardwareAddr)
+
+	if cfg.NAT != "" {
+		subnet := &net.IPNet{IP: net.ParseIP(cfg.IP).Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}
+		restore, err := netsetup.EnableNAT(subnet, cfg.NAT)
+		if err != nil {
+			return fmt.Errorf("NAT: %w", err)
+		}
+		*undo = append(*undo, func() {
+			if err := restore(); err != nil {
+				log.Printf("[NAT] Teardown: %v", err)
+			}
+		})
+	}
+
+	if cfg.StaticARP {
+		d.arp = netsetup.NewNeighbors(cfg.netIface(), cmp.Or(cfg.LeaseTime, dhcp.DefaultLeaseTime))
+		*undo = append(*undo, d.arp.Close)
+	}
+
+	// Create directories if needed
+	os.MkdirAll(cfg.TFTPRoot, 0755)
+	os.MkdirAll(cfg.HTTPRoot, 0755)
+
+	// Load host and profile definitions
+	switch {
+	case cfg.DefsGit.URL != "":
+		g := cfg.DefsGit
+		src := inventory.NewGitSource(g.URL, g.Branch, g.Path, g.Dir, d.store)
+		src.Reconciler.Audit, src.Reconciler.Domain = d.audit, cfg.Name
+		if err := src.Sync(); err != nil {
+			log.Printf("[GIT] Initial sync failed: %v", err)
+		}
+		go src.Run()
+	case cfg.Defs != "":
+		rec := inventory.NewReconciler(cfg.Defs, d.store)
+		rec.Audit, rec.Domain = d.audit, cfg.Name
+		rec.Sync()
+		go rec.Run()
+	}
+
+	// Publish profile artifacts into the roots
+	pub := oci.NewPublisher(d.oci, d.store, cfg.TFTPRoot, cfg.HTTPRoot)
+	pub.Domain = cfg.Name
+	pub.Sync()
+	go pub.Run()
+
+	if cfg.NetbootXYZ != "" {
+		nx, err := netbootxyz.New(cfg.NetbootXYZ, cfg.NetbootXYZAssets, cfg.TFTPRoot, cfg.HTTPRoot, cfg.httpURL())
+		if err != nil {
+			return err
+		}
+		nx.Domain = cfg.Name
+		d.netbootxyz = nx
+		go nx.Sync(context.Background())
+	}
+
+	// Start DHCP server
+	go func() {
+		if err := d.dhcp.ListenAndServe(); err != nil {
+			log.Fatalf("DHCP server error (%s): %v", cfg.Name, err)
+		}
+	}()
+
+	// Start DNS server. It always binds the domain address so it doesn't
+	// collide with a local stub resolver on :53.
+	if cfg.DNSDomain != "" || len(cfg.DNSUpstreams) > 0 {
+		dnsSrv := dns.NewServer(cfg.DNSDomain, domainRecords{d})
+		if len(cfg.DNSUpstreams) > 0 {
+			dnsSrv.Forwarder = dns.NewForwarder(cfg.DNSUpstreams)
+		}
+		dnsSrv.BlockExternal = cfg.DNSBlockExternal
+		go func() {
+			if err := dnsSrv.ListenAndServe(net.JoinHostPort(cfg.IP, "53")); err != nil {
+				log.Fatalf("DNS server error (%s): %v", cfg.Name, err)
+			}
+		}()
+	}
+
+	// Start NTP server
+	if cfg.NTP {
+		ntpSrv := ntp.NewServer()
+		go func() {
+			if err := ntpSrv.ListenAndServe(net.JoinHostPort(cfg.IP, "123")); err != nil {
+				log.Fatalf("NTP server error (%s): %v", cfg.Name, err)
+			}
+		}()
+	}
+
+	// Start IPv6 router advertisements
+	if cfg.IPv6Prefix != "" {
+		_, prefix, err := net.ParseCIDR(cfg.IPv6Prefix)
+		if err != nil {
+			return fmt.Errorf("ipv6Prefix: %w", err)
+		}
+		raSrv := ra.NewServer(cfg.netIface(), prefix)
+		raSrv.Managed, raSrv.Other = cfg.IPv6Managed || cfg.DHCPv6, cfg.IPv6Other
+		for _, v := range cfg.IPv6DNS {
+			ip := net.ParseIP(v)
+			if ip == nil || ip.To4() != nil {
+				return fmt.Errorf("ipv6DNS: %q is not an IPv6 address", v)
+			}
+			raSrv.DNS = append(raSrv.DNS, ip)
+		}
+		go func() {
+			if err := raSrv.ListenAndServe(); err != nil {
+				log.Fatalf("RA server error (%s): %v", cfg.Name, err)
+			}
+		}()
+
+		// Start DHCPv6 server, booting clients from the domain's address
+		// in the prefix
+		if cfg.DHCPv6 {
+			addr, err := addrIn(ifi, prefix)
+			if err != nil {
+				return fmt.Errorf("dhcpv6: %w", err)
+			}
+			v6 := dhcpv6.NewServer(cfg.netIface(), prefix, addr)
+			v6.DNS, v6.Events, v6.BootURL = raSrv.DNS, d.bus, d.bootURL(addr)
+			d.dhcpv6 = v6
+			go func() {
+				if err := v6.ListenAndServe(); err != nil {
+					log.Fatalf("DHCPv6 server error (%s): %v", cfg.Name, err)
+				}
+			}()
+		}
+	} else if cfg.DHCPv6 {
+		return fmt.Errorf("dhcpv6 needs ipv6Prefix")
+	}
+
+	// Start NBD server
+	if cfg.NBDRoot != "" {
+		nbdSrv := nbd.NewServer(cfg.NBDRoot)
+		nbdSrv.ExportFor = func(ip net.IP) string {
+			if h, ok := d.hostByIP(ip); ok {
+				return h.NBD
+			}
+			return ""
+		}
+		nbdSrv.Overlays, nbdSrv.ClientID = cfg.OverlayDir, d.clientID
+		go func() {
+			if err := nbdSrv.ListenAndServe(net.JoinHostPort(cfg.IP, "10809")); err != nil {
+				log.Fatalf("NBD server error (%s): %v", cfg.Name, err)
+			}
+		}()
+	}
+
+	// Start iSCSI target
+	if cfg.ISCSIRoot != "" {
+		iscsiSrv := iscsi.NewServer(cfg.ISCSIRoot)
+		iscsiSrv.Writable = cfg.ISCSIWritable
+		go func() {
+			if err := iscsiSrv.ListenAndServe(net.JoinHostPort(cfg.IP, "3260")); err != nil {
+				log.Fatalf("iSCSI server error (%s): %v", cfg.Name, err)
+			}
+		}()
+	}
+
+	// Start NFS server
+	if cfg.NFSRoot != "" {
+		nfsSrv := nfs.NewServer(cfg.NFSRoot)
+		nfsSrv.Overlays, nfsSrv.ClientID = cfg.OverlayDir, d.clientID
+		go func() {
+			if err := nfsSrv.ListenAndServe(net.JoinHostPort(cfg.IP, "2049")); err != nil {
+				log.Fatalf("NFS server error (%s): %v", cfg.Name, err)
+			}
+		}()
+	}
+
+	// Start syslog receiver
+	if cfg.Syslog {
+		syslogSrv := syslog.NewServer(d.logs)
+		syslogSrv.ClientID = d.clientID
+		go func() {
+			if err := syslogSrv.ListenAndServe(net.JoinHostPort(cfg.IP, "514")); err != nil {
+				log.Fatalf("syslog server error (%s): %v", cfg.Name, err)
+			}
+		}()
+	}
+
+	// Start serial console receiver
+	if cfg.Console {
+		consoleSrv := console.NewServer(d.consoles)
+		consoleSrv.Domain, consoleSrv.ClientID = cfg.Name, d.clientID
+		go func() {
+			if err := consoleSrv.ListenAndServe(net.JoinHostPort(cfg.IP, "5515")); err != nil {
+				log.Fatalf("Console server error (%s): %v", cfg.Name, err)
+			}
+		}()
+	}
+
+	// Start netconsole receiver
+	if cfg.Netconsole {
+		netconsole := console.NewNetconsole(d.consoles)
+		netconsole.Domain, netconsole.ClientID = cfg.Name, d.clientID
+		netconsole.Attach = func(ip net.IP, line string) { d.sessions.Console(cfg.Name, ip, line) }
+		go func() {
+			if err := netconsole.ListenAndServe(net.JoinHostPort(cfg.IP, "6666")); err != nil {
+				log.Fatalf("Netconsole error (%s): %v", cfg.Name, err)
+			}
+		}()
+	}
+
+	// Start multicast image sender
+	if cfg.MulticastRoot != "" {
+		d.multicast = mcast.NewServer(cfg.MulticastRoot, net.ParseIP(cfg.IP))
+		d.multicast.Events, d.multicast.Domain, d.multicast.ClientID = d.bus, cfg.Name, d.clientID
+		go func() {
+			if err := d.multicast.ListenAndServe(net.JoinHostPort(cfg.IP, "9000")); err != nil {
+				log.Fatalf("Multicast server error (%s): %v", cfg.Name, err)
+			}
+		}()
+	}
+
+	// Start introspection callback receiver
+	if cfg.Inspector {
+		inspectSrv := inspect.NewServer(d.inspected)
+		inspectSrv.Domain = cfg.Name
+		inspectSrv.HostName = func(mac net.HardwareAddr) string {
+			h, _ := d.store.HostByMAC(mac)
+			return h.Name
+		}
+		go func() {
+			if err := inspectSrv.ListenAndServe(net.JoinHostPort(cfg.IP, "5050")); err != nil {
+				log.Fatalf("Inspector error (%s): %v", cfg.Name, err)
+			}
+		}()
+	}
+
+	host := ""
+	if bindIP {
+		host = cfg.IP
+	}
+
+	// Start TFTP server
+	if cfg.SecureBoot != "" {
+		if err := d.checkSecureBoot(); err != nil {
+			return err
+		}
+	}
+	tftpSrv := tftp.NewServer(cfg.TFTPRoot)
+	tftpSrv.Events, tftpSrv.Domain, tftpSrv.Transfers = d.bus, cfg.Name, d.transfers
+	tftpSrv.Render, tftpSrv.Generate = d.recordRender, d.recordGenerate
+	tftpSrv.QoS, tftpSrv.Capture = d.qos, d.recorder.Packet
+	tftpSrv.Files = d.files
+	tftpSrv.TemplatesNeedToken = d.tokens != nil
+	go func() {
+		if err := tftpSrv.ListenAndServe(net.JoinHostPort(host, "69")); err != nil {
+			log.Fatalf("TFTP server error (%s): %v", cfg.Name, err)
+		}
+	}()
+	// Bound to the IPv4 address, DHCPv6 clients need their own listeners
+	host6 := ""
+	if bindIP && d.dhcpv6 != nil {
+		host6 = d.dhcpv6.Addr.String()
+		go func() {
+			if err := tftpSrv.ListenAndServe(net.JoinHostPort(host6, "69")); err != nil {
+				log.Fatalf("TFTP server error (%s): %v", cfg.Name, err)
+			}
+		}()
+	}
+
+	// Start HTTP server
+	httpSrv := httpserver.NewServer(cfg.HTTPRoot)
+	httpSrv.Events, httpSrv.Transfers = d.bus, d.transfers
+	httpSrv.Render, httpSrv.Generate = d.recordRender, d.recordGenerate
+	httpSrv.QoS, httpSrv.Domain = d.qos, cfg.Name
+	if d.tokens != nil {
+		httpSrv.Token = d.checkToken
+	}
+	if cfg.Hardware {
+		hw := hardware.NewHandler(d.hardware)
+		hw.Domain, hw.ClientID = cfg.Name, d.clientID
+		httpSrv.Handle("POST /hardware/{kind}", hw)
+	}
+	if cfg.Attest {
+		att := attest.NewHandler(d.attested)
+		att.Domain, att.ClientID, att.Policy, att.Result = cfg.Name, d.clientID, d.pcrPolicy, d.attestResult
+		httpSrv.Handle("GET /attest/nonce", att)
+		httpSrv.Handle("POST /attest", att)
+	}
+	httpSrv.Handle("POST /health", http.HandlerFunc(d.reportHealth))
+	httpSrv.Handle("POST /installed", http.HandlerFunc(d.reportInstalled))
+	httpSrv.Handle("POST /firmware", http.HandlerFunc(d.reportFirmware))
+	httpSrv.Handle("GET /media/{profile}/{path...}", http.HandlerFunc(d.serveMedia))
+	if d.netbootxyz != nil {
+		httpSrv.Handle("GET /"+netbootxyz.Dir+"/assets/{path...}", d.netbootxyz)
+	}
+	k8s := cluster.NewHandler(d.clusters)
+	k8s.Domain, k8s.Host = cfg.Name, d.hostName
+	k8s.Server = cfg.httpURL()
+	httpSrv.Handle("/cluster/{file}", k8s)
+	if cfg.PKI {
+		if d.ca == nil {
+			return fmt.Errorf("pki needs a CA (-ca-dir)")
+		}
+		certs := pki.NewHandler(d.ca, d.certs)
+		certs.Domain = cfg.Name
+		certs.HostName = func(ip net.IP) string {
+			h, _ := d.hostByIP(ip)
+			return h.Name
+		}
+		httpSrv.Handle("GET /pki/{file}", certs)
+	}
+	go func() {
+		addr := net.JoinHostPort(host, fmt.Sprint(cfg.HTTPPort))
+		if err := httpSrv.ListenAndServe(addr); err != nil {
+			log.Fatalf("HTTP server error (%s): %v", cfg.Name, err)
+		}
+	}()
+	if host6 != "" {
+		go func() {
+			addr := net.JoinHostPort(host6, fmt.Sprint(cfg.HTTPPort))
+			if err := httpSrv.ListenAndServe(addr); err != nil {
+				log.Fatalf("HTTP server error (%s): %v", cfg.Name, err)
+			}
+		}()
+	}
+
+	// Start HTTPS server for hosts holding a certificate
+	if cfg.PKI {
+		tlsCfg, err := d.ca.ServerConfig(net.ParseIP(cfg.IP), d.certs)
+		if err != nil {
+			return fmt.Errorf("pki: %w", err)
+		}
+		go func() {
+			addr := net.JoinHostPort(host, fmt.Sprint(cfg.HTTPSPort))
+			if err := httpSrv.ListenAndServeTLS(addr, tlsCfg); err != nil {
+				log.Fatalf("HTTPS server error (%s): %v", cfg.Name, err)
+			}
+		}()
+	}
+
+	if cfg.MDNS {
+		d.advertise(undo)
+	}
+
+	// Start Foreman smart proxy
+	if cfg.ForemanAddr != "" {
+		proxy := foreman.NewServer(d.store, cfg.TFTPRoot)
+		trusted, err := foreman.ParseTrusted(cfg.ForemanTrusted)
+		if err != nil {
+			return fmt.Errorf("foremanTrusted: %w", err)
+		}
+		proxy.Trusted, proxy.Audit, proxy.Domain = trusted, d.audit, cfg.Name
+		proxy.ServerIP = net.ParseIP(cfg.IP)
+		proxy.Subnet = &net.IPNet{IP: proxy.ServerIP.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}
+		proxy.RangeStart, proxy.RangeEnd = net.ParseIP(cfg.DHCPStart), net.ParseIP(cfg.DHCPEnd)
+		proxy.Leases = d.dhcp.Leases
+		go func() {
+			if err := proxy.ListenAndServe(cfg.ForemanAddr); err != nil {
+				log.Fatalf("Foreman proxy error (%s): %v", cfg.Name, err)
+			}
+		}()
+	}
+
+	// Roots holding full mirrors take a while to walk and hash
+	d.index.Start()
+	return nil
+}
+
+// advertise publishes the domain's HTTP root and, when reachable from its
+// network, the management API over mDNS/DNS-SD
+func (d *domain) advertise(undo *[]func()) {
+	cfg := d.cfg
+	hostname, _ := os.Hostname()
+	hostname, _, _ = strings.Cut(hostname, ".")
+	instance := fmt.Sprintf("go-pxe %s on %s", cfg.Name, hostname)
+	txt := []string{"domain=" + cfg.Name}
+
+	r := mdns.NewResponder(cfg.netIface(), hostLabel(hostname+"-"+cfg.Name), net.ParseIP(cfg.IP))
+	r.Services = append(r.Services, mdns.Service{Instance: instance, Type: "_http._tcp", Port: cfg.HTTPPort, TXT: append(txt, "path=/")})
+	if d.apiPort != 0 {
+		r.Services = append(r.Services, mdns.Service{Instance: instance, Type: mdnsAPIService, Port: d.apiPort, TXT: append(txt, "path=/api/v1")})
+	}
+	go func() {
+		if err := r.ListenAndServe(); err != nil {
+			log.Fatalf("mDNS responder error (%s): %v", cfg.Name, err)
+		}
+	}()
+	*undo = append(*undo, r.Close)
+}
+
+// hostLabel turns s into a valid host name label
+func hostLabel(s string) string {
+	b := []byte(strings.ToLower(s))
+	for i, c := range b {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') {
+			b[i] = '-'
+		}
+	}
+	return strings.Trim(string(b), "-")
+}
+
+// setupVLAN checks the domain's VLAN sub-interface exists, creating it and
+// assigning the server address if the domain asks for that
+func (d *domain) setupVLAN(undo *[]func()) error {
+	cfg := d.cfg
+	if cfg.VLAN < 1 || cfg.VLAN > 4094 {
+		return fmt.Errorf("VLAN %d out of range 1-4094", cfg.VLAN)
+	}
+	name := cfg.netIface()
+	if _, err := net.InterfaceByName(name); err == nil {
+		return nil
+	}
+	if !cfg.VLANCreate {
+		return fmt.Errorf("VLAN interface %s does not exist (set vlanCreate or -vlan-create to create it)", name)
+	}
+	remove, err := netsetup.AddVLAN(cfg.Iface, cfg.VLAN)
+	if err != nil {
+		return fmt.Errorf("VLAN: %w", err)
+	}
+	*undo = append(*undo, func() {
+		if err := remove(); err != nil {
+			log.Printf("[NET] Teardown: %v", err)
+		}
+	})
+	addr := &net.IPNet{IP: net.ParseIP(cfg.IP).To4(), Mask: net.CIDRMask(24, 32)}
+	if err := netsetup.AddAddress(name, addr); err != nil {
+		return fmt.Errorf("VLAN: %w", err)
+	}
+	return nil
+}
+
+// leases is the DHCP lease table, with the DHCPv6 leases whose client's
+// MAC address is known
+func (d *domain) leases() []dhcp.Lease {
+	list := d.dhcp.Leases()
+	if d.dhcpv6 == nil {
+		return list
+	}
+	for _, l := range d.dhcpv6.Leases() {
+		if l.MAC != "" {
+			list = append(list, dhcp.Lease{MAC: l.MAC, IP: l.IP, Arch: l.Arch, Seen: l.Seen})
+		}
+	}
+	return list
+}
+
+// hostByIP returns the inventory host currently leased ip
+func (d *domain) hostByIP(ip net.IP) (inventory.Host, bool) {
+	for _, l := range d.leases() {
+		if ip.Equal(net.ParseIP(l.IP)) {
+			mac, _ := net.ParseMAC(l.MAC)
+			return d.store.HostByMAC(mac)
+		}
+	}
+	return inventory.Host{}, false
+}
+
+// hostName names the inventory host currently leased ip
+func (d *domain) hostName(ip net.IP) (string, bool) {
+	h, ok := d.hostByIP(ip)
+	return h.Name, ok
+}
+
+// render fills in an HTTP or TFTP root template for the client at ip
+func (d *domain) render(name string, text []byte, ip net.IP) ([]byte, error) {
+	vars := d.templateVars(ip)
+	return render.Execute(name, text, vars, template.FuncMap{
+		"vault":         d.vaultSecret,
+		"sshHostKey":    func(typ string) (string, error) { return d.sshHostKey(vars.Hostname, typ, true) },
+		"sshHostKeyPub": func(typ string) (string, error) { return d.sshHostKey(vars.Hostname, typ, false) },
+	})
+}
+
+// templateVars describes the client at ip to templates
+func (d *domain) templateVars(ip net.IP) render.Vars {
+	v := render.Vars{IP: ip.String(), ServerIP: d.cfg.IP, Domain: d.cfg.Name}
+	for _, l := range d.dhcp.Leases() {
+		if !ip.Equal(net.ParseIP(l.IP)) {
+			continue
+		}
+		v.MAC, v.UUID, v.Arch = l.MAC, l.UUID, l.Arch
+		mac, _ := net.ParseMAC(l.MAC)
+		h, p, _ := d.store.ProfileFor(mac)
+		v.Hostname, v.Profile, v.Labels = h.Name, cmp.Or(p.Name, h.Profile), h.Labels
+		if h.Name == "" {
+			v.Profile = d.cfg.Discovery
+			p, _ = d.store.Profile(d.cfg.Discovery)
+		}
+		p = p.ForArch(l.Arch).Booted(d.cfg.httpURL())
+		v.Kernel, v.Initrd, v.Cmdline = p.Kernel, p.Initrd, p.Cmdline
+		v.BootFile = cmp.Or(h.BootFile, p.Loader())
+		break
+	}
+	// Only clients holding a lease get tokens, so asking for a boot menu
+	// from an address go-pxe never gave out yields none
+	if _, known := d.hostByIP(ip); d.tokens != nil && (v.MAC != "" || known) {
+		v.Token = d.tokens.Issue(d.clientID(ip), time.Now())
+	}
+	// Reports are filed under the same client ID
+	if r, ok := d.hardware.Get(d.clientID(ip)); ok {
+		v.Serial, v.UUID = r.Summary.Serial, cmp.Or(v.UUID, r.Summary.UUID)
+	} else if r, ok := d.inspected.Get(d.clientID(ip)); ok {
+		v.Serial = r.Summary.Serial
+	}
+	return v
+}
+
+// checkToken checks the provisioning token the client at ip presents for
+// its templates
+func (d *domain) checkToken(token string, ip net.IP) error {
+	return d.tokens.Verify(token, d.clientID(ip), time.Now())
+}
+
+// vaultSecret backs the templates' vault function:
+//
+//	rootpw --iscrypted {{ vault "secret/data/pxe/root" "hash" }}
+func (d *domain) vaultSecret(path, key string) (string, error) {
+	if d.vault == nil {
+		return "", fmt.Errorf("vault %s: no Vault configured (-vault-addr)", path)
+	}
+	return d.vault.Secret(path, key)
+}
+
+// sshHostKey backs the templates' sshHostKey and sshHostKeyPub functions,
+// returning the requesting host's private or public key of type typ:
+//
+//	cat > /etc/ssh/ssh_host_ed25519_key <<'EOF'
+//	{{ sshHostKey "ed25519" }}EOF
+func (d *domain) sshHostKey(host, typ string, private bool) (string, error) {
+	if d.hostKeys == nil {
+		return "", fmt.Errorf("sshHostKey: no SSH key directory configured (-ssh-key-dir)")
+	}
+	if host == "" {
+		return "", fmt.Errorf("sshHostKey: client is not an inventory host")
+	}
+	k, err := d.hostKeys.Key(host, typ)
+	if err != nil {
+		return "", err
+	}
+	if private {
+		return k.Private(), nil
+	}
+	return k.Public, nil
+}
+
+// bootFile is the boot file DHCP offers the client with mac and arch: its
+// host's or profile's, the discovery profile's if it is unknown, else ""
+// for the domain default
+func (d *domain) bootFile(mac net.HardwareAddr, arch string) string {
+	if _, ok := d.store.HostByMAC(mac); ok || d.cfg.Discovery == "" {
+		return d.store.BootFile(mac, arch)
+	}
+	p, _ := d.store.Profile(d.cfg.Discovery)
+	return p.ForArch(arch).Loader()
+}
+
+// bootFileFor backs dhcp.Config.BootFileFor: the client's own boot file,
+// else the default for its architecture
+func (d *domain) bootFileFor(mac net.HardwareAddr, arch string) (string, bool) {
+	if f := d.bootFile(mac, arch); f != "" {
+		return f, true
+	}
+	if code, ok := dhcp.ArchCode(arch); ok {
+		return d.archBootFile(mac, code), false
+	}
+	return "", false
+}
+
+// bootURL returns the boot file URL DHCPv6 offers clients, on the server
+// at addr: the boot file DHCP would offer, over HTTP to UEFI HTTP boot
+// clients and TFTP to the others
+func (d *domain) bootURL(addr net.IP) func(mac net.HardwareAddr, arch uint16) string {
+	return func(mac net.HardwareAddr, arch uint16) string {
+		name := dhcp.ArchName(arch)
+		f := d.defaultBootFile(name)
+		if mac != nil {
+			f, _ = d.bootFileFor(mac, name)
+			if d.localBoot(mac) {
+				f = d.cfg.LocalBoot
+			}
+		}
+		switch {
+		case f == "" || strings.Contains(f, "://"):
+			return f
+		case strings.HasSuffix(name, "-http"):
+			return "http://" + net.JoinHostPort(addr.String(), fmt.Sprint(d.cfg.HTTPPort)) + "/" + f
+		}
+		return "tftp://[" + addr.String() + "]/" + f
+	}
+}
+
+// addrIn is ifi's global address in prefix
+func addrIn(ifi *net.Interface, prefix *net.IPNet) (net.IP, error) {
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range addrs {
+		if ipn, ok := a.(*net.IPNet); ok && prefix.Contains(ipn.IP) {
+			return ipn.IP, nil
+		}
+	}
+	return nil, fmt.Errorf("%s has no address in %s", ifi.Name, prefix)
+}
+
+// offered installs a static ARP entry for an address offered to mac, if
+// the domain keeps them
+func (d *domain) offered(ip net.IP, mac net.HardwareAddr) {
+	d.arp.Set(ip, mac)
+}
+
+// probe reports whether another machine answers for ip, which DHCP is
+// about to offer; an address that can't be probed is taken as free
+func (d *domain) probe(ip net.IP) bool {
+	inUse, err := netsetup.InUse(d.cfg.netIface(), ip, d.cfg.ConflictProbe)
+	if err != nil {
+		log.Printf("[DHCP] Conflict probe of %s: %v", ip, err)
+	}
+	return inUse
+}
+
+// dropped removes the static ARP entry for a lease its client gave up
+func (d *domain) dropped(ip net.IP, mac net.HardwareAddr) {
+	d.arp.Remove(ip)
+}
+
+// revoke drops mac's lease, and its static ARP entry
+func (d *domain) revoke(mac net.HardwareAddr) bool {
+	ip, ok := d.dhcp.LeaseFor(mac)
+	if !d.dhcp.Revoke(mac) {
+		return false
+	}
+	if ok {
+		d.arp.Remove(ip)
+	}
+	return true
+}
+
+// dhcpDecide runs the domain's DHCP hook for r, with what the inventory
+// knows of the client
+func (d *domain) dhcpDecide(r dhcp.Request) (dhcp.Decision, error) {
+	if mac, err := net.ParseMAC(r.MAC); err == nil {
+		if h, ok := d.store.HostByMAC(mac); ok {
+			r.Host, r.Profile, r.Labels = h.Name, h.Profile, h.Labels
+		}
+	}
+	return d.hook.Decide(r)
+}
+
+// localBoot reports whether the host with mac must boot from its disk
+func (d *domain) localBoot(mac net.HardwareAddr) bool {
+	h, p, _ := d.store.ProfileFor(mac)
+	why := diskBoot(h, p)
+	if why == "" {
+		return false
+	}
+	log.Printf("[DHCP] %s: %s %s, booting from disk", d.cfg.Name, h.Name, why)
+	return true
+}
+
+// diskBoot tells why host h, of profile p, is kept from being provisioned,
+// or returns "" if it isn't: it is to be installed once and has been, p
+// is a firmware update it runs or gave up on, or p has maintenance
+// windows and now is outside all of them. A host flagged for
+// reinstallation isn't kept from it.
+func diskBoot(h inventory.Host, p inventory.Profile) string {
+	done, failed := h.Updated(p)
+	switch {
+	case h.Name == "" || !h.Reinstall.IsZero():
+		return ""
+	case h.Once && !h.Installed.IsZero():
+		return "was installed " + h.Installed.Format("2006-01-02 15:04")
+	case done:
+		return "runs firmware " + p.Firmware.Version
+	case failed:
+		return "failed to update to firmware " + p.Firmware.Version
+	case !p.InWindow(time.Now()):
+		return "is outside the windows of profile " + p.Name
+	}
+	return ""
+}
+
+// observe files a client booting without an inventory entry as pending
+func (d *domain) observe(c dhcp.Client) {
+	if _, ok := d.store.HostByMAC(c.MAC); ok {
+		return
+	}
+	p, added := d.pending.Seen(enroll.Pending{MAC: c.MAC.String(), IP: c.IP.String(), Arch: c.Arch, UUID: c.UUID, Vendor: c.Vendor})
+	if added {
+		log.Printf("[ENROLL] %s: unknown host %s (%s, UUID %s) pending approval", d.cfg.Name, p.MAC, cmp.Or(p.Arch, "arch unknown"), cmp.Or(p.UUID, "unknown"))
+	}
+}
+
+// bootPlan is what the client with mac should boot: the local boot file
+// if it is kept from being provisioned, its profile's files, the discovery
+// profile's if it is unknown, else the domain's default boot file
+func (d *domain) bootPlan(mac net.HardwareAddr) sessions.Plan {
+	h, p, _ := d.store.ProfileFor(mac)
+	if diskBoot(h, p) != "" {
+		return sessions.Plan{Host: h.Name, Profile: p.Name, BootFile: d.cfg.LocalBoot}
+	}
+	if h.Name == "" && d.cfg.Discovery != "" {
+		p, _ = d.store.Profile(d.cfg.Discovery)
+	}
+	p = p.ForArch(d.clientArch(mac)).Booted(d.cfg.httpURL())
+	plan := sessions.Plan{Host: h.Name, Profile: p.Name, BootFile: p.Loader(), Kernel: p.Kernel, Initrd: p.Initrd}
+	if h.BootFile != "" {
+		plan.BootFile = h.BootFile
+	}
+	if plan.BootFile == "" {
+		plan.BootFile = d.defaultBootFile(d.clientArch(mac))
+	}
+	return plan
+}
+
+// booted records the profile version a host's boot session got to the
+// initrd with
+func (d *domain) booted(s sessions.Session) {
+	mac, _ := net.ParseMAC(s.MAC)
+	h, p, ok := d.store.ProfileFor(mac)
+	if !ok {
+		return
+	}
+	hh, ok := d.store.RecordBoot(h.Name, p, s.Last)
+	if !ok {
+		return
+	}
+	switch {
+	case hh.Bad != "" && hh.Good != nil && hh.Version == inventory.Version(*hh.Good):
+		log.Printf("[HEALTH] %s: %s booted good version %s of profile %s in place of %s, which it never reported healthy on", d.cfg.Name, h.Name, hh.Version, p.Name, hh.Bad)
+	case !hh.Deadline.IsZero():
+		log.Printf("[HEALTH] %s: %s booted version %s of profile %s, expecting a health report by %s", d.cfg.Name, h.Name, hh.Version, p.Name, hh.Deadline.Format("15:04:05"))
+	}
+}
+
+// reportHealth takes a host's post-boot health report:
+//
+//	curl -sf -X POST http://10.0.0.1:8080/health
+func (d *domain) reportHealth(w http.ResponseWriter, r *http.Request) {
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	h, ok := d.hostByIP(net.ParseIP(host))
+	if !ok {
+		http.Error(w, "not an inventory host", http.StatusNotFound)
+		return
+	}
+	hh, ok := d.store.ReportHealth(h.Name, time.Now())
+	if !ok {
+		http.Error(w, "no boot recorded for "+h.Name, http.StatusConflict)
+		return
+	}
+	log.Printf("[HEALTH] %s: %s reported healthy on version %s of profile %s", d.cfg.Name, h.Name, hh.Version, hh.Booted.Name)
+	if h.Once && h.Installed.IsZero() {
+		// Up and running on its own, so the install is done
+		d.installed(h)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// reportInstalled takes the installer's completion callback, after which
+// hosts to be installed once boot from disk:
+//
+//	curl -sf -X POST http://10.0.0.1:8080/installed
+func (d *domain) reportInstalled(w http.ResponseWriter, r *http.Request) {
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	h, ok := d.hostByIP(net.ParseIP(host))
+	if !ok {
+		http.Error(w, "not an inventory host", http.StatusNotFound)
+		return
+	}
+	d.installed(h)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (d *domain) installed(h inventory.Host) {
+	d.store.SetInstalled(h.Name, time.Now())
+	switch {
+	case h.Once:
+		log.Printf("[INSTALL] %s: %s is installed and boots from disk from now on", d.cfg.Name, h.Name)
+	case !h.Reinstall.IsZero():
+		log.Printf("[INSTALL] %s: %s is reinstalled, clearing its reinstallation flag", d.cfg.Name, h.Name)
+	default:
+		log.Printf("[INSTALL] %s: %s is installed", d.cfg.Name, h.Name)
+	}
+}
+
+// pcrPolicy is the PCR values expected of the host at ip
+func (d *domain) pcrPolicy(ip net.IP) map[int]string {
+	h, ok := d.hostByIP(ip)
+	if !ok {
+		return nil
+	}
+	mac, _ := net.ParseMAC(h.MAC)
+	return d.store.PCRPolicy(mac)
+}
+
+// attestResult flags the outcome of an attestation in the host's record
+func (d *domain) attestResult(ip net.IP, r attest.Report) {
+	if h, ok := d.hostByIP(ip); ok {
+		d.store.SetAttestation(h.Name, inventory.Attestation{Time: r.Time, Verified: r.Verified, Mismatch: r.Mismatch, Error: r.Error})
+	}
+}
+
+// clientID names a diskless client's overlays: its inventory host name,
+// else its dashed MAC address, else its IP
+func (d *domain) clientID(ip net.IP) string {
+	for _, l := range d.dhcp.Leases() {
+		if !ip.Equal(net.ParseIP(l.IP)) {
+			continue
+		}
+		mac, _ := net.ParseMAC(l.MAC)
+		if h, ok := d.store.HostByMAC(mac); ok {
+			return h.Name
+		}
+		return strings.ReplaceAll(l.MAC, ":", "-")
+	}
+	return ip.String()
+}
+
+// domainRecords resolves DNS names from a domain's inventory and leases.
+// Inventory hosts are published under their name; other leases under their
+// dashed MAC address (52-54-00-12-34-56). The server itself is "go-pxe".
+type domainRecords struct {
+	d *domain
+}
+
+func (r domainRecords) LookupHost(label string) net.IP {
+	if label == "go-pxe" {
+		return net.ParseIP(r.d.cfg.IP)
+	}
+	for _, h := range r.d.store.Hosts() {
+		if strings.EqualFold(h.Name, label) {
+			mac, _ := net.ParseMAC(h.MAC)
+			ip, _ := r.d.dhcp.LeaseFor(mac)
+			return ip
+		}
+	}
+	for _, res := range r.d.cfg.Reservations {
+		if res.HostName != "" && strings.EqualFold(res.HostName, label) {
+			return net.ParseIP(res.IP)
+		}
+	}
+	if mac, err := net.ParseMAC(strings.ReplaceAll(label, "-", ":")); err == nil {
+		ip, _ := r.d.dhcp.LeaseFor(mac)
+		return ip
+	}
+	return nil
+}
+
+func (r domainRecords) LookupAddr(ip net.IP) string {
+	if ip.Equal(net.ParseIP(r.d.cfg.IP)) {
+		return "go-pxe"
+	}
+	for _, l := range r.d.dhcp.Leases() {
+		if !ip.Equal(net.ParseIP(l.IP)) {
+			continue
+		}
+		mac, _ := net.ParseMAC(l.MAC)
+		if h, ok := r.d.store.HostByMAC(mac); ok {
+			return strings.ToLower(h.Name)
+		}
+		if name := r.d.cfg.reservedName(mac); name != "" {
+			return strings.ToLower(name)
+		}
+		return strings.ReplaceAll(l.MAC, ":", "-")
+	}
+	return ""
+}
@@ -0,0 +1,115 @@
+// Package enroll keeps the machines that network-boot without being in the
+// inventory, with what their DHCP requests revealed, until an operator
+// approves them into it with a name and a profile or rejects them.
+package enroll
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxPending bounds the list so a flood of spoofed MACs can't exhaust memory
+const maxPending = 4096
+
+// Pending is an unknown machine seen booting
+type Pending struct {
+	MAC    string `json:"mac"`
+	IP     string `json:"ip,omitempty"`
+	Arch   string `json:"arch,omitempty"`   // e.g. "bios", "efi-x64"
+	UUID   string `json:"uuid,omitempty"`   // SMBIOS UUID
+	Vendor string `json:"vendor,omitempty"` // DHCP vendor class
+
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+	Boots     int       `json:"boots"` // DHCP offers made to it
+}
+
+// Store is the set of pending machines, by MAC
+type Store struct {
+	mu      sync.Mutex
+	pending map[string]Pending
+}
+
+// NewStore creates an empty store
+func NewStore() *Store {
+	return &Store{pending: make(map[string]Pending)}
+}
+
+// Seen records a boot of the machine described by p, reporting whether
+// it is new. Fields p leaves empty keep their earlier values. A new
+// machine is dropped when the list is full.
+func (s *Store) Seen(p Pending) (Pending, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	old, ok := s.pending[p.MAC]
+	if !ok {
+		if len(s.pending) >= maxPending {
+			return p, false
+		}
+		old = Pending{MAC: p.MAC, FirstSeen: now}
+	}
+	if p.IP != "" {
+		old.IP = p.IP
+	}
+	if p.Arch != "" {
+		old.Arch = p.Arch
+	}
+	if p.UUID != "" {
+		old.UUID = p.UUID
+	}
+	if p.Vendor != "" {
+		old.Vendor = p.Vendor
+	}
+	old.LastSeen = now
+	old.Boots++
+	s.pending[p.MAC] = old
+	return old, !ok
+}
+
+// Get returns the pending machine with mac
+func (s *Store) Get(mac string) (Pending, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.pending[mac]
+	return p, ok
+}
+
+// List returns every pending machine, first seen first
+func (s *Store) List() []Pending {
+	list := s.Snapshot()
+	sort.Slice(list, func(i, j int) bool { return list[i].FirstSeen.Before(list[j].FirstSeen) })
+	return list
+}
+
+// Delete forgets the machine with mac, reporting whether it was pending
+func (s *Store) Delete(mac string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.pending[mac]
+	delete(s.pending, mac)
+	return ok
+}
+
+// Snapshot returns every pending machine for backups
+func (s *Store) Snapshot() []Pending {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]Pending, 0, len(s.pending))
+	for _, p := range s.pending {
+		list = append(list, p)
+	}
+	return list
+}
+
+// Load replaces the machines awaiting approval with list, as a backup
+// restores them
+func (s *Store) Load(list []Pending) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = make(map[string]Pending, len(list))
+	for _, p := range list {
+		s.pending[p.MAC] = p
+	}
+}
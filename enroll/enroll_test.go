@@ -0,0 +1,65 @@
+package enroll
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestSeen(t *testing.T) {
+	s := NewStore()
+	p, isNew := s.Seen(Pending{MAC: "aa:bb:cc:dd:ee:01", IP: "10.0.0.5", Arch: "efi-x64", Vendor: "PXEClient"})
+	if !isNew || p.Boots != 1 || p.FirstSeen.IsZero() || p.FirstSeen != p.LastSeen {
+		t.Fatalf("first boot = %+v, %v", p, isNew)
+	}
+	time.Sleep(time.Millisecond)
+	p, isNew = s.Seen(Pending{MAC: "aa:bb:cc:dd:ee:01", UUID: "4c4c4544", Arch: "bios"})
+	if isNew || p.Boots != 2 || p.IP != "10.0.0.5" || p.Arch != "bios" || p.UUID != "4c4c4544" ||
+		p.Vendor != "PXEClient" || !p.LastSeen.After(p.FirstSeen) {
+		t.Errorf("second boot = %+v, %v", p, isNew)
+	}
+	if got, ok := s.Get("aa:bb:cc:dd:ee:01"); !ok || got != p {
+		t.Errorf("Get = %+v, %v", got, ok)
+	}
+}
+
+func TestLimit(t *testing.T) {
+	s := NewStore()
+	for i := range maxPending {
+		s.Seen(Pending{MAC: fmt.Sprintf("mac%d", i)})
+	}
+	if _, isNew := s.Seen(Pending{MAC: "one-too-many"}); isNew {
+		t.Error("new machine accepted past the limit")
+	}
+	if _, ok := s.Get("one-too-many"); ok {
+		t.Error("machine past the limit stored")
+	}
+	if p, _ := s.Seen(Pending{MAC: "mac0"}); p.Boots != 2 {
+		t.Errorf("known machine not counted when full: %+v", p)
+	}
+}
+
+func TestList(t *testing.T) {
+	s := NewStore()
+	for _, mac := range []string{"c", "a", "b"} {
+		s.Seen(Pending{MAC: mac})
+		time.Sleep(time.Millisecond)
+	}
+	list := s.List()
+	if len(list) != 3 || list[0].MAC != "c" || list[1].MAC != "a" || list[2].MAC != "b" {
+		t.Errorf("List = %+v", list)
+	}
+
+	snap := s.Snapshot()
+	if !s.Delete("a") || s.Delete("a") {
+		t.Error("Delete reported wrongly")
+	}
+	s.Seen(Pending{MAC: "d"})
+	s.Load(snap)
+	if _, ok := s.Get("a"); !ok {
+		t.Error("Load lost a machine")
+	}
+	if _, ok := s.Get("d"); ok {
+		t.Error("Load kept a machine missing from the snapshot")
+	}
+}
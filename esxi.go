@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/ars1364/go-pxe/inventory"
+)
+
+// generateESXi backs esxi/<profile>/: the profile's installer directory or
+// ISO, whatever case its files are in, with mboot.efi where the UEFI loader
+// is, a boot.cfg that loads from here, and the host's ks.cfg
+func (d *domain) generateESXi(name string, ip net.IP) ([]byte, bool) {
+	profile, rest, _ := strings.Cut(strings.TrimPrefix(name, "esxi/"), "/")
+	who, p := d.profileAt(ip)
+	if p.Name != profile || p.ESXi == nil {
+		// Not the client's own profile, e.g. when tried by hand
+		p, _ = d.store.Profile(profile)
+	}
+	if p.ESXi == nil {
+		return nil, false
+	}
+
+	var data []byte
+	var err error
+	switch {
+	case rest == "boot.cfg" || strings.HasSuffix(rest, "/boot.cfg"):
+		// mboot.efi tries 01-<mac>/boot.cfg first; both get the same
+		data, err = d.esxiBootCfg(who, p)
+	case rest == "ks.cfg":
+		if p.ESXi.Kickstart == "" {
+			return nil, false
+		}
+		data, err = d.rootFile(p.ESXi.Kickstart, ip)
+	case rest == "mboot.efi":
+		if data, err = d.esxiFile(p, "mboot.efi"); err != nil {
+			data, err = d.esxiFile(p, "efi/boot/bootx64.efi")
+		}
+	default:
+		data, err = d.esxiFile(p, rest)
+	}
+	if err != nil {
+		log.Printf("[TFTP] %s: %s for %s: %v", d.cfg.Name, name, who, err)
+		return nil, false
+	}
+	return data, true
+}
+
+// esxiFile reads name from the profile's installer directory or ISO,
+// matching each path element regardless of case: the ISO's names are
+// upper case, boot.cfg's lower case
+func (d *domain) esxiFile(p inventory.Profile, name string) ([]byte, error) {
+	var media fs.FS
+	if p.ESXi.Dir != "" {
+		media = os.DirFS(filepath.Join(d.cfg.TFTPRoot, filepath.FromSlash(p.ESXi.Dir)))
+	} else {
+		disc, err := d.openISO(p.Name)
+		if err != nil {
+			return nil, err
+		}
+		defer disc.Close()
+		media = disc
+	}
+	dir := "."
+	for _, elem := range strings.Split(name, "/") {
+		if elem == "" || elem == "." || elem == ".." {
+			return nil, fmt.Errorf("bad path %q", name)
+		}
+		entries, err := fs.ReadDir(media, dir)
+		if err != nil {
+			return nil, err
+		}
+		found := ""
+		for _, e := range entries {
+			if e.Name() == elem || found == "" && strings.EqualFold(e.Name(), elem) {
+				found = e.Name()
+			}
+		}
+		if found == "" {
+			return nil, fmt.Errorf("%s: no %s in %s", p.Name, name, cmp.Or(p.ESXi.Dir, p.ISO))
+		}
+		dir = path.Join(dir, found)
+	}
+	return fs.ReadFile(media, dir)
+}
+
+// esxiBootCfg rewrites the installer's boot.cfg to load from the network:
+// its paths are absolute, as on the CD, so prefix points at the profile's
+// directory and the paths are made relative to it. The kernel options
+// lose cdromBoot and gain the profile's cmdline and kickstart.
+func (d *domain) esxiBootCfg(who string, p inventory.Profile) ([]byte, error) {
+	orig, err := d.esxiFile(p, "boot.cfg")
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "prefix=esxi/%s\n", p.Name)
+	sc := bufio.NewScanner(bytes.NewReader(orig))
+	for sc.Scan() {
+		key, value, ok := strings.Cut(strings.TrimSpace(sc.Text()), "=")
+		switch {
+		case !ok:
+			fmt.Fprintln(&b, sc.Text())
+			continue
+		case key == "prefix":
+			continue
+		case key == "title":
+			value += fmt.Sprintf(" (%s, profile %s)", who, p.Name)
+		case key == "kernel" || key == "modules":
+			var files []string
+			for _, f := range strings.Fields(value) {
+				files = append(files, strings.TrimPrefix(f, "/"))
+			}
+			value = strings.Join(files, " ")
+		case key == "kernelopt":
+			var opts []string
+			for _, o := range strings.Fields(value) {
+				if o != "cdromBoot" {
+					opts = append(opts, o)
+				}
+			}
+			if p.Cmdline != "" {
+				opts = append(opts, p.Cmdline)
+			}
+			if p.ESXi.Kickstart != "" {
+				opts = append(opts, fmt.Sprintf("ks=%s/esxi/%s/ks.cfg", d.cfg.httpURL(), p.Name))
+			}
+			value = strings.Join(opts, " ")
+		}
+		fmt.Fprintf(&b, "%s=%s\n", key, value)
+	}
+	return b.Bytes(), sc.Err()
+}
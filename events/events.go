@@ -0,0 +1,105 @@
+package events
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Event types published by the services
+const (
+	DHCPOffer    = "dhcp.offer"
+	DHCPAck      = "dhcp.ack"
+	TFTPComplete = "tftp.complete"
+	TFTPFailed   = "tftp.failed"
+	HTTPRequest  = "http.request"
+
+	MulticastJoin   = "multicast.join"
+	MulticastDone   = "multicast.done"
+	MulticastFailed = "multicast.failed"
+)
+
+// Event is a single observation from one of the services
+type Event struct {
+	Time   time.Time        `json:"time"`
+	Type   string           `json:"type"`
+	MAC    net.HardwareAddr `json:"mac,omitempty"`
+	IP     net.IP           `json:"ip,omitempty"`
+	Path   string           `json:"path,omitempty"`
+	Bytes  int64            `json:"bytes,omitempty"`
+	Status int              `json:"status,omitempty"`
+	Err    string           `json:"err,omitempty"`
+
+	// Duration of the transfer or request the event completes
+	Duration time.Duration `json:"duration,omitempty"`
+
+	// Domain the event belongs to, and the revision of its host/profile
+	// definitions in effect (e.g. Git commit)
+	Domain   string `json:"domain,omitempty"`
+	Revision string `json:"revision,omitempty"`
+}
+
+// Bus fans events out to subscribers. A nil *Bus discards everything,
+// so servers can publish unconditionally.
+type Bus struct {
+	// Annotate, if set, fills in context on every event before delivery.
+	// Set it before the bus is shared.
+	Annotate func(*Event)
+
+	mu   sync.Mutex
+	subs map[chan Event]struct{}
+}
+
+// NewBus creates an empty event bus
+func NewBus() *Bus {
+	return &Bus{subs: make(map[chan Event]struct{})}
+}
+
+// Publish delivers e to every subscriber. Slow subscribers drop events
+// rather than stall the packet loops.
+func (b *Bus) Publish(e Event) {
+	if b == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if b.Annotate != nil {
+		b.Annotate(&e)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// Subscribe returns a channel receiving all future events and a function
+// that unsubscribes and closes it.
+func (b *Bus) Subscribe(buffer int) (<-chan Event, func()) {
+	ch := make(chan Event, buffer)
+	b.mu.Lock()
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+	return ch, func() {
+		b.mu.Lock()
+		if _, ok := b.subs[ch]; ok {
+			delete(b.subs, ch)
+			close(ch)
+		}
+		b.mu.Unlock()
+	}
+}
+
+// Forward republishes every event on b to dst, after b's Annotate has run
+func (b *Bus) Forward(dst *Bus) {
+	ch, _ := b.Subscribe(1024)
+	go func() {
+		for e := range ch {
+			dst.Publish(e)
+		}
+	}()
+}
@@ -0,0 +1,52 @@
+package events
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBus(t *testing.T) {
+	var nilBus *Bus
+	nilBus.Publish(Event{Type: DHCPOffer}) // discarded
+
+	b := NewBus()
+	b.Annotate = func(e *Event) { e.Domain = "lab" }
+	ch, unsubscribe := b.Subscribe(1)
+	b.Publish(Event{Type: DHCPOffer})
+	b.Publish(Event{Type: DHCPAck}) // the buffer is full: dropped
+
+	e := <-ch
+	if e.Type != DHCPOffer || e.Domain != "lab" || e.Time.IsZero() {
+		t.Errorf("event = %+v", e)
+	}
+	select {
+	case e := <-ch:
+		t.Errorf("slow subscriber got %+v", e)
+	default:
+	}
+
+	unsubscribe()
+	unsubscribe()
+	if _, ok := <-ch; ok {
+		t.Error("channel open after unsubscribing")
+	}
+	b.Publish(Event{Type: DHCPOffer})
+}
+
+func TestForward(t *testing.T) {
+	src, dst := NewBus(), NewBus()
+	src.Annotate = func(e *Event) { e.Domain = "lab" }
+	ch, _ := dst.Subscribe(1)
+	src.Forward(dst)
+
+	at := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	src.Publish(Event{Type: TFTPComplete, Time: at})
+	select {
+	case e := <-ch:
+		if e.Type != TFTPComplete || e.Domain != "lab" || !e.Time.Equal(at) {
+			t.Errorf("forwarded %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("event not forwarded")
+	}
+}
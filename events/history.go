@@ -0,0 +1,97 @@
+package events
+
+import (
+	"encoding/json"
+	"net"
+	"sync"
+)
+
+// History keeps the most recent events in a fixed-size ring
+type History struct {
+	mu   sync.Mutex
+	buf  []Event
+	next int
+	full bool
+}
+
+// NewHistory creates a ring holding up to size events
+func NewHistory(size int) *History {
+	return &History{buf: make([]Event, size)}
+}
+
+// Follow records every event published on bus until it is closed
+func (h *History) Follow(bus *Bus) {
+	ch, _ := bus.Subscribe(1024)
+	go func() {
+		for e := range ch {
+			h.Record(e)
+		}
+	}()
+}
+
+// Record appends e, evicting the oldest event when full
+func (h *History) Record(e Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.buf[h.next] = e
+	h.next = (h.next + 1) % len(h.buf)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// Events returns the recorded events, oldest first
+func (h *History) Events() []Event {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.full {
+		return append([]Event(nil), h.buf[:h.next]...)
+	}
+	return append(append([]Event(nil), h.buf[h.next:]...), h.buf[:h.next]...)
+}
+
+// Load replaces the ring contents with list, keeping the newest entries
+func (h *History) Load(list []Event) {
+	h.mu.Lock()
+	h.next, h.full = 0, false
+	h.mu.Unlock()
+	if len(list) > len(h.buf) {
+		list = list[len(list)-len(h.buf):]
+	}
+	for _, e := range list {
+		h.Record(e)
+	}
+}
+
+// MarshalJSON encodes the MAC in its usual colon form rather than base64
+func (e Event) MarshalJSON() ([]byte, error) {
+	type plain Event
+	var mac string
+	if e.MAC != nil {
+		mac = e.MAC.String()
+	}
+	return json.Marshal(struct {
+		plain
+		MAC string `json:"mac,omitempty"`
+	}{plain(e), mac})
+}
+
+func (e *Event) UnmarshalJSON(data []byte) error {
+	type plain Event
+	var v struct {
+		plain
+		MAC string `json:"mac,omitempty"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*e = Event(v.plain)
+	if v.MAC != "" {
+		mac, err := net.ParseMAC(v.MAC)
+		if err != nil {
+			return err
+		}
+		e.MAC = mac
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package events
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func types(list []Event) string {
+	var s []string
+	for _, e := range list {
+		s = append(s, e.Type)
+	}
+	return strings.Join(s, ",")
+}
+
+func TestHistory(t *testing.T) {
+	h := NewHistory(3)
+	if got := h.Events(); len(got) != 0 {
+		t.Errorf("empty history = %+v", got)
+	}
+	for _, typ := range []string{"a", "b"} {
+		h.Record(Event{Type: typ})
+	}
+	if got := types(h.Events()); got != "a,b" {
+		t.Errorf("events = %s", got)
+	}
+	for _, typ := range []string{"c", "d", "e"} {
+		h.Record(Event{Type: typ})
+	}
+	if got := types(h.Events()); got != "c,d,e" {
+		t.Errorf("after wrapping = %s", got)
+	}
+
+	h.Load([]Event{{Type: "1"}, {Type: "2"}, {Type: "3"}, {Type: "4"}})
+	if got := types(h.Events()); got != "2,3,4" {
+		t.Errorf("after Load = %s", got)
+	}
+	h.Load([]Event{{Type: "x"}})
+	if got := types(h.Events()); got != "x" {
+		t.Errorf("after short Load = %s", got)
+	}
+}
+
+func TestFollow(t *testing.T) {
+	bus := NewBus()
+	h := NewHistory(4)
+	h.Follow(bus)
+	bus.Publish(Event{Type: DHCPOffer})
+	// The history records from its own goroutine
+	for range 1000 {
+		if types(h.Events()) == DHCPOffer {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Error("followed event not recorded")
+}
+
+func TestEventJSON(t *testing.T) {
+	mac, _ := net.ParseMAC("aa:bb:cc:dd:ee:ff")
+	e := Event{Type: DHCPAck, MAC: mac, IP: net.IPv4(10, 0, 0, 5).To4()}
+	data, err := json.Marshal(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"mac":"aa:bb:cc:dd:ee:ff"`) {
+		t.Errorf("JSON = %s", data)
+	}
+	var back Event
+	if err := json.Unmarshal(data, &back); err != nil {
+		t.Fatal(err)
+	}
+	if back.MAC.String() != mac.String() || !back.IP.Equal(e.IP) || back.Type != DHCPAck {
+		t.Errorf("round trip = %+v", back)
+	}
+
+	if data, _ := json.Marshal(Event{Type: DHCPAck}); strings.Contains(string(data), "mac") {
+		t.Errorf("JSON without MAC = %s", data)
+	}
+	for _, bad := range []string{`{"mac":"nope"}`, `{"mac":5}`, `[`} {
+		if err := json.Unmarshal([]byte(bad), &back); err == nil {
+			t.Errorf("%s accepted", bad)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// runExport writes the lease table or boot history of a running server,
+// through its management API, as JSON or CSV for a CMDB or spreadsheet:
+//
+//	go-pxe export leases|boots [-format csv] [-columns mac,ip,host] [-since 7d] [-o file]
+//
+// -since and -until take a date, an RFC 3339 time, or a duration before
+// now.
+func runExport(args []string) {
+	if len(args) == 0 || (args[0] != "leases" && args[0] != "boots") {
+		log.Fatal("usage: go-pxe export leases|boots [flags]")
+	}
+	table := args[0]
+	fs := flag.NewFlagSet("export "+table, flag.ExitOnError)
+	apiURL := fs.String("api", "http://127.0.0.1:9090", "Management API of the server")
+	token := fs.String("token", os.Getenv("GOPXE_API_TOKEN"), "API bearer token (default from GOPXE_API_TOKEN)")
+	domain := fs.String("domain", "default", "Provisioning domain to export")
+	format := fs.String("format", "json", "Output format: json or csv")
+	columns := fs.String("columns", "", "Comma-separated columns to export, in order")
+	since := fs.String("since", "", "Only what was seen from then: a date, RFC 3339 time or duration ago, such as 7d or 12h")
+	until := fs.String("until", "", "Only what was seen before then, like -since")
+	out := fs.String("o", "", "File to write (default standard output)")
+	var host, mac, outcome *string
+	var limit *int
+	if table == "boots" {
+		host = fs.String("host", "", "Only boots of this host")
+		mac = fs.String("mac", "", "Only boots of this MAC address")
+		outcome = fs.String("outcome", "", "Only boots with this outcome, such as failed")
+		limit = fs.Int("limit", 0, "Export at most this many boots, newest first (default all)")
+	}
+	fs.Parse(args[1:])
+
+	q := url.Values{"format": {*format}}
+	if *columns != "" {
+		q.Set("columns", *columns)
+	}
+	for name, v := range map[string]string{"since": *since, "until": *until} {
+		if v == "" {
+			continue
+		}
+		t, err := parseWhen(v, time.Now())
+		if err != nil {
+			log.Fatalf("-%s: %v", name, err)
+		}
+		q.Set(name, t.Format(time.RFC3339))
+	}
+	if table == "boots" {
+		for name, v := range map[string]string{"host": *host, "mac": *mac, "outcome": *outcome} {
+			if v != "" {
+				q.Set(name, v)
+			}
+		}
+		if *limit > 0 {
+			q.Set("limit", strconv.Itoa(*limit))
+		}
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		w = f
+	}
+	c := newAPIClient(*apiURL, *domain, *token, 5*time.Minute)
+	if err := c.download("/"+table+"?"+q.Encode(), w); err != nil {
+		if *out != "" {
+			os.Remove(*out)
+		}
+		log.Fatal(err)
+	}
+	if *out != "" {
+		fmt.Fprintln(os.Stderr, "Wrote", *out)
+	}
+}
+
+// parseWhen reads a date, an RFC 3339 time, or a duration before now in
+// Go's syntax or whole days such as 7d
+func parseWhen(s string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation(time.DateOnly, s, time.Local); err == nil {
+		return t, nil
+	}
+	if n, ok := strings.CutSuffix(s, "d"); ok {
+		if days, err := strconv.Atoi(n); err == nil && days >= 0 {
+			return now.AddDate(0, 0, -days), nil
+		}
+	}
+	if d, err := time.ParseDuration(s); err == nil && d >= 0 {
+		return now.Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("%q is not a date, RFC 3339 time or duration", s)
+}
@@ -0,0 +1,457 @@
+// Package fetch downloads boot assets over HTTP(S). Downloads go through
+// the proxy named by HTTPS_PROXY, HTTP_PROXY and NO_PROXY, resume where an
+// interrupted attempt stopped (even across restarts), split large files
+// into parallel ranged requests and share an optional bandwidth cap. Boot
+// files are checked against published checksum lists, and their
+// signatures, before they are put in place.
+package fetch
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default is the fetcher go-pxe's downloads use; main applies the -fetch
+// flags to it
+var Default = New()
+
+// Fetcher downloads files
+type Fetcher struct {
+	Client *http.Client
+
+	// Chunks is how many ranged requests fetch one large file at once
+	Chunks int
+
+	// ChunkMin is the size below which a file is fetched in one request
+	ChunkMin int64
+
+	// Retries is how often a failed request is resumed before giving up
+	Retries int
+
+	// Idle aborts a request that received nothing for this long
+	Idle time.Duration
+
+	// Limiter, if set, caps the bandwidth of all downloads together
+	Limiter *Limiter
+
+	// Require is the least verification a Verified download needs to be
+	// kept; Unverified keeps anything no checksum list contradicts
+	Require string
+
+	// Keyring, if set, is the gpgv keyring checksum lists' signatures are
+	// checked against
+	Keyring string
+
+	// Catalog, if set, records every Verified download
+	Catalog Recorder
+}
+
+// New creates a fetcher with four chunks of at least 16 MiB and no
+// bandwidth cap
+func New() *Fetcher {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = http.ProxyFromEnvironment
+	t.ResponseHeaderTimeout = time.Minute
+	return &Fetcher{
+		Client:   &http.Client{Transport: t},
+		Chunks:   4,
+		ChunkMin: 16 << 20,
+		Retries:  5,
+		Idle:     time.Minute,
+		Require:  Unverified,
+	}
+}
+
+// state is kept beside a partial download in <dest>.part.json so a later
+// attempt can resume it
+type state struct {
+	URL       string  `json:"url"`
+	Validator string  `json:"validator"` // ETag or Last-Modified of the remote file
+	Size      int64   `json:"size"`
+	Chunks    []chunk `json:"chunks"`
+}
+
+type chunk struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`  // exclusive
+	Done  int64 `json:"done"` // bytes of the chunk written
+}
+
+// File downloads url to dest and returns its size. Data arrives in
+// <dest>.part, which is renamed to dest when complete, so dest is never
+// half written. header is sent with every request, e.g. for
+// authorization.
+func (f *Fetcher) File(ctx context.Context, url, dest string, header http.Header) (int64, error) {
+	part, meta := dest+".part", dest+".part.json"
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+		return 0, err
+	}
+
+	size, validator, ranges, err := f.probe(ctx, url, header)
+	if err != nil {
+		return 0, err
+	}
+	if !ranges || size < 0 {
+		// No resuming possible; stream it in one go
+		os.Remove(meta)
+		n, err := f.stream(ctx, url, part, header)
+		if err != nil {
+			return 0, err
+		}
+		return n, finish(part, dest)
+	}
+
+	st, resumed := loadState(meta, url, validator, size)
+	if !resumed {
+		st = newState(url, validator, size, f.chunks(size))
+		if err := os.WriteFile(part, nil, 0o644); err != nil {
+			return 0, err
+		}
+	} else {
+		var done int64
+		for _, c := range st.Chunks {
+			done += c.Done
+		}
+		log.Printf("[FETCH] Resuming %s at %d of %d bytes", url, done, size)
+	}
+	out, err := os.OpenFile(part, os.O_WRONLY|os.O_CREATE, 0o644)
+	if err != nil {
+		return 0, err
+	}
+	defer out.Close()
+
+	var (
+		mu    sync.Mutex
+		saved time.Time
+		wg    sync.WaitGroup
+		errs  = make([]error, len(st.Chunks))
+	)
+	save := func(force bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		if force || time.Since(saved) > time.Second {
+			writeState(meta, st)
+			saved = time.Now()
+		}
+	}
+	save(true)
+	for i := range st.Chunks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = f.fetchChunk(ctx, url, header, validator, out, &st.Chunks[i], &mu, save)
+		}()
+	}
+	wg.Wait()
+	save(true)
+	if ctx.Err() != nil {
+		return 0, ctx.Err()
+	}
+	if err := errors.Join(errs...); err != nil {
+		if errors.Is(err, errChanged) {
+			os.Remove(meta)
+			os.Remove(part)
+		}
+		return 0, err
+	}
+	if err := out.Close(); err != nil {
+		return 0, err
+	}
+	os.Remove(meta)
+	return size, finish(part, dest)
+}
+
+// probe learns the remote file's size, validator and whether it can be
+// fetched in ranges. It asks for the first byte rather than sending HEAD,
+// which presigned object store URLs often refuse.
+func (f *Fetcher) probe(ctx context.Context, url string, header http.Header) (int64, string, bool, error) {
+	req, err := newRequest(ctx, "GET", url, header)
+	if err != nil {
+		return 0, "", false, err
+	}
+	req.Header.Set("Range", "bytes=0-0")
+	resp, err := f.Client.Do(req)
+	if err != nil {
+		return 0, "", false, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.ContentLength, "", false, nil
+	case http.StatusPartialContent:
+	default:
+		return 0, "", false, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	_, total, _ := strings.Cut(resp.Header.Get("Content-Range"), "/")
+	size, err := strconv.ParseInt(total, 10, 64)
+	if err != nil {
+		return -1, "", false, nil // size unknown ("*")
+	}
+	validator := resp.Header.Get("ETag")
+	if validator == "" || strings.HasPrefix(validator, "W/") {
+		validator = resp.Header.Get("Last-Modified")
+	}
+	return size, validator, validator != "", nil
+}
+
+// chunks is how many parts a file of size is split into
+func (f *Fetcher) chunks(size int64) int {
+	n := 1
+	if size >= f.ChunkMin && f.Chunks > 1 {
+		n = f.Chunks
+	}
+	return n
+}
+
+func newState(url, validator string, size int64, n int) *state {
+	st := &state{URL: url, Validator: validator, Size: size}
+	step := size / int64(n)
+	for i := range n {
+		c := chunk{Start: int64(i) * step, End: int64(i+1) * step}
+		if i == n-1 {
+			c.End = size
+		}
+		st.Chunks = append(st.Chunks, c)
+	}
+	return st
+}
+
+// loadState returns the saved progress of a download of the same version
+// of url
+func loadState(meta, url, validator string, size int64) (*state, bool) {
+	data, err := os.ReadFile(meta)
+	if err != nil {
+		return nil, false
+	}
+	var st state
+	if json.Unmarshal(data, &st) != nil || st.URL != url || st.Validator != validator || st.Size != size || len(st.Chunks) == 0 {
+		return nil, false
+	}
+	// The chunks must still tile the file, or a damaged state would have
+	// the gaps skipped
+	var next int64
+	for _, c := range st.Chunks {
+		if c.Start != next || c.End < c.Start || c.Done < 0 || c.Done > c.End-c.Start {
+			return nil, false
+		}
+		next = c.End
+	}
+	if next != size {
+		return nil, false
+	}
+	if fi, err := os.Stat(strings.TrimSuffix(meta, ".json")); err != nil || fi.Size() > size {
+		return nil, false
+	}
+	return &st, true
+}
+
+func writeState(meta string, st *state) {
+	data, _ := json.Marshal(st)
+	tmp := meta + ".tmp"
+	if os.WriteFile(tmp, data, 0o644) == nil {
+		os.Rename(tmp, meta)
+	}
+}
+
+// fetchChunk fills one chunk, resuming after failures from where it got
+func (f *Fetcher) fetchChunk(ctx context.Context, url string, header http.Header, validator string, out *os.File, c *chunk, mu *sync.Mutex, save func(bool)) error {
+	var last error
+	for attempt := 0; attempt <= f.Retries; attempt++ {
+		mu.Lock()
+		done := c.Done
+		mu.Unlock()
+		if c.Start+done >= c.End {
+			return nil
+		}
+		if attempt > 0 {
+			log.Printf("[FETCH] %s: retrying bytes %d-%d after: %v", url, c.Start+done, c.End-1, last)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(backoff(attempt)):
+			}
+		}
+		err := f.fetchRange(ctx, url, header, validator, c.Start+done, c.End, func(p []byte, off int64) error {
+			if _, err := out.WriteAt(p, off); err != nil {
+				return err
+			}
+			mu.Lock()
+			c.Done += int64(len(p))
+			mu.Unlock()
+			save(false)
+			return nil
+		})
+		if err == nil {
+			return nil
+		}
+		if errors.Is(err, errChanged) || ctx.Err() != nil {
+			return err
+		}
+		last = err
+	}
+	return fmt.Errorf("%s: %w", url, last)
+}
+
+// errChanged means the remote file changed during the download
+var errChanged = errors.New("remote file changed during download")
+
+// fetchRange requests bytes [start, end) and passes them to write at their
+// offsets
+func (f *Fetcher) fetchRange(ctx context.Context, url string, header http.Header, validator string, start, end int64, write func([]byte, int64) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	req, err := newRequest(ctx, "GET", url, header)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end-1))
+	req.Header.Set("If-Range", validator)
+	resp, err := f.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK, http.StatusRequestedRangeNotSatisfiable:
+		// If-Range failed: the file is not the one we started on
+		return errChanged
+	default:
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	if cr := resp.Header.Get("Content-Range"); !strings.HasPrefix(cr, "bytes "+strconv.FormatInt(start, 10)+"-") {
+		return fmt.Errorf("GET %s: unexpected Content-Range %q", url, cr)
+	}
+
+	body := f.reader(resp.Body, cancel)
+	buf := make([]byte, 64<<10)
+	off := start
+	for off < end {
+		n, err := body.Read(buf[:min(int64(len(buf)), end-off)])
+		if n > 0 {
+			if werr := write(buf[:n], off); werr != nil {
+				return werr
+			}
+			off += int64(n)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if off < end {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+// stream downloads url whole into part, retrying from scratch on failure
+func (f *Fetcher) stream(ctx context.Context, url, part string, header http.Header) (int64, error) {
+	var last error
+	for attempt := 0; attempt <= f.Retries; attempt++ {
+		if attempt > 0 {
+			log.Printf("[FETCH] %s: restarting after: %v", url, last)
+			select {
+			case <-ctx.Done():
+				return 0, ctx.Err()
+			case <-time.After(backoff(attempt)):
+			}
+		}
+		n, err := f.streamOnce(ctx, url, part, header)
+		if err == nil || ctx.Err() != nil {
+			return n, err
+		}
+		last = err
+	}
+	return 0, fmt.Errorf("%s: %w", url, last)
+}
+
+func (f *Fetcher) streamOnce(ctx context.Context, url, part string, header http.Header) (int64, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	req, err := newRequest(ctx, "GET", url, header)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := f.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	out, err := os.Create(part)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(out, f.reader(resp.Body, cancel))
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && resp.ContentLength >= 0 && n != resp.ContentLength {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// reader wraps a response body with the bandwidth cap and the idle
+// timeout, which cancels the request
+func (f *Fetcher) reader(r io.Reader, cancel func()) io.Reader {
+	return &watchedReader{r: r, limiter: f.Limiter, idle: f.Idle, timer: time.AfterFunc(f.Idle, cancel)}
+}
+
+type watchedReader struct {
+	r       io.Reader
+	limiter *Limiter
+	idle    time.Duration
+	timer   *time.Timer
+}
+
+func (w *watchedReader) Read(p []byte) (int, error) {
+	n, err := w.r.Read(p)
+	if n > 0 {
+		w.timer.Reset(w.idle)
+		w.limiter.Wait(n)
+	}
+	if err != nil {
+		w.timer.Stop()
+	}
+	return n, err
+}
+
+func newRequest(ctx context.Context, method, url string, header http.Header) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	return req, nil
+}
+
+// finish moves a complete download into place
+func finish(part, dest string) error {
+	if err := os.Chmod(part, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(part, dest)
+}
+
+func backoff(attempt int) time.Duration {
+	return min(time.Duration(1<<attempt)*time.Second, 30*time.Second)
+}
@@ -0,0 +1,247 @@
+package fetch
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// origin serves data, in ranges if ranges is set
+type origin struct {
+	data   []byte
+	ranges bool
+	etag   func(r *http.Request) string // defaults to "v1"
+
+	mu        sync.Mutex
+	requested []string // Range of every request
+	cut       int      // if set, the next ranged response stops after cut bytes
+}
+
+func (o *origin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	o.mu.Lock()
+	o.requested = append(o.requested, r.Header.Get("Range"))
+	cut := 0
+	if r.Header.Get("Range") != "bytes=0-0" {
+		cut, o.cut = o.cut, 0
+	}
+	o.mu.Unlock()
+	if !o.ranges {
+		w.Write(o.data)
+		return
+	}
+	etag := `"v1"`
+	if o.etag != nil {
+		etag = o.etag(r)
+	}
+	w.Header().Set("ETag", etag)
+	if cut > 0 {
+		w = &cutWriter{ResponseWriter: w, left: cut}
+	}
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(o.data))
+}
+
+func (o *origin) ranged() []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var list []string
+	for _, r := range o.requested {
+		if r != "" && r != "bytes=0-0" {
+			list = append(list, r)
+		}
+	}
+	return list
+}
+
+// cutWriter drops the connection once left bytes are written
+type cutWriter struct {
+	http.ResponseWriter
+	left int
+}
+
+func (c *cutWriter) Write(p []byte) (int, error) {
+	if len(p) >= c.left {
+		c.ResponseWriter.Write(p[:c.left])
+		c.ResponseWriter.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}
+	c.left -= len(p)
+	return c.ResponseWriter.Write(p)
+}
+
+func testFetcher() *Fetcher {
+	f := New()
+	f.Retries = 0
+	return f
+}
+
+func testData(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	return data
+}
+
+func TestFile(t *testing.T) {
+	for _, ranges := range []bool{false, true} {
+		name := "streamed"
+		if ranges {
+			name = "ranged"
+		}
+		t.Run(name, func(t *testing.T) {
+			o := &origin{data: testData(5000), ranges: ranges}
+			srv := httptest.NewServer(o)
+			defer srv.Close()
+			dest := filepath.Join(t.TempDir(), "boot", "vmlinuz")
+
+			n, err := testFetcher().File(context.Background(), srv.URL+"/vmlinuz", dest, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _ := os.ReadFile(dest)
+			if n != 5000 || !bytes.Equal(got, o.data) {
+				t.Errorf("got %d bytes, file matches: %v", n, bytes.Equal(got, o.data))
+			}
+			left, _ := filepath.Glob(dest + ".part*")
+			if len(left) != 0 {
+				t.Errorf("left behind %v", left)
+			}
+		})
+	}
+}
+
+func TestFileChunks(t *testing.T) {
+	o := &origin{data: testData(1000), ranges: true}
+	srv := httptest.NewServer(o)
+	defer srv.Close()
+	f := testFetcher()
+	f.ChunkMin = 100
+	dest := filepath.Join(t.TempDir(), "initrd")
+
+	if _, err := f.File(context.Background(), srv.URL, dest, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(dest); !bytes.Equal(got, o.data) {
+		t.Error("file differs")
+	}
+	if got := o.ranged(); len(got) != 4 {
+		t.Errorf("ranges requested = %q, want 4", got)
+	}
+}
+
+func TestFileResume(t *testing.T) {
+	o := &origin{data: testData(1000), ranges: true, cut: 300}
+	srv := httptest.NewServer(o)
+	defer srv.Close()
+	dest := filepath.Join(t.TempDir(), "initrd")
+
+	if _, err := testFetcher().File(context.Background(), srv.URL, dest, nil); err == nil {
+		t.Fatal("cut download succeeded")
+	}
+	if _, err := os.Stat(dest + ".part.json"); err != nil {
+		t.Fatalf("no saved state: %v", err)
+	}
+	if _, err := testFetcher().File(context.Background(), srv.URL, dest, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(dest); !bytes.Equal(got, o.data) {
+		t.Error("resumed file differs")
+	}
+	if got := o.ranged(); len(got) != 2 || got[1] != "bytes=300-999" {
+		t.Errorf("ranges requested = %q, want the second from 300", got)
+	}
+}
+
+func TestFileChanged(t *testing.T) {
+	// The file changes between the probe and the download
+	o := &origin{data: testData(1000), ranges: true}
+	o.etag = func(r *http.Request) string {
+		if r.Header.Get("Range") == "bytes=0-0" {
+			return `"v1"`
+		}
+		return `"v2"`
+	}
+	srv := httptest.NewServer(o)
+	defer srv.Close()
+	dest := filepath.Join(t.TempDir(), "initrd")
+
+	_, err := testFetcher().File(context.Background(), srv.URL, dest, nil)
+	if err == nil || !strings.Contains(err.Error(), errChanged.Error()) {
+		t.Fatalf("error = %v, want %v", err, errChanged)
+	}
+	left, _ := filepath.Glob(dest + "*")
+	if len(left) != 0 {
+		t.Errorf("left behind %v", left)
+	}
+}
+
+func TestFileErrors(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+	dir := t.TempDir()
+	if _, err := testFetcher().File(context.Background(), srv.URL, filepath.Join(dir, "x"), nil); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("error = %v, want 404", err)
+	}
+	if _, err := testFetcher().File(context.Background(), "://bad", filepath.Join(dir, "x"), nil); err == nil {
+		t.Error("bad URL accepted")
+	}
+}
+
+func TestLoadState(t *testing.T) {
+	const url, validator, size = "http://mirror/x", `"v1"`, 100
+	tests := []struct {
+		name   string
+		chunks []chunk
+		ok     bool
+	}{
+		{"whole", []chunk{{0, 100, 10}}, true},
+		{"split", []chunk{{0, 50, 50}, {50, 100, 0}}, true},
+		{"none", nil, false},
+		{"gap", []chunk{{0, 40, 0}, {50, 100, 0}}, false},
+		{"overlap", []chunk{{0, 60, 0}, {50, 100, 0}}, false},
+		{"short", []chunk{{0, 90, 0}}, false},
+		{"past the end", []chunk{{0, 200, 0}}, false},
+		{"backwards", []chunk{{0, 50, 0}, {50, 40, 0}, {40, 100, 0}}, false},
+		{"negative done", []chunk{{0, 100, -5}}, false},
+		{"overdone", []chunk{{0, 100, 101}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			meta := filepath.Join(t.TempDir(), "x.part.json")
+			os.WriteFile(strings.TrimSuffix(meta, ".json"), nil, 0o644)
+			data, _ := json.Marshal(state{URL: url, Validator: validator, Size: size, Chunks: tt.chunks})
+			os.WriteFile(meta, data, 0o644)
+			if _, ok := loadState(meta, url, validator, size); ok != tt.ok {
+				t.Errorf("loadState = %v, want %v", ok, tt.ok)
+			}
+		})
+	}
+
+	meta := filepath.Join(t.TempDir(), "x.part.json")
+	os.WriteFile(meta, []byte("{"), 0o644)
+	if _, ok := loadState(meta, url, validator, size); ok {
+		t.Error("corrupt state loaded")
+	}
+}
+
+func TestNewState(t *testing.T) {
+	st := newState("u", "v", 10, 4)
+	var next int64
+	for _, c := range st.Chunks {
+		if c.Start != next {
+			t.Fatalf("chunks = %+v", st.Chunks)
+		}
+		next = c.End
+	}
+	if len(st.Chunks) != 4 || next != 10 {
+		t.Errorf("chunks = %+v", st.Chunks)
+	}
+}
@@ -0,0 +1,66 @@
+package fetch
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limiter caps throughput in bytes per second, allowing bursts of up to a
+// second's worth
+type Limiter struct {
+	rate float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter creates a limiter allowing rate bytes per second
+func NewLimiter(rate int64) *Limiter {
+	return &Limiter{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// Wait blocks until n more bytes may pass. A nil limiter never blocks.
+func (l *Limiter) Wait(n int) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = min(l.rate, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	deficit := -l.tokens
+	l.mu.Unlock()
+	if deficit > 0 {
+		time.Sleep(time.Duration(deficit / l.rate * float64(time.Second)))
+	}
+}
+
+// ParseRate parses a bandwidth such as "500K", "20M" or "1G" (bytes per
+// second, binary multiples)
+func ParseRate(rate string) (int64, error) {
+	s := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(rate)), "B")
+	mult := int64(1)
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'K':
+			mult, s = 1<<10, s[:n-1]
+		case 'M':
+			mult, s = 1<<20, s[:n-1]
+		case 'G':
+			mult, s = 1<<30, s[:n-1]
+		}
+	}
+	// The comparison also turns away NaN, and a rate that rounds to zero
+	// would have Wait sleep forever
+	v, err := strconv.ParseFloat(s, 64)
+	if bytes := v * float64(mult); err != nil || !(bytes >= 1 && bytes < math.MaxInt64) {
+		return 0, fmt.Errorf("invalid rate %q (want e.g. 500K, 20M or 1G)", rate)
+	}
+	return int64(v * float64(mult)), nil
+}
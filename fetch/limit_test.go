@@ -0,0 +1,52 @@
+package fetch
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+	}{
+		{"500", 500},
+		{"500K", 500 << 10},
+		{"20m", 20 << 20},
+		{" 1G ", 1 << 30},
+		{"1.5MB", 3 << 19},
+		{"", 0},
+		{"K", 0},
+		{"0", 0},
+		{"-5M", 0},
+		{"0.1", 0},
+		{"NaN", 0},
+		{"Inf", 0},
+		{"1e30G", 0},
+		{"fast", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseRate(tt.in)
+			if got != tt.want || (err != nil) != (tt.want == 0) {
+				t.Errorf("ParseRate = %d, %v; want %d", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	var none *Limiter
+	none.Wait(1 << 30)
+
+	l := NewLimiter(1000)
+	start := time.Now()
+	l.Wait(1000) // the first second's burst
+	if d := time.Since(start); d > 50*time.Millisecond {
+		t.Errorf("burst waited %s", d)
+	}
+	l.Wait(100)
+	if d := time.Since(start); d < 80*time.Millisecond {
+		t.Errorf("over the rate waited only %s", d)
+	}
+}
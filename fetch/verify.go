@@ -0,0 +1,266 @@
+package fetch
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Verification levels, weakest first
+const (
+	Unverified = "unverified" // no checksum list names the file
+	Checksum   = "checksum"   // it matches an unsigned checksum list, or one no keyring checks
+	Signed     = "signed"     // it matches a checksum list signed by a key in the keyring
+)
+
+// Levels are the verification levels, weakest first
+var Levels = []string{Unverified, Checksum, Signed}
+
+// SumsNames are the checksum lists looked for beside a file and in the
+// directories above it: Debian and Ubuntu's, and the BSD-style ones of
+// Fedora and the RHEL family
+var SumsNames = []string{"SHA256SUMS", "CHECKSUM"}
+
+// sumsDepth is how many directories above a file are searched
+const sumsDepth = 3
+
+// signatureExts are the detached signatures of a checksum list looked for
+var signatureExts = []string{".gpg", ".asc", ".sig"}
+
+// ErrMismatch means a checksum list names the file with another checksum
+var ErrMismatch = errors.New("checksum mismatch")
+
+// Verification is what is known of a downloaded file's integrity
+type Verification struct {
+	URL    string    `json:"url"`
+	Size   int64     `json:"size"`
+	SHA256 string    `json:"sha256"`
+	Level  string    `json:"verified"`
+	Sums   string    `json:"sums,omitempty"`      // checksum list it matched
+	Signer string    `json:"signature,omitempty"` // signature of the list, if checked
+	Time   time.Time `json:"time"`
+}
+
+// Recorder keeps the verification of downloads, by where they were put
+type Recorder interface {
+	Record(dest string, v Verification)
+}
+
+// Verified downloads url to dest like File, but only moves it into place
+// once its SHA-256 is checked against a checksum list: sums, such as a
+// release's published checksums, then SHA256SUMS and CHECKSUM files beside
+// the file and up to three directories above it. With a Keyring, a list's
+// signature, inline or in a detached .gpg, .asc or .sig beside it, is
+// checked with gpgv. A file whose checksum differs from a list's, or whose
+// list's signature is bad, or that doesn't reach the fetcher's Require
+// level, is deleted.
+func (f *Fetcher) Verified(ctx context.Context, url, dest string, header http.Header, sums ...string) (Verification, error) {
+	staged := filepath.Join(filepath.Dir(dest), "."+filepath.Base(dest)+".unverified")
+	n, err := f.File(ctx, url, staged, header)
+	if err != nil {
+		return Verification{}, err
+	}
+	v, err := f.verify(ctx, url, staged, header, sums)
+	if err == nil && slices.Index(Levels, v.Level) < slices.Index(Levels, f.Require) {
+		err = fmt.Errorf("%s is %s, %s required", url, v.Level, f.Require)
+	}
+	if err != nil {
+		os.Remove(staged)
+		return v, err
+	}
+	v.Size = n
+	if err := os.Rename(staged, dest); err != nil {
+		os.Remove(staged)
+		return v, err
+	}
+	if v.Level == Unverified {
+		log.Printf("[FETCH] %s: no checksum found, keeping it unverified", url)
+	}
+	if f.Catalog != nil {
+		f.Catalog.Record(dest, v)
+	}
+	return v, nil
+}
+
+// verify finds the first checksum list naming the file at url and checks
+// the download, file, against it
+func (f *Fetcher) verify(ctx context.Context, rawURL, file string, header http.Header, sums []string) (Verification, error) {
+	v := Verification{URL: rawURL, Level: Unverified, Time: time.Now()}
+	sum, err := sha256File(file)
+	if err != nil {
+		return v, err
+	}
+	v.SHA256 = sum
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return v, err
+	}
+	u.RawQuery, u.Fragment = "", ""
+	type list struct {
+		url  string
+		name string // the file's name in it
+	}
+	var lists []list
+	for _, s := range sums {
+		lists = append(lists, list{s, path.Base(u.Path)})
+	}
+	dir, rel := path.Dir(u.Path), path.Base(u.Path)
+	for range sumsDepth + 1 {
+		for _, name := range SumsNames {
+			l := *u
+			l.Path = path.Join(dir, name)
+			lists = append(lists, list{l.String(), rel})
+		}
+		if dir == "/" || dir == "." {
+			break
+		}
+		dir, rel = path.Dir(dir), path.Base(dir)+"/"+rel
+	}
+
+	for _, l := range lists {
+		data, err := f.small(ctx, l.url, header)
+		if err != nil {
+			continue
+		}
+		want, ok := parseSums(data)[l.name]
+		if !ok {
+			continue
+		}
+		if !strings.EqualFold(want, sum) {
+			return v, fmt.Errorf("%s: %w with %s", rawURL, ErrMismatch, l.url)
+		}
+		v.Level, v.Sums = Checksum, l.url
+		if f.Keyring == "" {
+			return v, nil
+		}
+		signer, err := f.checkSignature(ctx, l.url, data, header)
+		if err != nil {
+			return v, fmt.Errorf("%s: %w", l.url, err)
+		}
+		if signer != "" {
+			v.Level, v.Signer = Signed, signer
+		}
+		return v, nil
+	}
+	return v, nil
+}
+
+// checkSignature checks a checksum list's inline or detached signature
+// with gpgv, and returns where the signature was, or "" if it has none
+func (f *Fetcher) checkSignature(ctx context.Context, listURL string, data []byte, header http.Header) (string, error) {
+	tmp, err := os.MkdirTemp("", "go-pxe-sums-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+	list := filepath.Join(tmp, "sums")
+	if err := os.WriteFile(list, data, 0o600); err != nil {
+		return "", err
+	}
+	args := []string{list}
+	signer := listURL
+	if !bytes.HasPrefix(data, []byte(clearsigned)) {
+		signer = ""
+		for _, ext := range signatureExts {
+			if sig, err := f.small(ctx, listURL+ext, header); err == nil {
+				file := filepath.Join(tmp, "sums"+ext)
+				if err := os.WriteFile(file, sig, 0o600); err != nil {
+					return "", err
+				}
+				args, signer = []string{file, list}, listURL+ext
+				break
+			}
+		}
+		if signer == "" {
+			return "", nil
+		}
+	}
+	keyring, err := filepath.Abs(f.Keyring)
+	if err != nil {
+		return "", err
+	}
+	out, err := exec.CommandContext(ctx, "gpgv", append([]string{"--keyring", keyring}, args...)...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("bad signature %s: %v: %s", signer, err, bytes.TrimSpace(out))
+	}
+	return signer, nil
+}
+
+// small fetches a checksum list or signature, which fits in memory
+func (f *Fetcher) small(ctx context.Context, url string, header http.Header) ([]byte, error) {
+	req, err := newRequest(ctx, "GET", url, header)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := f.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 4<<20))
+}
+
+const clearsigned = "-----BEGIN PGP SIGNED MESSAGE-----"
+
+// bsdSum is a line of a BSD-style list: SHA256 (name) = checksum
+var bsdSum = regexp.MustCompile(`^SHA256 \((.+)\) = ([0-9a-fA-F]{64})$`)
+
+// parseSums reads the SHA-256 checksums of a list by file name, in the
+// GNU format of sha256sum ("checksum  name", "*name" for binary) or the
+// BSD one, ignoring the armor of a clearsigned list
+func parseSums(data []byte) map[string]string {
+	sums := make(map[string]string)
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "-----BEGIN PGP SIGNATURE-----" {
+			break
+		}
+		if m := bsdSum.FindStringSubmatch(line); m != nil {
+			sums[path.Clean(m[1])] = m[2]
+			continue
+		}
+		sum, name, ok := strings.Cut(line, " ")
+		if !ok || len(sum) != 64 {
+			continue
+		}
+		if _, err := hex.DecodeString(sum); err != nil {
+			continue
+		}
+		sums[path.Clean(strings.TrimPrefix(strings.TrimLeft(name, " "), "*"))] = sum
+	}
+	return sums
+}
+
+func sha256File(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
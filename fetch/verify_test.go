@@ -0,0 +1,203 @@
+package fetch
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func sha(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestParseSums(t *testing.T) {
+	k, i := sha("kernel"), sha("initrd")
+	list := strings.Join([]string{
+		clearsigned,
+		"Hash: SHA256",
+		"",
+		k + "  images/pxeboot/vmlinuz",
+		i + " *initrd.img",
+		"SHA256 (Fedora-40.iso) = " + strings.ToUpper(k),
+		"SHA256 (./odd) = " + i,
+		"# comment",
+		"MD5 (x) = d41d8cd98f00b204e9800998ecf8427e",
+		"tooshort  name",
+		strings.Repeat("zz", 32) + "  nothex",
+		k,
+		"-----BEGIN PGP SIGNATURE-----",
+		i + "  after-signature",
+	}, "\n")
+	got := parseSums([]byte(list))
+	want := map[string]string{
+		"images/pxeboot/vmlinuz": k,
+		"initrd.img":             i,
+		"Fedora-40.iso":          strings.ToUpper(k),
+		"odd":                    i,
+	}
+	if len(got) != len(want) {
+		t.Errorf("parseSums = %v", got)
+	}
+	for name, sum := range want {
+		if got[name] != sum {
+			t.Errorf("%s = %q, want %q", name, got[name], sum)
+		}
+	}
+}
+
+// mirror serves files by path
+func mirror(t *testing.T, files map[string]string) string {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(data))
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+type catalog map[string]Verification
+
+func (c catalog) Record(dest string, v Verification) { c[dest] = v }
+
+func TestVerified(t *testing.T) {
+	const kernel = "kernel"
+	tests := []struct {
+		name    string
+		files   map[string]string
+		sums    []string
+		require string
+		level   string
+		list    string
+		err     error
+	}{
+		{"beside", map[string]string{"/f/40/os/vmlinuz": kernel, "/f/40/os/SHA256SUMS": sha(kernel) + "  vmlinuz\n"}, nil, "", Checksum, "/f/40/os/SHA256SUMS", nil},
+		{"above", map[string]string{"/f/40/os/vmlinuz": kernel, "/f/40/CHECKSUM": "SHA256 (os/vmlinuz) = " + sha(kernel) + "\n"}, nil, "", Checksum, "/f/40/CHECKSUM", nil},
+		{"named", map[string]string{"/f/40/os/vmlinuz": kernel, "/release.sums": sha(kernel) + "  vmlinuz\n"}, []string{"/release.sums"}, "", Checksum, "/release.sums", nil},
+		{"other files only", map[string]string{"/f/40/os/vmlinuz": kernel, "/f/40/os/SHA256SUMS": sha("x") + "  initrd.img\n"}, nil, "", Unverified, "", nil},
+		{"none", map[string]string{"/f/40/os/vmlinuz": kernel}, nil, "", Unverified, "", nil},
+		{"mismatch", map[string]string{"/f/40/os/vmlinuz": kernel, "/f/40/os/SHA256SUMS": sha("tampered") + "  vmlinuz\n"}, nil, "", "", "", ErrMismatch},
+		{"below required", map[string]string{"/f/40/os/vmlinuz": kernel}, nil, Checksum, "", "", errors.New("unverified, checksum required")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := mirror(t, tt.files)
+			f := testFetcher()
+			if tt.require != "" {
+				f.Require = tt.require
+			}
+			cat := catalog{}
+			f.Catalog = cat
+			var sums []string
+			for _, s := range tt.sums {
+				sums = append(sums, base+s)
+			}
+			dest := filepath.Join(t.TempDir(), "vmlinuz")
+
+			v, err := f.Verified(context.Background(), base+"/f/40/os/vmlinuz", dest, nil, sums...)
+			if tt.err != nil {
+				if err == nil || (!errors.Is(err, tt.err) && !strings.Contains(err.Error(), tt.err.Error())) {
+					t.Fatalf("error = %v, want %v", err, tt.err)
+				}
+				left, _ := filepath.Glob(filepath.Join(filepath.Dir(dest), "*"))
+				if len(left) != 0 || len(cat) != 0 {
+					t.Errorf("left behind %v, cataloged %v", left, cat)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantList := ""
+			if tt.list != "" {
+				wantList = base + tt.list
+			}
+			if v.Level != tt.level || v.Sums != wantList || v.SHA256 != sha(kernel) || v.Size != int64(len(kernel)) {
+				t.Errorf("verification = %+v", v)
+			}
+			if data, _ := os.ReadFile(dest); string(data) != kernel {
+				t.Errorf("dest = %q", data)
+			}
+			if cat[dest] != v {
+				t.Errorf("cataloged %+v", cat)
+			}
+		})
+	}
+}
+
+// fakeGPGV puts a gpgv on PATH that accepts signatures if good is set
+func fakeGPGV(t *testing.T, good bool) {
+	dir := t.TempDir()
+	status := "1"
+	if good {
+		status = "0"
+	}
+	script := "#!/bin/sh\necho gpgv $*\nexit " + status + "\n"
+	if err := os.WriteFile(filepath.Join(dir, "gpgv"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestVerifiedSigned(t *testing.T) {
+	const kernel = "kernel"
+	list := sha(kernel) + "  vmlinuz\n"
+	tests := []struct {
+		name   string
+		files  map[string]string
+		good   bool
+		level  string
+		signer string
+		err    string
+	}{
+		{"detached", map[string]string{"/SHA256SUMS.asc": "sig"}, true, Signed, "/SHA256SUMS.asc", ""},
+		{"inline", map[string]string{"/SHA256SUMS": clearsigned + "\n\n" + list}, true, Signed, "/SHA256SUMS", ""},
+		{"unsigned", nil, true, Checksum, "", ""},
+		{"bad signature", map[string]string{"/SHA256SUMS.gpg": "sig"}, false, "", "", "bad signature"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeGPGV(t, tt.good)
+			files := map[string]string{"/vmlinuz": kernel, "/SHA256SUMS": list}
+			for k, v := range tt.files {
+				files[k] = v
+			}
+			base := mirror(t, files)
+			f := testFetcher()
+			f.Keyring = filepath.Join(t.TempDir(), "keyring.gpg")
+			dest := filepath.Join(t.TempDir(), "vmlinuz")
+
+			v, err := f.Verified(context.Background(), base+"/vmlinuz", dest, nil)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("error = %v, want %q", err, tt.err)
+				}
+				if _, err := os.Stat(dest); err == nil {
+					t.Error("badly signed file kept")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			signer := ""
+			if tt.signer != "" {
+				signer = base + tt.signer
+			}
+			if v.Level != tt.level || v.Signer != signer {
+				t.Errorf("verification = %+v", v)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/ars1364/go-pxe/inventory"
+)
+
+// generateFirmware backs firmware/update.sh, which the updater
+// environment of a host booting a firmware update runs
+func (d *domain) generateFirmware(name string, ip net.IP) ([]byte, bool) {
+	h, p, _ := d.store.ProfileFor(d.leaseMAC(ip))
+	if name != "firmware/update.sh" || p.Firmware == nil {
+		return nil, false
+	}
+	return updateScript(h.Name, p, d.cfg.httpURL()), true
+}
+
+// updateScript reports the firmware the host runs and, if go-pxe answers
+// update, loads the profile's capsules through the kernel's capsule loader
+// for the firmware to apply as the host reboots. A capsule that fails to
+// load leaves the host in the updater, with the rest unloaded.
+func updateScript(who string, p inventory.Profile, server string) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "#!/bin/sh\n# %s, profile %s, firmware %s (generated by go-pxe)\n", who, p.Name, p.Firmware.Version)
+	fmt.Fprintf(&b, "server=%s\n", server)
+	b.WriteString(`have=$(cat /sys/class/dmi/id/bios_version)
+action=$(curl -sf --retry 5 --data-binary "$have" "$server/firmware")
+echo "Firmware $have: ${action:-no answer}"
+if [ "$action" = update ]; then
+	[ -e /dev/efi_capsule_loader ] || modprobe capsule-loader
+	for capsule in`)
+	for _, c := range p.Firmware.Capsules {
+		fmt.Fprintf(&b, " '%s'", path.Clean("/" + c)[1:])
+	}
+	b.WriteString(`; do
+		echo "Loading $capsule"
+		curl -sf -o /tmp/capsule "$server/$capsule" && cat /tmp/capsule > /dev/efi_capsule_loader || { echo "Cannot load $capsule"; exit 1; }
+	done
+fi
+reboot -f
+`)
+	return []byte(b.String())
+}
+
+// reportFirmware takes the firmware version a host's updater reports, and
+// answers update, done, or failed once the host is given up on:
+//
+//	curl -sf --data-binary "$(cat /sys/class/dmi/id/bios_version)" http://10.0.0.1:8080/firmware
+func (d *domain) reportFirmware(w http.ResponseWriter, r *http.Request) {
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	h, p, _ := d.store.ProfileFor(d.leaseMAC(net.ParseIP(host)))
+	if h.Name == "" {
+		http.Error(w, "not an inventory host", http.StatusNotFound)
+		return
+	}
+	data, err := io.ReadAll(io.LimitReader(r.Body, 1024))
+	version := strings.TrimSpace(string(data))
+	if err != nil || version == "" {
+		http.Error(w, "no firmware version", http.StatusBadRequest)
+		return
+	}
+	target := ""
+	if p.Firmware != nil {
+		target = p.Firmware.Version
+	}
+	fr, ok := d.store.ReportFirmware(h.Name, version, target, time.Now())
+	if !ok {
+		http.Error(w, "not an inventory host", http.StatusNotFound)
+		return
+	}
+	h.Firmware = &fr
+	action := "done"
+	switch done, failed := h.Updated(p); {
+	case target == "":
+		log.Printf("[FIRMWARE] %s: %s runs firmware %s", d.cfg.Name, h.Name, version)
+	case done:
+		log.Printf("[FIRMWARE] %s: %s runs firmware %s, and boots from disk from now on", d.cfg.Name, h.Name, version)
+	case failed:
+		action = "failed"
+		log.Printf("[FIRMWARE] %s: %s still runs firmware %s after %d updates to %s, and boots from disk from now on", d.cfg.Name, h.Name, version, inventory.FirmwareTries, target)
+	default:
+		action = "update"
+		log.Printf("[FIRMWARE] %s: %s runs firmware %s, updating it to %s (try %d of %d)", d.cfg.Name, h.Name, version, target, fr.Tries, inventory.FirmwareTries)
+	}
+	fmt.Fprintln(w, action)
+}
@@ -0,0 +1,250 @@
+package foreman
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/ars1364/go-pxe/inventory"
+)
+
+// managedLabel marks hosts the proxy created for a reservation, so deleting
+// the reservation deletes the host. Reservations on hosts defined elsewhere
+// only set and clear the address and boot file.
+const managedLabel = "managedBy"
+
+// record is a smart-proxy DHCP record
+type record struct {
+	Name       string `json:"name,omitempty"`
+	Hostname   string `json:"hostname,omitempty"`
+	IP         string `json:"ip"`
+	MAC        string `json:"mac"`
+	Subnet     string `json:"subnet"`
+	Type       string `json:"type"` // "reservation" or "lease"
+	State      string `json:"state,omitempty"`
+	Filename   string `json:"filename,omitempty"`
+	NextServer string `json:"nextServer,omitempty"`
+	Deleteable bool   `json:"deleteable,omitempty"`
+}
+
+func (s *Server) subnetName() string {
+	return s.Subnet.IP.String() + "/" + net.IP(s.Subnet.Mask).String()
+}
+
+func (s *Server) subnets(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, []map[string]any{{
+		"network": s.Subnet.IP.String(),
+		"netmask": net.IP(s.Subnet.Mask).String(),
+		"options": map[string]any{
+			"range": []string{s.RangeStart.String(), s.RangeEnd.String()},
+		},
+	}})
+}
+
+// inSubnet checks the {network} of the path names the served subnet
+func (s *Server) inSubnet(w http.ResponseWriter, r *http.Request) bool {
+	if ip := net.ParseIP(r.PathValue("network")); ip == nil || !ip.Equal(s.Subnet.IP) {
+		http.Error(w, fmt.Sprintf("Subnet %s not found", r.PathValue("network")), http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+// records lists reservations followed by leases
+func (s *Server) records() []record {
+	var list []record
+	for _, h := range s.store.Hosts() {
+		if h.IP == "" {
+			continue
+		}
+		list = append(list, record{
+			Name: h.Name, Hostname: h.Name, IP: h.IP, MAC: h.MAC, Subnet: s.subnetName(),
+			Type: "reservation", Filename: h.BootFile, NextServer: s.ServerIP.String(), Deleteable: true,
+		})
+	}
+	for _, l := range s.Leases() {
+		rec := record{IP: l.IP, MAC: l.MAC, Subnet: s.subnetName(), Type: "lease", State: "active"}
+		if mac, err := net.ParseMAC(l.MAC); err == nil {
+			if h, ok := s.store.HostByMAC(mac); ok {
+				rec.Name, rec.Hostname = h.Name, h.Name
+			}
+		}
+		list = append(list, rec)
+	}
+	return list
+}
+
+func (s *Server) subnet(w http.ResponseWriter, r *http.Request) {
+	if !s.inSubnet(w, r) {
+		return
+	}
+	reservations, leases := []record{}, []record{}
+	for _, rec := range s.records() {
+		if rec.Type == "reservation" {
+			reservations = append(reservations, rec)
+		} else {
+			leases = append(leases, rec)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"reservations": reservations, "leases": leases})
+}
+
+func (s *Server) recordByMAC(w http.ResponseWriter, r *http.Request) {
+	if !s.inSubnet(w, r) {
+		return
+	}
+	mac, err := net.ParseMAC(r.PathValue("mac"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, rec := range s.records() {
+		if rec.MAC == mac.String() {
+			writeJSON(w, http.StatusOK, rec)
+			return
+		}
+	}
+	http.Error(w, fmt.Sprintf("No record for %s", mac), http.StatusNotFound)
+}
+
+func (s *Server) recordsByIP(w http.ResponseWriter, r *http.Request) {
+	if !s.inSubnet(w, r) {
+		return
+	}
+	ip := net.ParseIP(r.PathValue("ip"))
+	var found []record
+	for _, rec := range s.records() {
+		if ip.Equal(net.ParseIP(rec.IP)) {
+			found = append(found, rec)
+		}
+	}
+	if len(found) == 0 {
+		http.Error(w, fmt.Sprintf("No record for %s", r.PathValue("ip")), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, found)
+}
+
+// unusedIP suggests a free address between ?from and ?to (default the
+// pool), or the address ?mac already holds
+func (s *Server) unusedIP(w http.ResponseWriter, r *http.Request) {
+	if !s.inSubnet(w, r) {
+		return
+	}
+	used := map[string]bool{s.ServerIP.String(): true}
+	mac, _ := net.ParseMAC(r.FormValue("mac"))
+	for _, rec := range s.records() {
+		if mac != nil && rec.MAC == mac.String() {
+			writeJSON(w, http.StatusOK, map[string]string{"ip": rec.IP})
+			return
+		}
+		used[rec.IP] = true
+	}
+
+	from, to := s.RangeStart.To4(), s.RangeEnd.To4()
+	if v := net.ParseIP(r.FormValue("from")).To4(); v != nil {
+		from = v
+	}
+	if v := net.ParseIP(r.FormValue("to")).To4(); v != nil {
+		to = v
+	}
+	// Clamp to the subnet's host addresses, so a wide ?from-?to can't walk
+	// the whole address space or offer the network or broadcast address
+	network := binary.BigEndian.Uint32(s.Subnet.IP.To4())
+	broadcast := network | ^binary.BigEndian.Uint32(net.IP(s.Subnet.Mask).To4())
+	lo := max(binary.BigEndian.Uint32(from), network+1)
+	hi := min(binary.BigEndian.Uint32(to), broadcast-1)
+	for n := lo; n <= hi; n++ {
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, n)
+		if !used[ip.String()] {
+			writeJSON(w, http.StatusOK, map[string]string{"ip": ip.String()})
+			return
+		}
+	}
+	http.Error(w, "No free address in range", http.StatusNotFound)
+}
+
+// addReservation pins ip to mac, creating an inventory host named after
+// the Foreman host unless one with that MAC is already defined
+func (s *Server) addReservation(w http.ResponseWriter, r *http.Request) {
+	if !s.inSubnet(w, r) {
+		return
+	}
+	name := r.FormValue("hostname")
+	if name == "" {
+		name = r.FormValue("name")
+	}
+	mac, err := net.ParseMAC(r.FormValue("mac"))
+	ip := net.ParseIP(r.FormValue("ip")).To4()
+	if err != nil || ip == nil || name == "" {
+		http.Error(w, "Need hostname, ip and mac", http.StatusBadRequest)
+		return
+	}
+	if !s.Subnet.Contains(ip) {
+		http.Error(w, fmt.Sprintf("%s is outside subnet %s", ip, s.subnetName()), http.StatusBadRequest)
+		return
+	}
+	for _, rec := range s.records() {
+		if rec.IP == ip.String() && rec.MAC != mac.String() {
+			http.Error(w, fmt.Sprintf("%s is already in use by %s", ip, rec.MAC), http.StatusConflict)
+			return
+		}
+	}
+
+	h, existed := s.store.HostByMAC(mac)
+	before := h
+	if !existed {
+		h = inventory.Host{Name: name, MAC: mac.String(), Labels: map[string]string{managedLabel: "foreman"}}
+	}
+	h.IP, h.BootFile = ip.String(), r.FormValue("filename")
+	if err := s.store.PutHost(h); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	log.Printf("[FOREMAN] %s: reserved %s for %s (%s)", s.Domain, ip, mac, h.Name)
+	var prev any
+	if existed {
+		prev = before.Redacted()
+	}
+	s.Audit.Record(actor(r), s.Domain, "host.put", h.Name, prev, h.Redacted())
+}
+
+// deleteReservation drops the reservation named by {mac} or {ip}
+func (s *Server) deleteReservation(w http.ResponseWriter, r *http.Request) {
+	if !s.inSubnet(w, r) {
+		return
+	}
+	var h inventory.Host
+	found := false
+	if v := r.PathValue("mac"); v != "" {
+		if mac, err := net.ParseMAC(v); err == nil {
+			h, found = s.store.HostByMAC(mac)
+		}
+	} else {
+		ip := net.ParseIP(r.PathValue("ip"))
+		for _, x := range s.store.Hosts() {
+			if x.IP != "" && ip.Equal(net.ParseIP(x.IP)) {
+				h, found = x, true
+				break
+			}
+		}
+	}
+	if !found || h.IP == "" {
+		http.Error(w, "No such reservation", http.StatusNotFound)
+		return
+	}
+
+	before := h
+	if h.Labels[managedLabel] == "foreman" {
+		s.store.DeleteHost(h.Name)
+		s.Audit.Record(actor(r), s.Domain, "host.delete", h.Name, before.Redacted(), nil)
+	} else {
+		h.IP, h.BootFile = "", ""
+		s.store.PutHost(h)
+		s.Audit.Record(actor(r), s.Domain, "host.put", h.Name, before.Redacted(), h.Redacted())
+	}
+	log.Printf("[FOREMAN] %s: released %s from %s (%s)", s.Domain, before.IP, before.MAC, h.Name)
+}
@@ -0,0 +1,171 @@
+// Package foreman serves the subset of the Foreman smart-proxy REST API
+// covering its TFTP and DHCP modules, so a Foreman server can register
+// go-pxe as the provisioning proxy of a subnet.
+package foreman
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/ars1364/go-pxe/audit"
+	"github.com/ars1364/go-pxe/dhcp"
+	"github.com/ars1364/go-pxe/inventory"
+)
+
+// Version is the smart-proxy release whose API this mirrors, reported to
+// Foreman so it enables the matching features
+const Version = "3.9.0"
+
+// Server is a smart proxy for one provisioning domain
+type Server struct {
+	// Domain labels audit records and log lines
+	Domain string
+
+	// TFTPRoot receives boot menus and fetched kernels
+	TFTPRoot string
+
+	// ServerIP is the TFTP server and DHCP next-server Foreman templates
+	// point clients at
+	ServerIP net.IP
+
+	// Subnet and the pool RangeStart-RangeEnd describe the DHCP subnet;
+	// Leases lists the addresses handed out so far
+	Subnet     *net.IPNet
+	RangeStart net.IP
+	RangeEnd   net.IP
+	Leases     func() []dhcp.Lease
+
+	// Trusted, if set, limits access to these client networks; smart
+	// proxies have no users, so this is the only access control
+	Trusted []*net.IPNet
+
+	// Audit, if set, records reservation and boot menu changes
+	Audit *audit.Log
+
+	store *inventory.Store
+	mux   *http.ServeMux
+}
+
+// NewServer creates a proxy keeping DHCP reservations as hosts in store
+func NewServer(store *inventory.Store, tftpRoot string) *Server {
+	s := &Server{TFTPRoot: tftpRoot, store: store, mux: http.NewServeMux()}
+
+	s.mux.HandleFunc("GET /features", s.features)
+	s.mux.HandleFunc("GET /v2/features", s.featuresV2)
+	s.mux.HandleFunc("GET /version", s.version)
+
+	s.mux.HandleFunc("GET /tftp/serverName", s.serverName)
+	s.mux.HandleFunc("POST /tftp/create_default", s.createDefault)
+	s.mux.HandleFunc("POST /tftp/create_default/{variant}", s.createDefault)
+	s.mux.HandleFunc("POST /tftp/fetch_boot_file", s.fetchBootFile)
+	s.mux.HandleFunc("GET /tftp/{variant}/{mac}", s.getConfig)
+	s.mux.HandleFunc("POST /tftp/{variant}/{mac}", s.putConfig)
+	s.mux.HandleFunc("DELETE /tftp/{variant}/{mac}", s.deleteConfig)
+
+	s.mux.HandleFunc("GET /dhcp", s.subnets)
+	s.mux.HandleFunc("GET /dhcp/{network}", s.subnet)
+	s.mux.HandleFunc("GET /dhcp/{network}/unused_ip", s.unusedIP)
+	s.mux.HandleFunc("GET /dhcp/{network}/mac/{mac}", s.recordByMAC)
+	s.mux.HandleFunc("GET /dhcp/{network}/ip/{ip}", s.recordsByIP)
+	s.mux.HandleFunc("POST /dhcp/{network}", s.addReservation)
+	s.mux.HandleFunc("DELETE /dhcp/{network}/mac/{mac}", s.deleteReservation)
+	s.mux.HandleFunc("DELETE /dhcp/{network}/ip/{ip}", s.deleteReservation)
+	return s
+}
+
+// ParseTrusted parses a list of addresses and CIDR networks for Trusted
+func ParseTrusted(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, v := range list {
+		v = strings.TrimSpace(v)
+		if !strings.Contains(v, "/") {
+			if ip := net.ParseIP(v); ip != nil && ip.To4() != nil {
+				v += "/32"
+			} else {
+				v += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("trusted host %q: %w", v, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.trusted(r) {
+		log.Printf("[FOREMAN] %s: rejected %s %s from untrusted %s", s.Domain, r.Method, r.URL.Path, r.RemoteAddr)
+		http.Error(w, "Untrusted client", http.StatusForbidden)
+		return
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) trusted(r *http.Request) bool {
+	if s.Trusted == nil {
+		return true
+	}
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	ip := net.ParseIP(host)
+	for _, n := range s.Trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ListenAndServe serves the proxy API on addr
+func (s *Server) ListenAndServe(addr string) error {
+	if s.Trusted == nil {
+		log.Printf("[FOREMAN] %s: WARNING: no trusted hosts configured, anyone who can reach %s can change DHCP and boot menus", s.Domain, addr)
+	}
+	log.Printf("[FOREMAN] %s: smart proxy listening on %s", s.Domain, addr)
+	return http.ListenAndServe(addr, s)
+}
+
+func (s *Server) features(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, []string{"dhcp", "tftp"})
+}
+
+// featuresV2 is what Foreman 1.20 and later ask for first
+func (s *Server) featuresV2(w http.ResponseWriter, r *http.Request) {
+	module := func(settings map[string]any) map[string]any {
+		return map[string]any{
+			"http_enabled":  true,
+			"https_enabled": false,
+			"settings":      settings,
+			"state":         "running",
+			"capabilities":  []string{},
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"dhcp": module(map[string]any{"use_provider": "dhcp_gopxe"}),
+		"tftp": module(map[string]any{"tftp_servername": s.ServerIP.String()}),
+	})
+}
+
+func (s *Server) version(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"version": Version,
+		"modules": map[string]string{"dhcp": Version, "tftp": Version},
+	})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// actor attributes audit records to the calling Foreman
+func actor(r *http.Request) string {
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	return "foreman:" + host
+}
@@ -0,0 +1,347 @@
+package foreman
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ars1364/go-pxe/dhcp"
+	"github.com/ars1364/go-pxe/inventory"
+)
+
+func newServer(t *testing.T) (*Server, *inventory.Store) {
+	t.Helper()
+	store := inventory.NewStore()
+	s := NewServer(store, t.TempDir())
+	s.Domain = "test"
+	s.ServerIP = net.ParseIP("192.168.1.1")
+	_, s.Subnet, _ = net.ParseCIDR("192.168.1.0/24")
+	s.RangeStart, s.RangeEnd = net.ParseIP("192.168.1.100"), net.ParseIP("192.168.1.102")
+	s.Leases = func() []dhcp.Lease {
+		return []dhcp.Lease{{MAC: "aa:bb:cc:dd:ee:01", IP: "192.168.1.100"}}
+	}
+	return s, store
+}
+
+// do sends a request with form values from the client address 10.0.0.5
+func do(s *Server, method, target string, form url.Values) *httptest.ResponseRecorder {
+	var body *strings.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	} else {
+		body = strings.NewReader("")
+	}
+	r := httptest.NewRequest(method, target, body)
+	r.RemoteAddr = "10.0.0.5:4000"
+	if form != nil {
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+func TestParseTrusted(t *testing.T) {
+	nets, err := ParseTrusted([]string{"10.0.0.5", " 192.168.0.0/16", "fd00::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"10.0.0.5/32", "192.168.0.0/16", "fd00::1/128"}
+	for i, n := range nets {
+		if n.String() != want[i] {
+			t.Errorf("net %d = %s, want %s", i, n, want[i])
+		}
+	}
+	if _, err := ParseTrusted([]string{"foreman.example.com"}); err == nil {
+		t.Error("host name accepted")
+	}
+}
+
+func TestTrusted(t *testing.T) {
+	s, _ := newServer(t)
+	if w := do(s, "GET", "/features", nil); w.Code != http.StatusOK {
+		t.Errorf("no trusted list: status %d", w.Code)
+	}
+	s.Trusted, _ = ParseTrusted([]string{"10.0.0.0/24"})
+	if w := do(s, "GET", "/features", nil); w.Code != http.StatusOK {
+		t.Errorf("trusted client: status %d", w.Code)
+	}
+	s.Trusted, _ = ParseTrusted([]string{"10.0.1.0/24"})
+	if w := do(s, "GET", "/features", nil); w.Code != http.StatusForbidden {
+		t.Errorf("untrusted client: status %d, want 403", w.Code)
+	}
+}
+
+func TestReservations(t *testing.T) {
+	s, store := newServer(t)
+
+	tests := []struct {
+		name string
+		form url.Values
+		code int
+	}{
+		{"missing mac", url.Values{"hostname": {"node1"}, "ip": {"192.168.1.10"}}, http.StatusBadRequest},
+		{"missing name", url.Values{"mac": {"aa:bb:cc:dd:ee:02"}, "ip": {"192.168.1.10"}}, http.StatusBadRequest},
+		{"bad ip", url.Values{"hostname": {"node1"}, "mac": {"aa:bb:cc:dd:ee:02"}, "ip": {"nope"}}, http.StatusBadRequest},
+		{"outside subnet", url.Values{"hostname": {"node1"}, "mac": {"aa:bb:cc:dd:ee:02"}, "ip": {"10.1.1.10"}}, http.StatusBadRequest},
+		{"leased to another", url.Values{"hostname": {"node1"}, "mac": {"aa:bb:cc:dd:ee:02"}, "ip": {"192.168.1.100"}}, http.StatusConflict},
+		{"ok", url.Values{"hostname": {"node1"}, "mac": {"aa:bb:cc:dd:ee:02"}, "ip": {"192.168.1.10"}, "filename": {"pxelinux.0"}}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := do(s, "POST", "/dhcp/192.168.1.0", tt.form); w.Code != tt.code {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.code, w.Body)
+			}
+		})
+	}
+	h, ok := store.Host("node1")
+	if !ok || h.IP != "192.168.1.10" || h.BootFile != "pxelinux.0" || h.Labels[managedLabel] != "foreman" {
+		t.Fatalf("host = %+v, %v", h, ok)
+	}
+
+	w := do(s, "GET", "/dhcp/192.168.1.0/mac/aa:bb:cc:dd:ee:02", nil)
+	var rec record
+	if err := json.Unmarshal(w.Body.Bytes(), &rec); err != nil || rec.IP != "192.168.1.10" || rec.Type != "reservation" {
+		t.Errorf("record by MAC = %+v, %v", rec, err)
+	}
+	w = do(s, "GET", "/dhcp/192.168.1.0/ip/192.168.1.100", nil)
+	var recs []record
+	if err := json.Unmarshal(w.Body.Bytes(), &recs); err != nil || len(recs) != 1 || recs[0].Type != "lease" {
+		t.Errorf("records by IP = %+v, %v", recs, err)
+	}
+	if w := do(s, "GET", "/dhcp/192.168.2.0", nil); w.Code != http.StatusNotFound {
+		t.Errorf("other subnet: status %d, want 404", w.Code)
+	}
+
+	if w := do(s, "DELETE", "/dhcp/192.168.1.0/mac/aa:bb:cc:dd:ee:02", nil); w.Code != http.StatusOK {
+		t.Fatalf("delete: status %d", w.Code)
+	}
+	if _, ok := store.Host("node1"); ok {
+		t.Error("managed host survived deleting its reservation")
+	}
+	if w := do(s, "DELETE", "/dhcp/192.168.1.0/mac/aa:bb:cc:dd:ee:02", nil); w.Code != http.StatusNotFound {
+		t.Errorf("second delete: status %d, want 404", w.Code)
+	}
+}
+
+func TestReservationOnDefinedHost(t *testing.T) {
+	s, store := newServer(t)
+	if err := store.PutHost(inventory.Host{Name: "db1", MAC: "aa:bb:cc:dd:ee:03", Profile: "ubuntu"}); err != nil {
+		t.Fatal(err)
+	}
+	form := url.Values{"hostname": {"foreman-name"}, "mac": {"aa:bb:cc:dd:ee:03"}, "ip": {"192.168.1.20"}}
+	if w := do(s, "POST", "/dhcp/192.168.1.0", form); w.Code != http.StatusOK {
+		t.Fatalf("add: status %d: %s", w.Code, w.Body)
+	}
+	if h, _ := store.Host("db1"); h.IP != "192.168.1.20" {
+		t.Errorf("IP = %q", h.IP)
+	}
+	if w := do(s, "DELETE", "/dhcp/192.168.1.0/ip/192.168.1.20", nil); w.Code != http.StatusOK {
+		t.Fatalf("delete: status %d", w.Code)
+	}
+	h, ok := store.Host("db1")
+	if !ok || h.IP != "" || h.Profile != "ubuntu" {
+		t.Errorf("host = %+v, %v; want it kept without an address", h, ok)
+	}
+}
+
+func TestUnusedIP(t *testing.T) {
+	s, store := newServer(t)
+	store.PutHost(inventory.Host{Name: "node1", MAC: "aa:bb:cc:dd:ee:02", IP: "192.168.1.101"})
+
+	tests := []struct {
+		name  string
+		query string
+		code  int
+		ip    string
+	}{
+		{"pool", "", http.StatusOK, "192.168.1.102"},
+		{"held by mac", "?mac=aa:bb:cc:dd:ee:02", http.StatusOK, "192.168.1.101"},
+		{"range", "?from=192.168.1.1&to=192.168.1.5", http.StatusOK, "192.168.1.2"},
+		{"wide range", "?from=0.0.0.1&to=255.255.255.255", http.StatusOK, "192.168.1.2"},
+		{"above subnet", "?from=192.168.2.1&to=255.255.255.255", http.StatusNotFound, ""},
+		{"network address", "?from=192.168.1.0&to=192.168.1.1", http.StatusNotFound, ""},
+		{"inverted", "?from=192.168.1.50&to=192.168.1.40", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := do(s, "GET", "/dhcp/192.168.1.0/unused_ip"+tt.query, nil)
+			if w.Code != tt.code {
+				t.Fatalf("status %d, want %d", w.Code, tt.code)
+			}
+			var got map[string]string
+			json.Unmarshal(w.Body.Bytes(), &got)
+			if got["ip"] != tt.ip {
+				t.Errorf("ip = %q, want %q", got["ip"], tt.ip)
+			}
+		})
+	}
+}
+
+func TestConfigFiles(t *testing.T) {
+	mac, _ := net.ParseMAC("AA:BB:CC:DD:EE:FF")
+	tests := []struct {
+		variant string
+		want    []string
+	}{
+		{"syslinux", []string{"pxelinux.cfg/01-aa-bb-cc-dd-ee-ff"}},
+		{"pxegrub", []string{"grub/menu.lst.01AABBCCDDEEFF", "grub/01-aa-bb-cc-dd-ee-ff"}},
+		{"pxegrub2", []string{"grub2/grub.cfg-01-aa-bb-cc-dd-ee-ff", "grub2/grub.cfg-aa:bb:cc:dd:ee:ff"}},
+		{"ipxe", []string{"pxelinux.cfg/01-aa-bb-cc-dd-ee-ff.ipxe"}},
+		{"bogus", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.variant, func(t *testing.T) {
+			got, err := configFiles(tt.variant, mac)
+			if (err != nil) != (tt.want == nil) || strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("configFiles = %q, %v; want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestTFTP(t *testing.T) {
+	s, _ := newServer(t)
+	target := "/tftp/pxegrub2/aa:bb:cc:dd:ee:ff"
+
+	if w := do(s, "GET", target, nil); w.Code != http.StatusNotFound {
+		t.Errorf("get before put: status %d, want 404", w.Code)
+	}
+	if w := do(s, "POST", target, url.Values{}); w.Code != http.StatusBadRequest {
+		t.Errorf("put without pxeconfig: status %d, want 400", w.Code)
+	}
+	if w := do(s, "POST", "/tftp/pxegrub2/not-a-mac", url.Values{"pxeconfig": {"menu"}}); w.Code != http.StatusBadRequest {
+		t.Errorf("bad MAC: status %d, want 400", w.Code)
+	}
+	if w := do(s, "POST", target, url.Values{"pxeconfig": {"set default=0"}}); w.Code != http.StatusOK {
+		t.Fatalf("put: status %d", w.Code)
+	}
+	for _, f := range []string{"grub2/grub.cfg-01-aa-bb-cc-dd-ee-ff", "grub2/grub.cfg-aa:bb:cc:dd:ee:ff"} {
+		if data, err := os.ReadFile(filepath.Join(s.TFTPRoot, f)); err != nil || string(data) != "set default=0" {
+			t.Errorf("%s = %q, %v", f, data, err)
+		}
+	}
+	if w := do(s, "GET", target, nil); w.Body.String() != "set default=0" {
+		t.Errorf("get = %q", w.Body)
+	}
+	do(s, "DELETE", target, nil)
+	if w := do(s, "GET", target, nil); w.Code != http.StatusNotFound {
+		t.Errorf("get after delete: status %d, want 404", w.Code)
+	}
+
+	if w := do(s, "POST", "/tftp/create_default", url.Values{"menu": {"DEFAULT local"}}); w.Code != http.StatusOK {
+		t.Fatalf("create_default: status %d", w.Code)
+	}
+	if data, _ := os.ReadFile(filepath.Join(s.TFTPRoot, "pxelinux.cfg/default")); string(data) != "DEFAULT local" {
+		t.Errorf("default menu = %q", data)
+	}
+}
+
+func TestFetchBootFile(t *testing.T) {
+	s, _ := newServer(t)
+	tests := []struct {
+		name string
+		form url.Values
+	}{
+		{"no prefix", url.Values{"path": {"http://mirror/vmlinuz"}}},
+		{"not http", url.Values{"prefix": {"boot/alma"}, "path": {"file:///etc/passwd"}}},
+		{"escapes root", url.Values{"prefix": {"../../etc/x"}, "path": {"http://mirror/vmlinuz"}}},
+		{"absolute", url.Values{"prefix": {"/etc/x"}, "path": {"http://mirror/vmlinuz"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := do(s, "POST", "/tftp/fetch_boot_file", tt.form); w.Code != http.StatusBadRequest {
+				t.Errorf("status %d, want 400", w.Code)
+			}
+		})
+	}
+}
+
+func TestDiscovery(t *testing.T) {
+	s, _ := newServer(t)
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"/features", `["dhcp","tftp"]`},
+		{"/version", `{"modules":{"dhcp":"3.9.0","tftp":"3.9.0"},"version":"3.9.0"}`},
+		{"/tftp/serverName", `{"serverName":"192.168.1.1"}`},
+		{"/dhcp", `[{"netmask":"255.255.255.0","network":"192.168.1.0","options":{"range":["192.168.1.100","192.168.1.102"]}}]`},
+		{"/dhcp/192.168.1.0", `{"leases":[{"ip":"192.168.1.100","mac":"aa:bb:cc:dd:ee:01","subnet":"192.168.1.0/255.255.255.0","type":"lease","state":"active"}],"reservations":[]}`},
+	}
+	for _, tt := range tests {
+		w := do(s, "GET", tt.target, nil)
+		if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != tt.want || w.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("%s = %d %s", tt.target, w.Code, w.Body)
+		}
+	}
+
+	var features map[string]struct {
+		State    string         `json:"state"`
+		Settings map[string]any `json:"settings"`
+	}
+	w := do(s, "GET", "/v2/features", nil)
+	if err := json.Unmarshal(w.Body.Bytes(), &features); err != nil || features["dhcp"].State != "running" || features["tftp"].Settings["tftp_servername"] != "192.168.1.1" {
+		t.Errorf("v2 features = %s", w.Body)
+	}
+}
+
+func TestCreateDefault(t *testing.T) {
+	s, _ := newServer(t)
+	tests := []struct {
+		variant, file string
+		code          int
+	}{
+		{"pxegrub", "grub/menu.lst", http.StatusOK},
+		{"pxegrub2", "grub2/grub.cfg", http.StatusOK},
+		{"ipxe", "pxelinux.cfg/default.ipxe", http.StatusOK},
+		{"bogus", "", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		w := do(s, "POST", "/tftp/create_default/"+tt.variant, url.Values{"menu": {tt.variant + " menu"}})
+		if w.Code != tt.code {
+			t.Errorf("%s: status %d, want %d", tt.variant, w.Code, tt.code)
+		}
+		if tt.file == "" {
+			continue
+		}
+		if data, _ := os.ReadFile(filepath.Join(s.TFTPRoot, tt.file)); string(data) != tt.variant+" menu" {
+			t.Errorf("%s = %q", tt.file, data)
+		}
+	}
+	if w := do(s, "POST", "/tftp/create_default", url.Values{}); w.Code != http.StatusBadRequest {
+		t.Errorf("without a menu: status %d, want 400", w.Code)
+	}
+}
+
+func TestFetchBootFileDownloads(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "vmlinuz"), []byte("kernel"), 0o644)
+	mirror := httptest.NewServer(http.FileServer(http.Dir(dir)))
+	defer mirror.Close()
+
+	s, _ := newServer(t)
+	form := url.Values{"prefix": {"boot/almalinux-9"}, "path": {mirror.URL + "/vmlinuz"}}
+	if w := do(s, "POST", "/tftp/fetch_boot_file", form); w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	// The download runs after the reply
+	dest := filepath.Join(s.TFTPRoot, "boot", "almalinux-9-vmlinuz")
+	var data []byte
+	for range 100 {
+		if data, _ = os.ReadFile(dest); data != nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if string(data) != "kernel" {
+		t.Errorf("fetched %q", data)
+	}
+}
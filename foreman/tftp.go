@@ -0,0 +1,181 @@
+package foreman
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ars1364/go-pxe/fetch"
+)
+
+// configFiles returns the boot menu files, relative to the TFTP root, that
+// the bootloader variant reads for mac. The first is the one read back.
+func configFiles(variant string, mac net.HardwareAddr) ([]string, error) {
+	dashed := "01-" + strings.ReplaceAll(mac.String(), ":", "-")
+	switch variant {
+	case "syslinux", "pxelinux":
+		return []string{"pxelinux.cfg/" + dashed}, nil
+	case "pxegrub":
+		return []string{"grub/menu.lst." + strings.ToUpper("01"+strings.ReplaceAll(mac.String(), ":", "")), "grub/" + dashed}, nil
+	case "pxegrub2":
+		return []string{"grub2/grub.cfg-" + dashed, "grub2/grub.cfg-" + mac.String()}, nil
+	case "ipxe":
+		return []string{"pxelinux.cfg/" + dashed + ".ipxe"}, nil
+	}
+	return nil, fmt.Errorf("unsupported TFTP variant %q", variant)
+}
+
+// defaultFile is the menu the variant falls back to for unknown clients
+func defaultFile(variant string) (string, error) {
+	switch variant {
+	case "syslinux", "pxelinux":
+		return "pxelinux.cfg/default", nil
+	case "pxegrub":
+		return "grub/menu.lst", nil
+	case "pxegrub2":
+		return "grub2/grub.cfg", nil
+	case "ipxe":
+		return "pxelinux.cfg/default.ipxe", nil
+	}
+	return "", fmt.Errorf("unsupported TFTP variant %q", variant)
+}
+
+func (s *Server) serverName(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"serverName": s.ServerIP.String()})
+}
+
+func (s *Server) macFiles(w http.ResponseWriter, r *http.Request) ([]string, bool) {
+	mac, err := net.ParseMAC(r.PathValue("mac"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	files, err := configFiles(r.PathValue("variant"), mac)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	return files, true
+}
+
+func (s *Server) getConfig(w http.ResponseWriter, r *http.Request) {
+	files, ok := s.macFiles(w, r)
+	if !ok {
+		return
+	}
+	data, err := os.ReadFile(filepath.Join(s.TFTPRoot, files[0]))
+	if err != nil {
+		http.Error(w, "No boot menu for "+r.PathValue("mac"), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(data)
+}
+
+func (s *Server) putConfig(w http.ResponseWriter, r *http.Request) {
+	files, ok := s.macFiles(w, r)
+	if !ok {
+		return
+	}
+	config := r.FormValue("pxeconfig")
+	if config == "" {
+		http.Error(w, "Missing pxeconfig", http.StatusBadRequest)
+		return
+	}
+	for _, f := range files {
+		if err := s.writeFile(f, []byte(config)); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	log.Printf("[FOREMAN] %s: wrote %s boot menu for %s", s.Domain, r.PathValue("variant"), r.PathValue("mac"))
+	s.Audit.Record(actor(r), s.Domain, "tftp.put", files[0], nil, config)
+}
+
+func (s *Server) deleteConfig(w http.ResponseWriter, r *http.Request) {
+	files, ok := s.macFiles(w, r)
+	if !ok {
+		return
+	}
+	for _, f := range files {
+		os.Remove(filepath.Join(s.TFTPRoot, f))
+	}
+	log.Printf("[FOREMAN] %s: removed %s boot menu for %s", s.Domain, r.PathValue("variant"), r.PathValue("mac"))
+	s.Audit.Record(actor(r), s.Domain, "tftp.delete", files[0], nil, nil)
+}
+
+// createDefault writes the menu for clients without their own. Foreman
+// before 1.17 sends no variant and means syslinux.
+func (s *Server) createDefault(w http.ResponseWriter, r *http.Request) {
+	variant := r.PathValue("variant")
+	if variant == "" {
+		variant = "syslinux"
+	}
+	file, err := defaultFile(variant)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	menu := r.FormValue("menu")
+	if menu == "" {
+		http.Error(w, "Missing menu", http.StatusBadRequest)
+		return
+	}
+	if err := s.writeFile(file, []byte(menu)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("[FOREMAN] %s: wrote default %s boot menu", s.Domain, variant)
+	s.Audit.Record(actor(r), s.Domain, "tftp.put", file, nil, menu)
+}
+
+// fetchBootFile downloads an installer kernel or initrd into the TFTP root
+// as <prefix>-<file name>, e.g. boot/almalinux-9-vmlinuz. Downloads run in
+// the background, as with the real smart proxy.
+func (s *Server) fetchBootFile(w http.ResponseWriter, r *http.Request) {
+	prefix, src := r.FormValue("prefix"), r.FormValue("path")
+	u, err := url.Parse(src)
+	if prefix == "" || err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		http.Error(w, "Need prefix and an http(s) path", http.StatusBadRequest)
+		return
+	}
+	dest := filepath.Clean(filepath.FromSlash(prefix + "-" + path.Base(u.Path)))
+	if filepath.IsAbs(dest) || dest == ".." || strings.HasPrefix(dest, ".."+string(filepath.Separator)) {
+		http.Error(w, "prefix escapes the TFTP root", http.StatusBadRequest)
+		return
+	}
+	go func() {
+		start := time.Now()
+		n, err := s.download(src, dest)
+		if err != nil {
+			log.Printf("[FOREMAN] %s: fetch %s: %v", s.Domain, src, err)
+			return
+		}
+		log.Printf("[FOREMAN] %s: fetched %s (%d bytes) in %s", s.Domain, dest, n, time.Since(start).Round(time.Millisecond))
+	}()
+}
+
+func (s *Server) download(src, dest string) (int64, error) {
+	// The fetcher downloads beside the target and renames once the file
+	// is checked, so a client never boots a half-written or tampered
+	// kernel
+	v, err := fetch.Default.Verified(context.Background(), src, filepath.Join(s.TFTPRoot, dest), nil)
+	return v.Size, err
+}
+
+// writeFile replaces a file under the TFTP root
+func (s *Server) writeFile(name string, data []byte) error {
+	full := filepath.Join(s.TFTPRoot, name)
+	if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(full, data, 0644)
+}
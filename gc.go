@@ -0,0 +1,85 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/ars1364/go-pxe/assets"
+	"github.com/ars1364/go-pxe/netbootxyz"
+	"github.com/ars1364/go-pxe/oci"
+)
+
+// collect removes the images in the domain's roots that no profile, nor
+// definition a host could be rolled back to, references, and links
+// identical ones together. Images newer than minAge are kept. Directories
+// go-pxe manages itself, and those of the disk image services, are left
+// alone.
+func (d *domain) collect(minAge time.Duration, dryRun bool) (assets.Report, error) {
+	d.gcMu.Lock()
+	defer d.gcMu.Unlock()
+	roots := []string{d.cfg.TFTPRoot}
+	if !slices.Contains(roots, d.cfg.HTTPRoot) {
+		roots = append(roots, d.cfg.HTTPRoot)
+	}
+	skip := []string{d.cfg.SecureBoot, d.cfg.NBDRoot, d.cfg.ISCSIRoot, d.cfg.NFSRoot, d.cfg.OverlayDir, d.cfg.MulticastRoot}
+	for _, root := range roots {
+		skip = append(skip, filepath.Join(root, oci.Dir), filepath.Join(root, netbootxyz.Dir))
+	}
+	files, dirs := d.store.Files()
+	r, err := assets.Collect(assets.Options{Roots: roots, Files: files, Dirs: dirs, Skip: skip, MinAge: minAge, DryRun: dryRun})
+	if err != nil {
+		return r, err
+	}
+	if !dryRun {
+		d.index.Rescan()
+	}
+	if dryRun {
+		log.Printf("[GC] %s: would remove %d orphaned images and link %d duplicates, reclaiming %d MiB", d.cfg.Name, len(r.Orphans), len(r.Duplicates), r.Freed>>20)
+	} else {
+		log.Printf("[GC] %s: removed %d orphaned images and linked %d duplicates, reclaiming %d MiB", d.cfg.Name, len(r.Orphans), len(r.Duplicates), r.Freed>>20)
+	}
+	return r, nil
+}
+
+// runGC reclaims space in a running server's boot roots through its
+// management API:
+//
+//	go-pxe gc [-api http://127.0.0.1:9090] [-domain default] [-min-age 24h] [-delete]
+//
+// Without -delete it only lists what it would remove and link.
+func runGC(args []string) {
+	fs := flag.NewFlagSet("gc", flag.ExitOnError)
+	apiURL := fs.String("api", "http://127.0.0.1:9090", "Management API of the server")
+	token := fs.String("token", os.Getenv("GOPXE_API_TOKEN"), "API bearer token (default from GOPXE_API_TOKEN)")
+	domain := fs.String("domain", "default", "Provisioning domain whose roots to collect")
+	minAge := fs.Duration("min-age", 24*time.Hour, "Keep images modified more recently than this")
+	del := fs.Bool("delete", false, "Remove orphaned images and link duplicates, instead of listing them")
+	fs.Parse(args)
+
+	// Hashing large images takes a while
+	c := newAPIClient(*apiURL, *domain, *token, 30*time.Minute)
+	method := "GET"
+	if *del {
+		method = "POST"
+	}
+	var r assets.Report
+	if err := c.do(method, "/gc?minAge="+minAge.String(), &r); err != nil {
+		log.Fatal(err)
+	}
+	for _, f := range r.Orphans {
+		fmt.Printf("orphan     %8d MiB  %s\n", f.Size>>20, f.Path)
+	}
+	for _, f := range r.Duplicates {
+		fmt.Printf("duplicate  %8d MiB  %s = %s\n", f.Size>>20, f.Path, f.Of)
+	}
+	if r.DryRun {
+		fmt.Printf("%d MiB to reclaim; run with -delete to reclaim it\n", r.Freed>>20)
+	} else {
+		fmt.Printf("%d MiB reclaimed\n", r.Freed>>20)
+	}
+}
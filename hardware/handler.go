@@ -0,0 +1,75 @@
+package hardware
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+)
+
+const (
+	maxDocument = 4 << 20 // lshw of a large server is a few hundred KiB
+	maxKinds    = 16
+)
+
+var kindPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
+// Handler accepts documents posted to /hardware/<kind>:
+//
+//	lshw -json | curl -sf --data-binary @- http://10.0.0.1:8080/hardware/lshw
+type Handler struct {
+	// Domain labels log lines
+	Domain string
+
+	// ClientID, if set, names the client whose record a posted document
+	// goes in. Defaults to its IP address.
+	ClientID func(ip net.IP) string
+
+	store *Store
+}
+
+// NewHandler creates a handler filing documents in store
+func NewHandler(store *Store) *Handler {
+	return &Handler{store: store}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	kind := r.PathValue("kind")
+	if !kindPattern.MatchString(kind) {
+		http.Error(w, "invalid kind (want e.g. lshw, lsblk or dmidecode)", http.StatusBadRequest)
+		return
+	}
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxDocument+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(data) > maxDocument {
+		http.Error(w, fmt.Sprintf("document larger than %d bytes", maxDocument), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	ip := net.ParseIP(host)
+	client := ip.String()
+	if h.ClientID != nil {
+		client = h.ClientID(ip)
+	}
+	if rec, ok := h.store.Get(client); ok && len(rec.Documents) >= maxKinds && rec.Documents[kind] == nil {
+		http.Error(w, fmt.Sprintf("at most %d kinds of documents per client", maxKinds), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// JSON is kept as is; anything else, like dmidecode output, as text
+	doc := json.RawMessage(data)
+	if !json.Valid(data) {
+		doc, _ = json.Marshal(string(data))
+	}
+	rec := h.store.Put(client, ip.String(), kind, doc)
+	sum := rec.Summary
+	log.Printf("[HW] %s: %s posted %s (%d bytes): %s %s, %d MiB, %d disks", h.Domain, client, kind, len(data), sum.Vendor, sum.Product, sum.MemoryMiB, len(sum.Disks))
+	w.WriteHeader(http.StatusNoContent)
+}
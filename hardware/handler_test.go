@@ -0,0 +1,67 @@
+package hardware
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func post(h http.Handler, kind, body string) int {
+	mux := http.NewServeMux()
+	mux.Handle("POST /hardware/{kind}", h)
+	r := httptest.NewRequest("POST", "/hardware/"+kind, strings.NewReader(body))
+	r.RemoteAddr = "10.0.0.5:40000"
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	return w.Code
+}
+
+func TestHandler(t *testing.T) {
+	store := NewStore()
+	h := NewHandler(store)
+	h.ClientID = func(ip net.IP) string { return "host-" + ip.String() }
+
+	tests := []struct {
+		kind string
+		body string
+		code int
+	}{
+		{"lshw", lshw, http.StatusNoContent},
+		{"dmidecode", dmidecode, http.StatusNoContent},
+		{"Bad", "x", http.StatusBadRequest},
+		{"-x", "x", http.StatusBadRequest},
+		{strings.Repeat("a", 33), "x", http.StatusBadRequest},
+		{"big", strings.Repeat("x", maxDocument+1), http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		if code := post(h, tt.kind, tt.body); code != tt.code {
+			t.Errorf("%.20s: status %d, want %d", tt.kind, code, tt.code)
+		}
+	}
+
+	rec, ok := store.Get("host-10.0.0.5")
+	if !ok || rec.IP != "10.0.0.5" || rec.Summary.Vendor != "Supermicro" || rec.Summary.CPUs != 2 {
+		t.Fatalf("record = %+v", rec)
+	}
+	if d := string(rec.Documents["dmidecode"]); !strings.HasPrefix(d, `"# dmidecode`) {
+		t.Errorf("text document stored as %.40s", d)
+	}
+}
+
+func TestHandlerKinds(t *testing.T) {
+	h := NewHandler(NewStore())
+	for i := range maxKinds {
+		if code := post(h, fmt.Sprintf("kind%d", i), "{}"); code != http.StatusNoContent {
+			t.Fatalf("kind %d: status %d", i, code)
+		}
+	}
+	if code := post(h, "onemore", "{}"); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("kind past the limit: status %d", code)
+	}
+	if code := post(h, "kind0", "{}"); code != http.StatusNoContent {
+		t.Errorf("replacing a kind: status %d", code)
+	}
+}
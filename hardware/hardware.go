@@ -0,0 +1,147 @@
+// Package hardware keeps the hardware inventory clients report about
+// themselves: dmidecode, lshw, lsblk or any other tool output posted by a
+// small agent or a curl from the installer, stored per client together
+// with a summary of the common fields.
+package hardware
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Record is everything one client reported
+type Record struct {
+	Client  string    `json:"client"` // inventory host name, else dashed MAC, else IP
+	IP      string    `json:"ip,omitempty"`
+	Updated time.Time `json:"updated"`
+
+	Summary Summary `json:"summary"`
+
+	// Documents holds each tool's output by kind ("lshw", "lsblk",
+	// "dmidecode", ...): JSON as posted, plain text as a JSON string
+	Documents map[string]json.RawMessage `json:"documents,omitempty"`
+}
+
+// Summary is the part of the reports most queries are about
+type Summary struct {
+	Vendor    string `json:"vendor,omitempty"`
+	Product   string `json:"product,omitempty"`
+	Serial    string `json:"serial,omitempty"`
+	UUID      string `json:"uuid,omitempty"`
+	CPUModel  string `json:"cpuModel,omitempty"`
+	CPUs      int    `json:"cpus,omitempty"`
+	MemoryMiB int64  `json:"memoryMiB,omitempty"`
+	Disks     []Disk `json:"disks,omitempty"`
+}
+
+// Disk is one block device
+type Disk struct {
+	Name       string `json:"name"`
+	Model      string `json:"model,omitempty"`
+	Serial     string `json:"serial,omitempty"`
+	Size       int64  `json:"size"`
+	Rotational bool   `json:"rotational"`
+}
+
+// Filter selects records; empty fields match everything. Text fields match
+// case-insensitive substrings.
+type Filter struct {
+	Vendor       string
+	Product      string
+	Serial       string
+	MinMemoryMiB int64
+}
+
+func (f Filter) match(r Record) bool {
+	has := func(s, sub string) bool { return strings.Contains(strings.ToLower(s), strings.ToLower(sub)) }
+	return has(r.Summary.Vendor, f.Vendor) && has(r.Summary.Product, f.Product) &&
+		has(r.Summary.Serial, f.Serial) && r.Summary.MemoryMiB >= f.MinMemoryMiB
+}
+
+// Store keeps the latest documents of every client
+type Store struct {
+	mu      sync.Mutex
+	records map[string]Record
+}
+
+// NewStore creates an empty store
+func NewStore() *Store {
+	return &Store{records: make(map[string]Record)}
+}
+
+// Put stores one document of the client's, replacing an earlier one of the
+// same kind, and refreshes the summary
+func (s *Store) Put(client, ip, kind string, doc json.RawMessage) Record {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.records[client]
+	if !ok {
+		r = Record{Client: client}
+	}
+	docs := make(map[string]json.RawMessage, len(r.Documents)+1)
+	for k, v := range r.Documents {
+		docs[k] = v
+	}
+	docs[kind] = doc
+	r.Documents, r.IP, r.Updated = docs, ip, time.Now()
+	r.Summary = summarize(docs)
+	s.records[client] = r
+	return r
+}
+
+// Get returns the client's record
+func (s *Store) Get(client string) (Record, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.records[client]
+	return r, ok
+}
+
+// List returns the records matching f without their documents, by client
+func (s *Store) List(f Filter) []Record {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := []Record{}
+	for _, r := range s.records {
+		if f.match(r) {
+			r.Documents = nil
+			list = append(list, r)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Client < list[j].Client })
+	return list
+}
+
+// Delete forgets the client's record, reporting whether there was one
+func (s *Store) Delete(client string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.records[client]
+	delete(s.records, client)
+	return ok
+}
+
+// Snapshot returns every record for backups
+func (s *Store) Snapshot() []Record {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]Record, 0, len(s.records))
+	for _, r := range s.records {
+		list = append(list, r)
+	}
+	return list
+}
+
+// Load replaces every client's record, documents and all, with list, as a
+// backup restores them
+func (s *Store) Load(list []Record) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records = make(map[string]Record, len(list))
+	for _, r := range list {
+		s.records[r.Client] = r
+	}
+}
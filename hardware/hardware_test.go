@@ -0,0 +1,53 @@
+package hardware
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestStore(t *testing.T) {
+	s := NewStore()
+	s.Put("node1", "10.0.0.1", "lshw", json.RawMessage(lshw))
+	rec := s.Put("node1", "10.0.0.2", "dmidecode", text(dmidecode))
+	if len(rec.Documents) != 2 || rec.IP != "10.0.0.2" || rec.Summary.Vendor != "Supermicro" {
+		t.Errorf("record = %+v", rec)
+	}
+	s.Put("node2", "10.0.0.3", "lshw", json.RawMessage(`{"class": "system", "vendor": "HPE", "product": "DL360"}`))
+
+	tests := []struct {
+		name   string
+		filter Filter
+		want   []string
+	}{
+		{"all", Filter{}, []string{"node1", "node2"}},
+		{"vendor", Filter{Vendor: "super"}, []string{"node1"}},
+		{"product", Filter{Product: "dl3"}, []string{"node2"}},
+		{"serial", Filter{Serial: "abc"}, []string{"node1"}},
+		{"memory", Filter{MinMemoryMiB: 1024}, []string{"node1"}},
+		{"none", Filter{Vendor: "Lenovo"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			list := s.List(tt.filter)
+			var got []string
+			for _, r := range list {
+				if r.Documents != nil {
+					t.Error("List returned documents")
+				}
+				got = append(got, r.Client)
+			}
+			if len(got) != len(tt.want) || (len(got) > 0 && got[0] != tt.want[0]) {
+				t.Errorf("List = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	snap := s.Snapshot()
+	if !s.Delete("node2") || s.Delete("node2") {
+		t.Error("Delete reported wrongly")
+	}
+	s.Load(snap)
+	if r, ok := s.Get("node2"); !ok || r.Summary.Vendor != "HPE" {
+		t.Errorf("after Load = %+v, %v", r, ok)
+	}
+}
@@ -0,0 +1,148 @@
+package hardware
+
+import (
+	"bufio"
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// summarize fills in a summary from whichever documents there are.
+// dmidecode is the most exact about the system, lsblk about disks; lshw
+// fills the gaps.
+func summarize(docs map[string]json.RawMessage) Summary {
+	var sum Summary
+	if d, ok := docs["lshw"]; ok {
+		fromLshw(&sum, d)
+	}
+	if d, ok := docs["dmidecode"]; ok {
+		fromDmidecode(&sum, d)
+	}
+	if d, ok := docs["lsblk"]; ok {
+		fromLsblk(&sum, d)
+	}
+	return sum
+}
+
+// lshwNode is one node of `lshw -json` output
+type lshwNode struct {
+	ID       string     `json:"id"`
+	Class    string     `json:"class"`
+	Vendor   string     `json:"vendor"`
+	Product  string     `json:"product"`
+	Serial   string     `json:"serial"`
+	Size     int64      `json:"size"`
+	Config   lshwConfig `json:"configuration"`
+	Children []lshwNode `json:"children"`
+}
+
+type lshwConfig struct {
+	UUID string `json:"uuid"`
+}
+
+func fromLshw(sum *Summary, doc json.RawMessage) {
+	// Older lshw prints one object, newer ones an array of one
+	var roots []lshwNode
+	if json.Unmarshal(doc, &roots) != nil {
+		var root lshwNode
+		if json.Unmarshal(doc, &root) != nil {
+			return
+		}
+		roots = []lshwNode{root}
+	}
+	var walk func(n lshwNode)
+	walk = func(n lshwNode) {
+		switch {
+		case n.Class == "system" && sum.Vendor == "":
+			sum.Vendor, sum.Product, sum.Serial = n.Vendor, n.Product, n.Serial
+			if sum.UUID == "" {
+				sum.UUID = n.Config.UUID
+			}
+		case n.Class == "memory" && n.ID == "memory":
+			sum.MemoryMiB = n.Size >> 20
+		case n.Class == "processor" && strings.HasPrefix(n.ID, "cpu"):
+			sum.CPUs++
+			if sum.CPUModel == "" {
+				sum.CPUModel = n.Product
+			}
+		}
+		for _, c := range n.Children {
+			walk(c)
+		}
+	}
+	for _, r := range roots {
+		walk(r)
+	}
+}
+
+// fromDmidecode reads the System Information section of plain dmidecode
+// output, posted as text
+func fromDmidecode(sum *Summary, doc json.RawMessage) {
+	var text string
+	if json.Unmarshal(doc, &text) != nil {
+		return
+	}
+	section := ""
+	sc := bufio.NewScanner(strings.NewReader(text))
+	for sc.Scan() {
+		line := sc.Text()
+		if line != "" && line[0] != '\t' && line[0] != ' ' {
+			section = strings.TrimSpace(line)
+			continue
+		}
+		key, value, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		if value == "" || strings.EqualFold(value, "Not Specified") || strings.EqualFold(value, "To Be Filled By O.E.M.") {
+			continue
+		}
+		switch section + "/" + key {
+		case "System Information/Manufacturer":
+			sum.Vendor = value
+		case "System Information/Product Name":
+			sum.Product = value
+		case "System Information/Serial Number":
+			sum.Serial = value
+		case "System Information/UUID":
+			sum.UUID = strings.ToLower(value)
+		}
+	}
+}
+
+// fromLsblk reads `lsblk -J -b -o NAME,TYPE,SIZE,MODEL,SERIAL,ROTA`. Without
+// -b sizes are strings like "1.8T" and are left at 0.
+func fromLsblk(sum *Summary, doc json.RawMessage) {
+	var out struct {
+		Devices []map[string]any `json:"blockdevices"`
+	}
+	if json.Unmarshal(doc, &out) != nil {
+		return
+	}
+	sum.Disks = nil
+	for _, d := range out.Devices {
+		if t, ok := d["type"].(string); ok && t != "disk" {
+			continue
+		}
+		disk := Disk{Name: str(d["name"]), Model: strings.TrimSpace(str(d["model"])), Serial: str(d["serial"])}
+		switch v := d["size"].(type) {
+		case float64:
+			disk.Size = int64(v)
+		case string:
+			disk.Size, _ = strconv.ParseInt(v, 10, 64)
+		}
+		switch v := d["rota"].(type) {
+		case bool:
+			disk.Rotational = v
+		case string:
+			disk.Rotational = v == "1" || v == "true"
+		}
+		sum.Disks = append(sum.Disks, disk)
+	}
+}
+
+func str(v any) string {
+	s, _ := v.(string)
+	return s
+}
@@ -0,0 +1,79 @@
+package hardware
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+const lshw = `{"id": "node1", "class": "system", "vendor": "Dell Inc.", "product": "PowerEdge R640", "serial": "ABC123",
+	"configuration": {"uuid": "4c4c4544-0042"},
+	"children": [{"id": "core", "class": "bus", "children": [
+		{"id": "memory", "class": "memory", "size": 68719476736},
+		{"id": "cpu:0", "class": "processor", "product": "Xeon Gold 6130"},
+		{"id": "cpu:1", "class": "processor", "product": "Xeon Gold 6130"},
+		{"id": "cache", "class": "memory", "size": 1048576}
+	]}]}`
+
+const dmidecode = `# dmidecode 3.3
+Handle 0x0100, DMI type 1, 27 bytes
+System Information
+	Manufacturer: Supermicro
+	Product Name: SYS-1029P
+	Serial Number: To Be Filled By O.E.M.
+	UUID: 00000000-0000-0000-0000-AC1F6B000001
+
+Base Board Information
+	Manufacturer: Other Vendor
+`
+
+func text(s string) json.RawMessage {
+	data, _ := json.Marshal(s)
+	return data
+}
+
+func TestSummarize(t *testing.T) {
+	tests := []struct {
+		name string
+		docs map[string]json.RawMessage
+		want string
+	}{
+		{"lshw object", map[string]json.RawMessage{"lshw": json.RawMessage(lshw)},
+			"Dell Inc.|PowerEdge R640|ABC123|4c4c4544-0042|Xeon Gold 6130|2|65536|[]"},
+		{"lshw array", map[string]json.RawMessage{"lshw": json.RawMessage("[" + lshw + "]")},
+			"Dell Inc.|PowerEdge R640|ABC123|4c4c4544-0042|Xeon Gold 6130|2|65536|[]"},
+		{"dmidecode over lshw", map[string]json.RawMessage{"lshw": json.RawMessage(lshw), "dmidecode": text(dmidecode)},
+			"Supermicro|SYS-1029P|ABC123|00000000-0000-0000-0000-ac1f6b000001|Xeon Gold 6130|2|65536|[]"},
+		{"lsblk", map[string]json.RawMessage{"lsblk": json.RawMessage(`{"blockdevices": [
+			{"name": "sda", "type": "disk", "size": 480103981056, "model": "SSD  ", "serial": "S1", "rota": false},
+			{"name": "sdb", "type": "disk", "size": "4000787030016", "model": "HDD", "rota": "1"},
+			{"name": "sr0", "type": "rom", "size": 1073741312},
+			{"name": "nvme0n1", "size": "1.8T", "rota": "0"}
+		]}`)}, "|||||0|0|[{sda SSD S1 480103981056 false} {sdb HDD  4000787030016 true} {nvme0n1   0 false}]"},
+		{"none", nil, "|||||0|0|[]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := summarize(tt.docs)
+			got := fmt.Sprintf("%s|%s|%s|%s|%s|%d|%d|%v", s.Vendor, s.Product, s.Serial, s.UUID, s.CPUModel, s.CPUs, s.MemoryMiB, s.Disks)
+			if got != tt.want {
+				t.Errorf("summary = %s\nwant      %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSummarizeMalformed(t *testing.T) {
+	deep := strings.Repeat(`{"children": [`, 5000) + strings.Repeat(`]}`, 5000)
+	docs := []string{
+		``, `null`, `"text"`, `[1, 2]`, `{"children": "x"}`, `{"size": "big"}`, `[null]`, deep,
+		`{"blockdevices": "x"}`, `{"blockdevices": [null, 5, {"name": 5, "size": -1, "rota": []}]}`,
+	}
+	for _, d := range docs {
+		for _, kind := range []string{"lshw", "lsblk", "dmidecode"} {
+			summarize(map[string]json.RawMessage{kind: json.RawMessage(d)})
+		}
+	}
+	summarize(map[string]json.RawMessage{"dmidecode": text("System Information\n\t:\n\tManufacturer\n" + strings.Repeat("x", 100000))})
+}
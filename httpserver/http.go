@@ -1,22 +1,242 @@
 package httpserver
 
 import (
+	"bytes"
+	"crypto/tls"
+	"io"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ars1364/go-pxe/events"
+	"github.com/ars1364/go-pxe/qos"
+	"github.com/ars1364/go-pxe/transfers"
 )
 
-func ListenAndServe(addr, root string) error {
-	fs := http.FileServer(http.Dir(root))
-	mux := http.NewServeMux()
-	mux.Handle("/", logRequests(fs))
+type Server struct {
+	root string
+
+	// Events, if set, receives one event per completed request
+	Events *events.Bus
+
+	// Transfers, if set, tracks the progress of responses in flight
+	Transfers *transfers.Table
+
+	// QoS, if set, caps each client's requests in flight and bandwidth,
+	// shared with its TFTP transfers; Domain labels its metrics
+	QoS    *qos.Shaper
+	Domain string
+
+	// Render, if set, fills in templates for the requesting client: a
+	// request for a file that only exists as <name>.tmpl is answered with
+	// the rendered template. Templates are never served raw.
+	Render func(name string, text []byte, client net.IP) ([]byte, error)
+
+	// Generate, if set, is asked for files missing from the root and its
+	// templates, such as boot scripts built for the requesting client
+	Generate func(name string, client net.IP) ([]byte, bool)
+
+	// Token, if set, checks the token a client presents for a template,
+	// which is only rendered if it passes. Clients present tokens as
+	// ?token=<token>, or in a /token/<token>/ prefix to the path for
+	// those that only take a base URL, such as cloud-init's.
+	Token func(token string, client net.IP) error
+
+	routes map[string]http.Handler
+}
 
-	log.Printf("[HTTP] Serving %s on %s", root, addr)
-	return http.ListenAndServe(addr, mux)
+// TemplateSuffix marks template files in the HTTP root
+const TemplateSuffix = ".tmpl"
+
+func NewServer(root string) *Server {
+	return &Server{root: root}
+}
+
+// Handle serves requests matching pattern, such as "POST /hardware/{kind}",
+// with h instead of from the root. Call it before ListenAndServe.
+func (s *Server) Handle(pattern string, h http.Handler) {
+	if s.routes == nil {
+		s.routes = make(map[string]http.Handler)
+	}
+	s.routes[pattern] = h
+}
+
+func (s *Server) ListenAndServe(addr string) error {
+	log.Printf("[HTTP] Serving %s on %s", s.root, addr)
+	return http.ListenAndServe(addr, s.handler())
+}
+
+// ListenAndServeTLS serves the same root and routes over TLS on addr,
+// e.g. with cfg requiring client certificates
+func (s *Server) ListenAndServeTLS(addr string, cfg *tls.Config) error {
+	ln, err := tls.Listen("tcp", addr, cfg)
+	if err != nil {
+		return err
+	}
+	log.Printf("[HTTP] Serving %s over TLS on %s", s.root, addr)
+	return http.Serve(ln, s.handler())
+}
+
+func (s *Server) handler() http.Handler {
+	s.QoS.Instrument(s.Domain)
+	fs := http.FileServer(http.Dir(s.root))
+	mux := http.NewServeMux()
+	mux.Handle("/", s.logRequests(s.templates(fs)))
+	for pattern, h := range s.routes {
+		mux.Handle(pattern, s.logRequests(h))
+	}
+	return mux
 }
 
-func logRequests(next http.Handler) http.Handler {
+func (s *Server) logRequests(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		log.Printf("[HTTP] %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
-		next.ServeHTTP(w, r)
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK,
+			progress: s.Transfers.Start("http", net.ParseIP(host), r.URL.Path, -1)}
+		start := time.Now()
+		if slot, ok := s.QoS.Acquire(s.Domain, "http", net.ParseIP(host)); ok {
+			rec.slot = slot
+			next.ServeHTTP(rec, r)
+		} else {
+			log.Printf("[HTTP] Refusing %s to %s: too many requests in flight", r.URL.Path, host)
+			rec.Header().Set("Retry-After", "5")
+			http.Error(rec, "too many requests in flight", http.StatusServiceUnavailable)
+		}
+		rec.slot.Release()
+		rec.progress.Done()
+
+		s.Events.Publish(events.Event{
+			Type:     events.HTTPRequest,
+			IP:       net.ParseIP(host),
+			Path:     r.URL.Path,
+			Bytes:    rec.bytes,
+			Status:   rec.status,
+			Duration: time.Since(start),
+		})
+	})
+}
+
+// templates renders <path>.tmpl, or has Generate make <path>, when the
+// requested path doesn't exist
+func (s *Server) templates(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.Render == nil && s.Generate == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		name := path.Clean("/" + r.URL.Path)
+		token := r.URL.Query().Get("token")
+		if rest, ok := strings.CutPrefix(name, "/token/"); ok {
+			token, name, _ = strings.Cut(rest, "/")
+			name = "/" + name
+			r.URL.Path = name
+		}
+		// Templates are never served raw, whatever the path's prefix
+		if s.Render != nil && strings.HasSuffix(name, TemplateSuffix) {
+			http.NotFound(w, r)
+			return
+		}
+		full := filepath.Join(s.root, filepath.FromSlash(name))
+		if _, err := os.Stat(full); err == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		var out []byte
+		if text, err := os.ReadFile(full + TemplateSuffix); err == nil && s.Render != nil {
+			if s.Token != nil {
+				if err := s.Token(token, net.ParseIP(host)); err != nil {
+					log.Printf("[HTTP] Render %s for %s: %v", name, host, err)
+					http.Error(w, err.Error(), http.StatusForbidden)
+					return
+				}
+			}
+			if out, err = s.Render(name, text, net.ParseIP(host)); err != nil {
+				log.Printf("[HTTP] Render %s for %s: %v", name, host, err)
+				http.Error(w, "template error", http.StatusInternalServerError)
+				return
+			}
+		} else if gen, ok := s.generate(strings.TrimPrefix(name, "/"), net.ParseIP(host)); ok {
+			out = gen
+		} else {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// Rendered files are per client and may carry secrets
+		w.Header().Set("Cache-Control", "no-store")
+		http.ServeContent(w, r, path.Base(name), time.Now(), bytes.NewReader(out))
 	})
 }
+
+func (s *Server) generate(name string, client net.IP) ([]byte, bool) {
+	if s.Generate == nil {
+		return nil, false
+	}
+	return s.Generate(name, client)
+}
+
+// statusRecorder captures the status code and body size of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status   int
+	bytes    int64
+	progress *transfers.Progress
+	slot     *qos.Slot
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.status = code
+	if n, err := strconv.ParseInt(r.Header().Get("Content-Length"), 10, 64); err == nil {
+		r.progress.SetSize(n)
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	r.slot.Wait(len(b))
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	r.progress.Add(int64(n))
+	return n, err
+}
+
+// copyChunk bounds each sendfile call so progress advances during large
+// files; limitedChunk, to clients whose bandwidth is capped, so they are
+// paced smoothly
+const (
+	copyChunk    = 4 << 20
+	limitedChunk = 64 << 10
+)
+
+// ReadFrom keeps the underlying writer's sendfile path for large files
+func (r *statusRecorder) ReadFrom(src io.Reader) (int64, error) {
+	var total int64
+	chunk := int64(copyChunk)
+	if r.slot.Limited() {
+		chunk = limitedChunk
+	}
+	for {
+		r.slot.Wait(int(chunk))
+		n, err := io.CopyN(r.ResponseWriter, src, chunk)
+		total += n
+		r.bytes += n
+		r.progress.Add(n)
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil || n < chunk {
+			return total, err
+		}
+	}
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
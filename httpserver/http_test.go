@@ -0,0 +1,68 @@
+package httpserver
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTemplates(t *testing.T) {
+	root := t.TempDir()
+	for name, text := range map[string]string{
+		"user-data.tmpl": "secret {{.Host}}",
+		"plain.txt":      "plain",
+	} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(text), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := NewServer(root)
+	s.Render = func(name string, text []byte, client net.IP) ([]byte, error) {
+		return []byte("rendered " + name), nil
+	}
+	s.Token = func(token string, client net.IP) error {
+		if token != "good" {
+			return errors.New("bad token")
+		}
+		return nil
+	}
+	h := s.templates(http.FileServer(http.Dir(root)))
+
+	tests := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/plain.txt", http.StatusOK, "plain"},
+		{"/user-data?token=good", http.StatusOK, "rendered /user-data"},
+		{"/user-data?token=bad", http.StatusForbidden, ""},
+		{"/user-data", http.StatusForbidden, ""},
+		{"/token/good/user-data", http.StatusOK, "rendered /user-data"},
+		{"/token/bad/user-data", http.StatusForbidden, ""},
+		{"/user-data.tmpl", http.StatusNotFound, ""},
+		{"/token/anything/user-data.tmpl", http.StatusNotFound, ""},
+		{"/token/good/user-data.tmpl", http.StatusNotFound, ""},
+		{"/token/good/./user-data.tmpl", http.StatusNotFound, ""},
+		{"/token/x/sub/../user-data.tmpl", http.StatusNotFound, ""},
+		{"/token/anything/user-data.tmpl/", http.StatusNotFound, ""},
+		{"/user-data.tmpl/", http.StatusNotFound, ""},
+		{"/missing", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Fatalf("status %d, want %d (body %q)", rec.Code, tt.status, rec.Body)
+			}
+			if tt.body != "" && rec.Body.String() != tt.body {
+				t.Errorf("body %q, want %q", rec.Body, tt.body)
+			}
+		})
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/ars1364/go-pxe/bootcfg"
+	"github.com/ars1364/go-pxe/inventory"
+	"github.com/ars1364/go-pxe/iso"
+	"gopkg.in/yaml.v3"
+)
+
+// runImportISO turns an installation ISO into a boot profile:
+//
+//	go-pxe import-iso [-defs defs] [-http-root ./http] [-name profile] <image.iso>
+//
+// It recognizes the distribution, links the ISO into the HTTP root unless
+// it is there already, and writes defs/profiles/<name>.yaml, which a
+// server watching -defs picks up. The ISO is served as it is, kernel and
+// initrd included; nothing is extracted.
+func runImportISO(args []string) {
+	fs := flag.NewFlagSet("import-iso", flag.ExitOnError)
+	defs := fs.String("defs", "defs", "Definitions directory to write the profile to")
+	httpRoot := fs.String("http-root", "./http", "HTTP root directory of the server")
+	name := fs.String("name", "", "Profile name (default from the distribution and version)")
+	server := fs.String("server", "http://10.0.0.1:8080", "Server's HTTP URL, for the printed menu entry")
+	force := fs.Bool("force", false, "Replace an existing profile of the same name")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: go-pxe import-iso [flags] <image.iso>\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	disc, err := iso.Open(fs.Arg(0))
+	if err != nil {
+		log.Fatalf("[IMPORT] %v", err)
+	}
+	defer disc.Close()
+	distro, p, err := detectISO(disc)
+	if err != nil {
+		log.Fatalf("[IMPORT] %s: %v", fs.Arg(0), err)
+	}
+	p.Name = cmp.Or(*name, p.Name, profileName(disc.Label(), ""))
+	if p.Name == "" {
+		log.Fatalf("[IMPORT] %s: pass -name to name the profile", fs.Arg(0))
+	}
+	if p.ISO, err = linkISO(fs.Arg(0), *httpRoot); err != nil {
+		log.Fatalf("[IMPORT] %v", err)
+	}
+
+	file := filepath.Join(*defs, "profiles", p.Name+".yaml")
+	if _, err := os.Stat(file); err == nil && !*force {
+		log.Fatalf("[IMPORT] %s exists; pass -force to replace it or -name to pick another", file)
+	}
+	if err := inventory.NewStore().PutProfile(p); err != nil {
+		log.Fatalf("[IMPORT] %v", err)
+	}
+	if err := writeProfile(file, p); err != nil {
+		log.Fatalf("[IMPORT] %v", err)
+	}
+	fmt.Printf("Imported %s as profile %s (%s)\n\n", distro, p.Name, file)
+	b := p.Booted(strings.TrimSuffix(*server, "/"))
+	if b.Kernel != "" {
+		fmt.Printf("%s", bootcfg.GRUB(bootcfg.Menu{
+			Comment: "Menu entry of its hosts",
+			Entry:   &bootcfg.Entry{Title: distro, Kernel: b.Kernel, Initrd: b.Initrd, Cmdline: b.Cmdline},
+		}))
+	} else {
+		fmt.Printf("Its hosts boot %s\n", b.Loader())
+	}
+}
+
+// detectISO recognizes the distribution on disc and describes its profile
+func detectISO(disc *iso.FS) (string, inventory.Profile, error) {
+	// ESXi's names may be upper case
+	exists := func(name string) bool {
+		_, err := fs.Stat(disc, name)
+		_, uerr := fs.Stat(disc, strings.ToUpper(name))
+		return err == nil || uerr == nil
+	}
+	switch {
+	case exists(".treeinfo") && exists("images/pxeboot/vmlinuz"):
+		distro, version := treeInfo(disc)
+		return distro + " " + version, inventory.Profile{
+			Name:     profileName(distro, version),
+			Anaconda: &inventory.Anaconda{},
+		}, nil
+	case exists("casper/vmlinuz") && exists("casper/initrd"):
+		// .disk/info: Ubuntu-Server 24.04.4 LTS "Noble Numbat" - Release amd64 (20250213)
+		info, _ := fs.ReadFile(disc, ".disk/info")
+		distro, version := "Ubuntu", ""
+		if f := strings.Fields(string(info)); len(f) > 1 {
+			distro, _, _ = strings.Cut(f[0], "-")
+			version = f[1]
+		}
+		return distro + " " + version, inventory.Profile{
+			Name:   profileName(distro, version),
+			Casper: &inventory.Casper{},
+		}, nil
+	case exists("boot.cfg") && exists("b.b00"):
+		// ESXI-8.0U2-22380479-STANDARD
+		label := strings.Split(disc.Label(), "-")
+		version := ""
+		if len(label) > 1 {
+			version = label[1]
+		}
+		return "ESXi " + version, inventory.Profile{
+			Name: profileName("esxi", version),
+			ESXi: &inventory.ESXi{},
+		}, nil
+	case exists("sources/boot.wim"):
+		return "", inventory.Profile{}, errors.New("Windows installs from an SMB share through WinPE (see Windows Deployment in the README), not from the ISO")
+	}
+	return "", inventory.Profile{}, fmt.Errorf("unrecognized distribution (volume %s)", disc.Label())
+}
+
+// treeInfo reads the distribution's name and version from the .treeinfo of
+// a RHEL-family DVD
+func treeInfo(disc *iso.FS) (string, string) {
+	f, err := disc.Open(".treeinfo")
+	if err != nil {
+		return "", ""
+	}
+	defer f.Close()
+	values := map[string]string{}
+	section := ""
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if strings.HasPrefix(line, "[") {
+			section = strings.Trim(line, "[]")
+			continue
+		}
+		if k, v, ok := strings.Cut(line, "="); ok {
+			values[section+"."+strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+	}
+	// Current releases have [release]; older ones only [general]
+	name := values["release.name"]
+	if name == "" {
+		name = values["general.family"]
+	}
+	version := values["release.version"]
+	if version == "" {
+		version = values["general.version"]
+	}
+	return name, version
+}
+
+var notNameChar = regexp.MustCompile(`[^a-z0-9.]+`)
+
+// profileName makes a profile name of a distribution and version, such as
+// almalinux-9.7
+func profileName(distro, version string) string {
+	name := notNameChar.ReplaceAllString(strings.ToLower(distro+" "+version), "-")
+	return strings.Trim(name, "-.")
+}
+
+// linkISO returns the ISO's path relative to the HTTP root, linking it
+// there first if it is elsewhere
+func linkISO(image, httpRoot string) (string, error) {
+	abs, err := filepath.Abs(image)
+	if err != nil {
+		return "", err
+	}
+	root, err := filepath.Abs(httpRoot)
+	if err != nil {
+		return "", err
+	}
+	if rel, err := filepath.Rel(root, abs); err == nil && filepath.IsLocal(rel) {
+		return filepath.ToSlash(rel), nil
+	}
+	link := filepath.Join(root, filepath.Base(abs))
+	if target, err := os.Readlink(link); err == nil && target == abs {
+		return filepath.Base(abs), nil
+	}
+	if err := os.Symlink(abs, link); err != nil {
+		return "", fmt.Errorf("linking the ISO into the HTTP root: %w", err)
+	}
+	log.Printf("[IMPORT] Linked %s to %s", link, abs)
+	return filepath.Base(abs), nil
+}
+
+// writeProfile writes p as a definitions file named after it
+func writeProfile(file string, p inventory.Profile) error {
+	p.Name = ""
+	out, err := yaml.Marshal(p)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(file, append([]byte("# Written by go-pxe import-iso\n"), out...), 0o644)
+}
@@ -0,0 +1,127 @@
+// Package inspect receives hardware introspection reports from OpenStack
+// ironic-python-agent ramdisks, speaking the ironic-inspector /v1/continue
+// and Ironic /v1/continue_inspection callbacks, and keeps the latest report
+// of every client.
+package inspect
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Report is one client's hardware as its ramdisk described it
+type Report struct {
+	Client string    `json:"client"` // inventory host name, else dashed MAC
+	Host   string    `json:"host,omitempty"`
+	MAC    string    `json:"mac"` // the interface the client booted from
+	IP     string    `json:"ip,omitempty"`
+	Time   time.Time `json:"time"`
+
+	Summary Summary `json:"summary"`
+
+	// Data is the callback body as sent, for tools that want everything
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+// Summary is the part of a report most people look for
+type Summary struct {
+	Vendor     string      `json:"vendor,omitempty"`
+	Product    string      `json:"product,omitempty"`
+	Serial     string      `json:"serial,omitempty"`
+	CPUModel   string      `json:"cpuModel,omitempty"`
+	CPUs       int         `json:"cpus,omitempty"`
+	Arch       string      `json:"arch,omitempty"`
+	MemoryMiB  int64       `json:"memoryMiB,omitempty"`
+	Disks      []Disk      `json:"disks,omitempty"`
+	Interfaces []Interface `json:"interfaces,omitempty"`
+	BMCAddress string      `json:"bmcAddress,omitempty"`
+	Error      string      `json:"error,omitempty"` // reported by the ramdisk
+}
+
+// Disk is one block device
+type Disk struct {
+	Name       string `json:"name"`
+	Model      string `json:"model,omitempty"`
+	Serial     string `json:"serial,omitempty"`
+	Size       int64  `json:"size"`
+	Rotational bool   `json:"rotational"`
+}
+
+// Interface is one network interface
+type Interface struct {
+	Name string `json:"name"`
+	MAC  string `json:"mac"`
+	IP   string `json:"ip,omitempty"`
+}
+
+// Store keeps the latest report of every client
+type Store struct {
+	mu      sync.Mutex
+	reports map[string]Report
+}
+
+// NewStore creates an empty store
+func NewStore() *Store {
+	return &Store{reports: make(map[string]Report)}
+}
+
+// Put replaces the client's report
+func (s *Store) Put(r Report) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reports[r.Client] = r
+}
+
+// Get returns the client's report
+func (s *Store) Get(client string) (Report, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.reports[client]
+	return r, ok
+}
+
+// List returns every report without its raw data, most recent first
+func (s *Store) List() []Report {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]Report, 0, len(s.reports))
+	for _, r := range s.reports {
+		r.Data = nil
+		list = append(list, r)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Time.After(list[j].Time) })
+	return list
+}
+
+// Delete forgets the client's report, reporting whether there was one
+func (s *Store) Delete(client string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.reports[client]
+	delete(s.reports, client)
+	return ok
+}
+
+// Snapshot returns every report for backups
+func (s *Store) Snapshot() []Report {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]Report, 0, len(s.reports))
+	for _, r := range s.reports {
+		list = append(list, r)
+	}
+	return list
+}
+
+// Load replaces the introspection reports with list, as a backup restores
+// them
+func (s *Store) Load(list []Report) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reports = make(map[string]Report, len(list))
+	for _, r := range list {
+		s.reports[r.Client] = r
+	}
+}
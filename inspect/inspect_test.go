@@ -0,0 +1,39 @@
+package inspect
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestStore(t *testing.T) {
+	s := NewStore()
+	now := time.Now()
+	s.Put(Report{Client: "old", Time: now.Add(-time.Hour), Data: json.RawMessage(`{}`)})
+	s.Put(Report{Client: "new", Time: now, Data: json.RawMessage(`{}`)})
+
+	list := s.List()
+	if len(list) != 2 || list[0].Client != "new" || list[1].Client != "old" {
+		t.Fatalf("List = %+v", list)
+	}
+	if list[0].Data != nil {
+		t.Error("List kept raw data")
+	}
+	if r, ok := s.Get("new"); !ok || r.Data == nil {
+		t.Errorf("Get = %+v, %v", r, ok)
+	}
+
+	if !s.Delete("old") || s.Delete("old") {
+		t.Error("Delete reported wrongly")
+	}
+
+	snap := s.Snapshot()
+	s.Put(Report{Client: "later"})
+	s.Load(snap)
+	if _, ok := s.Get("later"); ok {
+		t.Error("Load kept a report missing from the snapshot")
+	}
+	if _, ok := s.Get("new"); !ok {
+		t.Error("Load lost a report")
+	}
+}
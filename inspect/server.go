@@ -0,0 +1,193 @@
+package inspect
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxReport bounds a callback body; real ones are tens of kilobytes
+const maxReport = 8 << 20
+
+// Server answers introspection callbacks
+type Server struct {
+	// Domain labels log lines
+	Domain string
+
+	// HostName, if set, returns the inventory host name of mac, or ""
+	HostName func(mac net.HardwareAddr) string
+
+	store *Store
+	mux   *http.ServeMux
+}
+
+// NewServer creates a callback server filing reports in store
+func NewServer(store *Store) *Server {
+	s := &Server{store: store, mux: http.NewServeMux()}
+	s.mux.HandleFunc("POST /v1/continue", s.callback)
+	s.mux.HandleFunc("POST /v1/continue_inspection", s.callback)
+	s.mux.HandleFunc("GET /{$}", s.root)
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// ListenAndServe serves the callbacks on addr
+func (s *Server) ListenAndServe(addr string) error {
+	log.Printf("[INSPECT] %s: introspection callbacks on http://%s/v1/continue", s.Domain, addr)
+	return http.ListenAndServe(addr, s)
+}
+
+// root is the API version document agents probe before calling back
+func (s *Server) root(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"versions": []map[string]string{{"id": "1", "status": "CURRENT"}},
+	})
+}
+
+// payload is the part of an ironic-python-agent inspection report go-pxe
+// reads
+type payload struct {
+	Inventory struct {
+		Interfaces []struct {
+			Name string `json:"name"`
+			MAC  string `json:"mac_address"`
+			IPv4 string `json:"ipv4_address"`
+		} `json:"interfaces"`
+		CPU struct {
+			Model string `json:"model_name"`
+			Count int    `json:"count"`
+			Arch  string `json:"architecture"`
+		} `json:"cpu"`
+		Memory struct {
+			Total      int64 `json:"total"`
+			PhysicalMB int64 `json:"physical_mb"`
+		} `json:"memory"`
+		Disks []struct {
+			Name       string `json:"name"`
+			Model      string `json:"model"`
+			Serial     string `json:"serial"`
+			Size       int64  `json:"size"`
+			Rotational bool   `json:"rotational"`
+		} `json:"disks"`
+		System struct {
+			Product      string `json:"product_name"`
+			Serial       string `json:"serial_number"`
+			Manufacturer string `json:"manufacturer"`
+		} `json:"system_vendor"`
+		BMCAddress string `json:"bmc_address"`
+	} `json:"inventory"`
+	BootInterface string `json:"boot_interface"`
+	Error         string `json:"error"`
+}
+
+func (s *Server) callback(w http.ResponseWriter, r *http.Request) {
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxReport))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	var p payload
+	if err := json.Unmarshal(data, &p); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid report: %w", err))
+		return
+	}
+	remote, _, _ := net.SplitHostPort(r.RemoteAddr)
+	mac := bootMAC(&p, remote)
+	if mac == nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("report names no interface"))
+		return
+	}
+
+	rep := Report{MAC: mac.String(), IP: remote, Time: time.Now(), Summary: summarize(&p), Data: data}
+	if s.HostName != nil {
+		rep.Host = s.HostName(mac)
+	}
+	rep.Client = rep.Host
+	if rep.Client == "" {
+		rep.Client = strings.ReplaceAll(rep.MAC, ":", "-")
+	}
+	s.store.Put(rep)
+
+	sum := rep.Summary
+	if sum.Error != "" {
+		log.Printf("[INSPECT] %s: %s reported an error: %s", s.Domain, rep.Client, sum.Error)
+	}
+	log.Printf("[INSPECT] %s: %s is a %s %s, %d CPUs, %d MiB, %d disks", s.Domain, rep.Client, sum.Vendor, sum.Product, sum.CPUs, sum.MemoryMiB, len(sum.Disks))
+	// Ironic identifies nodes by UUID; the agent only echoes it back, so
+	// the client ID serves
+	writeJSON(w, http.StatusOK, map[string]string{"uuid": rep.Client})
+}
+
+// bootMAC finds the interface the client booted from: the one the agent
+// names, else the one holding the address the report came from, else the
+// first
+func bootMAC(p *payload, remote string) net.HardwareAddr {
+	if p.BootInterface != "" {
+		// PXE style 01-aa-bb-cc-dd-ee-ff, or plain
+		v := p.BootInterface
+		if len(v) == 20 && strings.HasPrefix(v, "01-") {
+			v = v[3:]
+		}
+		if mac, err := net.ParseMAC(v); err == nil {
+			return mac
+		}
+	}
+	var first net.HardwareAddr
+	for _, ifc := range p.Inventory.Interfaces {
+		mac, err := net.ParseMAC(ifc.MAC)
+		if err != nil {
+			continue
+		}
+		if ifc.IPv4 != "" && ifc.IPv4 == remote {
+			return mac
+		}
+		if first == nil {
+			first = mac
+		}
+	}
+	return first
+}
+
+func summarize(p *payload) Summary {
+	inv := &p.Inventory
+	sum := Summary{
+		Vendor:     inv.System.Manufacturer,
+		Product:    inv.System.Product,
+		Serial:     inv.System.Serial,
+		CPUModel:   inv.CPU.Model,
+		CPUs:       inv.CPU.Count,
+		Arch:       inv.CPU.Arch,
+		MemoryMiB:  inv.Memory.PhysicalMB,
+		BMCAddress: inv.BMCAddress,
+		Error:      p.Error,
+	}
+	if sum.MemoryMiB == 0 {
+		sum.MemoryMiB = inv.Memory.Total >> 20
+	}
+	for _, d := range inv.Disks {
+		sum.Disks = append(sum.Disks, Disk{Name: d.Name, Model: d.Model, Serial: d.Serial, Size: d.Size, Rotational: d.Rotational})
+	}
+	for _, ifc := range inv.Interfaces {
+		sum.Interfaces = append(sum.Interfaces, Interface{Name: ifc.Name, MAC: ifc.MAC, IP: ifc.IPv4})
+	}
+	return sum
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError answers in the OpenStack error format agents log
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]any{"error": map[string]string{"message": err.Error()}})
+}
@@ -0,0 +1,125 @@
+package inspect
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const report = `{
+	"inventory": {
+		"interfaces": [
+			{"name": "eno1", "mac_address": "aa:bb:cc:dd:ee:01", "ipv4_address": "192.168.1.50"},
+			{"name": "eno2", "mac_address": "aa:bb:cc:dd:ee:02", "ipv4_address": "192.168.1.51"}
+		],
+		"cpu": {"model_name": "Xeon", "count": 16, "architecture": "x86_64"},
+		"memory": {"total": 34359738368},
+		"disks": [{"name": "/dev/sda", "model": "SSD", "size": 480103981056, "rotational": false}],
+		"system_vendor": {"product_name": "R640", "serial_number": "ABC123", "manufacturer": "Dell Inc."},
+		"bmc_address": "10.0.0.50"
+	}
+}`
+
+func post(s *Server, path, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", path, strings.NewReader(body))
+	r.RemoteAddr = "192.168.1.51:40000"
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+func TestCallback(t *testing.T) {
+	store := NewStore()
+	s := NewServer(store)
+	w := post(s, "/v1/continue", report)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var resp map[string]string
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp["uuid"] != "aa-bb-cc-dd-ee-02" {
+		t.Errorf("uuid = %q", resp["uuid"])
+	}
+
+	// The report came from eno2's address
+	r, ok := store.Get("aa-bb-cc-dd-ee-02")
+	if !ok {
+		t.Fatalf("reports = %+v", store.List())
+	}
+	sum := r.Summary
+	if r.MAC != "aa:bb:cc:dd:ee:02" || r.IP != "192.168.1.51" || sum.Vendor != "Dell Inc." || sum.CPUs != 16 ||
+		sum.MemoryMiB != 32768 || len(sum.Disks) != 1 || len(sum.Interfaces) != 2 || sum.BMCAddress != "10.0.0.50" {
+		t.Errorf("report = %+v", r)
+	}
+	if string(r.Data) != report {
+		t.Error("raw report not kept")
+	}
+}
+
+func TestBootMAC(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"pxe style", `{"boot_interface": "01-aa-bb-cc-dd-ee-09", "inventory": {"interfaces": [{"mac_address": "aa:bb:cc:dd:ee:01"}]}}`, "aa:bb:cc:dd:ee:09"},
+		{"plain", `{"boot_interface": "aa:bb:cc:dd:ee:09"}`, "aa:bb:cc:dd:ee:09"},
+		{"bad boot interface", `{"boot_interface": "eno1", "inventory": {"interfaces": [{"mac_address": "aa:bb:cc:dd:ee:01"}]}}`, "aa:bb:cc:dd:ee:01"},
+		{"first valid", `{"inventory": {"interfaces": [{"mac_address": "bogus"}, {"mac_address": "aa:bb:cc:dd:ee:03", "ipv4_address": "10.1.1.1"}]}}`, "aa:bb:cc:dd:ee:03"},
+		{"none", `{"inventory": {"interfaces": [{"mac_address": ""}]}}`, ""},
+		{"empty", `{}`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var p payload
+			if err := json.Unmarshal([]byte(tt.body), &p); err != nil {
+				t.Fatal(err)
+			}
+			if got := bootMAC(&p, "192.168.1.51"); got.String() != tt.want {
+				t.Errorf("bootMAC = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCallbackMalformed(t *testing.T) {
+	s := NewServer(NewStore())
+	for _, body := range []string{"", "{", "[]", `{"inventory": []}`, `{"inventory": {"cpu": {"count": "many"}}}`, `{}`, "null"} {
+		w := post(s, "/v1/continue_inspection", body)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%q: status %d, want 400", body, w.Code)
+		}
+		var e struct {
+			Error struct{ Message string } `json:"error"`
+		}
+		if json.Unmarshal(w.Body.Bytes(), &e); e.Error.Message == "" {
+			t.Errorf("%q: no error message in %s", body, w.Body)
+		}
+	}
+}
+
+func TestHostName(t *testing.T) {
+	store := NewStore()
+	s := NewServer(store)
+	s.HostName = func(mac net.HardwareAddr) string {
+		if mac.String() == "aa:bb:cc:dd:ee:02" {
+			return "node2"
+		}
+		return ""
+	}
+	post(s, "/v1/continue", report)
+	if r, ok := store.Get("node2"); !ok || r.Host != "node2" {
+		t.Errorf("reports = %+v", store.List())
+	}
+}
+
+func TestRoot(t *testing.T) {
+	w := httptest.NewRecorder()
+	NewServer(NewStore()).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "CURRENT") {
+		t.Errorf("status %d: %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,62 @@
+package inventory
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Anaconda installs RHEL and its rebuilds (Rocky, AlmaLinux, Fedora) with
+// the Anaconda installer: go-pxe adds the inst.* options it needs to the
+// profile's cmdline. With the profile's ISO, the installer boots from the
+// DVD's pxeboot kernel and installs from the DVD.
+type Anaconda struct {
+	// Repo is the installation repository URL (inst.repo). If the
+	// profile has an ISO too, only the installer image (inst.stage2) is
+	// loaded from it. Without either, Anaconda asks.
+	Repo string `yaml:"repo,omitempty" json:"repo,omitempty"`
+
+	// Kickstart is the kickstart file (inst.ks), relative to the HTTP
+	// root. As <name>.tmpl it is rendered for each host.
+	Kickstart string `yaml:"kickstart,omitempty" json:"kickstart,omitempty"`
+
+	// Console is the serial console, such as ttyS0,115200n8. The
+	// installer runs in text mode on it, with tty0 kept as well.
+	Console string `yaml:"console,omitempty" json:"console,omitempty"`
+}
+
+func (a *Anaconda) check() error {
+	if a == nil || a.Repo == "" {
+		return nil
+	}
+	scheme, _, _ := strings.Cut(a.Repo, ":")
+	switch scheme {
+	case "http", "https", "ftp", "nfs", "hd", "cdrom":
+		return nil
+	}
+	return fmt.Errorf("anaconda repo %q is not a repository URL", a.Repo)
+}
+
+func (a *Anaconda) boot(p *Profile, server string, c *cmdline) {
+	if p.ISO != "" {
+		if p.Kernel == "" {
+			p.Kernel = p.Media() + "images/pxeboot/vmlinuz"
+			p.Initrd = []string{p.Media() + "images/pxeboot/initrd.img"}
+		}
+		if a.Repo == "" {
+			c.add("inst.repo", server+"/"+p.Media())
+		} else {
+			c.add("inst.stage2", server+"/"+p.Media())
+		}
+	}
+	if a.Repo != "" {
+		c.add("inst.repo", a.Repo)
+	}
+	if a.Kickstart != "" {
+		c.add("inst.ks", server+path.Clean("/"+a.Kickstart))
+	}
+	if a.Console != "" && !c.has("console") {
+		*c = append(*c, "console=tty0", "console="+a.Console)
+		c.add("inst.text", "")
+	}
+}
@@ -0,0 +1,43 @@
+package inventory
+
+import "testing"
+
+func TestAnaconda(t *testing.T) {
+	const server = "http://10.0.0.1:8080"
+	tests := []struct {
+		name    string
+		p       Profile
+		kernel  string
+		initrd  string
+		cmdline string
+	}{
+		{"iso", Profile{Name: "rocky", ISO: "iso/rocky.iso", Anaconda: &Anaconda{Kickstart: "ks/rocky.cfg"}},
+			"media/rocky/images/pxeboot/vmlinuz", "media/rocky/images/pxeboot/initrd.img",
+			"inst.repo=http://10.0.0.1:8080/media/rocky/ inst.ks=http://10.0.0.1:8080/ks/rocky.cfg"},
+		{"iso and repo", Profile{Name: "rocky", ISO: "rocky.iso", Kernel: "k", Initrd: []string{"i"}, Anaconda: &Anaconda{Repo: "https://mirror/rocky/9/BaseOS/x86_64/os"}},
+			"k", "i", "inst.stage2=http://10.0.0.1:8080/media/rocky/ inst.repo=https://mirror/rocky/9/BaseOS/x86_64/os"},
+		{"console", Profile{Name: "alma", Kernel: "k", Cmdline: "quiet inst.repo=nfs:server:/alma", Anaconda: &Anaconda{Repo: "http://x", Console: "ttyS0,115200n8"}},
+			"k", "", "quiet inst.repo=nfs:server:/alma console=tty0 console=ttyS0,115200n8 inst.text"},
+		{"console set", Profile{Name: "alma", Kernel: "k", Cmdline: "console=ttyS1", Anaconda: &Anaconda{Console: "ttyS0"}},
+			"k", "", "console=ttyS1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := tt.p.Booted(server)
+			initrd := ""
+			if len(b.Initrd) > 0 {
+				initrd = b.Initrd[0]
+			}
+			if b.Kernel != tt.kernel || initrd != tt.initrd || b.Cmdline != tt.cmdline {
+				t.Errorf("booted kernel %s, initrd %s, cmdline %q", b.Kernel, initrd, b.Cmdline)
+			}
+		})
+	}
+
+	s := NewStore()
+	for _, repo := range []string{"mirror/rocky", "file:///srv/rocky", "javascript:x"} {
+		if err := s.PutProfile(Profile{Name: "rocky", Anaconda: &Anaconda{Repo: repo}}); err == nil {
+			t.Errorf("repo %q accepted", repo)
+		}
+	}
+}
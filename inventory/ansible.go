@@ -0,0 +1,69 @@
+package inventory
+
+import (
+	"slices"
+	"sort"
+	"strings"
+)
+
+// AnsibleHostVars are the variables go-pxe sets for each host of an
+// Ansible inventory
+type AnsibleHostVars struct {
+	Host    string            `json:"ansible_host,omitempty"`
+	MAC     string            `json:"gopxe_mac"`
+	Profile string            `json:"gopxe_profile,omitempty"`
+	Labels  map[string]string `json:"gopxe_labels,omitempty"`
+}
+
+// Ansible builds a dynamic inventory in the JSON form Ansible expects from
+// an inventory script's --list. Hosts are grouped by profile and by each
+// label as <key>_<value>; addr maps a host's MAC to its leased IP, if any,
+// which becomes its ansible_host.
+func Ansible(hosts []Host, addr map[string]string) map[string]any {
+	groups := make(map[string][]string)
+	vars := make(map[string]AnsibleHostVars, len(hosts))
+	for _, h := range hosts {
+		vars[h.Name] = AnsibleHostVars{Host: addr[h.MAC], MAC: h.MAC, Profile: h.Profile, Labels: h.Labels}
+		var in []string
+		if h.Profile != "" {
+			in = append(in, groupName(h.Profile))
+		}
+		for k, v := range h.Labels {
+			in = append(in, groupName(k+"_"+v))
+		}
+		if len(in) == 0 {
+			in = append(in, "ungrouped")
+		}
+		for _, g := range in {
+			if !slices.Contains(groups[g], h.Name) {
+				groups[g] = append(groups[g], h.Name)
+			}
+		}
+	}
+
+	inv := map[string]any{"_meta": map[string]any{"hostvars": vars}}
+	children := make([]string, 0, len(groups))
+	for g, members := range groups {
+		sort.Strings(members)
+		inv[g] = map[string][]string{"hosts": members}
+		children = append(children, g)
+	}
+	sort.Strings(children)
+	inv["all"] = map[string][]string{"children": children}
+	return inv
+}
+
+// groupName turns s into a valid Ansible group name: letters, digits and
+// underscores, not starting with a digit
+func groupName(s string) string {
+	g := []byte(strings.ToLower(s))
+	for i, c := range g {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9') {
+			g[i] = '_'
+		}
+	}
+	if len(g) > 0 && g[0] >= '0' && g[0] <= '9' {
+		return "_" + string(g)
+	}
+	return string(g)
+}
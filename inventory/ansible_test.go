@@ -0,0 +1,55 @@
+package inventory
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestAnsible(t *testing.T) {
+	hosts := []Host{
+		{Name: "web1", MAC: "aa:bb:cc:dd:ee:01", Profile: "alma-9", Labels: map[string]string{"rack": "A1", "env": "prod"}},
+		{Name: "web2", MAC: "aa:bb:cc:dd:ee:02", Profile: "alma-9", Labels: map[string]string{"env": "prod"}},
+		{Name: "spare", MAC: "aa:bb:cc:dd:ee:03"},
+		{Name: "db1", MAC: "aa:bb:cc:dd:ee:04", Profile: "9x", Labels: map[string]string{"env": "prod"}},
+	}
+	inv := Ansible(hosts, map[string]string{"aa:bb:cc:dd:ee:01": "10.0.0.5"})
+
+	// As Ansible reads it
+	data, err := json.Marshal(inv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]struct {
+		Hosts    []string                   `json:"hosts"`
+		Children []string                   `json:"children"`
+		HostVars map[string]AnsibleHostVars `json:"hostvars"`
+	}
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	groups := map[string][]string{
+		"alma_9":    {"web1", "web2"},
+		"_9x":       {"db1"},
+		"env_prod":  {"db1", "web1", "web2"},
+		"rack_a1":   {"web1"},
+		"ungrouped": {"spare"},
+	}
+	for g, members := range groups {
+		if !reflect.DeepEqual(got[g].Hosts, members) {
+			t.Errorf("group %s = %v, want %v", g, got[g].Hosts, members)
+		}
+	}
+	if want := []string{"_9x", "alma_9", "env_prod", "rack_a1", "ungrouped"}; !reflect.DeepEqual(got["all"].Children, want) {
+		t.Errorf("all = %v", got["all"].Children)
+	}
+	vars := got["_meta"].HostVars
+	if len(vars) != 4 || vars["web1"].Host != "10.0.0.5" || vars["web2"].Host != "" || vars["web1"].Labels["rack"] != "A1" || vars["db1"].Profile != "9x" {
+		t.Errorf("hostvars = %+v", vars)
+	}
+
+	empty, _ := json.Marshal(Ansible(nil, nil))
+	if string(empty) != `{"_meta":{"hostvars":{}},"all":{"children":[]}}` {
+		t.Errorf("empty inventory = %s", empty)
+	}
+}
@@ -0,0 +1,72 @@
+package inventory
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Arches are the client architectures variants are declared for, named
+// as DHCP names them (option 93). UEFI HTTP boot clients, such as
+// efi-x64-http, get the variant of their architecture, and U-Boot ones
+// that of UEFI on the same CPU unless they have their own.
+var Arches = []string{"bios", "efi-ia32", "efi-x64", "efi-arm32", "efi-arm64", "efi-riscv32", "efi-riscv64", "uboot-arm32", "uboot-arm64"}
+
+// Variant replaces the profile's boot files for clients of one
+// architecture; fields left empty keep the profile's
+type Variant struct {
+	BootFile string   `yaml:"bootFile,omitempty" json:"bootFile,omitempty"`
+	Kernel   string   `yaml:"kernel,omitempty" json:"kernel,omitempty"`
+	Initrd   []string `yaml:"initrd,omitempty" json:"initrd,omitempty"`
+	Cmdline  string   `yaml:"cmdline,omitempty" json:"cmdline,omitempty"`
+}
+
+// ForArch is the profile as clients of arch boot it, with its variant for
+// arch applied. Clients of unknown architecture, or of one without a
+// variant, get the profile as it is.
+func (p Profile) ForArch(arch string) Profile {
+	v, ok := lookupArch(p.Arch, arch)
+	if !ok {
+		return p
+	}
+	p.BootFile = cmp.Or(v.BootFile, p.BootFile)
+	p.Kernel = cmp.Or(v.Kernel, p.Kernel)
+	if v.Initrd != nil {
+		p.Initrd = v.Initrd
+	}
+	p.Cmdline = cmp.Or(v.Cmdline, p.Cmdline)
+	return p
+}
+
+// ProfileFor is the profile the entry boots on clients of arch, "" if it
+// has none for them
+func (e MenuEntry) ProfileFor(arch string) string {
+	if name, ok := lookupArch(e.Arch, arch); ok {
+		return name
+	}
+	return e.Profile
+}
+
+// lookupArch finds the variant for arch
+func lookupArch[V any](variants map[string]V, arch string) (V, bool) {
+	arch = strings.TrimSuffix(arch, "-http")
+	if v, ok := variants[arch]; ok {
+		return v, true
+	}
+	if cpu, ok := strings.CutPrefix(arch, "uboot-"); ok {
+		v, ok := variants["efi-"+cpu]
+		return v, ok
+	}
+	var none V
+	return none, false
+}
+
+func checkArches[V any](variants map[string]V) error {
+	for arch := range variants {
+		if !slices.Contains(Arches, arch) {
+			return fmt.Errorf("unknown architecture %q (known: %s)", arch, strings.Join(Arches, ", "))
+		}
+	}
+	return nil
+}
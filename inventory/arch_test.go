@@ -0,0 +1,51 @@
+package inventory
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestForArch(t *testing.T) {
+	p := Profile{
+		Name: "alma", BootFile: "pxelinux.0", Kernel: "x86/vmlinuz", Initrd: []string{"x86/initrd.img"}, Cmdline: "quiet",
+		Arch: map[string]Variant{
+			"efi-x64":   {BootFile: "grubx64.efi"},
+			"efi-arm64": {BootFile: "grubaa64.efi", Kernel: "arm/vmlinuz", Initrd: []string{"arm/initrd.img"}, Cmdline: "console=ttyAMA0"},
+		},
+	}
+	tests := []struct {
+		arch, bootFile, kernel, initrd, cmdline string
+	}{
+		{"bios", "pxelinux.0", "x86/vmlinuz", "x86/initrd.img", "quiet"},
+		{"efi-x64", "grubx64.efi", "x86/vmlinuz", "x86/initrd.img", "quiet"},
+		{"efi-x64-http", "grubx64.efi", "x86/vmlinuz", "x86/initrd.img", "quiet"},
+		{"efi-arm64", "grubaa64.efi", "arm/vmlinuz", "arm/initrd.img", "console=ttyAMA0"},
+		{"uboot-arm64", "grubaa64.efi", "arm/vmlinuz", "arm/initrd.img", "console=ttyAMA0"},
+		{"uboot-arm32", "pxelinux.0", "x86/vmlinuz", "x86/initrd.img", "quiet"},
+		{"", "pxelinux.0", "x86/vmlinuz", "x86/initrd.img", "quiet"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.arch, func(t *testing.T) {
+			v := p.ForArch(tt.arch)
+			if v.BootFile != tt.bootFile || v.Kernel != tt.kernel || strings.Join(v.Initrd, ",") != tt.initrd || v.Cmdline != tt.cmdline {
+				t.Errorf("ForArch = %s %s %v %q", v.BootFile, v.Kernel, v.Initrd, v.Cmdline)
+			}
+		})
+	}
+
+	if err := NewStore().PutProfile(Profile{Name: "x", Arch: map[string]Variant{"x86_64": {}}}); err == nil || !strings.Contains(err.Error(), "unknown architecture") {
+		t.Errorf("error = %v", err)
+	}
+}
+
+func TestMenuEntryForArch(t *testing.T) {
+	e := MenuEntry{Title: "Alma", Profile: "alma", Arch: map[string]string{"efi-arm64": "alma-arm"}}
+	for arch, want := range map[string]string{"bios": "alma", "efi-arm64": "alma-arm", "uboot-arm64": "alma-arm", "efi-arm64-http": "alma-arm"} {
+		if got := e.ProfileFor(arch); got != want {
+			t.Errorf("ProfileFor(%s) = %s, want %s", arch, got, want)
+		}
+	}
+	if got := (MenuEntry{Arch: map[string]string{"efi-x64": "x"}}).ProfileFor("bios"); got != "" {
+		t.Errorf("entry without a profile for bios gives %q", got)
+	}
+}
@@ -0,0 +1,27 @@
+package inventory
+
+import "path"
+
+// Casper installs Ubuntu from its live server ISO: the profile's ISO,
+// whose casper kernel boots and downloads the whole image from go-pxe
+type Casper struct {
+	// Autoinstall is the directory, relative to the HTTP root, with the
+	// autoinstall user-data and meta-data, either of which may be a
+	// template. Without it the installer asks.
+	Autoinstall string `yaml:"autoinstall,omitempty" json:"autoinstall,omitempty"`
+}
+
+func (u *Casper) boot(p *Profile, server string, c *cmdline) {
+	if p.Kernel == "" {
+		p.Kernel = p.Media() + "casper/vmlinuz"
+		p.Initrd = []string{p.Media() + "casper/initrd"}
+	}
+	c.add("ip", "dhcp")
+	c.add("url", server+path.Clean("/"+p.ISO))
+	// Keeps cloud-init from taking the ISO for its configuration
+	c.add("cloud-config-url", "/dev/null")
+	if u.Autoinstall != "" {
+		c.add("autoinstall", "")
+		c.add("ds", "nocloud-net;s="+server+path.Clean("/"+u.Autoinstall)+"/")
+	}
+}
@@ -0,0 +1,33 @@
+package inventory
+
+import "fmt"
+
+// ESXi installs VMware ESXi: hosts load mboot.efi from the extracted
+// installer, get its boot.cfg rewritten to load from the network, and
+// install from the kickstart file
+type ESXi struct {
+	// Dir is the installer ISO's contents, relative to the TFTP root,
+	// if the profile doesn't have the ISO itself. File names may be in
+	// any case.
+	Dir string `yaml:"dir,omitempty" json:"dir,omitempty"`
+
+	// Kickstart is the ks.cfg, relative to the HTTP root. As <name>.tmpl
+	// it is rendered for each host.
+	Kickstart string `yaml:"kickstart,omitempty" json:"kickstart,omitempty"`
+}
+
+func (e *ESXi) check(iso string) error {
+	if e != nil && e.Dir == "" && iso == "" {
+		return fmt.Errorf("esxi has neither a dir nor the profile's iso")
+	}
+	return nil
+}
+
+// Loader is the boot file hosts of the profile get: BootFile, or for ESXi
+// the installer's mboot.efi
+func (p Profile) Loader() string {
+	if p.BootFile == "" && p.ESXi != nil {
+		return "esxi/" + p.Name + "/mboot.efi"
+	}
+	return p.BootFile
+}
@@ -0,0 +1,26 @@
+package inventory
+
+import "testing"
+
+func TestESXi(t *testing.T) {
+	s := NewStore()
+	if err := s.PutProfile(Profile{Name: "esxi8", ESXi: &ESXi{Kickstart: "ks.cfg"}}); err == nil {
+		t.Error("esxi without files accepted")
+	}
+	if err := s.PutProfile(Profile{Name: "esxi8", ESXi: &ESXi{}, ISO: "VMware-ESXi-8.iso"}); err != nil {
+		t.Fatal(err)
+	}
+	s.PutProfile(Profile{Name: "esxi7", BootFile: "esxi7/efi/boot/bootx64.efi", ESXi: &ESXi{Dir: "esxi7"}})
+	s.PutHost(Host{Name: "hv1", MAC: "aa:bb:cc:dd:ee:01", Profile: "esxi8"})
+	s.PutHost(Host{Name: "hv2", MAC: "aa:bb:cc:dd:ee:02", Profile: "esxi7"})
+
+	if f := s.BootFile(mac("aa:bb:cc:dd:ee:01"), "efi-x64"); f != "esxi/esxi8/mboot.efi" {
+		t.Errorf("BootFile = %s", f)
+	}
+	if f := s.BootFile(mac("aa:bb:cc:dd:ee:02"), "efi-x64"); f != "esxi7/efi/boot/bootx64.efi" {
+		t.Errorf("profile's BootFile = %s", f)
+	}
+	if l := (Profile{Name: "x", BootFile: "pxelinux.0"}).Loader(); l != "pxelinux.0" {
+		t.Errorf("Loader = %s", l)
+	}
+}
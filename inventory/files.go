@@ -0,0 +1,74 @@
+package inventory
+
+import (
+	"path"
+	"strings"
+)
+
+// Files are the files the profile boots with, relative to the TFTP or HTTP
+// root, and dirs the directories it boots from; URLs are left out
+func (p Profile) Files() (files, dirs []string) {
+	add := func(list *[]string, names ...string) {
+		for _, n := range names {
+			if n != "" && !strings.Contains(n, "://") && !strings.HasPrefix(n, "(") {
+				*list = append(*list, path.Clean("/" + n)[1:])
+			}
+		}
+	}
+	add(&files, p.BootFile, p.Kernel, p.FDT, p.ISO)
+	add(&files, p.Initrd...)
+	add(&dirs, p.FDTDir)
+	for _, v := range p.Arch {
+		add(&files, v.BootFile, v.Kernel)
+		add(&files, v.Initrd...)
+	}
+	if p.WinPE != nil {
+		add(&files, p.WinPE.Unattend, p.WinPE.PostInstall)
+	}
+	if p.ESXi != nil {
+		add(&files, p.ESXi.Kickstart)
+		add(&dirs, p.ESXi.Dir)
+	}
+	if p.Anaconda != nil {
+		add(&files, p.Anaconda.Kickstart)
+	}
+	if p.Casper != nil {
+		add(&dirs, p.Casper.Autoinstall)
+	}
+	if p.Live != nil {
+		add(&files, p.Live.Image)
+	}
+	if p.Firmware != nil {
+		add(&files, p.Firmware.Capsules...)
+	}
+	if p.RaspberryPi != nil {
+		add(&dirs, p.RaspberryPi.Dir)
+	}
+	return files, dirs
+}
+
+// Files are the files and directories every profile boots from, and the
+// definitions hosts last booted and could be rolled back to, as well as
+// the hosts' own boot files and device trees
+func (s *Store) Files() (files, dirs []string) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	profiles := make([]Profile, 0, len(s.profiles))
+	for _, p := range s.profiles {
+		profiles = append(profiles, p)
+	}
+	for _, h := range s.hosts {
+		if h.Health != nil {
+			profiles = append(profiles, h.Health.Booted)
+			if h.Health.Good != nil {
+				profiles = append(profiles, *h.Health.Good)
+			}
+		}
+		profiles = append(profiles, Profile{BootFile: h.BootFile, FDT: h.FDT})
+	}
+	for _, p := range profiles {
+		f, d := p.Files()
+		files, dirs = append(files, f...), append(dirs, d...)
+	}
+	return files, dirs
+}
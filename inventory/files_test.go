@@ -0,0 +1,58 @@
+package inventory
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProfileFiles(t *testing.T) {
+	p := Profile{
+		BootFile: "/pxelinux.0", Kernel: "alma/../alma/vmlinuz", Initrd: []string{"alma/initrd.img", "http://10.0.0.1/extra.img"},
+		FDT: "(tftp)/bcm.dtb", FDTDir: "dtbs/", ISO: "iso/alma.iso",
+		Arch:     map[string]Variant{"efi-arm64": {Kernel: "arm/vmlinuz"}},
+		Anaconda: &Anaconda{Kickstart: "ks/alma.cfg"},
+		Firmware: &Firmware{Capsules: []string{"fw/a.cap"}},
+	}
+	files, dirs := p.Files()
+	slices.Sort(files)
+	if got := strings.Join(files, " "); got != "alma/initrd.img alma/vmlinuz arm/vmlinuz fw/a.cap iso/alma.iso ks/alma.cfg pxelinux.0" {
+		t.Errorf("files = %s", got)
+	}
+	if len(dirs) != 1 || dirs[0] != "dtbs" {
+		t.Errorf("dirs = %v", dirs)
+	}
+
+	for _, tt := range []struct {
+		p           Profile
+		files, dirs string
+	}{
+		{Profile{WinPE: &WinPE{Unattend: "win/unattend.xml", PostInstall: "win/post.ps1"}}, "win/unattend.xml win/post.ps1", ""},
+		{Profile{ESXi: &ESXi{Dir: "esxi8", Kickstart: "ks.cfg"}}, "ks.cfg", "esxi8"},
+		{Profile{Casper: &Casper{Autoinstall: "ai/noble"}}, "", "ai/noble"},
+		{Profile{Live: &Live{Image: "kiosk.squashfs"}}, "kiosk.squashfs", ""},
+		{Profile{RaspberryPi: &RaspberryPi{Dir: "pi"}}, "", "pi"},
+	} {
+		files, dirs := tt.p.Files()
+		if strings.Join(files, " ") != tt.files || strings.Join(dirs, " ") != tt.dirs {
+			t.Errorf("Files = %v, %v; want %s, %s", files, dirs, tt.files, tt.dirs)
+		}
+	}
+}
+
+func TestStoreFiles(t *testing.T) {
+	s := NewStore()
+	s.PutProfile(Profile{Name: "alma", Kernel: "alma/9.4/vmlinuz"})
+	s.PutHost(Host{Name: "node1", MAC: "aa:bb:cc:dd:ee:01", Profile: "alma", BootFile: "custom.efi", FDT: "board.dtb"})
+	s.RecordBoot("node1", Profile{Name: "alma", Kernel: "alma/9.3/vmlinuz"}, time.Now())
+	s.ReportHealth("node1", time.Now())
+	s.RecordBoot("node1", Profile{Name: "alma", Kernel: "alma/9.2/vmlinuz"}, time.Now())
+
+	files, _ := s.Files()
+	slices.Sort(files)
+	// The versions the host booted last and could be rolled back to too
+	if got := strings.Join(files, " "); got != "alma/9.2/vmlinuz alma/9.3/vmlinuz alma/9.4/vmlinuz board.dtb custom.efi" {
+		t.Errorf("files = %s", got)
+	}
+}
@@ -0,0 +1,106 @@
+package inventory
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// FirmwareTries is how many times a host is given a firmware update that
+// it still reports the old version after, before it is left on that
+const FirmwareTries = 3
+
+// Firmware makes the profile a firmware update: its kernel and initrd are
+// a small updater environment, which runs go-pxe's firmware/update.sh to
+// load the UEFI capsules for the firmware to apply on its next reboot.
+// Hosts report the version they run on every boot of the profile, and
+// boot from their disk once it is Version.
+type Firmware struct {
+	// Version is what the capsules update the firmware to, as hosts
+	// report it (their SMBIOS BIOS version)
+	Version string `yaml:"version" json:"version"`
+
+	// Capsules are the capsule files, relative to the HTTP root, loaded
+	// in order
+	Capsules []string `yaml:"capsules" json:"capsules"`
+}
+
+// FirmwareReport is the firmware version a host last reported running
+type FirmwareReport struct {
+	Version string    `json:"version"`
+	Time    time.Time `json:"time"`
+
+	// Target is the version the host's profile updates to, Tries the
+	// updates to it given so far
+	Target string `json:"target,omitempty"`
+	Tries  int    `json:"tries,omitempty"`
+}
+
+func (f *Firmware) check() error {
+	if f == nil {
+		return nil
+	}
+	if f.Version == "" {
+		return fmt.Errorf("firmware has no version")
+	}
+	if len(f.Capsules) == 0 {
+		return fmt.Errorf("firmware has no capsules")
+	}
+	for _, c := range f.Capsules {
+		// They are quoted in update.sh
+		if strings.ContainsAny(c, "'\n") {
+			return fmt.Errorf("firmware capsule %q has a quote or newline in its name", c)
+		}
+	}
+	return nil
+}
+
+// Updated reports whether the host runs the firmware p updates to, and
+// whether it gave up on it after FirmwareTries updates; both are false
+// unless p is a firmware update
+func (h Host) Updated(p Profile) (done, failed bool) {
+	if p.Firmware == nil || h.Firmware == nil {
+		return false, false
+	}
+	if h.Firmware.Version == p.Firmware.Version {
+		return true, false
+	}
+	return false, h.Firmware.Target == p.Firmware.Version && h.Firmware.Tries > FirmwareTries
+}
+
+// ReportFirmware records that the host runs firmware version, on the way
+// to target if it boots a firmware update, and counts the update it is
+// given next unless it runs target already. It reports false if there is
+// no such host.
+func (s *Store) ReportFirmware(name, version, target string, t time.Time) (FirmwareReport, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h, ok := s.hosts[name]
+	if !ok {
+		return FirmwareReport{}, false
+	}
+	r := FirmwareReport{Version: version, Time: t, Target: target}
+	if old := h.Firmware; old != nil && old.Target == target {
+		r.Tries = old.Tries
+	}
+	if target != "" && version != target {
+		r.Tries++
+	}
+	h.Firmware = &r
+	s.hosts[name] = h
+	return r, true
+}
+
+// ResetFirmware forgets the firmware the host reported, so it is given
+// failed updates again. It reports whether there was anything to forget.
+func (s *Store) ResetFirmware(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h, ok := s.hosts[name]
+	if !ok || h.Firmware == nil {
+		return false
+	}
+	h.Firmware = nil
+	s.hosts[name] = h
+	return true
+}
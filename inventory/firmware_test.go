@@ -0,0 +1,74 @@
+package inventory
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFirmwareCheck(t *testing.T) {
+	s := NewStore()
+	for _, bad := range []Firmware{
+		{Capsules: []string{"fw/bios.cap"}},
+		{Version: "2.1"},
+		{Version: "2.1", Capsules: []string{"fw/it's.cap"}},
+		{Version: "2.1", Capsules: []string{"fw/a.cap\nreboot"}},
+	} {
+		if err := s.PutProfile(Profile{Name: "fw", Firmware: &bad}); err == nil {
+			t.Errorf("%+v accepted", bad)
+		}
+	}
+}
+
+func TestReportFirmware(t *testing.T) {
+	s := NewStore()
+	p := Profile{Name: "fw", Kernel: "k", Firmware: &Firmware{Version: "2.1", Capsules: []string{"fw/bios.cap"}}}
+	s.PutProfile(p)
+	s.PutHost(Host{Name: "node1", MAC: "aa:bb:cc:dd:ee:01", Profile: "fw"})
+	now := time.Now()
+
+	if h, _ := s.Host("node1"); !updatedAs(h, p, false, false) {
+		t.Error("host without a report updated")
+	}
+	for try := 1; try <= FirmwareTries+1; try++ {
+		r, ok := s.ReportFirmware("node1", "1.0", "2.1", now)
+		if !ok || r.Tries != try || r.Target != "2.1" {
+			t.Fatalf("report %d = %+v, %v", try, r, ok)
+		}
+		h, _ := s.Host("node1")
+		if !updatedAs(h, p, false, try > FirmwareTries) {
+			t.Errorf("after %d tries: %+v", try, h.Firmware)
+		}
+	}
+
+	// A new target starts the count over
+	if r, _ := s.ReportFirmware("node1", "1.0", "2.2", now); r.Tries != 1 {
+		t.Errorf("tries = %d", r.Tries)
+	}
+	r, _ := s.ReportFirmware("node1", "2.1", "2.1", now)
+	h, _ := s.Host("node1")
+	if r.Tries != 0 || !updatedAs(h, p, true, false) {
+		t.Errorf("updated host = %+v", h.Firmware)
+	}
+	// Reported outside a firmware profile, nothing is counted
+	if r, _ := s.ReportFirmware("node1", "2.1", "", now); r.Tries != 0 || r.Target != "" {
+		t.Errorf("report = %+v", r)
+	}
+	if h, _ := s.Host("node1"); !updatedAs(h, Profile{}, false, false) {
+		t.Error("updated on a profile that isn't a firmware update")
+	}
+
+	// The report survives a redefinition
+	s.PutHost(Host{Name: "node1", MAC: "aa:bb:cc:dd:ee:01", Profile: "fw"})
+	if !s.ResetFirmware("node1") || s.ResetFirmware("node1") {
+		t.Error("ResetFirmware reported wrongly")
+	}
+	if _, ok := s.ReportFirmware("nobody", "1.0", "", now); ok {
+		t.Error("report from an unknown host recorded")
+	}
+}
+
+// updatedAs reports whether Updated says done and failed of h on p
+func updatedAs(h Host, p Profile, done, failed bool) bool {
+	d, f := h.Updated(p)
+	return d == done && f == failed
+}
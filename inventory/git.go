@@ -0,0 +1,106 @@
+package inventory
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// GitSource keeps a shallow clone of a branch up to date and reconciles the
+// definitions found under Path inside it. Definitions are only re-read when
+// the branch head moves.
+type GitSource struct {
+	URL      string
+	Branch   string
+	Path     string // definitions directory relative to the repository root
+	Dir      string // local clone
+	Interval time.Duration
+	Store    *Store
+
+	// Reconciler applies the checked-out definitions; its Actor is set to
+	// the commit being applied
+	Reconciler *Reconciler
+
+	rev string
+}
+
+// NewGitSource creates a source polling url every minute
+func NewGitSource(url, branch, path, dir string, store *Store) *GitSource {
+	return &GitSource{
+		URL:        url,
+		Branch:     branch,
+		Path:       path,
+		Dir:        dir,
+		Interval:   time.Minute,
+		Store:      store,
+		Reconciler: NewReconciler(filepath.Join(dir, path), store),
+	}
+}
+
+// Run polls the branch every Interval, never returning. A failed fetch
+// is logged and leaves the definitions last reconciled in place.
+func (g *GitSource) Run() {
+	log.Printf("[GIT] Polling %s (%s:%s) every %s", g.URL, g.Branch, g.Path, g.Interval)
+	for {
+		if err := g.Sync(); err != nil {
+			log.Printf("[GIT] %v", err)
+		}
+		time.Sleep(g.Interval)
+	}
+}
+
+// Sync fetches the branch and, if its head changed, checks it out and
+// reconciles the definitions against the store.
+func (g *GitSource) Sync() error {
+	if _, err := os.Stat(filepath.Join(g.Dir, ".git")); err != nil {
+		if err := git("", "clone", "--quiet", "--depth", "1", "--single-branch", "--branch", g.Branch, g.URL, g.Dir); err != nil {
+			return err
+		}
+	} else {
+		if err := git(g.Dir, "fetch", "--quiet", "--depth", "1", "origin", g.Branch); err != nil {
+			return err
+		}
+		if err := git(g.Dir, "reset", "--quiet", "--hard", "FETCH_HEAD"); err != nil {
+			return err
+		}
+	}
+
+	out, err := exec.Command("git", "-C", g.Dir, "rev-parse", "HEAD").Output()
+	if err != nil {
+		return fmt.Errorf("git rev-parse: %w", err)
+	}
+	rev := strings.TrimSpace(string(out))
+	if rev == g.rev {
+		return nil
+	}
+
+	log.Printf("[GIT] %s is at %s, reconciling", g.Branch, shortRev(rev))
+	g.Reconciler.Actor = "git:" + shortRev(rev)
+	g.Reconciler.Sync()
+	g.rev = rev
+	g.Store.SetRevision(rev)
+	return nil
+}
+
+func git(dir string, args ...string) error {
+	cmd := args[0]
+	if dir != "" {
+		args = append([]string{"-C", dir}, args...)
+	}
+	out, err := exec.Command("git", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("git %s: %v: %s", cmd, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func shortRev(rev string) string {
+	if len(rev) > 12 {
+		return rev[:12]
+	}
+	return rev
+}
@@ -0,0 +1,79 @@
+package inventory
+
+import (
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// commit commits dir's contents and returns the new head
+func commit(t *testing.T, dir string) string {
+	t.Helper()
+	for _, args := range [][]string{{"add", "-A"}, {"commit", "-q", "--allow-empty", "-m", "defs"}} {
+		if out, err := exec.Command("git", append([]string{"-C", dir}, args...)...).CombinedOutput(); err != nil {
+			t.Fatalf("git %s: %v: %s", args[0], err, out)
+		}
+	}
+	out, _ := exec.Command("git", "-C", dir, "rev-parse", "HEAD").Output()
+	return strings.TrimSpace(string(out))
+}
+
+func TestGitSource(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	t.Setenv("GIT_CONFIG_GLOBAL", "/dev/null")
+	t.Setenv("GIT_AUTHOR_NAME", "test")
+	t.Setenv("GIT_AUTHOR_EMAIL", "test@example.com")
+	t.Setenv("GIT_COMMITTER_NAME", "test")
+	t.Setenv("GIT_COMMITTER_EMAIL", "test@example.com")
+
+	origin := t.TempDir()
+	if out, err := exec.Command("git", "init", "-q", "-b", "main", origin).CombinedOutput(); err != nil {
+		t.Fatalf("git init: %v: %s", err, out)
+	}
+	define(t, origin, "defs/hosts/node1.yaml", "mac: aa:bb:cc:dd:ee:01\n")
+	define(t, origin, "hosts/elsewhere.yaml", "mac: aa:bb:cc:dd:ee:02\n")
+	rev := commit(t, origin)
+
+	s := NewStore()
+	g := NewGitSource("file://"+origin, "main", "defs", filepath.Join(t.TempDir(), "clone"), s)
+	if err := g.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Host("node1"); !ok || len(s.Hosts()) != 1 {
+		t.Errorf("hosts = %+v", s.Hosts())
+	}
+	if s.Revision() != rev || g.Reconciler.Actor != "git:"+rev[:12] {
+		t.Errorf("revision %s, actor %s; want %s", s.Revision(), g.Reconciler.Actor, rev)
+	}
+
+	// Nothing new, nothing reconciled: a host put meanwhile stays
+	s.DeleteHost("node1")
+	if err := g.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Host("node1"); ok {
+		t.Error("definitions reconciled without a new commit")
+	}
+
+	define(t, origin, "defs/hosts/node1.yaml", "")
+	define(t, origin, "defs/hosts/node2.yaml", "mac: aa:bb:cc:dd:ee:03\n")
+	rev = commit(t, origin)
+	if err := g.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Host("node2"); !ok || s.Revision() != rev {
+		t.Errorf("hosts %+v at %s, want %s", s.Hosts(), s.Revision(), rev)
+	}
+
+	g.Branch = "missing"
+	if err := g.Sync(); err == nil || !strings.HasPrefix(err.Error(), "git fetch: ") {
+		t.Errorf("error = %v", err)
+	}
+	g = NewGitSource("file://"+filepath.Join(origin, "missing"), "main", "defs", filepath.Join(t.TempDir(), "clone"), s)
+	if err := g.Sync(); err == nil || !strings.HasPrefix(err.Error(), "git clone: ") {
+		t.Errorf("error = %v", err)
+	}
+}
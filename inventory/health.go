@@ -0,0 +1,111 @@
+package inventory
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+)
+
+// Health follows the versions of its profile a host boots. A profile with
+// a health timeout requires the host to report healthy within it after
+// booting; a version it boots without doing so is marked bad, and the host
+// is given the last version it reported healthy on instead.
+type Health struct {
+	Booted   Profile   `json:"booted"`  // profile definition last booted
+	Version  string    `json:"version"` // of Booted
+	Time     time.Time `json:"time"`
+	Deadline time.Time `json:"deadline,omitzero"` // for the health report, zero if none is required
+	Healthy  bool      `json:"healthy"`
+	Reported time.Time `json:"reported,omitzero"`
+
+	// Good is the last definition the host reported healthy on, Bad the
+	// version replaced by it
+	Good *Profile `json:"good,omitempty"`
+	Bad  string   `json:"bad,omitempty"`
+}
+
+// Version identifies a profile definition: it changes with any field
+func Version(p Profile) string {
+	data, _ := json.Marshal(p)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:6])
+}
+
+// missed reports whether the boot went unreported past its deadline at t
+func (hh *Health) missed(t time.Time) bool {
+	return !hh.Healthy && !hh.Deadline.IsZero() && t.After(hh.Deadline)
+}
+
+// rollback returns the definition to boot instead of p, if p is a bad
+// version and there is a good one
+func (hh *Health) rollback(p Profile, t time.Time) (Profile, bool) {
+	if hh == nil || hh.Good == nil {
+		return Profile{}, false
+	}
+	v := Version(p)
+	if v == Version(*hh.Good) || v != hh.Bad && !(v == hh.Version && hh.missed(t)) {
+		return Profile{}, false
+	}
+	return *hh.Good, true
+}
+
+// RecordBoot notes that the host booted profile p at t, marking the version
+// it booted before bad if that one missed its health deadline. It returns
+// the host's new health, or false if there is no such host.
+func (s *Store) RecordBoot(name string, p Profile, t time.Time) (Health, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h, ok := s.hosts[name]
+	if !ok {
+		return Health{}, false
+	}
+	hh := &Health{Booted: p, Version: Version(p), Time: t}
+	if d, _ := time.ParseDuration(p.HealthTimeout); d > 0 {
+		hh.Deadline = t.Add(d)
+	}
+	if old := h.Health; old != nil {
+		hh.Good, hh.Bad = old.Good, old.Bad
+		if old.missed(t) && old.Version != hh.Version {
+			hh.Bad = old.Version
+		}
+	}
+	h.Health = hh
+	s.hosts[name] = h
+	return *hh, true
+}
+
+// ReportHealth records that the host is healthy on the version it last
+// booted, making that its good version. It reports false if the host is
+// unknown or has no recorded boot.
+func (s *Store) ReportHealth(name string, t time.Time) (Health, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h, ok := s.hosts[name]
+	if !ok || h.Health == nil {
+		return Health{}, false
+	}
+	hh := *h.Health
+	good := hh.Booted
+	hh.Healthy, hh.Reported, hh.Good = true, t, &good
+	if hh.Bad == hh.Version {
+		hh.Bad = ""
+	}
+	h.Health = &hh
+	s.hosts[name] = h
+	return hh, true
+}
+
+// ResetHealth forgets the host's boot versions, so it boots its profile as
+// defined again. It reports whether there was anything to forget.
+func (s *Store) ResetHealth(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h, ok := s.hosts[name]
+	if !ok || h.Health == nil {
+		return false
+	}
+	h.Health = nil
+	s.hosts[name] = h
+	return true
+}
@@ -0,0 +1,87 @@
+package inventory
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHealth(t *testing.T) {
+	s := NewStore()
+	v1 := Profile{Name: "alma", Kernel: "alma/9.3/vmlinuz", HealthTimeout: "30m"}
+	v2 := Profile{Name: "alma", Kernel: "alma/9.4/vmlinuz", HealthTimeout: "30m"}
+	s.PutProfile(v1)
+	s.PutHost(Host{Name: "node1", MAC: "aa:bb:cc:dd:ee:01", Profile: "alma"})
+	node1 := mac("aa:bb:cc:dd:ee:01")
+	start := time.Now().Add(-2 * time.Hour)
+
+	if Version(v1) == Version(v2) || Version(v1) != Version(v1) || len(Version(v1)) != 12 {
+		t.Errorf("versions %s, %s", Version(v1), Version(v2))
+	}
+	if _, ok := s.ReportHealth("node1", start); ok {
+		t.Error("healthy before any boot")
+	}
+
+	hh, ok := s.RecordBoot("node1", v1, start)
+	if !ok || hh.Version != Version(v1) || !hh.Deadline.Equal(start.Add(30*time.Minute)) {
+		t.Fatalf("RecordBoot = %+v, %v", hh, ok)
+	}
+	hh, _ = s.ReportHealth("node1", start.Add(time.Minute))
+	if !hh.Healthy || hh.Good == nil || hh.Good.Kernel != v1.Kernel {
+		t.Errorf("ReportHealth = %+v", hh)
+	}
+
+	// v2 boots and never reports healthy: past its deadline the host is
+	// given v1 again
+	s.PutProfile(v2)
+	s.RecordBoot("node1", v2, start.Add(time.Hour))
+	if _, p, _ := s.ProfileFor(node1); p.Kernel != v1.Kernel {
+		t.Errorf("unhealthy host boots %s", p.Kernel)
+	}
+	hh, _ = s.RecordBoot("node1", v1, time.Now())
+	if hh.Bad != Version(v2) {
+		t.Errorf("bad version = %q", hh.Bad)
+	}
+	// The bad version stays rolled back, however long ago it failed
+	if _, p, _ := s.ProfileFor(node1); p.Kernel != v1.Kernel {
+		t.Errorf("host boots the bad version %s", p.Kernel)
+	}
+
+	// A version after it is tried
+	v3 := Profile{Name: "alma", Kernel: "alma/9.5/vmlinuz"}
+	s.PutProfile(v3)
+	if _, p, _ := s.ProfileFor(node1); p.Kernel != v3.Kernel {
+		t.Errorf("new version not tried: %s", p.Kernel)
+	}
+
+	s.PutProfile(v2)
+	if !s.ResetHealth("node1") || s.ResetHealth("node1") {
+		t.Error("ResetHealth reported wrongly")
+	}
+	if _, p, _ := s.ProfileFor(node1); p.Kernel != v2.Kernel {
+		t.Errorf("reset host boots %s", p.Kernel)
+	}
+	if _, ok := s.RecordBoot("nobody", v1, start); ok {
+		t.Error("recorded a boot of an unknown host")
+	}
+}
+
+func TestHealthWithinDeadline(t *testing.T) {
+	s := NewStore()
+	v1 := Profile{Name: "alma", Kernel: "v1", HealthTimeout: "30m"}
+	v2 := Profile{Name: "alma", Kernel: "v2", HealthTimeout: "30m"}
+	s.PutHost(Host{Name: "node1", MAC: "aa:bb:cc:dd:ee:01", Profile: "alma"})
+	s.RecordBoot("node1", v1, time.Now())
+	s.ReportHealth("node1", time.Now())
+
+	// Still within its deadline, v2 is booted again
+	s.PutProfile(v2)
+	s.RecordBoot("node1", v2, time.Now())
+	if _, p, _ := s.ProfileFor(mac("aa:bb:cc:dd:ee:01")); p.Kernel != "v2" {
+		t.Errorf("host boots %s within the deadline", p.Kernel)
+	}
+	// Healthy on v2, it is the version to roll back to
+	hh, _ := s.ReportHealth("node1", time.Now())
+	if hh.Bad != "" || hh.Good.Kernel != "v2" {
+		t.Errorf("health = %+v", hh)
+	}
+}
@@ -0,0 +1,548 @@
+// Package inventory holds the hosts and boot profiles go-pxe serves.
+package inventory
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Profile describes what a host boots
+type Profile struct {
+	Name     string   `yaml:"name,omitempty" json:"name"`
+	BootFile string   `yaml:"bootFile,omitempty" json:"bootFile,omitempty"`
+	Kernel   string   `yaml:"kernel,omitempty" json:"kernel,omitempty"`
+	Initrd   []string `yaml:"initrd,omitempty" json:"initrd,omitempty"`
+	Cmdline  string   `yaml:"cmdline,omitempty" json:"cmdline,omitempty"`
+
+	// FDT is the device tree blob the kernel boots with on boards whose
+	// firmware doesn't provide one, such as U-Boot's; FDTDir instead is a
+	// directory of them, from which U-Boot picks its board's (fdtfile)
+	FDT    string `yaml:"fdt,omitempty" json:"fdt,omitempty"`
+	FDTDir string `yaml:"fdtDir,omitempty" json:"fdtDir,omitempty"`
+
+	// ISO, if set, is an installation disc image, relative to the HTTP
+	// root, whose files are served under media/<profile>/ over TFTP and
+	// HTTP, without extracting it
+	ISO string `yaml:"iso,omitempty" json:"iso,omitempty"`
+
+	// Artifact, if set, is an OCI artifact pinned by digest
+	// (registry/repo:tag@sha256:...) whose files are pulled and served
+	// under oci/<profile>/ in the TFTP and HTTP roots
+	Artifact string `yaml:"artifact,omitempty" json:"artifact,omitempty"`
+
+	// PCRs are the SHA-256 PCR values, by index, that hosts booting this
+	// profile must attest to
+	PCRs map[int]string `yaml:"pcrs,omitempty" json:"pcrs,omitempty"`
+
+	// Windows, if set, are the maintenance windows (see ParseWindow), in
+	// the server's local time, during which hosts get the profile. Outside
+	// them they boot from their own disk.
+	Windows []string `yaml:"windows,omitempty" json:"windows,omitempty"`
+
+	// HealthTimeout, if set (e.g. "30m"), is how long after booting the
+	// profile a host has to report healthy before it is rolled back to
+	// the version it last reported healthy on
+	HealthTimeout string `yaml:"healthTimeout,omitempty" json:"healthTimeout,omitempty"`
+
+	// WinPE, if set, makes the profile a Windows installation
+	WinPE *WinPE `yaml:"winpe,omitempty" json:"winpe,omitempty"`
+
+	// ESXi, if set, makes the profile an ESXi installation
+	ESXi *ESXi `yaml:"esxi,omitempty" json:"esxi,omitempty"`
+
+	// Anaconda, if set, makes the profile a RHEL-family installation
+	Anaconda *Anaconda `yaml:"anaconda,omitempty" json:"anaconda,omitempty"`
+
+	// Casper, if set, makes the profile an Ubuntu live installation
+	Casper *Casper `yaml:"casper,omitempty" json:"casper,omitempty"`
+
+	// Live, if set, makes the profile a live system running from RAM
+	Live *Live `yaml:"live,omitempty" json:"live,omitempty"`
+
+	// ISOBoot, if set, boots the profile's ISO as it is
+	ISOBoot *ISOBoot `yaml:"isoBoot,omitempty" json:"isoBoot,omitempty"`
+
+	// Firmware, if set, makes the profile a firmware update
+	Firmware *Firmware `yaml:"firmware,omitempty" json:"firmware,omitempty"`
+
+	// Menu, if set, makes the profile a menu of other profiles
+	Menu *Menu `yaml:"menu,omitempty" json:"menu,omitempty"`
+
+	// Arch are variants of the profile by client architecture (see
+	// Arches), such as an arm64 kernel and initrd
+	Arch map[string]Variant `yaml:"arch,omitempty" json:"arch,omitempty"`
+
+	// RaspberryPi, if set, makes the profile a Raspberry Pi boot
+	RaspberryPi *RaspberryPi `yaml:"raspberryPi,omitempty" json:"raspberryPi,omitempty"`
+}
+
+// Host is a known machine, identified by MAC address
+type Host struct {
+	Name    string            `yaml:"name,omitempty" json:"name"`
+	MAC     string            `yaml:"mac" json:"mac"`
+	Profile string            `yaml:"profile,omitempty" json:"profile,omitempty"`
+	Labels  map[string]string `yaml:"labels,omitempty" json:"labels,omitempty"`
+
+	// IP, if set, is the host's fixed IPv4 address, handed out by DHCP
+	// instead of one from the pool
+	IP string `yaml:"ip,omitempty" json:"ip,omitempty"`
+
+	// BootFile, if set, overrides the profile's boot file
+	BootFile string `yaml:"bootFile,omitempty" json:"bootFile,omitempty"`
+
+	// FDT, if set, overrides the profile's device tree blob for this
+	// board
+	FDT string `yaml:"fdt,omitempty" json:"fdt,omitempty"`
+
+	// Once installs the host a single time: after it reports its install
+	// complete, it boots from its own disk
+	Once bool `yaml:"once,omitempty" json:"once,omitempty"`
+
+	// Installed is when the host last reported its install complete. It
+	// is not part of the definition and survives updates to it.
+	Installed time.Time `yaml:"-" json:"installed,omitzero"`
+
+	// Reinstall is when the host was flagged for reinstallation: until it
+	// reports an install complete, it boots its profile even if it was
+	// installed once or is outside the profile's windows. Like Installed
+	// it survives updates to the definition.
+	Reinstall time.Time `yaml:"-" json:"reinstall,omitzero"`
+
+	// NBD is the image (relative to the NBD root) served as this host's
+	// default NBD export
+	NBD string `yaml:"nbd,omitempty" json:"nbd,omitempty"`
+
+	// BMC, if set, lets go-pxe power the host and force a PXE boot
+	BMC *BMC `yaml:"bmc,omitempty" json:"bmc,omitempty"`
+
+	// PCRs override the profile's expected PCR values for this host
+	PCRs map[int]string `yaml:"pcrs,omitempty" json:"pcrs,omitempty"`
+
+	// RaspberryPi, if set, identifies the host as a Raspberry Pi and
+	// overrides its profile's boot partition
+	RaspberryPi *RaspberryPiHost `yaml:"raspberryPi,omitempty" json:"raspberryPi,omitempty"`
+
+	// Attestation is the outcome of the host's latest TPM attestation.
+	// It is not part of the definition and survives updates to it.
+	Attestation *Attestation `yaml:"-" json:"attestation,omitempty"`
+
+	// Health tracks the profile versions the host boots. Like
+	// Attestation it survives updates to the definition.
+	Health *Health `yaml:"-" json:"health,omitempty"`
+
+	// Firmware is the version the host last reported running, and
+	// likewise survives updates to the definition
+	Firmware *FirmwareReport `yaml:"-" json:"firmware,omitempty"`
+}
+
+// Attestation summarises a host's latest TPM attestation
+type Attestation struct {
+	Time     time.Time `json:"time"`
+	Verified bool      `json:"verified"`
+	Mismatch []int     `json:"mismatch,omitempty"` // PCRs differing from the policy
+	Error    string    `json:"error,omitempty"`    // why the evidence was rejected
+}
+
+// BMC is a host's baseboard management controller
+type BMC struct {
+	Type     string `yaml:"type,omitempty" json:"type,omitempty"` // "redfish" (default) or "ipmi"
+	Address  string `yaml:"address" json:"address"`               // host[:port], or a URL for Redfish
+	Username string `yaml:"username,omitempty" json:"username,omitempty"`
+	Password string `yaml:"password,omitempty" json:"password,omitempty"`
+
+	// PasswordEnv names an environment variable holding the password, so
+	// definitions kept in Git carry no secrets
+	PasswordEnv string `yaml:"passwordEnv,omitempty" json:"passwordEnv,omitempty"`
+
+	// Insecure skips TLS verification of the BMC's (often self-signed)
+	// Redfish certificate
+	Insecure bool `yaml:"insecure,omitempty" json:"insecure,omitempty"`
+
+	// UEFI asks for a UEFI network boot; without it some IPMI BMCs fall
+	// back to legacy BIOS for the one-time boot
+	UEFI bool `yaml:"uefi,omitempty" json:"uefi,omitempty"`
+}
+
+// Redacted is shown in place of a BMC password
+const Redacted = "********"
+
+// Secret returns the BMC password, from PasswordEnv if set
+func (b *BMC) Secret() string {
+	if b.PasswordEnv != "" {
+		return os.Getenv(b.PasswordEnv)
+	}
+	return b.Password
+}
+
+// Redacted returns a copy of h safe to show or log: its BMC password
+// masked
+func (h Host) Redacted() Host {
+	if h.BMC != nil && h.BMC.Password != "" {
+		b := *h.BMC
+		b.Password = Redacted
+		h.BMC = &b
+	}
+	return h
+}
+
+// Store is the live, concurrency-safe set of hosts and profiles
+type Store struct {
+	mu       sync.RWMutex
+	hosts    map[string]Host
+	byMAC    map[string]string // normalized MAC -> host name
+	profiles map[string]Profile
+	rollouts map[string]Rollout // by stable profile
+	revision string
+}
+
+// NewStore creates an empty store
+func NewStore() *Store {
+	return &Store{
+		hosts:    make(map[string]Host),
+		byMAC:    make(map[string]string),
+		profiles: make(map[string]Profile),
+		rollouts: make(map[string]Rollout),
+	}
+}
+
+// NormalizeMAC returns the canonical lowercase colon form of mac
+func NormalizeMAC(mac string) (string, error) {
+	hw, err := net.ParseMAC(strings.TrimSpace(mac))
+	if err != nil {
+		return "", err
+	}
+	return hw.String(), nil
+}
+
+// PutHost creates or replaces a host
+func (s *Store) PutHost(h Host) error {
+	if h.Name == "" {
+		return fmt.Errorf("host has no name")
+	}
+	mac, err := NormalizeMAC(h.MAC)
+	if err != nil {
+		return fmt.Errorf("host %s: %w", h.Name, err)
+	}
+	h.MAC = mac
+	if h.BMC != nil && h.BMC.Address == "" {
+		return fmt.Errorf("host %s: bmc has no address", h.Name)
+	}
+	if h.IP != "" {
+		ip := net.ParseIP(h.IP).To4()
+		if ip == nil {
+			return fmt.Errorf("host %s: %q is not an IPv4 address", h.Name, h.IP)
+		}
+		h.IP = ip.String()
+	}
+	if err := checkPCRs(h.PCRs); err != nil {
+		return fmt.Errorf("host %s: %w", h.Name, err)
+	}
+	if err := h.RaspberryPi.check(); err != nil {
+		return fmt.Errorf("host %s: %w", h.Name, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if other, ok := s.byMAC[mac]; ok && other != h.Name {
+		return fmt.Errorf("host %s: MAC %s already belongs to %s", h.Name, mac, other)
+	}
+	if h.IP != "" {
+		for _, other := range s.hosts {
+			if other.IP == h.IP && other.Name != h.Name {
+				return fmt.Errorf("host %s: address %s already belongs to %s", h.Name, h.IP, other.Name)
+			}
+		}
+	}
+	if serial := h.RaspberryPi.serial(); serial != "" {
+		for _, other := range s.hosts {
+			if other.RaspberryPi.serial() == serial && other.Name != h.Name {
+				return fmt.Errorf("host %s: serial %s already belongs to %s", h.Name, serial, other.Name)
+			}
+		}
+	}
+	if old, ok := s.hosts[h.Name]; ok {
+		delete(s.byMAC, old.MAC)
+		if h.Attestation == nil {
+			h.Attestation = old.Attestation
+		}
+		if h.Health == nil {
+			h.Health = old.Health
+		}
+		if h.Firmware == nil {
+			h.Firmware = old.Firmware
+		}
+		if h.Installed.IsZero() {
+			h.Installed = old.Installed
+		}
+		if h.Reinstall.IsZero() {
+			h.Reinstall = old.Reinstall
+		}
+	}
+	s.hosts[h.Name] = h
+	s.byMAC[mac] = h.Name
+	return nil
+}
+
+// DeleteHost removes a host by name
+func (s *Store) DeleteHost(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if h, ok := s.hosts[name]; ok {
+		delete(s.byMAC, h.MAC)
+		delete(s.hosts, name)
+	}
+}
+
+// Host looks up a host by name
+func (s *Store) Host(name string) (Host, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	h, ok := s.hosts[name]
+	return h, ok
+}
+
+// HostByMAC looks up a host by hardware address
+func (s *Store) HostByMAC(mac net.HardwareAddr) (Host, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	h, ok := s.hosts[s.byMAC[mac.String()]]
+	return h, ok
+}
+
+// Hosts returns all hosts sorted by name
+func (s *Store) Hosts() []Host {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := make([]Host, 0, len(s.hosts))
+	for _, h := range s.hosts {
+		list = append(list, h)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// PutProfile creates or replaces a profile
+func (s *Store) PutProfile(p Profile) error {
+	if p.Name == "" {
+		return fmt.Errorf("profile has no name")
+	}
+	if p.Artifact != "" && !strings.Contains(p.Artifact, "@sha256:") {
+		return fmt.Errorf("profile %s: artifact %q is not pinned by digest", p.Name, p.Artifact)
+	}
+	if err := checkPCRs(p.PCRs); err != nil {
+		return fmt.Errorf("profile %s: %w", p.Name, err)
+	}
+	if d, err := time.ParseDuration(p.HealthTimeout); p.HealthTimeout != "" && (err != nil || d <= 0) {
+		return fmt.Errorf("profile %s: bad healthTimeout %q", p.Name, p.HealthTimeout)
+	}
+	for _, w := range p.Windows {
+		if _, err := ParseWindow(w); err != nil {
+			return fmt.Errorf("profile %s: %w", p.Name, err)
+		}
+	}
+	if err := p.WinPE.check(); err != nil {
+		return fmt.Errorf("profile %s: %w", p.Name, err)
+	}
+	if err := p.ESXi.check(p.ISO); err != nil {
+		return fmt.Errorf("profile %s: %w", p.Name, err)
+	}
+	if err := p.Anaconda.check(); err != nil {
+		return fmt.Errorf("profile %s: %w", p.Name, err)
+	}
+	if p.Casper != nil && p.ISO == "" {
+		return fmt.Errorf("profile %s: casper needs the profile's iso", p.Name)
+	}
+	if err := p.Live.check(p.ISO); err != nil {
+		return fmt.Errorf("profile %s: %w", p.Name, err)
+	}
+	if err := p.ISOBoot.check(p.ISO); err != nil {
+		return fmt.Errorf("profile %s: %w", p.Name, err)
+	}
+	if err := p.Firmware.check(); err != nil {
+		return fmt.Errorf("profile %s: %w", p.Name, err)
+	}
+	if err := p.Menu.check(p); err != nil {
+		return fmt.Errorf("profile %s: %w", p.Name, err)
+	}
+	if err := checkArches(p.Arch); err != nil {
+		return fmt.Errorf("profile %s: %w", p.Name, err)
+	}
+	if err := p.RaspberryPi.check(); err != nil {
+		return fmt.Errorf("profile %s: %w", p.Name, err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.profiles[p.Name] = p
+	return nil
+}
+
+// DeleteProfile removes a profile by name
+func (s *Store) DeleteProfile(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.profiles, name)
+}
+
+// Profile looks up a profile by name
+func (s *Store) Profile(name string) (Profile, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	p, ok := s.profiles[name]
+	return p, ok
+}
+
+// Profiles returns all profiles sorted by name
+func (s *Store) Profiles() []Profile {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := make([]Profile, 0, len(s.profiles))
+	for _, p := range s.profiles {
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// ProfileFor returns the host registered for mac and the profile it boots:
+// its own, or the canary profile if a rollout selects it, unless that is a
+// version the host failed to report healthy on; then the last version it
+// did report healthy on
+func (s *Store) ProfileFor(mac net.HardwareAddr) (Host, Profile, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	h, ok := s.hosts[s.byMAC[mac.String()]]
+	if !ok {
+		return Host{}, Profile{}, false
+	}
+	p, ok := s.profiles[s.profileOf(h)]
+	if good, rolled := h.Health.rollback(p, time.Now()); ok && rolled {
+		return h, good, true
+	}
+	return h, p, ok
+}
+
+// BootFile returns the host's or else its profile's boot file for mac, of
+// architecture arch, or "" if the host is unknown or neither overrides the
+// default.
+func (s *Store) BootFile(mac net.HardwareAddr, arch string) string {
+	h, p, _ := s.ProfileFor(mac)
+	if h.BootFile != "" {
+		return h.BootFile
+	}
+	return p.ForArch(arch).Loader()
+}
+
+// AddressFor returns the fixed address of the host with mac, or nil
+func (s *Store) AddressFor(mac net.HardwareAddr) net.IP {
+	h, ok := s.HostByMAC(mac)
+	if !ok {
+		return nil
+	}
+	return net.ParseIP(h.IP).To4()
+}
+
+// Reserved reports whether ip is some host's fixed address
+func (s *Store) Reserved(ip net.IP) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, h := range s.hosts {
+		if h.IP != "" && ip.Equal(net.ParseIP(h.IP)) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPCRs validates expected PCR values and normalizes them to lower case
+func checkPCRs(pcrs map[int]string) error {
+	for i, v := range pcrs {
+		v = strings.ToLower(strings.TrimSpace(v))
+		if b, err := hex.DecodeString(v); i < 0 || i > 23 || err != nil || len(b) != 32 {
+			return fmt.Errorf("pcrs: want SHA-256 values of PCRs 0-23, got %d: %q", i, pcrs[i])
+		}
+		pcrs[i] = v
+	}
+	return nil
+}
+
+// PCRPolicy returns the PCR values expected of the host with mac: its
+// profile's, overridden by its own
+func (s *Store) PCRPolicy(mac net.HardwareAddr) map[int]string {
+	h, p, _ := s.ProfileFor(mac)
+	policy := make(map[int]string)
+	for i, v := range p.PCRs {
+		policy[i] = v
+	}
+	for i, v := range h.PCRs {
+		policy[i] = v
+	}
+	return policy
+}
+
+// SetAttestation records the outcome of a host's TPM attestation,
+// reporting false if there is no such host
+func (s *Store) SetAttestation(name string, a Attestation) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h, ok := s.hosts[name]
+	if !ok {
+		return false
+	}
+	h.Attestation = &a
+	s.hosts[name] = h
+	return true
+}
+
+// SetInstalled records when the host last completed an install, which
+// clears its reinstallation flag; the zero time lets a host to be
+// installed once be installed again. It reports false if there is no such
+// host.
+func (s *Store) SetInstalled(name string, t time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h, ok := s.hosts[name]
+	if !ok {
+		return false
+	}
+	h.Installed = t
+	if !t.IsZero() {
+		h.Reinstall = time.Time{}
+	}
+	s.hosts[name] = h
+	return true
+}
+
+// SetReinstall flags the host for reinstallation at t, or clears the flag
+// for the zero time. It reports false if there is no such host.
+func (s *Store) SetReinstall(name string, t time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h, ok := s.hosts[name]
+	if !ok {
+		return false
+	}
+	h.Reinstall = t
+	s.hosts[name] = h
+	return true
+}
+
+// SetRevision records the version (e.g. Git commit) of the definitions
+// currently applied
+func (s *Store) SetRevision(rev string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.revision = rev
+}
+
+// Revision returns the version of the applied definitions, if known
+func (s *Store) Revision() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.revision
+}
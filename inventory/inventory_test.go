@@ -0,0 +1,198 @@
+package inventory
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func mac(s string) net.HardwareAddr {
+	hw, _ := net.ParseMAC(s)
+	return hw
+}
+
+var sha = strings.Repeat("ab", 32)
+
+func TestPutHost(t *testing.T) {
+	s := NewStore()
+	if err := s.PutHost(Host{Name: "node1", MAC: " AA-BB-CC-DD-EE-01 ", IP: "10.0.0.5"}); err != nil {
+		t.Fatal(err)
+	}
+	h, ok := s.HostByMAC(mac("aa:bb:cc:dd:ee:01"))
+	if !ok || h.Name != "node1" || h.MAC != "aa:bb:cc:dd:ee:01" {
+		t.Fatalf("HostByMAC = %+v, %v", h, ok)
+	}
+
+	tests := []struct {
+		name string
+		h    Host
+		err  string
+	}{
+		{"no name", Host{MAC: "aa:bb:cc:dd:ee:09"}, "no name"},
+		{"bad mac", Host{Name: "x", MAC: "aa:bb"}, "invalid MAC"},
+		{"bmc without address", Host{Name: "x", MAC: "aa:bb:cc:dd:ee:09", BMC: &BMC{}}, "bmc has no address"},
+		{"ipv6", Host{Name: "x", MAC: "aa:bb:cc:dd:ee:09", IP: "fd00::5"}, "not an IPv4 address"},
+		{"bad pcr", Host{Name: "x", MAC: "aa:bb:cc:dd:ee:09", PCRs: map[int]string{24: sha}}, "pcrs"},
+		{"short pcr", Host{Name: "x", MAC: "aa:bb:cc:dd:ee:09", PCRs: map[int]string{7: "abcd"}}, "pcrs"},
+		{"bad serial", Host{Name: "x", MAC: "aa:bb:cc:dd:ee:09", RaspberryPi: &RaspberryPiHost{Serial: "xyz"}}, "serial"},
+		{"mac taken", Host{Name: "x", MAC: "aa:bb:cc:dd:ee:01"}, "already belongs to node1"},
+		{"ip taken", Host{Name: "x", MAC: "aa:bb:cc:dd:ee:09", IP: "10.0.0.5"}, "already belongs to node1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := s.PutHost(tt.h); err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+	if len(s.Hosts()) != 1 {
+		t.Errorf("hosts = %+v", s.Hosts())
+	}
+
+	// State outside the definition survives a redefinition; the old MAC
+	// is released
+	installed := time.Now()
+	s.SetInstalled("node1", installed)
+	s.SetAttestation("node1", Attestation{Verified: true})
+	if err := s.PutHost(Host{Name: "node1", MAC: "aa:bb:cc:dd:ee:02", PCRs: map[int]string{7: " " + strings.ToUpper(sha)}}); err != nil {
+		t.Fatal(err)
+	}
+	h, _ = s.Host("node1")
+	if !h.Installed.Equal(installed) || h.Attestation == nil || !h.Attestation.Verified || h.PCRs[7] != sha {
+		t.Errorf("redefined = %+v", h)
+	}
+	if _, ok := s.HostByMAC(mac("aa:bb:cc:dd:ee:01")); ok {
+		t.Error("old MAC still maps to the host")
+	}
+	if err := s.PutHost(Host{Name: "node2", MAC: "aa:bb:cc:dd:ee:01"}); err != nil {
+		t.Errorf("released MAC: %v", err)
+	}
+
+	s.DeleteHost("node1")
+	if _, ok := s.HostByMAC(mac("aa:bb:cc:dd:ee:02")); ok {
+		t.Error("deleted host found by MAC")
+	}
+	if s.SetInstalled("node1", installed) || s.SetReinstall("node1", installed) || s.SetAttestation("node1", Attestation{}) {
+		t.Error("updated a deleted host")
+	}
+}
+
+func TestInstalled(t *testing.T) {
+	s := NewStore()
+	s.PutHost(Host{Name: "node1", MAC: "aa:bb:cc:dd:ee:01", Once: true})
+	s.SetReinstall("node1", time.Now())
+	s.SetInstalled("node1", time.Time{})
+	if h, _ := s.Host("node1"); h.Reinstall.IsZero() {
+		t.Error("clearing the install cleared the reinstallation")
+	}
+	s.SetInstalled("node1", time.Now())
+	if h, _ := s.Host("node1"); !h.Reinstall.IsZero() || h.Installed.IsZero() {
+		t.Errorf("host = %+v", h)
+	}
+}
+
+func TestBMCSecret(t *testing.T) {
+	t.Setenv("NODE1_BMC", "from-env")
+	b := &BMC{Address: "10.0.1.5", Password: "inline"}
+	if b.Secret() != "inline" {
+		t.Errorf("Secret = %s", b.Secret())
+	}
+	b.PasswordEnv = "NODE1_BMC"
+	if b.Secret() != "from-env" {
+		t.Errorf("Secret = %s", b.Secret())
+	}
+
+	h := Host{Name: "node1", BMC: &BMC{Address: "x", Password: "secret"}}
+	if r := h.Redacted(); r.BMC.Password != Redacted || h.BMC.Password != "secret" {
+		t.Errorf("redacted %+v, original %+v", r.BMC, h.BMC)
+	}
+	if r := (Host{Name: "node2"}).Redacted(); r.BMC != nil {
+		t.Errorf("redacted = %+v", r)
+	}
+}
+
+func TestPutProfile(t *testing.T) {
+	s := NewStore()
+	tests := []struct {
+		name string
+		p    Profile
+		err  string
+	}{
+		{"no name", Profile{}, "no name"},
+		{"unpinned artifact", Profile{Name: "x", Artifact: "ghcr.io/x/y:1"}, "not pinned"},
+		{"bad pcr", Profile{Name: "x", PCRs: map[int]string{-1: sha}}, "pcrs"},
+		{"bad health timeout", Profile{Name: "x", HealthTimeout: "soon"}, "healthTimeout"},
+		{"negative health timeout", Profile{Name: "x", HealthTimeout: "-5m"}, "healthTimeout"},
+		{"bad window", Profile{Name: "x", Windows: []string{"Caturday 10:00-11:00"}}, "bad days"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := s.PutProfile(tt.p); err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+	if err := s.PutProfile(Profile{Name: "alma", Artifact: "ghcr.io/x/y:1@sha256:" + sha, HealthTimeout: "30m"}); err != nil {
+		t.Fatal(err)
+	}
+	s.PutProfile(Profile{Name: "ubuntu"})
+	if list := s.Profiles(); len(list) != 2 || list[0].Name != "alma" {
+		t.Errorf("Profiles = %+v", list)
+	}
+	s.DeleteProfile("alma")
+	if _, ok := s.Profile("alma"); ok {
+		t.Error("deleted profile found")
+	}
+}
+
+func TestProfileFor(t *testing.T) {
+	s := NewStore()
+	s.PutProfile(Profile{Name: "alma", BootFile: "pxelinux.0", PCRs: map[int]string{0: sha, 7: sha}})
+	s.PutHost(Host{Name: "node1", MAC: "aa:bb:cc:dd:ee:01", Profile: "alma", IP: "10.0.0.5", PCRs: map[int]string{7: strings.Repeat("cd", 32)}})
+	s.PutHost(Host{Name: "node2", MAC: "aa:bb:cc:dd:ee:02", Profile: "alma", BootFile: "ipxe.efi"})
+	s.PutHost(Host{Name: "node3", MAC: "aa:bb:cc:dd:ee:03", Profile: "missing"})
+
+	if h, p, ok := s.ProfileFor(mac("aa:bb:cc:dd:ee:01")); !ok || h.Name != "node1" || p.Name != "alma" {
+		t.Errorf("ProfileFor = %+v, %+v, %v", h, p, ok)
+	}
+	if h, _, ok := s.ProfileFor(mac("aa:bb:cc:dd:ee:03")); ok || h.Name != "node3" {
+		t.Errorf("host with a missing profile = %+v, %v", h, ok)
+	}
+	if _, _, ok := s.ProfileFor(mac("aa:bb:cc:dd:ee:09")); ok {
+		t.Error("unknown MAC has a profile")
+	}
+
+	if f := s.BootFile(mac("aa:bb:cc:dd:ee:01"), "bios"); f != "pxelinux.0" {
+		t.Errorf("BootFile = %s", f)
+	}
+	if f := s.BootFile(mac("aa:bb:cc:dd:ee:02"), "bios"); f != "ipxe.efi" {
+		t.Errorf("host's BootFile = %s", f)
+	}
+	if f := s.BootFile(mac("aa:bb:cc:dd:ee:09"), "bios"); f != "" {
+		t.Errorf("unknown host's BootFile = %s", f)
+	}
+
+	if ip := s.AddressFor(mac("aa:bb:cc:dd:ee:01")); !ip.Equal(net.IPv4(10, 0, 0, 5)) {
+		t.Errorf("AddressFor = %v", ip)
+	}
+	if ip := s.AddressFor(mac("aa:bb:cc:dd:ee:02")); ip != nil {
+		t.Errorf("AddressFor without a fixed address = %v", ip)
+	}
+	if !s.Reserved(net.IPv4(10, 0, 0, 5)) || s.Reserved(net.IPv4(10, 0, 0, 6)) {
+		t.Error("Reserved reported wrongly")
+	}
+
+	policy := s.PCRPolicy(mac("aa:bb:cc:dd:ee:01"))
+	if len(policy) != 2 || policy[0] != sha || policy[7] != strings.Repeat("cd", 32) {
+		t.Errorf("PCRPolicy = %v", policy)
+	}
+}
+
+func TestRevision(t *testing.T) {
+	s := NewStore()
+	s.SetRevision("abc123")
+	if s.Revision() != "abc123" {
+		t.Errorf("Revision = %s", s.Revision())
+	}
+}
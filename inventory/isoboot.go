@@ -0,0 +1,52 @@
+package inventory
+
+import (
+	"cmp"
+	"fmt"
+	"path"
+)
+
+// ISOBoot boots the profile's ISO whole, for small rescue, diagnostic and
+// firmware update discs that have no network boot of their own
+type ISOBoot struct {
+	// Method is sanboot, iPXE attaching the ISO over HTTP as a drive the
+	// firmware boots from (BIOS and UEFI), or memdisk, SYSLINUX's memdisk
+	// loading it into memory (BIOS only, from iPXE or PXELINUX). The
+	// profile's kernel is memdisk unless it names another.
+	Method string `yaml:"method" json:"method"`
+}
+
+func (b *ISOBoot) check(iso string) error {
+	if b == nil {
+		return nil
+	}
+	if b.Method != "sanboot" && b.Method != "memdisk" {
+		return fmt.Errorf("isoBoot method %q is neither sanboot nor memdisk", b.Method)
+	}
+	if iso == "" {
+		return fmt.Errorf("isoBoot needs the profile's iso")
+	}
+	return nil
+}
+
+func (b *ISOBoot) boot(p *Profile, server string, c *cmdline) {
+	if b.Method != "memdisk" {
+		return
+	}
+	p.Kernel = cmp.Or(p.Kernel, "memdisk")
+	p.Initrd = []string{server + path.Clean("/"+p.ISO)}
+	// memdisk takes the ISO for a floppy or hard disk image unless told,
+	// and raw has it copy the image without the BIOS's help, which some
+	// firmware needs
+	c.add("iso", "")
+	c.add("raw", "")
+}
+
+// SAN is the URL of the ISO iPXE sanboots for the profile, "" unless it
+// boots one
+func (p Profile) SAN(server string) string {
+	if p.ISOBoot == nil || p.ISOBoot.Method != "sanboot" {
+		return ""
+	}
+	return server + path.Clean("/"+p.ISO)
+}
@@ -0,0 +1,37 @@
+package inventory
+
+import "testing"
+
+func TestISOBoot(t *testing.T) {
+	const server = "http://10.0.0.1:8080"
+	san := Profile{Name: "rescue", ISO: "/iso/systemrescue.iso", ISOBoot: &ISOBoot{Method: "sanboot"}}
+	if got := san.SAN(server); got != "http://10.0.0.1:8080/iso/systemrescue.iso" {
+		t.Errorf("SAN = %s", got)
+	}
+	if b := san.Booted(server); b.Kernel != "" || b.Cmdline != "" {
+		t.Errorf("sanboot profile booted as %+v", b)
+	}
+
+	mem := Profile{Name: "fw", ISO: "fw.iso", ISOBoot: &ISOBoot{Method: "memdisk"}}
+	if mem.SAN(server) != "" || (Profile{}).SAN(server) != "" {
+		t.Error("SAN set for a profile not sanbooted")
+	}
+	b := mem.Booted(server)
+	if b.Kernel != "memdisk" || len(b.Initrd) != 1 || b.Initrd[0] != server+"/fw.iso" || b.Cmdline != "iso raw" {
+		t.Errorf("memdisk profile booted as %+v", b)
+	}
+	mem.Kernel = "syslinux/memdisk"
+	if b := mem.Booted(server); b.Kernel != "syslinux/memdisk" {
+		t.Errorf("kernel = %s", b.Kernel)
+	}
+
+	s := NewStore()
+	for _, bad := range []Profile{
+		{Name: "x", ISO: "x.iso", ISOBoot: &ISOBoot{Method: "grub"}},
+		{Name: "x", ISOBoot: &ISOBoot{Method: "sanboot"}},
+	} {
+		if err := s.PutProfile(bad); err == nil {
+			t.Errorf("%+v accepted", bad.ISOBoot)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package inventory
+
+import (
+	"cmp"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Live boots a live system into RAM: its initrd downloads the root
+// filesystem's squashfs image from go-pxe and runs from memory, with
+// nothing on the machine's disks, for diskless kiosks and rescue
+type Live struct {
+	// Initramfs is the live system's: dracut (Fedora, RHEL and their
+	// rebuilds), casper (Ubuntu) or live-boot (Debian)
+	Initramfs string `yaml:"initramfs" json:"initramfs"`
+
+	// Image is the squashfs, relative to the HTTP root. With the
+	// profile's ISO it defaults to the ISO's own (for casper, the whole
+	// ISO), and the kernel and initrd to the ISO's.
+	Image string `yaml:"image,omitempty" json:"image,omitempty"`
+}
+
+// liveFiles are where live ISOs keep their kernel, initrd and squashfs,
+// by initramfs
+var liveFiles = map[string][3]string{
+	"dracut":    {"images/pxeboot/vmlinuz", "images/pxeboot/initrd.img", "LiveOS/squashfs.img"},
+	"casper":    {"casper/vmlinuz", "casper/initrd", ""},
+	"live-boot": {"live/vmlinuz", "live/initrd.img", "live/filesystem.squashfs"},
+}
+
+func (l *Live) check(iso string) error {
+	if l == nil {
+		return nil
+	}
+	if _, ok := liveFiles[l.Initramfs]; !ok {
+		return fmt.Errorf("live initramfs %q is none of dracut, casper and live-boot", l.Initramfs)
+	}
+	if l.Image == "" && iso == "" {
+		return fmt.Errorf("live has neither an image nor the profile's iso")
+	}
+	return nil
+}
+
+func (l *Live) boot(p *Profile, server string, c *cmdline) {
+	files := liveFiles[l.Initramfs]
+	image := ""
+	if l.Image != "" {
+		image = server + path.Clean("/"+l.Image)
+	}
+	if p.ISO != "" {
+		if p.Kernel == "" {
+			p.Kernel = p.Media() + files[0]
+			p.Initrd = []string{p.Media() + files[1]}
+		}
+		if image == "" && files[2] != "" {
+			image = server + "/" + p.Media() + files[2]
+		}
+	}
+	switch l.Initramfs {
+	case "dracut":
+		c.add("ip", "dhcp")
+		c.add("rd.neednet", "1")
+		c.add("root", "live:"+image)
+		c.add("rd.live.image", "")
+		c.add("rd.live.ram", "1")
+	case "casper":
+		c.add("boot", "casper")
+		c.add("ip", "dhcp")
+		if image == "" || strings.HasSuffix(image, ".iso") {
+			// Releases whose root is several squashfs layers only boot
+			// from the whole ISO
+			c.add("url", cmp.Or(image, server+path.Clean("/"+p.ISO)))
+		} else {
+			c.add("fetch", image)
+		}
+		c.add("toram", "")
+	case "live-boot":
+		c.add("boot", "live")
+		c.add("fetch", image)
+		c.add("toram", "")
+	}
+}
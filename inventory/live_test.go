@@ -0,0 +1,42 @@
+package inventory
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLive(t *testing.T) {
+	const server = "http://10.0.0.1:8080"
+	tests := []struct {
+		name    string
+		p       Profile
+		kernel  string
+		cmdline string
+	}{
+		{"dracut iso", Profile{Name: "fedora", ISO: "fedora-live.iso", Live: &Live{Initramfs: "dracut"}}, "media/fedora/images/pxeboot/vmlinuz",
+			"ip=dhcp rd.neednet=1 root=live:http://10.0.0.1:8080/media/fedora/LiveOS/squashfs.img rd.live.image rd.live.ram=1"},
+		{"dracut image", Profile{Name: "kiosk", Kernel: "kiosk/vmlinuz", Live: &Live{Initramfs: "dracut", Image: "kiosk/squashfs.img"}}, "kiosk/vmlinuz",
+			"ip=dhcp rd.neednet=1 root=live:http://10.0.0.1:8080/kiosk/squashfs.img rd.live.image rd.live.ram=1"},
+		{"casper iso", Profile{Name: "noble", ISO: "iso/noble.iso", Live: &Live{Initramfs: "casper"}}, "media/noble/casper/vmlinuz",
+			"boot=casper ip=dhcp url=http://10.0.0.1:8080/iso/noble.iso toram"},
+		{"casper squashfs", Profile{Name: "jammy", ISO: "jammy.iso", Live: &Live{Initramfs: "casper", Image: "jammy/filesystem.squashfs"}}, "media/jammy/casper/vmlinuz",
+			"boot=casper ip=dhcp fetch=http://10.0.0.1:8080/jammy/filesystem.squashfs toram"},
+		{"live-boot", Profile{Name: "debian", ISO: "debian-live.iso", Cmdline: "toram=filesystem.squashfs", Live: &Live{Initramfs: "live-boot"}}, "media/debian/live/vmlinuz",
+			"toram=filesystem.squashfs boot=live fetch=http://10.0.0.1:8080/media/debian/live/filesystem.squashfs"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := tt.p.Booted(server)
+			if b.Kernel != tt.kernel || b.Cmdline != tt.cmdline {
+				t.Errorf("booted %s %q\nwant %s %q", b.Kernel, b.Cmdline, tt.kernel, tt.cmdline)
+			}
+		})
+	}
+
+	s := NewStore()
+	for _, bad := range []Live{{Initramfs: "initramfs-tools", Image: "x"}, {Initramfs: "dracut"}} {
+		if err := s.PutProfile(Profile{Name: "live", Live: &bad}); err == nil || !strings.Contains(err.Error(), "live") {
+			t.Errorf("%+v: error = %v", bad, err)
+		}
+	}
+}
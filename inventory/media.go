@@ -0,0 +1,57 @@
+package inventory
+
+import "strings"
+
+// Media is where the files of the profile's ISO are served, relative to
+// the TFTP and HTTP roots
+func (p Profile) Media() string {
+	return "media/" + p.Name + "/"
+}
+
+// Booted is the profile as hosts boot it from the go-pxe whose HTTP
+// server is at server (http://host:port): for Anaconda, casper and live
+// systems, with the kernel and initrd from the ISO unless the profile
+// names them, and the installer's or initramfs's options added to the
+// cmdline, except those it already sets; for ISOs booted by memdisk, with
+// memdisk loading the ISO
+func (p Profile) Booted(server string) Profile {
+	c := cmdline(strings.Fields(p.Cmdline))
+	switch {
+	case p.Anaconda != nil:
+		p.Anaconda.boot(&p, server, &c)
+	case p.Casper != nil:
+		p.Casper.boot(&p, server, &c)
+	case p.Live != nil:
+		p.Live.boot(&p, server, &c)
+	case p.ISOBoot != nil:
+		p.ISOBoot.boot(&p, server, &c)
+	default:
+		return p
+	}
+	p.Cmdline = strings.Join(c, " ")
+	return p
+}
+
+// cmdline is a kernel command line being built
+type cmdline []string
+
+// has reports whether key, or key=value, is set
+func (c cmdline) has(key string) bool {
+	for _, o := range c {
+		if k, _, _ := strings.Cut(o, "="); k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// add sets key=value, or key alone for an empty value, unless key is set
+func (c *cmdline) add(key, value string) {
+	if c.has(key) {
+		return
+	}
+	if value != "" {
+		key += "=" + value
+	}
+	*c = append(*c, key)
+}
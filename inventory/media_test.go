@@ -0,0 +1,43 @@
+package inventory
+
+import "testing"
+
+func TestCasper(t *testing.T) {
+	p := Profile{Name: "noble", ISO: "/iso/../iso/ubuntu-24.04.iso", Cmdline: "ip=10.0.0.5::10.0.0.1:255.255.255.0", Casper: &Casper{Autoinstall: "autoinstall/noble"}}
+	b := p.Booted("http://10.0.0.1:8080")
+	if b.Kernel != "media/noble/casper/vmlinuz" || len(b.Initrd) != 1 || b.Initrd[0] != "media/noble/casper/initrd" {
+		t.Errorf("booted %s, %v", b.Kernel, b.Initrd)
+	}
+	want := "ip=10.0.0.5::10.0.0.1:255.255.255.0 url=http://10.0.0.1:8080/iso/ubuntu-24.04.iso cloud-config-url=/dev/null " +
+		"autoinstall ds=nocloud-net;s=http://10.0.0.1:8080/autoinstall/noble/"
+	if b.Cmdline != want {
+		t.Errorf("cmdline = %q\nwant %q", b.Cmdline, want)
+	}
+	if p.Kernel != "" || p.Cmdline != "ip=10.0.0.5::10.0.0.1:255.255.255.0" {
+		t.Error("Booted changed the profile")
+	}
+
+	if err := NewStore().PutProfile(Profile{Name: "noble", Casper: &Casper{}}); err == nil {
+		t.Error("casper without an iso accepted")
+	}
+}
+
+func TestBootedPlain(t *testing.T) {
+	p := Profile{Name: "alma", Kernel: "k", Cmdline: "  quiet   splash "}
+	if b := p.Booted("http://x"); b.Cmdline != p.Cmdline {
+		t.Errorf("plain profile's cmdline rewritten to %q", b.Cmdline)
+	}
+}
+
+func TestCmdline(t *testing.T) {
+	c := cmdline{"ip=dhcp", "quiet", "rd.live.image"}
+	if !c.has("ip") || !c.has("quiet") || c.has("ip=dhcp") || c.has("rd.live") {
+		t.Error("has reported wrongly")
+	}
+	c.add("quiet", "1")
+	c.add("root", "live:x=y")
+	c.add("toram", "")
+	if len(c) != 5 || c[3] != "root=live:x=y" || c[4] != "toram" {
+		t.Errorf("cmdline = %q", c)
+	}
+}
@@ -0,0 +1,87 @@
+package inventory
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+)
+
+// Menu makes the profile an interactive boot menu: its hosts choose among
+// other profiles and their local disk, offered alike by GRUB, PXELINUX and
+// iPXE
+type Menu struct {
+	// Title heads the menu; the profile's name if empty
+	Title string `yaml:"title,omitempty" json:"title,omitempty"`
+
+	// Entries are the choices, in order
+	Entries []MenuEntry `yaml:"entries" json:"entries"`
+
+	// Default is the title of the entry booted when Timeout runs out; the
+	// first entry if empty
+	Default string `yaml:"default,omitempty" json:"default,omitempty"`
+
+	// Timeout (e.g. "10s") is how long the menu waits for a choice. Without
+	// one it waits until someone chooses.
+	Timeout string `yaml:"timeout,omitempty" json:"timeout,omitempty"`
+}
+
+// MenuEntry boots another profile, which must boot a kernel or ISO of its
+// own, or the local disk. Arch names other profiles for clients of some
+// architectures (see Arches); clients of others get Profile, and without
+// it the entry isn't shown to them.
+type MenuEntry struct {
+	Title     string            `yaml:"title" json:"title"`
+	Profile   string            `yaml:"profile,omitempty" json:"profile,omitempty"`
+	Arch      map[string]string `yaml:"arch,omitempty" json:"arch,omitempty"`
+	LocalBoot bool              `yaml:"localBoot,omitempty" json:"localBoot,omitempty"`
+}
+
+func (m *Menu) check(p Profile) error {
+	if m == nil {
+		return nil
+	}
+	if p.Kernel != "" || p.WinPE != nil || p.ESXi != nil || p.Anaconda != nil || p.Casper != nil || p.Live != nil || p.ISOBoot != nil || p.Firmware != nil {
+		return errors.New("a menu boots its entries' profiles, not a kernel of its own")
+	}
+	if len(m.Entries) == 0 {
+		return errors.New("menu has no entries")
+	}
+	titles := make(map[string]bool)
+	for i, e := range m.Entries {
+		switch {
+		case e.Title == "":
+			return fmt.Errorf("menu entry %d has no title", i+1)
+		case titles[e.Title]:
+			return fmt.Errorf("menu has two entries titled %q", e.Title)
+		case (e.Profile == "" && len(e.Arch) == 0) == !e.LocalBoot:
+			return fmt.Errorf("menu entry %q needs either a profile or localBoot", e.Title)
+		case e.Profile == p.Name || slices.Contains(slices.Collect(maps.Values(e.Arch)), p.Name):
+			return fmt.Errorf("menu entry %q boots the menu itself", e.Title)
+		}
+		if err := checkArches(e.Arch); err != nil {
+			return fmt.Errorf("menu entry %q: %w", e.Title, err)
+		}
+		titles[e.Title] = true
+	}
+	if m.Default != "" && !titles[m.Default] {
+		return fmt.Errorf("menu default %q is none of its entries", m.Default)
+	}
+	if _, err := m.Wait(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Wait is the menu's Timeout, 0 if it waits for a choice
+func (m *Menu) Wait() (time.Duration, error) {
+	if m.Timeout == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(m.Timeout)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("bad menu timeout %q", m.Timeout)
+	}
+	return d, nil
+}
@@ -0,0 +1,50 @@
+package inventory
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMenu(t *testing.T) {
+	entries := []MenuEntry{{Title: "Alma", Profile: "alma"}, {Title: "Disk", LocalBoot: true}}
+	tests := []struct {
+		name string
+		p    Profile
+		err  string
+	}{
+		{"own kernel", Profile{Kernel: "k", Menu: &Menu{Entries: entries}}, "not a kernel of its own"},
+		{"own installer", Profile{Live: &Live{Initramfs: "dracut", Image: "x"}, Menu: &Menu{Entries: entries}}, "not a kernel of its own"},
+		{"empty", Profile{Menu: &Menu{}}, "no entries"},
+		{"untitled", Profile{Menu: &Menu{Entries: []MenuEntry{{Profile: "alma"}}}}, "entry 1 has no title"},
+		{"same title", Profile{Menu: &Menu{Entries: []MenuEntry{{Title: "A", Profile: "a"}, {Title: "A", Profile: "b"}}}}, "two entries titled"},
+		{"nothing to boot", Profile{Menu: &Menu{Entries: []MenuEntry{{Title: "A"}}}}, "either a profile or localBoot"},
+		{"both", Profile{Menu: &Menu{Entries: []MenuEntry{{Title: "A", Profile: "a", LocalBoot: true}}}}, "either a profile or localBoot"},
+		{"itself", Profile{Menu: &Menu{Entries: []MenuEntry{{Title: "A", Profile: "menu"}}}}, "boots the menu itself"},
+		{"itself by arch", Profile{Menu: &Menu{Entries: []MenuEntry{{Title: "A", Arch: map[string]string{"bios": "menu"}}}}}, "boots the menu itself"},
+		{"bad arch", Profile{Menu: &Menu{Entries: []MenuEntry{{Title: "A", Arch: map[string]string{"efi-x86": "a"}}}}}, "unknown architecture"},
+		{"bad default", Profile{Menu: &Menu{Entries: entries, Default: "Windows"}}, "none of its entries"},
+		{"bad timeout", Profile{Menu: &Menu{Entries: entries, Timeout: "10"}}, "bad menu timeout"},
+		{"zero timeout", Profile{Menu: &Menu{Entries: entries, Timeout: "0s"}}, "bad menu timeout"},
+	}
+	s := NewStore()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.p.Name = "menu"
+			if err := s.PutProfile(tt.p); err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+
+	m := &Menu{Entries: append(entries, MenuEntry{Title: "Pi", Arch: map[string]string{"uboot-arm64": "pi"}}), Default: "Disk", Timeout: "10s"}
+	if err := s.PutProfile(Profile{Name: "menu", BootFile: "ipxe.efi", Menu: m}); err != nil {
+		t.Fatal(err)
+	}
+	if d, err := m.Wait(); d != 10*time.Second || err != nil {
+		t.Errorf("Wait = %s, %v", d, err)
+	}
+	if d, err := (&Menu{}).Wait(); d != 0 || err != nil {
+		t.Errorf("Wait without a timeout = %s, %v", d, err)
+	}
+}
@@ -0,0 +1,65 @@
+package inventory
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// RaspberryPi boots Raspberry Pis from a copy of a boot partition: its
+// firmware (start4.elf, fixup4.dat), kernel, device trees, overlays,
+// config.txt and cmdline.txt. The bootloader asks for them under a
+// directory named after the Pi's serial number, which go-pxe serves from
+// Dir for every Pi of the profile.
+type RaspberryPi struct {
+	// Dir is the boot partition's copy, relative to the TFTP root
+	Dir string `yaml:"dir" json:"dir"`
+}
+
+// RaspberryPiHost overrides the profile's boot partition for one Pi
+type RaspberryPiHost struct {
+	// Serial is the Pi's serial number, the last 8 hex digits of the one
+	// in /proc/cpuinfo, which its bootloader names its TFTP directory
+	// after. Without it the Pi is known by its MAC address.
+	Serial string `yaml:"serial,omitempty" json:"serial,omitempty"`
+
+	// Config lines are added to the profile's config.txt
+	Config []string `yaml:"config,omitempty" json:"config,omitempty"`
+
+	// Cmdline replaces the profile's cmdline.txt
+	Cmdline string `yaml:"cmdline,omitempty" json:"cmdline,omitempty"`
+}
+
+var piSerial = regexp.MustCompile(`^[0-9a-f]{8}$`)
+
+func (r *RaspberryPi) check() error {
+	if r != nil && r.Dir == "" {
+		return fmt.Errorf("raspberryPi has no dir")
+	}
+	return nil
+}
+
+func (r *RaspberryPiHost) check() error {
+	if r == nil || r.Serial == "" || piSerial.MatchString(r.Serial) {
+		return nil
+	}
+	return fmt.Errorf("raspberryPi serial %q is not 8 hex digits", r.Serial)
+}
+
+func (r *RaspberryPiHost) serial() string {
+	if r == nil {
+		return ""
+	}
+	return r.Serial
+}
+
+// HostBySerial returns the Raspberry Pi with serial number serial
+func (s *Store) HostBySerial(serial string) (Host, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, h := range s.hosts {
+		if serial != "" && h.RaspberryPi.serial() == serial {
+			return h, true
+		}
+	}
+	return Host{}, false
+}
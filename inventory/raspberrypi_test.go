@@ -0,0 +1,40 @@
+package inventory
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRaspberryPi(t *testing.T) {
+	s := NewStore()
+	if err := s.PutProfile(Profile{Name: "pi", RaspberryPi: &RaspberryPi{}}); err == nil {
+		t.Error("raspberryPi without a dir accepted")
+	}
+	if err := s.PutProfile(Profile{Name: "pi", RaspberryPi: &RaspberryPi{Dir: "pi/boot"}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, serial := range []string{"1234567", "123456789", "1234567G", "DEADBEEF"} {
+		if err := s.PutHost(Host{Name: "pi1", MAC: "dc:a6:32:00:00:01", RaspberryPi: &RaspberryPiHost{Serial: serial}}); err == nil {
+			t.Errorf("serial %q accepted", serial)
+		}
+	}
+	if err := s.PutHost(Host{Name: "pi1", MAC: "dc:a6:32:00:00:01", Profile: "pi", RaspberryPi: &RaspberryPiHost{Serial: "deadbeef"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutHost(Host{Name: "pi2", MAC: "dc:a6:32:00:00:02", RaspberryPi: &RaspberryPiHost{Serial: "deadbeef"}}); err == nil || !strings.Contains(err.Error(), "belongs to pi1") {
+		t.Errorf("duplicate serial: %v", err)
+	}
+	// Known by its MAC address
+	if err := s.PutHost(Host{Name: "pi3", MAC: "dc:a6:32:00:00:03", RaspberryPi: &RaspberryPiHost{}}); err != nil {
+		t.Error(err)
+	}
+
+	if h, ok := s.HostBySerial("deadbeef"); !ok || h.Name != "pi1" {
+		t.Errorf("HostBySerial = %+v, %v", h, ok)
+	}
+	for _, serial := range []string{"", "00000000"} {
+		if h, ok := s.HostBySerial(serial); ok {
+			t.Errorf("HostBySerial(%q) = %s", serial, h.Name)
+		}
+	}
+}
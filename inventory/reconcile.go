@@ -0,0 +1,185 @@
+package inventory
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/ars1364/go-pxe/audit"
+)
+
+// Reconciler keeps a Store in sync with a definitions directory laid out as
+//
+//	<dir>/hosts/<name>.yaml
+//	<dir>/profiles/<name>.yaml
+//
+// Entries it created are updated or deleted as files change. Entries added
+// to the store by other means are left alone.
+type Reconciler struct {
+	Dir      string
+	Store    *Store
+	Interval time.Duration
+
+	// Audit, if set, records every change applied, attributed to Actor
+	// within Domain
+	Audit  *audit.Log
+	Actor  string
+	Domain string
+
+	// last successfully parsed definition per file
+	hosts    map[string]Host
+	profiles map[string]Profile
+}
+
+// NewReconciler creates a reconciler polling dir every two seconds
+func NewReconciler(dir string, store *Store) *Reconciler {
+	return &Reconciler{
+		Dir:      dir,
+		Actor:    "defs:" + dir,
+		Store:    store,
+		Interval: 2 * time.Second,
+		hosts:    make(map[string]Host),
+		profiles: make(map[string]Profile),
+	}
+}
+
+// Run rescans Dir every Interval, never returning
+func (r *Reconciler) Run() {
+	log.Printf("[DEFS] Watching %s every %s", r.Dir, r.Interval)
+	for {
+		r.Sync()
+		time.Sleep(r.Interval)
+	}
+}
+
+// Sync performs one reconcile pass. A file that fails to parse keeps its
+// previously applied definition so a half-saved edit never deletes a host.
+func (r *Reconciler) Sync() {
+	profiles := make(map[string]Profile)
+	for _, file := range r.list("profiles") {
+		var p Profile
+		if err := readYAML(file, &p); err != nil {
+			log.Printf("[DEFS] %v", err)
+			if prev, ok := r.profiles[file]; ok {
+				profiles[file] = prev
+			}
+			continue
+		}
+		if p.Name == "" {
+			p.Name = baseName(file)
+		}
+		profiles[file] = p
+	}
+
+	hosts := make(map[string]Host)
+	for _, file := range r.list("hosts") {
+		var h Host
+		if err := readYAML(file, &h); err != nil {
+			log.Printf("[DEFS] %v", err)
+			if prev, ok := r.hosts[file]; ok {
+				hosts[file] = prev
+			}
+			continue
+		}
+		if h.Name == "" {
+			h.Name = baseName(file)
+		}
+		hosts[file] = h
+	}
+
+	// Deletions first, so a definition moving between files isn't removed
+	// right after being re-applied under its new file.
+	for file, h := range r.hosts {
+		if cur, ok := hosts[file]; !ok || cur.Name != h.Name {
+			r.Store.DeleteHost(h.Name)
+			log.Printf("[DEFS] Deleted host %s", h.Name)
+			r.Audit.Record(r.Actor, r.Domain, "host.delete", h.Name, h.Redacted(), nil)
+		}
+	}
+	for file, p := range r.profiles {
+		if cur, ok := profiles[file]; !ok || cur.Name != p.Name {
+			r.Store.DeleteProfile(p.Name)
+			log.Printf("[DEFS] Deleted profile %s", p.Name)
+			r.Audit.Record(r.Actor, r.Domain, "profile.delete", p.Name, p, nil)
+		}
+	}
+
+	// Profiles before hosts so new hosts never point at a missing profile
+	for file, p := range profiles {
+		if prev, ok := r.profiles[file]; ok && reflect.DeepEqual(prev, p) {
+			continue
+		}
+		if err := r.Store.PutProfile(p); err != nil {
+			log.Printf("[DEFS] %s: %v", file, err)
+			if prev, ok := r.profiles[file]; ok && prev.Name == p.Name {
+				profiles[file] = prev
+			} else {
+				delete(profiles, file)
+			}
+			continue
+		}
+		log.Printf("[DEFS] Applied profile %s", p.Name)
+		var before any
+		if prev, ok := r.profiles[file]; ok && prev.Name == p.Name {
+			before = prev
+		}
+		r.Audit.Record(r.Actor, r.Domain, "profile.put", p.Name, before, p)
+	}
+
+	for file, h := range hosts {
+		if prev, ok := r.hosts[file]; ok && reflect.DeepEqual(prev, h) {
+			continue
+		}
+		if err := r.Store.PutHost(h); err != nil {
+			log.Printf("[DEFS] %s: %v", file, err)
+			if prev, ok := r.hosts[file]; ok && prev.Name == h.Name {
+				hosts[file] = prev
+			} else {
+				delete(hosts, file)
+			}
+			continue
+		}
+		if _, ok := r.Store.Profile(h.Profile); h.Profile != "" && !ok {
+			log.Printf("[DEFS] Host %s references unknown profile %q", h.Name, h.Profile)
+		}
+		log.Printf("[DEFS] Applied host %s (%s)", h.Name, h.MAC)
+		var before any
+		if prev, ok := r.hosts[file]; ok && prev.Name == h.Name {
+			before = prev.Redacted()
+		}
+		r.Audit.Record(r.Actor, r.Domain, "host.put", h.Name, before, h.Redacted())
+	}
+
+	r.hosts = hosts
+	r.profiles = profiles
+}
+
+func (r *Reconciler) list(kind string) []string {
+	var files []string
+	for _, pattern := range []string{"*.yaml", "*.yml"} {
+		m, _ := filepath.Glob(filepath.Join(r.Dir, kind, pattern))
+		files = append(files, m...)
+	}
+	return files
+}
+
+func readYAML(file string, v any) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	if err := yaml.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+	return nil
+}
+
+func baseName(file string) string {
+	return strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+}
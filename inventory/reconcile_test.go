@@ -0,0 +1,115 @@
+package inventory
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ars1364/go-pxe/audit"
+)
+
+// define writes a definition file, or removes it for empty data
+func define(t *testing.T, dir, name, data string) {
+	t.Helper()
+	file := filepath.Join(dir, name)
+	if data == "" {
+		os.Remove(file)
+		return
+	}
+	os.MkdirAll(filepath.Dir(file), 0755)
+	if err := os.WriteFile(file, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	dir := t.TempDir()
+	s := NewStore()
+	r := NewReconciler(dir, s)
+	log, err := audit.Open(filepath.Join(t.TempDir(), "audit.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Audit, r.Domain = log, "lab"
+
+	define(t, dir, "profiles/alma.yaml", "kernel: alma/vmlinuz\ninitrd: [alma/initrd.img]\n")
+	define(t, dir, "hosts/node1.yaml", "mac: aa:bb:cc:dd:ee:01\nprofile: alma\nbmc: {address: 10.0.1.1, password: hunter2}\n")
+	define(t, dir, "hosts/other.yml", "name: node2\nmac: aa:bb:cc:dd:ee:02\n")
+	define(t, dir, "hosts/notes.txt", "mac: aa:bb:cc:dd:ee:03\n")
+	s.PutHost(Host{Name: "manual", MAC: "aa:bb:cc:dd:ee:09"})
+	r.Sync()
+
+	if p, ok := s.Profile("alma"); !ok || p.Kernel != "alma/vmlinuz" || len(p.Initrd) != 1 {
+		t.Errorf("profile = %+v, %v", p, ok)
+	}
+	if h, ok := s.Host("node1"); !ok || h.Profile != "alma" || h.BMC.Password != "hunter2" {
+		t.Errorf("node1 = %+v, %v", h, ok)
+	}
+	if len(s.Hosts()) != 3 {
+		t.Errorf("hosts = %+v", s.Hosts())
+	}
+
+	// A broken edit keeps the definition applied before
+	define(t, dir, "hosts/node1.yaml", "mac: [unterminated\n")
+	r.Sync()
+	if _, ok := s.Host("node1"); !ok {
+		t.Fatal("half-saved file deleted its host")
+	}
+	// So does an invalid one
+	define(t, dir, "hosts/node1.yaml", "mac: aa:bb:cc:dd:ee:02\nprofile: alma\n")
+	r.Sync()
+	if h, _ := s.Host("node1"); h.MAC != "aa:bb:cc:dd:ee:01" {
+		t.Errorf("invalid redefinition applied: %+v", h)
+	}
+	define(t, dir, "hosts/node1.yaml", "mac: aa:bb:cc:dd:ee:01\nprofile: ubuntu\n")
+	r.Sync()
+	if h, _ := s.Host("node1"); h.Profile != "ubuntu" {
+		t.Errorf("node1 = %+v", h)
+	}
+
+	// Renamed within its file, and removed
+	define(t, dir, "hosts/other.yml", "name: node3\nmac: aa:bb:cc:dd:ee:02\n")
+	define(t, dir, "profiles/alma.yaml", "")
+	r.Sync()
+	if _, ok := s.Host("node2"); ok {
+		t.Error("renamed host kept under its old name")
+	}
+	if _, ok := s.Host("node3"); !ok {
+		t.Error("renamed host not applied")
+	}
+	if _, ok := s.Profile("alma"); ok {
+		t.Error("removed profile kept")
+	}
+	if _, ok := s.Host("manual"); !ok {
+		t.Error("host defined elsewhere deleted")
+	}
+
+	entries, err := log.Query(audit.Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actions []string
+	for _, e := range entries {
+		if e.Actor != "defs:"+dir || e.Domain != "lab" {
+			t.Errorf("entry = %+v", e)
+		}
+		if strings.Contains(string(e.Before)+string(e.After), "hunter2") {
+			t.Errorf("BMC password in the audit log: %+v", e)
+		}
+		actions = append(actions, e.Action+" "+e.Target)
+	}
+	want := []string{"profile.put alma", "host.put node1", "host.put node2", "host.put node1", "host.delete node2", "profile.delete alma", "host.put node3"}
+	if len(actions) != len(want) {
+		t.Fatalf("audited %q", actions)
+	}
+	// Within one pass, puts of different files come in any order
+	for i := range 2 {
+		if actions[1+i] != want[1] && actions[1+i] != want[2] {
+			t.Errorf("audited %q", actions)
+		}
+	}
+	if actions[0] != want[0] || actions[3] != want[3] || strings.Join(actions[4:], ",") != strings.Join(want[4:], ",") {
+		t.Errorf("audited %q", actions)
+	}
+}
@@ -0,0 +1,141 @@
+package inventory
+
+import (
+	"fmt"
+	"hash/fnv"
+	"slices"
+	"sort"
+	"time"
+)
+
+// Rollout moves part of a profile's hosts onto a canary profile, e.g. a new
+// image version, while the rest stay on the stable one. Hosts are chosen
+// explicitly, by a stable hash of their names, or both; raising Percent
+// keeps the hosts already chosen.
+type Rollout struct {
+	Profile string    `json:"profile"` // stable profile
+	Canary  string    `json:"canary"`
+	Percent int       `json:"percent,omitempty"`
+	Hosts   []string  `json:"hosts,omitempty"`
+	Started time.Time `json:"started"`
+
+	// Canaries lists the hosts currently on the canary profile. It is
+	// filled in when reading rollouts and ignored when putting them.
+	Canaries []string `json:"canaries,omitempty"`
+}
+
+// Selects reports whether the host with the given name is on the canary
+func (r Rollout) Selects(host string) bool {
+	if slices.Contains(r.Hosts, host) {
+		return true
+	}
+	h := fnv.New32a()
+	h.Write([]byte(host))
+	return int(h.Sum32()%100) < r.Percent
+}
+
+// PutRollout starts or adjusts the rollout of a profile. A rollout whose
+// canary profile doesn't exist leaves every host on the stable one.
+func (s *Store) PutRollout(r Rollout) error {
+	if r.Profile == "" || r.Canary == "" {
+		return fmt.Errorf("rollout needs a profile and a canary profile")
+	}
+	if r.Profile == r.Canary {
+		return fmt.Errorf("rollout of %s: canary is the profile itself", r.Profile)
+	}
+	if r.Percent < 0 || r.Percent > 100 {
+		return fmt.Errorf("rollout of %s: percent %d out of range 0-100", r.Profile, r.Percent)
+	}
+	r.Canaries = nil
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old, ok := s.rollouts[r.Profile]; ok && r.Started.IsZero() {
+		r.Started = old.Started
+	}
+	if r.Started.IsZero() {
+		r.Started = time.Now()
+	}
+	s.rollouts[r.Profile] = r
+	return nil
+}
+
+// DeleteRollout ends the rollout of a profile, returning every host to it.
+// It reports whether there was one.
+func (s *Store) DeleteRollout(profile string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.rollouts[profile]
+	delete(s.rollouts, profile)
+	return ok
+}
+
+// PromoteRollout ends the rollout of a profile by making the canary
+// profile's definition the stable one, and returns the promoted profile
+func (s *Store) PromoteRollout(profile string) (Profile, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.rollouts[profile]
+	if !ok {
+		return Profile{}, fmt.Errorf("profile %s has no rollout", profile)
+	}
+	p, ok := s.profiles[r.Canary]
+	if !ok {
+		return Profile{}, fmt.Errorf("rollout of %s: no such canary profile %q", profile, r.Canary)
+	}
+	p.Name = profile
+	s.profiles[profile] = p
+	delete(s.rollouts, profile)
+	return p, nil
+}
+
+// Rollout looks up the rollout of a profile
+func (s *Store) Rollout(profile string) (Rollout, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	r, ok := s.rollouts[profile]
+	if ok {
+		r.Canaries = s.canaries(r)
+	}
+	return r, ok
+}
+
+// Rollouts returns all rollouts sorted by profile
+func (s *Store) Rollouts() []Rollout {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := make([]Rollout, 0, len(s.rollouts))
+	for _, r := range s.rollouts {
+		r.Canaries = s.canaries(r)
+		list = append(list, r)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Profile < list[j].Profile })
+	return list
+}
+
+// canaries lists the hosts r puts on its canary profile
+func (s *Store) canaries(r Rollout) []string {
+	if _, ok := s.profiles[r.Canary]; !ok {
+		return nil
+	}
+	var names []string
+	for _, h := range s.hosts {
+		if h.Profile == r.Profile && r.Selects(h.Name) {
+			names = append(names, h.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// profileOf is the name of the profile h boots: its own, or the canary of
+// a rollout that selects it
+func (s *Store) profileOf(h Host) string {
+	r, ok := s.rollouts[h.Profile]
+	if !ok || !r.Selects(h.Name) {
+		return h.Profile
+	}
+	if _, ok := s.profiles[r.Canary]; !ok {
+		return h.Profile
+	}
+	return r.Canary
+}
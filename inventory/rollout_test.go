@@ -0,0 +1,112 @@
+package inventory
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSelects(t *testing.T) {
+	var names []string
+	for i := range 200 {
+		names = append(names, fmt.Sprintf("node%d", i))
+	}
+	chosen := func(percent int) []string {
+		var in []string
+		for _, n := range names {
+			if (Rollout{Percent: percent}).Selects(n) {
+				in = append(in, n)
+			}
+		}
+		return in
+	}
+	if len(chosen(0)) != 0 || len(chosen(100)) != len(names) {
+		t.Error("0% or 100% rollout chose wrongly")
+	}
+	ten, half := chosen(10), chosen(50)
+	if len(ten) < 5 || len(ten) > 40 || len(half) < 70 || len(half) > 130 {
+		t.Errorf("10%% chose %d, 50%% chose %d of %d", len(ten), len(half), len(names))
+	}
+	for _, n := range ten {
+		if !slices.Contains(half, n) {
+			t.Errorf("%s left the canary when the rollout grew", n)
+		}
+	}
+	if !(Rollout{Hosts: []string{"node1"}}).Selects("node1") {
+		t.Error("named host not selected")
+	}
+}
+
+func TestRollout(t *testing.T) {
+	s := NewStore()
+	s.PutProfile(Profile{Name: "alma", Kernel: "alma/9.3/vmlinuz"})
+	s.PutHost(Host{Name: "node1", MAC: "aa:bb:cc:dd:ee:01", Profile: "alma"})
+	s.PutHost(Host{Name: "node2", MAC: "aa:bb:cc:dd:ee:02", Profile: "alma"})
+	s.PutHost(Host{Name: "other", MAC: "aa:bb:cc:dd:ee:03", Profile: "ubuntu"})
+
+	for _, bad := range []Rollout{
+		{Canary: "alma-next"},
+		{Profile: "alma", Canary: "alma"},
+		{Profile: "alma", Canary: "alma-next", Percent: 101},
+		{Profile: "alma", Canary: "alma-next", Percent: -1},
+	} {
+		if err := s.PutRollout(bad); err == nil {
+			t.Errorf("%+v accepted", bad)
+		}
+	}
+
+	// Without its canary profile, the rollout moves nobody
+	if err := s.PutRollout(Rollout{Profile: "alma", Canary: "alma-next", Hosts: []string{"node1", "other"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, p, _ := s.ProfileFor(mac("aa:bb:cc:dd:ee:01")); p.Name != "alma" {
+		t.Errorf("node1 boots %s without a canary profile", p.Name)
+	}
+	if r, _ := s.Rollout("alma"); r.Canaries != nil {
+		t.Errorf("canaries = %v", r.Canaries)
+	}
+
+	s.PutProfile(Profile{Name: "alma-next", Kernel: "alma/9.4/vmlinuz"})
+	if _, p, _ := s.ProfileFor(mac("aa:bb:cc:dd:ee:01")); p.Name != "alma-next" {
+		t.Errorf("node1 boots %s", p.Name)
+	}
+	if _, p, _ := s.ProfileFor(mac("aa:bb:cc:dd:ee:02")); p.Name != "alma" {
+		t.Errorf("node2 boots %s", p.Name)
+	}
+	// Only hosts of the stable profile are canaries
+	r, _ := s.Rollout("alma")
+	if strings.Join(r.Canaries, ",") != "node1" {
+		t.Errorf("canaries = %v", r.Canaries)
+	}
+
+	// Adjusted, the rollout keeps its start; its canaries are worked out
+	started := r.Started
+	if err := s.PutRollout(Rollout{Profile: "alma", Canary: "alma-next", Percent: 100, Canaries: []string{"x"}}); err != nil {
+		t.Fatal(err)
+	}
+	list := s.Rollouts()
+	if len(list) != 1 || !list[0].Started.Equal(started) || strings.Join(list[0].Canaries, ",") != "node1,node2" {
+		t.Errorf("rollouts = %+v", list)
+	}
+
+	p, err := s.PromoteRollout("alma")
+	if err != nil || p.Name != "alma" || p.Kernel != "alma/9.4/vmlinuz" {
+		t.Fatalf("PromoteRollout = %+v, %v", p, err)
+	}
+	if _, p, _ := s.ProfileFor(mac("aa:bb:cc:dd:ee:02")); p.Name != "alma" || p.Kernel != "alma/9.4/vmlinuz" {
+		t.Errorf("node2 boots %+v after promotion", p)
+	}
+	if _, err := s.PromoteRollout("alma"); err == nil {
+		t.Error("promoted a finished rollout")
+	}
+
+	s.PutRollout(Rollout{Profile: "alma", Canary: "gone", Started: time.Now()})
+	if _, err := s.PromoteRollout("alma"); err == nil {
+		t.Error("promoted a missing canary")
+	}
+	if !s.DeleteRollout("alma") || s.DeleteRollout("alma") {
+		t.Error("DeleteRollout reported wrongly")
+	}
+}
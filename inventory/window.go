@@ -0,0 +1,97 @@
+package inventory
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Window is a recurring weekly span of time, such as "Sat 22:00-06:00"
+// (Saturday night into Sunday morning), "Mon-Fri 20:00-23:00",
+// "Sat,Sun 00:00-24:00" or "01:00-05:00" (every day). A window whose end
+// is not after its start runs past midnight into the next day.
+type Window struct {
+	days       [7]bool // by time.Weekday the window starts on
+	start, end int     // minutes after midnight
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// ParseWindow parses a window of the form "[days] HH:MM-HH:MM"
+func ParseWindow(s string) (Window, error) {
+	var w Window
+	f := strings.Fields(s)
+	switch len(f) {
+	case 1:
+		w.days = [7]bool{true, true, true, true, true, true, true}
+	case 2:
+		for _, part := range strings.Split(f[0], ",") {
+			from, to, isRange := strings.Cut(part, "-")
+			a, ok := weekdays[strings.ToLower(from)]
+			b, ok2 := weekdays[strings.ToLower(to)]
+			if !ok || isRange && !ok2 {
+				return Window{}, fmt.Errorf("window %q: bad days %q (want e.g. Mon-Fri or Sat,Sun)", s, f[0])
+			}
+			if !isRange {
+				b = a
+			}
+			for d := a; ; d = (d + 1) % 7 {
+				w.days[d] = true
+				if d == b {
+					break
+				}
+			}
+		}
+	default:
+		return Window{}, fmt.Errorf("window %q: want [days] HH:MM-HH:MM", s)
+	}
+
+	from, to, ok := strings.Cut(f[len(f)-1], "-")
+	var err error
+	if w.start, err = clock(from); err == nil && ok {
+		w.end, err = clock(to)
+	}
+	if err != nil || !ok || w.start == 24*60 {
+		return Window{}, fmt.Errorf("window %q: bad times %q (want HH:MM-HH:MM)", s, f[len(f)-1])
+	}
+	return w, nil
+}
+
+// clock parses HH:MM, up to 24:00, into minutes after midnight
+func clock(s string) (int, error) {
+	if s == "24:00" {
+		return 24 * 60, nil
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Contains reports whether t falls within the window, in t's location
+func (w Window) Contains(t time.Time) bool {
+	day, m := t.Weekday(), t.Hour()*60+t.Minute()
+	if w.start < w.end {
+		return w.days[day] && m >= w.start && m < w.end
+	}
+	// Past midnight: the tail belongs to the previous day's window
+	return w.days[day] && m >= w.start || w.days[(day+6)%7] && m < w.end
+}
+
+// InWindow reports whether hosts of the profile may be provisioned at t:
+// always if it defines no windows, else when t falls within one of them
+func (p Profile) InWindow(t time.Time) bool {
+	if len(p.Windows) == 0 {
+		return true
+	}
+	for _, s := range p.Windows {
+		if w, err := ParseWindow(s); err == nil && w.Contains(t) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,63 @@
+package inventory
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseWindow(t *testing.T) {
+	for _, bad := range []string{"", "Sat", "Sat 22:00", "Caturday 22:00-06:00", "Mon- 10:00-11:00", "Mon 25:00-26:00",
+		"Mon 10:00-10:60", "Mon 24:00-06:00", "Mon Tue 10:00-11:00", "10:00~11:00"} {
+		if _, err := ParseWindow(bad); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
+
+func TestWindowContains(t *testing.T) {
+	// 2024-06-01 is a Saturday
+	at := func(day int, clock string) time.Time {
+		c, _ := time.Parse("15:04", clock)
+		return time.Date(2024, 6, day, c.Hour(), c.Minute(), 0, 0, time.UTC)
+	}
+	tests := []struct {
+		window string
+		in     []time.Time
+		out    []time.Time
+	}{
+		{"Sat 22:00-06:00", []time.Time{at(1, "22:00"), at(1, "23:59"), at(2, "05:59")}, []time.Time{at(1, "21:59"), at(2, "06:00"), at(2, "22:00"), at(1, "05:00")}},
+		{"Mon-Fri 20:00-23:00", []time.Time{at(3, "20:00"), at(7, "22:59")}, []time.Time{at(1, "21:00"), at(3, "23:00")}},
+		{"Fri-Mon 12:00-13:00", []time.Time{at(1, "12:30"), at(3, "12:30"), at(7, "12:30")}, []time.Time{at(4, "12:30")}},
+		{"sat,SUN 00:00-24:00", []time.Time{at(1, "00:00"), at(2, "23:59")}, []time.Time{at(3, "00:00"), at(7, "23:59")}},
+		{"01:00-05:00", []time.Time{at(4, "01:00"), at(5, "04:59")}, []time.Time{at(4, "05:00"), at(4, "00:59")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.window, func(t *testing.T) {
+			w, err := ParseWindow(tt.window)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, in := range tt.in {
+				if !w.Contains(in) {
+					t.Errorf("%s not in window", in.Format(time.RFC1123))
+				}
+			}
+			for _, out := range tt.out {
+				if w.Contains(out) {
+					t.Errorf("%s in window", out.Format(time.RFC1123))
+				}
+			}
+		})
+	}
+}
+
+func TestInWindow(t *testing.T) {
+	sat := time.Date(2024, 6, 1, 23, 0, 0, 0, time.UTC)
+	if !(Profile{}).InWindow(sat) {
+		t.Error("profile without windows is out of them")
+	}
+	p := Profile{Windows: []string{"Mon 01:00-02:00", "Sat 22:00-06:00"}}
+	if !p.InWindow(sat) || p.InWindow(sat.Add(-2*time.Hour)) {
+		t.Error("InWindow reported wrongly")
+	}
+}
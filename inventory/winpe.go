@@ -0,0 +1,34 @@
+package inventory
+
+import (
+	"fmt"
+	"strings"
+)
+
+// WinPE installs Windows from WinPE: the profile's kernel is wimboot and
+// its initrds are WinPE's bcd, boot.sdi and boot.wim. go-pxe adds a script
+// that runs Setup from Source with the host's answer file.
+type WinPE struct {
+	// Source is the SMB share holding the installation media, such as
+	// \\fileserver\win2022
+	Source string `yaml:"source" json:"source"`
+
+	// Unattend is the answer file, relative to the HTTP root. As
+	// <name>.tmpl it is rendered for each host.
+	Unattend string `yaml:"unattend,omitempty" json:"unattend,omitempty"`
+
+	// PostInstall is a PowerShell script, relative to the HTTP root and
+	// likewise a template, run by the post-install hook before it reports
+	// the install complete
+	PostInstall string `yaml:"postInstall,omitempty" json:"postInstall,omitempty"`
+}
+
+func (w *WinPE) check() error {
+	if w == nil {
+		return nil
+	}
+	if !strings.HasPrefix(w.Source, `\\`) {
+		return fmt.Errorf(`winpe source %q is not an SMB share (\\server\share)`, w.Source)
+	}
+	return nil
+}
@@ -0,0 +1,15 @@
+package inventory
+
+import "testing"
+
+func TestWinPE(t *testing.T) {
+	s := NewStore()
+	for _, source := range []string{"", "fileserver/win2022", `\fileserver\win2022`, "smb://fileserver/win2022"} {
+		if err := s.PutProfile(Profile{Name: "win", WinPE: &WinPE{Source: source}}); err == nil {
+			t.Errorf("source %q accepted", source)
+		}
+	}
+	if err := s.PutProfile(Profile{Name: "win", Kernel: "wimboot", WinPE: &WinPE{Source: `\\fileserver\win2022`}}); err != nil {
+		t.Error(err)
+	}
+}
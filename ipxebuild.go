@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+
+	"github.com/ars1364/go-pxe/fetch"
+)
+
+// ipxeTarget is an iPXE binary go-pxe ipxe-build makes: its make target,
+// where it goes in the TFTP root and the DHCP client architectures
+// (option 93) it is offered to with -ipxe
+type ipxeTarget struct {
+	Platform string
+	Target   string
+	File     string
+	Archs    []uint16
+}
+
+var ipxeBuilds = []ipxeTarget{
+	{"bios", "bin/undionly.kpxe", "ipxe/undionly.kpxe", []uint16{0}},
+	{"x86_64-efi", "bin-x86_64-efi/ipxe.efi", "ipxe/ipxe.efi", []uint16{7, 9}},
+	{"arm64-efi", "bin-arm64-efi/ipxe.efi", "ipxe/arm64/ipxe.efi", []uint16{11, 22}},
+	{"riscv64-efi", "bin-riscv64-efi/ipxe.efi", "ipxe/riscv64/ipxe.efi", []uint16{27}},
+}
+
+// ipxeBuild is the iPXE binary in root offered to clients of arch, if
+// there is one
+func ipxeBuild(root string, arch uint16) string {
+	for _, b := range ipxeBuilds {
+		if !slices.Contains(b.Archs, arch) {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(root, filepath.FromSlash(b.File))); err == nil {
+			return b.File
+		}
+	}
+	return ""
+}
+
+// ipxeScript is the script embedded in the binaries: it gets an address
+// and chains the client's boot.ipxe from server, retrying until it can
+func ipxeScript(server string) string {
+	return `#!ipxe
+# Embedded by go-pxe ipxe-build
+:retry
+dhcp && chain --autofree ` + server + `/boot.ipxe && exit
+echo Booting from ` + server + ` failed, retrying in 10 seconds
+sleep 10
+goto retry
+`
+}
+
+// runIPXEBuild builds iPXE with a script embedded that goes straight to
+// go-pxe's boot.ipxe, skipping the chainload through DHCP, and puts the
+// binaries where -ipxe offers them:
+//
+//	go-pxe ipxe-build [-src ./ipxe-src] [-tftp-root ./tftp] [-platforms bios,x86_64-efi]
+//	go-pxe ipxe-build -prebuilt https://ci.example.com/ipxe/
+//
+// The iPXE source is cloned into -src unless it is there; building needs
+// its toolchain (gcc, binutils, make, perl, liblzma, mtools). -prebuilt
+// fetches binaries built elsewhere, such as by this command in CI,
+// instead.
+func runIPXEBuild(args []string) {
+	fs := flag.NewFlagSet("ipxe-build", flag.ExitOnError)
+	src := fs.String("src", "./ipxe-src", "iPXE source tree, cloned from -repo if missing")
+	repo := fs.String("repo", "https://github.com/ipxe/ipxe.git", "iPXE Git repository")
+	tftpRoot := fs.String("tftp-root", "./tftp", "TFTP root to put the binaries in (under ipxe/)")
+	httpPort := fs.Int("http-port", 8080, "Server's HTTP port")
+	server := fs.String("server", "", "Server's HTTP URL to embed (default http://${next-server}:<http-port>, the DHCP server's address)")
+	platforms := fs.String("platforms", "bios,x86_64-efi", "Comma-separated platforms to build: bios, x86_64-efi, arm64-efi, riscv64-efi")
+	cross := fs.String("cross", "", "Cross-compiler prefix for arm64-efi or riscv64-efi on other hosts, e.g. aarch64-linux-gnu-")
+	prebuilt := fs.String("prebuilt", "", "Fetch <url>/undionly.kpxe, <url>/ipxe.efi, <url>/arm64/ipxe.efi and <url>/riscv64/ipxe.efi instead of building")
+	fs.StringVar(&fetch.Default.Require, "fetch-verify", fetch.Unverified, "Least verification of -prebuilt binaries to keep them: unverified, checksum (listed in a SHA256SUMS beside them) or signed")
+	fs.StringVar(&fetch.Default.Keyring, "fetch-keyring", "", "gpgv keyring to check the signatures of -prebuilt checksum lists against")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: go-pxe ipxe-build [flags]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var builds []ipxeTarget
+	for _, p := range strings.Split(*platforms, ",") {
+		i := slices.IndexFunc(ipxeBuilds, func(b ipxeTarget) bool { return b.Platform == p })
+		if i < 0 {
+			log.Fatalf("[IPXE] Unknown platform %q", p)
+		}
+		builds = append(builds, ipxeBuilds[i])
+	}
+
+	if *prebuilt != "" {
+		if err := checkVerify(); err != nil {
+			log.Fatalf("[IPXE] %v", err)
+		}
+		base := strings.TrimSuffix(*prebuilt, "/")
+		for _, b := range builds {
+			url := base + "/" + strings.TrimPrefix(b.File, "ipxe/")
+			v, err := fetch.Default.Verified(context.Background(), url, filepath.Join(*tftpRoot, filepath.FromSlash(b.File)), nil)
+			if err != nil {
+				log.Fatalf("[IPXE] %v", err)
+			}
+			fmt.Printf("%s: %s (%s)\n", b.Platform, b.File, v.Level)
+		}
+		return
+	}
+
+	if _, err := os.Stat(filepath.Join(*src, "src", "Makefile")); err != nil {
+		log.Printf("[IPXE] Cloning %s into %s", *repo, *src)
+		if err := run("git", "clone", "--depth", "1", *repo, *src); err != nil {
+			log.Fatalf("[IPXE] %v", err)
+		}
+	}
+	// HTTPS, for menus such as netboot.xyz's; iPXE builds without it by
+	// default. An existing local config is the operator's.
+	local := filepath.Join(*src, "src", "config", "local", "general.h")
+	if _, err := os.Stat(local); err != nil {
+		if err := os.WriteFile(local, []byte("#define DOWNLOAD_PROTO_HTTPS\n"), 0o644); err != nil {
+			log.Fatalf("[IPXE] %v", err)
+		}
+	}
+
+	if *server == "" {
+		*server = fmt.Sprintf("http://${next-server}:%d", *httpPort)
+	}
+	script, err := filepath.Abs(filepath.Join(*tftpRoot, "ipxe", "embed.ipxe"))
+	if err != nil {
+		log.Fatalf("[IPXE] %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(script), 0o755); err != nil {
+		log.Fatalf("[IPXE] %v", err)
+	}
+	if err := os.WriteFile(script, []byte(ipxeScript(*server)), 0o644); err != nil {
+		log.Fatalf("[IPXE] %v", err)
+	}
+
+	for _, b := range builds {
+		margs := []string{"-C", filepath.Join(*src, "src"), fmt.Sprintf("-j%d", runtime.NumCPU()), b.Target, "EMBED=" + script}
+		if (b.Platform == "arm64-efi" || b.Platform == "riscv64-efi") && *cross != "" {
+			margs = append(margs, "CROSS="+*cross)
+		}
+		log.Printf("[IPXE] Building %s", b.Target)
+		if err := run("make", margs...); err != nil {
+			log.Fatalf("[IPXE] %v", err)
+		}
+		out, err := os.ReadFile(filepath.Join(*src, "src", filepath.FromSlash(b.Target)))
+		if err != nil {
+			log.Fatalf("[IPXE] %v", err)
+		}
+		dest := filepath.Join(*tftpRoot, filepath.FromSlash(b.File))
+		if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+			log.Fatalf("[IPXE] %v", err)
+		}
+		if err := os.WriteFile(dest, out, 0o644); err != nil {
+			log.Fatalf("[IPXE] %v", err)
+		}
+		fmt.Printf("%s: %s\n", b.Platform, b.File)
+	}
+	fmt.Printf("\nThey chain %s/boot.ipxe; start the server with -ipxe to offer them.\n", *server)
+}
+
+// run runs a command, its output going to ours
+func run(name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s %s: %w", name, args[0], err)
+	}
+	return nil
+}
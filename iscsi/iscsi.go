@@ -0,0 +1,438 @@
+// Package iscsi is a minimal iSCSI target exporting disk images as
+// single-LUN targets, enough for iPXE sanboot and the OS initiator that
+// takes over from it (e.g. diskless Windows via iBFT).
+package iscsi
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/ars1364/go-pxe/disk"
+)
+
+// TargetPrefix is prepended to every exported target name
+const TargetPrefix = "iqn.2024-01.io.github.ars1364.go-pxe"
+
+const (
+	maxRecvData = 64 << 10  // our MaxRecvDataSegmentLength
+	maxBurst    = 256 << 10 // our MaxBurstLength
+	firstBurst  = 64 << 10  // our FirstBurstLength
+)
+
+// Login status class and detail (RFC 7143 section 11.13.5)
+const (
+	statusAuthFailed   = 0x0201
+	statusNotFound     = 0x0203
+	statusMissingParam = 0x0207
+	statusInitiatorErr = 0x0200
+	statusTargetErr    = 0x0300
+)
+
+// Server exports the images under a root directory, one target per file
+type Server struct {
+	root string
+
+	// Writable serves raw images read-write. qcow2 images are always
+	// read-only.
+	Writable bool
+
+	tsih atomic.Uint32
+}
+
+func NewServer(root string) *Server {
+	return &Server{root: root}
+}
+
+// TargetName returns the IQN for the image at rel (relative to the root)
+func TargetName(rel string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(filepath.ToSlash(rel)) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '.', r == '-':
+			b.WriteRune(r)
+		case r == '/':
+			b.WriteByte(':')
+		default:
+			b.WriteByte('-')
+		}
+	}
+	return TargetPrefix + ":" + b.String()
+}
+
+// targets maps target names to image paths
+func (s *Server) targets() map[string]string {
+	targets := make(map[string]string)
+	filepath.WalkDir(s.root, func(path string, d os.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() {
+			rel, _ := filepath.Rel(s.root, path)
+			targets[TargetName(rel)] = path
+		}
+		return nil
+	})
+	return targets
+}
+
+// ListenAndServe accepts initiators on addr (normally <ip>:3260)
+func (s *Server) ListenAndServe(addr string) error {
+	ln, err := net.Listen("tcp4", addr)
+	if err != nil {
+		return fmt.Errorf("iSCSI listen: %w", err)
+	}
+	defer ln.Close()
+
+	mode := "read-only"
+	if s.Writable {
+		mode = "read-write"
+	}
+	log.Printf("[ISCSI] Listening on %s, root: %s (%s)", addr, s.root, mode)
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Printf("[ISCSI] Accept error: %v", err)
+			continue
+		}
+		go func() {
+			defer conn.Close()
+			sess := &session{srv: s, conn: conn, maxRecv: 8192, maxBurst: maxBurst}
+			defer sess.close()
+			if err := sess.serve(); err != nil && !errors.Is(err, io.EOF) {
+				log.Printf("[ISCSI] %s: %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// session is one initiator connection. Only one connection per session is
+// supported (MaxConnections=1).
+type session struct {
+	srv  *Server
+	conn net.Conn
+
+	initiator string
+	discovery bool
+	target    string
+	img       disk.Image
+	rw        disk.WritableImage // nil when read-only
+
+	statSN   uint32
+	expCmdSN uint32
+	nextTTT  uint32
+
+	maxRecv  int // initiator's MaxRecvDataSegmentLength
+	maxBurst int
+}
+
+func (s *session) close() {
+	if s.img != nil {
+		s.img.Close()
+	}
+}
+
+func (s *session) serve() error {
+	if err := s.login(); err != nil {
+		return err
+	}
+	for {
+		p, err := readPDU(s.conn, maxRecvData)
+		if err != nil {
+			return err
+		}
+		if !p.immediate() && p.opcode() != opDataOut {
+			s.expCmdSN = p.u32(24) + 1
+		}
+
+		switch p.opcode() {
+		case opNopOut:
+			err = s.nopIn(p)
+		case opSCSICmd:
+			if s.discovery {
+				err = s.reject(p, 0x0b) // not allowed in a discovery session
+				break
+			}
+			err = s.scsiCommand(p)
+		case opText:
+			err = s.text(p)
+		case opTaskMgmt:
+			r := &pdu{}
+			r.bhs[0], r.bhs[1] = opTaskMgmtRsp, flagFinal
+			r.put32(16, p.itt())
+			s.seq(r, true)
+			err = r.writeTo(s.conn)
+		case opLogout:
+			r := &pdu{}
+			r.bhs[0], r.bhs[1] = opLogoutResp, flagFinal
+			r.put32(16, p.itt())
+			s.seq(r, true)
+			log.Printf("[ISCSI] %s logged out of %s", s.initiator, s.target)
+			return r.writeTo(s.conn)
+		default:
+			err = s.reject(p, 0x04) // command not supported
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// seq fills in the sequence numbers of a response. status responses
+// consume a StatSN.
+func (s *session) seq(r *pdu, status bool) {
+	if status {
+		r.put32(24, s.statSN)
+		s.statSN++
+	}
+	r.put32(28, s.expCmdSN)
+	r.put32(32, s.expCmdSN) // command window of one: no queueing
+}
+
+// login runs the login phase up to full feature phase
+func (s *session) login() error {
+	var pending []byte
+	sentTPGT, sentMaxRecv := false, false
+	first := true
+
+	for {
+		p, err := readPDU(s.conn, maxRecvData)
+		if err != nil {
+			return err
+		}
+		if p.opcode() != opLogin {
+			return fmt.Errorf("expected login, got opcode %#x", p.opcode())
+		}
+		transit := p.flags()&0x80 != 0
+		cont := p.flags()&0x40 != 0
+		csg, nsg := (p.flags()>>2)&3, p.flags()&3
+		if first {
+			s.expCmdSN = p.u32(24)
+			s.statSN = p.u32(28)
+			first = false
+		}
+
+		r := &pdu{}
+		r.bhs[0] = opLoginResp
+		copy(r.bhs[8:14], p.bhs[8:14]) // ISID
+		r.put32(16, p.itt())
+
+		pending = append(pending, p.data...)
+		if cont {
+			// More keys follow; acknowledge without changing stage
+			r.bhs[1] = csg << 2
+			s.seq(r, true)
+			if err := r.writeTo(s.conn); err != nil {
+				return err
+			}
+			continue
+		}
+
+		reply, status := s.negotiate(parseKeys(pending), csg)
+		pending = nil
+		if status != 0 {
+			r.bhs[1] = csg << 2
+			r.bhs[36], r.bhs[37] = byte(status>>8), byte(status)
+			s.seq(r, true)
+			r.writeTo(s.conn)
+			return fmt.Errorf("login failed with status %#04x", status)
+		}
+		if !s.discovery && !sentTPGT {
+			reply = appendKey(reply, "TargetPortalGroupTag", "1")
+			sentTPGT = true
+		}
+		if csg == 1 && !sentMaxRecv {
+			reply = appendKey(reply, "MaxRecvDataSegmentLength", strconv.Itoa(maxRecvData))
+			sentMaxRecv = true
+		}
+
+		r.bhs[1] = csg << 2
+		if transit {
+			r.bhs[1] |= 0x80 | nsg
+		}
+		full := transit && nsg == 3
+		if full {
+			if !s.discovery && s.img == nil {
+				r.bhs[1] = csg << 2
+				r.bhs[36], r.bhs[37] = statusMissingParam>>8, statusMissingParam&0xff
+				s.seq(r, true)
+				r.writeTo(s.conn)
+				return fmt.Errorf("login named no target")
+			}
+			tsih := uint16(s.srv.tsih.Add(1))
+			if tsih == 0 {
+				tsih = uint16(s.srv.tsih.Add(1))
+			}
+			r.bhs[14], r.bhs[15] = byte(tsih>>8), byte(tsih)
+		}
+		r.data = reply
+		s.seq(r, true)
+		if err := r.writeTo(s.conn); err != nil {
+			return err
+		}
+		if full {
+			if s.discovery {
+				log.Printf("[ISCSI] %s started discovery session", s.initiator)
+			} else {
+				mode := "read-only"
+				if s.rw != nil {
+					mode = "read-write"
+				}
+				log.Printf("[ISCSI] %s logged in to %s (%s)", s.initiator, s.target, mode)
+			}
+			return nil
+		}
+	}
+}
+
+// negotiate answers the keys offered in one login request, returning the
+// reply keys or a non-zero login status
+func (s *session) negotiate(keys [][2]string, csg byte) ([]byte, int) {
+	var reply []byte
+	for _, kv := range keys {
+		key, value := kv[0], kv[1]
+		switch key {
+		case "InitiatorName":
+			s.initiator = value
+		case "InitiatorAlias", "TargetAlias":
+		case "SessionType":
+			s.discovery = value == "Discovery"
+		case "TargetName":
+			if status := s.attach(value); status != 0 {
+				return nil, status
+			}
+		case "AuthMethod":
+			if !containsValue(value, "None") {
+				return nil, statusAuthFailed
+			}
+			reply = appendKey(reply, key, "None")
+		case "HeaderDigest", "DataDigest":
+			if !containsValue(value, "None") {
+				return nil, statusInitiatorErr
+			}
+			reply = appendKey(reply, key, "None")
+		case "MaxRecvDataSegmentLength":
+			if n, err := strconv.Atoi(value); err == nil && n >= 512 {
+				s.maxRecv = n
+			}
+		case "MaxBurstLength":
+			n := negotiateMin(value, maxBurst)
+			s.maxBurst = n
+			reply = appendKey(reply, key, strconv.Itoa(n))
+		case "FirstBurstLength":
+			reply = appendKey(reply, key, strconv.Itoa(negotiateMin(value, firstBurst)))
+		case "InitialR2T", "DataPDUInOrder", "DataSequenceInOrder":
+			reply = appendKey(reply, key, "Yes")
+		case "ImmediateData", "IFMarker", "OFMarker":
+			reply = appendKey(reply, key, "No")
+		case "MaxConnections", "MaxOutstandingR2T":
+			reply = appendKey(reply, key, "1")
+		case "ErrorRecoveryLevel":
+			reply = appendKey(reply, key, "0")
+		case "DefaultTime2Wait", "DefaultTime2Retain":
+			reply = appendKey(reply, key, value)
+		default:
+			reply = appendKey(reply, key, "NotUnderstood")
+		}
+	}
+	if csg == 0 && s.initiator == "" {
+		return nil, statusMissingParam
+	}
+	return reply, 0
+}
+
+// attach opens the image behind a target name
+func (s *session) attach(name string) int {
+	if s.img != nil {
+		return 0
+	}
+	path, ok := s.srv.targets()[name]
+	if !ok {
+		log.Printf("[ISCSI] %s asked for unknown target %s", s.conn.RemoteAddr(), name)
+		return statusNotFound
+	}
+	if s.srv.Writable {
+		rw, err := disk.OpenWritable(path)
+		if err == nil {
+			s.img, s.rw, s.target = rw, rw, name
+			return 0
+		}
+		log.Printf("[ISCSI] Serving %s read-only: %v", name, err)
+	}
+	img, err := disk.Open(path)
+	if err != nil {
+		log.Printf("[ISCSI] Open %s: %v", path, err)
+		return statusTargetErr
+	}
+	s.img, s.target = img, name
+	return 0
+}
+
+func (s *session) nopIn(p *pdu) error {
+	if p.itt() == 0xffffffff {
+		return nil // a ping response, not a ping
+	}
+	r := &pdu{data: p.data}
+	r.bhs[0], r.bhs[1] = opNopIn, flagFinal
+	copy(r.bhs[8:16], p.bhs[8:16])
+	r.put32(16, p.itt())
+	r.put32(20, 0xffffffff)
+	s.seq(r, true)
+	return r.writeTo(s.conn)
+}
+
+// text answers SendTargets, the only text request initiators need
+func (s *session) text(p *pdu) error {
+	var reply []byte
+	for _, kv := range parseKeys(p.data) {
+		if kv[0] != "SendTargets" {
+			reply = appendKey(reply, kv[0], "NotUnderstood")
+			continue
+		}
+		portal := s.conn.LocalAddr().String() + ",1"
+		for name := range s.srv.targets() {
+			if kv[1] == "All" && s.discovery || kv[1] == name || kv[1] == "" && name == s.target {
+				reply = appendKey(reply, "TargetName", name)
+				reply = appendKey(reply, "TargetAddress", portal)
+			}
+		}
+	}
+	r := &pdu{data: reply}
+	r.bhs[0], r.bhs[1] = opTextResp, flagFinal
+	r.put32(16, p.itt())
+	r.put32(20, 0xffffffff)
+	s.seq(r, true)
+	return r.writeTo(s.conn)
+}
+
+func (s *session) reject(p *pdu, reason byte) error {
+	r := &pdu{data: append([]byte(nil), p.bhs[:]...)}
+	r.bhs[0], r.bhs[1], r.bhs[2] = opReject, flagFinal, reason
+	r.put32(16, 0xffffffff)
+	s.seq(r, true)
+	return r.writeTo(s.conn)
+}
+
+func containsValue(list, want string) bool {
+	for _, v := range strings.Split(list, ",") {
+		if v == want {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiateMin is the lesser of a burst length offered and ours, ours if
+// the offer is below the 512 bytes RFC 7143 allows
+func negotiateMin(offer string, ours int) int {
+	n, err := strconv.Atoi(offer)
+	if err != nil || n < 512 || n > ours {
+		return ours
+	}
+	return n
+}
@@ -0,0 +1,306 @@
+package iscsi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTargetName(t *testing.T) {
+	tests := []struct {
+		rel  string
+		want string
+	}{
+		{"disk.img", TargetPrefix + ":disk.img"},
+		{"win/Server 2022.qcow2", TargetPrefix + ":win:server-2022.qcow2"},
+		{"a_b", TargetPrefix + ":a-b"},
+	}
+	for _, tt := range tests {
+		if got := TargetName(tt.rel); got != tt.want {
+			t.Errorf("TargetName(%q) = %q, want %q", tt.rel, got, tt.want)
+		}
+	}
+}
+
+// initiator is a test client of one session
+type initiator struct {
+	t    *testing.T
+	conn net.Conn
+	done chan error
+	itt  uint32
+}
+
+// dial serves one session of s over loopback
+func dial(t *testing.T, s *Server) *initiator {
+	t.Helper()
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	done := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		defer conn.Close()
+		sess := &session{srv: s, conn: conn, maxRecv: 8192, maxBurst: maxBurst}
+		defer sess.close()
+		done <- sess.serve()
+	}()
+	conn, err := net.Dial("tcp4", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return &initiator{t: t, conn: conn, done: done}
+}
+
+// send sends a PDU of opcode with flags and data, letting set fill in
+// the rest of its header
+func (c *initiator) send(opcode, flags byte, data []byte, set func(p *pdu)) {
+	c.t.Helper()
+	c.itt++
+	p := &pdu{data: data}
+	p.bhs[0], p.bhs[1] = opcode, flags
+	p.put32(16, c.itt)
+	if set != nil {
+		set(p)
+	}
+	if err := p.writeTo(c.conn); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *initiator) recv() *pdu {
+	c.t.Helper()
+	p, err := readPDU(c.conn, 1<<24)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return p
+}
+
+// login logs in with keys in one request, returning the login status
+func (c *initiator) login(keys ...string) int {
+	c.t.Helper()
+	var data []byte
+	for _, kv := range keys {
+		data = append(append(data, kv...), 0)
+	}
+	c.send(opLogin|flagImmediate, 0x80|1<<2|3, data, nil) // operational to full feature
+	r := c.recv()
+	if r.opcode() != opLoginResp {
+		c.t.Fatalf("login answered with opcode %#x", r.opcode())
+	}
+	return int(r.bhs[36])<<8 | int(r.bhs[37])
+}
+
+// command runs a SCSI command with cdb, sending out as write data,
+// returning the data read and the sense key on CHECK CONDITION
+func (c *initiator) command(cdb []byte, expected int, out []byte) ([]byte, byte) {
+	c.t.Helper()
+	c.send(opSCSICmd, flagFinal, nil, func(p *pdu) {
+		p.put32(20, uint32(expected))
+		copy(p.bhs[32:], cdb)
+	})
+	var data []byte
+	for {
+		r := c.recv()
+		switch r.opcode() {
+		case opDataIn:
+			data = append(data, r.data...)
+			if r.flags()&0x01 != 0 {
+				return data, 0
+			}
+		case opR2T:
+			off, n := int(r.u32(40)), int(r.u32(44))
+			ttt := r.u32(20)
+			c.send(opDataOut, flagFinal, out[off:off+n], func(p *pdu) {
+				p.put32(16, c.itt)
+				p.put32(20, ttt)
+				p.put32(40, uint32(off))
+			})
+			c.itt--
+		case opSCSIResp:
+			if r.bhs[3] == statusCheckCondition {
+				return nil, r.data[2+2] & 0x0f
+			}
+			return data, 0
+		default:
+			c.t.Fatalf("command answered with opcode %#x", r.opcode())
+		}
+	}
+}
+
+func read10(lba uint32, blocks uint16) []byte {
+	cdb := []byte{0x28, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(cdb[2:], lba)
+	binary.BigEndian.PutUint16(cdb[7:], blocks)
+	return cdb
+}
+
+func write10(lba uint32, blocks uint16) []byte {
+	cdb := read10(lba, blocks)
+	cdb[0] = 0x2a
+	return cdb
+}
+
+// image writes an 8-block raw image whose blocks are filled with '0' to
+// '7' as disk.img under a new root
+func image(t *testing.T) (string, []byte) {
+	t.Helper()
+	var data []byte
+	for i := range 8 {
+		data = append(data, bytes.Repeat([]byte{'0' + byte(i)}, blockSize)...)
+	}
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "disk.img"), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return root, data
+}
+
+func TestSession(t *testing.T) {
+	root, data := image(t)
+	c := dial(t, NewServer(root))
+	if status := c.login("InitiatorName=iqn.test", "TargetName="+TargetName("disk.img"), "MaxBurstLength=0", "HeaderDigest=None"); status != 0 {
+		t.Fatalf("login status %#04x", status)
+	}
+
+	read16 := make([]byte, 16)
+	read16[0] = 0x88
+	binary.BigEndian.PutUint64(read16[2:], 1<<64-1)
+	binary.BigEndian.PutUint32(read16[10:], 2)
+	tests := []struct {
+		name     string
+		cdb      []byte
+		expected int
+		want     []byte
+		sense    byte
+	}{
+		{"inquiry", []byte{0x12, 0, 0, 0, 36, 0}, 36, nil, 0},
+		{"read capacity", []byte{0x25, 0, 0, 0, 0, 0, 0, 0, 0, 0}, 8, []byte{0, 0, 0, 7, 0, 0, 2, 0}, 0},
+		{"read", read10(2, 3), 3 * blockSize, data[2*blockSize : 5*blockSize], 0},
+		{"read to the end", read10(6, 2), 2 * blockSize, data[6*blockSize:], 0},
+		{"read past the end", read10(7, 2), 2 * blockSize, nil, senseIllegalRequest},
+		{"read at an overflowing LBA", read16, 2 * blockSize, nil, senseIllegalRequest},
+		{"write to a read-only target", write10(0, 1), blockSize, nil, senseDataProtect},
+		{"unknown command", []byte{0xff}, 0, nil, senseIllegalRequest},
+		{"inquiry of an unknown page", []byte{0x12, 1, 0x42, 0, 255, 0}, 255, nil, senseIllegalRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, sense := c.command(tt.cdb, tt.expected, make([]byte, tt.expected))
+			if sense != tt.sense {
+				t.Fatalf("sense key %#x, want %#x", sense, tt.sense)
+			}
+			if tt.want != nil && !bytes.Equal(got, tt.want) {
+				t.Errorf("data %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	c.send(opText|flagImmediate, flagFinal, []byte("SendTargets=\x00"), nil)
+	if r := c.recv(); !strings.Contains(string(r.data), "TargetName="+TargetName("disk.img")) {
+		t.Errorf("SendTargets answered %q", r.data)
+	}
+	c.send(opLogout|flagImmediate, flagFinal, nil, nil)
+	if r := c.recv(); r.opcode() != opLogoutResp {
+		t.Errorf("logout answered with opcode %#x", r.opcode())
+	}
+	if err := <-c.done; err != nil {
+		t.Errorf("serve after logout: %v", err)
+	}
+}
+
+func TestWrite(t *testing.T) {
+	root, data := image(t)
+	s := NewServer(root)
+	s.Writable = true
+	c := dial(t, s)
+	if status := c.login("InitiatorName=iqn.test", "TargetName="+TargetName("disk.img"), "MaxBurstLength=512"); status != 0 {
+		t.Fatalf("login status %#04x", status)
+	}
+	out := bytes.Repeat([]byte("w"), 2*blockSize)
+	if _, sense := c.command(write10(3, 2), len(out), out); sense != 0 {
+		t.Fatalf("write sense key %#x", sense)
+	}
+	if _, sense := c.command(write10(7, 2), len(out), out); sense != senseIllegalRequest {
+		t.Errorf("write past the end: sense key %#x", sense)
+	}
+	got, _ := c.command(read10(2, 4), 4*blockSize, nil)
+	want := append(append(append([]byte(nil), data[2*blockSize:3*blockSize]...), out...), data[5*blockSize:6*blockSize]...)
+	if !bytes.Equal(got, want) {
+		t.Errorf("read back %q", got)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	root, _ := image(t)
+	tests := []struct {
+		name   string
+		keys   []string
+		status int
+	}{
+		{"discovery", []string{"InitiatorName=iqn.test", "SessionType=Discovery"}, 0},
+		{"unknown target", []string{"InitiatorName=iqn.test", "TargetName=" + TargetName("missing.img")}, statusNotFound},
+		{"no target", []string{"InitiatorName=iqn.test"}, statusMissingParam},
+		{"CHAP only", []string{"InitiatorName=iqn.test", "AuthMethod=CHAP", "TargetName=" + TargetName("disk.img")}, statusAuthFailed},
+		{"digests", []string{"InitiatorName=iqn.test", "HeaderDigest=CRC32C", "TargetName=" + TargetName("disk.img")}, statusInitiatorErr},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := dial(t, NewServer(root))
+			if status := c.login(tt.keys...); status != tt.status {
+				t.Errorf("login status %#04x, want %#04x", status, tt.status)
+			}
+		})
+	}
+}
+
+func TestMalformed(t *testing.T) {
+	root, _ := image(t)
+	login := func(data string) []byte {
+		p := &pdu{data: []byte(data)}
+		p.bhs[0], p.bhs[1] = opLogin|flagImmediate, 0x80|1<<2|3
+		var buf bytes.Buffer
+		p.writeTo(&buf)
+		return buf.Bytes()
+	}
+	scsi := make([]byte, bhsLen)
+	scsi[0] = opSCSICmd
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"not a login", scsi},
+		{"truncated header", login("")[:30]},
+		{"oversized data segment", append(login("")[:5], 0xff, 0xff, 0xff)},
+		{"keys without terminator", login("InitiatorName=iqn.test")},
+		{"SCSI in discovery", append(login("InitiatorName=iqn.test\x00SessionType=Discovery\x00"), scsi...)},
+		{"unknown opcode", append(login("InitiatorName=iqn.test\x00SessionType=Discovery\x00"), append([]byte{0x1f}, make([]byte, bhsLen-1)...)...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := dial(t, NewServer(root))
+			c.conn.Write(tt.data)
+			c.conn.(*net.TCPConn).CloseWrite()
+			go io.Copy(io.Discard, c.conn)
+			select {
+			case <-c.done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("serve did not return")
+			}
+		})
+	}
+}
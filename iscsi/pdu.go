@@ -0,0 +1,112 @@
+package iscsi
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Opcodes (RFC 7143 section 11)
+const (
+	opNopOut      = 0x00
+	opSCSICmd     = 0x01
+	opTaskMgmt    = 0x02
+	opLogin       = 0x03
+	opText        = 0x04
+	opDataOut     = 0x05
+	opLogout      = 0x06
+	opNopIn       = 0x20
+	opSCSIResp    = 0x21
+	opTaskMgmtRsp = 0x22
+	opLoginResp   = 0x23
+	opTextResp    = 0x24
+	opDataIn      = 0x25
+	opLogoutResp  = 0x26
+	opR2T         = 0x31
+	opReject      = 0x3f
+
+	flagFinal     = 0x80
+	flagImmediate = 0x40
+
+	bhsLen = 48
+)
+
+// pdu is one iSCSI protocol data unit: a basic header segment plus data
+type pdu struct {
+	bhs  [bhsLen]byte
+	data []byte
+}
+
+func (p *pdu) opcode() byte    { return p.bhs[0] & 0x3f }
+func (p *pdu) immediate() bool { return p.bhs[0]&flagImmediate != 0 }
+func (p *pdu) flags() byte     { return p.bhs[1] }
+func (p *pdu) itt() uint32     { return p.u32(16) }
+
+func (p *pdu) u32(off int) uint32 { return binary.BigEndian.Uint32(p.bhs[off:]) }
+
+func (p *pdu) put32(off int, v uint32) { binary.BigEndian.PutUint32(p.bhs[off:], v) }
+
+// readPDU reads a PDU, skipping any additional header segments. Digests
+// are never negotiated.
+func readPDU(r io.Reader, maxData int) (*pdu, error) {
+	p := &pdu{}
+	if _, err := io.ReadFull(r, p.bhs[:]); err != nil {
+		return nil, err
+	}
+	ahs := int(p.bhs[4]) * 4
+	dsl := int(p.bhs[5])<<16 | int(p.bhs[6])<<8 | int(p.bhs[7])
+	if dsl > maxData {
+		return nil, fmt.Errorf("data segment of %d bytes exceeds %d", dsl, maxData)
+	}
+	if ahs > 0 {
+		if _, err := io.CopyN(io.Discard, r, int64(ahs)); err != nil {
+			return nil, err
+		}
+	}
+	buf := make([]byte, pad4(dsl))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	p.data = buf[:dsl]
+	return p, nil
+}
+
+func (p *pdu) writeTo(w io.Writer) error {
+	n := len(p.data)
+	p.bhs[4] = 0
+	p.bhs[5], p.bhs[6], p.bhs[7] = byte(n>>16), byte(n>>8), byte(n)
+	buf := make([]byte, bhsLen+pad4(n))
+	copy(buf, p.bhs[:])
+	copy(buf[bhsLen:], p.data)
+	_, err := w.Write(buf)
+	return err
+}
+
+func pad4(n int) int { return (n + 3) &^ 3 }
+
+// parseKeys decodes the key=value\0 pairs of login and text PDUs
+func parseKeys(data []byte) [][2]string {
+	var kv [][2]string
+	start := 0
+	for i, b := range data {
+		if b != 0 {
+			continue
+		}
+		pair := string(data[start:i])
+		start = i + 1
+		for j := 0; j < len(pair); j++ {
+			if pair[j] == '=' {
+				kv = append(kv, [2]string{pair[:j], pair[j+1:]})
+				break
+			}
+		}
+	}
+	return kv
+}
+
+func appendKey(b []byte, key, value string) []byte {
+	b = append(b, key...)
+	b = append(b, '=')
+	b = append(b, value...)
+	return append(b, 0)
+}
@@ -0,0 +1,82 @@
+package iscsi
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestParseKeys(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want [][2]string
+	}{
+		{"pairs", "InitiatorName=iqn.x\x00SessionType=Normal\x00", [][2]string{{"InitiatorName", "iqn.x"}, {"SessionType", "Normal"}}},
+		{"value with =", "K=a=b\x00", [][2]string{{"K", "a=b"}}},
+		{"empty value", "K=\x00", [][2]string{{"K", ""}}},
+		{"no =", "garbage\x00K=v\x00", [][2]string{{"K", "v"}}},
+		{"unterminated", "K=v", nil},
+		{"empty", "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseKeys([]byte(tt.data)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseKeys = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadPDU(t *testing.T) {
+	// header is a BHS with ahs words of additional header and a data
+	// segment of dsl bytes
+	header := func(ahs byte, dsl int) []byte {
+		bhs := make([]byte, bhsLen)
+		bhs[0], bhs[4] = opText, ahs
+		bhs[5], bhs[6], bhs[7] = byte(dsl>>16), byte(dsl>>8), byte(dsl)
+		return bhs
+	}
+	tests := []struct {
+		name  string
+		input []byte
+		data  string // read, if the PDU is valid
+		ok    bool
+	}{
+		{"no data", header(0, 0), "", true},
+		{"padded data", append(header(0, 5), "hello\x00\x00\x00"...), "hello", true},
+		{"additional header", append(append(header(1, 2), "AHS!"...), "hi\x00\x00"...), "hi", true},
+		{"truncated header", header(0, 0)[:20], "", false},
+		{"truncated data", append(header(0, 8), "four"...), "", false},
+		{"missing padding", append(header(0, 5), "hello"...), "", false},
+		{"truncated additional header", append(header(255, 0), "AHS"...), "", false},
+		{"oversized data", header(0, 1<<24-1), "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := readPDU(bytes.NewReader(tt.input), 1024)
+			if (err == nil) != tt.ok {
+				t.Fatalf("readPDU error %v, want ok %v", err, tt.ok)
+			}
+			if tt.ok && string(p.data) != tt.data {
+				t.Errorf("data %q, want %q", p.data, tt.data)
+			}
+		})
+	}
+}
+
+func TestWriteTo(t *testing.T) {
+	p := &pdu{data: []byte("hello")}
+	p.bhs[0], p.bhs[4] = opTextResp, 9
+	var buf bytes.Buffer
+	if err := p.writeTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != bhsLen+8 {
+		t.Fatalf("wrote %d bytes, want %d", buf.Len(), bhsLen+8)
+	}
+	back, err := readPDU(&buf, 1024)
+	if err != nil || back.opcode() != opTextResp || string(back.data) != "hello" {
+		t.Errorf("read back %v %q: %v", back, back.data, err)
+	}
+}
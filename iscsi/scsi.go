@@ -0,0 +1,358 @@
+package iscsi
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"log"
+)
+
+const blockSize = 512
+
+// SCSI status and sense keys
+const (
+	statusGood           = 0x00
+	statusCheckCondition = 0x02
+
+	senseNoSense        = 0x00
+	senseMediumError    = 0x03
+	senseIllegalRequest = 0x05
+	senseDataProtect    = 0x07
+)
+
+const maxTransfer = 32 << 20
+
+var (
+	errInvalidOpcode = sense(senseIllegalRequest, 0x20, 0x00)
+	errLBARange      = sense(senseIllegalRequest, 0x21, 0x00)
+	errInvalidField  = sense(senseIllegalRequest, 0x24, 0x00)
+	errLUN           = sense(senseIllegalRequest, 0x25, 0x00)
+	errWriteProtect  = sense(senseDataProtect, 0x27, 0x00)
+	errRead          = sense(senseMediumError, 0x11, 0x00)
+	errWrite         = sense(senseMediumError, 0x0c, 0x00)
+)
+
+// sense builds fixed-format sense data
+func sense(key, asc, ascq byte) []byte {
+	return []byte{0x70, 0, key, 0, 0, 0, 0, 10, 0, 0, 0, 0, asc, ascq, 0, 0, 0, 0}
+}
+
+// scsiCommand executes one SCSI command PDU and sends its data and status
+func (s *session) scsiCommand(p *pdu) error {
+	cdb := p.bhs[32:48]
+	lun0 := binary.BigEndian.Uint64(p.bhs[8:16]) == 0
+	expected := int(p.u32(20))
+
+	var data, senseData []byte
+	transferred := 0
+	switch cdb[0] {
+	case 0x0a, 0x2a, 0xaa, 0x8a: // WRITE(6/10/12/16)
+		if !lun0 {
+			senseData = errLUN
+			break
+		}
+		var err error
+		if senseData, err = s.write(p, cdb); err != nil {
+			return err
+		}
+		transferred = expected
+	default:
+		data, senseData = s.execute(cdb, lun0)
+	}
+
+	if senseData != nil {
+		return s.response(p, statusCheckCondition, senseData, 0, 0)
+	}
+	if len(data) == 0 {
+		return s.response(p, statusGood, nil, expected, transferred)
+	}
+	return s.dataIn(p, data, expected)
+}
+
+// execute runs every command except writes, returning data for the
+// initiator or sense data on failure
+func (s *session) execute(cdb []byte, lun0 bool) ([]byte, []byte) {
+	be := binary.BigEndian
+	switch cdb[0] {
+	case 0x12: // INQUIRY
+		return s.inquiry(cdb, lun0)
+	case 0xa0: // REPORT LUNS
+		data := make([]byte, 16)
+		be.PutUint32(data, 8)
+		return truncate(data, int(be.Uint32(cdb[6:]))), nil
+	case 0x03: // REQUEST SENSE
+		return truncate(sense(senseNoSense, 0, 0), int(cdb[4])), nil
+	}
+	if !lun0 {
+		return nil, errLUN
+	}
+
+	blocks := uint64(s.img.Size() / blockSize)
+	switch cdb[0] {
+	case 0x00, 0x1b, 0x1e, 0x2f, 0x8f: // TEST UNIT READY, START STOP, PREVENT ALLOW, VERIFY
+		return nil, nil
+	case 0x25: // READ CAPACITY(10)
+		data := make([]byte, 8)
+		be.PutUint32(data, uint32(min(blocks-1, 0xffffffff)))
+		be.PutUint32(data[4:], blockSize)
+		return data, nil
+	case 0x9e: // SERVICE ACTION IN(16)
+		if cdb[1]&0x1f != 0x10 {
+			return nil, errInvalidOpcode
+		}
+		data := make([]byte, 32) // READ CAPACITY(16)
+		be.PutUint64(data, blocks-1)
+		be.PutUint32(data[8:], blockSize)
+		return truncate(data, int(be.Uint32(cdb[10:]))), nil
+	case 0x1a: // MODE SENSE(6)
+		data := []byte{3, 0, s.deviceParam(), 0}
+		return truncate(data, int(cdb[4])), nil
+	case 0x5a: // MODE SENSE(10)
+		data := []byte{0, 6, 0, s.deviceParam(), 0, 0, 0, 0}
+		return truncate(data, int(be.Uint16(cdb[7:]))), nil
+	case 0x35, 0x91: // SYNCHRONIZE CACHE(10/16)
+		if s.rw != nil {
+			if err := s.rw.Sync(); err != nil {
+				log.Printf("[ISCSI] %s sync: %v", s.target, err)
+				return nil, errWrite
+			}
+		}
+		return nil, nil
+	case 0x08, 0x28, 0xa8, 0x88: // READ(6/10/12/16)
+		lba, n := rwArgs(cdb)
+		if lba > blocks || uint64(n) > blocks-lba {
+			return nil, errLBARange
+		}
+		if n*blockSize > maxTransfer {
+			return nil, errInvalidField
+		}
+		data := make([]byte, n*blockSize)
+		if _, err := s.img.ReadAt(data, int64(lba)*blockSize); err != nil {
+			log.Printf("[ISCSI] %s read at LBA %d: %v", s.target, lba, err)
+			return nil, errRead
+		}
+		return data, nil
+	}
+	return nil, errInvalidOpcode
+}
+
+// deviceParam is the MODE SENSE device-specific parameter: write protect
+func (s *session) deviceParam() byte {
+	if s.rw == nil {
+		return 0x80
+	}
+	return 0
+}
+
+func (s *session) inquiry(cdb []byte, lun0 bool) ([]byte, []byte) {
+	alloc := int(binary.BigEndian.Uint16(cdb[3:]))
+	peripheral := byte(0x00) // direct access block device
+	if !lun0 {
+		peripheral = 0x7f // no device at this LUN
+	}
+
+	if cdb[1]&1 == 0 {
+		if cdb[2] != 0 {
+			return nil, errInvalidField
+		}
+		data := make([]byte, 36)
+		data[0] = peripheral
+		data[2] = 0x05 // SPC-3
+		data[3] = 0x02
+		data[4] = byte(len(data) - 5)
+		data[7] = 0x02 // CmdQue
+		copy(data[8:16], fmt.Sprintf("%-8s", "GO-PXE"))
+		copy(data[16:32], fmt.Sprintf("%-16.16s", s.shortName()))
+		copy(data[32:36], "1.0 ")
+		return truncate(data, alloc), nil
+	}
+
+	// Vital product data pages
+	var page []byte
+	switch cdb[2] {
+	case 0x00: // supported pages
+		page = []byte{0x00, 0x80, 0x83}
+	case 0x80: // unit serial number
+		page = []byte(fmt.Sprintf("%016x", s.id()))
+	case 0x83: // device identification
+		naa := make([]byte, 12)
+		naa[0], naa[1], naa[3] = 0x01, 0x03, 8 // binary, NAA, LUN association
+		binary.BigEndian.PutUint64(naa[4:], 3<<60|s.id()>>4)
+		vendor := []byte{0x02, 0x01, 0, 0}
+		vendor = append(vendor, fmt.Sprintf("%-8s%s", "GO-PXE", s.target)...)
+		vendor[3] = byte(len(vendor) - 4)
+		page = append(naa, vendor...)
+	default:
+		return nil, errInvalidField
+	}
+	data := []byte{peripheral, cdb[2], byte(len(page) >> 8), byte(len(page))}
+	return truncate(append(data, page...), alloc), nil
+}
+
+// shortName is the target name without the common prefix
+func (s *session) shortName() string {
+	return s.target[len(TargetPrefix)+1:]
+}
+
+// id is a stable identifier derived from the target name
+func (s *session) id() uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s.target))
+	return h.Sum64()
+}
+
+// write solicits the data of a WRITE command with R2Ts and stores it
+func (s *session) write(p *pdu, cdb []byte) ([]byte, error) {
+	if s.rw == nil {
+		return errWriteProtect, nil
+	}
+	lba, n := rwArgs(cdb)
+	if blocks := uint64(s.img.Size() / blockSize); lba > blocks || uint64(n) > blocks-lba {
+		return errLBARange, nil
+	}
+	base := int64(lba) * blockSize
+	length := min(n*blockSize, int(p.u32(20)))
+
+	var writeErr error
+	store := func(data []byte, off int) {
+		if writeErr == nil && off+len(data) <= length {
+			_, writeErr = s.rw.WriteAt(data, base+int64(off))
+		}
+	}
+
+	received := len(p.data) // immediate data, if the initiator sent any
+	store(p.data, 0)
+	var r2tsn uint32
+	for received < length {
+		burst := min(length-received, s.maxBurst)
+		ttt := s.nextTTT
+		s.nextTTT++
+
+		r := &pdu{}
+		r.bhs[0], r.bhs[1] = opR2T, flagFinal
+		copy(r.bhs[8:16], p.bhs[8:16])
+		r.put32(16, p.itt())
+		r.put32(20, ttt)
+		r.put32(24, s.statSN)
+		s.seq(r, false)
+		r.put32(36, r2tsn)
+		r.put32(40, uint32(received))
+		r.put32(44, uint32(burst))
+		r2tsn++
+		if err := r.writeTo(s.conn); err != nil {
+			return nil, err
+		}
+
+		for got := 0; got < burst; {
+			d, err := readPDU(s.conn, maxRecvData)
+			if err != nil {
+				return nil, err
+			}
+			if d.opcode() == opNopOut {
+				if err := s.nopIn(d); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if d.opcode() != opDataOut || d.u32(20) != ttt {
+				return nil, fmt.Errorf("expected Data-Out for R2T %d, got opcode %#x", ttt, d.opcode())
+			}
+			store(d.data, int(d.u32(40)))
+			got += len(d.data)
+		}
+		received += burst
+	}
+	if writeErr != nil {
+		log.Printf("[ISCSI] %s write at LBA %d: %v", s.target, lba, writeErr)
+		return errWrite, nil
+	}
+	return nil, nil
+}
+
+// dataIn sends read data in Data-In PDUs, with status in the last one
+func (s *session) dataIn(p *pdu, data []byte, expected int) error {
+	var flags byte
+	var residual int
+	switch {
+	case len(data) > expected:
+		flags, residual = 0x04, len(data)-expected // overflow
+		data = data[:expected]
+	case len(data) < expected:
+		flags, residual = 0x02, expected-len(data) // underflow
+	}
+	if len(data) == 0 {
+		return s.response(p, statusGood, nil, expected, 0)
+	}
+
+	var dataSN uint32
+	for off := 0; off < len(data); {
+		burstEnd := (off/s.maxBurst + 1) * s.maxBurst
+		n := min(s.maxRecv, len(data)-off, burstEnd-off)
+		last := off+n == len(data)
+
+		r := &pdu{data: data[off : off+n]}
+		r.bhs[0] = opDataIn
+		copy(r.bhs[8:16], p.bhs[8:16])
+		r.put32(16, p.itt())
+		r.put32(20, 0xffffffff)
+		r.put32(36, dataSN)
+		r.put32(40, uint32(off))
+		if last || off+n == burstEnd {
+			r.bhs[1] |= flagFinal
+		}
+		if last {
+			r.bhs[1] |= 0x01 | flags // status present
+			r.bhs[3] = statusGood
+			r.put32(44, uint32(residual))
+		}
+		s.seq(r, last)
+		if err := r.writeTo(s.conn); err != nil {
+			return err
+		}
+		dataSN++
+		off += n
+	}
+	return nil
+}
+
+// response sends a SCSI Response PDU, with sense data for CHECK CONDITION
+func (s *session) response(p *pdu, status byte, senseData []byte, expected, transferred int) error {
+	r := &pdu{}
+	r.bhs[0], r.bhs[1], r.bhs[3] = opSCSIResp, flagFinal, status
+	r.put32(16, p.itt())
+	if expected > transferred {
+		r.bhs[1] |= 0x02 // underflow
+		r.put32(44, uint32(expected-transferred))
+	}
+	if senseData != nil {
+		r.data = append([]byte{byte(len(senseData) >> 8), byte(len(senseData))}, senseData...)
+	}
+	s.seq(r, true)
+	return r.writeTo(s.conn)
+}
+
+// rwArgs decodes the LBA and block count of a READ or WRITE CDB
+func rwArgs(cdb []byte) (uint64, int) {
+	be := binary.BigEndian
+	switch cdb[0] {
+	case 0x08, 0x0a:
+		n := int(cdb[4])
+		if n == 0 {
+			n = 256
+		}
+		return uint64(cdb[1]&0x1f)<<16 | uint64(be.Uint16(cdb[2:])), n
+	case 0x28, 0x2a:
+		return uint64(be.Uint32(cdb[2:])), int(be.Uint16(cdb[7:]))
+	case 0xa8, 0xaa:
+		return uint64(be.Uint32(cdb[2:])), int(be.Uint32(cdb[6:]))
+	default:
+		return be.Uint64(cdb[2:]), int(be.Uint32(cdb[10:]))
+	}
+}
+
+func truncate(data []byte, n int) []byte {
+	if len(data) > n {
+		return data[:n]
+	}
+	return data
+}
@@ -0,0 +1,131 @@
+package iscsi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"testing"
+)
+
+// attached is a session on disk.img of root, writable if asked
+func attached(t *testing.T, root string, writable bool) *session {
+	t.Helper()
+	srv := NewServer(root)
+	srv.Writable = writable
+	s := &session{srv: srv}
+	if status := s.attach(TargetName("disk.img")); status != 0 {
+		t.Fatalf("attach status %#04x", status)
+	}
+	t.Cleanup(s.close)
+	return s
+}
+
+// cdb16 pads a CDB to the 16 bytes of a SCSI Command PDU
+func cdb16(b ...byte) []byte {
+	return append(b, make([]byte, 16-len(b))...)
+}
+
+func TestExecute(t *testing.T) {
+	root, _ := image(t)
+	s := attached(t, root, false)
+	serial := fmt.Sprintf("%016x", s.id())
+
+	capacity16 := cdb16(0x9e, 0x10)
+	binary.BigEndian.PutUint32(capacity16[10:], 32)
+	tests := []struct {
+		name  string
+		cdb   []byte
+		lun0  bool
+		want  []byte
+		sense []byte
+	}{
+		{"report LUNs", cdb16(0xa0, 0, 0, 0, 0, 0, 0, 0, 0, 16), false, []byte{0, 0, 0, 8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, nil},
+		{"report LUNs truncated", cdb16(0xa0, 0, 0, 0, 0, 0, 0, 0, 0, 4), true, []byte{0, 0, 0, 8}, nil},
+		{"request sense", cdb16(0x03, 0, 0, 0, 3), true, []byte{0x70, 0, 0}, nil},
+		{"mode sense(6)", cdb16(0x1a, 0, 0x3f, 0, 255), true, []byte{3, 0, 0x80, 0}, nil},
+		{"mode sense(10)", cdb16(0x5a, 0, 0x3f, 0, 0, 0, 0, 0, 255), true, []byte{0, 6, 0, 0x80, 0, 0, 0, 0}, nil},
+		{"read capacity(16)", capacity16, true, append([]byte{0, 0, 0, 0, 0, 0, 0, 7, 0, 0, 2, 0}, make([]byte, 20)...), nil},
+		{"other service action", cdb16(0x9e, 0x11), true, nil, errInvalidOpcode},
+		{"test unit ready", cdb16(0x00), true, nil, nil},
+		{"sync without writes", cdb16(0x35), true, nil, nil},
+		{"read of another LUN", read10(0, 1), false, nil, errLUN},
+		{"supported pages", cdb16(0x12, 1, 0x00, 0, 255), true, []byte{0, 0, 0, 3, 0x00, 0x80, 0x83}, nil},
+		{"serial number", cdb16(0x12, 1, 0x80, 0, 255), true, append([]byte{0, 0x80, 0, 16}, serial...), nil},
+		{"standard inquiry of another LUN", cdb16(0x12, 0, 0, 0, 1), false, []byte{0x7f}, nil},
+		{"page without EVPD", cdb16(0x12, 0, 0x80, 0, 255), true, nil, errInvalidField},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, sense := s.execute(tt.cdb, tt.lun0)
+			if !bytes.Equal(sense, tt.sense) {
+				t.Fatalf("sense %x, want %x", sense, tt.sense)
+			}
+			if !bytes.Equal(data, tt.want) {
+				t.Errorf("data %x, want %x", data, tt.want)
+			}
+		})
+	}
+
+	// The serial number and identifiers stay with the target name
+	if id := attached(t, root, false).id(); id != s.id() {
+		t.Errorf("id %x, then %x", s.id(), id)
+	}
+	data, _ := s.execute(cdb16(0x12, 1, 0x83, 0, 255), true)
+	if naa := data[4:16]; naa[1] != 0x03 || binary.BigEndian.Uint64(naa[4:]) != 3<<60|s.id()>>4 {
+		t.Errorf("NAA descriptor %x", naa)
+	}
+	if vendor := data[16:]; !bytes.HasSuffix(vendor, []byte("GO-PXE  "+TargetName("disk.img"))) || int(vendor[3]) != len(vendor)-4 {
+		t.Errorf("vendor descriptor %q", vendor)
+	}
+	if data, _ := s.execute(cdb16(0x12, 0, 0, 0, 36), true); !bytes.HasPrefix(data[8:], []byte("GO-PXE  disk.img  ")) {
+		t.Errorf("inquiry %q", data)
+	}
+}
+
+func TestExecuteWritable(t *testing.T) {
+	root, _ := image(t)
+	s := attached(t, root, true)
+	if data, _ := s.execute(cdb16(0x1a, 0, 0x3f, 0, 255), true); data[2] != 0 {
+		t.Errorf("writable target reports write protect: %x", data)
+	}
+	if _, sense := s.execute(cdb16(0x91), true); sense != nil {
+		t.Errorf("sync sense %x", sense)
+	}
+}
+
+func TestRWArgs(t *testing.T) {
+	tests := []struct {
+		cdb []byte
+		lba uint64
+		n   int
+	}{
+		{cdb16(0x08, 0xe1, 0x02, 0x03, 0), 0x010203, 256}, // the top bits of byte 1 aren't LBA
+		{cdb16(0x0a, 0, 0, 9, 4), 9, 4},
+		{read10(0xfffffffe, 0xffff), 0xfffffffe, 0xffff},
+		{cdb16(0xa8, 0, 0, 0, 0, 5, 0, 0, 1, 0), 5, 256},
+		{cdb16(0x88, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 2), 1 << 32, 2},
+	}
+	for _, tt := range tests {
+		if lba, n := rwArgs(tt.cdb); lba != tt.lba || n != tt.n {
+			t.Errorf("rwArgs(%x) = %d, %d, want %d, %d", tt.cdb, lba, n, tt.lba, tt.n)
+		}
+	}
+}
+
+func TestExecuteMalformed(t *testing.T) {
+	root, _ := image(t)
+	s := attached(t, root, true)
+	// Every opcode with every field set, none of which may panic
+	for op := range 256 {
+		for _, fill := range []byte{0x00, 0x7f, 0xff} {
+			cdb := bytes.Repeat([]byte{fill}, 16)
+			cdb[0] = byte(op)
+			for _, lun0 := range []bool{true, false} {
+				data, _ := s.execute(cdb, lun0)
+				if len(data) > maxTransfer {
+					t.Errorf("%x returned %d bytes", cdb, len(data))
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,393 @@
+// Package iso reads ISO 9660 images, such as distribution DVDs, as file
+// systems, so their files can be served without extracting them. Long
+// names come from Rock Ridge or else Joliet; plain ISO 9660 names are
+// lower-cased without their version, as Linux mounts them.
+package iso
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	sectorSize = 2048
+	maxDirSize = 16 << 20 // far beyond any real directory
+)
+
+// FS is an open image. It implements fs.FS and fs.ReadDirFS.
+type FS struct {
+	r      io.ReaderAt
+	closer io.Closer
+	root   entry
+	label  string
+	rr     bool // names from Rock Ridge
+	joliet bool // names from the Joliet tree
+	skip   int  // SUSP bytes to skip in each system use area
+}
+
+// entry is a directory record
+type entry struct {
+	name  string
+	start int64 // byte offset of the extent
+	size  int64
+	dir   bool
+	mtime time.Time
+}
+
+// Open opens the image at name
+func Open(name string) (*FS, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	fsys, err := New(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	fsys.closer = f
+	return fsys, nil
+}
+
+// New reads the image in r
+func New(r io.ReaderAt) (*FS, error) {
+	fsys := &FS{r: r}
+	var primary, joliet []byte
+	for lba := int64(16); ; lba++ {
+		vd := make([]byte, sectorSize)
+		if _, err := r.ReadAt(vd, lba*sectorSize); err != nil {
+			return nil, fmt.Errorf("not an ISO 9660 image: %w", err)
+		}
+		if string(vd[1:6]) != "CD001" {
+			return nil, errors.New("not an ISO 9660 image")
+		}
+		switch vd[0] {
+		case 1:
+			primary = vd
+		case 2:
+			// Joliet is UCS-2 level 1, 2 or 3
+			if esc := vd[88:91]; esc[0] == '%' && esc[1] == '/' && bytes.IndexByte([]byte("@CE"), esc[2]) >= 0 {
+				joliet = vd
+			}
+		}
+		if vd[0] == 255 || lba > 64 {
+			break
+		}
+	}
+	if primary == nil {
+		return nil, errors.New("no primary volume descriptor")
+	}
+	fsys.label = strings.TrimSpace(string(primary[40:72]))
+	fsys.root = fsys.record(primary[156:190], false)
+
+	// Rock Ridge announces itself in the root's "." record
+	if dot, err := fsys.readDir(fsys.root, true); err == nil && len(dot) > 0 {
+		if sp := dot[0]; len(sp) >= 7 && string(sp[:2]) == "SP" && sp[4] == 0xBE && sp[5] == 0xEF {
+			fsys.rr, fsys.skip = true, int(sp[6])
+		}
+	}
+	if !fsys.rr && joliet != nil {
+		fsys.joliet = true
+		fsys.root = fsys.record(joliet[156:190], false)
+	}
+	return fsys, nil
+}
+
+// Close closes the image file if Open opened it
+func (fsys *FS) Close() error {
+	if fsys.closer == nil {
+		return nil
+	}
+	return fsys.closer.Close()
+}
+
+// Label is the volume identifier, such as "RHEL-9-4-0-BaseOS-x86_64"
+func (fsys *FS) Label() string {
+	return fsys.label
+}
+
+// record decodes a directory record, naming it from its Rock Ridge entries,
+// with withRR, or else its identifier
+func (fsys *FS) record(b []byte, withRR bool) entry {
+	e := entry{
+		start: int64(binary.LittleEndian.Uint32(b[2:6])) * sectorSize,
+		size:  int64(binary.LittleEndian.Uint32(b[10:14])),
+		dir:   b[25]&0x02 != 0,
+		mtime: recorded(b[18:25]),
+	}
+	id := b[33:min(33+int(b[32]), len(b))]
+	switch {
+	case fsys.joliet:
+		u := make([]uint16, len(id)/2)
+		for i := range u {
+			u[i] = binary.BigEndian.Uint16(id[2*i:])
+		}
+		e.name = string(utf16.Decode(u))
+	default:
+		e.name = strings.ToLower(string(id))
+	}
+	if i := strings.LastIndexByte(e.name, ';'); i >= 0 {
+		e.name = e.name[:i]
+	}
+	if !e.dir {
+		e.name = strings.TrimSuffix(e.name, ".")
+	}
+	if withRR {
+		if name, ok := fsys.rrName(b); ok {
+			e.name = name
+		}
+	}
+	return e
+}
+
+// recorded decodes a directory record's 7-byte date
+func recorded(b []byte) time.Time {
+	zone := time.FixedZone("", int(int8(b[6]))*15*60)
+	return time.Date(1900+int(b[0]), time.Month(b[1]), int(b[2]), int(b[3]), int(b[4]), int(b[5]), 0, zone)
+}
+
+// susp returns the System Use Sharing Protocol entries of record b,
+// following continuation areas
+func (fsys *FS) susp(b []byte) [][]byte {
+	n := 33 + int(b[32])
+	if n%2 == 1 {
+		n++ // padding after an even-length identifier
+	}
+	area := b[min(n+fsys.skip, len(b)):]
+	var entries [][]byte
+	for hops := 0; hops < 8; hops++ {
+		var next []byte
+		for len(area) >= 4 {
+			l := int(area[2])
+			if l < 4 || l > len(area) {
+				break
+			}
+			e := area[:l]
+			area = area[l:]
+			switch string(e[:2]) {
+			case "ST":
+				area = nil
+			case "CE":
+				if l >= 28 && binary.LittleEndian.Uint32(e[20:24]) <= sectorSize {
+					block := int64(binary.LittleEndian.Uint32(e[4:8]))
+					off := int64(binary.LittleEndian.Uint32(e[12:16]))
+					size := binary.LittleEndian.Uint32(e[20:24])
+					next = make([]byte, size)
+					if _, err := fsys.r.ReadAt(next, block*sectorSize+off); err != nil {
+						next = nil
+					}
+				}
+			default:
+				entries = append(entries, e)
+			}
+		}
+		if next == nil {
+			break
+		}
+		area = next
+	}
+	return entries
+}
+
+// rrName is the Rock Ridge name of record b, if it has one
+func (fsys *FS) rrName(b []byte) (string, bool) {
+	var name []byte
+	found := false
+	for _, e := range fsys.susp(b) {
+		if string(e[:2]) == "NM" && len(e) >= 5 && e[4]&0x06 == 0 {
+			name = append(name, e[5:]...)
+			found = true
+		}
+	}
+	return string(name), found
+}
+
+// readDir returns the records of directory d. With raw, it only returns
+// the system use entries of its "." record.
+func (fsys *FS) readDir(d entry, raw bool) ([][]byte, error) {
+	if d.size > maxDirSize {
+		return nil, errors.New("directory too large")
+	}
+	data := make([]byte, d.size)
+	if _, err := fsys.r.ReadAt(data, d.start); err != nil {
+		return nil, err
+	}
+	var records [][]byte
+	for off := 0; off < len(data); {
+		l := int(data[off])
+		if l == 0 {
+			// Records don't cross sectors; the rest of this one is padding
+			off = (off/sectorSize + 1) * sectorSize
+			continue
+		}
+		if l < 34 || off+l > len(data) {
+			return nil, errors.New("corrupt directory record")
+		}
+		rec := data[off : off+l]
+		off += l
+		if raw {
+			return fsys.susp(rec), nil
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+// list returns the entries of directory d, without "." and "..". Parts of
+// a file larger than 4 GiB, recorded as consecutive records, are joined.
+func (fsys *FS) list(d entry) ([]entry, error) {
+	records, err := fsys.readDir(d, false)
+	if err != nil {
+		return nil, err
+	}
+	var list []entry
+	more := false // the last record has more extents
+	for _, rec := range records {
+		if rec[32] == 1 && (rec[33] == 0 || rec[33] == 1) {
+			continue
+		}
+		e := fsys.record(rec, fsys.rr)
+		if more && len(list) > 0 {
+			// Extents are written back to back
+			list[len(list)-1].size += e.size
+		} else {
+			list = append(list, e)
+		}
+		more = rec[25]&0x80 != 0
+	}
+	return list, nil
+}
+
+// lookup finds the entry at name, a slash-separated path
+func (fsys *FS) lookup(name string) (entry, error) {
+	if !fs.ValidPath(name) {
+		return entry{}, fs.ErrInvalid
+	}
+	e := fsys.root
+	e.name = "."
+	if name == "." {
+		return e, nil
+	}
+	for _, elem := range strings.Split(name, "/") {
+		if !e.dir {
+			return entry{}, fs.ErrNotExist
+		}
+		list, err := fsys.list(e)
+		if err != nil {
+			return entry{}, err
+		}
+		i := slices.IndexFunc(list, func(x entry) bool { return x.name == elem })
+		if i < 0 {
+			return entry{}, fs.ErrNotExist
+		}
+		e = list[i]
+	}
+	return e, nil
+}
+
+// Open opens the named file or directory
+func (fsys *FS) Open(name string) (fs.File, error) {
+	e, err := fsys.lookup(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &file{SectionReader: io.NewSectionReader(fsys.r, e.start, e.size), fsys: fsys, e: e}, nil
+}
+
+// ReadDir lists the named directory sorted by name
+func (fsys *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	e, err := fsys.lookup(name)
+	if err == nil && !e.dir {
+		err = errors.New("not a directory")
+	}
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	list, err := fsys.list(e)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	entries := make([]fs.DirEntry, len(list))
+	for i, x := range list {
+		entries[i] = fs.FileInfoToDirEntry(info{x})
+	}
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int { return strings.Compare(a.Name(), b.Name()) })
+	return entries, nil
+}
+
+// file is an open file or directory; it is also an io.ReadSeeker, as
+// http.FS needs
+type file struct {
+	*io.SectionReader
+	fsys    *FS
+	e       entry
+	listed  bool
+	entries []fs.DirEntry // not yet returned by ReadDir
+}
+
+func (f *file) Stat() (fs.FileInfo, error) { return info{f.e}, nil }
+func (f *file) Close() error               { return nil }
+
+func (f *file) Read(p []byte) (int, error) {
+	if f.e.dir {
+		return 0, &fs.PathError{Op: "read", Path: f.e.name, Err: errors.New("is a directory")}
+	}
+	return f.SectionReader.Read(p)
+}
+
+// ReadDir returns the next n entries of the directory, or all the rest
+// if n <= 0
+func (f *file) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !f.e.dir {
+		return nil, &fs.PathError{Op: "readdir", Path: f.e.name, Err: errors.New("not a directory")}
+	}
+	if !f.listed {
+		list, err := f.fsys.list(f.e)
+		if err != nil {
+			return nil, err
+		}
+		f.listed = true
+		f.entries = make([]fs.DirEntry, len(list))
+		for i, x := range list {
+			f.entries[i] = fs.FileInfoToDirEntry(info{x})
+		}
+	}
+	if n <= 0 {
+		rest := f.entries
+		f.entries = nil
+		return rest, nil
+	}
+	if len(f.entries) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(f.entries))
+	next := f.entries[:n]
+	f.entries = f.entries[n:]
+	return next, nil
+}
+
+// info describes an entry
+type info struct{ e entry }
+
+func (i info) Name() string       { return path.Base(i.e.name) }
+func (i info) Size() int64        { return i.e.size }
+func (i info) ModTime() time.Time { return i.e.mtime }
+func (i info) IsDir() bool        { return i.e.dir }
+func (i info) Sys() any           { return nil }
+
+func (i info) Mode() fs.FileMode {
+	if i.e.dir {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
@@ -0,0 +1,298 @@
+package iso
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+	"unicode/utf16"
+)
+
+// Sectors of the test image
+const (
+	secPVD = 16 + iota
+	secSVD
+	secEnd
+	secRoot
+	secBoot
+	secJolietRoot
+	secJolietBoot
+	secReadme
+	secKernel
+	secBig          // two extents
+	secContinuation = secBig + 3
+	sectors         = secContinuation + 1
+)
+
+var (
+	readme = []byte("hello from the DVD\n")
+	kernel = bytes.Repeat([]byte("K"), 1500)
+	mtime  = time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)
+)
+
+// dirRecord encodes a directory record with the system use area su
+func dirRecord(id []byte, lba, size int, flags byte, su []byte) []byte {
+	n := 33 + len(id)
+	if n%2 == 1 {
+		n++
+	}
+	b := make([]byte, n, n+len(su))
+	b = append(b, su...)
+	b[0] = byte(len(b))
+	binary.LittleEndian.PutUint32(b[2:], uint32(lba))
+	binary.BigEndian.PutUint32(b[6:], uint32(lba))
+	binary.LittleEndian.PutUint32(b[10:], uint32(size))
+	binary.BigEndian.PutUint32(b[14:], uint32(size))
+	copy(b[18:25], []byte{124, 5, 1, 12, 30, 0, 0})
+	b[25] = flags
+	b[32] = byte(len(id))
+	copy(b[33:], id)
+	return b
+}
+
+// nm is a Rock Ridge name entry
+func nm(name string) []byte {
+	return append([]byte{'N', 'M', byte(5 + len(name)), 1, 0}, name...)
+}
+
+func ucs2(s string) []byte {
+	var b []byte
+	for _, u := range utf16.Encode([]rune(s)) {
+		b = binary.BigEndian.AppendUint16(b, u)
+	}
+	return b
+}
+
+// buildISO returns an image holding README.TXT, BOOT/VMLINUZ. and the
+// two-extent BIG.IMG, with Rock Ridge names if rr and a Joliet tree if
+// joliet
+func buildISO(rr, joliet bool) []byte {
+	img := make([]byte, sectors*sectorSize)
+	sector := func(n int) []byte { return img[n*sectorSize : (n+1)*sectorSize] }
+	su := func(b []byte) []byte {
+		if rr {
+			return b
+		}
+		return nil
+	}
+
+	dot := func(lba int, root bool) []byte {
+		var sp []byte
+		if root {
+			sp = []byte{'S', 'P', 7, 1, 0xBE, 0xEF, 0}
+		}
+		return dirRecord([]byte{0}, lba, sectorSize, 0x02, su(sp))
+	}
+	dotdot := dirRecord([]byte{1}, secRoot, sectorSize, 0x02, nil)
+
+	// CE pointing at the rest of the kernel's name
+	ce := make([]byte, 28)
+	copy(ce, []byte{'C', 'E', 28, 1})
+	binary.LittleEndian.PutUint32(ce[4:], secContinuation)
+	binary.LittleEndian.PutUint32(ce[20:], 32)
+	copy(sector(secContinuation), nm("vmlinuz-6.1"))
+
+	put := func(n int, records ...[]byte) {
+		copy(sector(n), bytes.Join(records, nil))
+	}
+	put(secRoot,
+		dot(secRoot, true), dotdot,
+		dirRecord([]byte("BOOT"), secBoot, sectorSize, 0x02, su(nm("boot"))),
+		dirRecord([]byte("README.TXT;1"), secReadme, len(readme), 0, su(nm("ReadMe.txt"))),
+		dirRecord([]byte("BIG.IMG;1"), secBig, sectorSize, 0x80, su(nm("big.img"))),
+		dirRecord([]byte("BIG.IMG;1"), secBig+1, sectorSize+5, 0, su(nm("big.img"))))
+	put(secBoot, dot(secBoot, false), dotdot,
+		dirRecord([]byte("VMLINUZ."), secKernel, len(kernel), 0, su(ce)))
+	put(secJolietRoot,
+		dirRecord([]byte{0}, secJolietRoot, sectorSize, 0x02, nil), dotdot,
+		dirRecord(ucs2("boot"), secJolietBoot, sectorSize, 0x02, nil),
+		dirRecord(ucs2("Read Me.txt;1"), secReadme, len(readme), 0, nil),
+		dirRecord(ucs2("big.img;1"), secBig, sectorSize, 0x80, nil),
+		dirRecord(ucs2("big.img;1"), secBig+1, sectorSize+5, 0, nil))
+	put(secJolietBoot, dirRecord([]byte{0}, secJolietBoot, sectorSize, 0x02, nil), dotdot,
+		dirRecord(ucs2("vmlinuz-6.1"), secKernel, len(kernel), 0, nil))
+	copy(sector(secReadme), readme)
+	copy(img[secKernel*sectorSize:], kernel)
+	for i := range 2*sectorSize + 5 {
+		img[secBig*sectorSize+i] = byte(i)
+	}
+
+	vd := func(n int, typ byte, root int) {
+		b := sector(n)
+		b[0] = typ
+		copy(b[1:], "CD001")
+		b[6] = 1
+		copy(b[40:72], "TEST_DVD                        ")
+		copy(b[156:190], dirRecord([]byte{0}, root, sectorSize, 0x02, nil))
+	}
+	vd(secPVD, 1, secRoot)
+	if joliet {
+		vd(secSVD, 2, secJolietRoot)
+		copy(sector(secSVD)[88:], "%/E")
+	} else {
+		vd(secSVD, 2, secRoot) // another supplementary descriptor, ignored
+	}
+	copy(sector(secEnd), "\xffCD001\x01")
+	return img
+}
+
+func TestFS(t *testing.T) {
+	tests := []struct {
+		name   string
+		rr     bool
+		joliet bool
+		readme string
+		kernel string
+	}{
+		{"ISO 9660", false, false, "readme.txt", "boot/vmlinuz"},
+		{"Rock Ridge", true, false, "ReadMe.txt", "boot/vmlinuz-6.1"},
+		{"Joliet", false, true, "Read Me.txt", "boot/vmlinuz-6.1"},
+		{"Rock Ridge over Joliet", true, true, "ReadMe.txt", "boot/vmlinuz-6.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fsys, err := New(bytes.NewReader(buildISO(tt.rr, tt.joliet)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fsys.Label() != "TEST_DVD" {
+				t.Errorf("label %q", fsys.Label())
+			}
+			if err := fstest.TestFS(fsys, tt.readme, tt.kernel, "big.img"); err != nil {
+				t.Fatal(err)
+			}
+			for name, want := range map[string][]byte{tt.readme: readme, tt.kernel: kernel} {
+				if got, err := fs.ReadFile(fsys, name); err != nil || !bytes.Equal(got, want) {
+					t.Errorf("%s: %d bytes, %v", name, len(got), err)
+				}
+			}
+			big, err := fs.ReadFile(fsys, "big.img")
+			if err != nil || len(big) != 2*sectorSize+5 || big[2*sectorSize+4] != (2*sectorSize+4)&0xff {
+				t.Errorf("big.img: %d bytes, %v", len(big), err)
+			}
+			fi, err := fs.Stat(fsys, tt.readme)
+			if err != nil || !fi.ModTime().Equal(mtime) || fi.Mode() != 0444 {
+				t.Errorf("stat %s: %v, %v", tt.readme, fi, err)
+			}
+			if _, err := fsys.Open("boot/missing"); err == nil {
+				t.Error("opened a missing file")
+			}
+			if _, err := fsys.Open(tt.readme + "/x"); err == nil {
+				t.Error("opened a file under a file")
+			}
+			if _, err := fsys.ReadDir(tt.readme); err == nil {
+				t.Error("listed a file")
+			}
+			d, _ := fsys.Open("boot")
+			if _, err := d.Read(make([]byte, 1)); err == nil {
+				t.Error("read a directory")
+			}
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	img := buildISO(false, false)
+	for _, n := range []int{0, 100, secPVD * sectorSize, secPVD*sectorSize + 100} {
+		if _, err := New(bytes.NewReader(img[:n])); err == nil {
+			t.Errorf("opened %d bytes", n)
+		}
+	}
+	noPrimary := bytes.Clone(img)
+	noPrimary[secPVD*sectorSize] = 3
+	if _, err := New(bytes.NewReader(noPrimary)); err == nil {
+		t.Error("opened an image without a primary volume descriptor")
+	}
+	noMagic := bytes.Clone(img)
+	copy(noMagic[secSVD*sectorSize+1:], "CD002")
+	if _, err := New(bytes.NewReader(noMagic)); err == nil {
+		t.Error("opened an image with a bad descriptor")
+	}
+}
+
+// walk reads every file and directory down to depth, as a corrupt
+// directory may contain itself
+func walk(fsys fs.FS, dir string, depth int) {
+	entries, _ := fs.ReadDir(fsys, dir)
+	for _, e := range entries {
+		name := path.Join(dir, e.Name())
+		if e.IsDir() {
+			if depth > 0 {
+				walk(fsys, name, depth-1)
+			}
+			continue
+		}
+		if f, err := fsys.Open(name); err == nil {
+			io.Copy(io.Discard, f)
+			f.Close()
+		}
+	}
+}
+
+func TestMalformed(t *testing.T) {
+	// Corrupt each byte of the descriptors' root records and the
+	// directories in turn
+	for _, opts := range [][2]bool{{false, false}, {true, false}, {false, true}} {
+		img := buildISO(opts[0], opts[1])
+		var offsets []int
+		for _, sec := range []int{secPVD, secSVD} {
+			for i := 156; i < 190; i++ {
+				offsets = append(offsets, sec*sectorSize+i)
+			}
+		}
+		for _, sec := range []int{secRoot, secBoot, secJolietRoot, secJolietBoot} {
+			for i := range 256 {
+				offsets = append(offsets, sec*sectorSize+i)
+			}
+		}
+		for _, off := range offsets {
+			for _, v := range []byte{0x00, 0x01, 0x7f, 0xff} {
+				bad := bytes.Clone(img)
+				bad[off] = v
+				fsys, err := New(bytes.NewReader(bad))
+				if err != nil {
+					continue
+				}
+				walk(fsys, ".", 2)
+			}
+		}
+	}
+
+	t.Run("identifier past the record", func(t *testing.T) {
+		img := buildISO(false, false)
+		img[secPVD*sectorSize+156+32] = 0xff
+		fsys, err := New(bytes.NewReader(img))
+		if err != nil {
+			t.Fatal(err)
+		}
+		walk(fsys, ".", 2)
+	})
+	t.Run("oversized continuation", func(t *testing.T) {
+		img := buildISO(true, false)
+		i := bytes.Index(img[secBoot*sectorSize:], []byte{'C', 'E', 28, 1})
+		binary.LittleEndian.PutUint32(img[secBoot*sectorSize+i+20:], 1<<31)
+		fsys, err := New(bytes.NewReader(img))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fs.Stat(fsys, "boot/vmlinuz"); err != nil {
+			t.Errorf("kernel without its Rock Ridge name: %v", err)
+		}
+	})
+	t.Run("oversized directory", func(t *testing.T) {
+		img := buildISO(false, false)
+		binary.LittleEndian.PutUint32(img[secRoot*sectorSize+68+10:], 1<<31)
+		fsys, err := New(bytes.NewReader(img))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fsys.ReadDir("boot"); err == nil || !strings.Contains(err.Error(), "too large") {
+			t.Errorf("listed a 2 GiB directory: %v", err)
+		}
+	})
+}
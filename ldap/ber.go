@@ -0,0 +1,306 @@
+package ldap
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+// BER tags of the LDAPv3 messages and fields used here (RFC 4511)
+const (
+	tagInteger     = 0x02
+	tagOctetString = 0x04
+	tagEnumerated  = 0x0a
+	tagSequence    = 0x30
+
+	tagBindRequest    = 0x60
+	tagBindResponse   = 0x61
+	tagUnbindRequest  = 0x42
+	tagSearchRequest  = 0x63
+	tagSearchEntry    = 0x64
+	tagSearchDone     = 0x65
+	tagSearchRef      = 0x73
+	tagAuthSimple     = 0x80
+	tagFilterEquality = 0xa3
+	tagFilterPresent  = 0x87
+
+	scopeBase    = 0
+	scopeSubtree = 2
+
+	resultSuccess            = 0
+	resultSizeLimitExceeded  = 4
+	resultInvalidCredentials = 49
+
+	maxMessage = 1 << 20
+)
+
+type conn struct {
+	nc     net.Conn
+	r      *bufio.Reader
+	lastID int
+}
+
+type entry struct {
+	dn    string
+	attrs map[string][]string // by lower-case attribute name
+}
+
+// bind performs a simple bind
+func (c *conn) bind(dn, password string) error {
+	req := tlv(tagBindRequest,
+		tlv(tagInteger, 3),
+		tlv(tagOctetString, dn),
+		tlv(tagAuthSimple, password))
+	resp, err := c.roundTrip(req)
+	if err != nil {
+		return err
+	}
+	if len(resp) != 1 || resp[0].tag != tagBindResponse {
+		return errors.New("unexpected bind response")
+	}
+	return result(resp[0])
+}
+
+// search returns the entries under base matching attr=value, or every entry
+// in scope when attr is empty, with attributes attrs (none if nil)
+func (c *conn) search(base string, scope int, attr, value string, attrs []string) ([]entry, error) {
+	filter := tlv(tagFilterPresent, "objectClass")
+	if attr != "" {
+		filter = tlv(tagFilterEquality, tlv(tagOctetString, attr), tlv(tagOctetString, value))
+	}
+	var list []any
+	if attrs == nil {
+		list = append(list, tlv(tagOctetString, "1.1")) // no attributes
+	}
+	for _, a := range attrs {
+		list = append(list, tlv(tagOctetString, a))
+	}
+	req := tlv(tagSearchRequest,
+		tlv(tagOctetString, base),
+		tlv(tagEnumerated, scope),
+		tlv(tagEnumerated, 0), // never deref aliases
+		tlv(tagInteger, 2),    // size limit: two tell a unique match from an ambiguous one
+		tlv(tagInteger, 10),   // time limit in seconds
+		tlv(0x01, false),      // types only
+		filter,
+		tlv(tagSequence, list...))
+	resp, err := c.roundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	var entries []entry
+	for _, op := range resp {
+		switch op.tag {
+		case tagSearchEntry:
+			e, err := parseEntry(op)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, e)
+		case tagSearchDone:
+			// Over the size limit, the entries so far are still returned
+			if err := result(op); err != nil && resultCode(op) != resultSizeLimitExceeded {
+				return nil, err
+			}
+		}
+	}
+	return entries, nil
+}
+
+func (c *conn) close() {
+	c.lastID++
+	c.nc.Write(tlv(tagSequence, tlv(tagInteger, c.lastID), []byte{tagUnbindRequest, 0}))
+	c.nc.Close()
+}
+
+// roundTrip sends one request and reads responses until the one that ends
+// it: a bind response or a search done
+func (c *conn) roundTrip(op []byte) ([]element, error) {
+	if c.r == nil {
+		c.r = bufio.NewReader(c.nc)
+	}
+	c.lastID++
+	if _, err := c.nc.Write(tlv(tagSequence, tlv(tagInteger, c.lastID), op)); err != nil {
+		return nil, fmt.Errorf("ldap: %w", err)
+	}
+	var ops []element
+	for {
+		msg, err := readElement(c.r)
+		if err != nil {
+			return nil, fmt.Errorf("ldap: %w", err)
+		}
+		fields, err := msg.children()
+		if err != nil || len(fields) < 2 {
+			return nil, errors.New("ldap: malformed message")
+		}
+		if fields[0].int() != c.lastID {
+			continue // e.g. a notice of disconnection
+		}
+		ops = append(ops, fields[1])
+		if fields[1].tag != tagSearchEntry && fields[1].tag != tagSearchRef {
+			return ops, nil
+		}
+	}
+}
+
+// result turns an LDAPResult into an error
+func result(op element) error {
+	fields, err := op.children()
+	if err != nil || len(fields) < 3 {
+		return errors.New("ldap: malformed result")
+	}
+	switch code := resultCode(op); code {
+	case resultSuccess:
+		return nil
+	case resultInvalidCredentials:
+		return ErrInvalidCredentials
+	default:
+		if msg := string(fields[2].value); msg != "" {
+			return fmt.Errorf("ldap: result code %d: %s", code, msg)
+		}
+		return fmt.Errorf("ldap: result code %d", code)
+	}
+}
+
+func resultCode(op element) int {
+	fields, err := op.children()
+	if err != nil || len(fields) == 0 {
+		return -1
+	}
+	return fields[0].int()
+}
+
+func parseEntry(op element) (entry, error) {
+	fields, err := op.children()
+	if err != nil || len(fields) < 2 {
+		return entry{}, errors.New("ldap: malformed search entry")
+	}
+	e := entry{dn: string(fields[0].value), attrs: make(map[string][]string)}
+	attrs, err := fields[1].children()
+	if err != nil {
+		return entry{}, errors.New("ldap: malformed search entry")
+	}
+	for _, a := range attrs {
+		parts, err := a.children()
+		if err != nil || len(parts) < 2 {
+			continue
+		}
+		vals, _ := parts[1].children()
+		name := strings.ToLower(string(parts[0].value))
+		for _, v := range vals {
+			e.attrs[name] = append(e.attrs[name], string(v.value))
+		}
+	}
+	return e, nil
+}
+
+// element is one decoded BER tag-length-value
+type element struct {
+	tag   byte
+	value []byte
+}
+
+func (e element) children() ([]element, error) {
+	var list []element
+	r := bufio.NewReader(bytes.NewReader(e.value))
+	for {
+		c, err := readElement(r)
+		if err == io.EOF {
+			return list, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, c)
+	}
+}
+
+func (e element) int() int {
+	n := 0
+	for i, b := range e.value {
+		if i == 0 && b&0x80 != 0 {
+			n = -1
+		}
+		n = n<<8 | int(b)
+	}
+	return n
+}
+
+func readElement(r *bufio.Reader) (element, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return element{}, err
+	}
+	b, err := r.ReadByte()
+	if err != nil {
+		return element{}, io.ErrUnexpectedEOF
+	}
+	n := int(b)
+	if b&0x80 != 0 {
+		size := int(b & 0x7f)
+		if size == 0 || size > 4 {
+			return element{}, errors.New("unsupported BER length")
+		}
+		n = 0
+		for range size {
+			b, err := r.ReadByte()
+			if err != nil {
+				return element{}, io.ErrUnexpectedEOF
+			}
+			n = n<<8 | int(b)
+		}
+	}
+	if n < 0 || n > maxMessage { // n wraps on 32-bit platforms
+		return element{}, errors.New("message too large")
+	}
+	value := make([]byte, n)
+	if _, err := io.ReadFull(r, value); err != nil {
+		return element{}, io.ErrUnexpectedEOF
+	}
+	return element{tag: tag, value: value}, nil
+}
+
+// tlv encodes a BER element. v is a string, an int, a bool or nested
+// encoded elements.
+func tlv(tag byte, v ...any) []byte {
+	var value []byte
+	for _, x := range v {
+		switch x := x.(type) {
+		case string:
+			value = append(value, x...)
+		case []byte:
+			value = append(value, x...)
+		case bool:
+			if x {
+				value = append(value, 0xff)
+			} else {
+				value = append(value, 0)
+			}
+		case int:
+			var be []byte
+			for n := x; ; n >>= 8 {
+				be = append([]byte{byte(n)}, be...)
+				if n < 0x80 && n >= -0x80 {
+					break
+				}
+			}
+			value = append(value, be...)
+		}
+	}
+	out := []byte{tag}
+	switch n := len(value); {
+	case n < 0x80:
+		out = append(out, byte(n))
+	case n < 0x100:
+		out = append(out, 0x81, byte(n))
+	case n < 0x10000:
+		out = append(out, 0x82, byte(n>>8), byte(n))
+	default:
+		out = append(out, 0x84, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	return append(out, value...)
+}
@@ -0,0 +1,86 @@
+package ldap
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestTLV(t *testing.T) {
+	tests := []struct {
+		name string
+		b    []byte
+		want []byte
+	}{
+		{"int zero", tlv(tagInteger, 0), []byte{0x02, 1, 0}},
+		{"int 127", tlv(tagInteger, 127), []byte{0x02, 1, 0x7f}},
+		{"int 128", tlv(tagInteger, 128), []byte{0x02, 2, 0, 0x80}},
+		{"int 256", tlv(tagInteger, 256), []byte{0x02, 2, 1, 0}},
+		{"int -1", tlv(tagInteger, -1), []byte{0x02, 1, 0xff}},
+		{"int -129", tlv(tagInteger, -129), []byte{0x02, 2, 0xff, 0x7f}},
+		{"bool", tlv(0x01, true, false), []byte{0x01, 2, 0xff, 0}},
+		{"string", tlv(tagOctetString, "ab"), []byte{0x04, 2, 'a', 'b'}},
+		{"nested", tlv(tagSequence, tlv(tagInteger, 1), []byte{tagUnbindRequest, 0}), []byte{0x30, 5, 0x02, 1, 1, 0x42, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !bytes.Equal(tt.b, tt.want) {
+				t.Errorf("tlv = % x, want % x", tt.b, tt.want)
+			}
+		})
+	}
+
+	for _, n := range []int{0, 1, 127, 128, 255, 256, 65535, 65536} {
+		b := tlv(tagOctetString, strings.Repeat("x", n))
+		e, err := readElement(bufio.NewReader(bytes.NewReader(b)))
+		if err != nil || e.tag != tagOctetString || len(e.value) != n {
+			t.Errorf("%d-byte string read back as %d bytes, %v", n, len(e.value), err)
+		}
+	}
+	for _, n := range []int{0, 1, 127, 128, -1, -128, -129, 1 << 20, -(1 << 20)} {
+		e, _ := readElement(bufio.NewReader(bytes.NewReader(tlv(tagInteger, n))))
+		if got := e.int(); got != n {
+			t.Errorf("int %d read back as %d", n, got)
+		}
+	}
+}
+
+func TestReadElement(t *testing.T) {
+	tests := []struct {
+		name    string
+		b       []byte
+		wantErr error
+	}{
+		{"empty", nil, io.EOF},
+		{"no length", []byte{0x04}, io.ErrUnexpectedEOF},
+		{"short value", []byte{0x04, 3, 'a'}, io.ErrUnexpectedEOF},
+		{"short long length", []byte{0x04, 0x82, 1}, io.ErrUnexpectedEOF},
+		{"indefinite length", []byte{0x30, 0x80, 0, 0}, nil},
+		{"five length bytes", []byte{0x04, 0x85, 0, 0, 0, 0, 1, 'a'}, nil},
+		{"too large", []byte{0x04, 0x84, 0xff, 0xff, 0xff, 0xff}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := readElement(bufio.NewReader(bytes.NewReader(tt.b)))
+			if err == nil || tt.wantErr != nil && err != tt.wantErr {
+				t.Errorf("error %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	bad := element{tag: tagSequence, value: []byte{0x04, 5, 'a'}}
+	if _, err := bad.children(); err == nil {
+		t.Error("children of a truncated sequence")
+	}
+	if code := resultCode(bad); code != -1 {
+		t.Errorf("result code of a malformed result %d", code)
+	}
+	if err := result(bad); err == nil {
+		t.Error("malformed result is a success")
+	}
+	if _, err := parseEntry(bad); err == nil {
+		t.Error("parsed a malformed entry")
+	}
+}
@@ -0,0 +1,161 @@
+// Package ldap authenticates users against an LDAP directory with a simple
+// bind and reads their group memberships. It speaks just enough LDAPv3 for
+// that: bind, a single-attribute search and unbind.
+package ldap
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ErrInvalidCredentials is returned for a wrong user name or password
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// Directory is an LDAP server users log in to. Users are found either by
+// UserDN, a DN template such as "uid={username},ou=people,dc=example,dc=com",
+// or by searching BaseDN for UserAttr=<name> after binding as BindDN.
+type Directory struct {
+	URL      string // ldap://host[:389] or ldaps://host[:636]
+	Insecure bool   // skip certificate verification for ldaps
+
+	UserDN string
+
+	BindDN       string
+	BindPassword string
+	BaseDN       string
+	UserAttr     string // "uid" by default; "sAMAccountName" for AD
+
+	GroupAttr string // attribute listing the user's groups, "memberOf" by default
+	Timeout   time.Duration
+}
+
+// Authenticate checks username and password and returns the user's groups:
+// each group DN followed by its first RDN value (e.g. its cn)
+func (d *Directory) Authenticate(username, password string) ([]string, error) {
+	// An empty password is an unauthenticated bind, which servers accept
+	if username == "" || password == "" {
+		return nil, ErrInvalidCredentials
+	}
+	c, err := d.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer c.close()
+
+	dn := strings.ReplaceAll(d.UserDN, "{username}", escapeDN(username))
+	if d.UserDN == "" {
+		if d.BaseDN == "" {
+			return nil, errors.New("ldap: set userDN or baseDN")
+		}
+		if err := c.bind(d.BindDN, d.BindPassword); err != nil {
+			// Not the user's credentials: %v keeps it from reading as
+			// ErrInvalidCredentials
+			return nil, fmt.Errorf("ldap: service bind: %v", err)
+		}
+		entries, err := c.search(d.BaseDN, scopeSubtree, d.userAttr(), username, nil)
+		if err != nil {
+			return nil, fmt.Errorf("ldap: find user: %w", err)
+		}
+		if len(entries) != 1 {
+			return nil, ErrInvalidCredentials
+		}
+		dn = entries[0].dn
+	}
+
+	if err := c.bind(dn, password); err != nil {
+		return nil, err
+	}
+	entries, err := c.search(dn, scopeBase, "", "", []string{d.groupAttr()})
+	if err != nil {
+		return nil, fmt.Errorf("ldap: read groups: %w", err)
+	}
+	var groups []string
+	for _, e := range entries {
+		for _, g := range e.attrs[strings.ToLower(d.groupAttr())] {
+			groups = append(groups, g)
+			if cn := firstRDNValue(g); cn != "" {
+				groups = append(groups, cn)
+			}
+		}
+	}
+	return groups, nil
+}
+
+func (d *Directory) userAttr() string {
+	if d.UserAttr == "" {
+		return "uid"
+	}
+	return d.UserAttr
+}
+
+func (d *Directory) groupAttr() string {
+	if d.GroupAttr == "" {
+		return "memberOf"
+	}
+	return d.GroupAttr
+}
+
+func (d *Directory) dial() (*conn, error) {
+	u, err := url.Parse(d.URL)
+	if err != nil {
+		return nil, fmt.Errorf("ldap: %w", err)
+	}
+	timeout := d.Timeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	host := u.Host
+	var nc net.Conn
+	switch u.Scheme {
+	case "ldap":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "389")
+		}
+		nc, err = net.DialTimeout("tcp", host, timeout)
+	case "ldaps":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "636")
+		}
+		dialer := &net.Dialer{Timeout: timeout}
+		nc, err = tls.DialWithDialer(dialer, "tcp", host, &tls.Config{ServerName: u.Hostname(), InsecureSkipVerify: d.Insecure})
+	default:
+		return nil, fmt.Errorf("ldap: unsupported URL scheme %q", u.Scheme)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ldap: %w", err)
+	}
+	nc.SetDeadline(time.Now().Add(timeout))
+	return &conn{nc: nc}, nil
+}
+
+// escapeDN escapes a value for use in a DN (RFC 4514)
+func escapeDN(s string) string {
+	var b strings.Builder
+	for i, r := range s {
+		switch {
+		case strings.ContainsRune(`,+"\<>;=`, r), r == '#' && i == 0, r == ' ' && (i == 0 || i == len(s)-1):
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == 0:
+			b.WriteString(`\00`)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// firstRDNValue returns "admins" for "cn=admins,ou=groups,dc=example"
+func firstRDNValue(dn string) string {
+	rdn, _, _ := strings.Cut(dn, ",")
+	_, v, ok := strings.Cut(rdn, "=")
+	if !ok {
+		return ""
+	}
+	return strings.TrimSpace(v)
+}
@@ -0,0 +1,214 @@
+package ldap
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+var (
+	passwords = map[string]string{
+		"cn=svc,dc=example":              "svcpw",
+		"uid=alice,ou=people,dc=example": "secret",
+		"uid=bob,ou=people,dc=example":   "hunter2",
+	}
+	memberOf = map[string][]string{
+		"uid=alice,ou=people,dc=example": {"cn=admins,ou=groups,dc=example", "cn=ops,ou=groups,dc=example"},
+	}
+)
+
+// serveLDAP answers binds and searches on one connection from passwords and
+// memberOf. Searching for uid=dup finds two entries.
+func serveLDAP(nc net.Conn) {
+	defer nc.Close()
+	r := bufio.NewReader(nc)
+	for {
+		msg, err := readElement(r)
+		if err != nil {
+			return
+		}
+		fields, _ := msg.children()
+		id := fields[0].int()
+		op := fields[1]
+		args, _ := op.children()
+		reply := func(op []byte) { nc.Write(tlv(tagSequence, tlv(tagInteger, id), op)) }
+		done := func(tag byte, code int) {
+			reply(tlv(tag, tlv(tagEnumerated, code), tlv(tagOctetString, ""), tlv(tagOctetString, "")))
+		}
+		entry := func(dn string, attrs ...[]byte) {
+			reply(tlv(tagSearchEntry, tlv(tagOctetString, dn), tlv(tagSequence, toAny(attrs)...)))
+		}
+
+		switch op.tag {
+		case tagBindRequest:
+			dn, password := string(args[1].value), string(args[2].value)
+			if pw, ok := passwords[dn]; ok && pw == password {
+				done(tagBindResponse, resultSuccess)
+			} else {
+				done(tagBindResponse, resultInvalidCredentials)
+			}
+		case tagSearchRequest:
+			base, scope := string(args[0].value), args[1].int()
+			if scope == scopeBase {
+				var vals [][]byte
+				for _, g := range memberOf[base] {
+					vals = append(vals, tlv(tagOctetString, g))
+				}
+				entry(base, tlv(tagSequence, tlv(tagOctetString, "memberOf"), tlv(0x31, toAny(vals)...)))
+				done(tagSearchDone, resultSuccess)
+				continue
+			}
+			filter, _ := args[6].children()
+			attr, value := string(filter[0].value), string(filter[1].value)
+			switch {
+			case attr == "uid" && value == "dup":
+				entry("uid=dup1,ou=people,dc=example")
+				entry("uid=dup2,ou=people,dc=example")
+				done(tagSearchDone, resultSizeLimitExceeded)
+			case attr == "uid":
+				if dn := "uid=" + value + ",ou=people,dc=example"; passwords[dn] != "" {
+					entry(dn)
+				}
+				done(tagSearchDone, resultSuccess)
+			default:
+				done(tagSearchDone, 32) // noSuchObject
+			}
+		case tagUnbindRequest:
+			return
+		}
+	}
+}
+
+func toAny(list [][]byte) []any {
+	var out []any
+	for _, b := range list {
+		out = append(out, b)
+	}
+	return out
+}
+
+func startLDAP(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			nc, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveLDAP(nc)
+		}
+	}()
+	return "ldap://" + ln.Addr().String()
+}
+
+func TestAuthenticate(t *testing.T) {
+	url := startLDAP(t)
+	template := &Directory{URL: url, UserDN: "uid={username},ou=people,dc=example", Timeout: 5 * time.Second}
+	search := &Directory{URL: url, BindDN: "cn=svc,dc=example", BindPassword: "svcpw", BaseDN: "dc=example", Timeout: 5 * time.Second}
+	admins := []string{"cn=admins,ou=groups,dc=example", "admins", "cn=ops,ou=groups,dc=example", "ops"}
+
+	tests := []struct {
+		name     string
+		dir      *Directory
+		user     string
+		password string
+		want     []string
+		wantErr  error
+	}{
+		{"DN template", template, "alice", "secret", admins, nil},
+		{"DN template without groups", template, "bob", "hunter2", nil, nil},
+		{"DN template wrong password", template, "alice", "wrong", nil, ErrInvalidCredentials},
+		{"DN template unknown user", template, "carol", "secret", nil, ErrInvalidCredentials},
+		{"empty password", template, "alice", "", nil, ErrInvalidCredentials},
+		{"empty user", template, "", "secret", nil, ErrInvalidCredentials},
+		{"search", search, "alice", "secret", admins, nil},
+		{"search wrong password", search, "alice", "wrong", nil, ErrInvalidCredentials},
+		{"search unknown user", search, "carol", "secret", nil, ErrInvalidCredentials},
+		{"search ambiguous user", search, "dup", "secret", nil, ErrInvalidCredentials},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			groups, err := tt.dir.Authenticate(tt.user, tt.password)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("error %v, want %v", err, tt.wantErr)
+			}
+			if !slices.Equal(groups, tt.want) {
+				t.Errorf("groups %q, want %q", groups, tt.want)
+			}
+		})
+	}
+
+	for _, dir := range []*Directory{
+		{URL: url, BindDN: "cn=svc,dc=example", BindPassword: "wrong", BaseDN: "dc=example"},
+		{URL: url},
+		{URL: "http://" + url[len("ldap://"):]},
+	} {
+		if _, err := dir.Authenticate("alice", "secret"); err == nil || errors.Is(err, ErrInvalidCredentials) {
+			t.Errorf("%+v: error %v, want a configuration error", dir, err)
+		}
+	}
+}
+
+func TestMalformedResponse(t *testing.T) {
+	for _, resp := range [][]byte{
+		{0x30, 0},                   // no message ID or operation
+		{0x30, 3, 0x02, 1, 1},       // no operation
+		{0x30, 5, 0x02, 1, 1, 0x61}, // truncated operation
+		tlv(tagSequence, tlv(tagInteger, 1), tlv(tagBindResponse)), // empty result
+		{0x30, 0x84, 0xff, 0xff, 0xff, 0xff},                       // oversized
+	} {
+		client, server := net.Pipe()
+		go func() {
+			readElement(bufio.NewReader(server))
+			server.Write(resp)
+			server.Close()
+		}()
+		c := &conn{nc: client}
+		if err := c.bind("cn=x", "y"); err == nil {
+			t.Errorf("bind succeeded on % x", resp)
+		}
+		client.Close()
+	}
+}
+
+func TestEscapeDN(t *testing.T) {
+	tests := map[string]string{
+		"alice":       "alice",
+		"smith, john": `smith\, john`,
+		"a+b=c":       `a\+b\=c`,
+		`"q"<x>;\`:    `\"q\"\<x\>\;\\`,
+		"#1":          `\#1`,
+		"a#1":         "a#1",
+		" pad ":       `\ pad\ `,
+		"nul\x00":     `nul\00`,
+		"ünïcode":     "ünïcode",
+		"*)(uid=*":    `*)(uid\=*`,
+	}
+	for in, want := range tests {
+		if got := escapeDN(in); got != want {
+			t.Errorf("escapeDN(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestFirstRDNValue(t *testing.T) {
+	tests := map[string]string{
+		"cn=admins,ou=groups,dc=example": "admins",
+		"CN= Domain Admins ,DC=corp":     "Domain Admins",
+		"admins":                         "",
+		"":                               "",
+	}
+	for in, want := range tests {
+		if got := firstRDNValue(in); got != want {
+			t.Errorf("firstRDNValue(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
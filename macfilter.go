@@ -0,0 +1,26 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/ars1364/go-pxe/dhcp"
+)
+
+// checkMACFilters checks that allowMacs and denyMacs hold MAC addresses
+// and OUIs
+func (c domainConfig) checkMACFilters() error {
+	if _, err := dhcp.ParseMACList(c.AllowMACs); err != nil {
+		return fmt.Errorf("allowMacs: %w", err)
+	}
+	if _, err := dhcp.ParseMACList(c.DenyMACs); err != nil {
+		return fmt.Errorf("denyMacs: %w", err)
+	}
+	return nil
+}
+
+// macList is allowMacs or denyMacs as the DHCP server takes it; it is
+// checked already
+func macList(list []string) dhcp.MACList {
+	l, _ := dhcp.ParseMACList(list)
+	return l
+}
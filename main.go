@@ -3,79 +3,463 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
+	"github.com/ars1364/go-pxe/api"
+	"github.com/ars1364/go-pxe/assets"
+	"github.com/ars1364/go-pxe/audit"
+	"github.com/ars1364/go-pxe/bootlog"
 	"github.com/ars1364/go-pxe/dhcp"
-	"github.com/ars1364/go-pxe/httpserver"
-	"github.com/ars1364/go-pxe/tftp"
+	"github.com/ars1364/go-pxe/events"
+	"github.com/ars1364/go-pxe/fetch"
+	"github.com/ars1364/go-pxe/memory"
+	"github.com/ars1364/go-pxe/metrics"
+	"github.com/ars1364/go-pxe/oci"
+	"github.com/ars1364/go-pxe/pki"
+	"github.com/ars1364/go-pxe/qos"
+	"github.com/ars1364/go-pxe/quirks"
+	"github.com/ars1364/go-pxe/sessions"
+	"github.com/ars1364/go-pxe/sshkeys"
+	"github.com/ars1364/go-pxe/tracing"
+	"github.com/ars1364/go-pxe/vault"
 )
 
+// Recent events kept in memory and included in backups
+const historySize = 10000
+
+// DNS-SD service type of the management API
+const mdnsAPIService = "_gopxe._tcp"
+
+// Syslog messages kept per client, enough for a full Anaconda install
+const logsPerClient = 20000
+
+// Serial console output kept per client, in bytes
+const consolePerClient = 1 << 20
+
+// options holds the flags shared by the server and its subcommands
+type options struct {
+	iface     string
+	vlan      int
+	vlanNew   bool
+	serverIP  string
+	dhcpStart string
+	dhcpEnd   string
+	dhcpWork  int
+	dhcpHook  string
+	staticARP bool
+	rawSocket bool
+	declHold  time.Duration
+	probe     time.Duration
+	leaseTime time.Duration
+	proxyDHCP bool
+	tftpRoot  string
+	httpRoot  string
+	httpPort  int
+	bootFile  string
+	bootARM   string
+	bootRISCV string
+	bootFiles string
+	reserve   string
+	allowMACs string
+	denyMACs  string
+	relays    string
+	bootMenu  string
+	menuMsg   string
+	menuWait  time.Duration
+	localBoot string
+	secBoot   string
+	auto      bool
+	natOut    string
+	dnsDomain string
+	domName   string
+	gateway   string
+	dnsAddrs  string
+	ntpAddrs  string
+	dnsUp     string
+	dnsBlock  bool
+	ntp       bool
+	v6Prefix  string
+	v6Managed bool
+	v6Other   bool
+	v6DNS     string
+	dhcpv6    bool
+	nbdRoot   string
+	iscsiRoot string
+	iscsiRW   bool
+	nfsRoot   string
+	overlays  string
+	mcastRoot string
+	syslog    bool
+	console   bool
+	netcons   bool
+	mdns      bool
+	inspector bool
+	hardware  bool
+	attest    bool
+	pki       bool
+	httpsPort int
+	enroll    bool
+	discovery string
+	foreman   string
+	fmTrusted string
+	defsDir   string
+	gitURL    string
+	gitBranch string
+	gitPath   string
+	gitDir    string
+	nbxyz     string
+	nbxyzAll  bool
+	ipxe      bool
+	bootToken time.Duration
+
+	domainsFile string
+	apiAddr     string
+	metricsAddr string
+	otlp        string
+	apiUsers    string
+	auditLog    string
+	vaultAddr   string
+	vaultRole   string
+	vaultMount  string
+	caDir       string
+	sshKeyDir   string
+	ociCache    string
+	ociPlain    string
+	fetchRate   string
+	fetchChunks int
+	fetchVerify string
+	fetchKeys   string
+	catalog     string
+	qosXfers    int
+	qosRate     string
+
+	// Memory sizes, each from memBudget unless set
+	memBudget  string
+	memCache   string
+	memMaxFile string
+	memBuffer  string
+
+	protoMode string
+
+	leaseDir string
+
+	bootLog     string
+	bootLogKeep time.Duration
+
+	backupDir      string
+	backupS3       string
+	backupInterval time.Duration
+	backupKeep     int
+
+	// restoreFrom seeds state from a backup snapshot (set by "restore")
+	restoreFrom string
+}
+
+func (o *options) register(fs *flag.FlagSet) {
+	fs.StringVar(&o.iface, "iface", "en7", "Network interface to listen on")
+	fs.IntVar(&o.vlan, "vlan", 0, "Serve the 802.1Q sub-interface of -iface with this VLAN ID (e.g. eth0.100) instead of -iface itself")
+	fs.BoolVar(&o.vlanNew, "vlan-create", false, "Create the -vlan sub-interface and assign -ip to it if it doesn't exist (removed on shutdown)")
+	fs.StringVar(&o.serverIP, "ip", "10.0.0.1", "Server IP address on the PXE interface")
+	fs.StringVar(&o.dhcpStart, "dhcp-start", "10.0.0.100", "DHCP range start")
+	fs.StringVar(&o.dhcpEnd, "dhcp-end", "10.0.0.200", "DHCP range end")
+	fs.IntVar(&o.dhcpWork, "dhcp-workers", dhcp.DefaultWorkers, "DHCP packets handled at once, so one slow client doesn't hold up a rack booting together")
+	fs.DurationVar(&o.leaseTime, "lease-time", dhcp.DefaultLeaseTime, "How long DHCP leases run, e.g. 2m on short-lived provisioning networks or 72h in a lab")
+	fs.DurationVar(&o.declHold, "decline-hold", dhcp.DefaultDeclineHold, "How long an address a client declines as in use by another machine is kept out of the DHCP pool")
+	fs.DurationVar(&o.probe, "conflict-probe", 0, "Before offering an address, ping it for this long (e.g. 300ms) and pass over it if a statically configured host answers, by ICMP or ARP (0 = off)")
+	fs.BoolVar(&o.rawSocket, "raw-socket", false, "Send DHCP replies as Ethernet frames to the client's MAC address (AF_PACKET, or BPF on macOS) instead of UDP broadcasts")
+	fs.BoolVar(&o.staticARP, "static-arp", false, "Install a static ARP entry for each address offered, for as long as its lease, for clients slow to answer ARP")
+	fs.BoolVar(&o.proxyDHCP, "proxy-dhcp", false, "Run as a proxyDHCP server next to the network's own DHCP server: answer PXE clients with boot options only, never addresses (-dhcp-start and -dhcp-end unused)")
+	fs.StringVar(&o.dhcpHook, "dhcp-hook", "", "Template deciding on each DHCP request: deny it, or override its boot file and options (see README)")
+	fs.StringVar(&o.tftpRoot, "tftp-root", "./tftp", "TFTP root directory")
+	fs.StringVar(&o.httpRoot, "http-root", "./http", "HTTP root directory")
+	fs.IntVar(&o.httpPort, "http-port", 8080, "HTTP server port")
+	fs.StringVar(&o.bootFile, "boot-file", "bootx64.efi", "PXE boot filename (UEFI)")
+	fs.StringVar(&o.bootARM, "boot-file-arm64", "bootaa64.efi", "PXE boot filename for ARM64 clients (UEFI or U-Boot), e.g. grubaa64.efi")
+	fs.StringVar(&o.allowMACs, "allow-macs", "", "Comma-separated MAC addresses and OUIs (e.g. 52:54:00) of the only clients DHCP answers, such as on a switch shared with production hosts")
+	fs.StringVar(&o.denyMACs, "deny-macs", "", "Comma-separated MAC addresses and OUIs of clients DHCP never answers")
+	fs.StringVar(&o.reserve, "reservations", "", "Fixed DHCP addresses by MAC address, with an optional host name and boot file, e.g. 52:54:00:12:34:56=10.0.0.10=rtr1=ipxe.efi,52:54:00:12:34:57=10.0.0.11")
+	fs.StringVar(&o.relays, "relay-pools", "", "Address pools for routed subnets behind DHCP relay agents, or subnets on other interfaces with @interface, as subnet[@interface]=start-end[=router[=bootfile]], e.g. 10.1.0.0/24=10.1.0.100-10.1.0.200,10.2.0.0/24=10.2.0.100-10.2.0.200=10.2.0.254=undionly.kpxe")
+	fs.StringVar(&o.bootMenu, "boot-menu", "", "Boot menu for BIOS PXE firmware, as label=file items; label= boots from disk, e.g. \"Install Ubuntu=ubuntu/lpxelinux.0,Rescue=rescue.0,Local boot=\"")
+	fs.StringVar(&o.menuMsg, "menu-prompt", dhcp.DefaultMenuPrompt, "Prompt PXE firmware shows before -boot-menu")
+	fs.DurationVar(&o.menuWait, "menu-timeout", dhcp.DefaultMenuTimeout, "How long PXE firmware shows -menu-prompt before booting the first -boot-menu item (at most 255s)")
+	fs.StringVar(&o.bootFiles, "boot-files", "", "Boot files by client architecture, replacing -boot-file and the others, e.g. bios=undionly.kpxe,efi-ia32=ipxe32.efi")
+	fs.StringVar(&o.bootRISCV, "boot-file-riscv64", "bootriscv64.efi", "PXE boot filename for RISC-V 64 UEFI clients, e.g. grubriscv64.efi")
+	fs.StringVar(&o.localBoot, "localboot-file", "", "Boot file offered to hosts that must boot from disk, e.g. outside their profile's windows (none if empty, so firmware moves on to the next boot device)")
+	fs.StringVar(&o.secBoot, "secure-boot-dir", "", "Serve the signed shim and GRUB in <dir>/x64 and <dir>/aa64 to UEFI clients, so they netboot with Secure Boot on")
+	fs.StringVar(&o.natOut, "nat", "", "Enable IP forwarding and NAT PXE clients out through this uplink interface (e.g. en0)")
+	fs.StringVar(&o.dnsDomain, "dns-domain", "", "Serve DNS for hosts and leases under this zone (e.g. pxe.lan) and advertise it via DHCP")
+	fs.StringVar(&o.dnsUp, "dns-upstream", "", "Comma-separated upstream resolvers for names outside -dns-domain (enables the caching forwarder)")
+	fs.BoolVar(&o.dnsBlock, "dns-block-external", false, "Answer NXDOMAIN for names outside -dns-domain instead of forwarding")
+	fs.BoolVar(&o.ntp, "ntp", false, "Serve SNTP from the local clock and advertise it via DHCP option 42")
+	fs.StringVar(&o.gateway, "gateway", "", "Default gateway to advertise via DHCP option 3 (default -ip)")
+	fs.StringVar(&o.dnsAddrs, "dns-servers", "", "Comma-separated resolvers to advertise via DHCP option 6 (default -ip)")
+	fs.StringVar(&o.ntpAddrs, "ntp-servers", "", "Comma-separated NTP servers to advertise via DHCP option 42, instead of -ntp's")
+	fs.StringVar(&o.domName, "domain-name", "", "Domain name to advertise via DHCP option 15 (default -dns-domain)")
+	fs.StringVar(&o.v6Prefix, "ipv6-prefix", "", "Send IPv6 router advertisements for this /64 (e.g. fd00:10::/64) so clients autoconfigure")
+	fs.BoolVar(&o.v6Managed, "ipv6-managed", false, "Set the RA managed flag: clients get their address from DHCPv6")
+	fs.BoolVar(&o.v6Other, "ipv6-other", false, "Set the RA other-config flag: clients get the boot URL and other options from DHCPv6")
+	fs.BoolVar(&o.dhcpv6, "dhcpv6", false, "Answer DHCPv6 with addresses in -ipv6-prefix and the boot file URL, for UEFI IPv6 PXE and HTTP boot (sets the RA managed flag)")
+	fs.StringVar(&o.v6DNS, "ipv6-dns", "", "Comma-separated IPv6 resolvers to advertise in router advertisements (RDNSS)")
+	fs.StringVar(&o.nbdRoot, "nbd-root", "", "Serve the raw/qcow2 images in this directory over NBD (port 10809) for diskless roots")
+	fs.StringVar(&o.iscsiRoot, "iscsi-root", "", "Export the images in this directory as iSCSI targets (port 3260) for iPXE sanboot")
+	fs.BoolVar(&o.iscsiRW, "iscsi-writable", false, "Serve raw -iscsi-root images read-write (qcow2 stays read-only)")
+	fs.StringVar(&o.nfsRoot, "nfs-root", "", "Export this root filesystem directory read-only over NFSv3 (ports 2049 and 111) for nfsroot clients")
+	fs.StringVar(&o.overlays, "overlay-dir", "", "Give each NBD/NFS client a private copy-on-write overlay in this directory, making exports writable")
+	fs.StringVar(&o.mcastRoot, "multicast-root", "", "Multicast the disk images in this directory to receivers started through the API (control port 9000, see cmd/mcast-receive)")
+	fs.BoolVar(&o.syslog, "syslog", false, "Receive installer syslog on port 514 (udp+tcp) and keep it per host for the API")
+	fs.BoolVar(&o.console, "console", false, "Capture serial console output streamed to port 5515 (socat /dev/ttyS0 tcp:<ip>:5515) and keep it per host for the API")
+	fs.BoolVar(&o.netcons, "netconsole", false, "Receive Linux netconsole kernel messages on UDP port 6666, keep them with the host's console output and flag kernel panics in its boot session")
+	fs.BoolVar(&o.inspector, "inspector", false, "Accept ironic-python-agent introspection callbacks on port 5050 (ipa-inspection-callback-url=http://<ip>:5050/v1/continue)")
+	fs.BoolVar(&o.hardware, "hardware", false, "Accept hardware reports (lshw -json, lsblk -J, dmidecode...) POSTed to http://<ip>:<http-port>/hardware/<kind> and keep them per host for the API")
+	fs.BoolVar(&o.attest, "attest", false, "Accept TPM 2.0 quotes and event logs POSTed to http://<ip>:<http-port>/attest, check them against the profiles' PCR values and flag the result on the host")
+	fs.BoolVar(&o.pki, "pki", false, "Issue each inventory host a client certificate once at http://<ip>:<http-port>/pki/client.pem and serve the HTTP root to holders over mutual TLS on -https-port (needs -ca-dir)")
+	fs.IntVar(&o.httpsPort, "https-port", 8443, "Mutual TLS port of the HTTP server with -pki")
+	fs.BoolVar(&o.enroll, "enroll", false, "List machines that boot without a host definition as pending, for approval through the API")
+	fs.StringVar(&o.discovery, "discovery-profile", "", "Profile that machines without a host definition boot, e.g. an inspection ramdisk (default boot file if empty)")
+	fs.BoolVar(&o.mdns, "mdns", false, "Advertise the HTTP root and management API via mDNS/DNS-SD on the PXE interface")
+	fs.StringVar(&o.foreman, "foreman-addr", "", "Listen address for a Foreman smart-proxy API (TFTP and DHCP modules), e.g. :8000 (disabled if empty)")
+	fs.StringVar(&o.fmTrusted, "foreman-trusted", "", "Comma-separated addresses or CIDRs allowed to call -foreman-addr (anyone if empty)")
+	fs.StringVar(&o.defsDir, "defs", "", "Directory of host/profile YAML definitions to reconcile live (hosts/*.yaml, profiles/*.yaml)")
+	fs.StringVar(&o.gitURL, "defs-git", "", "Git repository to poll for definitions (overrides -defs)")
+	fs.StringVar(&o.gitBranch, "defs-git-branch", "main", "Branch of -defs-git to follow")
+	fs.StringVar(&o.gitPath, "defs-git-path", ".", "Definitions directory inside -defs-git")
+	fs.StringVar(&o.gitDir, "defs-git-dir", "./defs-git", "Local clone of -defs-git")
+	fs.StringVar(&o.nbxyz, "netbootxyz", "", "Boot machines without a profile into netboot.xyz: remote (its iPXE builds and hosted menus) or mirror (stock iPXE and its menus copied into the HTTP root)")
+	fs.BoolVar(&o.nbxyzAll, "netbootxyz-assets", false, "With -netbootxyz mirror, also cache the kernels and images the menus boot in the HTTP root as clients ask for them")
+	fs.BoolVar(&o.ipxe, "ipxe", false, "Offer the iPXE builds with an embedded script in <tftp-root>/ipxe/ (see go-pxe ipxe-build) by client architecture")
+	fs.DurationVar(&o.bootToken, "boot-token", 0, "Require a provisioning token, valid this long after it is issued in the kernel command line ({{ .Token }}), for rendered templates over HTTP (0 disables)")
+	fs.StringVar(&o.domainsFile, "domains", "", "YAML file defining several isolated provisioning domains (replaces the per-domain flags above)")
+	fs.StringVar(&o.apiAddr, "api-addr", "", "Listen address for the management API, e.g. 127.0.0.1:9090 (disabled if empty)")
+	fs.StringVar(&o.metricsAddr, "metrics-addr", "", "Listen address for the Prometheus /metrics endpoint, e.g. :9100 (disabled if empty)")
+	fs.StringVar(&o.otlp, "otlp-endpoint", os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"), "OTLP/HTTP collector to export per-boot traces to, e.g. http://localhost:4318 (headers from OTEL_EXPORTER_OTLP_HEADERS)")
+	fs.StringVar(&o.apiUsers, "api-users", "", "YAML file of API users, tokens, roles and OIDC/LDAP providers (the API is open to anyone if unset)")
+	fs.StringVar(&o.auditLog, "audit-log", "", "Append-only JSON-lines file recording every API and definitions change")
+	fs.StringVar(&o.vaultAddr, "vault-addr", os.Getenv("VAULT_ADDR"), "Vault server resolving {{ vault }} secrets in HTTP templates (token from VAULT_TOKEN)")
+	fs.StringVar(&o.vaultRole, "vault-role-id", os.Getenv("VAULT_ROLE_ID"), "Log in to Vault with this AppRole role ID (secret ID from VAULT_SECRET_ID) instead of a token")
+	fs.StringVar(&o.vaultMount, "vault-approle-mount", "approle", "Mount path of the Vault AppRole auth method")
+	fs.StringVar(&o.caDir, "ca-dir", "", "Directory holding the provisioning CA (ca.crt, ca.key), created on first start")
+	fs.StringVar(&o.sshKeyDir, "ssh-key-dir", "", "Directory of pre-generated SSH host keys per domain and host, for {{ sshHostKey }} in templates and the API's known_hosts")
+	fs.StringVar(&o.ociCache, "oci-cache", "./oci-cache", "Cache directory for profile artifacts pulled from OCI registries (logins from ~/.docker/config.json)")
+	fs.StringVar(&o.ociPlain, "oci-plain-http", "", "Comma-separated registries (host:port) to pull from over plain HTTP")
+	fs.StringVar(&o.fetchRate, "fetch-rate", "", "Cap the bandwidth of all asset downloads together, e.g. 20M (bytes per second; unlimited if empty)")
+	fs.IntVar(&o.qosXfers, "qos-transfers", 0, "Cap each client's TFTP and HTTP transfers in flight together, so one client can't take the server over (0 is unlimited)")
+	fs.StringVar(&o.qosRate, "qos-rate", "", "Cap each client's bandwidth across TFTP and HTTP together, e.g. 50M (bytes per second; unlimited if empty)")
+	fs.StringVar(&o.memBudget, "memory-budget", "", "Memory for the whole server, e.g. 512M on an edge box or 16G on a large server; the sizes below default from it, and the Go runtime collects garbage harder near it (unlimited if empty)")
+	fs.StringVar(&o.memCache, "file-cache", "", "Memory for the files sent over TFTP, kept for their next transfers (default 64M, or a quarter of -memory-budget)")
+	fs.StringVar(&o.memMaxFile, "max-memory-file", "", "Largest file read into memory whole for TFTP; larger ones are streamed from disk (default 16M, or a 32nd of -memory-budget)")
+	fs.StringVar(&o.memBuffer, "transfer-buffer", "", "Read-ahead buffer of each TFTP transfer streamed from disk (default 64K, or from -memory-budget)")
+	fs.StringVar(&o.protoMode, "protocol-mode", "compat", "DHCP and TFTP behavior: compat tolerates the quirks of old and broken boot ROMs, strict keeps to the RFCs; either logs each quirk seen")
+	fs.IntVar(&o.fetchChunks, "fetch-chunks", 4, "Parallel ranged requests per large asset download")
+	fs.StringVar(&o.fetchVerify, "fetch-verify", fetch.Unverified, "Least verification a downloaded boot file needs to be kept: unverified (anything no checksum contradicts), checksum (listed in a SHA256SUMS or CHECKSUM file beside it) or signed (in a list signed by a key in -fetch-keyring)")
+	fs.StringVar(&o.fetchKeys, "fetch-keyring", "", "gpgv keyring, e.g. from gpg --export, to check the signatures of checksum lists against")
+	fs.StringVar(&o.catalog, "asset-catalog", "./assets.json", "JSON file recording where each downloaded boot file came from and how it was verified")
+	fs.StringVar(&o.leaseDir, "lease-dir", "", "Directory keeping each domain's DHCP leases (<domain>.json), so clients keep their addresses across restarts")
+	fs.StringVar(&o.bootLog, "boot-log", "", "Directory for the persistent boot history: one append-only JSON-lines file per day")
+	fs.DurationVar(&o.bootLogKeep, "boot-log-retention", 0, "Delete boot history older than this, e.g. 2160h for 90 days (0 keeps all)")
+	fs.StringVar(&o.backupDir, "backup-dir", "", "Directory for scheduled state snapshots (leases, hosts, boot history, installer logs, consoles, hardware reports, attestations, certificates, pending hosts)")
+	fs.StringVar(&o.backupS3, "backup-s3", "", "Also upload snapshots to s3://bucket/prefix (credentials from AWS_* env)")
+	fs.DurationVar(&o.backupInterval, "backup-interval", time.Hour, "Time between state snapshots")
+	fs.IntVar(&o.backupKeep, "backup-keep", 48, "Local snapshots to retain (0 keeps all)")
+	fs.BoolVar(&o.auto, "auto", false, "Zero-config: pick an unused private /24, assign it to -iface and derive -ip and the DHCP range")
+}
+
+// defaultDomain builds the single domain described by the command-line flags
+func (o *options) defaultDomain() domainConfig {
+	cfg := domainConfig{
+		Name:       "default",
+		Iface:      o.iface,
+		VLAN:       o.vlan,
+		IP:         o.serverIP,
+		DHCPStart:  o.dhcpStart,
+		DHCPEnd:    o.dhcpEnd,
+		TFTPRoot:   o.tftpRoot,
+		HTTPRoot:   o.httpRoot,
+		HTTPPort:   o.httpPort,
+		BootFile:   o.bootFile,
+		LocalBoot:  o.localBoot,
+		SecureBoot: o.secBoot,
+		NAT:        o.natOut,
+		DNSDomain:  o.dnsDomain,
+		DomainName: o.domName,
+		Gateway:    o.gateway,
+		Defs:       o.defsDir,
+
+		DNSBlockExternal: o.dnsBlock,
+		NTP:              o.ntp,
+		IPv6Prefix:       o.v6Prefix,
+		IPv6Managed:      o.v6Managed,
+		IPv6Other:        o.v6Other,
+		DHCPv6:           o.dhcpv6,
+		NBDRoot:          o.nbdRoot,
+		ISCSIRoot:        o.iscsiRoot,
+		ISCSIWritable:    o.iscsiRW,
+		NFSRoot:          o.nfsRoot,
+		OverlayDir:       o.overlays,
+		MulticastRoot:    o.mcastRoot,
+		Syslog:           o.syslog,
+		Console:          o.console,
+		Netconsole:       o.netcons,
+		MDNS:             o.mdns,
+		Inspector:        o.inspector,
+		Hardware:         o.hardware,
+		Attest:           o.attest,
+		PKI:              o.pki,
+		HTTPSPort:        o.httpsPort,
+		Enroll:           o.enroll,
+		Discovery:        o.discovery,
+		ForemanAddr:      o.foreman,
+		VLANCreate:       o.vlanNew,
+		NetbootXYZ:       o.nbxyz,
+		NetbootXYZAssets: o.nbxyzAll,
+		IPXE:             o.ipxe,
+		BootToken:        o.bootToken,
+		DHCPWorkers:      o.dhcpWork,
+		DHCPHook:         o.dhcpHook,
+		StaticARP:        o.staticARP,
+		RawSocket:        o.rawSocket,
+		DeclineHold:      o.declHold,
+		ConflictProbe:    o.probe,
+		LeaseTime:        o.leaseTime,
+		MenuPrompt:       o.menuMsg,
+		MenuTimeout:      o.menuWait,
+		ProxyDHCP:        o.proxyDHCP,
+		BootFileARM64:    o.bootARM,
+		BootFileRISCV64:  o.bootRISCV,
+	}
+	if o.dnsUp != "" {
+		cfg.DNSUpstreams = strings.Split(o.dnsUp, ",")
+	}
+	if o.v6DNS != "" {
+		cfg.IPv6DNS = strings.Split(o.v6DNS, ",")
+	}
+	if o.dnsAddrs != "" {
+		cfg.DNSServers = strings.Split(o.dnsAddrs, ",")
+	}
+	if o.ntpAddrs != "" {
+		cfg.NTPServers = strings.Split(o.ntpAddrs, ",")
+	}
+	if o.allowMACs != "" {
+		cfg.AllowMACs = strings.Split(o.allowMACs, ",")
+	}
+	if o.denyMACs != "" {
+		cfg.DenyMACs = strings.Split(o.denyMACs, ",")
+	}
+	if o.fmTrusted != "" {
+		cfg.ForemanTrusted = strings.Split(o.fmTrusted, ",")
+	}
+	cfg.DefsGit.URL = o.gitURL
+	cfg.DefsGit.Branch = o.gitBranch
+	cfg.DefsGit.Path = o.gitPath
+	cfg.DefsGit.Dir = o.gitDir
+	return cfg
+}
+
+// memorySizes are the memory sizes the flags set, the others defaulting
+// from -memory-budget
+func (o *options) memorySizes() (memory.Sizes, error) {
+	var budget int64
+	if o.memBudget != "" {
+		var err error
+		if budget, err = memory.ParseSize(o.memBudget); err != nil {
+			return memory.Sizes{}, fmt.Errorf("-memory-budget: %w", err)
+		}
+	}
+	sizes := memory.Defaults(budget)
+	for _, f := range []struct {
+		flag, value string
+		size        *int64
+	}{
+		{"-file-cache", o.memCache, &sizes.Cache},
+		{"-max-memory-file", o.memMaxFile, &sizes.MaxFile},
+	} {
+		if f.value == "" {
+			continue
+		}
+		n, err := memory.ParseSize(f.value)
+		if err != nil {
+			return sizes, fmt.Errorf("%s: %w", f.flag, err)
+		}
+		*f.size = n
+	}
+	if o.memBuffer != "" {
+		n, err := memory.ParseSize(o.memBuffer)
+		if err != nil {
+			return sizes, fmt.Errorf("-transfer-buffer: %w", err)
+		}
+		sizes.Buffer = int(n)
+	}
+	return sizes, sizes.Check()
+}
+
 func main() {
-	iface := flag.String("iface", "en7", "Network interface to listen on")
-	serverIP := flag.String("ip", "10.0.0.1", "Server IP address on the PXE interface")
-	dhcpStart := flag.String("dhcp-start", "10.0.0.100", "DHCP range start")
-	dhcpEnd := flag.String("dhcp-end", "10.0.0.200", "DHCP range end")
-	tftpRoot := flag.String("tftp-root", "./tftp", "TFTP root directory")
-	httpRoot := flag.String("http-root", "./http", "HTTP root directory")
-	httpPort := flag.Int("http-port", 8080, "HTTP server port")
-	bootFile := flag.String("boot-file", "bootx64.efi", "PXE boot filename (UEFI)")
-	flag.Parse()
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "test-vm":
+			runTestVM(os.Args[2:])
+			return
+		case "restore":
+			runRestore(os.Args[2:])
+			return
+		case "top":
+			runTop(os.Args[2:])
+			return
+		case "discover":
+			runDiscover(os.Args[2:])
+			return
+		case "power":
+			runPower(os.Args[2:])
+			return
+		case "reinstall":
+			runReinstall(os.Args[2:])
+			return
+		case "gc":
+			runGC(os.Args[2:])
+			return
+		case "record":
+			runRecord(os.Args[2:])
+			return
+		case "export":
+			runExport(os.Args[2:])
+			return
+		case "report":
+			runReport(os.Args[2:])
+			return
+		case "assets":
+			runAssets(os.Args[2:])
+			return
+		case "import-iso":
+			runImportISO(os.Args[2:])
+			return
+		case "ipxe-build":
+			runIPXEBuild(os.Args[2:])
+			return
+		}
+	}
 
-	fmt.Println("=== Go PXE Boot Server ===")
-	fmt.Printf("Interface:  %s\n", *iface)
-	fmt.Printf("Server IP:  %s\n", *serverIP)
-	fmt.Printf("DHCP Range: %s - %s\n", *dhcpStart, *dhcpEnd)
-	fmt.Printf("TFTP Root:  %s\n", *tftpRoot)
-	fmt.Printf("HTTP Root:  %s\n", *httpRoot)
-	fmt.Printf("Boot File:  %s\n", *bootFile)
-	fmt.Println()
+	var opts options
+	opts.register(flag.CommandLine)
+	flag.Parse()
+	serve(&opts)
+}
 
-	// Validate interface
-	ifi, err := net.InterfaceByName(*iface)
+// serve runs all services until SIGINT/SIGTERM
+func serve(opts *options) {
+	_, cleanup, err := startServices(opts, events.NewBus())
 	if err != nil {
-		log.Fatalf("Interface %s not found: %v", *iface, err)
-	}
-	fmt.Printf("Interface %s MAC: %s\n", ifi.Name, ifi.HardwareAddr)
-
-	// Create directories if needed
-	os.MkdirAll(*tftpRoot, 0755)
-	os.MkdirAll(*httpRoot, 0755)
-
-	// Start DHCP server
-	dhcpSrv := dhcp.NewServer(dhcp.Config{
-		Interface:  *iface,
-		ServerIP:   net.ParseIP(*serverIP),
-		RangeStart: net.ParseIP(*dhcpStart),
-		RangeEnd:   net.ParseIP(*dhcpEnd),
-		SubnetMask: net.IPv4Mask(255, 255, 255, 0),
-		BootFile:   *bootFile,
-		TFTPServer: *serverIP,
-	})
-	go func() {
-		if err := dhcpSrv.ListenAndServe(); err != nil {
-			log.Fatalf("DHCP server error: %v", err)
-		}
-	}()
-
-	// Start TFTP server
-	tftpSrv := tftp.NewServer(*tftpRoot)
-	go func() {
-		if err := tftpSrv.ListenAndServe(":69"); err != nil {
-			log.Fatalf("TFTP server error: %v", err)
-		}
-	}()
-
-	// Start HTTP server
-	go func() {
-		addr := fmt.Sprintf(":%d", *httpPort)
-		if err := httpserver.ListenAndServe(addr, *httpRoot); err != nil {
-			log.Fatalf("HTTP server error: %v", err)
-		}
-	}()
+		cleanup()
+		log.Fatal(err)
+	}
+	defer cleanup()
 
 	fmt.Println()
 	fmt.Println("All services started. Waiting for PXE clients...")
@@ -87,3 +471,314 @@ func main() {
 	<-sig
 	fmt.Println("\nShutting down.")
 }
+
+// startServices starts every configured domain plus the shared management
+// API and backups in the background, publishing service events to bus. The
+// running domains are returned; cleanup undoes any host configuration
+// made along the way and is always safe to call.
+func startServices(opts *options, bus *events.Bus) (domains []*domain, cleanup func(), err error) {
+	var undo []func()
+	cleanup = func() {
+		for i := len(undo) - 1; i >= 0; i-- {
+			undo[i]()
+		}
+	}
+
+	var configs []domainConfig
+	if opts.domainsFile != "" {
+		if opts.auto {
+			return nil, cleanup, fmt.Errorf("-auto cannot be combined with -domains")
+		}
+		if configs, err = loadDomains(opts.domainsFile); err != nil {
+			return nil, cleanup, err
+		}
+	} else {
+		if opts.auto {
+			if opts.vlan != 0 {
+				return nil, cleanup, fmt.Errorf("-auto cannot be combined with -vlan")
+			}
+			c, err := autoConfigure(opts)
+			if err != nil {
+				return nil, cleanup, fmt.Errorf("zero-config: %w", err)
+			}
+			undo = append(undo, c)
+		}
+		cfg := opts.defaultDomain()
+		if cfg.BootFiles, err = parseBootFiles(opts.bootFiles); err != nil {
+			return nil, cleanup, fmt.Errorf("-boot-files: %w", err)
+		}
+		if err := cfg.checkNetOptions(); err != nil {
+			return nil, cleanup, err
+		}
+		if err := cfg.checkMACFilters(); err != nil {
+			return nil, cleanup, err
+		}
+		if cfg.RelayPools, err = parseRelayPools(opts.relays); err != nil {
+			return nil, cleanup, fmt.Errorf("-relay-pools: %w", err)
+		}
+		if cfg.Reservations, err = parseReservations(opts.reserve); err != nil {
+			return nil, cleanup, fmt.Errorf("-reservations: %w", err)
+		}
+		if cfg.BootMenu, err = parseBootMenu(opts.bootMenu); err == nil {
+			err = cfg.checkBootMenu()
+		}
+		if err != nil {
+			return nil, cleanup, fmt.Errorf("-boot-menu: %w", err)
+		}
+		configs = []domainConfig{cfg}
+	}
+
+	var auditLog *audit.Log
+	if opts.auditLog != "" {
+		if auditLog, err = audit.Open(opts.auditLog); err != nil {
+			return nil, cleanup, err
+		}
+	}
+
+	var vaultClient *vault.Client
+	if opts.vaultAddr != "" {
+		vaultClient = vault.New(opts.vaultAddr)
+		vaultClient.Token, vaultClient.Namespace = os.Getenv("VAULT_TOKEN"), os.Getenv("VAULT_NAMESPACE")
+		vaultClient.RoleID, vaultClient.SecretID, vaultClient.Mount = opts.vaultRole, os.Getenv("VAULT_SECRET_ID"), opts.vaultMount
+		if vaultClient.Token == "" && vaultClient.RoleID == "" {
+			return nil, cleanup, fmt.Errorf("-vault-addr needs VAULT_TOKEN or -vault-role-id")
+		}
+	}
+
+	var ca *pki.CA
+	if opts.caDir != "" {
+		if ca, err = pki.LoadCA(opts.caDir); err != nil {
+			return nil, cleanup, err
+		}
+		log.Printf("[PKI] Provisioning CA %s (%s)", opts.caDir, ca.Fingerprint())
+	}
+
+	fetch.Default.Chunks = opts.fetchChunks
+	if opts.fetchRate != "" {
+		rate, err := fetch.ParseRate(opts.fetchRate)
+		if err != nil {
+			return nil, cleanup, fmt.Errorf("-fetch-rate: %w", err)
+		}
+		fetch.Default.Limiter = fetch.NewLimiter(rate)
+	}
+	fetch.Default.Require, fetch.Default.Keyring = opts.fetchVerify, opts.fetchKeys
+	if err := checkVerify(); err != nil {
+		return nil, cleanup, err
+	}
+	catalog, err := assets.OpenCatalog(opts.catalog)
+	if err != nil {
+		return nil, cleanup, fmt.Errorf("-asset-catalog: %w", err)
+	}
+	fetch.Default.Catalog = catalog
+
+	ociClient := oci.NewClient(opts.ociCache)
+	if opts.ociPlain != "" {
+		ociClient.PlainHTTP = strings.Split(opts.ociPlain, ",")
+	}
+	if creds, err := oci.DockerCredentials(dockerConfig()); err == nil {
+		ociClient.Credentials = creds
+	} else if !os.IsNotExist(err) {
+		return nil, cleanup, err
+	}
+
+	var shaper *qos.Shaper
+	if opts.qosXfers > 0 || opts.qosRate != "" {
+		limits := qos.Limits{Transfers: opts.qosXfers}
+		if opts.qosRate != "" {
+			if limits.Rate, err = fetch.ParseRate(opts.qosRate); err != nil {
+				return nil, cleanup, fmt.Errorf("-qos-rate: %w", err)
+			}
+		}
+		shaper = qos.NewShaper(limits)
+	}
+
+	if quirks.Default, err = quirks.ParseMode(opts.protoMode); err != nil {
+		return nil, cleanup, fmt.Errorf("-protocol-mode: %w", err)
+	}
+	sizes, err := opts.memorySizes()
+	if err != nil {
+		return nil, cleanup, err
+	}
+	sizes.Apply()
+	if sizes.Budget > 0 {
+		log.Printf("[MEM] Budget %d MiB: %d MiB file cache, files up to %d MiB in memory, %d KiB transfer buffers",
+			sizes.Budget>>20, sizes.Cache>>20, sizes.MaxFile>>20, sizes.Buffer>>10)
+	}
+	files := memory.NewFiles(sizes)
+
+	fmt.Println("=== Go PXE Boot Server ===")
+	if opts.leaseDir != "" {
+		if err := os.MkdirAll(opts.leaseDir, 0o755); err != nil {
+			return nil, cleanup, fmt.Errorf("-lease-dir: %w", err)
+		}
+	}
+	for _, cfg := range configs {
+		if cfg.LeaseFile == "" && opts.leaseDir != "" {
+			cfg.LeaseFile = filepath.Join(opts.leaseDir, cfg.Name+".json")
+		}
+		d := newDomain(cfg, bus)
+		if cfg.LeaseFile != "" {
+			if err := d.dhcp.LoadLeaseFile(); err != nil {
+				return nil, cleanup, fmt.Errorf("domain %s: leases: %w", cfg.Name, err)
+			}
+			undo = append(undo, func() {
+				if err := d.dhcp.SaveLeases(); err != nil {
+					log.Printf("[DHCP] %s: saving leases: %v", cfg.Name, err)
+				}
+			})
+		}
+		d.audit = auditLog
+		d.vault = vaultClient
+		d.oci = ociClient
+		d.ca = ca
+		d.index.Catalog = catalog
+		d.qos = shaper
+		d.files = files
+		if d.hook != nil {
+			if err := d.hook.Load(); err != nil {
+				return nil, cleanup, fmt.Errorf("domain %s: DHCP hook: %w", cfg.Name, err)
+			}
+		}
+		if opts.sshKeyDir != "" {
+			d.hostKeys = sshkeys.NewStore(filepath.Join(opts.sshKeyDir, cfg.Name))
+		}
+		d.printConfig()
+		domains = append(domains, d)
+	}
+
+	// Recordings keep the log lines about the machines they record
+	logs := []io.Writer{os.Stderr}
+	for _, d := range domains {
+		logs = append(logs, d.recorder)
+	}
+	log.SetOutput(io.MultiWriter(logs...))
+
+	history := events.NewHistory(historySize)
+	history.Follow(bus)
+
+	tracker := sessions.NewTracker()
+	tracker.Plan = func(name string, mac net.HardwareAddr) sessions.Plan {
+		for _, d := range domains {
+			if d.cfg.Name == name {
+				return d.bootPlan(mac)
+			}
+		}
+		return sessions.Plan{}
+	}
+	tracker.Booted = func(s sessions.Session) {
+		for _, d := range domains {
+			if d.cfg.Name == s.Domain {
+				d.booted(s)
+			}
+		}
+	}
+	tracker.Follow(bus)
+	for _, d := range domains {
+		d.sessions = tracker
+	}
+
+	var bootLog *bootlog.Log
+	if opts.bootLog != "" {
+		if bootLog, err = bootlog.Open(opts.bootLog, opts.bootLogKeep); err != nil {
+			return nil, cleanup, err
+		}
+		tracker.Finished = func(s sessions.Session) { bootLog.Add(bootlog.FromSession(s)) }
+		undo = append(undo, bootLog.Close, tracker.Close)
+	}
+
+	if opts.otlp != "" {
+		tracer := tracing.NewTracer(opts.otlp, tracing.ParseHeaders(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS")))
+		tracer.Follow(bus)
+		undo = append(undo, tracer.Close)
+		log.Printf("[TRACE] Exporting boot traces to %s", opts.otlp)
+	}
+
+	if opts.restoreFrom != "" {
+		if err := restoreSnapshot(opts.restoreFrom, domains, history); err != nil {
+			return nil, cleanup, fmt.Errorf("restore: %w", err)
+		}
+	}
+
+	if opts.apiAddr != "" {
+		host, port, err := net.SplitHostPort(opts.apiAddr)
+		if err != nil {
+			return nil, cleanup, fmt.Errorf("-api-addr: %w", err)
+		}
+		p, _ := strconv.Atoi(port)
+		for _, d := range domains {
+			if ip := net.ParseIP(host); host == "" || ip.IsUnspecified() || ip.Equal(net.ParseIP(d.cfg.IP)) {
+				d.apiPort = p
+			}
+		}
+	}
+
+	for _, d := range domains {
+		if err := d.start(len(domains) > 1, &undo); err != nil {
+			return nil, cleanup, fmt.Errorf("domain %s: %w", d.cfg.Name, err)
+		}
+	}
+
+	if opts.backupDir != "" || opts.backupS3 != "" {
+		sched, err := newBackupScheduler(opts, domains, history)
+		if err != nil {
+			return nil, cleanup, fmt.Errorf("backup: %w", err)
+		}
+		go sched.Run()
+	}
+
+	if opts.metricsAddr != "" {
+		go func() {
+			if err := metrics.Default.ListenAndServe(opts.metricsAddr); err != nil {
+				log.Fatalf("Metrics server error: %v", err)
+			}
+		}()
+	}
+
+	if opts.apiAddr != "" {
+		var apiDomains []*api.Domain
+		for _, d := range domains {
+			apiDomains = append(apiDomains, &api.Domain{Name: d.cfg.Name, Store: d.store, Leases: d.leases, Revoke: d.revoke, Logs: d.logs,
+				Sessions: tracker, Transfers: d.transfers, Inspections: d.inspected, Hardware: d.hardware, Pending: d.pending, Consoles: d.consoles, Attestation: d.attested,
+				Certificates: d.certs, HostKeys: d.hostKeys, DNSDomain: d.cfg.DNSDomain, Multicast: d.multicast,
+				Clusters: d.clusters, GC: d.collect, Assets: d.listAssets, AssetIndex: d.index.Status, Recordings: d.recorder})
+		}
+		var auth *api.Auth
+		if opts.apiUsers != "" {
+			if auth, err = api.LoadAuth(opts.apiUsers); err != nil {
+				return nil, cleanup, err
+			}
+		}
+		apiSrv := api.NewServer(apiDomains, auth)
+		apiSrv.Audit = auditLog
+		apiSrv.Boots = bootLog
+		apiSrv.History = history
+		apiSrv.CA = ca
+		go func() {
+			if err := apiSrv.ListenAndServe(opts.apiAddr); err != nil {
+				log.Fatalf("API server error: %v", err)
+			}
+		}()
+	}
+
+	return domains, cleanup, nil
+}
+
+// checkVerify checks the verification the fetcher is set to require
+func checkVerify() error {
+	switch {
+	case !slices.Contains(fetch.Levels, fetch.Default.Require):
+		return fmt.Errorf("-fetch-verify %q is none of %s", fetch.Default.Require, strings.Join(fetch.Levels, ", "))
+	case fetch.Default.Require == fetch.Signed && fetch.Default.Keyring == "":
+		return fmt.Errorf("-fetch-verify %s needs -fetch-keyring", fetch.Signed)
+	}
+	return nil
+}
+
+// dockerConfig is the Docker client config file holding registry logins
+func dockerConfig() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return filepath.Join(dir, "config.json")
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".docker", "config.json")
+}
@@ -0,0 +1,159 @@
+package mcast
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// Packets start with a magic, a type and the transfer ID (0 in joins)
+const (
+	magic      = "GPXM"
+	headerSize = 9
+
+	msgJoin     = 1 // receiver: name of the image wanted
+	msgAnnounce = 2 // sender: group, port, size and block size of the transfer
+	msgData     = 3 // sender: block index and payload
+	msgRound    = 4 // sender: end of a pass, receivers report what they miss
+	msgNak      = 5 // receiver: round, blocks held, missing ranges
+	msgDone     = 6 // receiver: round, has every block
+	msgEnd      = 7 // sender: transfer over
+	msgReject   = 8 // sender: why a join was refused
+
+	// BlockSize keeps data packets within a 1500-byte MTU
+	BlockSize = 1400
+
+	// maxRanges bounds a NAK; the rest are reported next round
+	maxRanges = 160
+
+	// maxSize is the largest image whose blocks a uint32 can number
+	maxSize = BlockSize * (1<<32 - 1)
+)
+
+var errShort = errors.New("short packet")
+
+type packet struct {
+	typ  byte
+	id   uint32
+	body []byte
+}
+
+func parse(b []byte) (packet, error) {
+	if len(b) < headerSize || string(b[:4]) != magic {
+		return packet{}, errShort
+	}
+	return packet{typ: b[4], id: binary.BigEndian.Uint32(b[5:9]), body: b[headerSize:]}, nil
+}
+
+func header(typ byte, id uint32, size int) []byte {
+	b := make([]byte, headerSize, headerSize+size)
+	copy(b, magic)
+	b[4] = typ
+	binary.BigEndian.PutUint32(b[5:], id)
+	return b
+}
+
+// announcement describes a transfer to a receiver that joined it
+type announcement struct {
+	group net.IP
+	port  int
+	size  int64
+	name  string
+}
+
+func (a announcement) marshal(id uint32) []byte {
+	b := header(msgAnnounce, id, 16+len(a.name))
+	b = append(b, a.group.To4()...)
+	b = binary.BigEndian.AppendUint16(b, uint16(a.port))
+	b = binary.BigEndian.AppendUint64(b, uint64(a.size))
+	b = binary.BigEndian.AppendUint16(b, BlockSize)
+	return append(b, a.name...)
+}
+
+func parseAnnouncement(body []byte) (announcement, error) {
+	if len(body) < 16 {
+		return announcement{}, errShort
+	}
+	if bs := binary.BigEndian.Uint16(body[14:16]); bs != BlockSize {
+		return announcement{}, errors.New("sender uses a different block size")
+	}
+	size := binary.BigEndian.Uint64(body[6:14])
+	if size == 0 || size > maxSize { // the server sends no empty images
+		return announcement{}, fmt.Errorf("announced size %d is out of range", size)
+	}
+	return announcement{
+		group: net.IP(append([]byte(nil), body[:4]...)),
+		port:  int(binary.BigEndian.Uint16(body[4:6])),
+		size:  int64(size),
+		name:  string(body[16:]),
+	}, nil
+}
+
+// span is a run of blocks
+type span struct {
+	start, count uint32
+}
+
+func marshalNak(id, round, held uint32, missing []span) []byte {
+	b := header(msgNak, id, 8+8*len(missing))
+	b = binary.BigEndian.AppendUint32(b, round)
+	b = binary.BigEndian.AppendUint32(b, held)
+	for _, s := range missing {
+		b = binary.BigEndian.AppendUint32(b, s.start)
+		b = binary.BigEndian.AppendUint32(b, s.count)
+	}
+	return b
+}
+
+func parseNak(body []byte) (round, held uint32, missing []span, err error) {
+	if len(body) < 8 || (len(body)-8)%8 != 0 {
+		return 0, 0, nil, errShort
+	}
+	round, held = binary.BigEndian.Uint32(body), binary.BigEndian.Uint32(body[4:])
+	for b := body[8:]; len(b) > 0; b = b[8:] {
+		missing = append(missing, span{binary.BigEndian.Uint32(b), binary.BigEndian.Uint32(b[4:])})
+	}
+	return round, held, missing, nil
+}
+
+// bitset tracks blocks
+type bitset []uint64
+
+func newBitset(n uint32) bitset {
+	return make(bitset, (n+63)/64)
+}
+
+func (b bitset) has(i uint32) bool { return b[i/64]&(1<<(i%64)) != 0 }
+func (b bitset) set(i uint32)      { b[i/64] |= 1 << (i % 64) }
+
+func (b bitset) empty() bool {
+	for _, w := range b {
+		if w != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// spans lists the runs of blocks below n that are not set, at most limit
+func (b bitset) spans(n uint32, limit int) []span {
+	var out []span
+	for i := uint32(0); i < n && len(out) < limit; i++ {
+		if b.has(i) {
+			continue
+		}
+		s := span{start: i}
+		for i < n && !b.has(i) {
+			i++
+		}
+		s.count = i - s.start
+		out = append(out, s)
+	}
+	return out
+}
+
+// blocks is how many blocks an image of size bytes takes
+func blocks(size int64) uint32 {
+	return uint32((size + BlockSize - 1) / BlockSize)
+}
@@ -0,0 +1,117 @@
+package mcast
+
+import (
+	"encoding/binary"
+	"net"
+	"slices"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		b       []byte
+		wantErr bool
+	}{
+		{"header only", header(msgEnd, 7, 0), false},
+		{"with body", append(header(msgJoin, 0, 3), "img"...), false},
+		{"short", header(msgEnd, 7, 0)[:8], true},
+		{"bad magic", append([]byte("XPXM"), header(msgEnd, 7, 0)[4:]...), true},
+		{"empty", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := parse(tt.b)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && (p.typ != tt.b[4] || p.id != binary.BigEndian.Uint32(tt.b[5:]) || len(p.body) != len(tt.b)-headerSize) {
+				t.Errorf("parsed %+v", p)
+			}
+		})
+	}
+}
+
+func TestAnnouncement(t *testing.T) {
+	a := announcement{group: net.IPv4(239, 255, 90, 2).To4(), port: DataPort, size: 1 << 33, name: "images/ubuntu.img"}
+	p, err := parse(a.marshal(9))
+	if err != nil || p.typ != msgAnnounce || p.id != 9 {
+		t.Fatalf("parse = %+v, %v", p, err)
+	}
+	got, err := parseAnnouncement(p.body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.group.Equal(a.group) || got.port != a.port || got.size != a.size || got.name != a.name {
+		t.Errorf("announcement %+v, want %+v", got, a)
+	}
+
+	for n := range 16 {
+		if _, err := parseAnnouncement(p.body[:n]); err == nil {
+			t.Errorf("parsed %d bytes", n)
+		}
+	}
+	body := slices.Clone(p.body)
+	binary.BigEndian.PutUint16(body[14:], 512)
+	if _, err := parseAnnouncement(body); err == nil {
+		t.Error("accepted another block size")
+	}
+	for _, size := range []uint64{0, maxSize + 1, 1 << 63, 1<<64 - 1} {
+		binary.BigEndian.PutUint64(body[6:], size)
+		binary.BigEndian.PutUint16(body[14:], BlockSize)
+		if _, err := parseAnnouncement(body); err == nil {
+			t.Errorf("accepted size %d", size)
+		}
+	}
+}
+
+func TestNak(t *testing.T) {
+	missing := []span{{0, 3}, {10, 1}}
+	p, err := parse(marshalNak(4, 2, 100, missing))
+	if err != nil || p.typ != msgNak || p.id != 4 {
+		t.Fatalf("parse = %+v, %v", p, err)
+	}
+	round, held, got, err := parseNak(p.body)
+	if err != nil || round != 2 || held != 100 || !slices.Equal(got, missing) {
+		t.Errorf("parseNak = %d, %d, %v, %v", round, held, got, err)
+	}
+	if _, _, got, err := parseNak(p.body[:8]); err != nil || len(got) != 0 {
+		t.Errorf("NAK without ranges = %v, %v", got, err)
+	}
+	for _, n := range []int{0, 4, 7, 12, 23} {
+		if _, _, _, err := parseNak(p.body[:n]); err == nil {
+			t.Errorf("parsed %d bytes", n)
+		}
+	}
+}
+
+func TestBitset(t *testing.T) {
+	b := newBitset(130)
+	if len(b) != 3 || !b.empty() {
+		t.Fatalf("new bitset %v", b)
+	}
+	for _, i := range []uint32{0, 1, 5, 63, 64, 129} {
+		b.set(i)
+	}
+	if b.empty() || !b.has(63) || !b.has(64) || b.has(62) || b.has(128) {
+		t.Errorf("bitset %x", b)
+	}
+	want := []span{{2, 3}, {6, 57}, {65, 64}}
+	if got := b.spans(130, maxRanges); !slices.Equal(got, want) {
+		t.Errorf("spans = %v, want %v", got, want)
+	}
+	if got := b.spans(130, 2); !slices.Equal(got, want[:2]) {
+		t.Errorf("spans limited to 2 = %v", got)
+	}
+	if got := b.spans(4, maxRanges); !slices.Equal(got, []span{{2, 2}}) {
+		t.Errorf("spans below 4 = %v", got)
+	}
+}
+
+func TestBlocks(t *testing.T) {
+	for size, want := range map[int64]uint32{1: 1, BlockSize: 1, BlockSize + 1: 2, 10 * BlockSize: 10, maxSize: 1<<32 - 1} {
+		if got := blocks(size); got != want {
+			t.Errorf("blocks(%d) = %d, want %d", size, got, want)
+		}
+	}
+}
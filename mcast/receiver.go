@@ -0,0 +1,123 @@
+package mcast
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// Receive asks the server at addr (host:port of its control port) for
+// image, waiting up to wait for a transfer of it to be scheduled, and
+// writes the image to out. ifi, if set, is the interface to receive
+// multicast on. progress, if set, is called with the bytes held after
+// every round.
+func Receive(addr, image string, out io.WriterAt, ifi *net.Interface, wait time.Duration, progress func(held, size int64)) error {
+	server, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return err
+	}
+	ctl, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return err
+	}
+	defer ctl.Close()
+
+	// Join until the server announces the transfer
+	join := append(header(msgJoin, 0, len(image)), image...)
+	var id uint32
+	var a announcement
+	deadline := time.Now().Add(wait)
+	buf := make([]byte, 2048)
+	for id == 0 {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("no transfer of %s announced within %s", image, wait)
+		}
+		ctl.WriteToUDP(join, server)
+		ctl.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, _, err := ctl.ReadFromUDP(buf)
+		if err != nil {
+			continue
+		}
+		p, err := parse(buf[:n])
+		switch {
+		case err != nil:
+		case p.typ == msgReject:
+			// Not scheduled yet; keep asking
+			time.Sleep(3 * time.Second)
+		case p.typ == msgAnnounce:
+			if a, err = parseAnnouncement(p.body); err != nil {
+				return err
+			}
+			id = p.id
+		}
+	}
+
+	data, err := net.ListenMulticastUDP("udp4", ifi, &net.UDPAddr{IP: a.group, Port: a.port})
+	if err != nil {
+		return fmt.Errorf("joining %s: %w", a.group, err)
+	}
+	defer data.Close()
+	data.SetReadBuffer(8 << 20)
+
+	total := blocks(a.size)
+	have := newBitset(total)
+	var held uint32
+	started := false
+	for {
+		if !started {
+			// Stay on the server's list while it waits for others
+			ctl.WriteToUDP(join, server)
+			data.SetReadDeadline(time.Now().Add(2 * time.Second))
+		} else {
+			data.SetReadDeadline(time.Now().Add(time.Minute))
+		}
+		n, _, err := data.ReadFromUDP(buf)
+		var ne net.Error
+		if errors.As(err, &ne) && ne.Timeout() && !started {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("receiving %s: %w", image, err)
+		}
+		p, err := parse(buf[:n])
+		if err != nil || p.id != id {
+			continue
+		}
+		started = true
+		switch p.typ {
+		case msgData:
+			if len(p.body) < 4 {
+				continue
+			}
+			i := uint32(p.body[0])<<24 | uint32(p.body[1])<<16 | uint32(p.body[2])<<8 | uint32(p.body[3])
+			if i >= total || have.has(i) {
+				continue
+			}
+			if _, err := out.WriteAt(p.body[4:], int64(i)*BlockSize); err != nil {
+				return err
+			}
+			have.set(i)
+			held++
+		case msgRound:
+			if len(p.body) < 4 {
+				continue
+			}
+			round := uint32(p.body[0])<<24 | uint32(p.body[1])<<16 | uint32(p.body[2])<<8 | uint32(p.body[3])
+			if progress != nil {
+				progress(min(int64(held)*BlockSize, a.size), a.size)
+			}
+			if held == total {
+				ctl.WriteToUDP(append(header(msgDone, id, 4), p.body[:4]...), server)
+				continue
+			}
+			ctl.WriteToUDP(marshalNak(id, round, held, have.spans(total, maxRanges)), server)
+		case msgEnd:
+			if held != total {
+				return fmt.Errorf("transfer of %s ended with %d of %d blocks received", image, held, total)
+			}
+			return nil
+		}
+	}
+}
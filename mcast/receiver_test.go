@@ -0,0 +1,162 @@
+package mcast
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// image is an io.WriterAt in memory
+type image struct {
+	mu   sync.Mutex
+	data []byte
+}
+
+func (m *image) WriteAt(p []byte, off int64) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if end := int(off) + len(p); end > len(m.data) {
+		m.data = append(m.data, make([]byte, end-len(m.data))...)
+	}
+	return copy(m.data[off:], p), nil
+}
+
+// loopback is the loopback interface, if multicast can be received on it
+func loopback(t *testing.T) *net.Interface {
+	t.Helper()
+	ifaces, _ := net.Interfaces()
+	for _, ifi := range ifaces {
+		if ifi.Flags&net.FlagLoopback == 0 {
+			continue
+		}
+		conn, err := net.ListenMulticastUDP("udp4", &ifi, &net.UDPAddr{IP: net.IPv4(239, 255, 90, 1), Port: DataPort})
+		if err != nil {
+			t.Skipf("no multicast on %s: %v", ifi.Name, err)
+		}
+		conn.Close()
+		return &ifi
+	}
+	t.Skip("no loopback interface")
+	return nil
+}
+
+// control answers every join on a loopback port with reply
+func control(t *testing.T, reply []byte) string {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			_, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(reply, from)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestReceive(t *testing.T) {
+	ifi := loopback(t)
+	root := t.TempDir()
+	want := bytes.Repeat([]byte("block"), 3*BlockSize/5+100)
+	os.WriteFile(filepath.Join(root, "disk.img"), want, 0o644)
+	s, conn := startServer(t, root)
+	if _, err := s.Start("disk.img", Options{Receivers: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	var got image
+	var progress []int64
+	err := Receive(conn.RemoteAddr().String(), "disk.img", &got, ifi, 10*time.Second, func(held, size int64) {
+		progress = append(progress, held)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.data, want) {
+		t.Errorf("received %d bytes, want %d", len(got.data), len(want))
+	}
+	if len(progress) == 0 || progress[len(progress)-1] != int64(len(want)) {
+		t.Errorf("progress %v", progress)
+	}
+}
+
+func TestReceiveNoTransfer(t *testing.T) {
+	tests := []struct {
+		name  string
+		reply []byte
+		wait  time.Duration
+		err   string
+	}{
+		{"not announced in time", []byte("garbage"), 10 * time.Millisecond, "no transfer of disk.img announced within 10ms"},
+		{"short announcement", append(header(msgAnnounce, 1, 3), 1, 2, 3), time.Minute, "short packet"},
+		{"empty image", announcement{group: net.IPv4(239, 255, 90, 1), port: DataPort, name: "disk.img"}.marshal(1), time.Minute, "size 0 is out of range"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Receive(control(t, tt.reply), "disk.img", &image{}, nil, tt.wait, nil)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("Receive = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestReceiveMalformed(t *testing.T) {
+	ifi := loopback(t)
+	group := net.IPv4(239, 255, 90, 3)
+	addr := control(t, announcement{group: group, port: DataPort, size: 2 * BlockSize, name: "disk.img"}.marshal(7))
+	conn, err := NewServer(t.TempDir(), net.IPv4(127, 0, 0, 1)).dataConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	block := func(id uint32, i byte, data []byte) []byte {
+		return append(append(header(msgData, id, 4+len(data)), 0, 0, 0, i), data...)
+	}
+	packets := [][]byte{
+		[]byte("garbage"),
+		append(header(msgData, 7, 3), 0, 0, 0),
+		append(header(msgRound, 7, 2), 0, 1),
+		block(8, 0, []byte("another transfer")),
+		block(7, 9, []byte("past the end")),
+		block(7, 0, []byte("first")),
+		block(7, 0, []byte("again")),
+		header(msgEnd, 7, 0),
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			for _, p := range packets {
+				conn.WriteToUDP(p, &net.UDPAddr{IP: group, Port: DataPort})
+			}
+			select {
+			case <-stop:
+				return
+			case <-time.After(50 * time.Millisecond):
+			}
+		}
+	}()
+
+	var got image
+	err = Receive(addr, "disk.img", &got, ifi, time.Minute, nil)
+	if err == nil || !strings.Contains(err.Error(), "ended with 1 of 2 blocks received") {
+		t.Errorf("Receive = %v", err)
+	}
+	if string(got.data) != "first" {
+		t.Errorf("wrote %q", got.data)
+	}
+}
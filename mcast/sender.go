@@ -0,0 +1,513 @@
+// Package mcast pushes a disk image to a whole rack at once over IP
+// multicast, udpcast-style. Receivers in the installer ask the server for
+// an image on the control port and are told the multicast group it is sent
+// to. Once enough receivers have joined, the image goes out in a pass of
+// data packets; each pass ends with a round marker, receivers report the
+// blocks they miss, and the next pass resends only those, until every
+// receiver has the whole image or stops responding.
+package mcast
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ars1364/go-pxe/events"
+	"github.com/ars1364/go-pxe/fetch"
+)
+
+// Transfer states
+const (
+	Waiting = "waiting" // for receivers to join
+	Sending = "sending"
+	Done    = "done"
+	Failed  = "failed"
+	Aborted = "aborted"
+)
+
+const (
+	// DataPort is where data packets are sent, in the transfer's group
+	DataPort = 9001
+
+	defaultRate    = 50 << 20
+	collectWindow  = 300 * time.Millisecond // for reports after a round
+	silentRounds   = 5                      // rounds without a report before a receiver is dropped
+	silentTime     = 10 * time.Second
+	maxTransfers   = 100 // finished transfers kept for the API
+	readAheadBlock = 256
+)
+
+// Options control when and how fast a transfer is sent
+type Options struct {
+	Receivers int           `json:"receivers"` // start once this many have joined
+	Wait      time.Duration `json:"wait"`      // start after this long with whoever has joined
+	Rate      int64         `json:"rate"`      // bytes per second, 50 MiB/s if 0
+}
+
+// Receiver is one machine taking part in a transfer
+type Receiver struct {
+	IP     string    `json:"ip"`
+	Client string    `json:"client"`
+	Joined time.Time `json:"joined"`
+	Blocks uint32    `json:"blocks"` // held, as last reported
+	Done   bool      `json:"done"`
+	Error  string    `json:"error,omitempty"`
+
+	lastRound uint32
+	lastSeen  time.Time
+}
+
+// Transfer is one image being multicast
+type Transfer struct {
+	ID        uint32     `json:"id"`
+	Image     string     `json:"image"`
+	Group     string     `json:"group"`
+	Size      int64      `json:"size"`
+	Blocks    uint32     `json:"blocks"`
+	Options   Options    `json:"options"`
+	State     string     `json:"state"`
+	Error     string     `json:"error,omitempty"`
+	Created   time.Time  `json:"created"`
+	Started   time.Time  `json:"started,omitzero"`
+	Finished  time.Time  `json:"finished,omitzero"`
+	Rounds    uint32     `json:"rounds"`
+	Receivers []Receiver `json:"receivers"`
+
+	group     net.IP
+	file      *os.File
+	receivers map[string]*Receiver // by control address
+	resend    bitset               // blocks reported missing this round
+}
+
+// Server schedules transfers of the images under a root directory and
+// answers receivers on the control port
+type Server struct {
+	// Events, if set, receives a join, done or failed event per receiver
+	Events *events.Bus
+
+	// Domain labels log lines
+	Domain string
+
+	// ClientID, if set, names a receiver in its transfer's progress and
+	// events. Defaults to its IP address.
+	ClientID func(ip net.IP) string
+
+	root string
+	ip   net.IP
+
+	mu        sync.Mutex
+	conn      *net.UDPConn
+	transfers []*Transfer
+	next      uint32
+}
+
+// NewServer creates a server sending images from root out of the
+// interface with address ip
+func NewServer(root string, ip net.IP) *Server {
+	return &Server{root: root, ip: ip, next: 1}
+}
+
+// ListenAndServe answers joins and receiver reports on addr
+func (s *Server) ListenAndServe(addr string) error {
+	ua, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp4", ua)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.conn = conn
+	s.mu.Unlock()
+	log.Printf("[MCAST] Serving images from %s, control on %s", s.root, addr)
+
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return err
+		}
+		p, err := parse(buf[:n])
+		if err != nil {
+			continue
+		}
+		switch p.typ {
+		case msgJoin:
+			s.join(conn, from, string(p.body))
+		case msgNak, msgDone:
+			s.report(from, p)
+		}
+	}
+}
+
+// Start schedules a transfer of image, a path under the root
+func (s *Server) Start(image string, opts Options) (Transfer, error) {
+	name := filepath.ToSlash(filepath.Clean("/" + image))[1:]
+	if name == "" {
+		return Transfer{}, errors.New("no image given")
+	}
+	f, err := os.Open(filepath.Join(s.root, filepath.FromSlash(name)))
+	if err != nil {
+		return Transfer{}, err
+	}
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() || fi.Size() == 0 {
+		f.Close()
+		return Transfer{}, fmt.Errorf("%s is not a non-empty image file", name)
+	}
+	if fi.Size() > maxSize {
+		f.Close()
+		return Transfer{}, fmt.Errorf("%s is too large to multicast", name)
+	}
+	if opts.Receivers < 1 {
+		opts.Receivers = 1
+	}
+	if opts.Rate <= 0 {
+		opts.Rate = defaultRate
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		f.Close()
+		return Transfer{}, errors.New("multicast server not running")
+	}
+	for _, t := range s.transfers {
+		if t.Image == name && (t.State == Waiting || t.State == Sending) {
+			f.Close()
+			return Transfer{}, fmt.Errorf("%s is already being sent (transfer %d)", name, t.ID)
+		}
+	}
+	t := &Transfer{
+		ID: s.next, Image: name, Size: fi.Size(), Blocks: blocks(fi.Size()), Options: opts,
+		State: Waiting, Created: time.Now(),
+		group:     net.IPv4(239, 255, 90, byte(s.next%250+1)),
+		file:      f,
+		receivers: make(map[string]*Receiver),
+	}
+	t.Group = t.group.String()
+	s.next++
+	s.transfers = append(s.transfers, t)
+	s.prune()
+	go s.run(t)
+	log.Printf("[MCAST] %s: transfer %d of %s (%d bytes) to %s waiting for %d receivers", s.Domain, t.ID, name, t.Size, t.Group, opts.Receivers)
+	return t.status(), nil
+}
+
+// List returns every transfer, newest first
+func (s *Server) List() []Transfer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]Transfer, 0, len(s.transfers))
+	for i := len(s.transfers) - 1; i >= 0; i-- {
+		list = append(list, s.transfers[i].status())
+	}
+	return list
+}
+
+// Get returns one transfer
+func (s *Server) Get(id uint32) (Transfer, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t := s.find(id); t != nil {
+		return t.status(), true
+	}
+	return Transfer{}, false
+}
+
+// Abort stops a waiting or running transfer, reporting whether there was
+// one
+func (s *Server) Abort(id uint32) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := s.find(id)
+	if t == nil || (t.State != Waiting && t.State != Sending) {
+		return false
+	}
+	t.State = Aborted
+	return true
+}
+
+func (s *Server) find(id uint32) *Transfer {
+	for _, t := range s.transfers {
+		if t.ID == id {
+			return t
+		}
+	}
+	return nil
+}
+
+// prune drops the oldest finished transfers beyond maxTransfers
+func (s *Server) prune() {
+	for len(s.transfers) > maxTransfers {
+		i := 0
+		for i < len(s.transfers) && (s.transfers[i].State == Waiting || s.transfers[i].State == Sending) {
+			i++
+		}
+		if i == len(s.transfers) {
+			return
+		}
+		s.transfers = append(s.transfers[:i], s.transfers[i+1:]...)
+	}
+}
+
+// status copies t for callers outside the lock
+func (t *Transfer) status() Transfer {
+	c := *t
+	c.Receivers = make([]Receiver, 0, len(t.receivers))
+	for _, r := range t.receivers {
+		c.Receivers = append(c.Receivers, *r)
+	}
+	sort.Slice(c.Receivers, func(i, j int) bool { return c.Receivers[i].Joined.Before(c.Receivers[j].Joined) })
+	return c
+}
+
+// join answers a receiver asking for an image with the transfer sending it
+func (s *Server) join(conn *net.UDPConn, from *net.UDPAddr, name string) {
+	name = strings.TrimPrefix(name, "/")
+	s.mu.Lock()
+	var t *Transfer
+	for _, c := range s.transfers {
+		if c.Image == name && (c.State == Waiting || c.State == Sending) {
+			t = c
+		}
+	}
+	if t == nil {
+		s.mu.Unlock()
+		conn.WriteToUDP(append(header(msgReject, 0, 0), "no transfer of "+name+" is scheduled"...), from)
+		return
+	}
+	r, ok := t.receivers[from.String()]
+	if !ok {
+		r = &Receiver{IP: from.IP.String(), Client: from.IP.String(), Joined: time.Now(), lastRound: t.Rounds}
+		if s.ClientID != nil {
+			r.Client = s.ClientID(from.IP)
+		}
+		t.receivers[from.String()] = r
+	}
+	r.lastSeen = time.Now()
+	msg := announcement{group: t.group, port: DataPort, size: t.Size, name: t.Image}.marshal(t.ID)
+	s.mu.Unlock()
+
+	conn.WriteToUDP(msg, from)
+	if !ok {
+		log.Printf("[MCAST] %s: %s joined transfer %d of %s", s.Domain, r.Client, t.ID, name)
+		s.Events.Publish(events.Event{Type: events.MulticastJoin, IP: from.IP, Path: name})
+	}
+}
+
+// report records a receiver's NAK or completion
+func (s *Server) report(from *net.UDPAddr, p packet) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := s.find(p.id)
+	if t == nil || t.State != Sending {
+		return
+	}
+	r := t.receivers[from.String()]
+	if r == nil || r.Done || r.Error != "" {
+		return
+	}
+	if p.typ == msgDone {
+		r.Done, r.Blocks, r.lastSeen = true, t.Blocks, time.Now()
+		log.Printf("[MCAST] %s: %s received %s", s.Domain, r.Client, t.Image)
+		s.Events.Publish(events.Event{Type: events.MulticastDone, IP: from.IP, Path: t.Image, Bytes: t.Size, Duration: time.Since(t.Started)})
+		return
+	}
+	round, held, missing, err := parseNak(p.body)
+	if err != nil {
+		return
+	}
+	r.Blocks, r.lastRound, r.lastSeen = held, round, time.Now()
+	for _, sp := range missing {
+		for i := sp.start; i-sp.start < sp.count && i < t.Blocks; i++ { // start+count may wrap
+			t.resend.set(i)
+		}
+	}
+}
+
+// run waits for receivers and sends t in rounds until it is complete
+func (s *Server) run(t *Transfer) {
+	defer t.file.Close()
+	deadline := time.Now().Add(t.Options.Wait)
+	for {
+		s.mu.Lock()
+		state, joined := t.State, len(t.receivers)
+		expired := t.Options.Wait > 0 && time.Now().After(deadline)
+		if state == Waiting && (joined >= t.Options.Receivers || expired && joined > 0) {
+			t.State, t.Started, t.resend = Sending, time.Now(), newBitset(t.Blocks)
+			state = Sending
+		}
+		s.mu.Unlock()
+		if state == Aborted {
+			s.finish(t, nil, "")
+			return
+		}
+		if state == Sending {
+			break
+		}
+		if t.Options.Wait > 0 && time.Now().After(deadline) {
+			s.finish(t, nil, "no receivers joined")
+			return
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+
+	conn, err := s.dataConn()
+	if err != nil {
+		s.finish(t, nil, err.Error())
+		return
+	}
+	defer conn.Close()
+	dst := &net.UDPAddr{IP: t.group, Port: DataPort}
+	log.Printf("[MCAST] %s: sending %s to %d receivers on %s", s.Domain, t.Image, len(t.receivers), dst)
+
+	limiter := fetch.NewLimiter(t.Options.Rate)
+	due := newBitset(t.Blocks) // blocks to send this pass: all at first
+	for i := range due {
+		due[i] = ^uint64(0)
+	}
+	rd := &blockReader{f: t.file, size: t.Size}
+	for round := uint32(1); ; round++ {
+		for i := uint32(0); i < t.Blocks; i++ {
+			if !due.has(i) {
+				continue
+			}
+			data, err := rd.block(i)
+			if err != nil {
+				s.finish(t, conn, "reading image: "+err.Error())
+				return
+			}
+			msg := header(msgData, t.ID, 4+len(data))
+			msg = append(msg, byte(i>>24), byte(i>>16), byte(i>>8), byte(i))
+			msg = append(msg, data...)
+			limiter.Wait(len(msg))
+			conn.WriteToUDP(msg, dst)
+		}
+		for range 3 {
+			conn.WriteToUDP(append(header(msgRound, t.ID, 4), byte(round>>24), byte(round>>16), byte(round>>8), byte(round)), dst)
+			time.Sleep(10 * time.Millisecond)
+		}
+		time.Sleep(collectWindow)
+
+		s.mu.Lock()
+		t.Rounds = round
+		active := 0
+		for _, r := range t.receivers {
+			if r.Done || r.Error != "" {
+				continue
+			}
+			if round-r.lastRound > silentRounds && time.Since(r.lastSeen) > silentTime {
+				r.Error = "stopped responding"
+				log.Printf("[MCAST] %s: %s stopped responding to transfer %d", s.Domain, r.Client, t.ID)
+				s.Events.Publish(events.Event{Type: events.MulticastFailed, IP: net.ParseIP(r.IP), Path: t.Image, Err: r.Error})
+				continue
+			}
+			active++
+		}
+		aborted := t.State == Aborted
+		due, t.resend = t.resend, newBitset(t.Blocks)
+		s.mu.Unlock()
+
+		if aborted || active == 0 {
+			s.finish(t, conn, "")
+			return
+		}
+		if due.empty() {
+			// Nothing reported missing; ask again after a pause
+			time.Sleep(200 * time.Millisecond)
+		}
+	}
+}
+
+// finish ends t, telling receivers over conn if it was sending
+func (s *Server) finish(t *Transfer, conn *net.UDPConn, failure string) {
+	if conn != nil {
+		for range 3 {
+			conn.WriteToUDP(header(msgEnd, t.ID, 0), &net.UDPAddr{IP: t.group, Port: DataPort})
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	done := 0
+	reason := cmp.Or(failure, "transfer aborted")
+	for _, r := range t.receivers {
+		if r.Done {
+			done++
+			continue
+		}
+		if r.Error == "" {
+			r.Error = reason
+			s.Events.Publish(events.Event{Type: events.MulticastFailed, IP: net.ParseIP(r.IP), Path: t.Image, Err: r.Error})
+		}
+	}
+	switch {
+	case t.State == Aborted:
+	case failure != "":
+		t.State, t.Error = Failed, failure
+	case done == 0:
+		t.State, t.Error = Failed, "no receiver got the image"
+	default:
+		t.State = Done
+	}
+	t.Finished = time.Now()
+	log.Printf("[MCAST] %s: transfer %d of %s %s: %d of %d receivers complete", s.Domain, t.ID, t.Image, t.State, done, len(t.receivers))
+}
+
+// dataConn opens a socket sending multicast out of the server's interface
+func (s *Server) dataConn() (*net.UDPConn, error) {
+	var addr [4]byte
+	copy(addr[:], s.ip.To4())
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			if err := c.Control(func(fd uintptr) {
+				sockErr = syscall.SetsockoptInet4Addr(int(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_IF, addr)
+			}); err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+	pc, err := lc.ListenPacket(context.Background(), "udp4", net.JoinHostPort(s.ip.String(), "0"))
+	if err != nil {
+		return nil, fmt.Errorf("multicast socket: %w", err)
+	}
+	return pc.(*net.UDPConn), nil
+}
+
+// blockReader reads an image block by block, a window at a time
+type blockReader struct {
+	f     *os.File
+	size  int64
+	start uint32
+	buf   []byte
+}
+
+func (b *blockReader) block(i uint32) ([]byte, error) {
+	n := uint32(len(b.buf)+BlockSize-1) / BlockSize
+	if b.buf == nil || i < b.start || i >= b.start+n {
+		off := int64(i) * BlockSize
+		want := min(int64(readAheadBlock*BlockSize), b.size-off)
+		buf := make([]byte, want)
+		if _, err := b.f.ReadAt(buf, off); err != nil && err != io.EOF {
+			return nil, err
+		}
+		b.start, b.buf = i, buf
+	}
+	lo := int(i-b.start) * BlockSize
+	return b.buf[lo:min(lo+BlockSize, len(b.buf))], nil
+}
@@ -0,0 +1,162 @@
+package mcast
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// startServer runs a server on a loopback control port and returns a
+// receiver's control socket connected to it
+func startServer(t *testing.T, root string) (*Server, *net.UDPConn) {
+	t.Helper()
+	s := NewServer(root, net.IPv4(127, 0, 0, 1))
+	go s.ListenAndServe("127.0.0.1:0")
+	var ctl *net.UDPAddr
+	for range 100 {
+		s.mu.Lock()
+		if s.conn != nil {
+			ctl = s.conn.LocalAddr().(*net.UDPAddr)
+		}
+		s.mu.Unlock()
+		if ctl != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if ctl == nil {
+		t.Fatal("server did not start")
+	}
+	conn, err := net.DialUDP("udp4", nil, ctl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		s.mu.Lock()
+		s.conn.Close()
+		s.mu.Unlock()
+	})
+	return s, conn
+}
+
+func exchange(t *testing.T, conn *net.UDPConn, msg []byte) packet {
+	t.Helper()
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 2048)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := parse(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestJoin(t *testing.T) {
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "images"), 0755)
+	os.WriteFile(filepath.Join(root, "images", "disk.img"), bytes.Repeat([]byte{1}, 3*BlockSize+10), 0644)
+	os.WriteFile(filepath.Join(root, "empty.img"), nil, 0644)
+	s, conn := startServer(t, root)
+
+	join := func(name string) packet {
+		return exchange(t, conn, append(header(msgJoin, 0, len(name)), name...))
+	}
+	if p := join("images/disk.img"); p.typ != msgReject || !bytes.Contains(p.body, []byte("images/disk.img")) {
+		t.Errorf("join before Start: %+v", p)
+	}
+
+	for _, image := range []string{"", "/", "missing.img", "empty.img", "images"} {
+		if _, err := s.Start(image, Options{}); err == nil {
+			t.Errorf("started a transfer of %q", image)
+		}
+	}
+	tr, err := s.Start("../images/disk.img", Options{Receivers: 2, Wait: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.Image != "images/disk.img" || tr.Blocks != 4 || tr.State != Waiting || tr.Options.Rate != defaultRate {
+		t.Errorf("transfer %+v", tr)
+	}
+	if _, err := s.Start("images/disk.img", Options{}); err == nil {
+		t.Error("started a second transfer of the same image")
+	}
+
+	p := join("/images/disk.img")
+	if p.typ != msgAnnounce || p.id != tr.ID {
+		t.Fatalf("join: %+v", p)
+	}
+	a, err := parseAnnouncement(p.body)
+	if err != nil || a.group.String() != tr.Group || a.port != DataPort || a.size != 3*BlockSize+10 || a.name != tr.Image {
+		t.Errorf("announcement %+v, %v", a, err)
+	}
+	join("images/disk.img") // joining again keeps one receiver
+
+	got, ok := s.Get(tr.ID)
+	if !ok || len(got.Receivers) != 1 || got.Receivers[0].IP != "127.0.0.1" || got.State != Waiting {
+		t.Errorf("after joins: %+v", got)
+	}
+	if !s.Abort(tr.ID) || s.Abort(tr.ID) {
+		t.Error("Abort does not abort exactly once")
+	}
+	for range 100 {
+		if got, _ = s.Get(tr.ID); got.State != Aborted || !got.Finished.IsZero() {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got.Finished.IsZero() || got.Receivers[0].Error != "transfer aborted" {
+		t.Errorf("after Abort: %+v", got)
+	}
+	if list := s.List(); len(list) != 1 || list[0].ID != tr.ID {
+		t.Errorf("List = %+v", list)
+	}
+}
+
+func TestReport(t *testing.T) {
+	s := NewServer(t.TempDir(), nil)
+	from := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 10), Port: 40000}
+	tr := &Transfer{ID: 1, Blocks: 100, State: Sending, receivers: map[string]*Receiver{from.String(): {}}, resend: newBitset(100)}
+	s.transfers = append(s.transfers, tr)
+
+	nak := func(missing ...span) {
+		p, _ := parse(marshalNak(1, 3, 90, missing))
+		s.report(from, p)
+	}
+	nak(span{5, 2}, span{98, 10}, span{1 << 31, 1 << 31}, span{40, 1<<32 - 1})
+	want := []span{{0, 5}, {7, 33}}
+	if got := tr.resend.spans(tr.Blocks, maxRanges); !slices.Equal(got, want) {
+		t.Errorf("blocks not due = %v, want %v", got, want)
+	}
+	if r := tr.receivers[from.String()]; r.Blocks != 90 || r.lastRound != 3 {
+		t.Errorf("receiver %+v", r)
+	}
+
+	// A short NAK and a stranger's report change nothing
+	tr.resend = newBitset(100)
+	s.report(from, packet{typ: msgNak, id: 1, body: []byte{0, 0, 0}})
+	s.report(&net.UDPAddr{IP: from.IP, Port: 1}, packet{typ: msgDone, id: 1})
+	if !tr.resend.empty() {
+		t.Error("malformed NAK marked blocks")
+	}
+
+	p, _ := parse(header(msgDone, 1, 0))
+	s.report(from, p)
+	if r := tr.receivers[from.String()]; !r.Done || r.Blocks != 100 {
+		t.Errorf("receiver after done %+v", r)
+	}
+	nak(span{0, 1})
+	if !tr.resend.empty() {
+		t.Error("NAK after done marked blocks")
+	}
+}
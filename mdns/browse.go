@@ -0,0 +1,176 @@
+package mdns
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Instance is a service instance found by Browse
+type Instance struct {
+	Name  string   `json:"name"`
+	Host  string   `json:"host"`
+	Addrs []net.IP `json:"addrs"`
+	Port  int      `json:"port"`
+	TXT   []string `json:"txt,omitempty"`
+}
+
+// Lookup returns the value of key in the instance's TXT record
+func (in Instance) Lookup(key string) string {
+	for _, kv := range in.TXT {
+		if k, v, ok := strings.Cut(kv, "="); ok && strings.EqualFold(k, key) {
+			return v
+		}
+	}
+	return ""
+}
+
+// Browse asks every multicast-capable interface for instances of service
+// (e.g. "_gopxe._tcp") and collects the answers that arrive within wait
+func Browse(service string, wait time.Duration) ([]Instance, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, fmt.Errorf("mDNS browse: %w", err)
+	}
+	defer conn.Close()
+
+	typeName := service + ".local"
+	query := (&message{questions: []question{{name: typeName, qtype: typePTR, class: classIN}}}).pack()
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	sent := 0
+	for _, ifi := range ifaces {
+		ip := ipv4Of(&ifi)
+		if ifi.Flags&net.FlagUp == 0 || ifi.Flags&net.FlagMulticast == 0 || ip == nil {
+			continue
+		}
+		var addr [4]byte
+		copy(addr[:], ip)
+		var sockErr error
+		raw.Control(func(fd uintptr) {
+			sockErr = syscall.SetsockoptInet4Addr(int(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_IF, addr)
+		})
+		if sockErr != nil {
+			continue
+		}
+		if _, err := conn.WriteToUDP(query, &net.UDPAddr{IP: group, Port: port}); err == nil {
+			sent++
+		}
+	}
+	if sent == 0 {
+		return nil, fmt.Errorf("mDNS browse: no multicast interface to ask on")
+	}
+
+	a := newAnswers(typeName)
+	buf := make([]byte, 9000)
+	conn.SetReadDeadline(time.Now().Add(wait))
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		a.add(buf[:n])
+	}
+	return a.instances(), nil
+}
+
+// answers collects what responses tell of the instances of a service type
+type answers struct {
+	typeName string
+	names    map[string]bool // instances, from PTR records
+	srvs     map[string]Instance
+	txts     map[string][]string
+	addrs    map[string][]net.IP // by host
+}
+
+func newAnswers(typeName string) *answers {
+	return &answers{
+		typeName: typeName,
+		names:    make(map[string]bool),
+		srvs:     make(map[string]Instance),
+		txts:     make(map[string][]string),
+		addrs:    make(map[string][]net.IP),
+	}
+}
+
+// add takes in the records of the response msg, ignoring queries and
+// malformed messages
+func (a *answers) add(msg []byte) {
+	m, err := parseMessage(msg)
+	if err != nil || m.flags&flagQR == 0 {
+		return
+	}
+	for _, rr := range m.records {
+		key := strings.ToLower(rr.name)
+		switch rr.rtype {
+		case typePTR:
+			if target, _, err := readName(msg, rr.off); err == nil && strings.EqualFold(rr.name, a.typeName) {
+				a.names[strings.ToLower(target)] = true
+			}
+		case typeSRV:
+			if len(rr.data) < 7 {
+				continue
+			}
+			if target, _, err := readName(msg, rr.off+6); err == nil {
+				a.srvs[key] = Instance{Name: rr.name, Host: target, Port: int(binary.BigEndian.Uint16(rr.data[4:]))}
+			}
+		case typeTXT:
+			a.txts[key] = parseTXT(rr.data)
+		case typeA:
+			if len(rr.data) == 4 {
+				a.addrs[key] = appendIP(a.addrs[key], net.IP(append([]byte(nil), rr.data...)))
+			}
+		}
+	}
+}
+
+// instances are the instances both pointed to and located, by name
+func (a *answers) instances() []Instance {
+	var found []Instance
+	for name := range a.names {
+		in, ok := a.srvs[name]
+		if !ok {
+			continue
+		}
+		in.Name = splitName(in.Name)[0] // the instance label, unescaped
+		in.TXT = a.txts[name]
+		in.Addrs = a.addrs[strings.ToLower(in.Host)]
+		found = append(found, in)
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].Name < found[j].Name })
+	return found
+}
+
+func ipv4Of(ifi *net.Interface) net.IP {
+	addrs, _ := ifi.Addrs()
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.To4() != nil {
+			return n.IP.To4()
+		}
+	}
+	return nil
+}
+
+func appendIP(list []net.IP, ip net.IP) []net.IP {
+	for _, x := range list {
+		if x.Equal(ip) {
+			return list
+		}
+	}
+	return append(list, ip)
+}
@@ -0,0 +1,83 @@
+package mdns
+
+import (
+	"net"
+	"slices"
+	"testing"
+)
+
+// response is testResponder's answer to a browse for service
+func response(service string) []byte {
+	r := testResponder()
+	q := question{name: service + ".local", qtype: typePTR}
+	return (&message{flags: flagQR | flagAA, records: r.answer(q)}).pack()
+}
+
+func TestAnswers(t *testing.T) {
+	a := newAnswers("_http._tcp.local")
+	a.add(response("_http._tcp"))
+	a.add(response("_http._tcp")) // repeated: no duplicates
+	a.add(response("_gopxe._tcp"))
+
+	found := a.instances()
+	if len(found) != 2 {
+		t.Fatalf("found %+v", found)
+	}
+	api, web := found[0], found[1]
+	if api.Name != "api" || api.Host != "lab01.local" || api.Port != 8081 || api.TXT != nil {
+		t.Errorf("api = %+v", api)
+	}
+	if web.Name != "web.lab01" || web.Port != 80 {
+		t.Errorf("web = %+v", web)
+	}
+	for _, in := range found {
+		if len(in.Addrs) != 1 || !in.Addrs[0].Equal(net.IPv4(192, 0, 2, 1)) {
+			t.Errorf("%s at %v", in.Name, in.Addrs)
+		}
+	}
+
+	a = newAnswers("_GOPXE._tcp.local")
+	a.add(response("_gopxe._tcp"))
+	if found := a.instances(); len(found) != 1 || !slices.Equal(found[0].TXT, []string{"path=/"}) || found[0].Lookup("path") != "/" {
+		t.Errorf("found %+v", found)
+	}
+}
+
+func TestAnswersIgnored(t *testing.T) {
+	a := newAnswers("_gopxe._tcp.local")
+
+	// A query, though it carries the records as known answers
+	msg := response("_gopxe._tcp")
+	msg[2] &^= 0x80
+	a.add(msg)
+
+	// Instances only located, not pointed to
+	r := testResponder()
+	a.add((&message{flags: flagQR, records: []record{r.srv(r.Services[0]), r.a()}}).pack())
+
+	// A SRV record too short for its target
+	a.add((&message{flags: flagQR, records: []record{
+		ptr("_gopxe._tcp.local", "x._gopxe._tcp.local"),
+		{name: "x._gopxe._tcp.local", rtype: typeSRV, class: classIN, data: []byte{0, 0, 0, 0, 0, 80}},
+	}}).pack())
+	if found := a.instances(); len(found) != 0 {
+		t.Errorf("found %+v", found)
+	}
+}
+
+func TestAnswersMalformed(t *testing.T) {
+	msg := response("_http._tcp")
+	for n := range len(msg) {
+		a := newAnswers("_http._tcp.local")
+		a.add(msg[:n])
+		a.instances()
+	}
+	// Every byte flipped
+	for i := range msg {
+		bad := slices.Clone(msg)
+		bad[i] ^= 0xff
+		a := newAnswers("_http._tcp.local")
+		a.add(bad)
+		a.instances()
+	}
+}
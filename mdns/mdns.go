@@ -0,0 +1,256 @@
+// Package mdns advertises go-pxe's services with multicast DNS and DNS-SD
+// (RFC 6762, RFC 6763), so lab tools and "go-pxe discover" can find a
+// running server on the provisioning network without knowing its address.
+package mdns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	port        = 5353
+	hostTTL     = 120  // A and SRV records
+	serviceTTL  = 4500 // PTR and TXT records
+	legacyTTL   = 10   // answers to one-shot queries from other ports
+	servicesPTR = "_services._dns-sd._udp.local"
+)
+
+var group = net.IPv4(224, 0, 0, 251)
+
+// Service is one advertised service instance
+type Service struct {
+	Instance string // e.g. "go-pxe default on lab01"
+	Type     string // e.g. "_http._tcp"
+	Port     int
+	TXT      []string // key=value pairs
+}
+
+func (s Service) typeName() string     { return s.Type + ".local" }
+func (s Service) instanceName() string { return escapeLabel(s.Instance) + "." + s.typeName() }
+
+// Responder answers mDNS queries for its host name and services on one
+// interface
+type Responder struct {
+	Interface string
+	Host      string // label of the host name, advertised as <Host>.local
+	IP        net.IP
+	Services  []Service
+
+	mu   sync.Mutex
+	conn *net.UDPConn
+}
+
+func NewResponder(iface, host string, ip net.IP) *Responder {
+	return &Responder{Interface: iface, Host: host, IP: ip.To4()}
+}
+
+// ListenAndServe announces the services and answers queries until Close
+func (r *Responder) ListenAndServe() error {
+	ifi, err := net.InterfaceByName(r.Interface)
+	if err != nil {
+		return fmt.Errorf("interface lookup %s: %w", r.Interface, err)
+	}
+	if r.IP == nil {
+		return fmt.Errorf("mDNS needs an IPv4 address")
+	}
+
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			if err := c.Control(func(fd uintptr) { sockErr = setSocketOptions(int(fd), ifi, r.IP) }); err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+	pc, err := lc.ListenPacket(context.Background(), "udp4", fmt.Sprintf("0.0.0.0:%d", port))
+	if err != nil {
+		return fmt.Errorf("mDNS listen: %w", err)
+	}
+	conn := pc.(*net.UDPConn)
+	r.mu.Lock()
+	r.conn = conn
+	r.mu.Unlock()
+
+	log.Printf("[MDNS] Advertising %s.local (%s) with %d services on %s", r.Host, r.IP, len(r.Services), ifi.Name)
+	go func() {
+		// Announce twice, a second apart (RFC 6762 section 8.3)
+		for i := 0; i < 2; i++ {
+			r.send(conn, r.announcement(hostTTL, serviceTTL), nil)
+			time.Sleep(time.Second)
+		}
+	}()
+
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			log.Printf("[MDNS] Read error: %v", err)
+			continue
+		}
+		q, err := parseMessage(buf[:n])
+		if err != nil || q.flags&flagQR != 0 {
+			continue
+		}
+		r.respond(conn, q, from)
+	}
+}
+
+// respond answers the questions of q we are authoritative for
+func (r *Responder) respond(conn *net.UDPConn, q *message, from *net.UDPAddr) {
+	resp := &message{flags: flagQR | flagAA}
+	legacy := from.Port != port
+	unicast := legacy
+	for _, qu := range q.questions {
+		before := len(resp.records)
+		resp.records = append(resp.records, r.answer(qu)...)
+		if len(resp.records) > before && qu.class&unicastQU != 0 {
+			unicast = true
+		}
+	}
+	if len(resp.records) == 0 {
+		return
+	}
+	if legacy {
+		// One-shot resolvers expect a conventional DNS response: the
+		// query's ID and questions, no cache-flush bits, short TTLs
+		resp.id, resp.questions = q.id, q.questions
+		for i := range resp.records {
+			resp.records[i].class &^= cacheFlush
+			resp.records[i].ttl = min(resp.records[i].ttl, legacyTTL)
+		}
+	}
+	if unicast {
+		r.send(conn, resp, from)
+	} else {
+		r.send(conn, resp, nil)
+	}
+}
+
+// answer returns the records answering one question, with the records a
+// resolver will need next
+func (r *Responder) answer(q question) []record {
+	var out []record
+	wants := func(t uint16) bool { return q.qtype == t || q.qtype == typeANY }
+	host := r.Host + ".local"
+
+	switch {
+	case strings.EqualFold(q.name, servicesPTR) && wants(typePTR):
+		seen := make(map[string]bool)
+		for _, s := range r.Services {
+			if !seen[s.Type] {
+				seen[s.Type] = true
+				out = append(out, ptr(servicesPTR, s.typeName()))
+			}
+		}
+	case strings.EqualFold(q.name, host) && wants(typeA):
+		out = append(out, r.a())
+	default:
+		for _, s := range r.Services {
+			switch {
+			case strings.EqualFold(q.name, s.typeName()) && wants(typePTR):
+				out = append(out, ptr(s.typeName(), s.instanceName()), r.srv(s), txt(s), r.a())
+			case strings.EqualFold(q.name, s.instanceName()):
+				if wants(typeSRV) {
+					out = append(out, r.srv(s), r.a())
+				}
+				if wants(typeTXT) {
+					out = append(out, txt(s))
+				}
+			}
+		}
+	}
+	return out
+}
+
+// announcement lists every record, e.g. to announce or retract them
+func (r *Responder) announcement(hTTL, sTTL uint32) *message {
+	m := &message{flags: flagQR | flagAA}
+	a := r.a()
+	a.ttl = hTTL
+	m.records = append(m.records, a)
+	seen := make(map[string]bool)
+	for _, s := range r.Services {
+		if !seen[s.Type] {
+			seen[s.Type] = true
+			p := ptr(servicesPTR, s.typeName())
+			p.ttl = sTTL
+			m.records = append(m.records, p)
+		}
+		p, srv, t := ptr(s.typeName(), s.instanceName()), r.srv(s), txt(s)
+		p.ttl, srv.ttl, t.ttl = sTTL, hTTL, sTTL
+		m.records = append(m.records, p, srv, t)
+	}
+	return m
+}
+
+func (r *Responder) a() record {
+	return record{name: r.Host + ".local", rtype: typeA, class: classIN | cacheFlush, ttl: hostTTL, data: r.IP}
+}
+
+func (r *Responder) srv(s Service) record {
+	return record{name: s.instanceName(), rtype: typeSRV, class: classIN | cacheFlush, ttl: hostTTL,
+		data: srvData(s.Port, r.Host+".local")}
+}
+
+func txt(s Service) record {
+	return record{name: s.instanceName(), rtype: typeTXT, class: classIN | cacheFlush, ttl: serviceTTL, data: txtData(s.TXT)}
+}
+
+// ptr is a shared record, so it never carries the cache-flush bit
+func ptr(name, target string) record {
+	return record{name: name, rtype: typePTR, class: classIN, ttl: serviceTTL, data: appendName(nil, target)}
+}
+
+// send multicasts m, or unicasts it to dst if set
+func (r *Responder) send(conn *net.UDPConn, m *message, dst *net.UDPAddr) {
+	if dst == nil {
+		dst = &net.UDPAddr{IP: group, Port: port}
+	}
+	if _, err := conn.WriteToUDP(m.pack(), dst); err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Printf("[MDNS] Send to %s failed: %v", dst, err)
+	}
+}
+
+// Close retracts the advertised records and stops the responder
+func (r *Responder) Close() {
+	r.mu.Lock()
+	conn := r.conn
+	r.conn = nil
+	r.mu.Unlock()
+	if conn == nil {
+		return
+	}
+	r.send(conn, r.announcement(0, 0), nil)
+	conn.Close()
+}
+
+// joinGroup pins outgoing multicast to the interface of ip and joins the
+// mDNS group there
+func joinGroup(fd int, ip net.IP) error {
+	var addr [4]byte
+	copy(addr[:], ip.To4())
+	if err := syscall.SetsockoptInet4Addr(fd, syscall.IPPROTO_IP, syscall.IP_MULTICAST_IF, addr); err != nil {
+		return &net.OpError{Op: "IP_MULTICAST_IF", Err: err}
+	}
+	if err := syscall.SetsockoptByte(fd, syscall.IPPROTO_IP, syscall.IP_MULTICAST_TTL, 255); err != nil {
+		return &net.OpError{Op: "IP_MULTICAST_TTL", Err: err}
+	}
+	mreq := &syscall.IPMreq{Interface: addr}
+	copy(mreq.Multiaddr[:], group.To4())
+	if err := syscall.SetsockoptIPMreq(fd, syscall.IPPROTO_IP, syscall.IP_ADD_MEMBERSHIP, mreq); err != nil {
+		return &net.OpError{Op: "IP_ADD_MEMBERSHIP", Err: err}
+	}
+	return nil
+}
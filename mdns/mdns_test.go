@@ -0,0 +1,119 @@
+package mdns
+
+import (
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+func testResponder() *Responder {
+	r := NewResponder("lo", "lab01", net.IPv4(192, 0, 2, 1))
+	r.Services = []Service{
+		{Instance: "go-pxe on lab01", Type: "_gopxe._tcp", Port: 8080, TXT: []string{"path=/"}},
+		{Instance: "web.lab01", Type: "_http._tcp", Port: 80},
+		{Instance: "api", Type: "_http._tcp", Port: 8081},
+	}
+	return r
+}
+
+func types(records []record) []uint16 {
+	var out []uint16
+	for _, rr := range records {
+		out = append(out, rr.rtype)
+	}
+	return out
+}
+
+func TestAnswer(t *testing.T) {
+	r := testResponder()
+	tests := []struct {
+		name string
+		q    question
+		want []uint16
+	}{
+		{"service types", question{name: servicesPTR, qtype: typePTR}, []uint16{typePTR, typePTR}},
+		{"host", question{name: "LAB01.local", qtype: typeA}, []uint16{typeA}},
+		{"host ANY", question{name: "lab01.local", qtype: typeANY}, []uint16{typeA}},
+		{"host AAAA", question{name: "lab01.local", qtype: 28}, nil},
+		{"browse", question{name: "_gopxe._tcp.local", qtype: typePTR}, []uint16{typePTR, typeSRV, typeTXT, typeA}},
+		{"browse two instances", question{name: "_http._tcp.local", qtype: typePTR}, []uint16{typePTR, typeSRV, typeTXT, typeA, typePTR, typeSRV, typeTXT, typeA}},
+		{"escaped instance SRV", question{name: `web\.lab01._http._tcp.local`, qtype: typeSRV}, []uint16{typeSRV, typeA}},
+		{"instance TXT", question{name: "api._http._tcp.local", qtype: typeTXT}, []uint16{typeTXT}},
+		{"instance ANY", question{name: "api._http._tcp.local", qtype: typeANY}, []uint16{typeSRV, typeA, typeTXT}},
+		{"unescaped dot", question{name: "web.lab01._http._tcp.local", qtype: typeSRV}, nil},
+		{"other host", question{name: "lab02.local", qtype: typeA}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := types(r.answer(tt.q)); !slices.Equal(got, tt.want) {
+				t.Errorf("answer types %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAnnouncement(t *testing.T) {
+	r := testResponder()
+	m := r.announcement(0, 0)
+	// A, then per type one services PTR, and per service PTR, SRV, TXT
+	if want := 1 + 2 + 3*3; len(m.records) != want {
+		t.Fatalf("%d records, want %d", len(m.records), want)
+	}
+	for _, rr := range m.records {
+		if rr.ttl != 0 {
+			t.Errorf("%s type %d: TTL %d, want 0", rr.name, rr.rtype, rr.ttl)
+		}
+		if rr.rtype == typePTR && rr.class&cacheFlush != 0 {
+			t.Errorf("shared PTR %s has the cache-flush bit", rr.name)
+		}
+	}
+	if _, err := parseMessage(m.pack()); err != nil {
+		t.Errorf("announcement does not parse: %v", err)
+	}
+}
+
+func TestRespond(t *testing.T) {
+	r := testResponder()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	from := client.LocalAddr().(*net.UDPAddr)
+
+	// A one-shot query from an ordinary port gets a unicast DNS answer
+	q := &message{id: 42, questions: []question{
+		{name: "lab01.local", qtype: typeA, class: classIN},
+		{name: "lab02.local", qtype: typeA, class: classIN},
+	}}
+	r.respond(conn, q, from)
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 9000)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := parseMessage(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.id != 42 || resp.flags != flagQR|flagAA || len(resp.questions) != 2 || len(resp.records) != 1 {
+		t.Fatalf("response %+v", resp)
+	}
+	if rr := resp.records[0]; rr.class != classIN || rr.ttl != legacyTTL || !net.IP(rr.data).Equal(r.IP) {
+		t.Errorf("legacy answer %+v", rr)
+	}
+
+	// Nothing to answer: no reply
+	r.respond(conn, &message{questions: []question{{name: "lab02.local", qtype: typeA, class: classIN}}}, from)
+	client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := client.Read(buf); err == nil {
+		t.Error("answered a question for another host")
+	}
+}
@@ -0,0 +1,223 @@
+package mdns
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// Record types
+const (
+	typeA   = 1
+	typePTR = 12
+	typeTXT = 16
+	typeSRV = 33
+	typeANY = 255
+
+	classIN    = 1
+	cacheFlush = 1 << 15 // record class bit: replaces cached records
+	unicastQU  = 1 << 15 // question class bit: unicast response wanted
+)
+
+// header flag bits
+const (
+	flagQR = 1 << 15
+	flagAA = 1 << 10
+)
+
+type question struct {
+	name  string // without trailing dot, dots inside labels escaped
+	qtype uint16
+	class uint16
+}
+
+type record struct {
+	name  string
+	rtype uint16
+	class uint16
+	ttl   uint32
+	data  []byte // encoded RDATA, names uncompressed
+	off   int    // RDATA offset in the message it was parsed from
+}
+
+type message struct {
+	id        uint16
+	flags     uint16
+	questions []question
+	records   []record // answers, authority and additional
+}
+
+func parseMessage(msg []byte) (*message, error) {
+	if len(msg) < 12 {
+		return nil, fmt.Errorf("message too short: %d bytes", len(msg))
+	}
+	m := &message{id: binary.BigEndian.Uint16(msg[0:2]), flags: binary.BigEndian.Uint16(msg[2:4])}
+	qd := int(binary.BigEndian.Uint16(msg[4:6]))
+	rr := int(binary.BigEndian.Uint16(msg[6:8])) + int(binary.BigEndian.Uint16(msg[8:10])) + int(binary.BigEndian.Uint16(msg[10:12]))
+	off := 12
+	for i := 0; i < qd; i++ {
+		name, n, err := readName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		if n+4 > len(msg) {
+			return nil, fmt.Errorf("truncated question")
+		}
+		m.questions = append(m.questions, question{name: name, qtype: binary.BigEndian.Uint16(msg[n:]), class: binary.BigEndian.Uint16(msg[n+2:])})
+		off = n + 4
+	}
+	for i := 0; i < rr; i++ {
+		name, n, err := readName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		if n+10 > len(msg) {
+			return nil, fmt.Errorf("truncated record")
+		}
+		length := int(binary.BigEndian.Uint16(msg[n+8:]))
+		if n+10+length > len(msg) {
+			return nil, fmt.Errorf("truncated record data")
+		}
+		m.records = append(m.records, record{
+			name:  name,
+			rtype: binary.BigEndian.Uint16(msg[n:]),
+			class: binary.BigEndian.Uint16(msg[n+2:]),
+			ttl:   binary.BigEndian.Uint32(msg[n+4:]),
+			data:  msg[n+10 : n+10+length],
+			off:   n + 10,
+		})
+		off = n + 10 + length
+	}
+	return m, nil
+}
+
+// readName decodes a possibly compressed name starting at off and returns
+// it with the offset just past it. Names compare case-insensitively.
+func readName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, fmt.Errorf("name out of bounds")
+		}
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, "."), end, nil
+		case n&0xC0 == 0xC0:
+			if off+1 >= len(msg) {
+				return "", 0, fmt.Errorf("truncated pointer")
+			}
+			if jumps++; jumps > 16 {
+				return "", 0, fmt.Errorf("compression loop")
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3FFF)
+		default:
+			if off+1+n > len(msg) {
+				return "", 0, fmt.Errorf("label out of bounds")
+			}
+			labels = append(labels, escapeLabel(string(msg[off+1:off+1+n])))
+			off += 1 + n
+		}
+	}
+}
+
+// appendName encodes name uncompressed. Labels may contain dots escaped
+// as "\.", which DNS-SD instance names use freely.
+func appendName(b []byte, name string) []byte {
+	for _, label := range splitName(name) {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+func splitName(name string) []string {
+	var labels []string
+	var cur strings.Builder
+	for i := 0; i < len(name); i++ {
+		switch {
+		case name[i] == '\\' && i+1 < len(name):
+			i++
+			cur.WriteByte(name[i])
+		case name[i] == '.':
+			labels = append(labels, cur.String())
+			cur.Reset()
+		default:
+			cur.WriteByte(name[i])
+		}
+	}
+	if cur.Len() > 0 {
+		labels = append(labels, cur.String())
+	}
+	return labels
+}
+
+// escapeLabel makes s usable as one label of a dotted name
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ".", `\.`).Replace(s)
+}
+
+func (m *message) pack() []byte {
+	b := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(b[0:], m.id)
+	binary.BigEndian.PutUint16(b[2:], m.flags)
+	binary.BigEndian.PutUint16(b[4:], uint16(len(m.questions)))
+	binary.BigEndian.PutUint16(b[6:], uint16(len(m.records)))
+	for _, q := range m.questions {
+		b = appendName(b, q.name)
+		b = binary.BigEndian.AppendUint16(b, q.qtype)
+		b = binary.BigEndian.AppendUint16(b, q.class)
+	}
+	for _, r := range m.records {
+		b = appendName(b, r.name)
+		b = binary.BigEndian.AppendUint16(b, r.rtype)
+		b = binary.BigEndian.AppendUint16(b, r.class)
+		b = binary.BigEndian.AppendUint32(b, r.ttl)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(r.data)))
+		b = append(b, r.data...)
+	}
+	return b
+}
+
+func txtData(entries []string) []byte {
+	var b []byte
+	for _, e := range entries {
+		if len(e) > 255 {
+			e = e[:255]
+		}
+		b = append(b, byte(len(e)))
+		b = append(b, e...)
+	}
+	if len(b) == 0 {
+		b = []byte{0} // a TXT record may not be empty
+	}
+	return b
+}
+
+func parseTXT(data []byte) []string {
+	var entries []string
+	for len(data) > 0 {
+		n := int(data[0])
+		if 1+n > len(data) {
+			break
+		}
+		if n > 0 {
+			entries = append(entries, string(data[1:1+n]))
+		}
+		data = data[1+n:]
+	}
+	return entries
+}
+
+func srvData(port int, target string) []byte {
+	b := []byte{0, 0, 0, 0} // priority, weight
+	b = binary.BigEndian.AppendUint16(b, uint16(port))
+	return appendName(b, target)
+}
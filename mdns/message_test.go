@@ -0,0 +1,129 @@
+package mdns
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestReadName(t *testing.T) {
+	tests := []struct {
+		name    string
+		msg     []byte
+		off     int
+		want    string
+		wantEnd int
+		wantErr bool
+	}{
+		{"plain", []byte{3, 'l', 'a', 'b', 5, 'l', 'o', 'c', 'a', 'l', 0}, 0, "lab.local", 11, false},
+		{"root", []byte{0}, 0, "", 1, false},
+		{"compressed", []byte{5, 'l', 'o', 'c', 'a', 'l', 0, 3, 'l', 'a', 'b', 0xc0, 0}, 7, "lab.local", 13, false},
+		{"escaped dot", []byte{3, 'a', '.', 'b', 0}, 0, `a\.b`, 5, false},
+		{"escaped backslash", []byte{1, '\\', 0}, 0, `\\`, 3, false},
+		{"pointer loop", []byte{0xc0, 0}, 0, "", 0, true},
+		{"pointer out of bounds", []byte{0xc0, 40}, 0, "", 0, true},
+		{"truncated pointer", []byte{3, 'l', 'a', 'b', 0xc0}, 0, "", 0, true},
+		{"label out of bounds", []byte{9, 'l', 'a', 'b'}, 0, "", 0, true},
+		{"no terminator", []byte{3, 'l', 'a', 'b'}, 0, "", 0, true},
+		{"offset past the end", []byte{0}, 4, "", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, end, err := readName(tt.msg, tt.off)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want error %v", err, tt.wantErr)
+			}
+			if name != tt.want || end != tt.wantEnd {
+				t.Errorf("readName = %q, %d, want %q, %d", name, end, tt.want, tt.wantEnd)
+			}
+		})
+	}
+}
+
+func TestNames(t *testing.T) {
+	instance := escapeLabel(`go-pxe v1.2 \ lab`) + "._gopxe._tcp.local"
+	labels := splitName(instance)
+	if want := []string{`go-pxe v1.2 \ lab`, "_gopxe", "_tcp", "local"}; !slices.Equal(labels, want) {
+		t.Errorf("splitName = %q, want %q", labels, want)
+	}
+	name, _, err := readName(appendName(nil, instance), 0)
+	if err != nil || name != instance {
+		t.Errorf("name round trip = %q, %v", name, err)
+	}
+}
+
+func TestMessage(t *testing.T) {
+	m := &message{
+		id:        7,
+		flags:     flagQR | flagAA,
+		questions: []question{{name: "_gopxe._tcp.local", qtype: typePTR, class: classIN | unicastQU}},
+		records: []record{
+			{name: "lab.local", rtype: typeA, class: classIN | cacheFlush, ttl: hostTTL, data: []byte{192, 0, 2, 1}},
+			{name: "x._gopxe._tcp.local", rtype: typeSRV, class: classIN, ttl: hostTTL, data: srvData(8080, "lab.local")},
+			{name: "x._gopxe._tcp.local", rtype: typeTXT, class: classIN, ttl: serviceTTL, data: txtData([]string{"path=/", ""})},
+		},
+	}
+	msg := m.pack()
+	got, err := parseMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.id != m.id || got.flags != m.flags || !slices.Equal(got.questions, m.questions) || len(got.records) != len(m.records) {
+		t.Fatalf("parsed %+v", got)
+	}
+	for i, rr := range got.records {
+		want := m.records[i]
+		if rr.name != want.name || rr.rtype != want.rtype || rr.class != want.class || rr.ttl != want.ttl || !slices.Equal(rr.data, want.data) {
+			t.Errorf("record %d = %+v, want %+v", i, rr, want)
+		}
+		if !slices.Equal(msg[rr.off:rr.off+len(rr.data)], rr.data) {
+			t.Errorf("record %d offset %d does not point at its data", i, rr.off)
+		}
+	}
+	if target, _, err := readName(msg, got.records[1].off+6); err != nil || target != "lab.local" {
+		t.Errorf("SRV target = %q, %v", target, err)
+	}
+	if txt := parseTXT(got.records[2].data); !slices.Equal(txt, []string{"path=/"}) {
+		t.Errorf("TXT = %q", txt)
+	}
+
+	// Every truncation fails cleanly
+	for n := range len(msg) {
+		if _, err := parseMessage(msg[:n]); err == nil {
+			t.Errorf("parsed %d of %d bytes", n, len(msg))
+		}
+	}
+}
+
+func TestTXT(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want []string
+	}{
+		{"empty record", txtData(nil), nil},
+		{"entries", txtData([]string{"a=1", "b"}), []string{"a=1", "b"}},
+		{"overlong entry", []byte{9, 'a', '=', '1'}, nil},
+		{"truncated second entry", []byte{3, 'a', '=', '1', 5, 'b'}, []string{"a=1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseTXT(tt.data); !slices.Equal(got, tt.want) {
+				t.Errorf("parseTXT = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	long := make([]byte, 300)
+	if data := txtData([]string{string(long)}); len(data) != 256 {
+		t.Errorf("300-byte entry encoded in %d bytes, want 256", len(data))
+	}
+}
+
+func TestLookup(t *testing.T) {
+	in := Instance{TXT: []string{"path=/api", "Version=1.2", "flag"}}
+	for key, want := range map[string]string{"path": "/api", "version": "1.2", "flag": "", "missing": ""} {
+		if got := in.Lookup(key); got != want {
+			t.Errorf("Lookup(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
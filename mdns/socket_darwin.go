@@ -0,0 +1,19 @@
+package mdns
+
+import (
+	"net"
+	"syscall"
+)
+
+// setSocketOptions shares :5353 with other responders (mDNSResponder) and
+// pins the socket to ifi, so each domain only hears and answers its own
+// network
+func setSocketOptions(fd int, ifi *net.Interface, ip net.IP) error {
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEPORT, 1); err != nil {
+		return &net.OpError{Op: "SO_REUSEPORT", Err: err}
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_BOUND_IF, ifi.Index); err != nil {
+		return &net.OpError{Op: "IP_BOUND_IF", Err: err}
+	}
+	return joinGroup(fd, ip)
+}
@@ -0,0 +1,18 @@
+package mdns
+
+import (
+	"net"
+	"syscall"
+)
+
+// setSocketOptions shares :5353 with other responders (avahi) and pins the
+// socket to ifi, so each domain only hears and answers its own network
+func setSocketOptions(fd int, ifi *net.Interface, ip net.IP) error {
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+		return &net.OpError{Op: "SO_REUSEADDR", Err: err}
+	}
+	if err := syscall.BindToDevice(fd, ifi.Name); err != nil {
+		return &net.OpError{Op: "SO_BINDTODEVICE", Err: err}
+	}
+	return joinGroup(fd, ip)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"io/fs"
+	"log"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/ars1364/go-pxe/iso"
+)
+
+// openISO opens the ISO of the named profile
+func (d *domain) openISO(profile string) (*iso.FS, error) {
+	p, ok := d.store.Profile(profile)
+	if !ok || p.ISO == "" {
+		return nil, fs.ErrNotExist
+	}
+	return iso.Open(filepath.Join(d.cfg.HTTPRoot, filepath.FromSlash(path.Clean("/"+p.ISO))))
+}
+
+// generateMedia backs media/<profile>/ over TFTP, for kernels and
+// initrds; HTTP clients get serveMedia
+func (d *domain) generateMedia(name string) ([]byte, bool) {
+	profile, rest, _ := strings.Cut(strings.TrimPrefix(name, "media/"), "/")
+	disc, err := d.openISO(profile)
+	if err != nil {
+		return nil, false
+	}
+	defer disc.Close()
+	data, err := fs.ReadFile(disc, rest)
+	if err != nil {
+		log.Printf("[TFTP] %s: %s: %v", d.cfg.Name, name, err)
+		return nil, false
+	}
+	return data, true
+}
+
+// serveMedia serves the files of a profile's ISO, as installers such as
+// Anaconda need their repository: a directory with .treeinfo, not the ISO
+func (d *domain) serveMedia(w http.ResponseWriter, r *http.Request) {
+	disc, err := d.openISO(r.PathValue("profile"))
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("[HTTP] %s: %s: %v", d.cfg.Name, r.URL.Path, err)
+		}
+		http.NotFound(w, r)
+		return
+	}
+	defer disc.Close()
+	http.ServeFileFS(w, r, disc, cmp.Or(strings.TrimSuffix(r.PathValue("path"), "/"), "."))
+}
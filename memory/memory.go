@@ -0,0 +1,253 @@
+// Package memory sizes what go-pxe holds in memory, so the same server
+// fits a 512 MB edge box and makes use of a large one: the cache of files
+// sent over TFTP, shared between transfers; the largest file read into
+// memory whole, larger ones being streamed from disk; the buffer each
+// streamed transfer reads ahead into; and a total budget the others
+// default from.
+package memory
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ars1364/go-pxe/metrics"
+)
+
+var (
+	mCached = metrics.Default.Gauge("gopxe_file_cache_bytes", "Bytes of files kept in memory between transfers.")
+	mLookup = metrics.Default.Counter("gopxe_file_cache_lookups_total", "Files opened for transfers, by result: hit, miss or streamed from disk.", "result")
+)
+
+// Without a budget, the sizes are these
+const (
+	DefaultCache   = 64 << 20
+	DefaultMaxFile = 16 << 20
+	DefaultBuffer  = 64 << 10
+)
+
+// Sizes are what may be held in memory; zero Cache or MaxFile is none
+type Sizes struct {
+	Budget  int64 // for the whole process, 0 if unlimited
+	Cache   int64 // files kept between transfers, shared by all of them
+	MaxFile int64 // larger files are streamed from disk, not read whole
+	Buffer  int   // read ahead by each streamed transfer
+}
+
+// Defaults returns the sizes for a budget, or the defaults above if it is
+// 0: a quarter of it for the cache, files up to a 32nd of it in memory,
+// and a buffer of an 8192nd of it, from 16 KiB to 1 MiB
+func Defaults(budget int64) Sizes {
+	if budget <= 0 {
+		return Sizes{Cache: DefaultCache, MaxFile: DefaultMaxFile, Buffer: DefaultBuffer}
+	}
+	return Sizes{
+		Budget:  budget,
+		Cache:   budget / 4,
+		MaxFile: budget / 32,
+		Buffer:  int(min(max(budget>>13, 16<<10), 1<<20)),
+	}
+}
+
+// Check reports sizes that don't fit together
+func (s Sizes) Check() error {
+	if s.Cache < 0 || s.MaxFile < 0 || s.Buffer < 0 {
+		return fmt.Errorf("memory sizes can't be negative")
+	}
+	if s.Budget > 0 && s.Cache+s.MaxFile > s.Budget {
+		return fmt.Errorf("file cache (%d MiB) and largest in-memory file (%d MiB) exceed the memory budget (%d MiB)",
+			s.Cache>>20, s.MaxFile>>20, s.Budget>>20)
+	}
+	return nil
+}
+
+// Apply sets the Go runtime's memory limit to the budget, so it collects
+// garbage harder rather than outgrow it, unless GOMEMLIMIT already set one
+func (s Sizes) Apply() {
+	if s.Budget > 0 && os.Getenv("GOMEMLIMIT") == "" {
+		debug.SetMemoryLimit(s.Budget)
+	}
+}
+
+// ParseSize parses a size such as "512M" or "4G" (bytes, binary multiples)
+func ParseSize(size string) (int64, error) {
+	s := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(size)), "B")
+	mult := int64(1)
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'K':
+			mult, s = 1<<10, s[:n-1]
+		case 'M':
+			mult, s = 1<<20, s[:n-1]
+		case 'G':
+			mult, s = 1<<30, s[:n-1]
+		}
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	bytes := v * float64(mult)
+	if err != nil || !(bytes >= 0 && bytes < math.MaxInt64) {
+		return 0, fmt.Errorf("invalid size %q (want e.g. 64K, 512M or 4G)", size)
+	}
+	return int64(bytes), nil
+}
+
+// Files opens files for transfers within Sizes: those up to MaxFile are
+// read whole and kept, the most recently used up to Cache, for the next
+// transfers of them, such as the boot loader a whole rack asks for; the
+// others are streamed from disk. A nil *Files reads every file whole.
+type Files struct {
+	sizes Sizes
+
+	mu      sync.Mutex
+	entries map[string]*list.Element // of *entry, by path
+	lru     list.List                // most recently used first
+	used    int64
+}
+
+type entry struct {
+	path string
+	mod  time.Time
+	data []byte
+}
+
+// NewFiles opens files within sizes
+func NewFiles(sizes Sizes) *Files {
+	return &Files{sizes: sizes, entries: make(map[string]*list.Element)}
+}
+
+// Open opens the file at path for one transfer. Its Content must be closed.
+func (f *Files) Open(path string) (*Content, error) {
+	if f == nil {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return Bytes(data), nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, fmt.Errorf("%s is a directory", path)
+	}
+	if info.Size() > f.sizes.MaxFile {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		mLookup.With("streamed").Inc()
+		return &Content{file: file, size: info.Size(), bufSize: max(f.sizes.Buffer, 512)}, nil
+	}
+
+	f.mu.Lock()
+	if el, ok := f.entries[path]; ok {
+		if e := el.Value.(*entry); e.mod.Equal(info.ModTime()) && int64(len(e.data)) == info.Size() {
+			f.lru.MoveToFront(el)
+			f.mu.Unlock()
+			mLookup.With("hit").Inc()
+			return Bytes(e.data), nil
+		}
+		f.remove(el)
+	}
+	f.mu.Unlock()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	mLookup.With("miss").Inc()
+	f.keep(path, info.ModTime(), data)
+	return Bytes(data), nil
+}
+
+// keep caches data, forgetting the least recently used files to make room
+func (f *Files) keep(path string, mod time.Time, data []byte) {
+	size := int64(len(data))
+	if size > f.sizes.Cache {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if el, ok := f.entries[path]; ok {
+		f.remove(el)
+	}
+	for f.used+size > f.sizes.Cache {
+		f.remove(f.lru.Back())
+	}
+	f.entries[path] = f.lru.PushFront(&entry{path, mod, data})
+	f.used += size
+	mCached.With().Set(float64(f.used))
+}
+
+// remove forgets a cached file; f.mu is held
+func (f *Files) remove(el *list.Element) {
+	e := f.lru.Remove(el).(*entry)
+	delete(f.entries, e.path)
+	f.used -= int64(len(e.data))
+	mCached.With().Set(float64(f.used))
+}
+
+// Content is a file opened for one transfer, in memory or streamed from
+// disk through a read-ahead buffer
+type Content struct {
+	data []byte
+
+	file    *os.File
+	size    int64
+	bufSize int
+	buf     []byte
+	bufOff  int64
+}
+
+// Bytes is content already in memory, such as a rendered template. It is
+// only read.
+func Bytes(data []byte) *Content {
+	return &Content{data: data, size: int64(len(data))}
+}
+
+// Size returns the content's length
+func (c *Content) Size() int64 {
+	return c.size
+}
+
+// Chunk returns up to n bytes at off, fewer only at the end. They are only
+// valid until the next call.
+func (c *Content) Chunk(off int64, n int) ([]byte, error) {
+	end := min(off+int64(n), c.size)
+	if off >= end {
+		return nil, nil
+	}
+	if c.file == nil {
+		return c.data[off:end], nil
+	}
+	if off < c.bufOff || end > c.bufOff+int64(len(c.buf)) {
+		if cap(c.buf) < n {
+			c.buf = make([]byte, max(c.bufSize, n))
+		}
+		m, err := c.file.ReadAt(c.buf[:cap(c.buf)], off)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		c.buf, c.bufOff = c.buf[:m], off
+		if off+int64(m) < end {
+			return nil, io.ErrUnexpectedEOF
+		}
+	}
+	return c.buf[off-c.bufOff : end-c.bufOff], nil
+}
+
+// Close releases the file, if the content is streamed from one
+func (c *Content) Close() error {
+	if c.file == nil {
+		return nil
+	}
+	return c.file.Close()
+}
@@ -0,0 +1,157 @@
+package memory
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseSize(t *testing.T) {
+	for in, want := range map[string]int64{"512": 512, "64K": 64 << 10, " 512mb ": 512 << 20, "1.5G": 3 << 29, "0": 0} {
+		if got, err := ParseSize(in); err != nil || got != want {
+			t.Errorf("ParseSize(%q) = %d, %v; want %d", in, got, err, want)
+		}
+	}
+	for _, bad := range []string{"", "M", "-1G", "lots", "NaN", "Inf", "1e30G", "4T"} {
+		if got, err := ParseSize(bad); err == nil {
+			t.Errorf("ParseSize(%q) = %d", bad, got)
+		}
+	}
+}
+
+func TestDefaults(t *testing.T) {
+	if s := Defaults(0); s.Cache != DefaultCache || s.MaxFile != DefaultMaxFile || s.Buffer != DefaultBuffer || s.Budget != 0 {
+		t.Errorf("Defaults(0) = %+v", s)
+	}
+	s := Defaults(512 << 20)
+	if s.Cache != 128<<20 || s.MaxFile != 16<<20 || s.Buffer != 64<<10 || s.Check() != nil {
+		t.Errorf("Defaults(512M) = %+v", s)
+	}
+	if s := Defaults(16 << 20); s.Buffer != 16<<10 {
+		t.Errorf("small budget's buffer = %d", s.Buffer)
+	}
+	if s := Defaults(64 << 30); s.Buffer != 1<<20 {
+		t.Errorf("large budget's buffer = %d", s.Buffer)
+	}
+	for _, bad := range []Sizes{{Cache: -1}, {Buffer: -1}, {Budget: 100 << 20, Cache: 80 << 20, MaxFile: 40 << 20}} {
+		if bad.Check() == nil {
+			t.Errorf("%+v accepted", bad)
+		}
+	}
+}
+
+func write(t *testing.T, dir, name string, size int) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	data := bytes.Repeat([]byte(name[:1]), size)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// read reads c whole in chunks of n
+func read(t *testing.T, c *Content, n int) []byte {
+	t.Helper()
+	var out []byte
+	for off := int64(0); ; off += int64(n) {
+		chunk, err := c.Chunk(off, n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(chunk) == 0 {
+			return out
+		}
+		out = append(out, chunk...)
+	}
+}
+
+func TestFiles(t *testing.T) {
+	dir := t.TempDir()
+	a, b, c := write(t, dir, "a", 400), write(t, dir, "b", 400), write(t, dir, "c", 400)
+	big := write(t, dir, "z", 5000)
+	f := NewFiles(Sizes{Cache: 1000, MaxFile: 500, Buffer: 1024})
+
+	for _, path := range []string{a, b, a, c} {
+		content, err := f.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if content.Size() != 400 || content.file != nil {
+			t.Errorf("%s opened as %+v", path, content)
+		}
+		content.Close()
+	}
+	// b was the least recently used when c needed room
+	if _, ok := f.entries[b]; ok || len(f.entries) != 2 || f.used != 800 {
+		t.Errorf("cached %v, %d bytes", f.entries, f.used)
+	}
+
+	// A changed file is read again
+	os.WriteFile(a, []byte("new"), 0644)
+	future := time.Now().Add(time.Hour)
+	os.Chtimes(a, future, future)
+	content, _ := f.Open(a)
+	if string(read(t, content, 512)) != "new" || f.used != 403 {
+		t.Errorf("changed file read as stale, %d bytes cached", f.used)
+	}
+
+	// Past MaxFile, streamed
+	content, err := f.Open(big)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer content.Close()
+	if content.file == nil || content.Size() != 5000 {
+		t.Fatalf("large file opened as %+v", content)
+	}
+	if got := read(t, content, 512); !bytes.Equal(got, bytes.Repeat([]byte("z"), 5000)) {
+		t.Errorf("streamed %d bytes", len(got))
+	}
+	// Going back, as a retransmission does, and with larger chunks
+	if chunk, err := content.Chunk(512, 512); err != nil || len(chunk) != 512 {
+		t.Errorf("Chunk back = %d, %v", len(chunk), err)
+	}
+	if chunk, err := content.Chunk(0, 4096); err != nil || len(chunk) != 4096 {
+		t.Errorf("larger chunk = %d, %v", len(chunk), err)
+	}
+
+	if _, err := f.Open(dir); err == nil {
+		t.Error("opened a directory")
+	}
+	if _, err := f.Open(filepath.Join(dir, "missing")); err == nil {
+		t.Error("opened a missing file")
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	dir := t.TempDir()
+	path := write(t, dir, "z", 5000)
+	content, err := NewFiles(Sizes{MaxFile: 100, Buffer: 1024}).Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer content.Close()
+	os.Truncate(path, 1000)
+	if _, err := content.Chunk(256, 512); err != nil {
+		t.Errorf("Chunk within the file = %v", err)
+	}
+	if _, err := content.Chunk(1024, 512); err != io.ErrUnexpectedEOF {
+		t.Errorf("Chunk past the truncated end = %v", err)
+	}
+}
+
+func TestNilFiles(t *testing.T) {
+	path := write(t, t.TempDir(), "a", 10)
+	var f *Files
+	content, err := f.Open(path)
+	if err != nil || content.Size() != 10 || string(read(t, content, 4)) != "aaaaaaaaaa" {
+		t.Errorf("Open = %+v, %v", content, err)
+	}
+	if chunk, _ := Bytes([]byte("abc")).Chunk(5, 10); chunk != nil {
+		t.Errorf("Chunk past the end = %q", chunk)
+	}
+}
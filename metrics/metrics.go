@@ -0,0 +1,182 @@
+// Package metrics is a small Prometheus-compatible instrumentation library:
+// labeled counters and gauges rendered in the text exposition format, with
+// no dependencies beyond the standard library.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Default is the registry the servers instrument themselves in
+var Default = NewRegistry()
+
+// Registry holds metric families in registration order
+type Registry struct {
+	mu       sync.Mutex
+	families []*family
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+type family struct {
+	name, help, kind string
+	labels           []string
+
+	mu     sync.Mutex
+	series map[string]*Value
+}
+
+// Value is one labeled series. Counters only go up; gauges may also be
+// set, or computed at scrape time with SetFunc.
+type Value struct {
+	labels string
+	bits   atomic.Uint64
+	fn     atomic.Pointer[func() float64]
+}
+
+// Add adds delta to the value
+func (v *Value) Add(delta float64) {
+	for {
+		old := v.bits.Load()
+		if v.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+delta)) {
+			return
+		}
+	}
+}
+
+func (v *Value) Inc() { v.Add(1) }
+func (v *Value) Dec() { v.Add(-1) }
+
+// Set replaces the value of a gauge
+func (v *Value) Set(f float64) {
+	v.bits.Store(math.Float64bits(f))
+}
+
+// SetFunc makes a gauge report fn's result on every scrape
+func (v *Value) SetFunc(fn func() float64) {
+	v.fn.Store(&fn)
+}
+
+func (v *Value) get() float64 {
+	if fn := v.fn.Load(); fn != nil {
+		return (*fn)()
+	}
+	return math.Float64frombits(v.bits.Load())
+}
+
+// Vec is a metric family partitioned by label values
+type Vec struct {
+	f *family
+}
+
+// Counter registers a counter family. Names should end in _total.
+func (r *Registry) Counter(name, help string, labels ...string) Vec {
+	return r.register(name, help, "counter", labels)
+}
+
+// Gauge registers a gauge family
+func (r *Registry) Gauge(name, help string, labels ...string) Vec {
+	return r.register(name, help, "gauge", labels)
+}
+
+func (r *Registry) register(name, help, kind string, labels []string) Vec {
+	f := &family{name: name, help: help, kind: kind, labels: labels, series: make(map[string]*Value)}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, g := range r.families {
+		if g.name == name {
+			panic("metrics: duplicate metric " + name)
+		}
+	}
+	r.families = append(r.families, f)
+	return Vec{f}
+}
+
+// With returns the series for the given label values, in the order the
+// labels were registered, creating it at zero
+func (v Vec) With(values ...string) *Value {
+	if len(values) != len(v.f.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", v.f.name, len(v.f.labels), len(values)))
+	}
+	var b strings.Builder
+	for i, l := range v.f.labels {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(l)
+		b.WriteString(`="`)
+		b.WriteString(escape(values[i]))
+		b.WriteByte('"')
+	}
+	key := b.String()
+
+	v.f.mu.Lock()
+	defer v.f.mu.Unlock()
+	s, ok := v.f.series[key]
+	if !ok {
+		s = &Value{labels: key}
+		v.f.series[key] = s
+	}
+	return s
+}
+
+func escape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+// WriteText renders every family in the Prometheus text format
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	families := append([]*family(nil), r.families...)
+	r.mu.Unlock()
+
+	var b strings.Builder
+	for _, f := range families {
+		f.mu.Lock()
+		series := make([]*Value, 0, len(f.series))
+		for _, s := range f.series {
+			series = append(series, s)
+		}
+		f.mu.Unlock()
+		if len(series) == 0 {
+			continue
+		}
+		sort.Slice(series, func(i, j int) bool { return series[i].labels < series[j].labels })
+
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+		for _, s := range series {
+			b.WriteString(f.name)
+			if s.labels != "" {
+				b.WriteString("{" + s.labels + "}")
+			}
+			b.WriteString(" " + strconv.FormatFloat(s.get(), 'g', -1, 64) + "\n")
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// ServeHTTP serves the registry to Prometheus scrapers
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteText(w)
+}
+
+// ListenAndServe serves /metrics on addr
+func (r *Registry) ListenAndServe(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", r)
+	log.Printf("[METRICS] Listening on %s/metrics", addr)
+	return http.ListenAndServe(addr, mux)
+}
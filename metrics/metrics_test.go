@@ -0,0 +1,108 @@
+package metrics
+
+import (
+	"math"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	r := NewRegistry()
+	requests := r.Counter("gopxe_requests_total", "Requests served", "proto", "status")
+	active := r.Gauge("gopxe_active", "Transfers in flight")
+	r.Gauge("gopxe_unused", "Never set", "x")
+	leases := r.Gauge("gopxe_leases", "Leases held")
+
+	requests.With("tftp", "ok").Add(2)
+	requests.With("http", "ok").Inc()
+	requests.With("tftp", "ok").Inc()
+	requests.With("http", "quote\"back\\slash\nline").Inc()
+	active.With().Inc()
+	active.With().Inc()
+	active.With().Dec()
+	leases.With().SetFunc(func() float64 { return 42 })
+
+	var b strings.Builder
+	if err := r.WriteText(&b); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP gopxe_requests_total Requests served
+# TYPE gopxe_requests_total counter
+gopxe_requests_total{proto="http",status="ok"} 1
+gopxe_requests_total{proto="http",status="quote\"back\\slash\nline"} 1
+gopxe_requests_total{proto="tftp",status="ok"} 3
+# HELP gopxe_active Transfers in flight
+# TYPE gopxe_active gauge
+gopxe_active 1
+# HELP gopxe_leases Leases held
+# TYPE gopxe_leases gauge
+gopxe_leases 42
+`
+	if b.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", b.String(), want)
+	}
+}
+
+func TestValue(t *testing.T) {
+	r := NewRegistry()
+	g := r.Gauge("g", "help").With()
+	g.Set(1.5)
+	g.Add(-3)
+	if got := g.get(); got != -1.5 {
+		t.Errorf("value = %v", got)
+	}
+	g.Set(math.Inf(1))
+	var b strings.Builder
+	r.WriteText(&b)
+	if !strings.Contains(b.String(), "g +Inf\n") {
+		t.Errorf("got %q", b.String())
+	}
+
+	c := r.Counter("c_total", "help").With()
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 1000 {
+				c.Inc()
+			}
+		}()
+	}
+	wg.Wait()
+	if got := c.get(); got != 8000 {
+		t.Errorf("concurrent count = %v", got)
+	}
+}
+
+func TestMisuse(t *testing.T) {
+	panics := func(name string, f func()) {
+		t.Helper()
+		defer func() {
+			if recover() == nil {
+				t.Errorf("%s did not panic", name)
+			}
+		}()
+		f()
+	}
+	r := NewRegistry()
+	v := r.Counter("x_total", "help", "a")
+	panics("duplicate", func() { r.Gauge("x_total", "help") })
+	panics("too few labels", func() { v.With() })
+	panics("too many labels", func() { v.With("1", "2") })
+}
+
+func TestServeHTTP(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("x_total", "help").With().Inc()
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	if !strings.Contains(w.Body.String(), "x_total 1\n") {
+		t.Errorf("body = %q", w.Body)
+	}
+}
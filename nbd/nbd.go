@@ -0,0 +1,397 @@
+// Package nbd serves disk images over the Network Block Device protocol
+// (fixed newstyle handshake), so diskless clients can mount their root from
+// go-pxe.
+package nbd
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/ars1364/go-pxe/disk"
+)
+
+const (
+	nbdMagic    = 0x4e42444d41474943 // "NBDMAGIC"
+	optMagic    = 0x49484156454f5054 // "IHAVEOPT"
+	replyMagic  = 0x0003e889045565a9
+	reqMagic    = 0x25609513
+	simpleReply = 0x67446698
+
+	flagFixedNewstyle = 1 << 0
+	flagNoZeroes      = 1 << 1
+
+	optExportName = 1
+	optAbort      = 2
+	optList       = 3
+	optInfo       = 6
+	optGo         = 7
+
+	repAck        = 1
+	repServer     = 2
+	repInfo       = 3
+	repErrUnsup   = 1<<31 + 1
+	repErrInvalid = 1<<31 + 3
+	repErrUnknown = 1<<31 + 6
+
+	infoExport = 0
+
+	transHasFlags  = 1 << 0
+	transReadOnly  = 1 << 1
+	transSendFlush = 1 << 2
+
+	cmdRead  = 0
+	cmdWrite = 1
+	cmdDisc  = 2
+	cmdFlush = 3
+
+	errPerm  = 1
+	errIO    = 5
+	errInval = 22
+
+	maxRequest = 32 << 20
+)
+
+// Server exports the images under a root directory
+type Server struct {
+	root string
+
+	// ExportFor, if set, names the image a client gets when it asks for the
+	// default (empty) export, e.g. the one assigned to its inventory host
+	ExportFor func(remote net.IP) string
+
+	// Overlays, if set, makes exports writable: each client writes to its
+	// own copy-on-write overlay under <Overlays>/<client>/nbd/, leaving the
+	// shared image untouched
+	Overlays string
+
+	// ClientID names a client's overlay directory (default: its IP)
+	ClientID func(remote net.IP) string
+
+	mu       sync.Mutex
+	attached map[string]*overlayRef // overlay path -> open overlay
+}
+
+func NewServer(root string) *Server {
+	return &Server{root: root, attached: make(map[string]*overlayRef)}
+}
+
+// overlayRef shares one open overlay between a client's connections
+type overlayRef struct {
+	*disk.Overlay
+	srv  *Server
+	path string
+	refs int
+}
+
+func (r *overlayRef) Close() error {
+	r.srv.mu.Lock()
+	defer r.srv.mu.Unlock()
+	if r.refs--; r.refs > 0 {
+		return nil
+	}
+	delete(r.srv.attached, r.path)
+	return r.Overlay.Close()
+}
+
+// ListenAndServe accepts NBD clients on addr (normally <ip>:10809)
+func (s *Server) ListenAndServe(addr string) error {
+	ln, err := net.Listen("tcp4", addr)
+	if err != nil {
+		return fmt.Errorf("NBD listen: %w", err)
+	}
+	defer ln.Close()
+
+	log.Printf("[NBD] Listening on %s, root: %s", addr, s.root)
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Printf("[NBD] Accept error: %v", err)
+			continue
+		}
+		go func() {
+			defer conn.Close()
+			if err := s.serve(conn); err != nil && !errors.Is(err, io.EOF) {
+				log.Printf("[NBD] %s: %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// resolve maps an export name to a path under root
+func (s *Server) resolve(name string, remote net.IP) (string, bool) {
+	if name == "" && s.ExportFor != nil {
+		name = s.ExportFor(remote)
+	}
+	clean := strings.TrimPrefix(filepath.Clean("/"+name), "/")
+	if clean == "" || strings.Contains(clean, "..") {
+		return "", false
+	}
+	return filepath.Join(s.root, clean), true
+}
+
+func (s *Server) serve(conn net.Conn) error {
+	remote := conn.RemoteAddr().(*net.TCPAddr).IP
+	be := binary.BigEndian
+
+	hello := make([]byte, 18)
+	be.PutUint64(hello[0:], nbdMagic)
+	be.PutUint64(hello[8:], optMagic)
+	be.PutUint16(hello[16:], flagFixedNewstyle|flagNoZeroes)
+	if _, err := conn.Write(hello); err != nil {
+		return err
+	}
+	var clientFlags uint32
+	if err := binary.Read(conn, be, &clientFlags); err != nil {
+		return err
+	}
+	noZeroes := clientFlags&flagNoZeroes != 0
+
+	// Option haggling until the client picks an export
+	for {
+		var hdr struct {
+			Magic  uint64
+			Option uint32
+			Length uint32
+		}
+		if err := binary.Read(conn, be, &hdr); err != nil {
+			return err
+		}
+		if hdr.Magic != optMagic || hdr.Length > 4096 {
+			return fmt.Errorf("bad option header")
+		}
+		data := make([]byte, hdr.Length)
+		if _, err := io.ReadFull(conn, data); err != nil {
+			return err
+		}
+
+		switch hdr.Option {
+		case optExportName:
+			img, name, err := s.open(string(data), remote)
+			if err != nil {
+				return err // this option has no error reply; just hang up
+			}
+			defer img.Close()
+			reply := make([]byte, 10, 134)
+			be.PutUint64(reply[0:], uint64(img.Size()))
+			be.PutUint16(reply[8:], transFlags(img))
+			if !noZeroes {
+				reply = reply[:134]
+			}
+			if _, err := conn.Write(reply); err != nil {
+				return err
+			}
+			return s.transmit(conn, img, name)
+
+		case optInfo, optGo:
+			if len(data) < 4 || int(be.Uint32(data))+4 > len(data) {
+				writeOptReply(conn, hdr.Option, repErrInvalid, nil)
+				continue
+			}
+			img, name, err := s.open(string(data[4:4+be.Uint32(data)]), remote)
+			if err != nil {
+				log.Printf("[NBD] %s: %v", remote, err)
+				writeOptReply(conn, hdr.Option, repErrUnknown, []byte(err.Error()))
+				continue
+			}
+			info := make([]byte, 12)
+			be.PutUint16(info[0:], infoExport)
+			be.PutUint64(info[2:], uint64(img.Size()))
+			be.PutUint16(info[10:], transFlags(img))
+			writeOptReply(conn, hdr.Option, repInfo, info)
+			if err := writeOptReply(conn, hdr.Option, repAck, nil); err != nil {
+				img.Close()
+				return err
+			}
+			if hdr.Option == optInfo {
+				img.Close()
+				continue
+			}
+			defer img.Close()
+			return s.transmit(conn, img, name)
+
+		case optList:
+			for _, name := range s.list() {
+				entry := make([]byte, 4+len(name))
+				be.PutUint32(entry, uint32(len(name)))
+				copy(entry[4:], name)
+				writeOptReply(conn, hdr.Option, repServer, entry)
+			}
+			writeOptReply(conn, hdr.Option, repAck, nil)
+
+		case optAbort:
+			writeOptReply(conn, hdr.Option, repAck, nil)
+			return nil
+
+		default:
+			writeOptReply(conn, hdr.Option, repErrUnsup, nil)
+		}
+	}
+}
+
+func (s *Server) open(name string, remote net.IP) (disk.Image, string, error) {
+	path, ok := s.resolve(name, remote)
+	if !ok {
+		return nil, "", fmt.Errorf("no export %q for %s", name, remote)
+	}
+	rel, _ := filepath.Rel(s.root, path)
+	if s.Overlays != "" {
+		img, err := s.openOverlay(path, rel, remote)
+		if err != nil {
+			return nil, "", err
+		}
+		log.Printf("[NBD] %s attached %s with overlay %s", remote, rel, img.path)
+		return img, rel, nil
+	}
+
+	img, err := disk.Open(path)
+	if err != nil {
+		return nil, "", err
+	}
+	log.Printf("[NBD] %s attached %s (%d bytes)", remote, rel, img.Size())
+	return img, rel, nil
+}
+
+// openOverlay opens the client's overlay of the image at path, sharing it
+// with the client's other connections
+func (s *Server) openOverlay(path, rel string, remote net.IP) (*overlayRef, error) {
+	id := remote.String()
+	if s.ClientID != nil {
+		id = s.ClientID(remote)
+	}
+	ovl := filepath.Join(disk.ClientDir(s.Overlays, id), "nbd", rel+".overlay")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ref, ok := s.attached[ovl]; ok {
+		ref.refs++
+		return ref, nil
+	}
+	base, err := disk.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	o, err := disk.OpenOverlay(base, ovl)
+	if err != nil {
+		base.Close()
+		return nil, err
+	}
+	ref := &overlayRef{Overlay: o, srv: s, path: ovl, refs: 1}
+	s.attached[ovl] = ref
+	return ref, nil
+}
+
+// transFlags advertises what the client may do with img
+func transFlags(img disk.Image) uint16 {
+	if _, ok := img.(disk.WritableImage); ok {
+		return transHasFlags | transSendFlush
+	}
+	return transHasFlags | transReadOnly | transSendFlush
+}
+
+// list returns the image files under root
+func (s *Server) list() []string {
+	var names []string
+	filepath.WalkDir(s.root, func(path string, d os.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() {
+			rel, _ := filepath.Rel(s.root, path)
+			names = append(names, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	return names
+}
+
+func writeOptReply(w io.Writer, option, typ uint32, data []byte) error {
+	buf := make([]byte, 20+len(data))
+	be := binary.BigEndian
+	be.PutUint64(buf[0:], replyMagic)
+	be.PutUint32(buf[8:], option)
+	be.PutUint32(buf[12:], typ)
+	be.PutUint32(buf[16:], uint32(len(data)))
+	copy(buf[20:], data)
+	_, err := w.Write(buf)
+	return err
+}
+
+// transmit serves block requests until the client disconnects
+func (s *Server) transmit(conn net.Conn, img disk.Image, name string) error {
+	be := binary.BigEndian
+	hdr := make([]byte, 28)
+	for {
+		if _, err := io.ReadFull(conn, hdr); err != nil {
+			return err
+		}
+		if be.Uint32(hdr[0:]) != reqMagic {
+			return fmt.Errorf("bad request magic")
+		}
+		typ := be.Uint16(hdr[6:])
+		handle := hdr[8:16]
+		offset := int64(be.Uint64(hdr[16:]))
+		length := be.Uint32(hdr[24:])
+
+		reply := make([]byte, 16)
+		be.PutUint32(reply[0:], simpleReply)
+		copy(reply[8:], handle)
+
+		switch typ {
+		case cmdRead:
+			if length > maxRequest || offset < 0 || offset > img.Size()-int64(length) {
+				be.PutUint32(reply[4:], errInval)
+				break
+			}
+			data := make([]byte, length)
+			if _, err := img.ReadAt(data, offset); err != nil && err != io.EOF {
+				log.Printf("[NBD] %s read at %d: %v", name, offset, err)
+				be.PutUint32(reply[4:], errIO)
+				break
+			}
+			reply = append(reply, data...)
+		case cmdWrite:
+			rw, ok := img.(disk.WritableImage)
+			if !ok || length > maxRequest {
+				// Drain the payload and refuse
+				if _, err := io.CopyN(io.Discard, conn, int64(length)); err != nil {
+					return err
+				}
+				be.PutUint32(reply[4:], errPerm)
+				break
+			}
+			data := make([]byte, length)
+			if _, err := io.ReadFull(conn, data); err != nil {
+				return err
+			}
+			if offset < 0 || offset > img.Size()-int64(length) {
+				be.PutUint32(reply[4:], errInval)
+				break
+			}
+			if _, err := rw.WriteAt(data, offset); err != nil {
+				log.Printf("[NBD] %s write at %d: %v", name, offset, err)
+				be.PutUint32(reply[4:], errIO)
+			}
+		case cmdFlush:
+			if rw, ok := img.(disk.WritableImage); ok {
+				if err := rw.Sync(); err != nil {
+					log.Printf("[NBD] %s flush: %v", name, err)
+					be.PutUint32(reply[4:], errIO)
+				}
+			}
+		case cmdDisc:
+			log.Printf("[NBD] %s detached %s", conn.RemoteAddr(), name)
+			return nil
+		default:
+			be.PutUint32(reply[4:], errInval)
+		}
+		if _, err := conn.Write(reply); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package nbd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// connect serves one connection to s, returning the client's end after
+// the greeting, and a channel receiving what serve returned
+func connect(t *testing.T, s *Server) (net.Conn, chan error) {
+	t.Helper()
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	done := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		defer conn.Close()
+		done <- s.serve(conn)
+	}()
+	conn, err := net.Dial("tcp4", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	hello := make([]byte, 18)
+	if _, err := io.ReadFull(conn, hello); err != nil {
+		t.Fatal(err)
+	}
+	if binary.BigEndian.Uint64(hello) != nbdMagic || binary.BigEndian.Uint64(hello[8:]) != optMagic {
+		t.Fatalf("greeting %x", hello)
+	}
+	binary.Write(conn, binary.BigEndian, uint32(flagFixedNewstyle|flagNoZeroes))
+	return conn, done
+}
+
+// option is an option request
+func option(opt uint32, data []byte) []byte {
+	buf := binary.BigEndian.AppendUint64(nil, optMagic)
+	buf = binary.BigEndian.AppendUint32(buf, opt)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(data)))
+	return append(buf, data...)
+}
+
+// request is a transmission request
+func request(cmd uint16, offset uint64, length uint32) []byte {
+	buf := binary.BigEndian.AppendUint32(nil, reqMagic)
+	buf = binary.BigEndian.AppendUint16(buf, 0)
+	buf = binary.BigEndian.AppendUint16(buf, cmd)
+	buf = append(buf, "handle01"...)
+	buf = binary.BigEndian.AppendUint64(buf, offset)
+	return binary.BigEndian.AppendUint32(buf, length)
+}
+
+// goOption asks for export name and transmission
+func goOption(name string) []byte {
+	data := binary.BigEndian.AppendUint32(nil, uint32(len(name)))
+	data = append(data, name...)
+	return option(optGo, append(data, 0, 0))
+}
+
+// readOptReply reads an option reply, returning its type and data
+func readOptReply(t *testing.T, r io.Reader) (uint32, []byte) {
+	t.Helper()
+	hdr := make([]byte, 20)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, binary.BigEndian.Uint32(hdr[16:]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		t.Fatal(err)
+	}
+	return binary.BigEndian.Uint32(hdr[12:]), data
+}
+
+// readReply reads a simple reply carrying n bytes of data on success,
+// returning its error and data
+func readReply(t *testing.T, r io.Reader, n int) (uint32, []byte) {
+	t.Helper()
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		t.Fatal(err)
+	}
+	if binary.BigEndian.Uint32(hdr) != simpleReply || string(hdr[8:]) != "handle01" {
+		t.Fatalf("reply header %x", hdr)
+	}
+	errno := binary.BigEndian.Uint32(hdr[4:])
+	if errno != 0 {
+		return errno, nil
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		t.Fatal(err)
+	}
+	return 0, data
+}
+
+// image writes a 4 KiB raw image named disk.img under a new root
+func image(t *testing.T) (string, []byte) {
+	t.Helper()
+	root := t.TempDir()
+	data := bytes.Repeat([]byte("0123456789abcdef"), 256)
+	if err := os.WriteFile(filepath.Join(root, "disk.img"), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return root, data
+}
+
+func TestTransmit(t *testing.T) {
+	root, data := image(t)
+	conn, done := connect(t, NewServer(root))
+
+	conn.Write(option(optList, nil))
+	if typ, entry := readOptReply(t, conn); typ != repServer || string(entry[4:]) != "disk.img" {
+		t.Fatalf("list reply %d %q", typ, entry)
+	}
+	if typ, _ := readOptReply(t, conn); typ != repAck {
+		t.Fatalf("list ended with %d", typ)
+	}
+
+	conn.Write(goOption("../disk.img/../../etc"))
+	if typ, _ := readOptReply(t, conn); typ != repErrUnknown {
+		t.Fatalf("go outside root: reply %d, want %d", typ, uint32(repErrUnknown))
+	}
+
+	conn.Write(goOption("disk.img"))
+	typ, info := readOptReply(t, conn)
+	if typ != repInfo || binary.BigEndian.Uint64(info[2:]) != uint64(len(data)) {
+		t.Fatalf("go reply %d %x", typ, info)
+	}
+	if flags := binary.BigEndian.Uint16(info[10:]); flags&transReadOnly == 0 {
+		t.Errorf("flags %#x, want read-only", flags)
+	}
+	if typ, _ := readOptReply(t, conn); typ != repAck {
+		t.Fatalf("go ended with %d", typ)
+	}
+
+	tests := []struct {
+		name   string
+		req    []byte
+		errno  uint32
+		offset int
+		length int
+	}{
+		{"read", request(cmdRead, 16, 32), 0, 16, 32},
+		{"read to the end", request(cmdRead, 4064, 32), 0, 4064, 32},
+		{"read past the end", request(cmdRead, 4080, 32), errInval, 0, 0},
+		{"read at an overflowing offset", request(cmdRead, math.MaxInt64, 1), errInval, 0, 0},
+		{"read at a negative offset", request(cmdRead, 1<<63, 1), errInval, 0, 0},
+		{"oversized read", request(cmdRead, 0, maxRequest+1), errInval, 0, 0},
+		{"write to a read-only export", append(request(cmdWrite, 0, 4), "xxxx"...), errPerm, 0, 0},
+		{"flush", request(cmdFlush, 0, 0), 0, 0, 0},
+		{"unknown command", request(9, 0, 0), errInval, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn.Write(tt.req)
+			errno, got := readReply(t, conn, tt.length)
+			if errno != tt.errno {
+				t.Fatalf("error %d, want %d", errno, tt.errno)
+			}
+			if want := data[tt.offset : tt.offset+tt.length]; !bytes.Equal(got, want) {
+				t.Errorf("read %q, want %q", got, want)
+			}
+		})
+	}
+
+	conn.Write(request(cmdDisc, 0, 0))
+	if err := <-done; err != nil {
+		t.Errorf("serve after disconnect: %v", err)
+	}
+}
+
+func TestOverlay(t *testing.T) {
+	root, data := image(t)
+	s := NewServer(root)
+	s.Overlays = t.TempDir()
+	conn, done := connect(t, s)
+	conn.Write(goOption("disk.img"))
+	if typ, info := readOptReply(t, conn); typ != repInfo || binary.BigEndian.Uint16(info[10:])&transReadOnly != 0 {
+		t.Fatalf("go reply %d %x, want a writable export", typ, info)
+	}
+	readOptReply(t, conn)
+
+	conn.Write(append(request(cmdWrite, 8, 4), "XXXX"...))
+	if errno, _ := readReply(t, conn, 0); errno != 0 {
+		t.Fatalf("write error %d", errno)
+	}
+	conn.Write(append(request(cmdWrite, math.MaxInt64-1, 4), "XXXX"...))
+	if errno, _ := readReply(t, conn, 0); errno != errInval {
+		t.Fatalf("write at an overflowing offset: error %d, want %d", errno, errInval)
+	}
+	conn.Write(request(cmdRead, 0, 16))
+	if _, got := readReply(t, conn, 16); string(got) != "01234567XXXXcdef" {
+		t.Errorf("read %q after write", got)
+	}
+	conn.Write(request(cmdDisc, 0, 0))
+	<-done
+
+	if base, _ := os.ReadFile(filepath.Join(root, "disk.img")); !bytes.Equal(base, data) {
+		t.Error("write reached the shared image")
+	}
+}
+
+func TestMalformed(t *testing.T) {
+	root, _ := image(t)
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"truncated flags", []byte{0, 0}},
+		{"bad option magic", append([]byte("NOTOPTS!"), make([]byte, 8)...)},
+		{"oversized option", option(optList, nil)[:12]},
+		{"truncated option", option(optGo, []byte("disk"))[:18]},
+		{"go with a long name", option(optGo, []byte{0xff, 0xff, 0xff, 0xff, 'd'})},
+		{"go without a name length", option(optGo, []byte{0})},
+		{"unknown export", option(optExportName, []byte("missing.img"))},
+		{"bad request magic", append(goOption("disk.img"), make([]byte, 28)...)},
+		{"truncated request", append(goOption("disk.img"), request(cmdRead, 0, 16)[:20]...)},
+		{"truncated write", append(goOption("disk.img"), append(request(cmdWrite, 0, 16), "short"...)...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, done := connect(t, NewServer(root))
+			data := tt.data
+			if tt.name == "oversized option" {
+				data = binary.BigEndian.AppendUint32(data, 4097)
+			}
+			conn.Write(data)
+			conn.(*net.TCPConn).CloseWrite()
+			go io.Copy(io.Discard, conn)
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("serve did not return")
+			}
+		})
+	}
+}
+
+func TestOptionsCorrupted(t *testing.T) {
+	root, _ := image(t)
+	s := NewServer(root)
+	opts := append(option(optList, nil), goOption("disk.img")...)
+	for i := range opts {
+		bad := bytes.Clone(opts)
+		bad[i] ^= 0xff
+		conn, done := connect(t, s)
+		conn.Write(append(bad, request(cmdDisc, 0, 0)...))
+		conn.(*net.TCPConn).CloseWrite()
+		go io.Copy(io.Discard, conn)
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("byte %d flipped: serve did not return", i)
+		}
+	}
+}
@@ -0,0 +1,300 @@
+// Package netbootxyz boots machines go-pxe has nothing else for into
+// netboot.xyz, whose menus install or run dozens of operating systems. In
+// Remote mode clients chainload netboot.xyz's own iPXE builds, which fetch
+// the menus from boot.netboot.xyz. In Mirror mode they chainload stock
+// iPXE into a copy of the menus in the HTTP root, and with Assets the
+// kernels and images those boot are cached there as clients ask for them.
+package netbootxyz
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/ars1364/go-pxe/fetch"
+)
+
+// Modes
+const (
+	Remote = "remote"
+	Mirror = "mirror"
+)
+
+// Dir is the subdirectory of each root netboot.xyz's files are kept under
+const Dir = "netboot.xyz"
+
+// Upstream locations
+var (
+	MenusURL  = "https://github.com/netbootxyz/netboot.xyz/releases/latest/download/menus.tar.gz"
+	SumsURL   = "https://github.com/netbootxyz/netboot.xyz/releases/latest/download/netboot.xyz-sha256-checksums.txt"
+	AssetsURL = "https://github.com/netbootxyz"
+	RemoteURL = "https://boot.netboot.xyz"
+)
+
+// loaders are the iPXE builds by DHCP client architecture (option 93) and
+// mode, with where they are downloaded from
+var loaders = map[string]map[uint16]string{
+	Remote: {
+		0:  "https://boot.netboot.xyz/ipxe/netboot.xyz-undionly.kpxe",
+		7:  "https://boot.netboot.xyz/ipxe/netboot.xyz.efi",
+		9:  "https://boot.netboot.xyz/ipxe/netboot.xyz.efi",
+		11: "https://boot.netboot.xyz/ipxe/netboot.xyz-arm64.efi",
+		22: "https://boot.netboot.xyz/ipxe/netboot.xyz-arm64.efi",
+	},
+	Mirror: {
+		0:  "https://boot.ipxe.org/undionly.kpxe",
+		7:  "https://boot.ipxe.org/ipxe.efi",
+		9:  "https://boot.ipxe.org/ipxe.efi",
+		11: "https://boot.ipxe.org/arm64-efi/ipxe.efi",
+		22: "https://boot.ipxe.org/arm64-efi/ipxe.efi",
+	},
+}
+
+// liveEndpoint is the line of the menus' boot.cfg naming where assets
+// come from
+var liveEndpoint = regexp.MustCompile(`(?m)^set live_endpoint .*$`)
+
+// Service fetches netboot.xyz's files into the roots and serves its assets
+type Service struct {
+	Mode     string
+	Assets   bool   // cache assets (Mirror only)
+	TFTPRoot string // iPXE builds
+	HTTPRoot string // menus and assets
+	Server   string // go-pxe's HTTP URL, as clients reach it
+
+	// Domain labels log lines
+	Domain string
+
+	mu      sync.Mutex
+	pending map[string]*download // assets being fetched, by path
+}
+
+type download struct {
+	done chan struct{}
+	err  error
+}
+
+// New creates a service; mode is Remote or Mirror
+func New(mode string, assets bool, tftpRoot, httpRoot, server string) (*Service, error) {
+	if mode != Remote && mode != Mirror {
+		return nil, fmt.Errorf("netboot.xyz mode %q is neither %s nor %s", mode, Remote, Mirror)
+	}
+	if assets && mode != Mirror {
+		return nil, errors.New("netboot.xyz assets are only cached in mirror mode")
+	}
+	return &Service{
+		Mode:     mode,
+		Assets:   assets,
+		TFTPRoot: tftpRoot,
+		HTTPRoot: httpRoot,
+		Server:   server,
+		pending:  make(map[string]*download),
+	}, nil
+}
+
+// Sync downloads the iPXE builds that are missing and, in Mirror mode, the
+// latest menus. A failed download leaves what is there in place.
+func (s *Service) Sync(ctx context.Context) {
+	for _, url := range loaders[s.Mode] {
+		dest := s.loaderPath(url)
+		if _, err := os.Stat(dest); err == nil {
+			continue
+		}
+		v, err := fetch.Default.Verified(ctx, url, dest, nil, s.sums()...)
+		if err != nil {
+			log.Printf("[NETBOOT] %s: %v", s.Domain, err)
+			continue
+		}
+		log.Printf("[NETBOOT] %s: Fetched %s (%s)", s.Domain, url, v.Level)
+	}
+	if s.Mode != Mirror {
+		return
+	}
+	if err := s.syncMenus(ctx); err != nil {
+		log.Printf("[NETBOOT] %s: Menus: %v", s.Domain, err)
+		return
+	}
+	log.Printf("[NETBOOT] %s: Menus from %s", s.Domain, MenusURL)
+}
+
+// loaderPath is where the iPXE build from url is kept: for the arm64 one,
+// in a subdirectory of its own as its name is the x86 one's
+func (s *Service) loaderPath(url string) string {
+	return filepath.Join(s.TFTPRoot, filepath.FromSlash(s.loaderFile(url)))
+}
+
+func (s *Service) loaderFile(url string) string {
+	name := url[strings.LastIndex(url, "/")+1:]
+	if strings.Contains(url, "/arm64-efi/") {
+		return Dir + "/arm64/" + name
+	}
+	return Dir + "/" + name
+}
+
+// sums are the checksum lists the iPXE builds are checked against:
+// netboot.xyz's own are in its release's, stock iPXE publishes none
+func (s *Service) sums() []string {
+	if s.Mode == Remote {
+		return []string{SumsURL}
+	}
+	return nil
+}
+
+// BootFile is the iPXE build for DHCP client architecture arch, relative
+// to the TFTP root, or "" if there is none or it isn't downloaded yet
+func (s *Service) BootFile(arch uint16) string {
+	url, ok := loaders[s.Mode][arch]
+	if !ok {
+		return ""
+	}
+	if _, err := os.Stat(s.loaderPath(url)); err != nil {
+		return ""
+	}
+	return s.loaderFile(url)
+}
+
+// Script is the iPXE script that takes a client already running iPXE to
+// the menus
+func (s *Service) Script(comment string) []byte {
+	menu := RemoteURL
+	if s.Mode == Mirror {
+		menu = s.Server + "/" + Dir + "/menus/menu.ipxe"
+	}
+	return fmt.Appendf(nil, "#!ipxe\n# %s\nchain --autofree %s\n", comment, menu)
+}
+
+// syncMenus replaces the menus in the HTTP root with the latest release's.
+// With Assets, their boot.cfg is pointed at the cache.
+func (s *Service) syncMenus(ctx context.Context) error {
+	base := filepath.Join(s.HTTPRoot, Dir)
+	archive := filepath.Join(base, "menus.tar.gz")
+	if _, err := fetch.Default.Verified(ctx, MenusURL, archive, nil, SumsURL); err != nil {
+		return err
+	}
+	tmp, err := os.MkdirTemp(base, ".menus-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	if err := untar(archive, tmp); err != nil {
+		return fmt.Errorf("%s: %w", archive, err)
+	}
+	if _, err := os.Stat(filepath.Join(tmp, "menu.ipxe")); err != nil {
+		return fmt.Errorf("%s has no menu.ipxe", MenusURL)
+	}
+	if s.Assets {
+		cfg := filepath.Join(tmp, "boot.cfg")
+		data, err := os.ReadFile(cfg)
+		if err != nil {
+			return err
+		}
+		data = liveEndpoint.ReplaceAll(data, []byte("set live_endpoint "+s.Server+"/"+Dir+"/assets"))
+		if err := os.WriteFile(cfg, data, 0o644); err != nil {
+			return err
+		}
+	}
+	menus := filepath.Join(base, "menus")
+	if err := os.RemoveAll(menus); err != nil {
+		return err
+	}
+	return os.Rename(tmp, menus)
+}
+
+// untar extracts the regular files of a .tar.gz into dir
+func untar(archive, dir string) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := filepath.FromSlash(strings.TrimPrefix(h.Name, "./"))
+		if h.Typeflag != tar.TypeReg || !filepath.IsLocal(name) {
+			continue
+		}
+		dest := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+			return err
+		}
+		out, err := os.Create(dest)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(out, tr)
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// ServeHTTP serves the assets under /netboot.xyz/assets/, downloading each
+// from netboot.xyz's GitHub releases on its first request. Clients asking
+// for a file being downloaded wait for it.
+func (s *Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("path")
+	if !s.Assets || !filepath.IsLocal(filepath.FromSlash(name)) {
+		http.NotFound(w, r)
+		return
+	}
+	dest := filepath.Join(s.HTTPRoot, Dir, "assets", filepath.FromSlash(name))
+	if _, err := os.Stat(dest); err != nil {
+		if err := s.cache(r.Context(), name, dest); err != nil {
+			log.Printf("[NETBOOT] %s: %s: %v", s.Domain, name, err)
+			http.Error(w, "fetching "+name+" failed", http.StatusBadGateway)
+			return
+		}
+	}
+	http.ServeFile(w, r, dest)
+}
+
+// cache downloads an asset once, however many clients ask for it
+func (s *Service) cache(ctx context.Context, name, dest string) error {
+	s.mu.Lock()
+	d, ok := s.pending[name]
+	if !ok {
+		d = &download{done: make(chan struct{})}
+		s.pending[name] = d
+		go func() {
+			// Not tied to the first client: the others still want it
+			url := AssetsURL + "/" + name
+			log.Printf("[NETBOOT] %s: Caching %s", s.Domain, url)
+			_, d.err = fetch.Default.Verified(context.Background(), url, dest, nil)
+			s.mu.Lock()
+			delete(s.pending, name)
+			s.mu.Unlock()
+			close(d.done)
+		}()
+	}
+	s.mu.Unlock()
+	select {
+	case <-d.done:
+		return d.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,265 @@
+package netbootxyz
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ars1364/go-pxe/fetch"
+)
+
+func sha(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// archive builds a .tar.gz of files; a name ending in "@" becomes a
+// symlink
+func archive(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, data := range files {
+		h := &tar.Header{Name: name, Mode: 0o644, Size: int64(len(data)), Typeflag: tar.TypeReg}
+		if link, ok := strings.CutSuffix(name, "@"); ok {
+			h = &tar.Header{Name: link, Linkname: data, Typeflag: tar.TypeSymlink}
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		if h.Typeflag == tar.TypeReg {
+			tw.Write([]byte(data))
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	gz.Close()
+	return buf.Bytes()
+}
+
+// upstream stands in for GitHub and boot.ipxe.org, serving files by path
+func upstream(t *testing.T, files map[string][]byte) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	}))
+	t.Cleanup(srv.Close)
+
+	f := fetch.New()
+	f.Retries = 0
+	saved, menus, sums, assets := fetch.Default, MenusURL, SumsURL, AssetsURL
+	mirror := loaders[Mirror]
+	t.Cleanup(func() {
+		fetch.Default, MenusURL, SumsURL, AssetsURL = saved, menus, sums, assets
+		loaders[Mirror] = mirror
+	})
+	fetch.Default = f
+	MenusURL, SumsURL, AssetsURL = srv.URL+"/menus.tar.gz", srv.URL+"/sums.txt", srv.URL+"/assets"
+	loaders[Mirror] = map[uint16]string{
+		0:  srv.URL + "/undionly.kpxe",
+		11: srv.URL + "/arm64-efi/ipxe.efi",
+	}
+	return srv
+}
+
+func TestNew(t *testing.T) {
+	if _, err := New("local", false, "", "", ""); err == nil {
+		t.Error("unknown mode accepted")
+	}
+	if _, err := New(Remote, true, "", "", ""); err == nil {
+		t.Error("assets accepted in remote mode")
+	}
+	if s, err := New(Mirror, true, "", "", ""); err != nil || !s.Assets {
+		t.Errorf("New = %+v, %v", s, err)
+	}
+}
+
+func TestScript(t *testing.T) {
+	s, _ := New(Remote, false, "", "", "http://10.0.0.1:8080")
+	if got := string(s.Script("lab")); got != "#!ipxe\n# lab\nchain --autofree https://boot.netboot.xyz\n" {
+		t.Errorf("remote script = %q", got)
+	}
+	s, _ = New(Mirror, false, "", "", "http://10.0.0.1:8080")
+	if got := string(s.Script("lab")); !strings.HasSuffix(got, "chain --autofree http://10.0.0.1:8080/netboot.xyz/menus/menu.ipxe\n") {
+		t.Errorf("mirror script = %q", got)
+	}
+}
+
+func TestSync(t *testing.T) {
+	menus := archive(t, map[string]string{
+		"./menu.ipxe":    "#!ipxe\nmenu",
+		"boot.cfg":       "#!ipxe\nset live_endpoint https://github.com/netbootxyz\nset x 1\n",
+		"sub/linux.ipxe": "#!ipxe\n",
+		"../escape":      "x",
+		"link@":          "/etc/passwd",
+	})
+	upstream(t, map[string][]byte{
+		"/menus.tar.gz":       menus,
+		"/sums.txt":           []byte(sha(menus) + "  menus.tar.gz\n"),
+		"/undionly.kpxe":      []byte("bios"),
+		"/arm64-efi/ipxe.efi": []byte("arm64"),
+	})
+	dir := t.TempDir()
+	tftp, root := filepath.Join(dir, "tftp"), filepath.Join(dir, "http")
+	s, _ := New(Mirror, true, tftp, root, "http://10.0.0.1:8080")
+
+	if f := s.BootFile(0); f != "" {
+		t.Errorf("BootFile before Sync = %q", f)
+	}
+	s.Sync(context.Background())
+
+	for arch, want := range map[uint16]string{0: "netboot.xyz/undionly.kpxe", 11: "netboot.xyz/arm64/ipxe.efi", 7: ""} {
+		if got := s.BootFile(arch); got != want {
+			t.Errorf("BootFile(%d) = %q, want %q", arch, got, want)
+		}
+	}
+	if data, _ := os.ReadFile(filepath.Join(tftp, "netboot.xyz", "arm64", "ipxe.efi")); string(data) != "arm64" {
+		t.Errorf("arm64 build = %q", data)
+	}
+	base := filepath.Join(root, Dir, "menus")
+	cfg, _ := os.ReadFile(filepath.Join(base, "boot.cfg"))
+	if string(cfg) != "#!ipxe\nset live_endpoint http://10.0.0.1:8080/netboot.xyz/assets\nset x 1\n" {
+		t.Errorf("boot.cfg = %q", cfg)
+	}
+	if _, err := os.Stat(filepath.Join(base, "sub", "linux.ipxe")); err != nil {
+		t.Error(err)
+	}
+	for _, name := range []string{filepath.Join(root, Dir, "escape"), filepath.Join(base, "link")} {
+		if _, err := os.Lstat(name); err == nil {
+			t.Errorf("extracted %s", name)
+		}
+	}
+	if tmp, _ := filepath.Glob(filepath.Join(root, Dir, ".menus-*")); len(tmp) != 0 {
+		t.Errorf("left %v behind", tmp)
+	}
+}
+
+func TestSyncKeepsMenus(t *testing.T) {
+	tests := []struct {
+		name  string
+		menus []byte
+	}{
+		{"not gzip", []byte("<html>rate limited</html>")},
+		{"truncated", archive(t, map[string]string{"menu.ipxe": strings.Repeat("x", 4096)})[:100]},
+		{"no menu", archive(t, map[string]string{"boot.cfg": "#!ipxe\n"})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream(t, map[string][]byte{
+				"/menus.tar.gz": tt.menus,
+				"/sums.txt":     []byte(sha(tt.menus) + "  menus.tar.gz\n"),
+			})
+			root := t.TempDir()
+			old := filepath.Join(root, Dir, "menus", "menu.ipxe")
+			os.MkdirAll(filepath.Dir(old), 0o755)
+			os.WriteFile(old, []byte("old"), 0o644)
+			s, _ := New(Mirror, false, t.TempDir(), root, "")
+
+			if err := s.syncMenus(context.Background()); err == nil {
+				t.Error("bad menus accepted")
+			}
+			if data, _ := os.ReadFile(old); string(data) != "old" {
+				t.Errorf("menu.ipxe = %q", data)
+			}
+		})
+	}
+}
+
+func TestSyncChecksum(t *testing.T) {
+	menus := archive(t, map[string]string{"menu.ipxe": "#!ipxe\n"})
+	upstream(t, map[string][]byte{
+		"/menus.tar.gz": menus,
+		"/sums.txt":     []byte(sha([]byte("other")) + "  menus.tar.gz\n"),
+	})
+	root := t.TempDir()
+	s, _ := New(Mirror, false, t.TempDir(), root, "")
+	if err := s.syncMenus(context.Background()); err == nil {
+		t.Error("menus with the wrong checksum accepted")
+	}
+	if _, err := os.Stat(filepath.Join(root, Dir, "menus")); err == nil {
+		t.Error("menus installed")
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	release := make(chan struct{})
+	var fetched atomic.Int32
+	srv := upstream(t, nil)
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/assets/ubuntu-squash/releases/download/24.04/vmlinuz" {
+			http.NotFound(w, r)
+			return
+		}
+		// Each download starts by probing for range support
+		if r.Header.Get("Range") == "bytes=0-0" {
+			fetched.Add(1)
+		}
+		<-release
+		w.Write([]byte("kernel"))
+	})
+	root := t.TempDir()
+	s, _ := New(Mirror, true, t.TempDir(), root, "")
+	mux := http.NewServeMux()
+	mux.Handle("GET /"+Dir+"/assets/{path...}", s)
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", "/"+Dir+"/assets/"+path, nil))
+		return w
+	}
+	const asset = "ubuntu-squash/releases/download/24.04/vmlinuz"
+
+	// A client giving up doesn't stop the download the others wait for
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := s.cache(ctx, asset, filepath.Join(root, Dir, "assets", filepath.FromSlash(asset))); err != context.Canceled {
+		t.Errorf("cancelled client: %v", err)
+	}
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- get(asset) }()
+	close(release)
+	if w := <-done; w.Code != http.StatusOK || w.Body.String() != "kernel" {
+		t.Errorf("asset = %d %q", w.Code, w.Body)
+	}
+	if w := get(asset); w.Code != http.StatusOK || fetched.Load() != 1 {
+		t.Errorf("second request = %d, fetched %d times", w.Code, fetched.Load())
+	}
+	if w := get("missing/vmlinuz"); w.Code != http.StatusBadGateway {
+		t.Errorf("missing asset = %d", w.Code)
+	}
+	if len(s.pending) != 0 {
+		t.Errorf("pending = %v", s.pending)
+	}
+
+	s.Assets = false
+	if w := get(asset); w.Code != http.StatusNotFound {
+		t.Errorf("without Assets = %d", w.Code)
+	}
+}
+
+func TestServeHTTPPaths(t *testing.T) {
+	s, _ := New(Mirror, true, "", t.TempDir(), "")
+	for _, path := range []string{"", "../secret", "a/../../secret", "/etc/passwd"} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.SetPathValue("path", path)
+		s.ServeHTTP(w, r)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%q = %d", path, w.Code)
+		}
+	}
+}
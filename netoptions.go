@@ -0,0 +1,75 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"net"
+	"time"
+)
+
+// checkNetOptions checks that gateway, dnsServers and ntpServers are IPv4
+// addresses, as DHCP advertises them, that the lease time is long enough
+// for clients to renew, and that conflict probes leave time to offer
+func (c domainConfig) checkNetOptions() error {
+	if c.ConflictProbe < 0 || c.ConflictProbe > time.Second {
+		return fmt.Errorf("conflictProbe: %s is not between 0 and 1s", c.ConflictProbe)
+	}
+	if c.LeaseTime < 0 || c.LeaseTime > 0 && c.LeaseTime < time.Minute {
+		return fmt.Errorf("leaseTime: %s is shorter than a minute", c.LeaseTime)
+	}
+	if c.LeaseTime > math.MaxUint32*time.Second {
+		return fmt.Errorf("leaseTime: %s is longer than DHCP allows", c.LeaseTime)
+	}
+	if c.Gateway != "" && net.ParseIP(c.Gateway).To4() == nil {
+		return fmt.Errorf("gateway: %q is not an IPv4 address", c.Gateway)
+	}
+	for name, list := range map[string][]string{"dnsServers": c.DNSServers, "ntpServers": c.NTPServers} {
+		for _, v := range list {
+			if net.ParseIP(v).To4() == nil {
+				return fmt.Errorf("%s: %q is not an IPv4 address", name, v)
+			}
+		}
+	}
+	return nil
+}
+
+// parseIPs parses addresses already checked
+func parseIPs(list []string) []net.IP {
+	var ips []net.IP
+	for _, v := range list {
+		ips = append(ips, net.ParseIP(v))
+	}
+	return ips
+}
+
+// gateway is the router DHCP advertises, nil for the server itself
+func (c domainConfig) gateway() net.IP {
+	if c.Gateway == "" {
+		return nil
+	}
+	return net.ParseIP(c.Gateway)
+}
+
+// dnsServers are the resolvers DHCP advertises, nil for the server itself
+func (c domainConfig) dnsServers() []net.IP {
+	return parseIPs(c.DNSServers)
+}
+
+// ntpServers are the time servers DHCP advertises: NTPServers, else the
+// server itself if it serves NTP
+func (c domainConfig) ntpServers() []net.IP {
+	if len(c.NTPServers) > 0 {
+		return parseIPs(c.NTPServers)
+	}
+	if c.NTP {
+		return []net.IP{net.ParseIP(c.IP)}
+	}
+	return nil
+}
+
+// domainName is the domain name DHCP advertises: DomainName, else the
+// zone the server's DNS serves
+func (c domainConfig) domainName() string {
+	return cmp.Or(c.DomainName, c.DNSDomain)
+}
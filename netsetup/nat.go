@@ -0,0 +1,132 @@
+package netsetup
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+const (
+	nftTable  = "gopxe"
+	pfAnchor  = "com.apple/gopxe" // evaluated by the stock macOS pf.conf nat-anchor "com.apple/*"
+	pfTokenRe = `Token : (\d+)`
+)
+
+// runInput is like run but feeds input to the command's stdin
+func runInput(input, name string, args ...string) (string, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = strings.NewReader(input)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%s %s: %v: %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
+
+func output(name string, args ...string) (string, error) {
+	out, err := exec.Command(name, args...).Output()
+	if err != nil {
+		return "", fmt.Errorf("%s %s: %w", name, strings.Join(args, " "), err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// EnableNAT turns on IPv4 forwarding and masquerades traffic from subnet
+// leaving through uplink, so clients can reach external mirrors mid-install.
+// The returned function removes the rule and restores the previous
+// forwarding setting.
+func EnableNAT(subnet *net.IPNet, uplink string) (func() error, error) {
+	switch runtime.GOOS {
+	case "linux":
+		return enableNATLinux(subnet, uplink)
+	case "darwin":
+		return enableNATDarwin(subnet, uplink)
+	}
+	return nil, fmt.Errorf("NAT not supported on %s", runtime.GOOS)
+}
+
+func enableNATLinux(subnet *net.IPNet, uplink string) (func() error, error) {
+	prev, err := output("sysctl", "-n", "net.ipv4.ip_forward")
+	if err != nil {
+		return nil, err
+	}
+	if err := run("sysctl", "-w", "net.ipv4.ip_forward=1"); err != nil {
+		return nil, err
+	}
+
+	rules := fmt.Sprintf(`table ip %[1]s {
+	chain postrouting {
+		type nat hook postrouting priority srcnat; policy accept;
+		ip saddr %[2]s oifname "%[3]s" masquerade
+	}
+	chain forward {
+		type filter hook forward priority filter; policy accept;
+		ip saddr %[2]s oifname "%[3]s" accept
+		ip daddr %[2]s ct state established,related accept
+	}
+}
+`, nftTable, subnet, uplink)
+	if _, err := runInput(rules, "nft", "-f", "-"); err != nil {
+		run("sysctl", "-w", "net.ipv4.ip_forward="+prev)
+		return nil, err
+	}
+	log.Printf("[NAT] Forwarding enabled, masquerading %s via %s (nft table ip %s)", subnet, uplink, nftTable)
+
+	return func() error {
+		log.Printf("[NAT] Removing nft table ip %s", nftTable)
+		err := run("nft", "delete", "table", "ip", nftTable)
+		if err2 := run("sysctl", "-w", "net.ipv4.ip_forward="+prev); err == nil {
+			err = err2
+		}
+		return err
+	}, nil
+}
+
+func enableNATDarwin(subnet *net.IPNet, uplink string) (func() error, error) {
+	prev, err := output("sysctl", "-n", "net.inet.ip.forwarding")
+	if err != nil {
+		return nil, err
+	}
+	if err := run("sysctl", "-w", "net.inet.ip.forwarding=1"); err != nil {
+		return nil, err
+	}
+	restore := func() error { return run("sysctl", "-w", "net.inet.ip.forwarding="+prev) }
+
+	rule := fmt.Sprintf("nat on %s from %s to any -> (%s)\n", uplink, subnet, uplink)
+	if _, err := runInput(rule, "pfctl", "-a", pfAnchor, "-f", "-"); err != nil {
+		restore()
+		return nil, err
+	}
+
+	// pfctl -E enables pf with a reference token, so we only turn it off
+	// again if nobody else needs it.
+	out, err := runInput("", "pfctl", "-E")
+	if err != nil {
+		run("pfctl", "-a", pfAnchor, "-F", "all")
+		restore()
+		return nil, err
+	}
+	var token string
+	if m := regexp.MustCompile(pfTokenRe).FindStringSubmatch(out); m != nil {
+		token = m[1]
+	}
+	log.Printf("[NAT] Forwarding enabled, masquerading %s via %s (pf anchor %s)", subnet, uplink, pfAnchor)
+
+	return func() error {
+		log.Printf("[NAT] Flushing pf anchor %s", pfAnchor)
+		err := run("pfctl", "-a", pfAnchor, "-F", "all")
+		if token != "" {
+			if err2 := run("pfctl", "-X", token); err == nil {
+				err = err2
+			}
+		}
+		if err2 := restore(); err == nil {
+			err = err2
+		}
+		return err
+	}, nil
+}
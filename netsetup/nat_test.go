@@ -0,0 +1,112 @@
+package netsetup
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// output is what tool prints when run
+func (f *tools) output(tool, out string) {
+	if err := os.WriteFile(filepath.Join(f.dir, tool+".out"), []byte(out), 0o644); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+func TestNATLinux(t *testing.T) {
+	f := fakeTools(t)
+	f.output("sysctl", "0\n")
+	_, subnet, _ := net.ParseCIDR("10.0.0.0/24")
+
+	undo, err := enableNATLinux(subnet, "eth1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := f.calls()
+	if !slices.Equal(calls[:3], []string{"sysctl -n net.ipv4.ip_forward", "sysctl -w net.ipv4.ip_forward=1", "nft -f -"}) {
+		t.Errorf("ran %q", calls)
+	}
+	rules := strings.Join(calls[3:], "\n")
+	for _, want := range []string{"table ip gopxe {", `ip saddr 10.0.0.0/24 oifname "eth1" masquerade`, "ip daddr 10.0.0.0/24 ct state established,related accept"} {
+		if !strings.Contains(rules, want) {
+			t.Errorf("rules lack %q:\n%s", want, rules)
+		}
+	}
+	if err := undo(); err != nil {
+		t.Fatal(err)
+	}
+	if calls := f.calls(); !slices.Equal(calls, []string{"nft delete table ip gopxe", "sysctl -w net.ipv4.ip_forward=0"}) {
+		t.Errorf("undo ran %q", calls)
+	}
+
+	// Forwarding is restored even if the table is gone already
+	undo, _ = enableNATLinux(subnet, "eth1")
+	f.calls()
+	f.fail("nft delete *")
+	if err := undo(); err == nil || !slices.Contains(f.calls(), "sysctl -w net.ipv4.ip_forward=0") {
+		t.Errorf("undo with the table gone: %v", err)
+	}
+}
+
+func TestNATLinuxFailure(t *testing.T) {
+	f := fakeTools(t)
+	f.output("sysctl", "1\n")
+	f.fail("nft *")
+	_, subnet, _ := net.ParseCIDR("10.0.0.0/24")
+	if undo, err := enableNATLinux(subnet, "eth1"); err == nil || undo != nil {
+		t.Fatal("nft failure not reported")
+	}
+	if calls := f.calls(); calls[len(calls)-1] != "sysctl -w net.ipv4.ip_forward=1" {
+		t.Errorf("forwarding not restored: %q", calls)
+	}
+
+	f.fail("sysctl -n *")
+	if _, err := enableNATLinux(subnet, "eth1"); err == nil {
+		t.Error("unreadable forwarding setting ignored")
+	}
+	if calls := f.calls(); len(calls) != 1 {
+		t.Errorf("ran %q", calls)
+	}
+}
+
+func TestNATDarwin(t *testing.T) {
+	f := fakeTools(t)
+	f.output("sysctl", "0\n")
+	f.output("pfctl", "pf enabled\nToken : 12345\n")
+	_, subnet, _ := net.ParseCIDR("10.0.0.0/24")
+
+	undo, err := enableNATDarwin(subnet, "en0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"sysctl -n net.inet.ip.forwarding",
+		"sysctl -w net.inet.ip.forwarding=1",
+		"pfctl -a com.apple/gopxe -f -",
+		"nat on en0 from 10.0.0.0/24 to any -> (en0)",
+		"pfctl -E",
+	}
+	if calls := f.calls(); !slices.Equal(calls, want) {
+		t.Errorf("ran %q\nwant %q", calls, want)
+	}
+	if err := undo(); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{"pfctl -a com.apple/gopxe -F all", "pfctl -X 12345", "sysctl -w net.inet.ip.forwarding=0"}
+	if calls := f.calls(); !slices.Equal(calls, want) {
+		t.Errorf("undo ran %q\nwant %q", calls, want)
+	}
+
+	// pf refusing to start leaves no rules behind
+	f.fail("pfctl -E")
+	if _, err := enableNATDarwin(subnet, "en0"); err == nil {
+		t.Fatal("pfctl -E failure not reported")
+	}
+	calls := f.calls()
+	if !slices.Equal(calls[len(calls)-2:], []string{"pfctl -a com.apple/gopxe -F all", "sysctl -w net.inet.ip.forwarding=0"}) {
+		t.Errorf("ran %q", calls)
+	}
+}
@@ -0,0 +1,148 @@
+package netsetup
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// SetNeighbor installs a static ARP entry for ip at mac on iface,
+// replacing any entry ip has
+func SetNeighbor(iface string, ip net.IP, mac net.HardwareAddr) error {
+	switch runtime.GOOS {
+	case "linux":
+		return run("ip", "neigh", "replace", ip.String(), "lladdr", mac.String(), "dev", iface, "nud", "permanent")
+	case "darwin":
+		return run("arp", "-S", ip.String(), mac.String(), "ifscope", iface)
+	}
+	return fmt.Errorf("static ARP entries not supported on %s", runtime.GOOS)
+}
+
+// DeleteNeighbor removes ip's ARP entry from iface
+func DeleteNeighbor(iface string, ip net.IP) error {
+	switch runtime.GOOS {
+	case "linux":
+		return run("ip", "neigh", "del", ip.String(), "dev", iface)
+	case "darwin":
+		return run("arp", "-d", ip.String(), "ifscope", iface)
+	}
+	return fmt.Errorf("static ARP entries not supported on %s", runtime.GOOS)
+}
+
+// Neighbors keeps static ARP entries on an interface for a while after
+// they were last set, such as for the addresses DHCP offers, so unicast
+// reaches clients before they have answered an ARP request. A nil
+// *Neighbors does nothing.
+type Neighbors struct {
+	iface string
+	ttl   time.Duration
+
+	mu      sync.Mutex
+	entries map[string]neighbor // by IP
+	done    chan struct{}
+}
+
+type neighbor struct {
+	ip        net.IP
+	mac       net.HardwareAddr
+	expires   time.Time
+	installed bool // false if installing it failed, so it isn't retried
+}
+
+// NewNeighbors manages static ARP entries on iface, each removed ttl after
+// it was last set
+func NewNeighbors(iface string, ttl time.Duration) *Neighbors {
+	n := &Neighbors{iface: iface, ttl: ttl, entries: make(map[string]neighbor), done: make(chan struct{})}
+	go n.expire()
+	return n
+}
+
+// Set installs or renews the entry for ip at mac. Entries mac had for
+// other addresses, from a lease that moved, are removed.
+func (n *Neighbors) Set(ip net.IP, mac net.HardwareAddr) {
+	if n == nil {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	key := ip.String()
+	e, ok := n.entries[key]
+	if ok && e.mac.String() == mac.String() {
+		e.expires = time.Now().Add(n.ttl)
+		n.entries[key] = e
+		return
+	}
+	for _, other := range n.entries {
+		if other.mac.String() == mac.String() {
+			n.delete(other)
+		}
+	}
+	e = neighbor{ip: ip, mac: mac, expires: time.Now().Add(n.ttl)}
+	err := SetNeighbor(n.iface, ip, mac)
+	e.installed = err == nil
+	n.entries[key] = e
+	if err != nil {
+		log.Printf("[NET] Static ARP entry %s -> %s: %v", ip, mac, err)
+		return
+	}
+	log.Printf("[NET] Static ARP entry %s -> %s on %s", ip, mac, n.iface)
+}
+
+// Remove removes the entry for ip, if there is one
+func (n *Neighbors) Remove(ip net.IP) {
+	if n == nil {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if e, ok := n.entries[ip.String()]; ok {
+		n.delete(e)
+	}
+}
+
+// Close stops expiring entries and removes them all
+func (n *Neighbors) Close() {
+	if n == nil {
+		return
+	}
+	close(n.done)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, e := range n.entries {
+		n.delete(e)
+	}
+}
+
+// expire removes the entries not renewed in time, until Close
+func (n *Neighbors) expire() {
+	tick := time.NewTicker(time.Minute)
+	defer tick.Stop()
+	for {
+		select {
+		case <-n.done:
+			return
+		case now := <-tick.C:
+			n.mu.Lock()
+			for _, e := range n.entries {
+				if now.After(e.expires) {
+					n.delete(e)
+				}
+			}
+			n.mu.Unlock()
+		}
+	}
+}
+
+// delete removes an entry; n.mu is held
+func (n *Neighbors) delete(e neighbor) {
+	delete(n.entries, e.ip.String())
+	if !e.installed {
+		return
+	}
+	if err := DeleteNeighbor(n.iface, e.ip); err != nil {
+		log.Printf("[NET] Removing static ARP entry %s: %v", e.ip, err)
+	}
+}
@@ -0,0 +1,72 @@
+package netsetup
+
+import (
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestNeighbors(t *testing.T) {
+	supported(t)
+	f := fakeTools(t)
+	mac1, _ := net.ParseMAC("aa:bb:cc:dd:ee:01")
+	mac2, _ := net.ParseMAC("aa:bb:cc:dd:ee:02")
+	ip1, ip2, ip3 := net.IPv4(10, 0, 0, 5), net.IPv4(10, 0, 0, 6), net.IPv4(10, 0, 0, 7)
+	set := func(ip string, mac net.HardwareAddr) map[string][]string {
+		return map[string][]string{
+			"linux":  {"ip neigh replace " + ip + " lladdr " + mac.String() + " dev eth0 nud permanent"},
+			"darwin": {"arp -S " + ip + " " + mac.String() + " ifscope eth0"},
+		}
+	}
+	del := func(ip string) map[string][]string {
+		return map[string][]string{
+			"linux":  {"ip neigh del " + ip + " dev eth0"},
+			"darwin": {"arp -d " + ip + " ifscope eth0"},
+		}
+	}
+	n := NewNeighbors("eth0", time.Hour)
+
+	n.Set(ip1, mac1)
+	f.expect(set("10.0.0.5", mac1))
+	n.Set(ip1, mac1) // renewed, not reinstalled
+	f.expect(nil)
+
+	// The lease moved: the old address's entry goes
+	n.Set(ip2, mac1)
+	if got := f.calls(); len(got) != 2 || got[0] != del("10.0.0.5")[runtime.GOOS][0] || got[1] != set("10.0.0.6", mac1)[runtime.GOOS][0] {
+		t.Errorf("moving the lease ran %q", got)
+	}
+
+	// An entry that failed to install isn't deleted
+	f.fail("ip neigh replace *", "arp -S *")
+	n.Set(ip3, mac2)
+	f.expect(set("10.0.0.7", mac2))
+	n.Remove(ip3)
+	f.expect(nil)
+	f.fail()
+
+	n.Remove(ip2)
+	f.expect(del("10.0.0.6"))
+	n.Remove(ip2)
+	f.expect(nil)
+
+	n.Set(ip1, mac2)
+	f.calls()
+	n.Close()
+	f.expect(del("10.0.0.5"))
+	if len(n.entries) != 0 {
+		t.Errorf("entries left: %v", n.entries)
+	}
+}
+
+func TestNilNeighbors(t *testing.T) {
+	f := fakeTools(t)
+	var n *Neighbors
+	n.Set(net.IPv4(10, 0, 0, 5), net.HardwareAddr{0xaa, 0, 0, 0, 0, 1})
+	n.Remove(net.IPv4(10, 0, 0, 5))
+	n.Close()
+	if calls := f.calls(); calls != nil {
+		t.Errorf("ran %q", calls)
+	}
+}
@@ -0,0 +1,123 @@
+// Package netsetup configures the host network stack (addresses, forwarding,
+// firewall rules) by driving the platform's own tools: ifconfig/pfctl/sysctl
+// on macOS and ip/nft/sysctl on Linux.
+package netsetup
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// run executes a system command and folds its output into the error
+func run(name string, args ...string) error {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %v: %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// AddAddress assigns addr to iface and brings the interface up
+func AddAddress(iface string, addr *net.IPNet) error {
+	ones, _ := addr.Mask.Size()
+	log.Printf("[NET] Assigning %s/%d to %s", addr.IP, ones, iface)
+	switch runtime.GOOS {
+	case "darwin":
+		return run("ifconfig", iface, "alias", addr.IP.String(), "netmask", net.IP(addr.Mask).String(), "up")
+	case "linux":
+		if err := run("ip", "addr", "add", fmt.Sprintf("%s/%d", addr.IP, ones), "dev", iface); err != nil {
+			return err
+		}
+		return run("ip", "link", "set", iface, "up")
+	}
+	return fmt.Errorf("address assignment not supported on %s", runtime.GOOS)
+}
+
+// RemoveAddress undoes AddAddress
+func RemoveAddress(iface string, addr *net.IPNet) error {
+	ones, _ := addr.Mask.Size()
+	log.Printf("[NET] Removing %s/%d from %s", addr.IP, ones, iface)
+	switch runtime.GOOS {
+	case "darwin":
+		return run("ifconfig", iface, "-alias", addr.IP.String())
+	case "linux":
+		return run("ip", "addr", "del", fmt.Sprintf("%s/%d", addr.IP, ones), "dev", iface)
+	}
+	return fmt.Errorf("address removal not supported on %s", runtime.GOOS)
+}
+
+// Candidate /24s for zero-config mode, tried in order. The first entry
+// matches the documented defaults; the rest are less common picks.
+var candidateSubnets = func() []*net.IPNet {
+	var list []*net.IPNet
+	add := func(a, b, c byte) {
+		list = append(list, &net.IPNet{IP: net.IPv4(a, b, c, 0).To4(), Mask: net.CIDRMask(24, 32)})
+	}
+	add(10, 0, 0)
+	add(10, 77, 77)
+	add(172, 31, 77)
+	add(192, 168, 77)
+	for i := 1; i < 255; i++ {
+		add(10, byte(i), 0)
+	}
+	return list
+}()
+
+// InterfaceIPv4 returns the first IPv4 address configured on iface, if any
+func InterfaceIPv4(iface string) (*net.IPNet, error) {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range addrs {
+		if ipn, ok := a.(*net.IPNet); ok && ipn.IP.To4() != nil {
+			return &net.IPNet{IP: ipn.IP.To4(), Mask: ipn.Mask}, nil
+		}
+	}
+	return nil, nil
+}
+
+// PickFreeSubnet returns an RFC1918 /24 that does not overlap any network
+// configured on this host.
+func PickFreeSubnet() (*net.IPNet, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	var inUse []*net.IPNet
+	for _, a := range addrs {
+		if ipn, ok := a.(*net.IPNet); ok && ipn.IP.To4() != nil {
+			inUse = append(inUse, ipn)
+		}
+	}
+
+	for _, cand := range candidateSubnets {
+		free := true
+		for _, used := range inUse {
+			if used.Contains(cand.IP) || cand.Contains(used.IP) {
+				free = false
+				break
+			}
+		}
+		if free {
+			return cand, nil
+		}
+	}
+	return nil, fmt.Errorf("no free RFC1918 /24 found")
+}
+
+// HostAddr returns the n-th address inside subnet
+func HostAddr(subnet *net.IPNet, n byte) net.IP {
+	ip := make(net.IP, 4)
+	copy(ip, subnet.IP.To4())
+	ip[3] += n
+	return ip
+}
@@ -0,0 +1,156 @@
+package netsetup
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// tools are fake ip, ifconfig, sysctl, nft, pfctl and arp commands that
+// log their command lines, and what they are fed on stdin when reading
+// from "-"
+type tools struct {
+	t   *testing.T
+	dir string
+}
+
+// fakeTools puts the fake tools first on PATH
+func fakeTools(t *testing.T) *tools {
+	dir := t.TempDir()
+	script := `#!/bin/sh
+line="$(basename "$0") $*"
+echo "$line" >> ` + dir + `/log
+case " $*" in *" -") cat >> ` + dir + `/log ;; esac
+set -f
+IFS='
+'
+for pattern in $FAKE_FAIL; do
+	case "$line" in $pattern) echo "$line failed"; exit 1 ;; esac
+done
+out=` + dir + `/$(basename "$0").out
+if [ -f "$out" ]; then cat "$out"; fi
+`
+	for _, name := range []string{"ip", "ifconfig", "sysctl", "nft", "pfctl", "arp"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(script), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	t.Setenv("FAKE_FAIL", "")
+	return &tools{t, dir}
+}
+
+// fail makes the command lines matching any of the shell patterns fail
+func (f *tools) fail(patterns ...string) {
+	f.t.Setenv("FAKE_FAIL", strings.Join(patterns, "\n"))
+}
+
+// calls returns the lines logged so far and clears the log
+func (f *tools) calls() []string {
+	data, _ := os.ReadFile(filepath.Join(f.dir, "log"))
+	os.Remove(filepath.Join(f.dir, "log"))
+	if len(data) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+// expect checks the calls against the ones wanted on this platform
+func (f *tools) expect(want map[string][]string) {
+	f.t.Helper()
+	if got := f.calls(); !slices.Equal(got, want[runtime.GOOS]) {
+		f.t.Errorf("ran %q\nwant %q", got, want[runtime.GOOS])
+	}
+}
+
+func supported(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+		t.Skip("not supported on " + runtime.GOOS)
+	}
+}
+
+func TestAddress(t *testing.T) {
+	supported(t)
+	f := fakeTools(t)
+	_, subnet, _ := net.ParseCIDR("10.0.0.0/24")
+	addr := &net.IPNet{IP: HostAddr(subnet, 1), Mask: subnet.Mask}
+
+	if err := AddAddress("eth0", addr); err != nil {
+		t.Fatal(err)
+	}
+	f.expect(map[string][]string{
+		"linux":  {"ip addr add 10.0.0.1/24 dev eth0", "ip link set eth0 up"},
+		"darwin": {"ifconfig eth0 alias 10.0.0.1 netmask 255.255.255.0 up"},
+	})
+	if err := RemoveAddress("eth0", addr); err != nil {
+		t.Fatal(err)
+	}
+	f.expect(map[string][]string{
+		"linux":  {"ip addr del 10.0.0.1/24 dev eth0"},
+		"darwin": {"ifconfig eth0 -alias 10.0.0.1"},
+	})
+
+	f.fail("ip addr add *", "ifconfig *")
+	err := AddAddress("eth0", addr)
+	if err == nil || !strings.Contains(err.Error(), " 10.0.0.1") || !strings.HasSuffix(err.Error(), "failed") {
+		t.Errorf("failed command: %v", err)
+	}
+	if runtime.GOOS == "linux" && len(f.calls()) != 1 {
+		t.Error("interface brought up without its address")
+	}
+}
+
+func TestHostAddr(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("192.168.77.0/24")
+	if ip := HostAddr(subnet, 10); !ip.Equal(net.IPv4(192, 168, 77, 10)) {
+		t.Errorf("HostAddr = %s", ip)
+	}
+	if !subnet.IP.Equal(net.IPv4(192, 168, 77, 0)) {
+		t.Errorf("subnet changed to %s", subnet)
+	}
+}
+
+func TestCandidateSubnets(t *testing.T) {
+	if first := candidateSubnets[0].String(); first != "10.0.0.0/24" {
+		t.Errorf("first candidate = %s", first)
+	}
+	seen := make(map[string]bool)
+	for _, c := range candidateSubnets {
+		if ones, bits := c.Mask.Size(); ones != 24 || bits != 32 || !c.IP.IsPrivate() || seen[c.String()] {
+			t.Errorf("candidate %s", c)
+		}
+		seen[c.String()] = true
+	}
+}
+
+func TestPickFreeSubnet(t *testing.T) {
+	subnet, err := PickFreeSubnet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrs, _ := net.InterfaceAddrs()
+	for _, a := range addrs {
+		if ipn, ok := a.(*net.IPNet); ok && (ipn.Contains(subnet.IP) || subnet.Contains(ipn.IP)) {
+			t.Errorf("picked %s, which overlaps %s", subnet, ipn)
+		}
+	}
+}
+
+func TestInterfaceIPv4(t *testing.T) {
+	ifaces, _ := net.Interfaces()
+	i := slices.IndexFunc(ifaces, func(ifi net.Interface) bool { return ifi.Flags&net.FlagLoopback != 0 })
+	if i < 0 {
+		t.Skip("no loopback interface")
+	}
+	addr, err := InterfaceIPv4(ifaces[i].Name)
+	if err != nil || addr == nil || !addr.IP.IsLoopback() || len(addr.IP) != 4 {
+		t.Errorf("InterfaceIPv4(%s) = %v, %v", ifaces[i].Name, addr, err)
+	}
+	if _, err := InterfaceIPv4("nonexistent0"); err == nil {
+		t.Error("unknown interface accepted")
+	}
+}
@@ -0,0 +1,108 @@
+package netsetup
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// InUse reports whether a machine answers for ip within timeout: to an
+// ICMP echo request, or to the ARP request the kernel sends on iface to
+// deliver it, which hosts firewalling ICMP answer too. Static ARP entries,
+// such as those Neighbors installs, don't count.
+func InUse(iface string, ip net.IP, timeout time.Duration) (bool, error) {
+	conn, err := net.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	id, seq := uint16(rand.Uint32()), uint16(rand.Uint32())
+	if _, err := conn.WriteTo(echoRequest(id, seq), &net.IPAddr{IP: ip}); err != nil {
+		return false, err
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		var ne net.Error
+		if errors.As(err, &ne) && ne.Timeout() {
+			break
+		}
+		if err != nil {
+			return false, err
+		}
+		// An echo reply (type 0) to this request
+		msg := buf[:n]
+		if len(msg) >= 8 && msg[0] == 0 && from.(*net.IPAddr).IP.Equal(ip) &&
+			binary.BigEndian.Uint16(msg[4:6]) == id && binary.BigEndian.Uint16(msg[6:8]) == seq {
+			return true, nil
+		}
+	}
+	return arpAnswered(iface, ip)
+}
+
+// echoRequest is an ICMP echo request with identifier id and sequence
+// number seq
+func echoRequest(id, seq uint16) []byte {
+	msg := []byte{8, 0, 0, 0, 0, 0, 0, 0, 'g', 'o', '-', 'p', 'x', 'e'}
+	binary.BigEndian.PutUint16(msg[4:6], id)
+	binary.BigEndian.PutUint16(msg[6:8], seq)
+	var sum uint32
+	for i := 0; i+1 < len(msg); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(msg[i:]))
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	binary.BigEndian.PutUint16(msg[2:4], ^uint16(sum))
+	return msg
+}
+
+// arpTable is the kernel's ARP table on Linux
+var arpTable = "/proc/net/arp"
+
+// arpAnswered reports whether iface's ARP table has a learned (complete,
+// not static) entry for ip
+func arpAnswered(iface string, ip net.IP) (bool, error) {
+	switch runtime.GOOS {
+	case "linux":
+		f, err := os.Open(arpTable)
+		if err != nil {
+			return false, err
+		}
+		defer f.Close()
+		// IP address, HW type, Flags, HW address, Mask, Device
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			fields := strings.Fields(sc.Text())
+			if len(fields) < 6 || fields[0] != ip.String() || fields[5] != iface {
+				continue
+			}
+			flags, err := strconv.ParseUint(fields[2], 0, 32)
+			if err != nil {
+				continue
+			}
+			const complete, permanent = 0x2, 0x4
+			return flags&complete != 0 && flags&permanent == 0, nil
+		}
+		return false, sc.Err()
+	case "darwin":
+		// "? (10.0.0.5) at 0:11:22:33:44:55 on en7 ifscope [ethernet]", with
+		// "(incomplete)" for no answer and "permanent" for static entries
+		out, err := output("arp", "-n", "-i", iface, ip.String())
+		if err != nil {
+			return false, nil // no entry
+		}
+		return strings.Contains(out, " at ") && !strings.Contains(out, "(incomplete)") && !strings.Contains(out, "permanent"), nil
+	}
+	return false, fmt.Errorf("ARP table not supported on %s", runtime.GOOS)
+}
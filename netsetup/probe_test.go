@@ -0,0 +1,101 @@
+package netsetup
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestEchoRequest(t *testing.T) {
+	msg := echoRequest(0x1234, 0xbeef)
+	if msg[0] != 8 || msg[1] != 0 || binary.BigEndian.Uint16(msg[4:]) != 0x1234 || binary.BigEndian.Uint16(msg[6:]) != 0xbeef {
+		t.Errorf("echo request = %x", msg)
+	}
+	// The ones' complement sum over a message with its checksum is all ones
+	var sum uint32
+	for i := 0; i < len(msg); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(msg[i:]))
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	if sum != 0xffff {
+		t.Errorf("checksum %x doesn't verify", msg[2:4])
+	}
+}
+
+func TestARPAnsweredLinux(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("reads /proc/net/arp")
+	}
+	arpTable = filepath.Join(t.TempDir(), "arp")
+	defer func() { arpTable = "/proc/net/arp" }()
+	os.WriteFile(arpTable, []byte(`IP address       HW type     Flags       HW address            Mask     Device
+10.0.0.5         0x1         0x2         00:11:22:33:44:55     *        eth0
+10.0.0.6         0x1         0x0         00:00:00:00:00:00     *        eth0
+10.0.0.7         0x1         0x6         00:11:22:33:44:57     *        eth0
+10.0.0.8         0x1         0x2         00:11:22:33:44:58     *        eth1
+10.0.0.9         0x1         zz          00:11:22:33:44:59     *        eth0
+10.0.0.10        0x1
+`), 0o644)
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"10.0.0.5", true},   // learned
+		{"10.0.0.6", false},  // incomplete
+		{"10.0.0.7", false},  // static
+		{"10.0.0.8", false},  // on another interface
+		{"10.0.0.9", false},  // unreadable flags
+		{"10.0.0.10", false}, // truncated line
+		{"10.0.0.11", false}, // absent
+	}
+	for _, tt := range tests {
+		if got, err := arpAnswered("eth0", net.ParseIP(tt.ip)); got != tt.want || err != nil {
+			t.Errorf("arpAnswered(%s) = %v, %v", tt.ip, got, err)
+		}
+	}
+
+	arpTable = filepath.Join(t.TempDir(), "missing")
+	if _, err := arpAnswered("eth0", net.ParseIP("10.0.0.5")); err == nil {
+		t.Error("missing ARP table not reported")
+	}
+}
+
+func TestARPAnsweredDarwin(t *testing.T) {
+	if runtime.GOOS != "darwin" {
+		t.Skip("runs arp")
+	}
+	f := fakeTools(t)
+	tests := []struct {
+		out  string
+		want bool
+	}{
+		{"? (10.0.0.5) at 0:11:22:33:44:55 on en7 ifscope [ethernet]", true},
+		{"? (10.0.0.5) at (incomplete) on en7 ifscope [ethernet]", false},
+		{"? (10.0.0.5) at 0:11:22:33:44:55 on en7 ifscope permanent [ethernet]", false},
+		{"10.0.0.5 (10.0.0.5) -- no entry", false},
+	}
+	for _, tt := range tests {
+		f.output("arp", tt.out)
+		if got, err := arpAnswered("en7", net.ParseIP("10.0.0.5")); got != tt.want || err != nil {
+			t.Errorf("%q: arpAnswered = %v, %v", tt.out, got, err)
+		}
+	}
+}
+
+func TestInUse(t *testing.T) {
+	if conn, err := net.ListenPacket("ip4:icmp", "0.0.0.0"); err != nil {
+		t.Skip("no raw ICMP socket: ", err)
+	} else {
+		conn.Close()
+	}
+	used, err := InUse("lo", net.IPv4(127, 0, 0, 1), time.Second)
+	if err != nil || !used {
+		t.Errorf("loopback: InUse = %v, %v", used, err)
+	}
+}
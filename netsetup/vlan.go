@@ -0,0 +1,61 @@
+package netsetup
+
+import (
+	"fmt"
+	"log"
+	"runtime"
+)
+
+// Longest interface name Linux accepts (IFNAMSIZ minus the NUL)
+const maxIfaceName = 15
+
+// VLANName is the name of the 802.1Q sub-interface of parent tagged with
+// id: parent.id on Linux (eth0.100, or vlan100 if that is too long) and
+// vlan<id> on macOS, which only accepts vlanN names
+func VLANName(parent string, id int) string {
+	name := fmt.Sprintf("%s.%d", parent, id)
+	if runtime.GOOS != "linux" || len(name) > maxIfaceName {
+		name = fmt.Sprintf("vlan%d", id)
+	}
+	return name
+}
+
+// AddVLAN creates the sub-interface of parent tagged with id and brings it
+// up. The returned function deletes it again.
+func AddVLAN(parent string, id int) (func() error, error) {
+	name := VLANName(parent, id)
+	log.Printf("[NET] Creating %s (VLAN %d on %s)", name, id, parent)
+	switch runtime.GOOS {
+	case "linux":
+		if err := run("ip", "link", "add", "link", parent, "name", name, "type", "vlan", "id", fmt.Sprint(id)); err != nil {
+			return nil, err
+		}
+		remove := func() error {
+			log.Printf("[NET] Deleting %s", name)
+			return run("ip", "link", "del", name)
+		}
+		if err := run("ip", "link", "set", parent, "up"); err != nil {
+			remove()
+			return nil, err
+		}
+		if err := run("ip", "link", "set", name, "up"); err != nil {
+			remove()
+			return nil, err
+		}
+		return remove, nil
+	case "darwin":
+		if err := run("ifconfig", name, "create"); err != nil {
+			return nil, err
+		}
+		remove := func() error {
+			log.Printf("[NET] Destroying %s", name)
+			return run("ifconfig", name, "destroy")
+		}
+		if err := run("ifconfig", name, "vlan", fmt.Sprint(id), "vlandev", parent, "up"); err != nil {
+			remove()
+			return nil, err
+		}
+		return remove, nil
+	}
+	return nil, fmt.Errorf("VLAN interfaces not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,72 @@
+package netsetup
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestVLANName(t *testing.T) {
+	tests := []struct {
+		parent        string
+		id            int
+		linux, darwin string
+	}{
+		{"eth0", 100, "eth0.100", "vlan100"},
+		{"enp3s0f1", 4094, "enp3s0f1.4094", "vlan4094"},
+		{"enx00e04c680001", 7, "vlan7", "vlan7"},
+	}
+	for _, tt := range tests {
+		want := tt.linux
+		if runtime.GOOS != "linux" {
+			want = tt.darwin
+		}
+		if got := VLANName(tt.parent, tt.id); got != want || len(got) > maxIfaceName {
+			t.Errorf("VLANName(%s, %d) = %s, want %s", tt.parent, tt.id, got, want)
+		}
+	}
+}
+
+func TestAddVLAN(t *testing.T) {
+	supported(t)
+	f := fakeTools(t)
+	remove, err := AddVLAN("eth0", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.expect(map[string][]string{
+		"linux":  {"ip link add link eth0 name eth0.100 type vlan id 100", "ip link set eth0 up", "ip link set eth0.100 up"},
+		"darwin": {"ifconfig vlan100 create", "ifconfig vlan100 vlan 100 vlandev eth0 up"},
+	})
+	if err := remove(); err != nil {
+		t.Fatal(err)
+	}
+	f.expect(map[string][]string{
+		"linux":  {"ip link del eth0.100"},
+		"darwin": {"ifconfig vlan100 destroy"},
+	})
+}
+
+func TestAddVLANFailure(t *testing.T) {
+	supported(t)
+	f := fakeTools(t)
+
+	// Created but not brought up: deleted again
+	f.fail("ip link set eth0.100 up", "ifconfig vlan100 vlan *")
+	if remove, err := AddVLAN("eth0", 100); err == nil || remove != nil {
+		t.Fatal("failure not reported")
+	}
+	f.expect(map[string][]string{
+		"linux":  {"ip link add link eth0 name eth0.100 type vlan id 100", "ip link set eth0 up", "ip link set eth0.100 up", "ip link del eth0.100"},
+		"darwin": {"ifconfig vlan100 create", "ifconfig vlan100 vlan 100 vlandev eth0 up", "ifconfig vlan100 destroy"},
+	})
+
+	// Not created: nothing to delete
+	f.fail("ip link add *", "ifconfig * create")
+	if _, err := AddVLAN("eth0", 100); err == nil {
+		t.Fatal("failure not reported")
+	}
+	f.expect(map[string][]string{
+		"linux":  {"ip link add link eth0 name eth0.100 type vlan id 100"},
+		"darwin": {"ifconfig vlan100 create"},
+	})
+}
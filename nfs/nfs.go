@@ -0,0 +1,528 @@
+// Package nfs is an embedded NFSv3 server (with MOUNT and a minimal
+// portmapper) exporting a root filesystem directory to nfsroot clients,
+// read-only or through per-client copy-on-write overlays.
+package nfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ars1364/go-pxe/disk"
+)
+
+// NFSv3 status codes (RFC 1813)
+const (
+	nfsOK          = 0
+	nfsErrNoEnt    = 2
+	nfsErrIO       = 5
+	nfsErrAccess   = 13
+	nfsErrExist    = 17
+	nfsErrNotDir   = 20
+	nfsErrIsDir    = 21
+	nfsErrInval    = 22
+	nfsErrNoSpc    = 28
+	nfsErrROFS     = 30
+	nfsErrNotEmpty = 66
+	nfsErrStale    = 70
+	nfsErrNotSupp  = 10004
+)
+
+// ACCESS bits a read-only export can grant
+const accessRead = 0x01 | 0x02 | 0x20 // READ, LOOKUP, EXECUTE
+
+const (
+	maxRead    = 32 << 10 // fits a UDP datagram
+	handleSize = 12
+)
+
+var handleMagic = []byte("gpx1")
+
+// Server exports a directory over NFSv3
+type Server struct {
+	root string
+	host string
+	port int
+
+	// Overlays, if set, makes the export writable: each client's changes
+	// go to its own upper directory under <Overlays>/<client>/nfs/, leaving
+	// the shared root untouched
+	Overlays string
+
+	// ClientID names a client's overlay directory (default: its IP)
+	ClientID func(remote net.IP) string
+
+	mu    sync.Mutex
+	views map[string]*view // client ID ("" when read-only) -> view
+	verf  uint64           // write verifier; changes on restart
+}
+
+func NewServer(root string) *Server {
+	return &Server{root: root, views: make(map[string]*view), verf: uint64(time.Now().UnixNano())}
+}
+
+// ListenAndServe serves NFS and MOUNT on addr (normally <ip>:2049). A
+// portmapper on port 111 of the same address points clients at it; if that
+// port is taken, clients must pass mountport= and port= themselves.
+func (s *Server) ListenAndServe(addr string) error {
+	host, port, err := splitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	s.host, s.port = host, port
+
+	go func() {
+		pmap := net.JoinHostPort(host, "111")
+		if err := s.serveRPC(pmap); err != nil {
+			log.Printf("[NFS] Portmapper unavailable on %s: %v (clients need port=%d,mountport=%d)", pmap, err, port, port)
+		}
+	}()
+
+	if s.Overlays != "" {
+		log.Printf("[NFS] Exporting %s on %s with per-client overlays in %s", s.root, addr, s.Overlays)
+	} else {
+		log.Printf("[NFS] Exporting %s read-only on %s", s.root, addr)
+	}
+	if err := s.serveRPC(addr); err != nil {
+		return fmt.Errorf("NFS listen: %w", err)
+	}
+	return nil
+}
+
+// view returns the filesystem remote sees
+func (s *Server) view(remote net.IP) *view {
+	id, upper := "", ""
+	if s.Overlays != "" {
+		id = remote.String()
+		if s.ClientID != nil {
+			id = s.ClientID(remote)
+		}
+		upper = filepath.Join(disk.ClientDir(s.Overlays, id), "nfs")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.views[id]
+	if !ok {
+		v = newView(s.root, upper)
+		s.views[id] = v
+	}
+	return v
+}
+
+func relPath(rel string) string {
+	rel = filepath.ToSlash(rel)
+	if rel == "." {
+		return ""
+	}
+	return rel
+}
+
+func errStatus(err error) uint32 {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return nfsErrNoEnt
+	case errors.Is(err, fs.ErrPermission):
+		return nfsErrAccess
+	case errors.Is(err, fs.ErrExist):
+		return nfsErrExist
+	case errors.Is(err, syscall.ENOTDIR):
+		return nfsErrNotDir
+	case errors.Is(err, syscall.EISDIR):
+		return nfsErrIsDir
+	case errors.Is(err, syscall.ENOTEMPTY):
+		return nfsErrNotEmpty
+	case errors.Is(err, syscall.ENOSPC):
+		return nfsErrNoSpc
+	case errors.Is(err, errors.ErrUnsupported):
+		return nfsErrNotSupp
+	}
+	return nfsErrIO
+}
+
+// putAttr encodes fattr3 for rel
+func (v *view) putAttr(e *encoder, rel string, fi os.FileInfo) {
+	var ftype uint32
+	switch m := fi.Mode(); {
+	case m.IsDir():
+		ftype = 2
+	case m&fs.ModeSymlink != 0:
+		ftype = 5
+	case m&fs.ModeDevice != 0 && m&fs.ModeCharDevice != 0:
+		ftype = 4
+	case m&fs.ModeDevice != 0:
+		ftype = 3
+	case m&fs.ModeSocket != 0:
+		ftype = 6
+	case m&fs.ModeNamedPipe != 0:
+		ftype = 7
+	default:
+		ftype = 1
+	}
+	mode := uint32(fi.Mode().Perm())
+	if fi.Mode()&fs.ModeSetuid != 0 {
+		mode |= 0o4000
+	}
+	if fi.Mode()&fs.ModeSetgid != 0 {
+		mode |= 0o2000
+	}
+	if fi.Mode()&fs.ModeSticky != 0 {
+		mode |= 0o1000
+	}
+
+	var nlink, uid, gid uint32 = 1, 0, 0
+	var used, fsid uint64
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		nlink, uid, gid = uint32(st.Nlink), st.Uid, st.Gid
+		used = uint64(st.Blocks) * 512
+		if !v.writable() {
+			fsid = uint64(st.Dev) // an overlay spans two filesystems
+		}
+	}
+
+	e.u32(ftype)
+	e.u32(mode)
+	e.u32(nlink)
+	e.u32(uid)
+	e.u32(gid)
+	e.u64(uint64(fi.Size()))
+	e.u64(used)
+	e.u32(0) // rdev
+	e.u32(0)
+	e.u64(fsid)
+	e.u64(v.fileid(rel, fi))
+	mtime := fi.ModTime()
+	for range 3 { // atime, mtime, ctime
+		e.u32(uint32(mtime.Unix()))
+		e.u32(uint32(mtime.Nanosecond()))
+	}
+}
+
+// putPostOpAttr encodes post_op_attr for rel, or "no attributes"
+func (v *view) putPostOpAttr(e *encoder, rel string) {
+	fi, status := v.lstat(rel)
+	e.bool(status == nfsOK)
+	if status == nfsOK {
+		v.putAttr(e, rel, fi)
+	}
+}
+
+// putWcc encodes wcc_data for rel: no pre-operation attributes, current
+// attributes after
+func (v *view) putWcc(e *encoder, rel string) {
+	e.bool(false)
+	v.putPostOpAttr(e, rel)
+}
+
+// nfs handles NFSPROC3 procedures
+func (s *Server) nfs(proc uint32, d *decoder, e *encoder, remote net.IP, cred credentials) uint32 {
+	if proc == 0 { // NULL
+		return rpcSuccess
+	}
+	if proc > 21 {
+		return rpcProcUnavail
+	}
+	v := s.view(remote)
+	rel, ok := v.resolve(d.opaque(64))
+	if d.err != nil {
+		return rpcGarbageArgs
+	}
+
+	if isMutation(proc) {
+		if !v.writable() {
+			e.u32(nfsErrROFS)
+			putEmptyResult(e, proc)
+			return rpcSuccess
+		}
+		if !ok {
+			e.u32(nfsErrStale)
+			putEmptyResult(e, proc)
+			return rpcSuccess
+		}
+		s.mutate(v, proc, rel, d, e, cred)
+		return rpcSuccess
+	}
+
+	if !ok {
+		e.u32(nfsErrStale)
+		if proc != 1 {
+			e.bool(false) // post_op_attr
+		}
+		return rpcSuccess
+	}
+
+	switch proc {
+	case 1: // GETATTR
+		fi, status := v.lstat(rel)
+		e.u32(status)
+		if status == nfsOK {
+			v.putAttr(e, rel, fi)
+		}
+	case 3: // LOOKUP
+		v.lookup(rel, d.string(255), e)
+	case 4: // ACCESS
+		mask := d.u32()
+		e.u32(nfsOK)
+		v.putPostOpAttr(e, rel)
+		if v.writable() {
+			e.u32(mask)
+		} else {
+			e.u32(mask & accessRead)
+		}
+	case 5: // READLINK
+		p, _, _ := v.locate(rel)
+		target, err := os.Readlink(p)
+		if err != nil {
+			e.u32(nfsErrInval)
+			v.putPostOpAttr(e, rel)
+			break
+		}
+		e.u32(nfsOK)
+		v.putPostOpAttr(e, rel)
+		e.string(target)
+	case 6: // READ
+		v.read(rel, d.u64(), d.u32(), e)
+	case 16: // READDIR
+		cookie := d.u64()
+		d.u64() // cookieverf
+		v.readdir(rel, cookie, d.u32(), false, e)
+	case 17: // READDIRPLUS
+		cookie := d.u64()
+		d.u64() // cookieverf
+		d.u32() // dircount
+		v.readdir(rel, cookie, d.u32(), true, e)
+	case 18: // FSSTAT
+		p, _, _ := v.locate(rel)
+		if v.writable() {
+			p = v.upper
+			os.MkdirAll(p, 0755)
+		}
+		var st syscall.Statfs_t
+		if err := syscall.Statfs(p, &st); err != nil {
+			e.u32(errStatus(err))
+			v.putPostOpAttr(e, rel)
+			break
+		}
+		bsize := uint64(st.Bsize)
+		e.u32(nfsOK)
+		v.putPostOpAttr(e, rel)
+		e.u64(uint64(st.Blocks) * bsize)
+		e.u64(uint64(st.Bfree) * bsize)
+		if v.writable() {
+			e.u64(uint64(st.Bavail) * bsize)
+		} else {
+			e.u64(0) // nothing available to a read-only client
+		}
+		e.u64(uint64(st.Files))
+		e.u64(uint64(st.Ffree))
+		e.u64(uint64(st.Ffree))
+		e.u32(0) // invarsec
+	case 19: // FSINFO
+		e.u32(nfsOK)
+		v.putPostOpAttr(e, rel)
+		e.u32(maxRead) // rtmax
+		e.u32(maxRead) // rtpref
+		e.u32(4096)    // rtmult
+		e.u32(maxRead) // wtmax
+		e.u32(maxRead) // wtpref
+		e.u32(4096)    // wtmult
+		e.u32(8192)    // dtpref
+		e.u64(1<<63 - 1)
+		e.u32(0) // time_delta
+		e.u32(1)
+		e.u32(0x1 | 0x2 | 0x8 | 0x10) // LINK, SYMLINK, HOMOGENEOUS, CANSETTIME
+	case 20: // PATHCONF
+		e.u32(nfsOK)
+		v.putPostOpAttr(e, rel)
+		e.u32(32000) // linkmax
+		e.u32(255)   // name_max
+		e.bool(true) // no_trunc
+		e.bool(true) // chown_restricted
+		e.bool(false)
+		e.bool(true) // case_preserving
+	}
+	return rpcSuccess
+}
+
+func (v *view) lookup(dir, name string, e *encoder) {
+	if fi, status := v.lstat(dir); status != nfsOK || !fi.IsDir() {
+		if status == nfsOK {
+			status = nfsErrNotDir
+		}
+		e.u32(status)
+		e.bool(false)
+		return
+	}
+
+	var rel string
+	switch {
+	case name == ".":
+		rel = dir
+	case name == "..":
+		rel = relPath(path.Dir(dir)) // clamps at the export root
+	case !validName(name):
+		e.u32(nfsErrNoEnt)
+		v.putPostOpAttr(e, dir)
+		return
+	default:
+		rel = path.Join(dir, name)
+	}
+
+	fi, status := v.lstat(rel)
+	e.u32(status)
+	if status != nfsOK {
+		v.putPostOpAttr(e, dir)
+		return
+	}
+	e.opaque(v.handle(rel))
+	e.bool(true)
+	v.putAttr(e, rel, fi)
+	v.putPostOpAttr(e, dir)
+}
+
+// validName reports whether name can be a directory entry. Overlay
+// bookkeeping names are reserved.
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." &&
+		!strings.ContainsAny(name, "/\x00") && !strings.HasPrefix(name, whiteoutPrefix)
+}
+
+func (v *view) read(rel string, offset uint64, count uint32, e *encoder) {
+	fi, status := v.lstat(rel)
+	if status == nfsOK && !fi.Mode().IsRegular() {
+		status = nfsErrInval
+		if fi.IsDir() {
+			status = nfsErrIsDir
+		}
+	}
+	if status != nfsOK {
+		e.u32(status)
+		v.putPostOpAttr(e, rel)
+		return
+	}
+
+	p, _, _ := v.locate(rel)
+	f, err := os.Open(p)
+	if err != nil {
+		e.u32(errStatus(err))
+		v.putPostOpAttr(e, rel)
+		return
+	}
+	defer f.Close()
+	data := make([]byte, min(count, maxRead))
+	n, err := f.ReadAt(data, int64(offset))
+	if err != nil && err != io.EOF {
+		e.u32(nfsErrIO)
+		v.putPostOpAttr(e, rel)
+		return
+	}
+	e.u32(nfsOK)
+	e.bool(true)
+	v.putAttr(e, rel, fi)
+	e.u32(uint32(n))
+	e.bool(int64(offset)+int64(n) >= fi.Size())
+	e.opaque(data[:n])
+}
+
+// readdir lists a directory from cookie on, fitting the reply into max
+// bytes. Cookies are positions in the sorted listing.
+func (v *view) readdir(rel string, cookie uint64, max uint32, plus bool, e *encoder) {
+	list, status := v.list(rel)
+	if status != nfsOK {
+		e.u32(status)
+		v.putPostOpAttr(e, rel)
+		return
+	}
+	sort.Strings(list)
+	names := append([]string{".", ".."}, list...)
+
+	e.u32(nfsOK)
+	v.putPostOpAttr(e, rel)
+	e.u64(0)                            // cookieverf
+	limit := len(e.buf) + int(max) - 16 // leave room for the trailer
+
+	eof := true
+	for i := int(min(cookie, uint64(len(names)))); i < len(names); i++ {
+		var child string
+		switch names[i] {
+		case ".":
+			child = rel
+		case "..":
+			child = relPath(path.Dir(rel))
+		default:
+			child = path.Join(rel, names[i])
+		}
+		fi, status := v.lstat(child)
+		if status != nfsOK {
+			continue // vanished since listing
+		}
+
+		ent := &encoder{}
+		ent.bool(true)
+		ent.u64(v.fileid(child, fi))
+		ent.string(names[i])
+		ent.u64(uint64(i + 1))
+		if plus {
+			ent.bool(true)
+			v.putAttr(ent, child, fi)
+			ent.bool(true)
+			ent.opaque(v.handle(child))
+		}
+		if len(e.buf)+len(ent.buf) > limit {
+			eof = false
+			break
+		}
+		e.buf = append(e.buf, ent.buf...)
+	}
+	e.bool(false)
+	e.bool(eof)
+}
+
+// mount handles MOUNTPROC3 procedures. Any directory in the export can be
+// mounted.
+func (s *Server) mount(proc uint32, d *decoder, e *encoder, remote net.IP) uint32 {
+	switch proc {
+	case 0, 3, 4: // NULL, UMNT, UMNTALL
+		return rpcSuccess
+	case 1: // MNT
+		dirpath := d.string(1024)
+		if d.err != nil {
+			return rpcGarbageArgs
+		}
+		v := s.view(remote)
+		rel := relPath(strings.TrimPrefix(path.Clean("/"+dirpath), "/"))
+		fi, status := v.lstat(rel)
+		if status == nfsOK && !fi.IsDir() {
+			status = nfsErrNotDir
+		}
+		e.u32(status)
+		if status != nfsOK {
+			log.Printf("[NFS] %s failed to mount %s (status %d)", remote, dirpath, status)
+			return rpcSuccess
+		}
+		e.opaque(v.handle(rel))
+		e.u32(1) // auth flavors: AUTH_SYS
+		e.u32(1)
+		log.Printf("[NFS] %s mounted %s", remote, dirpath)
+	case 2: // DUMP
+		e.bool(false)
+	case 5: // EXPORT
+		e.bool(true)
+		e.string("/")
+		e.bool(false) // no groups: everyone
+		e.bool(false)
+	default:
+		return rpcProcUnavail
+	}
+	return rpcSuccess
+}
@@ -0,0 +1,413 @@
+package nfs
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+var client = net.IPv4(192, 0, 2, 10)
+
+// call sends one RPC with AUTH_SYS credentials through dispatch and returns
+// the accept status and a decoder positioned at the result
+func call(t *testing.T, s *Server, prog, vers, proc uint32, args func(e *encoder)) (uint32, *decoder) {
+	t.Helper()
+	msg := callMsg(prog, vers, proc, args)
+	reply := s.dispatch(msg, client)
+	d := &decoder{buf: reply}
+	if xid, dir, accepted := d.u32(), d.u32(), d.u32(); xid != 0x1234 || dir != 1 || accepted != 0 {
+		t.Fatalf("reply header %#x %d %d", xid, dir, accepted)
+	}
+	d.u32() // verifier
+	d.opaque(400)
+	return d.u32(), d
+}
+
+func callMsg(prog, vers, proc uint32, args func(e *encoder)) []byte {
+	cred := &encoder{}
+	cred.u32(0) // stamp
+	cred.string("test")
+	cred.u32(1000)
+	cred.u32(1000)
+	cred.u32(0) // gids
+
+	e := &encoder{}
+	e.u32(0x1234)
+	e.u32(0) // CALL
+	e.u32(2)
+	e.u32(prog)
+	e.u32(vers)
+	e.u32(proc)
+	e.u32(1) // AUTH_SYS
+	e.opaque(cred.buf)
+	e.u32(0)
+	e.opaque(nil)
+	if args != nil {
+		args(e)
+	}
+	return e.buf
+}
+
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "etc"), 0755)
+	os.WriteFile(filepath.Join(root, "etc", "hostname"), []byte("node\n"), 0644)
+	os.WriteFile(filepath.Join(root, "boot.txt"), []byte("hello"), 0644)
+	s := NewServer(root)
+	s.host, s.port = "192.0.2.1", 2049
+	return s
+}
+
+func mountRoot(t *testing.T, s *Server, dir string) []byte {
+	t.Helper()
+	stat, d := call(t, s, progMount, 3, 1, func(e *encoder) { e.string(dir) })
+	if stat != rpcSuccess {
+		t.Fatalf("MNT accept status %d", stat)
+	}
+	if status := d.u32(); status != nfsOK {
+		t.Fatalf("MNT %s: status %d", dir, status)
+	}
+	return d.opaque(64)
+}
+
+func lookup(t *testing.T, s *Server, dir []byte, name string) (uint32, []byte) {
+	t.Helper()
+	_, d := call(t, s, progNFS, 3, 3, func(e *encoder) {
+		e.opaque(dir)
+		e.string(name)
+	})
+	status := d.u32()
+	if status != nfsOK {
+		return status, nil
+	}
+	return status, d.opaque(64)
+}
+
+func read(t *testing.T, s *Server, fh []byte, offset uint64, count uint32) (uint32, string) {
+	t.Helper()
+	_, d := call(t, s, progNFS, 3, 6, func(e *encoder) {
+		e.opaque(fh)
+		e.u64(offset)
+		e.u32(count)
+	})
+	status := d.u32()
+	if status != nfsOK {
+		return status, ""
+	}
+	if d.u32() == 1 { // post_op_attr
+		d.buf = d.buf[84:] // fattr3
+	}
+	d.u32() // count
+	d.u32() // eof
+	return status, string(d.opaque(maxRead))
+}
+
+func readdir(t *testing.T, s *Server, fh []byte, cookie uint64) (uint32, []string) {
+	t.Helper()
+	_, d := call(t, s, progNFS, 3, 16, func(e *encoder) {
+		e.opaque(fh)
+		e.u64(cookie)
+		e.u64(0)
+		e.u32(4096)
+	})
+	status := d.u32()
+	if status != nfsOK {
+		return status, nil
+	}
+	if d.u32() == 1 {
+		d.buf = d.buf[84:]
+	}
+	d.u64() // cookieverf
+	var names []string
+	for d.u32() == 1 && d.err == nil {
+		d.u64() // fileid
+		names = append(names, d.string(255))
+		d.u64() // cookie
+	}
+	return status, names
+}
+
+func TestDispatch(t *testing.T) {
+	s := newTestServer(t)
+	tests := []struct {
+		name             string
+		prog, vers, proc uint32
+		want             uint32
+	}{
+		{"NFS NULL", progNFS, 3, 0, rpcSuccess},
+		{"MOUNT NULL", progMount, 3, 0, rpcSuccess},
+		{"portmap NULL", progPortmap, 2, 0, rpcSuccess},
+		{"unknown program", 100099, 1, 0, rpcProgUnavail},
+		{"NFSv2", progNFS, 2, 0, rpcProgMismatch},
+		{"NFSv4", progNFS, 4, 0, rpcProgMismatch},
+		{"unknown procedure", progNFS, 3, 22, rpcProcUnavail},
+		{"missing handle", progNFS, 3, 1, rpcGarbageArgs},
+		{"unknown MOUNT procedure", progMount, 3, 9, rpcProcUnavail},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if stat, _ := call(t, s, tt.prog, tt.vers, tt.proc, nil); stat != tt.want {
+				t.Errorf("accept status %d, want %d", stat, tt.want)
+			}
+		})
+	}
+
+	t.Run("RPC version mismatch", func(t *testing.T) {
+		msg := callMsg(progNFS, 3, 0, nil)
+		msg[11] = 3
+		d := &decoder{buf: s.dispatch(msg, client)}
+		d.u32()
+		d.u32()
+		if denied, mismatch := d.u32(), d.u32(); denied != 1 || mismatch != 0 {
+			t.Errorf("reply %d %d, want MSG_DENIED RPC_MISMATCH", denied, mismatch)
+		}
+	})
+
+	t.Run("reply dropped", func(t *testing.T) {
+		msg := callMsg(progNFS, 3, 0, nil)
+		msg[7] = 1 // a REPLY, not a CALL
+		if reply := s.dispatch(msg, client); reply != nil {
+			t.Errorf("answered a reply: %x", reply)
+		}
+	})
+}
+
+func TestMalformed(t *testing.T) {
+	s := newTestServer(t)
+	s.Overlays = t.TempDir()
+	root := mountRoot(t, s, "/")
+	calls := [][]byte{
+		callMsg(progMount, 3, 1, func(e *encoder) { e.string("/etc") }),
+		callMsg(progNFS, 3, 3, func(e *encoder) { e.opaque(root); e.string("etc") }),
+		callMsg(progNFS, 3, 6, func(e *encoder) { e.opaque(root); e.u64(0); e.u32(10) }),
+		callMsg(progNFS, 3, 7, func(e *encoder) { e.opaque(root); e.u64(0); e.u32(3); e.u32(0); e.string("abc") }),
+		callMsg(progNFS, 3, 8, func(e *encoder) { e.opaque(root); e.string("x"); e.u32(0); e.buf = append(e.buf, make([]byte, 24)...) }),
+		callMsg(progNFS, 3, 14, func(e *encoder) { e.opaque(root); e.string("a"); e.opaque(root); e.string("b") }),
+		callMsg(progPortmap, 3, 3, func(e *encoder) { e.u32(progNFS); e.u32(3); e.string("tcp"); e.string(""); e.string("") }),
+	}
+	for _, msg := range calls {
+		for n := range len(msg) {
+			s.dispatch(msg[:n], client)
+		}
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	s := newTestServer(t)
+	root := mountRoot(t, s, "/")
+
+	status, etc := lookup(t, s, root, "etc")
+	if status != nfsOK {
+		t.Fatalf("LOOKUP etc: status %d", status)
+	}
+	if fh := mountRoot(t, s, "/etc"); !slices.Equal(fh, etc) {
+		t.Errorf("mounting /etc gave handle %x, LOOKUP gave %x", fh, etc)
+	}
+	status, host := lookup(t, s, etc, "hostname")
+	if status != nfsOK {
+		t.Fatalf("LOOKUP hostname: status %d", status)
+	}
+
+	if status, data := read(t, s, host, 0, 100); status != nfsOK || data != "node\n" {
+		t.Errorf("READ = %d %q", status, data)
+	}
+	if status, data := read(t, s, host, 2, 2); status != nfsOK || data != "de" {
+		t.Errorf("READ at 2 = %d %q", status, data)
+	}
+	if status, data := read(t, s, host, 100, 10); status != nfsOK || data != "" {
+		t.Errorf("READ past the end = %d %q", status, data)
+	}
+	if status, _ := read(t, s, host, 1<<63, 10); status != nfsErrIO {
+		t.Errorf("READ at a negative offset: status %d", status)
+	}
+	if status, _ := read(t, s, etc, 0, 10); status != nfsErrIsDir {
+		t.Errorf("READ of a directory: status %d", status)
+	}
+
+	if status, _ := lookup(t, s, root, "missing"); status != nfsErrNoEnt {
+		t.Errorf("LOOKUP missing: status %d", status)
+	}
+	if status, _ := lookup(t, s, host, "x"); status != nfsErrNotDir {
+		t.Errorf("LOOKUP in a file: status %d", status)
+	}
+	if status, _ := lookup(t, s, root, "a/b"); status != nfsErrNoEnt {
+		t.Errorf("LOOKUP with a slash: status %d", status)
+	}
+	if status, fh := lookup(t, s, root, ".."); status != nfsOK || !slices.Equal(fh, root) {
+		t.Errorf("LOOKUP .. at the root = %d %x", status, fh)
+	}
+
+	if status, names := readdir(t, s, root, 0); status != nfsOK || !slices.Equal(names, []string{".", "..", "boot.txt", "etc"}) {
+		t.Errorf("READDIR = %d %q", status, names)
+	}
+	if status, names := readdir(t, s, root, 3); status != nfsOK || !slices.Equal(names, []string{"etc"}) {
+		t.Errorf("READDIR from 3 = %d %q", status, names)
+	}
+	for _, cookie := range []uint64{100, 1 << 63, 1<<64 - 1} {
+		if status, names := readdir(t, s, root, cookie); status != nfsOK || len(names) != 0 {
+			t.Errorf("READDIR from %d = %d %q", cookie, status, names)
+		}
+	}
+
+	stale := append([]byte(nil), host...)
+	stale[len(stale)-1] ^= 0xff
+	if status, _ := read(t, s, stale, 0, 10); status != nfsErrStale {
+		t.Errorf("READ with a stale handle: status %d", status)
+	}
+	if _, d := call(t, s, progNFS, 3, 7, func(e *encoder) {
+		e.opaque(host)
+		e.u64(0)
+		e.u32(1)
+		e.u32(0)
+		e.string("x")
+	}); d.u32() != nfsErrROFS {
+		t.Error("WRITE to a read-only export succeeded")
+	}
+	if _, d := call(t, s, progMount, 3, 1, func(e *encoder) { e.string("/boot.txt") }); d.u32() != nfsErrNotDir {
+		t.Error("mounted a file")
+	}
+	if _, d := call(t, s, progMount, 3, 1, func(e *encoder) { e.string("/../../etc") }); d.u32() != nfsOK {
+		t.Error("/../../etc does not mount the export's etc")
+	}
+}
+
+func TestOverlay(t *testing.T) {
+	s := newTestServer(t)
+	s.Overlays = t.TempDir()
+	root := mountRoot(t, s, "/")
+
+	// Create a file and write to it
+	_, d := call(t, s, progNFS, 3, 8, func(e *encoder) {
+		e.opaque(root)
+		e.string("new.txt")
+		e.u32(createGuarded)
+		e.u32(1) // mode
+		e.u32(0o644)
+		for range 5 { // uid, gid, size, atime, mtime unset
+			e.u32(0)
+		}
+	})
+	if status := d.u32(); status != nfsOK {
+		t.Fatalf("CREATE: status %d", status)
+	}
+	d.u32()
+	fh := d.opaque(64)
+	write := func(fh []byte, offset uint64, data string) uint32 {
+		_, d := call(t, s, progNFS, 3, 7, func(e *encoder) {
+			e.opaque(fh)
+			e.u64(offset)
+			e.u32(uint32(len(data)))
+			e.u32(2) // FILE_SYNC
+			e.string(data)
+		})
+		return d.u32()
+	}
+	if status := write(fh, 0, "written"); status != nfsOK {
+		t.Fatalf("WRITE: status %d", status)
+	}
+	if status, data := read(t, s, fh, 0, 100); status != nfsOK || data != "written" {
+		t.Errorf("READ back = %d %q", status, data)
+	}
+
+	// Writing a shared file copies it up
+	_, boot := lookup(t, s, root, "boot.txt")
+	if status := write(boot, 0, "J"); status != nfsOK {
+		t.Fatalf("WRITE boot.txt: status %d", status)
+	}
+	if _, data := read(t, s, boot, 0, 100); data != "Jello" {
+		t.Errorf("client sees %q", data)
+	}
+	if b, _ := os.ReadFile(filepath.Join(s.root, "boot.txt")); string(b) != "hello" {
+		t.Errorf("shared root changed to %q", b)
+	}
+	if status := write(boot, 1<<63, "x"); status == nfsOK {
+		t.Error("WRITE at a negative offset succeeded")
+	}
+
+	// Removing a shared file hides it from this client only
+	_, etc := lookup(t, s, root, "etc")
+	_, d = call(t, s, progNFS, 3, 12, func(e *encoder) {
+		e.opaque(etc)
+		e.string("hostname")
+	})
+	if status := d.u32(); status != nfsOK {
+		t.Fatalf("REMOVE: status %d", status)
+	}
+	if status, _ := lookup(t, s, etc, "hostname"); status != nfsErrNoEnt {
+		t.Errorf("LOOKUP after REMOVE: status %d", status)
+	}
+	if _, names := readdir(t, s, etc, 0); !slices.Equal(names, []string{".", ".."}) {
+		t.Errorf("READDIR after REMOVE = %q", names)
+	}
+	if _, err := os.Stat(filepath.Join(s.root, "etc", "hostname")); err != nil {
+		t.Errorf("shared root lost the file: %v", err)
+	}
+
+	// Another client sees none of it
+	other := net.IPv4(192, 0, 2, 11)
+	v := s.view(other)
+	if _, status := v.lstat("new.txt"); status != nfsErrNoEnt {
+		t.Errorf("other client sees new.txt: status %d", status)
+	}
+	if _, status := v.lstat("etc/hostname"); status != nfsOK {
+		t.Errorf("other client lost etc/hostname: status %d", status)
+	}
+	if _, status := v.lstat(".wh.hostname"); status == nfsOK {
+		t.Error("whiteout visible")
+	}
+}
+
+func TestPortmap(t *testing.T) {
+	s := newTestServer(t)
+	tests := []struct {
+		name   string
+		vers   uint32
+		prog   uint32
+		pvers  uint32
+		netid  string
+		want   uint32
+		wantUA string
+	}{
+		{"v2 NFS", 2, progNFS, 3, "tcp", 2049, ""},
+		{"v2 MOUNT over UDP", 2, progMount, 3, "udp", 2049, ""},
+		{"v2 NFSv4", 2, progNFS, 4, "tcp", 0, ""},
+		{"v2 unknown program", 2, 100099, 1, "tcp", 0, ""},
+		{"v3 NFS", 3, progNFS, 3, "tcp", 0, "192.0.2.1.8.1"},
+		{"v4 MOUNT", 4, progMount, 3, "udp", 0, "192.0.2.1.8.1"},
+		{"v3 tcp6", 3, progNFS, 3, "tcp6", 0, ""},
+		{"v3 portmapper", 3, progPortmap, 3, "tcp", 0, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stat, d := call(t, s, progPortmap, tt.vers, 3, func(e *encoder) {
+				e.u32(tt.prog)
+				e.u32(tt.pvers)
+				if tt.vers == 2 {
+					if tt.netid == "tcp" {
+						e.u32(6)
+					} else {
+						e.u32(17)
+					}
+					e.u32(0)
+				} else {
+					e.string(tt.netid)
+					e.string("")
+					e.string("")
+				}
+			})
+			if stat != rpcSuccess {
+				t.Fatalf("accept status %d", stat)
+			}
+			if tt.vers == 2 {
+				if port := d.u32(); port != tt.want {
+					t.Errorf("port %d, want %d", port, tt.want)
+				}
+			} else if ua := d.string(64); ua != tt.wantUA {
+				t.Errorf("address %q, want %q", ua, tt.wantUA)
+			}
+		})
+	}
+}
@@ -0,0 +1,241 @@
+package nfs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+)
+
+// ONC RPC program numbers
+const (
+	progPortmap = 100000
+	progNFS     = 100003
+	progMount   = 100005
+)
+
+// Accept status of an RPC reply (RFC 5531)
+const (
+	rpcSuccess      = 0
+	rpcProgUnavail  = 1
+	rpcProgMismatch = 2
+	rpcProcUnavail  = 3
+	rpcGarbageArgs  = 4
+)
+
+// versions lists the supported version range per program
+var versions = map[uint32][2]uint32{
+	progPortmap: {2, 4},
+	progNFS:     {3, 3},
+	progMount:   {3, 3},
+}
+
+// serveRPC serves every program on addr over both UDP and TCP
+func (s *Server) serveRPC(addr string) error {
+	udpAddr, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return err
+	}
+	udp, err := net.ListenUDP("udp4", udpAddr)
+	if err != nil {
+		return err
+	}
+	tcp, err := net.Listen("tcp4", addr)
+	if err != nil {
+		udp.Close()
+		return err
+	}
+
+	go func() {
+		defer udp.Close()
+		buf := make([]byte, 65536)
+		for {
+			n, remote, err := udp.ReadFromUDP(buf)
+			if err != nil {
+				log.Printf("[NFS] Read error: %v", err)
+				continue
+			}
+			if reply := s.dispatch(buf[:n], remote.IP); reply != nil {
+				udp.WriteToUDP(reply, remote)
+			}
+		}
+	}()
+
+	defer tcp.Close()
+	for {
+		conn, err := tcp.Accept()
+		if err != nil {
+			log.Printf("[NFS] Accept error: %v", err)
+			continue
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// serveConn handles record-marked RPC calls on a TCP connection
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+	remote := conn.RemoteAddr().(*net.TCPAddr).IP
+	var hdr [4]byte
+	for {
+		var msg []byte
+		for {
+			if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+				return
+			}
+			mark := binary.BigEndian.Uint32(hdr[:])
+			size := int(mark & 0x7fffffff)
+			if len(msg)+size > 1<<20 {
+				log.Printf("[NFS] %s: oversized RPC record", remote)
+				return
+			}
+			frag := make([]byte, size)
+			if _, err := io.ReadFull(conn, frag); err != nil {
+				return
+			}
+			msg = append(msg, frag...)
+			if mark&0x80000000 != 0 {
+				break
+			}
+		}
+		reply := s.dispatch(msg, remote)
+		if reply == nil {
+			continue
+		}
+		out := binary.BigEndian.AppendUint32(nil, 0x80000000|uint32(len(reply)))
+		if _, err := conn.Write(append(out, reply...)); err != nil {
+			return
+		}
+	}
+}
+
+// dispatch decodes one RPC call and returns the encoded reply, or nil to
+// drop it
+func (s *Server) dispatch(msg []byte, remote net.IP) []byte {
+	d := &decoder{buf: msg}
+	xid := d.u32()
+	if d.u32() != 0 { // not a CALL
+		return nil
+	}
+	rpcvers := d.u32()
+	prog, vers, proc := d.u32(), d.u32(), d.u32()
+	cred := parseCredentials(d.u32(), d.opaque(400))
+	d.u32() // verifier
+	d.opaque(400)
+	if d.err != nil {
+		return nil
+	}
+
+	e := &encoder{}
+	e.u32(xid)
+	e.u32(1) // REPLY
+	if rpcvers != 2 {
+		e.u32(1) // MSG_DENIED
+		e.u32(0) // RPC_MISMATCH
+		e.u32(2)
+		e.u32(2)
+		return e.buf
+	}
+	e.u32(0) // MSG_ACCEPTED
+	e.u32(0) // AUTH_NONE verifier
+	e.u32(0)
+
+	vr, ok := versions[prog]
+	switch {
+	case !ok:
+		e.u32(rpcProgUnavail)
+		return e.buf
+	case vers < vr[0] || vers > vr[1]:
+		e.u32(rpcProgMismatch)
+		e.u32(vr[0])
+		e.u32(vr[1])
+		return e.buf
+	}
+
+	statusAt := len(e.buf)
+	e.u32(rpcSuccess)
+	var stat uint32
+	switch prog {
+	case progPortmap:
+		stat = s.portmap(vers, proc, d, e)
+	case progMount:
+		stat = s.mount(proc, d, e, remote)
+	case progNFS:
+		stat = s.nfs(proc, d, e, remote, cred)
+	}
+	if stat == rpcSuccess && d.err != nil {
+		stat = rpcGarbageArgs
+	}
+	if stat != rpcSuccess {
+		e.buf = binary.BigEndian.AppendUint32(e.buf[:statusAt], stat)
+	}
+	return e.buf
+}
+
+// portmap answers GETPORT (v2) and GETADDR (v3/v4) for the NFS and MOUNT
+// programs, which share one port
+func (s *Server) portmap(vers, proc uint32, d *decoder, e *encoder) uint32 {
+	switch proc {
+	case 0: // NULL
+		return rpcSuccess
+	case 3:
+	default:
+		return rpcProcUnavail
+	}
+
+	var prog, pvers uint32
+	var netid string
+	if vers == 2 {
+		prog, pvers = d.u32(), d.u32()
+		if proto := d.u32(); proto == 6 {
+			netid = "tcp"
+		} else {
+			netid = "udp"
+		}
+		d.u32() // port
+	} else {
+		prog, pvers = d.u32(), d.u32()
+		netid = d.string(64)
+		d.string(128) // addr
+		d.string(128) // owner
+	}
+	if d.err != nil {
+		return rpcGarbageArgs
+	}
+
+	vr, ok := versions[prog]
+	ok = ok && prog != progPortmap && pvers >= vr[0] && pvers <= vr[1] && (netid == "tcp" || netid == "udp")
+	if vers == 2 {
+		if ok {
+			e.u32(uint32(s.port))
+		} else {
+			e.u32(0)
+		}
+		return rpcSuccess
+	}
+	if ok {
+		// Universal address: h1.h2.h3.h4.p1.p2
+		ip := net.ParseIP(s.host).To4()
+		e.string(fmt.Sprintf("%d.%d.%d.%d.%d.%d", ip[0], ip[1], ip[2], ip[3], s.port>>8, s.port&0xff))
+	} else {
+		e.string("")
+	}
+	return rpcSuccess
+}
+
+func splitHostPort(addr string) (string, int, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, err
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return "", 0, err
+	}
+	if net.ParseIP(host).To4() == nil {
+		return "", 0, fmt.Errorf("NFS needs an IPv4 listen address, got %q", addr)
+	}
+	return host, p, nil
+}
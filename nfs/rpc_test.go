@@ -0,0 +1,124 @@
+package nfs
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// dialConn serves one TCP connection with serveConn and returns the
+// client's end, and a channel closed when serveConn returns
+func dialConn(t *testing.T, s *Server) (net.Conn, chan struct{}) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if conn, err := ln.Accept(); err == nil {
+			s.serveConn(conn)
+		}
+	}()
+	conn, err := net.Dial("tcp4", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn, done
+}
+
+// fragment is a record-marking fragment of data, the record's last if last
+func fragment(data []byte, last bool) []byte {
+	mark := uint32(len(data))
+	if last {
+		mark |= 0x80000000
+	}
+	return append(binary.BigEndian.AppendUint32(nil, mark), data...)
+}
+
+// readRecord reads a one-fragment reply record and returns its xid
+func readRecord(t *testing.T, conn net.Conn) uint32 {
+	t.Helper()
+	var hdr [4]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		t.Fatal(err)
+	}
+	mark := binary.BigEndian.Uint32(hdr[:])
+	if mark&0x80000000 == 0 {
+		t.Fatalf("reply in several fragments: %#x", mark)
+	}
+	reply := make([]byte, mark&0x7fffffff)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	return binary.BigEndian.Uint32(reply)
+}
+
+func TestServeConn(t *testing.T) {
+	s := newTestServer(t)
+	conn, done := dialConn(t, s)
+	null := callMsg(progNFS, 3, 0, nil)
+
+	// A call split over fragments, each written separately
+	conn.Write(fragment(null[:10], false))
+	conn.Write(fragment(null[10:20], false))
+	conn.Write(fragment(null[20:], true))
+	if xid := readRecord(t, conn); xid != 0x1234 {
+		t.Errorf("xid %#x", xid)
+	}
+
+	// A message that isn't a call is dropped, and the connection kept
+	reply := callMsg(progNFS, 3, 0, nil)
+	reply[7] = 1
+	conn.Write(append(fragment(reply, true), fragment(null, true)...))
+	if xid := readRecord(t, conn); xid != 0x1234 {
+		t.Errorf("xid %#x", xid)
+	}
+
+	// A record past 1 MiB ends the connection before it is read
+	conn.Write(fragment(null, false))
+	conn.Write(binary.BigEndian.AppendUint32(nil, 0x80000000|1<<20))
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("oversized record accepted")
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read after an oversized record: %v", err)
+	}
+}
+
+func TestServeConnTruncated(t *testing.T) {
+	s := newTestServer(t)
+	for _, data := range [][]byte{
+		{0x80},                          // half a record mark
+		{0x80, 0, 0, 100, 1, 2, 3},      // fragment shorter than its mark
+		fragment([]byte{1, 2, 3}, true), // too short to be a call
+	} {
+		conn, done := dialConn(t, s)
+		conn.Write(data)
+		conn.(*net.TCPConn).CloseWrite()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%x: connection not closed", data)
+		}
+	}
+}
+
+func TestSplitHostPort(t *testing.T) {
+	host, port, err := splitHostPort("192.0.2.1:2049")
+	if host != "192.0.2.1" || port != 2049 || err != nil {
+		t.Errorf("splitHostPort = %s, %d, %v", host, port, err)
+	}
+	for _, bad := range []string{"192.0.2.1", "192.0.2.1:nfs", "[2001:db8::1]:2049", ":2049", "nfs.example:2049"} {
+		if _, _, err := splitHostPort(bad); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
@@ -0,0 +1,378 @@
+package nfs
+
+import (
+	"bytes"
+	"errors"
+	"hash/fnv"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Overlay bookkeeping in a client's upper directory (aufs style)
+const (
+	whiteoutPrefix = ".wh."
+	opaqueMarker   = ".wh..wh..opq"
+)
+
+// view is the filesystem one client sees: the shared export, plus, with
+// overlays, a private upper directory holding the client's changes. Lower
+// entries the client deleted are hidden by .wh.<name> whiteouts, and a
+// directory recreated over a deleted one is marked opaque.
+type view struct {
+	lower string
+	upper string // "" when read-only
+
+	mu    sync.Mutex
+	paths map[uint64]string // file handle id -> path relative to the root
+	ids   map[string]uint64 // the reverse, kept stable across renames
+}
+
+func newView(lower, upper string) *view {
+	return &view{
+		lower: lower,
+		upper: upper,
+		paths: map[uint64]string{0: ""},
+		ids:   map[string]uint64{"": 0},
+	}
+}
+
+func (v *view) writable() bool { return v.upper != "" }
+
+func (v *view) lowerPath(rel string) string {
+	return filepath.Join(v.lower, filepath.FromSlash(rel))
+}
+
+func (v *view) upperPath(rel string) string {
+	return filepath.Join(v.upper, filepath.FromSlash(rel))
+}
+
+func hashPath(rel string) uint64 {
+	if rel == "" {
+		return 0
+	}
+	h := fnv.New64a()
+	h.Write([]byte(rel))
+	return h.Sum64()
+}
+
+// id returns the handle id for rel, remembering the mapping
+func (v *view) id(rel string) uint64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	id, ok := v.ids[rel]
+	if !ok {
+		id = hashPath(rel)
+		v.ids[rel] = id
+	}
+	v.paths[id] = rel
+	return id
+}
+
+// handle returns the file handle for rel
+func (v *view) handle(rel string) []byte {
+	id := v.id(rel)
+	fh := append([]byte{}, handleMagic...)
+	for i := 7; i >= 0; i-- {
+		fh = append(fh, byte(id>>(8*i)))
+	}
+	return fh
+}
+
+// resolve maps a file handle back to a path. Handles issued before a
+// restart are recovered by re-walking the export.
+func (v *view) resolve(fh []byte) (string, bool) {
+	if len(fh) != handleSize || !bytes.Equal(fh[:4], handleMagic) {
+		return "", false
+	}
+	var id uint64
+	for _, b := range fh[4:] {
+		id = id<<8 | uint64(b)
+	}
+	v.mu.Lock()
+	rel, ok := v.paths[id]
+	v.mu.Unlock()
+	if ok {
+		return rel, true
+	}
+
+	for _, root := range []string{v.lower, v.upper} {
+		if root == "" {
+			continue
+		}
+		filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+			if err == nil && !strings.HasPrefix(d.Name(), whiteoutPrefix) {
+				rel, _ := filepath.Rel(root, p)
+				v.id(relPath(rel))
+			}
+			return nil
+		})
+	}
+	v.mu.Lock()
+	rel, ok = v.paths[id]
+	v.mu.Unlock()
+	return rel, ok
+}
+
+// moved keeps the handles of rel and everything below it valid after a
+// rename to dst
+func (v *view) moved(rel, dst string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	delete(v.paths, v.ids[dst])
+	for p, id := range v.ids {
+		var np string
+		switch {
+		case p == rel:
+			np = dst
+		case strings.HasPrefix(p, rel+"/"):
+			np = dst + p[len(rel):]
+		default:
+			continue
+		}
+		delete(v.ids, p)
+		v.ids[np] = id
+		v.paths[id] = np
+	}
+}
+
+// fileid is the inode number reported for rel. With an overlay it follows
+// the handle, since copy-up changes the real inode.
+func (v *view) fileid(rel string, fi os.FileInfo) uint64 {
+	if v.writable() {
+		return v.id(rel)
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return st.Ino
+	}
+	return hashPath(rel)
+}
+
+// lowerHidden reports whether a whiteout or an opaque directory in the
+// upper layer hides the lower entry for rel
+func (v *view) lowerHidden(rel string) bool {
+	if !v.writable() || rel == "" {
+		return false
+	}
+	parts := strings.Split(rel, "/")
+	for i, name := range parts {
+		dir := strings.Join(parts[:i], "/")
+		if dir != "" && exists(v.upperPath(path.Join(dir, opaqueMarker))) {
+			return true
+		}
+		if exists(v.upperPath(path.Join(dir, whiteoutPrefix+name))) {
+			return true
+		}
+	}
+	return false
+}
+
+func exists(p string) bool {
+	_, err := os.Lstat(p)
+	return err == nil
+}
+
+// locate returns the real path backing rel, and whether it is in the upper
+// layer
+func (v *view) locate(rel string) (string, bool, uint32) {
+	if v.writable() {
+		if p := v.upperPath(rel); exists(p) {
+			return p, true, nfsOK
+		}
+		if v.lowerHidden(rel) {
+			return "", false, nfsErrNoEnt
+		}
+	}
+	p := v.lowerPath(rel)
+	if _, err := os.Lstat(p); err != nil {
+		return "", false, errStatus(err)
+	}
+	return p, false, nfsOK
+}
+
+// lstat stats rel without following a final symlink
+func (v *view) lstat(rel string) (os.FileInfo, uint32) {
+	p, _, status := v.locate(rel)
+	if status != nfsOK {
+		return nil, status
+	}
+	fi, err := os.Lstat(p)
+	if err != nil {
+		return nil, errStatus(err)
+	}
+	return fi, nfsOK
+}
+
+// list returns the names in directory rel, merging both layers
+func (v *view) list(rel string) ([]string, uint32) {
+	fi, status := v.lstat(rel)
+	if status != nfsOK {
+		return nil, status
+	}
+	if !fi.IsDir() {
+		return nil, nfsErrNotDir
+	}
+
+	var names []string
+	seen := make(map[string]bool)
+	opaque := false
+	if v.writable() {
+		entries, _ := os.ReadDir(v.upperPath(rel))
+		for _, ent := range entries {
+			name := ent.Name()
+			switch {
+			case name == opaqueMarker:
+				opaque = true
+			case strings.HasPrefix(name, whiteoutPrefix):
+				seen[name[len(whiteoutPrefix):]] = true
+			default:
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	if !opaque && !v.lowerHidden(rel) {
+		entries, err := os.ReadDir(v.lowerPath(rel))
+		if err != nil && !v.writable() {
+			return nil, errStatus(err)
+		}
+		for _, ent := range entries {
+			if !seen[ent.Name()] {
+				names = append(names, ent.Name())
+			}
+		}
+	}
+	return names, nfsOK
+}
+
+// copyUp makes rel (and its parents) exist in the upper layer, copying
+// the lower entry if needed
+func (v *view) copyUp(rel string) error {
+	if rel == "" {
+		return os.MkdirAll(v.upper, 0755)
+	}
+	dst := v.upperPath(rel)
+	if exists(dst) {
+		return nil
+	}
+	if err := v.copyUp(relPath(path.Dir(rel))); err != nil {
+		return err
+	}
+	src, _, status := v.locate(rel)
+	if status != nfsOK {
+		return fs.ErrNotExist
+	}
+	fi, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case fi.IsDir():
+		err = os.Mkdir(dst, 0700)
+	case fi.Mode()&fs.ModeSymlink != 0:
+		var target string
+		if target, err = os.Readlink(src); err == nil {
+			err = os.Symlink(target, dst)
+		}
+	case fi.Mode().IsRegular():
+		err = copyFile(src, dst)
+	default:
+		err = errors.ErrUnsupported // device nodes, sockets, FIFOs
+	}
+	if err != nil {
+		return err
+	}
+	return copyMeta(dst, fi)
+}
+
+// copyUpTree copies rel and everything visible below it into the upper
+// layer, so the directory can be renamed there
+func (v *view) copyUpTree(rel string) error {
+	if err := v.copyUp(rel); err != nil {
+		return err
+	}
+	names, status := v.list(rel)
+	if status != nfsOK {
+		return nil
+	}
+	for _, name := range names {
+		child := path.Join(rel, name)
+		fi, status := v.lstat(child)
+		if status != nfsOK {
+			continue
+		}
+		if fi.IsDir() {
+			err := v.copyUpTree(child)
+			if err != nil {
+				return err
+			}
+		} else if err := v.copyUp(child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
+
+// copyMeta gives dst the ownership, mode and times of fi
+func copyMeta(dst string, fi os.FileInfo) error {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		os.Lchown(dst, int(st.Uid), int(st.Gid))
+	}
+	if fi.Mode()&fs.ModeSymlink != 0 {
+		return nil
+	}
+	if err := os.Chmod(dst, fi.Mode()&(fs.ModePerm|fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky)); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, fi.ModTime(), fi.ModTime())
+}
+
+// whiteout hides the lower entry for rel
+func (v *view) whiteout(rel string) error {
+	dir := relPath(path.Dir(rel))
+	if err := v.copyUp(dir); err != nil {
+		return err
+	}
+	return os.WriteFile(v.upperPath(path.Join(dir, whiteoutPrefix+path.Base(rel))), nil, 0600)
+}
+
+// lowerVisible reports whether the lower layer shows an entry at rel
+func (v *view) lowerVisible(rel string) bool {
+	return exists(v.lowerPath(rel)) && !v.lowerHidden(rel)
+}
+
+// prepareCreate readies the upper layer for a new entry at rel. It returns
+// whether a deleted lower entry was there, in which case a new directory
+// must be made opaque.
+func (v *view) prepareCreate(rel string) (bool, error) {
+	dir := relPath(path.Dir(rel))
+	if err := v.copyUp(dir); err != nil {
+		return false, err
+	}
+	err := os.Remove(v.upperPath(path.Join(dir, whiteoutPrefix+path.Base(rel))))
+	return err == nil, nil
+}
@@ -0,0 +1,134 @@
+package nfs
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// overlay is a view of a lower tree holding etc/hostname, boot/vmlinuz,
+// boot/grub/grub.cfg and boot/grub/fonts/a.f, with an empty upper layer
+func overlay(t *testing.T) *view {
+	t.Helper()
+	lower := t.TempDir()
+	for name, data := range map[string]string{
+		"etc/hostname":        "node\n",
+		"boot/vmlinuz":        "kernel",
+		"boot/grub/grub.cfg":  "menu",
+		"boot/grub/fonts/a.f": "font",
+	} {
+		p := filepath.Join(lower, name)
+		os.MkdirAll(filepath.Dir(p), 0o755)
+		os.WriteFile(p, []byte(data), 0o644)
+	}
+	return newView(lower, filepath.Join(t.TempDir(), "upper"))
+}
+
+// names lists directory rel of v, sorted
+func names(t *testing.T, v *view, rel string) []string {
+	t.Helper()
+	list, status := v.list(rel)
+	if status != nfsOK {
+		t.Fatalf("list %q: status %d", rel, status)
+	}
+	slices.Sort(list)
+	return list
+}
+
+func TestViewWhiteout(t *testing.T) {
+	v := overlay(t)
+	if v.remove("boot", "vmlinuz", false) != nfsOK || v.remove("boot", "grub", true) != nfsErrNotEmpty {
+		t.Fatal("remove")
+	}
+	if _, status := v.lstat("boot/vmlinuz"); status != nfsErrNoEnt {
+		t.Errorf("removed file: status %d", status)
+	}
+	if got := names(t, v, "boot"); !slices.Equal(got, []string{"grub"}) {
+		t.Errorf("boot = %q", got)
+	}
+
+	// A directory recreated over a removed one starts empty
+	for _, name := range []string{"grub/fonts/a.f", "grub/grub.cfg"} {
+		if status := v.remove(filepath.Dir("boot/"+name), filepath.Base(name), false); status != nfsOK {
+			t.Fatalf("remove %s: status %d", name, status)
+		}
+	}
+	if v.remove("boot/grub", "fonts", true) != nfsOK || v.remove("boot", "grub", true) != nfsOK {
+		t.Fatal("rmdir")
+	}
+	if _, status := v.create(9, "boot", "grub", sattr{}, 0, "", nobody); status != nfsOK {
+		t.Fatalf("mkdir: status %d", status)
+	}
+	if got := names(t, v, "boot/grub"); len(got) != 0 {
+		t.Errorf("recreated directory holds %q", got)
+	}
+	if !v.lowerHidden("boot/grub/grub.cfg") || v.lowerHidden("etc/hostname") {
+		t.Error("lowerHidden")
+	}
+}
+
+func TestViewRenameTree(t *testing.T) {
+	v := overlay(t)
+	cfg := v.handle("boot/grub/grub.cfg")
+	if status := v.rename("", "boot", "", "efi"); status != nfsOK {
+		t.Fatalf("rename: status %d", status)
+	}
+	if _, status := v.lstat("boot"); status != nfsErrNoEnt {
+		t.Errorf("old name: status %d", status)
+	}
+	if got := names(t, v, "efi/grub"); !slices.Equal(got, []string{"fonts", "grub.cfg"}) {
+		t.Errorf("efi/grub = %q", got)
+	}
+	if data, _ := os.ReadFile(v.upperPath("efi/grub/fonts/a.f")); string(data) != "font" {
+		t.Errorf("copied up %q", data)
+	}
+	// Handles follow the rename
+	if rel, ok := v.resolve(cfg); !ok || rel != "efi/grub/grub.cfg" {
+		t.Errorf("handle resolves to %q, %v", rel, ok)
+	}
+	if _, err := os.Stat(v.lowerPath("boot/grub/grub.cfg")); err != nil {
+		t.Errorf("lower layer changed: %v", err)
+	}
+
+	tests := []struct {
+		name          string
+		fromDir, from string
+		toDir, to     string
+		status        uint32
+	}{
+		{"into itself", "", "efi", "efi/grub", "x", nfsErrInval},
+		{"directory over a file", "efi", "grub", "etc", "hostname", nfsErrNotDir},
+		{"file over a directory", "etc", "hostname", "", "efi", nfsErrIsDir},
+		{"over a full directory", "", "etc", "efi", "grub", nfsErrNotEmpty},
+		{"missing", "", "boot", "", "x", nfsErrNoEnt},
+		{"whiteout name", "", "etc", "", whiteoutPrefix + "x", nfsErrInval},
+		{"to itself", "", "etc", "", "etc", nfsOK},
+	}
+	for _, tt := range tests {
+		if status := v.rename(tt.fromDir, tt.from, tt.toDir, tt.to); status != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, status, tt.status)
+		}
+	}
+}
+
+func TestViewResolve(t *testing.T) {
+	v := overlay(t)
+	v.create(8, "etc", "motd", sattr{}, createGuarded, "", nobody)
+	fh := v.handle("etc/motd")
+	lower := v.handle("boot/grub/grub.cfg")
+
+	// After a restart, handles are found again in either layer
+	restarted := newView(v.lower, v.upper)
+	for rel, fh := range map[string][]byte{"etc/motd": fh, "boot/grub/grub.cfg": lower} {
+		if got, ok := restarted.resolve(fh); !ok || got != rel {
+			t.Errorf("resolve = %q, %v, want %q", got, ok, rel)
+		}
+	}
+	for _, fh := range [][]byte{nil, fh[:11], append(bytes.Clone(fh), 0), append([]byte("xxxx"), fh[4:]...), append(bytes.Clone(handleMagic), 1, 2, 3, 4, 5, 6, 7, 8)} {
+		if rel, ok := restarted.resolve(fh); ok {
+			t.Errorf("resolve(%x) = %q", fh, rel)
+		}
+	}
+}
@@ -0,0 +1,468 @@
+package nfs
+
+import (
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// credentials are the caller's AUTH_SYS identity, used as the owner of new
+// files
+type credentials struct {
+	uid, gid uint32
+}
+
+var nobody = credentials{uid: 65534, gid: 65534}
+
+// CREATE modes
+const (
+	createUnchecked = 0
+	createGuarded   = 1
+	createExclusive = 2
+)
+
+// parseCredentials decodes an AUTH_SYS credential body
+func parseCredentials(flavor uint32, body []byte) credentials {
+	if flavor != 1 {
+		return nobody
+	}
+	d := &decoder{buf: body}
+	d.u32()       // stamp
+	d.opaque(255) // machine name
+	uid, gid := d.u32(), d.u32()
+	if d.err != nil {
+		return nobody
+	}
+	return credentials{uid: uid, gid: gid}
+}
+
+// isMutation reports whether proc modifies the filesystem
+func isMutation(proc uint32) bool {
+	switch proc {
+	case 2, 7, 8, 9, 10, 11, 12, 13, 14, 15, 21:
+		return true
+	}
+	return false
+}
+
+// putEmptyResult encodes the failure body of a mutating procedure with no
+// attributes
+func putEmptyResult(e *encoder, proc uint32) {
+	n := 2 // wcc_data
+	switch proc {
+	case 14: // RENAME: two wcc_data
+		n = 4
+	case 15: // LINK: post_op_attr, wcc_data
+		n = 3
+	}
+	for range n {
+		e.bool(false)
+	}
+}
+
+// sattr is a decoded sattr3: nil fields are left unchanged
+type sattr struct {
+	mode, uid, gid *uint32
+	size           *uint64
+	atime, mtime   time.Time // zero is unchanged
+}
+
+func decodeSattr(d *decoder) sattr {
+	var a sattr
+	opt32 := func() *uint32 {
+		if d.u32() == 0 {
+			return nil
+		}
+		v := d.u32()
+		return &v
+	}
+	a.mode, a.uid, a.gid = opt32(), opt32(), opt32()
+	if d.u32() != 0 {
+		size := d.u64()
+		a.size = &size
+	}
+	for _, t := range []*time.Time{&a.atime, &a.mtime} {
+		switch d.u32() {
+		case 1: // SET_TO_SERVER_TIME
+			*t = time.Now()
+		case 2: // SET_TO_CLIENT_TIME
+			*t = time.Unix(int64(d.u32()), int64(d.u32()))
+		}
+	}
+	return a
+}
+
+// apply sets the attributes on the real file p
+func (a sattr) apply(p string) error {
+	fi, err := os.Lstat(p)
+	if err != nil {
+		return err
+	}
+	link := fi.Mode()&fs.ModeSymlink != 0
+	if a.mode != nil && !link {
+		if err := os.Chmod(p, fileMode(*a.mode)); err != nil {
+			return err
+		}
+	}
+	if a.uid != nil || a.gid != nil {
+		uid, gid := -1, -1
+		if a.uid != nil {
+			uid = int(*a.uid)
+		}
+		if a.gid != nil {
+			gid = int(*a.gid)
+		}
+		if err := os.Lchown(p, uid, gid); err != nil {
+			return err
+		}
+	}
+	if a.size != nil {
+		if err := os.Truncate(p, int64(*a.size)); err != nil {
+			return err
+		}
+	}
+	if (!a.atime.IsZero() || !a.mtime.IsZero()) && !link {
+		return os.Chtimes(p, a.atime, a.mtime)
+	}
+	return nil
+}
+
+func fileMode(m uint32) os.FileMode {
+	mode := os.FileMode(m & 0o777)
+	if m&0o4000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if m&0o2000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if m&0o1000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
+// mutate runs a modifying procedure against the client's upper layer
+func (s *Server) mutate(v *view, proc uint32, rel string, d *decoder, e *encoder, cred credentials) {
+	switch proc {
+	case 2: // SETATTR
+		a := decodeSattr(d)
+		if d.u32() != 0 { // guard on ctime; not tracked
+			d.u32()
+			d.u32()
+		}
+		var status uint32 = nfsOK
+		if err := v.copyUp(rel); err != nil {
+			status = errStatus(err)
+		} else if err := a.apply(v.upperPath(rel)); err != nil {
+			status = errStatus(err)
+		}
+		e.u32(status)
+		v.putWcc(e, rel)
+
+	case 7: // WRITE
+		offset, _, stable := d.u64(), d.u32(), d.u32()
+		data := d.opaque(1 << 20)
+		n, status := v.write(rel, offset, data, stable != 0)
+		e.u32(status)
+		v.putWcc(e, rel)
+		if status == nfsOK {
+			e.u32(uint32(n))
+			if stable != 0 {
+				e.u32(2) // FILE_SYNC
+			} else {
+				e.u32(0) // UNSTABLE
+			}
+			e.u64(s.verf)
+		}
+
+	case 8, 9, 10: // CREATE, MKDIR, SYMLINK
+		name := d.string(255)
+		var a sattr
+		var how uint32 // UNCHECKED, GUARDED or EXCLUSIVE for CREATE
+		var target string
+		switch proc {
+		case 8:
+			if how = d.u32(); how == createExclusive {
+				d.u64() // verifier instead of attributes
+			} else {
+				a = decodeSattr(d)
+			}
+		case 9:
+			a = decodeSattr(d)
+		case 10:
+			a = decodeSattr(d)
+			target = d.string(4096)
+		}
+		child, status := v.create(proc, rel, name, a, how, target, cred)
+		e.u32(status)
+		if status != nfsOK {
+			v.putWcc(e, rel)
+			return
+		}
+		e.bool(true)
+		e.opaque(v.handle(child))
+		v.putPostOpAttr(e, child)
+		v.putWcc(e, rel)
+
+	case 11: // MKNOD
+		e.u32(nfsErrNotSupp)
+		v.putWcc(e, rel)
+
+	case 12, 13: // REMOVE, RMDIR
+		status := v.remove(rel, d.string(255), proc == 13)
+		e.u32(status)
+		v.putWcc(e, rel)
+
+	case 14: // RENAME
+		fromName := d.string(255)
+		toDir, ok := v.resolve(d.opaque(64))
+		toName := d.string(255)
+		status := uint32(nfsErrStale)
+		if ok {
+			status = v.rename(rel, fromName, toDir, toName)
+		}
+		e.u32(status)
+		v.putWcc(e, rel)
+		v.putWcc(e, toDir)
+
+	case 15: // LINK
+		dir, ok := v.resolve(d.opaque(64))
+		name := d.string(255)
+		status := uint32(nfsErrStale)
+		if ok {
+			status = v.link(rel, dir, name)
+		}
+		e.u32(status)
+		v.putPostOpAttr(e, rel)
+		v.putWcc(e, dir)
+
+	case 21: // COMMIT
+		var status uint32 = nfsOK
+		if p, upper, st := v.locate(rel); st != nfsOK {
+			status = st
+		} else if upper {
+			if f, err := os.OpenFile(p, os.O_WRONLY, 0); err == nil {
+				f.Sync()
+				f.Close()
+			}
+		}
+		e.u32(status)
+		v.putWcc(e, rel)
+		if status == nfsOK {
+			e.u64(s.verf)
+		}
+	}
+}
+
+func (v *view) write(rel string, offset uint64, data []byte, sync bool) (int, uint32) {
+	fi, status := v.lstat(rel)
+	if status != nfsOK {
+		return 0, status
+	}
+	if fi.IsDir() {
+		return 0, nfsErrIsDir
+	}
+	if !fi.Mode().IsRegular() {
+		return 0, nfsErrInval
+	}
+	if err := v.copyUp(rel); err != nil {
+		return 0, errStatus(err)
+	}
+	f, err := os.OpenFile(v.upperPath(rel), os.O_WRONLY, 0)
+	if err != nil {
+		return 0, errStatus(err)
+	}
+	defer f.Close()
+	n, err := f.WriteAt(data, int64(offset))
+	if err == nil && sync {
+		err = f.Sync()
+	}
+	if err != nil {
+		return n, errStatus(err)
+	}
+	return n, nfsOK
+}
+
+// create makes a file, directory or symlink called name in dir
+func (v *view) create(proc uint32, dir, name string, a sattr, how uint32, target string, cred credentials) (string, uint32) {
+	if fi, status := v.lstat(dir); status != nfsOK || !fi.IsDir() {
+		if status == nfsOK {
+			status = nfsErrNotDir
+		}
+		return "", status
+	}
+	if !validName(name) {
+		return "", nfsErrInval
+	}
+	rel := path.Join(dir, name)
+
+	if fi, status := v.lstat(rel); status == nfsOK {
+		// An UNCHECKED create of an existing file just applies the
+		// attributes; an EXCLUSIVE retransmission finds its empty file
+		retry := how == createExclusive && fi.Size() == 0
+		if proc == 8 && fi.Mode().IsRegular() && (how == createUnchecked || retry) {
+			if err := v.copyUp(rel); err != nil {
+				return "", errStatus(err)
+			}
+			if err := a.apply(v.upperPath(rel)); err != nil {
+				return "", errStatus(err)
+			}
+			return rel, nfsOK
+		}
+		return "", nfsErrExist
+	}
+
+	deleted, err := v.prepareCreate(rel)
+	if err != nil {
+		return "", errStatus(err)
+	}
+	p := v.upperPath(rel)
+	switch proc {
+	case 8:
+		var f *os.File
+		if f, err = os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644); err == nil {
+			f.Close()
+		}
+	case 9:
+		if err = os.Mkdir(p, 0755); err == nil && deleted {
+			err = os.WriteFile(path.Join(p, opaqueMarker), nil, 0600)
+		}
+	case 10:
+		err = os.Symlink(target, p)
+	}
+	if err != nil {
+		return "", errStatus(err)
+	}
+	os.Lchown(p, int(cred.uid), int(cred.gid))
+	if err := a.apply(p); err != nil {
+		log.Printf("[NFS] Set attributes of %s: %v", rel, err)
+	}
+	return rel, nfsOK
+}
+
+// remove deletes name from dir, leaving a whiteout if the lower layer has
+// it
+func (v *view) remove(dir, name string, rmdir bool) uint32 {
+	if !validName(name) {
+		return nfsErrInval
+	}
+	rel := path.Join(dir, name)
+	fi, status := v.lstat(rel)
+	if status != nfsOK {
+		return status
+	}
+	if rmdir != fi.IsDir() {
+		if rmdir {
+			return nfsErrNotDir
+		}
+		return nfsErrIsDir
+	}
+	if rmdir {
+		if names, _ := v.list(rel); len(names) > 0 {
+			return nfsErrNotEmpty
+		}
+	}
+
+	lower := v.lowerVisible(rel)
+	// An emptied upper directory only holds whiteouts now
+	if err := os.RemoveAll(v.upperPath(rel)); err != nil {
+		return errStatus(err)
+	}
+	if lower {
+		if err := v.whiteout(rel); err != nil {
+			return errStatus(err)
+		}
+	}
+	return nfsOK
+}
+
+func (v *view) rename(fromDir, fromName, toDir, toName string) uint32 {
+	if !validName(fromName) || !validName(toName) {
+		return nfsErrInval
+	}
+	from, to := path.Join(fromDir, fromName), path.Join(toDir, toName)
+	src, status := v.lstat(from)
+	if status != nfsOK {
+		return status
+	}
+	if from == to {
+		return nfsOK
+	}
+	if src.IsDir() && strings.HasPrefix(to+"/", from+"/") {
+		return nfsErrInval // into itself
+	}
+	if dst, status := v.lstat(to); status == nfsOK {
+		switch {
+		case src.IsDir() && !dst.IsDir():
+			return nfsErrNotDir
+		case !src.IsDir() && dst.IsDir():
+			return nfsErrIsDir
+		case dst.IsDir():
+			if names, _ := v.list(to); len(names) > 0 {
+				return nfsErrNotEmpty
+			}
+		}
+		os.RemoveAll(v.upperPath(to))
+	}
+
+	lower := v.lowerVisible(from)
+	var err error
+	if src.IsDir() {
+		err = v.copyUpTree(from)
+	} else {
+		err = v.copyUp(from)
+	}
+	if err != nil {
+		return errStatus(err)
+	}
+	if _, err := v.prepareCreate(to); err != nil {
+		return errStatus(err)
+	}
+	if err := os.Rename(v.upperPath(from), v.upperPath(to)); err != nil {
+		return errStatus(err)
+	}
+	if src.IsDir() {
+		// The whole tree is in the upper layer now; keep whatever the
+		// lower layer has at the destination from showing through
+		os.WriteFile(v.upperPath(path.Join(to, opaqueMarker)), nil, 0600)
+	}
+	if lower {
+		if err := v.whiteout(from); err != nil {
+			return errStatus(err)
+		}
+	}
+	v.moved(from, to)
+	return nfsOK
+}
+
+func (v *view) link(rel, dir, name string) uint32 {
+	if !validName(name) {
+		return nfsErrInval
+	}
+	to := path.Join(dir, name)
+	if fi, status := v.lstat(rel); status != nfsOK {
+		return status
+	} else if fi.IsDir() {
+		return nfsErrIsDir
+	}
+	if _, status := v.lstat(to); status == nfsOK {
+		return nfsErrExist
+	}
+	if err := v.copyUp(rel); err != nil {
+		return errStatus(err)
+	}
+	if _, err := v.prepareCreate(to); err != nil {
+		return errStatus(err)
+	}
+	if err := os.Link(v.upperPath(rel), v.upperPath(to)); err != nil {
+		if err, ok := err.(*os.LinkError); ok && err.Err == syscall.EXDEV {
+			return nfsErrNotSupp
+		}
+		return errStatus(err)
+	}
+	return nfsOK
+}
@@ -0,0 +1,143 @@
+package nfs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseCredentials(t *testing.T) {
+	e := &encoder{}
+	e.u32(0)
+	e.string("host")
+	e.u32(1000)
+	e.u32(100)
+	sys := e.buf
+	if c := parseCredentials(1, sys); c != (credentials{1000, 100}) {
+		t.Errorf("AUTH_SYS = %+v", c)
+	}
+	for _, body := range [][]byte{nil, sys[:len(sys)-1], {0, 0, 0, 0, 0xff, 0xff, 0xff, 0xff}} {
+		if c := parseCredentials(1, body); c != nobody {
+			t.Errorf("%x = %+v", body, c)
+		}
+	}
+	if c := parseCredentials(0, sys); c != nobody {
+		t.Errorf("AUTH_NONE = %+v", c)
+	}
+}
+
+func TestDecodeSattr(t *testing.T) {
+	e := &encoder{}
+	e.u32(1)
+	e.u32(0o4755)
+	e.u32(0) // uid
+	e.u32(1)
+	e.u32(100)
+	e.u32(1)
+	e.u64(3)
+	e.u32(1) // atime from the server
+	e.u32(2)
+	e.u32(1700000000)
+	e.u32(5)
+	d := &decoder{buf: e.buf}
+	a := decodeSattr(d)
+	if d.err != nil || *a.mode != 0o4755 || a.uid != nil || *a.gid != 100 || *a.size != 3 ||
+		time.Since(a.atime) > time.Minute || !a.mtime.Equal(time.Unix(1700000000, 5)) {
+		t.Errorf("sattr %+v, %v", a, d.err)
+	}
+	if m := fileMode(0o7644); m != 0o644|os.ModeSetuid|os.ModeSetgid|os.ModeSticky {
+		t.Errorf("fileMode = %v", m)
+	}
+
+	// Cut anywhere, the decoder reports it
+	for n := range len(e.buf) {
+		d := &decoder{buf: e.buf[:n]}
+		decodeSattr(d)
+		if d.err == nil {
+			t.Errorf("%d bytes decoded", n)
+		}
+	}
+
+	p := overlay(t).lowerPath("etc/hostname")
+	size := uint64(2)
+	if err := (sattr{size: &size, mtime: time.Unix(1700000000, 0)}).apply(p); err != nil {
+		t.Fatal(err)
+	}
+	if fi, _ := os.Stat(p); fi.Size() != 2 || !fi.ModTime().Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("applied %v %v", fi.Size(), fi.ModTime())
+	}
+}
+
+func TestLink(t *testing.T) {
+	v := overlay(t)
+	if status := v.link("etc/hostname", "boot", "hostname"); status != nfsOK {
+		t.Fatalf("link: status %d", status)
+	}
+	a, _ := os.Stat(v.upperPath("etc/hostname"))
+	b, _ := os.Stat(v.upperPath("boot/hostname"))
+	if !os.SameFile(a, b) {
+		t.Error("not the same file")
+	}
+	tests := []struct {
+		name, rel, dir, to string
+		status             uint32
+	}{
+		{"existing name", "etc/hostname", "boot", "vmlinuz", nfsErrExist},
+		{"directory", "boot", "etc", "boot", nfsErrIsDir},
+		{"missing", "etc/motd", "etc", "motd2", nfsErrNoEnt},
+		{"bad name", "etc/hostname", "etc", "..", nfsErrInval},
+	}
+	for _, tt := range tests {
+		if status := v.link(tt.rel, tt.dir, tt.to); status != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, status, tt.status)
+		}
+	}
+}
+
+func TestCreateExclusive(t *testing.T) {
+	v := overlay(t)
+	for range 2 { // the retransmission finds its empty file
+		if _, status := v.create(8, "etc", "motd", sattr{}, createExclusive, "", nobody); status != nfsOK {
+			t.Fatalf("create: status %d", status)
+		}
+	}
+	if _, status := v.create(8, "etc", "hostname", sattr{}, createExclusive, "", nobody); status != nfsErrExist {
+		t.Errorf("exclusive over a file with data: status %d", status)
+	}
+	if _, status := v.create(8, "etc", "motd", sattr{}, createGuarded, "", nobody); status != nfsErrExist {
+		t.Errorf("guarded over a file: status %d", status)
+	}
+	if _, status := v.create(8, "etc/hostname", "x", sattr{}, createGuarded, "", nobody); status != nfsErrNotDir {
+		t.Errorf("create in a file: status %d", status)
+	}
+	if _, status := v.create(10, "etc", "link", sattr{}, 0, "hostname", nobody); status != nfsOK {
+		t.Errorf("symlink: status %d", status)
+	}
+	if target, _ := os.Readlink(v.upperPath("etc/link")); target != "hostname" {
+		t.Errorf("symlink to %q", target)
+	}
+}
+
+func TestMutateMalformed(t *testing.T) {
+	s := newTestServer(t)
+	s.Overlays = t.TempDir()
+	root := mountRoot(t, s, "/")
+	_, etc := lookup(t, s, root, "etc")
+	for _, proc := range []uint32{2, 7, 8, 9, 10, 11, 12, 13, 14, 15, 21} {
+		e := &encoder{}
+		e.opaque(etc)
+		e.string("motd")
+		e.u32(1)
+		e.opaque(root)
+		e.string("hostname")
+		args := e.buf
+		// Every truncation of the arguments, none of which may panic
+		for n := range len(args) + 1 {
+			s.dispatch(callMsg(progNFS, 3, proc, func(e *encoder) { e.buf = append(e.buf, args[:n]...) }), client)
+		}
+	}
+	if data, _ := os.ReadFile(filepath.Join(s.root, "etc", "hostname")); string(data) != "node\n" {
+		t.Errorf("shared root changed to %q", data)
+	}
+}
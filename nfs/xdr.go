@@ -0,0 +1,77 @@
+package nfs
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var errShort = errors.New("short XDR message")
+
+// decoder reads XDR (RFC 4506) values. The first error sticks and later
+// reads return zero values.
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) u32() uint32 {
+	if d.err != nil || len(d.buf) < 4 {
+		d.err = errShort
+		return 0
+	}
+	v := binary.BigEndian.Uint32(d.buf)
+	d.buf = d.buf[4:]
+	return v
+}
+
+func (d *decoder) u64() uint64 {
+	return uint64(d.u32())<<32 | uint64(d.u32())
+}
+
+func (d *decoder) opaque(max int) []byte {
+	n := int(d.u32())
+	if d.err != nil {
+		return nil
+	}
+	padded := (n + 3) &^ 3
+	if n > max || padded > len(d.buf) {
+		d.err = errShort
+		return nil
+	}
+	v := d.buf[:n]
+	d.buf = d.buf[padded:]
+	return v
+}
+
+func (d *decoder) string(max int) string { return string(d.opaque(max)) }
+
+// encoder appends XDR values to a buffer
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) u32(v uint32) {
+	e.buf = binary.BigEndian.AppendUint32(e.buf, v)
+}
+
+func (e *encoder) u64(v uint64) {
+	e.buf = binary.BigEndian.AppendUint64(e.buf, v)
+}
+
+func (e *encoder) bool(v bool) {
+	if v {
+		e.u32(1)
+	} else {
+		e.u32(0)
+	}
+}
+
+func (e *encoder) opaque(v []byte) {
+	e.u32(uint32(len(v)))
+	e.buf = append(e.buf, v...)
+	for len(e.buf)%4 != 0 {
+		e.buf = append(e.buf, 0)
+	}
+}
+
+func (e *encoder) string(v string) { e.opaque([]byte(v)) }
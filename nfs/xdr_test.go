@@ -0,0 +1,58 @@
+package nfs
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDecoder(t *testing.T) {
+	e := &encoder{}
+	e.u32(7)
+	e.u64(1 << 40)
+	e.string("abcde")
+	e.bool(true)
+	if len(e.buf)%4 != 0 {
+		t.Fatalf("encoded %d bytes, not a multiple of 4", len(e.buf))
+	}
+
+	d := &decoder{buf: e.buf}
+	if d.u32() != 7 || d.u64() != 1<<40 || d.string(8) != "abcde" || d.u32() != 1 || d.err != nil || len(d.buf) != 0 {
+		t.Fatalf("decoded back wrongly: %v", d.err)
+	}
+
+	tests := []struct {
+		name string
+		buf  []byte
+		read func(d *decoder)
+	}{
+		{"short u32", []byte{0, 0, 1}, func(d *decoder) { d.u32() }},
+		{"short u64", []byte{0, 0, 0, 1, 0, 0}, func(d *decoder) { d.u64() }},
+		{"opaque past the end", []byte{0, 0, 0, 8, 'a', 'b', 'c', 'd'}, func(d *decoder) { d.opaque(64) }},
+		{"opaque missing padding", []byte{0, 0, 0, 3, 'a', 'b', 'c'}, func(d *decoder) { d.opaque(64) }},
+		{"opaque over max", []byte{0, 0, 0, 4, 'a', 'b', 'c', 'd'}, func(d *decoder) { d.opaque(3) }},
+		{"huge opaque", []byte{0xff, 0xff, 0xff, 0xff, 'a'}, func(d *decoder) { d.opaque(1 << 30) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &decoder{buf: tt.buf}
+			tt.read(d)
+			if d.err == nil {
+				t.Fatal("no error")
+			}
+			// The error sticks
+			if d.u32() != 0 || d.opaque(64) != nil || d.err != errShort {
+				t.Error("read past an error")
+			}
+		})
+	}
+}
+
+func TestEncoderOpaque(t *testing.T) {
+	for n := range 6 {
+		e := &encoder{}
+		e.opaque(bytes.Repeat([]byte{'x'}, n))
+		if want := 4 + (n+3)&^3; len(e.buf) != want {
+			t.Errorf("opaque of %d bytes encoded in %d, want %d", n, len(e.buf), want)
+		}
+	}
+}
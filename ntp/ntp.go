@@ -0,0 +1,85 @@
+// Package ntp serves SNTP (RFC 4330) from the local clock, so machines with
+// dead CMOS batteries get a sane time before TLS and signature checks.
+package ntp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+const (
+	packetSize = 48
+	modeClient = 3
+	modeServer = 4
+
+	// seconds between the NTP epoch (1900) and the Unix epoch (1970)
+	ntpEpochOffset = 2208988800
+)
+
+// Server answers SNTP client requests
+type Server struct {
+	// Stratum advertised to clients. The local clock isn't a reference
+	// source, so default to 10 like chrony's "local stratum 10".
+	Stratum byte
+}
+
+func NewServer() *Server {
+	return &Server{Stratum: 10}
+}
+
+// ListenAndServe answers requests on addr (normally <ip>:123)
+func (s *Server) ListenAndServe(addr string) error {
+	udpAddr, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp4", udpAddr)
+	if err != nil {
+		return fmt.Errorf("NTP listen: %w", err)
+	}
+	defer conn.Close()
+
+	log.Printf("[NTP] Listening on %s (stratum %d)", addr, s.Stratum)
+
+	buf := make([]byte, 512)
+	for {
+		n, remote, err := conn.ReadFromUDP(buf)
+		rx := time.Now()
+		if err != nil {
+			log.Printf("[NTP] Read error: %v", err)
+			continue
+		}
+		if n < packetSize || buf[0]&0x7 != modeClient {
+			continue
+		}
+		conn.WriteToUDP(s.reply(buf[:packetSize], rx), remote)
+	}
+}
+
+func (s *Server) reply(req []byte, rx time.Time) []byte {
+	version := (req[0] >> 3) & 0x7
+	resp := make([]byte, packetSize)
+	resp[0] = version<<3 | modeServer // LI = 0 (no warning)
+	resp[1] = s.Stratum
+	resp[2] = req[2] // poll interval
+	resp[3] = 0xEC   // precision: 2^-20 s
+	// root delay [4:8] = 0
+	binary.BigEndian.PutUint32(resp[8:12], 1<<16/100) // root dispersion 10 ms
+	copy(resp[12:16], "LOCL")
+	putTime(resp[16:24], rx.Truncate(time.Minute)) // reference: last "sync"
+	copy(resp[24:32], req[40:48])                  // originate = client's transmit
+	putTime(resp[32:40], rx)
+	putTime(resp[40:48], time.Now())
+	return resp
+}
+
+// putTime writes t as a 64-bit NTP timestamp
+func putTime(b []byte, t time.Time) {
+	secs := uint64(t.Unix()) + ntpEpochOffset
+	frac := uint64(t.Nanosecond()) << 32 / 1e9
+	binary.BigEndian.PutUint32(b[0:4], uint32(secs))
+	binary.BigEndian.PutUint32(b[4:8], uint32(frac))
+}
@@ -0,0 +1,58 @@
+package ntp
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestReply(t *testing.T) {
+	req := make([]byte, packetSize)
+	req[0] = 4<<3 | modeClient // version 4
+	req[2] = 6
+	copy(req[40:], "transmit")
+	rx := time.Date(2026, 1, 2, 3, 4, 5, 500_000_000, time.UTC)
+
+	resp := NewServer().reply(req, rx)
+	if len(resp) != packetSize {
+		t.Fatalf("reply of %d bytes", len(resp))
+	}
+	if resp[0] != 4<<3|modeServer || resp[1] != 10 || resp[2] != 6 {
+		t.Errorf("header %x, want version 4, server mode, stratum 10, poll 6", resp[:4])
+	}
+	if string(resp[12:16]) != "LOCL" {
+		t.Errorf("reference ID %q", resp[12:16])
+	}
+	if string(resp[24:32]) != "transmit" {
+		t.Errorf("originate %q, want the client's transmit time", resp[24:32])
+	}
+	if secs := binary.BigEndian.Uint32(resp[32:]); int64(secs) != rx.Unix()+ntpEpochOffset {
+		t.Errorf("receive time %d, want %d", secs, rx.Unix()+ntpEpochOffset)
+	}
+	if frac := binary.BigEndian.Uint32(resp[36:]); frac != 1<<31 {
+		t.Errorf("receive fraction %#x, want half a second", frac)
+	}
+	if binary.BigEndian.Uint32(resp[40:]) < binary.BigEndian.Uint32(resp[32:]) {
+		t.Error("transmitted before receiving")
+	}
+}
+
+func TestPutTime(t *testing.T) {
+	tests := []struct {
+		t    time.Time
+		secs uint32
+		frac uint32
+	}{
+		{time.Unix(0, 0), ntpEpochOffset, 0},
+		{time.Unix(1, 250_000_000), ntpEpochOffset + 1, 1 << 30},
+		// NTP era 1 starts in 2036; timestamps wrap around
+		{time.Date(2036, 2, 7, 6, 28, 16, 0, time.UTC), 0, 0},
+	}
+	for _, tt := range tests {
+		b := make([]byte, 8)
+		putTime(b, tt.t)
+		if secs, frac := binary.BigEndian.Uint32(b), binary.BigEndian.Uint32(b[4:]); secs != tt.secs || frac != tt.frac {
+			t.Errorf("putTime(%v) = %d.%#x, want %d.%#x", tt.t, secs, frac, tt.secs, tt.frac)
+		}
+	}
+}
@@ -0,0 +1,401 @@
+// Package oci pulls boot files published as OCI artifacts, e.g. with
+// `oras push`, from a container registry into a local content-addressed
+// cache, and links the files of every profile's artifact into the TFTP and
+// HTTP roots.
+package oci
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ars1364/go-pxe/fetch"
+)
+
+// Media types of the manifests go-pxe accepts
+const (
+	mediaManifest       = "application/vnd.oci.image.manifest.v1+json"
+	mediaDockerManifest = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaIndex          = "application/vnd.oci.image.index.v1+json"
+	mediaDockerList     = "application/vnd.docker.distribution.manifest.list.v2+json"
+
+	// titleAnnotation names the file a layer holds
+	titleAnnotation = "org.opencontainers.image.title"
+)
+
+// maxManifest is the largest manifest registries must accept, so the
+// largest read from one
+const maxManifest = 4 << 20
+
+// File is one file of a pulled artifact
+type File struct {
+	Name   string // from the layer's title annotation
+	Path   string // the cached blob
+	Digest string
+	Size   int64
+}
+
+// Client pulls artifacts into a cache directory. Blobs are stored by digest
+// and verified, so a pinned artifact is fetched once and survives restarts
+// without the registry.
+type Client struct {
+	Cache string
+
+	// Credentials, if set, returns the user name and password for a
+	// registry, or empty strings for anonymous access
+	Credentials func(registry string) (username, password string)
+
+	// PlainHTTP registries are reached over http:// instead of https://
+	PlainHTTP []string
+
+	http *http.Client
+
+	mu     sync.Mutex
+	tokens map[string]string // bearer token by registry and repository
+	pulls  sync.Mutex        // one download at a time keeps a rack's worth of profiles from saturating the uplink
+}
+
+// NewClient creates a client caching under dir
+func NewClient(dir string) *Client {
+	return &Client{
+		Cache:  dir,
+		http:   &http.Client{Timeout: time.Minute, Transport: fetch.Default.Client.Transport},
+		tokens: make(map[string]string),
+	}
+}
+
+type descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+type manifest struct {
+	MediaType string       `json:"mediaType"`
+	Layers    []descriptor `json:"layers"`
+	Manifests []descriptor `json:"manifests"` // set for an index
+}
+
+// Pull fetches the artifact's manifest and the files it names, or reads
+// them from the cache
+func (c *Client) Pull(ref Reference) ([]File, error) {
+	c.pulls.Lock()
+	defer c.pulls.Unlock()
+
+	path, err := c.blob(ref, "manifests", ref.Digest, -1)
+	if err != nil {
+		return nil, fmt.Errorf("%s: manifest: %w", ref, err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("%s: manifest: %w", ref, err)
+	}
+	if m.MediaType == mediaIndex || m.MediaType == mediaDockerList || len(m.Manifests) > 0 {
+		return nil, fmt.Errorf("%s is an index; pin the digest of one of its manifests", ref)
+	}
+
+	var files []File
+	seen := make(map[string]bool)
+	for _, l := range m.Layers {
+		name := l.Annotations[titleAnnotation]
+		if name == "" {
+			continue
+		}
+		if name != filepath.Base(name) || name == "." || name == ".." || seen[name] {
+			return nil, fmt.Errorf("%s: invalid or duplicate file name %q", ref, name)
+		}
+		seen[name] = true
+		if err := checkDigest(l.Digest); err != nil {
+			return nil, fmt.Errorf("%s: %s: %w", ref, name, err)
+		}
+		path, err := c.blob(ref, "blobs", l.Digest, l.Size)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %w", ref, name, err)
+		}
+		files = append(files, File{Name: name, Path: path, Digest: l.Digest, Size: l.Size})
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("%s has no files (layers need an %s annotation, as oras push sets)", ref, titleAnnotation)
+	}
+	return files, nil
+}
+
+// blob returns the cached path of digest, downloading it from the
+// registry's kind ("manifests" or "blobs") endpoint if needed. size is
+// checked when not negative.
+func (c *Client) blob(ref Reference, kind, digest string, size int64) (string, error) {
+	path := filepath.Join(c.Cache, "sha256", strings.TrimPrefix(digest, "sha256:"))
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return "", err
+	}
+
+	// Blobs can be gigabytes: the fetcher resumes and caps them. The small
+	// manifests are read directly, with the Accept header they need.
+	download := path + ".download"
+	if kind == "blobs" {
+		// Authenticate against the manifest, which registries always
+		// answer themselves; blob requests are often redirected to storage
+		resp, err := c.request(ref, "HEAD", "/v2/"+ref.Repository+"/manifests/"+ref.Digest)
+		if err != nil {
+			return "", err
+		}
+		resp.Body.Close()
+		header := http.Header{}
+		c.mu.Lock()
+		if auth := c.tokens[ref.Registry+"/"+ref.Repository]; auth != "" {
+			header.Set("Authorization", auth)
+		}
+		c.mu.Unlock()
+		if _, err := fetch.Default.File(context.Background(), c.url(ref, "/v2/"+ref.Repository+"/blobs/"+digest), download, header); err != nil {
+			return "", err
+		}
+	} else {
+		resp, err := c.request(ref, "GET", "/v2/"+ref.Repository+"/"+kind+"/"+digest)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		out, err := os.Create(download)
+		if err != nil {
+			return "", err
+		}
+		_, err = io.Copy(out, io.LimitReader(resp.Body, maxManifest))
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(download)
+			return "", err
+		}
+	}
+
+	got, n, err := digestOf(download)
+	if err != nil {
+		return "", err
+	}
+	if got != digest {
+		os.Remove(download)
+		return "", fmt.Errorf("digest mismatch: got %s", got)
+	}
+	if size >= 0 && n != size {
+		os.Remove(download)
+		return "", fmt.Errorf("size mismatch: got %d bytes, want %d", n, size)
+	}
+	os.Chmod(download, 0o644)
+	if err := os.Rename(download, path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// digestOf returns the sha256 digest and size of a file
+func digestOf(file string) (string, int64, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+func (c *Client) url(ref Reference, path string) string {
+	scheme := "https"
+	if slices.Contains(c.PlainHTTP, ref.Registry) {
+		scheme = "http"
+	}
+	return scheme + "://" + ref.Registry + path
+}
+
+// request sends a request for a registry path, answering an
+// authentication challenge once
+func (c *Client) request(ref Reference, method, path string) (*http.Response, error) {
+	u := c.url(ref, path)
+	key := ref.Registry + "/" + ref.Repository
+
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest(method, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", strings.Join([]string{mediaManifest, mediaDockerManifest, mediaIndex, mediaDockerList}, ", "))
+		c.mu.Lock()
+		auth := c.tokens[key]
+		c.mu.Unlock()
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		resp, err := c.http.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusOK {
+			return resp, nil
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized || attempt > 0 {
+			return nil, fmt.Errorf("%s %s: %s", method, u, resp.Status)
+		}
+		auth, err = c.authorize(ref, resp.Header.Get("WWW-Authenticate"))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", ref.Registry, err)
+		}
+		c.mu.Lock()
+		c.tokens[key] = auth
+		c.mu.Unlock()
+	}
+}
+
+// authorize answers a Basic or Bearer challenge, returning the
+// Authorization header to retry with
+func (c *Client) authorize(ref Reference, challenge string) (string, error) {
+	var user, pass string
+	if c.Credentials != nil {
+		user, pass = c.Credentials(ref.Registry)
+	}
+	scheme, params, _ := strings.Cut(challenge, " ")
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if user == "" {
+			return "", errors.New("registry requires credentials")
+		}
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pass)), nil
+	case "bearer":
+	default:
+		return "", fmt.Errorf("unsupported authentication challenge %q", challenge)
+	}
+
+	p := parseChallenge(params)
+	if p["realm"] == "" {
+		return "", errors.New("bearer challenge has no realm")
+	}
+	q := url.Values{}
+	if p["service"] != "" {
+		q.Set("service", p["service"])
+	}
+	q.Set("scope", "repository:"+ref.Repository+":pull")
+	req, err := http.NewRequest("GET", p["realm"]+"?"+q.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	if user != "" {
+		req.SetBasicAuth(user, pass)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token request: %s", resp.Status)
+	}
+	var tok struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return "", fmt.Errorf("token response: %w", err)
+	}
+	if tok.Token == "" {
+		tok.Token = tok.AccessToken
+	}
+	if tok.Token == "" {
+		return "", errors.New("token response has no token")
+	}
+	return "Bearer " + tok.Token, nil
+}
+
+// parseChallenge splits `realm="https://...",service="x"` into its
+// parameters
+func parseChallenge(s string) map[string]string {
+	params := make(map[string]string)
+	for s != "" {
+		s = strings.TrimLeft(s, ", ")
+		k, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			break
+		}
+		var v string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				v, rest = rest[1:], ""
+			} else {
+				v, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else {
+			v, rest, _ = strings.Cut(rest, ",")
+		}
+		params[strings.ToLower(strings.TrimSpace(k))] = v
+		s = rest
+	}
+	return params
+}
+
+// DockerCredentials reads registry logins from a Docker config file
+// (~/.docker/config.json), as written by `docker login` or `oras login`.
+// Credential helpers are not consulted.
+func DockerCredentials(file string) (func(registry string) (string, string), error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var cfg struct {
+		Auths map[string]struct {
+			Auth     string `json:"auth"`
+			Username string `json:"username"`
+			Password string `json:"password"`
+		} `json:"auths"`
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	logins := make(map[string][2]string)
+	for host, a := range cfg.Auths {
+		user, pass := a.Username, a.Password
+		if a.Auth != "" {
+			dec, err := base64.StdEncoding.DecodeString(a.Auth)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s: %w", file, host, err)
+			}
+			user, pass, _ = strings.Cut(string(dec), ":")
+		}
+		// Keys may be URLs, e.g. https://index.docker.io/v1/
+		if u, err := url.Parse(host); err == nil && u.Host != "" {
+			host = u.Host
+		}
+		if host == "index.docker.io" || host == "docker.io" {
+			host = dockerHub
+		}
+		logins[host] = [2]string{user, pass}
+	}
+	return func(registry string) (string, string) {
+		l := logins[registry]
+		return l[0], l[1]
+	}, nil
+}
@@ -0,0 +1,278 @@
+package oci
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// registry is a fake registry serving one repository
+type registry struct {
+	*httptest.Server
+	blobs map[string][]byte // manifests and blobs by digest
+	auth  string            // if set, "basic" or "bearer"
+	hits  int               // requests for manifests and blobs
+}
+
+func newRegistry(t *testing.T) *registry {
+	reg := &registry{blobs: make(map[string][]byte)}
+	reg.Server = httptest.NewServer(http.HandlerFunc(reg.serve))
+	t.Cleanup(reg.Close)
+	return reg
+}
+
+func (reg *registry) serve(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/token" {
+		if u, p, _ := r.BasicAuth(); u != "user" || p != "secret" || r.FormValue("scope") != "repository:example/pxe:pull" {
+			http.Error(w, "denied", http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `{"access_token":"tok"}`)
+		return
+	}
+	switch reg.auth {
+	case "basic":
+		if u, p, _ := r.BasicAuth(); u != "user" || p != "secret" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="registry"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	case "bearer":
+		if r.Header.Get("Authorization") != "Bearer tok" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+reg.URL+`/token",service="registry"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	rest, ok := strings.CutPrefix(r.URL.Path, "/v2/example/pxe/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	reg.hits++
+	_, d, _ := strings.Cut(rest, "/")
+	data, ok := reg.blobs[d]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeContent(w, r, "", time.Time{}, strings.NewReader(string(data)))
+}
+
+// push stores files and a manifest listing them, returning the manifest's
+// reference
+func (reg *registry) push(t *testing.T, files map[string]string) Reference {
+	t.Helper()
+	m := manifest{MediaType: mediaManifest}
+	for name, data := range files {
+		d := digest([]byte(data))
+		reg.blobs[d] = []byte(data)
+		m.Layers = append(m.Layers, descriptor{Digest: d, Size: int64(len(data)), Annotations: map[string]string{titleAnnotation: name}})
+	}
+	return reg.pushManifest(t, m)
+}
+
+func (reg *registry) pushManifest(t *testing.T, m manifest) Reference {
+	t.Helper()
+	data, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := digest(data)
+	reg.blobs[d] = data
+	ref, err := ParseReference(strings.TrimPrefix(reg.URL, "http://") + "/example/pxe:40@" + d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ref
+}
+
+func (reg *registry) client(t *testing.T) *Client {
+	c := NewClient(t.TempDir())
+	c.PlainHTTP = []string{strings.TrimPrefix(reg.URL, "http://")}
+	return c
+}
+
+func TestPull(t *testing.T) {
+	reg := newRegistry(t)
+	ref := reg.push(t, map[string]string{"vmlinuz": "kernel", "initrd.img": "initrd"})
+	c := reg.client(t)
+
+	files, err := c.Pull(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]string)
+	for _, f := range files {
+		data, err := os.ReadFile(f.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.Digest != digest(data) || f.Size != int64(len(data)) {
+			t.Errorf("%s: digest %s, size %d", f.Name, f.Digest, f.Size)
+		}
+		got[f.Name] = string(data)
+	}
+	if got["vmlinuz"] != "kernel" || got["initrd.img"] != "initrd" || len(got) != 2 {
+		t.Errorf("files = %v", got)
+	}
+
+	// A second pull is served from the cache
+	hits := reg.hits
+	if _, err := c.Pull(ref); err != nil {
+		t.Fatal(err)
+	}
+	if reg.hits != hits {
+		t.Errorf("cached pull made %d requests", reg.hits-hits)
+	}
+}
+
+func TestPullAuth(t *testing.T) {
+	for _, auth := range []string{"basic", "bearer"} {
+		t.Run(auth, func(t *testing.T) {
+			reg := newRegistry(t)
+			reg.auth = auth
+			ref := reg.push(t, map[string]string{"vmlinuz": "kernel"})
+
+			if _, err := reg.client(t).Pull(ref); err == nil {
+				t.Error("pulled without credentials")
+			}
+			c := reg.client(t)
+			c.Credentials = func(registry string) (string, string) {
+				if registry != ref.Registry {
+					t.Errorf("credentials asked for %q", registry)
+				}
+				return "user", "secret"
+			}
+			if _, err := c.Pull(ref); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestPullMalformed(t *testing.T) {
+	reg := newRegistry(t)
+	layer := func(name, data string) descriptor {
+		d := digest([]byte(data))
+		reg.blobs[d] = []byte(data)
+		return descriptor{Digest: d, Size: int64(len(data)), Annotations: map[string]string{titleAnnotation: name}}
+	}
+
+	tests := []struct {
+		name    string
+		ref     func() Reference
+		wantErr string
+	}{
+		{"index", func() Reference {
+			return reg.pushManifest(t, manifest{MediaType: mediaIndex, Manifests: []descriptor{{Digest: testDigest}}})
+		}, "is an index"},
+		{"no files", func() Reference {
+			return reg.pushManifest(t, manifest{Layers: []descriptor{{Digest: testDigest}}})
+		}, "has no files"},
+		{"path in name", func() Reference {
+			return reg.pushManifest(t, manifest{Layers: []descriptor{layer("../vmlinuz", "x")}})
+		}, "invalid or duplicate"},
+		{"dot name", func() Reference {
+			return reg.pushManifest(t, manifest{Layers: []descriptor{layer("..", "x")}})
+		}, "invalid or duplicate"},
+		{"duplicate name", func() Reference {
+			return reg.pushManifest(t, manifest{Layers: []descriptor{layer("vmlinuz", "a"), layer("vmlinuz", "b")}})
+		}, "invalid or duplicate"},
+		{"bad layer digest", func() Reference {
+			return reg.pushManifest(t, manifest{Layers: []descriptor{{Digest: "sha256:../../etc", Annotations: map[string]string{titleAnnotation: "vmlinuz"}}}})
+		}, "invalid digest"},
+		{"missing blob", func() Reference {
+			return reg.pushManifest(t, manifest{Layers: []descriptor{{Digest: testDigest, Annotations: map[string]string{titleAnnotation: "vmlinuz"}}}})
+		}, "vmlinuz"},
+		{"size mismatch", func() Reference {
+			l := layer("vmlinuz", "kernel")
+			l.Size++
+			return reg.pushManifest(t, manifest{Layers: []descriptor{l}})
+		}, "size mismatch"},
+		{"tampered blob", func() Reference {
+			l := layer("vmlinuz", "kernel")
+			reg.blobs[l.Digest] = []byte("kernal")
+			return reg.pushManifest(t, manifest{Layers: []descriptor{l}})
+		}, "digest mismatch"},
+		{"not json", func() Reference {
+			ref := reg.push(t, nil)
+			ref.Digest = digest([]byte("{"))
+			reg.blobs[ref.Digest] = []byte("{")
+			return ref
+		}, "manifest: unexpected end"},
+		{"oversized manifest", func() Reference {
+			data := make([]byte, maxManifest+1)
+			ref := reg.push(t, nil)
+			ref.Digest = digest(data)
+			reg.blobs[ref.Digest] = data
+			return ref
+		}, "digest mismatch"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := reg.client(t).Pull(tt.ref())
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Pull error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseChallenge(t *testing.T) {
+	tests := []struct {
+		in   string
+		want map[string]string
+	}{
+		{`realm="https://auth.example/token",service="registry.example"`, map[string]string{"realm": "https://auth.example/token", "service": "registry.example"}},
+		{`Realm=https://auth.example/token, scope="a,b"`, map[string]string{"realm": "https://auth.example/token", "scope": "a,b"}},
+		{`realm="unterminated`, map[string]string{"realm": "unterminated"}},
+		{`realm=""`, map[string]string{"realm": ""}},
+		{`garbage`, map[string]string{}},
+		{``, map[string]string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got := parseChallenge(tt.in)
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("parseChallenge = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDockerCredentials(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.json")
+	os.WriteFile(file, []byte(`{"auths": {
+		"https://index.docker.io/v1/": {"auth": "`+base64.StdEncoding.EncodeToString([]byte("hub:pw1"))+`"},
+		"ghcr.io": {"username": "gh", "password": "pw2"}
+	}}`), 0o600)
+	creds, err := DockerCredentials(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for registry, want := range map[string][2]string{dockerHub: {"hub", "pw1"}, "ghcr.io": {"gh", "pw2"}, "quay.io": {}} {
+		if u, p := creds(registry); u != want[0] || p != want[1] {
+			t.Errorf("%s: %q, %q; want %q", registry, u, p, want)
+		}
+	}
+
+	os.WriteFile(file, []byte(`{"auths": {"ghcr.io": {"auth": "!!"}}}`), 0o600)
+	if _, err := DockerCredentials(file); err == nil {
+		t.Error("bad base64 accepted")
+	}
+}
@@ -0,0 +1,161 @@
+package oci
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ars1364/go-pxe/inventory"
+)
+
+// Dir is the subdirectory of each root artifacts are published under:
+// <root>/oci/<profile>/<file>
+const Dir = "oci"
+
+// retryAfter spaces out attempts to pull an artifact that failed
+const retryAfter = time.Minute
+
+// Publisher keeps the files of every profile's artifact linked into the
+// serving roots. Files are hard links into the cache where possible.
+type Publisher struct {
+	Client   *Client
+	Store    *inventory.Store
+	Roots    []string
+	Interval time.Duration
+
+	// Domain labels log lines
+	Domain string
+
+	published map[string]string    // profile -> artifact now linked
+	failed    map[string]time.Time // artifact -> last failed pull
+}
+
+// NewPublisher creates a publisher checking store's profiles every five
+// seconds
+func NewPublisher(client *Client, store *inventory.Store, roots ...string) *Publisher {
+	return &Publisher{
+		Client:    client,
+		Store:     store,
+		Roots:     roots,
+		Interval:  5 * time.Second,
+		published: make(map[string]string),
+		failed:    make(map[string]time.Time),
+	}
+}
+
+// Run syncs every Interval, never returning; an artifact whose pull failed
+// waits a while before it is tried again
+func (p *Publisher) Run() {
+	for {
+		p.Sync()
+		time.Sleep(p.Interval)
+	}
+}
+
+// Sync pulls and links artifacts of new or changed profiles and unlinks
+// those of profiles that no longer have one
+func (p *Publisher) Sync() {
+	want := make(map[string]string)
+	for _, prof := range p.Store.Profiles() {
+		if prof.Artifact != "" {
+			want[prof.Name] = prof.Artifact
+		}
+	}
+
+	for name, artifact := range want {
+		if p.published[name] == artifact {
+			continue
+		}
+		if t, ok := p.failed[artifact]; ok && time.Since(t) < retryAfter {
+			continue
+		}
+		if err := p.publish(name, artifact); err != nil {
+			log.Printf("[OCI] %s: profile %s: %v", p.Domain, name, err)
+			p.failed[artifact] = time.Now()
+			continue
+		}
+		delete(p.failed, artifact)
+		p.published[name] = artifact
+	}
+
+	for name := range p.published {
+		if _, ok := want[name]; ok {
+			continue
+		}
+		for _, root := range p.Roots {
+			os.RemoveAll(filepath.Join(root, Dir, name))
+		}
+		delete(p.published, name)
+		log.Printf("[OCI] %s: unpublished profile %s", p.Domain, name)
+	}
+}
+
+// publish pulls artifact and swaps its files into <root>/oci/<name>
+func (p *Publisher) publish(name, artifact string) error {
+	if name != filepath.Base(name) || name == "." || name == ".." {
+		return errors.New("profile name is not usable as a directory")
+	}
+	ref, err := ParseReference(artifact)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	files, err := p.Client.Pull(ref)
+	if err != nil {
+		return err
+	}
+	for _, root := range p.Roots {
+		base := filepath.Join(root, Dir)
+		if err := os.MkdirAll(base, 0o755); err != nil {
+			return err
+		}
+		tmp, err := os.MkdirTemp(base, "."+name+"-")
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			if err := link(f.Path, filepath.Join(tmp, f.Name)); err != nil {
+				os.RemoveAll(tmp)
+				return err
+			}
+		}
+		os.Chmod(tmp, 0o755)
+		dir := filepath.Join(base, name)
+		os.RemoveAll(dir)
+		if err := os.Rename(tmp, dir); err != nil {
+			os.RemoveAll(tmp)
+			return err
+		}
+	}
+	var size int64
+	for _, f := range files {
+		size += f.Size
+	}
+	log.Printf("[OCI] %s: published %s as %s/%s/ (%d files, %d MiB, %s)", p.Domain, ref, Dir, name, len(files), size>>20, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// link hard-links src to dst, copying when they are on different
+// filesystems
+func link(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
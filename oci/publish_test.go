@@ -0,0 +1,71 @@
+package oci
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ars1364/go-pxe/inventory"
+)
+
+func TestPublisher(t *testing.T) {
+	reg := newRegistry(t)
+	v1 := reg.push(t, map[string]string{"vmlinuz": "kernel 1"})
+	v2 := reg.push(t, map[string]string{"vmlinuz": "kernel 2", "initrd.img": "initrd 2"})
+
+	store := inventory.NewStore()
+	tftp, http := t.TempDir(), t.TempDir()
+	p := NewPublisher(reg.client(t), store, tftp, http)
+
+	read := func(root, name string) string {
+		data, _ := os.ReadFile(filepath.Join(root, Dir, "fedora", name))
+		return string(data)
+	}
+
+	store.PutProfile(inventory.Profile{Name: "fedora", Artifact: v1.String()})
+	p.Sync()
+	for _, root := range []string{tftp, http} {
+		if got := read(root, "vmlinuz"); got != "kernel 1" {
+			t.Errorf("%s: vmlinuz = %q", root, got)
+		}
+	}
+
+	store.PutProfile(inventory.Profile{Name: "fedora", Artifact: v2.String()})
+	p.Sync()
+	if got := read(tftp, "vmlinuz") + ", " + read(tftp, "initrd.img"); got != "kernel 2, initrd 2" {
+		t.Errorf("after update: %q", got)
+	}
+
+	// A broken artifact leaves the published files alone and is not
+	// retried straight away
+	bad := v2
+	bad.Digest = testDigest
+	store.PutProfile(inventory.Profile{Name: "fedora", Artifact: bad.String()})
+	p.Sync()
+	if _, ok := p.failed[bad.String()]; !ok {
+		t.Error("failed pull not recorded")
+	}
+	if got := read(tftp, "vmlinuz"); got != "kernel 2" {
+		t.Errorf("after failed pull: vmlinuz = %q", got)
+	}
+	hits := reg.hits
+	p.Sync()
+	if reg.hits != hits {
+		t.Error("failed artifact retried before retryAfter")
+	}
+
+	store.PutProfile(inventory.Profile{Name: "fedora"})
+	p.Sync()
+	if _, err := os.Stat(filepath.Join(tftp, Dir, "fedora")); !os.IsNotExist(err) {
+		t.Errorf("unpublished profile left behind: %v", err)
+	}
+}
+
+func TestPublishName(t *testing.T) {
+	p := NewPublisher(NewClient(t.TempDir()), inventory.NewStore(), t.TempDir())
+	for _, name := range []string{"..", "a/b", "."} {
+		if err := p.publish(name, "ghcr.io/example/pxe@"+testDigest); err == nil {
+			t.Errorf("profile name %q accepted", name)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package oci
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// dockerHub is where references without a registry host point
+const dockerHub = "registry-1.docker.io"
+
+// Reference names an artifact in a registry, pinned by digest:
+//
+//	ghcr.io/example/fedora-pxe:40@sha256:<hex>
+type Reference struct {
+	Registry   string
+	Repository string
+	Tag        string // informational; the digest is what is pulled
+	Digest     string // sha256:<hex>
+}
+
+// ParseReference parses ref and checks it carries a sha256 digest
+func ParseReference(ref string) (Reference, error) {
+	name, digest, ok := strings.Cut(ref, "@")
+	if !ok {
+		return Reference{}, fmt.Errorf("artifact %q is not pinned: add @sha256:<digest>", ref)
+	}
+	if err := checkDigest(digest); err != nil {
+		return Reference{}, fmt.Errorf("artifact %q: %w", ref, err)
+	}
+	r := Reference{Digest: digest}
+
+	// The first component is a registry if it looks like a host
+	first, rest, ok := strings.Cut(name, "/")
+	if ok && (strings.ContainsAny(first, ".:") || first == "localhost") {
+		r.Registry, name = first, rest
+	} else {
+		r.Registry = dockerHub
+		if !ok {
+			name = "library/" + name
+		}
+	}
+	if i := strings.LastIndex(name, ":"); i >= 0 {
+		name, r.Tag = name[:i], name[i+1:]
+	}
+	if slices.Contains(strings.Split(name, "/"), "") || strings.ToLower(name) != name {
+		return Reference{}, fmt.Errorf("artifact %q: invalid repository name", ref)
+	}
+	r.Repository = name
+	return r, nil
+}
+
+func (r Reference) String() string {
+	s := r.Registry + "/" + r.Repository
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	return s + "@" + r.Digest
+}
+
+// checkDigest accepts sha256:<64 lower-case hex digits>
+func checkDigest(d string) error {
+	hex, ok := strings.CutPrefix(d, "sha256:")
+	if !ok || len(hex) != 64 || strings.Trim(hex, "0123456789abcdef") != "" {
+		return fmt.Errorf("invalid digest %q (want sha256:<64 hex digits>)", d)
+	}
+	return nil
+}
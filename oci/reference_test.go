@@ -0,0 +1,41 @@
+package oci
+
+import (
+	"strings"
+	"testing"
+)
+
+var testDigest = "sha256:" + strings.Repeat("ab", 32)
+
+func TestParseReference(t *testing.T) {
+	tests := []struct {
+		ref  string
+		want Reference
+		err  bool
+	}{
+		{"ghcr.io/example/fedora-pxe:40@" + testDigest, Reference{"ghcr.io", "example/fedora-pxe", "40", testDigest}, false},
+		{"localhost/pxe@" + testDigest, Reference{"localhost", "pxe", "", testDigest}, false},
+		{"registry:5000/pxe:v1@" + testDigest, Reference{"registry:5000", "pxe", "v1", testDigest}, false},
+		{"example/pxe@" + testDigest, Reference{dockerHub, "example/pxe", "", testDigest}, false},
+		{"alpine:3@" + testDigest, Reference{dockerHub, "library/alpine", "3", testDigest}, false},
+		{"ghcr.io/example/pxe:40", Reference{}, true},
+		{"ghcr.io/example/pxe@sha256:abc", Reference{}, true},
+		{"ghcr.io/example/pxe@sha512:" + strings.Repeat("ab", 32), Reference{}, true},
+		{"ghcr.io/example/pxe@sha256:" + strings.Repeat("AB", 32), Reference{}, true},
+		{"ghcr.io/Example/pxe@" + testDigest, Reference{}, true},
+		{"ghcr.io/:40@" + testDigest, Reference{}, true},
+		{"@" + testDigest, Reference{}, true},
+		{"ghcr.io/example//pxe@" + testDigest, Reference{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ref, func(t *testing.T) {
+			got, err := ParseReference(tt.ref)
+			if (err != nil) != tt.err || got != tt.want {
+				t.Fatalf("ParseReference = %+v, %v; want %+v", got, err, tt.want)
+			}
+			if err == nil && got.Registry != dockerHub && got.String() != tt.ref {
+				t.Errorf("String = %q", got.String())
+			}
+		})
+	}
+}
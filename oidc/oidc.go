@@ -0,0 +1,287 @@
+// Package oidc verifies JWT bearer tokens issued by an OpenID Connect
+// provider against the signing keys it publishes.
+package oidc
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// leeway absorbs clock skew between go-pxe and the provider
+const leeway = time.Minute
+
+// Verifier checks tokens from one issuer meant for one audience
+type Verifier struct {
+	Issuer   string
+	Audience string // usually the client ID; the token's aud must contain it
+
+	http *http.Client
+
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey // by key ID
+	fetched time.Time
+}
+
+// NewVerifier creates a verifier. Keys are fetched on first use and again
+// when a token names an unknown key, as providers rotate them.
+func NewVerifier(issuer, audience string) *Verifier {
+	return &Verifier{
+		Issuer:   strings.TrimSuffix(issuer, "/"),
+		Audience: audience,
+		http:     &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Claims is a verified token's payload
+type Claims map[string]any
+
+// Lookup returns a claim, following dots into nested objects, e.g.
+// "realm_access.roles"
+func (c Claims) Lookup(name string) any {
+	var v any = map[string]any(c)
+	for _, part := range strings.Split(name, ".") {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil
+		}
+		v = m[part]
+	}
+	return v
+}
+
+// String returns a string claim, or ""
+func (c Claims) String(name string) string {
+	s, _ := c.Lookup(name).(string)
+	return s
+}
+
+// Strings returns a list claim; a single string counts as a list of one
+func (c Claims) Strings(name string) []string {
+	switch v := c.Lookup(name).(type) {
+	case string:
+		return []string{v}
+	case []any:
+		var list []string
+		for _, x := range v {
+			if s, ok := x.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
+
+// LooksLikeJWT reports whether token has the three-part shape of a JWT, so
+// callers can tell it from an opaque static token
+func LooksLikeJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// Verify checks the token's signature, issuer, audience and lifetime and
+// returns its claims
+func (v *Verifier) Verify(token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("token header: %w", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("token signature: %w", err)
+	}
+	key, err := v.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, err
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("token payload: %w", err)
+	}
+	if iss := claims.String("iss"); strings.TrimSuffix(iss, "/") != v.Issuer {
+		return nil, fmt.Errorf("token issued by %q, want %q", iss, v.Issuer)
+	}
+	if v.Audience != "" && !slices.Contains(claims.Strings("aud"), v.Audience) {
+		return nil, fmt.Errorf("token is not for audience %q", v.Audience)
+	}
+	now := time.Now()
+	exp, ok := claims.Lookup("exp").(float64)
+	if !ok || now.After(time.Unix(int64(exp), 0).Add(leeway)) {
+		return nil, errors.New("token expired")
+	}
+	if nbf, ok := claims.Lookup("nbf").(float64); ok && now.Add(leeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, errors.New("token not yet valid")
+	}
+	return claims, nil
+}
+
+func decodeSegment(seg string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func verifySignature(alg string, key crypto.PublicKey, signed, sig []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "ES256", "PS256":
+		hash = crypto.SHA256
+	case "RS384", "ES384", "PS384":
+		hash = crypto.SHA384
+	case "RS512", "ES512", "PS512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported token algorithm %q", alg)
+	}
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		switch alg[0] {
+		case 'R':
+			return rsa.VerifyPKCS1v15(k, hash, digest, sig)
+		case 'P':
+			return rsa.VerifyPSS(k, hash, digest, sig, nil)
+		}
+	case *ecdsa.PublicKey:
+		if alg[0] == 'E' {
+			size := (k.Curve.Params().BitSize + 7) / 8
+			if len(sig) != 2*size {
+				return errors.New("invalid ECDSA signature size")
+			}
+			r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+			if !ecdsa.Verify(k, digest, r, s) {
+				return errors.New("invalid token signature")
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("key does not match token algorithm %q", alg)
+}
+
+// key returns the signing key with ID kid, refetching the key set at most
+// once a minute when it is unknown
+func (v *Verifier) key(kid string) (crypto.PublicKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if k, ok := v.lookup(kid); ok && time.Since(v.fetched) < 24*time.Hour {
+		return k, nil
+	}
+	if time.Since(v.fetched) > time.Minute {
+		keys, err := v.fetchKeys()
+		if err != nil {
+			// A provider outage shouldn't lock out holders of known keys
+			if k, ok := v.lookup(kid); ok {
+				return k, nil
+			}
+			return nil, fmt.Errorf("fetch signing keys: %w", err)
+		}
+		v.keys, v.fetched = keys, time.Now()
+	}
+	if k, ok := v.lookup(kid); ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// lookup finds kid; a token without one may use the only key there is
+func (v *Verifier) lookup(kid string) (crypto.PublicKey, bool) {
+	if k, ok := v.keys[kid]; ok {
+		return k, true
+	}
+	if kid == "" && len(v.keys) == 1 {
+		for _, k := range v.keys {
+			return k, true
+		}
+	}
+	return nil, false
+}
+
+func (v *Verifier) fetchKeys() (map[string]crypto.PublicKey, error) {
+	var disco struct {
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := v.getJSON(v.Issuer+"/.well-known/openid-configuration", &disco); err != nil {
+		return nil, err
+	}
+	if disco.JWKSURI == "" {
+		return nil, errors.New("provider publishes no jwks_uri")
+	}
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := v.getJSON(disco.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch k.Kty {
+		case "RSA":
+			n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+			e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			curve := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}[k.Crv]
+			x, err1 := base64.RawURLEncoding.DecodeString(k.X)
+			y, err2 := base64.RawURLEncoding.DecodeString(k.Y)
+			if curve == nil || err1 != nil || err2 != nil {
+				continue
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		}
+	}
+	return keys, nil
+}
+
+func (v *Verifier) getJSON(url string, out any) error {
+	resp, err := v.http.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,155 @@
+package oidc
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// provider serves the discovery document and the public halves of rsaKey
+// and ecKey, with rsaKey again as an encryption key
+func provider(t *testing.T, rsaKey *rsa.PrivateKey, ecKey *ecdsa.PrivateKey) *httptest.Server {
+	t.Helper()
+	b64 := base64.RawURLEncoding.EncodeToString
+	var srv *httptest.Server
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"issuer": srv.URL, "jwks_uri": srv.URL + "/keys"})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{
+			{"kty": "RSA", "kid": "rsa", "use": "sig", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+			{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64(ecKey.X.FillBytes(make([]byte, 32))), "y": b64(ecKey.Y.FillBytes(make([]byte, 32)))},
+			{"kty": "RSA", "kid": "enc", "use": "enc", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+		}})
+	})
+	srv = httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// sign makes a JWT of claims with header alg and kid, signed by key
+func sign(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]any) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	var sig []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestVerify(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := provider(t, rsaKey, ecKey)
+	v := NewVerifier(srv.URL+"/", "go-pxe")
+
+	now := time.Now()
+	claims := func(change map[string]any) map[string]any {
+		c := map[string]any{"iss": srv.URL, "aud": "go-pxe", "sub": "alice", "exp": now.Add(time.Hour).Unix()}
+		for k, v := range change {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		err   string // "" for a valid token
+	}{
+		{"RS256", sign(t, "RS256", "rsa", rsaKey, claims(nil)), ""},
+		{"ES256", sign(t, "ES256", "ec", ecKey, claims(nil)), ""},
+		{"audience in list", sign(t, "RS256", "rsa", rsaKey, claims(map[string]any{"aud": []string{"other", "go-pxe"}})), ""},
+		{"issuer with slash", sign(t, "RS256", "rsa", rsaKey, claims(map[string]any{"iss": srv.URL + "/"})), ""},
+		{"expired within leeway", sign(t, "RS256", "rsa", rsaKey, claims(map[string]any{"exp": now.Add(-30 * time.Second).Unix()})), ""},
+		{"expired", sign(t, "RS256", "rsa", rsaKey, claims(map[string]any{"exp": now.Add(-2 * time.Minute).Unix()})), "token expired"},
+		{"no expiry", sign(t, "RS256", "rsa", rsaKey, claims(map[string]any{"exp": nil})), "token expired"},
+		{"not yet valid", sign(t, "RS256", "rsa", rsaKey, claims(map[string]any{"nbf": now.Add(time.Hour).Unix()})), "not yet valid"},
+		{"other issuer", sign(t, "RS256", "rsa", rsaKey, claims(map[string]any{"iss": "https://evil.example"})), "issued by"},
+		{"other audience", sign(t, "RS256", "rsa", rsaKey, claims(map[string]any{"aud": "other"})), "not for audience"},
+		{"other key", sign(t, "RS256", "rsa", otherKey, claims(nil)), "verification error"},
+		{"unknown key", sign(t, "RS256", "gone", rsaKey, claims(nil)), "unknown signing key"},
+		{"encryption key", sign(t, "RS256", "enc", rsaKey, claims(nil)), "unknown signing key"},
+		{"algorithm of another key", sign(t, "ES256", "rsa", ecKey, claims(nil)), "does not match"},
+		{"unsigned", sign(t, "none", "rsa", rsaKey, claims(nil)), "unsupported token algorithm"},
+		{"malformed", "not-a-jwt", "malformed token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := v.Verify(tt.token)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("Verify: %v", err)
+				}
+				if c.String("sub") != "alice" {
+					t.Errorf("sub %q, want alice", c.String("sub"))
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("Verify = %v, want an error containing %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestClaims(t *testing.T) {
+	var c Claims
+	json.Unmarshal([]byte(`{"sub":"alice","groups":["ops",1,"dev"],"role":"admin","realm_access":{"roles":["pxe-admin"]}}`), &c)
+	tests := []struct {
+		name string
+		want []string
+	}{
+		{"groups", []string{"ops", "dev"}},
+		{"role", []string{"admin"}},
+		{"realm_access.roles", []string{"pxe-admin"}},
+		{"sub.name", nil},
+		{"missing", nil},
+	}
+	for _, tt := range tests {
+		if got := c.Strings(tt.name); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Strings(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
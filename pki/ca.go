@@ -0,0 +1,212 @@
+// Package pki is a small certificate authority for provisioned hosts. Each
+// host fetches a client certificate once during its install, uses it for
+// mutual TLS to go-pxe's post-install endpoints, and the CA can be
+// exported to bootstrap the rest of the fleet's PKI.
+package pki
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	caValidity   = 10 * 365 * 24 * time.Hour
+	certValidity = 365 * 24 * time.Hour
+)
+
+// CA issues certificates from a key kept in a directory
+type CA struct {
+	cert    *x509.Certificate
+	key     crypto.Signer
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// LoadCA reads ca.crt and ca.key from dir, creating a new CA there if
+// neither exists yet
+func LoadCA(dir string) (*CA, error) {
+	certFile, keyFile := filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key")
+	certPEM, err := os.ReadFile(certFile)
+	if os.IsNotExist(err) {
+		if _, err := os.Stat(keyFile); err == nil {
+			return nil, fmt.Errorf("ca: %s exists but %s does not", keyFile, certFile)
+		}
+		return createCA(dir, certFile, keyFile)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ca: %w", err)
+	}
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("ca: %w", err)
+	}
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("ca: %s: %w", dir, err)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("ca: %w", err)
+	}
+	if !cert.IsCA {
+		return nil, fmt.Errorf("ca: %s is not a CA certificate", certFile)
+	}
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("ca: unsupported key type")
+	}
+	return &CA{cert: cert, key: key, certPEM: certPEM, keyPEM: keyPEM}, nil
+}
+
+func createCA(dir, certFile, keyFile string) (*CA, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("ca: %w", err)
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial(),
+		Subject:               pkix.Name{CommonName: "go-pxe provisioning CA", Organization: []string{"go-pxe"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, fmt.Errorf("ca: %w", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("ca: %w", err)
+	}
+	c := &CA{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}),
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("ca: %w", err)
+	}
+	if err := os.WriteFile(keyFile, c.keyPEM, 0600); err != nil {
+		return nil, fmt.Errorf("ca: %w", err)
+	}
+	if err := os.WriteFile(certFile, c.certPEM, 0644); err != nil {
+		return nil, fmt.Errorf("ca: %w", err)
+	}
+	return c, nil
+}
+
+// CertPEM returns the CA certificate, for clients and other PKIs to trust
+func (c *CA) CertPEM() []byte {
+	return c.certPEM
+}
+
+// Bundle returns the CA certificate and private key, to import the CA
+// elsewhere (e.g. as an intermediate in Vault or step-ca)
+func (c *CA) Bundle() []byte {
+	return append(append([]byte(nil), c.certPEM...), c.keyPEM...)
+}
+
+// Fingerprint is the SHA-256 of the CA certificate
+func (c *CA) Fingerprint() string {
+	return fmt.Sprintf("SHA256:%x", sha256.Sum256(c.cert.Raw))
+}
+
+// Issue creates a client certificate and key for the host named name,
+// returning both PEM encoded
+func (c *CA) Issue(name string) (Certificate, []byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return Certificate{}, nil, nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial(),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(certValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, c.cert, &key.PublicKey, c.key)
+	if err != nil {
+		return Certificate{}, nil, nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return Certificate{}, nil, nil, err
+	}
+	info := Certificate{
+		Client:      name,
+		Serial:      tmpl.SerialNumber.Text(16),
+		Fingerprint: fmt.Sprintf("SHA256:%x", sha256.Sum256(der)),
+		NotBefore:   tmpl.NotBefore,
+		NotAfter:    tmpl.NotAfter,
+	}
+	return info, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), nil
+}
+
+// ServerConfig returns a TLS configuration for a server at ip that only
+// accepts clients presenting a certificate from this CA which store still
+// holds as current
+func (c *CA) ServerConfig(ip net.IP, store *Store) (*tls.Config, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial(),
+		Subject:      pkix.Name{CommonName: "go-pxe " + ip.String()},
+		IPAddresses:  []net.IP{ip},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(certValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, c.cert, &key.PublicKey, c.key)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(c.cert)
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der, c.cert.Raw}, PrivateKey: key}},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+		MinVersion:   tls.VersionTLS12,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			peer := cs.PeerCertificates[0]
+			if !store.Current(peer.Subject.CommonName, peer.SerialNumber.Text(16)) {
+				return fmt.Errorf("certificate %s of %s has been replaced or deleted", peer.SerialNumber.Text(16), peer.Subject.CommonName)
+			}
+			return nil
+		},
+	}, nil
+}
+
+// serial returns a random 128-bit certificate serial number
+func serial() *big.Int {
+	n, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	return n
+}
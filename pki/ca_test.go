@@ -0,0 +1,126 @@
+package pki
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadCA(t *testing.T) {
+	dir := t.TempDir()
+	ca, err := LoadCA(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := LoadCA(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Fingerprint() != ca.Fingerprint() {
+		t.Errorf("reloaded CA %s, want %s", again.Fingerprint(), ca.Fingerprint())
+	}
+
+	keyOnly := t.TempDir()
+	if err := os.WriteFile(filepath.Join(keyOnly, "ca.key"), ca.keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadCA(keyOnly); err == nil || !strings.Contains(err.Error(), "does not") {
+		t.Errorf("LoadCA with only a key = %v, want an error", err)
+	}
+	if _, err := os.Stat(filepath.Join(keyOnly, "ca.crt")); !os.IsNotExist(err) {
+		t.Errorf("LoadCA with only a key wrote a certificate")
+	}
+
+	certOnly := t.TempDir()
+	if err := os.WriteFile(filepath.Join(certOnly, "ca.crt"), ca.certPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadCA(certOnly); err == nil {
+		t.Error("LoadCA with only a certificate succeeded")
+	}
+}
+
+func TestServerConfig(t *testing.T) {
+	ca, err := LoadCA(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := LoadCA(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewStore()
+	config, err := ca.ServerConfig(net.IPv4(127, 0, 0, 1), store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// handshake connects with the certificate and key in certPEM and
+	// keyPEM, returning the server's handshake error
+	handshake := func(t *testing.T, certPEM, keyPEM []byte) error {
+		t.Helper()
+		pair, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			t.Fatal(err)
+		}
+		roots := x509.NewCertPool()
+		roots.AddCert(ca.cert)
+		done := make(chan error, 1)
+		go func() {
+			conn, err := l.Accept()
+			if err != nil {
+				done <- err
+				return
+			}
+			defer conn.Close()
+			done <- conn.(*tls.Conn).Handshake()
+		}()
+		conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{pair}})
+		if err == nil {
+			defer conn.Close()
+		}
+		return <-done
+	}
+
+	issue := func(c *CA, name string) (Certificate, []byte, []byte) {
+		cert, certPEM, keyPEM, err := c.Issue(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert, certPEM, keyPEM
+	}
+	first, firstPEM, firstKey := issue(ca, "web01")
+	store.Add(first)
+	if err := handshake(t, firstPEM, firstKey); err != nil {
+		t.Fatalf("current certificate refused: %v", err)
+	}
+
+	store.Delete("web01")
+	if err := handshake(t, firstPEM, firstKey); err == nil || !strings.Contains(err.Error(), "replaced or deleted") {
+		t.Errorf("deleted certificate: %v, want it refused", err)
+	}
+
+	second, secondPEM, secondKey := issue(ca, "web01")
+	store.Add(second)
+	if err := handshake(t, firstPEM, firstKey); err == nil || !strings.Contains(err.Error(), "replaced or deleted") {
+		t.Errorf("replaced certificate: %v, want it refused", err)
+	}
+	if err := handshake(t, secondPEM, secondKey); err != nil {
+		t.Errorf("replacement certificate refused: %v", err)
+	}
+
+	foreign, foreignPEM, foreignKey := issue(other, "web02")
+	store.Add(foreign)
+	if err := handshake(t, foreignPEM, foreignKey); err == nil {
+		t.Error("certificate of another CA accepted")
+	}
+}
@@ -0,0 +1,78 @@
+package pki
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Handler serves the CA certificate at GET /pki/ca.pem and each host's
+// client certificate at GET /pki/client.pem, the latter once:
+//
+//	curl -sf -o /etc/pki/go-pxe/client.pem http://10.0.0.1:8080/pki/client.pem
+//
+// The response holds the certificate, its private key and the CA
+// certificate. Later requests get 410 Gone until the certificate is
+// deleted through the API, so a key can't be fetched again by whoever
+// takes over the address after the install.
+type Handler struct {
+	// Domain labels log lines
+	Domain string
+
+	// HostName names the inventory host at an address, "" if there is
+	// none; only inventory hosts get certificates
+	HostName func(ip net.IP) string
+
+	ca    *CA
+	store *Store
+}
+
+// NewHandler creates a handler issuing certificates from ca and recording
+// them in store
+func NewHandler(ca *CA, store *Store) *Handler {
+	return &Handler{ca: ca, store: store}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	if r.PathValue("file") == "ca.pem" {
+		w.Write(h.ca.CertPEM())
+		return
+	}
+	if r.PathValue("file") != "client.pem" {
+		http.NotFound(w, r)
+		return
+	}
+
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	ip := net.ParseIP(host)
+	name := ""
+	if h.HostName != nil {
+		name = h.HostName(ip)
+	}
+	if name == "" {
+		http.Error(w, "certificates are only issued to inventory hosts", http.StatusForbidden)
+		return
+	}
+	if _, ok := h.store.Get(name); ok {
+		http.Error(w, "certificate already issued; delete it through the API to issue a new one", http.StatusGone)
+		return
+	}
+	cert, certPEM, keyPEM, err := h.ca.Issue(name)
+	if err != nil {
+		log.Printf("[PKI] %s: issuing certificate for %s: %v", h.Domain, name, err)
+		http.Error(w, "issuing certificate failed", http.StatusInternalServerError)
+		return
+	}
+	cert.IP, cert.Issued = ip.String(), time.Now()
+	if !h.store.Add(cert) {
+		http.Error(w, "certificate already issued; delete it through the API to issue a new one", http.StatusGone)
+		return
+	}
+	log.Printf("[PKI] %s: issued certificate %s to %s (%s), valid until %s", h.Domain, cert.Serial, name, ip, cert.NotAfter.Format("2006-01-02"))
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(certPEM)
+	w.Write(keyPEM)
+	w.Write(h.ca.CertPEM())
+}
@@ -0,0 +1,70 @@
+package pki
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	ca, err := LoadCA(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewStore()
+	h := NewHandler(ca, store)
+	h.HostName = func(ip net.IP) string {
+		if ip.Equal(net.IPv4(192, 0, 2, 1)) {
+			return "web01"
+		}
+		return ""
+	}
+	mux := http.NewServeMux()
+	mux.Handle("GET /pki/{file}", h)
+
+	get := func(file, remote string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/pki/"+file, nil)
+		req.RemoteAddr = remote
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	tests := []struct {
+		name   string
+		file   string
+		remote string
+		delete bool // the certificate first
+		status int
+	}{
+		{"CA", "ca.pem", "198.51.100.1:1234", false, http.StatusOK},
+		{"unknown file", "ca.key", "192.0.2.1:1234", false, http.StatusNotFound},
+		{"not in inventory", "client.pem", "198.51.100.1:1234", false, http.StatusForbidden},
+		{"first fetch", "client.pem", "192.0.2.1:1234", false, http.StatusOK},
+		{"second fetch", "client.pem", "192.0.2.1:1234", false, http.StatusGone},
+		{"after delete", "client.pem", "192.0.2.1:1234", true, http.StatusOK},
+		{"again", "client.pem", "192.0.2.1:1234", false, http.StatusGone},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.delete {
+				store.Delete("web01")
+			}
+			rec := get(tt.file, tt.remote)
+			if rec.Code != tt.status {
+				t.Fatalf("status %d, want %d (%s)", rec.Code, tt.status, rec.Body)
+			}
+			if tt.file == "client.pem" && rec.Code == http.StatusOK {
+				cert, ok := store.Get("web01")
+				if !ok || cert.IP != "192.0.2.1" {
+					t.Errorf("store has %+v, want web01's certificate", cert)
+				}
+				if body := rec.Body.String(); !strings.Contains(body, "PRIVATE KEY") || strings.Count(body, "CERTIFICATE-----\n") != 4 {
+					t.Errorf("response holds %q, want a certificate, its key and the CA", body)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package pki
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Certificate records a client certificate handed out. The private key
+// went to the host and is not kept.
+type Certificate struct {
+	Client      string    `json:"client"` // inventory host name, the certificate's common name
+	IP          string    `json:"ip,omitempty"`
+	Serial      string    `json:"serial"` // hex
+	Fingerprint string    `json:"fingerprint"`
+	NotBefore   time.Time `json:"notBefore"`
+	NotAfter    time.Time `json:"notAfter"`
+	Issued      time.Time `json:"issued"`
+}
+
+// Store keeps the current certificate of every client. A client gets one
+// certificate; another is only issued after an operator deletes it.
+type Store struct {
+	mu    sync.Mutex
+	certs map[string]Certificate
+}
+
+// NewStore creates an empty store
+func NewStore() *Store {
+	return &Store{certs: make(map[string]Certificate)}
+}
+
+// Add records c as the client's certificate, reporting false if the
+// client already has one
+func (s *Store) Add(c Certificate) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.certs[c.Client]; ok {
+		return false
+	}
+	s.certs[c.Client] = c
+	return true
+}
+
+// Current reports whether serial is the client's current certificate
+func (s *Store) Current(client, serial string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.certs[client]
+	return ok && c.Serial == serial
+}
+
+// Get returns the client's certificate
+func (s *Store) Get(client string) (Certificate, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.certs[client]
+	return c, ok
+}
+
+// List returns every certificate by client
+func (s *Store) List() []Certificate {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]Certificate, 0, len(s.certs))
+	for _, c := range s.certs {
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Client < list[j].Client })
+	return list
+}
+
+// Delete forgets the client's certificate, so mutual TLS no longer accepts
+// it and the next install fetches a new one. It reports whether there was
+// one.
+func (s *Store) Delete(client string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.certs[client]
+	delete(s.certs, client)
+	return ok
+}
+
+// Snapshot returns every certificate for backups
+func (s *Store) Snapshot() []Certificate {
+	return s.List()
+}
+
+// Load replaces the issued certificates with list, as a backup restores
+// them, so only their serials are current again
+func (s *Store) Load(list []Certificate) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.certs = make(map[string]Certificate, len(list))
+	for _, c := range list {
+		s.certs[c.Client] = c
+	}
+}
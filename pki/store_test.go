@@ -0,0 +1,51 @@
+package pki
+
+import "testing"
+
+func TestStore(t *testing.T) {
+	s := NewStore()
+	if !s.Add(Certificate{Client: "web01", Serial: "0a"}) || !s.Add(Certificate{Client: "db01", Serial: "0b"}) {
+		t.Fatal("first certificates refused")
+	}
+	if s.Add(Certificate{Client: "web01", Serial: "0c"}) {
+		t.Error("second certificate for web01 accepted")
+	}
+	if !s.Current("web01", "0a") || s.Current("web01", "0c") || s.Current("app01", "0a") {
+		t.Error("wrong serial current")
+	}
+	if c, ok := s.Get("db01"); !ok || c.Serial != "0b" {
+		t.Errorf("Get = %+v, %v", c, ok)
+	}
+	if list := s.List(); len(list) != 2 || list[0].Client != "db01" || list[1].Client != "web01" {
+		t.Errorf("List = %+v", list)
+	}
+
+	if !s.Delete("web01") || s.Delete("web01") || s.Current("web01", "0a") {
+		t.Error("deleted certificate still held")
+	}
+	if !s.Add(Certificate{Client: "web01", Serial: "0c"}) {
+		t.Error("no new certificate after deleting")
+	}
+}
+
+func TestStoreLoad(t *testing.T) {
+	s := NewStore()
+	s.Add(Certificate{Client: "web01", Serial: "0a"})
+	backup := s.Snapshot()
+
+	s.Delete("web01")
+	s.Add(Certificate{Client: "web01", Serial: "0c"})
+	s.Add(Certificate{Client: "db01", Serial: "0b"})
+	s.Load(backup)
+	if !s.Current("web01", "0a") || s.Current("web01", "0c") {
+		t.Error("restored serial not current")
+	}
+	if _, ok := s.Get("db01"); ok {
+		t.Error("certificate issued after the backup kept")
+	}
+
+	backup[0].Serial = "ff"
+	if !s.Current("web01", "0a") {
+		t.Error("store shares the backup's slice")
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// runPower drives a host's BMC through a running server's management API:
+//
+//	go-pxe power [-api http://127.0.0.1:9090] [-domain default] <host> <status|on|off|cycle|pxe|reprovision>
+//
+// reprovision sets a one-time network boot and power-cycles the host, so it
+// comes back up in the installer.
+func runPower(args []string) {
+	fs := flag.NewFlagSet("power", flag.ExitOnError)
+	apiURL := fs.String("api", "http://127.0.0.1:9090", "Management API of the server")
+	token := fs.String("token", os.Getenv("GOPXE_API_TOKEN"), "API bearer token (default from GOPXE_API_TOKEN)")
+	domain := fs.String("domain", "default", "Provisioning domain of the host")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: go-pxe power [flags] <host> <status|on|off|cycle|pxe|reprovision>\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	host, action := fs.Arg(0), fs.Arg(1)
+
+	// BMCs can take a while, the server gives up after 90s
+	c := newAPIClient(*apiURL, *domain, *token, 2*time.Minute)
+	path := "/hosts/" + host
+	var err error
+	switch action {
+	case "status":
+		var p struct{ State string }
+		if err := c.get(path+"/power", &p); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("%s: power %s\n", host, p.State)
+		return
+	case "on", "off", "cycle":
+		err = c.post(path+"/power/"+action, nil)
+	case "pxe", "reprovision":
+		err = c.post(path+"/"+action, nil)
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("%s: %s done\n", host, action)
+}
@@ -0,0 +1,116 @@
+// Package qos shares the provisioning servers fairly between clients: it
+// caps each client's transfers in flight and its bandwidth across TFTP and
+// HTTP together, so one greedy client can't take the server over while a
+// rack reimages.
+package qos
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ars1364/go-pxe/fetch"
+	"github.com/ars1364/go-pxe/metrics"
+)
+
+var (
+	mRejected = metrics.Default.Counter("gopxe_qos_rejected_total", "Transfers refused because the client had as many in flight as allowed, by protocol.", "domain", "proto")
+	mDelayed  = metrics.Default.Counter("gopxe_qos_delay_seconds_total", "Time transfers were held back to keep clients within their bandwidth, by protocol.", "domain", "proto")
+)
+
+// Limits are what each client may take; zero is unlimited
+type Limits struct {
+	Transfers int   // transfers in flight
+	Rate      int64 // bytes per second
+}
+
+// Shaper enforces Limits on every client, by address. A nil *Shaper
+// admits everything at full speed, so servers can use it unconditionally.
+type Shaper struct {
+	limits Limits
+
+	mu      sync.Mutex
+	clients map[string]*client
+}
+
+type client struct {
+	transfers int
+	limiter   *fetch.Limiter // nil if the rate is unlimited
+}
+
+// NewShaper creates a shaper enforcing limits
+func NewShaper(limits Limits) *Shaper {
+	return &Shaper{limits: limits, clients: make(map[string]*client)}
+}
+
+// Instrument starts domain's series at zero
+func (s *Shaper) Instrument(domain string) {
+	for _, proto := range []string{"tftp", "http"} {
+		mRejected.With(domain, proto)
+		mDelayed.With(domain, proto)
+	}
+}
+
+// Acquire admits a transfer to ip over proto ("tftp" or "http") for
+// domain, unless ip already has as many in flight as allowed. The Slot
+// must be released when the transfer ends.
+func (s *Shaper) Acquire(domain, proto string, ip net.IP) (*Slot, bool) {
+	if s == nil {
+		return nil, true
+	}
+	key := ip.String()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.clients[key]
+	if c == nil {
+		c = &client{}
+		if s.limits.Rate > 0 {
+			c.limiter = fetch.NewLimiter(s.limits.Rate)
+		}
+		s.clients[key] = c
+	}
+	if s.limits.Transfers > 0 && c.transfers >= s.limits.Transfers {
+		mRejected.With(domain, proto).Inc()
+		return nil, false
+	}
+	c.transfers++
+	return &Slot{s: s, c: c, key: key, domain: domain, proto: proto}, true
+}
+
+// Slot is one admitted transfer. A nil *Slot never waits.
+type Slot struct {
+	s             *Shaper
+	c             *client
+	key           string
+	domain, proto string
+}
+
+// Limited reports whether the slot's bandwidth is capped
+func (sl *Slot) Limited() bool {
+	return sl != nil && sl.c.limiter != nil
+}
+
+// Wait blocks until n more bytes may be sent to the client, which shares
+// its bandwidth with its other transfers
+func (sl *Slot) Wait(n int) {
+	if !sl.Limited() {
+		return
+	}
+	start := time.Now()
+	sl.c.limiter.Wait(n)
+	if d := time.Since(start); d > time.Millisecond {
+		mDelayed.With(sl.domain, sl.proto).Add(d.Seconds())
+	}
+}
+
+// Release ends the transfer; the client is forgotten with its last one
+func (sl *Slot) Release() {
+	if sl == nil {
+		return
+	}
+	sl.s.mu.Lock()
+	defer sl.s.mu.Unlock()
+	if sl.c.transfers--; sl.c.transfers == 0 {
+		delete(sl.s.clients, sl.key)
+	}
+}
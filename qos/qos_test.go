@@ -0,0 +1,126 @@
+package qos
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ars1364/go-pxe/metrics"
+)
+
+var (
+	ip1 = net.IPv4(10, 0, 0, 5)
+	ip2 = net.IPv4(10, 0, 0, 6)
+)
+
+// metric returns the value of series in the default registry, or -1 if
+// it has none
+func metric(series string) float64 {
+	var b strings.Builder
+	metrics.Default.WriteText(&b)
+	for line := range strings.Lines(b.String()) {
+		if v, ok := strings.CutPrefix(line, series+" "); ok {
+			f, _ := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			return f
+		}
+	}
+	return -1
+}
+
+func TestTransfers(t *testing.T) {
+	s := NewShaper(Limits{Transfers: 2})
+	s.Instrument("qos-transfers")
+	rejected := `gopxe_qos_rejected_total{domain="qos-transfers",proto="http"}`
+	before := metric(rejected)
+	if before < 0 {
+		t.Error("series not instrumented")
+	}
+
+	a, ok1 := s.Acquire("qos-transfers", "tftp", ip1)
+	b, ok2 := s.Acquire("qos-transfers", "http", ip1)
+	if !ok1 || !ok2 {
+		t.Fatal("transfers within the limit refused")
+	}
+	if _, ok := s.Acquire("qos-transfers", "http", ip1); ok {
+		t.Error("third transfer admitted")
+	}
+	if got := metric(rejected) - before; got != 1 {
+		t.Errorf("counted %v rejections", got)
+	}
+	if _, ok := s.Acquire("qos-transfers", "http", ip2); !ok {
+		t.Error("another client refused")
+	}
+
+	a.Release()
+	c, ok := s.Acquire("qos-transfers", "tftp", ip1)
+	if !ok {
+		t.Error("transfer refused after one ended")
+	}
+	b.Release()
+	c.Release()
+	if _, ok := s.clients[ip1.String()]; ok {
+		t.Error("client kept after its last transfer")
+	}
+}
+
+func TestUnlimited(t *testing.T) {
+	s := NewShaper(Limits{})
+	for range 100 {
+		sl, ok := s.Acquire("lab", "tftp", ip1)
+		if !ok || sl.Limited() {
+			t.Fatalf("Acquire = %v, %v", sl, ok)
+		}
+	}
+
+	var nilShaper *Shaper
+	sl, ok := nilShaper.Acquire("lab", "http", ip1)
+	if !ok || sl != nil || sl.Limited() {
+		t.Errorf("nil shaper: Acquire = %v, %v", sl, ok)
+	}
+	sl.Wait(1 << 30) // never waits
+	sl.Release()
+}
+
+func TestRate(t *testing.T) {
+	const rate = 100 << 10
+	s := NewShaper(Limits{Rate: rate})
+	s.Instrument("qos-rate")
+	delayed := `gopxe_qos_delay_seconds_total{domain="qos-rate",proto="tftp"}`
+	before := metric(delayed)
+
+	// A client's transfers share its bandwidth: the first second's worth
+	// passes at once, the next half second's is split between the two
+	a, _ := s.Acquire("qos-rate", "tftp", ip1)
+	b, _ := s.Acquire("qos-rate", "http", ip1)
+	other, _ := s.Acquire("qos-rate", "http", ip2)
+	if !a.Limited() || a.c != b.c || a.c == other.c {
+		t.Fatal("transfers don't share a client limiter")
+	}
+	a.Wait(rate)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for _, sl := range []*Slot{a, b} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sl.Wait(rate / 4)
+		}()
+	}
+	wg.Wait()
+	if d := time.Since(start); d < 400*time.Millisecond || d > 2*time.Second {
+		t.Errorf("sending half a second's worth took %s", d)
+	}
+	if got := metric(delayed) - before; got < 0.2 {
+		t.Errorf("counted %vs of delay", got)
+	}
+
+	// Other clients have their own
+	start = time.Now()
+	other.Wait(rate / 2)
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("another client waited %s", d)
+	}
+}
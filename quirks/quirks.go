@@ -0,0 +1,99 @@
+// Package quirks switches the DHCP and TFTP servers between strict RFC
+// conformance and the leniency old and broken boot ROMs need, logging and
+// counting every deviation tolerated or refused, to show where a fleet
+// allows tightening behavior.
+package quirks
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/ars1364/go-pxe/metrics"
+)
+
+var mQuirks = metrics.Default.Counter("gopxe_protocol_quirks_total", "Deviations from the RFCs seen, by protocol, quirk and whether they were tolerated or refused.", "domain", "proto", "quirk", "action")
+
+// Mode is how the servers treat deviations from the RFCs
+type Mode int
+
+const (
+	// Compat tolerates the known quirks of boot ROMs, as go-pxe always has
+	Compat Mode = iota
+	// Strict keeps to the RFCs, refusing what they don't allow
+	Strict
+)
+
+// Default is the mode of every server, set once at startup
+var Default Mode
+
+// ParseMode reads "compat" or "strict"
+func ParseMode(s string) (Mode, error) {
+	switch s {
+	case "compat", "":
+		return Compat, nil
+	case "strict":
+		return Strict, nil
+	}
+	return Compat, fmt.Errorf("protocol mode %q, want compat or strict", s)
+}
+
+func (m Mode) String() string {
+	if m == Strict {
+		return "strict"
+	}
+	return "compat"
+}
+
+// Quirk is a deviation from the RFCs that compatibility mode tolerates
+type Quirk string
+
+// The quirks of DHCP (RFC 2131, 2132) and PXE (RFC 4578) clients
+const (
+	// TruncatedOption is an option running past the end of the packet;
+	// the options before it are kept
+	TruncatedOption Quirk = "truncated-option"
+	// MissingEnd is options not closed by the End option
+	MissingEnd Quirk = "missing-end"
+	// HardwareType is a hardware type or address length other than
+	// Ethernet's; the first 6 bytes of chaddr are taken as the MAC
+	HardwareType Quirk = "hardware-type"
+	// UUIDWithoutType is a client machine identifier (option 97) of 16
+	// bytes, missing the type byte
+	UUIDWithoutType Quirk = "uuid-without-type"
+	// PaddedReply is a reply padded to 548 bytes, as some ROMs silently
+	// drop shorter ones, rather than BOOTP's 300
+	PaddedReply Quirk = "padded-reply"
+)
+
+// The quirks of TFTP (RFC 1350, 2347-2349) clients
+const (
+	// Unterminated is a request whose last field lacks its NUL
+	Unterminated Quirk = "unterminated"
+	// TransferMode is a transfer mode other than octet or netascii; the
+	// file is sent as octet
+	TransferMode Quirk = "transfer-mode"
+	// BlockSize is a blksize outside 8-65464; it is used, capped to the
+	// MTU, rather than ignored
+	BlockSize Quirk = "blksize"
+	// WrongTID is an acknowledgment from another port of the client,
+	// which the transfer moves to rather than answering it with an error
+	WrongTID Quirk = "wrong-tid"
+)
+
+// Allow reports whether q is tolerated for client over proto ("dhcp" or
+// "tftp"), and logs and counts the decision. detail says what was seen or
+// done.
+func (m Mode) Allow(domain, proto string, q Quirk, client, detail string) bool {
+	tag := "[DHCP]"
+	if proto == "tftp" {
+		tag = "[TFTP]"
+	}
+	if m == Strict {
+		log.Printf("%s Strict: %s refused for %s: %s", tag, q, client, detail)
+		mQuirks.With(domain, proto, string(q), "refused").Inc()
+		return false
+	}
+	log.Printf("%s Quirk %s tolerated for %s: %s", tag, q, client, detail)
+	mQuirks.With(domain, proto, string(q), "tolerated").Inc()
+	return true
+}
@@ -0,0 +1,81 @@
+package quirks
+
+import (
+	"bytes"
+	"log"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/ars1364/go-pxe/metrics"
+)
+
+func TestParseMode(t *testing.T) {
+	tests := []struct {
+		in   string
+		mode Mode
+		ok   bool
+	}{
+		{"", Compat, true},
+		{"compat", Compat, true},
+		{"strict", Strict, true},
+		{"Strict", Compat, false},
+		{"lenient", Compat, false},
+	}
+	for _, tt := range tests {
+		m, err := ParseMode(tt.in)
+		if m != tt.mode || (err == nil) != tt.ok {
+			t.Errorf("ParseMode(%q) = %s, %v", tt.in, m, err)
+		}
+		if tt.ok && tt.in != "" && m.String() != tt.in {
+			t.Errorf("%s.String() = %s", tt.in, m)
+		}
+	}
+}
+
+// metric is the value of series in the default registry, or 0
+func metric(series string) float64 {
+	var b strings.Builder
+	metrics.Default.WriteText(&b)
+	for line := range strings.Lines(b.String()) {
+		if v, ok := strings.CutPrefix(line, series+" "); ok {
+			f, _ := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			return f
+		}
+	}
+	return 0
+}
+
+func TestAllow(t *testing.T) {
+	var logs bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&logs)
+	series := []string{
+		`gopxe_protocol_quirks_total{domain="quirks-test",proto="dhcp",quirk="missing-end",action="tolerated"}`,
+		`gopxe_protocol_quirks_total{domain="quirks-test",proto="tftp",quirk="blksize",action="refused"}`,
+	}
+	var before []float64
+	for _, s := range series {
+		before = append(before, metric(s))
+	}
+
+	if !Compat.Allow("quirks-test", "dhcp", MissingEnd, "aa:bb:cc:dd:ee:01", "no End option") {
+		t.Error("compat mode refused a quirk")
+	}
+	if Strict.Allow("quirks-test", "tftp", BlockSize, "10.0.0.5:2000", "blksize 4") {
+		t.Error("strict mode tolerated a quirk")
+	}
+	for _, want := range []string{
+		"[DHCP] Quirk missing-end tolerated for aa:bb:cc:dd:ee:01: no End option",
+		"[TFTP] Strict: blksize refused for 10.0.0.5:2000: blksize 4",
+	} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("log lacks %q:\n%s", want, logs.String())
+		}
+	}
+	for i, s := range series {
+		if got := metric(s); got != before[i]+1 {
+			t.Errorf("%s = %v, was %v", s, got, before[i])
+		}
+	}
+}
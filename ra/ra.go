@@ -0,0 +1,220 @@
+// Package ra sends IPv6 router advertisements (RFC 4861) on the
+// provisioning segment, so IPv6 clients can autoconfigure an address, learn
+// resolvers (RFC 8106) and know whether to ask DHCPv6 without a real router.
+package ra
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ICMPv6 types and RA option codes
+const (
+	typeRouterSolicit = 133
+	typeRouterAdvert  = 134
+
+	optSourceLinkAddr = 1
+	optPrefixInfo     = 3
+	optRDNSS          = 25
+
+	flagManaged = 0x80
+	flagOther   = 0x40
+
+	flagOnLink     = 0x80
+	flagAutonomous = 0x40
+)
+
+// RFC 4861 section 10 timings
+const (
+	initialAdverts    = 3
+	initialInterval   = 16 * time.Second
+	minDelayBetweenRA = 3 * time.Second
+)
+
+var allNodes = net.ParseIP("ff02::1")
+var allRouters = net.ParseIP("ff02::2")
+
+// Server advertises Prefix on Interface
+type Server struct {
+	Interface string
+	Prefix    *net.IPNet
+
+	// Managed and Other set the M and O flags, telling clients to get
+	// addresses, or only other configuration such as the boot URL, from
+	// DHCPv6
+	Managed bool
+	Other   bool
+
+	// DNS servers advertised in an RDNSS option if set
+	DNS []net.IP
+
+	// Interval is the longest time between unsolicited advertisements
+	Interval time.Duration
+
+	mu   sync.Mutex
+	last time.Time
+}
+
+func NewServer(iface string, prefix *net.IPNet) *Server {
+	return &Server{Interface: iface, Prefix: prefix, Interval: 600 * time.Second}
+}
+
+// ListenAndServe advertises periodically and answers router solicitations
+func (s *Server) ListenAndServe() error {
+	if ones, bits := s.Prefix.Mask.Size(); ones != 64 || bits != 128 {
+		return fmt.Errorf("prefix %s must be an IPv6 /64 for address autoconfiguration", s.Prefix)
+	}
+	if s.Interval < 4*time.Second || s.Interval > 1800*time.Second {
+		return fmt.Errorf("advertisement interval %s must be between 4s and 30m", s.Interval)
+	}
+	ifi, err := net.InterfaceByName(s.Interface)
+	if err != nil {
+		return fmt.Errorf("interface lookup %s: %w", s.Interface, err)
+	}
+	linkLocal, err := linkLocalAddr(ifi)
+	if err != nil {
+		return err
+	}
+
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			if err := c.Control(func(fd uintptr) { sockErr = setSocketOptions(int(fd), ifi) }); err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+	pc, err := lc.ListenPacket(context.Background(), "ip6:ipv6-icmp", linkLocal.String()+"%"+ifi.Name)
+	if err != nil {
+		return fmt.Errorf("RA listen: %w", err)
+	}
+	defer pc.Close()
+
+	log.Printf("[RA] Advertising %s on %s (managed=%v, other=%v, %d DNS servers)", s.Prefix, ifi.Name, s.Managed, s.Other, len(s.DNS))
+
+	ra := s.advert(ifi.HardwareAddr)
+	dst := &net.IPAddr{IP: allNodes, Zone: ifi.Name}
+	go func() {
+		for i := 0; ; i++ {
+			s.send(pc, ra, dst)
+			wait := s.Interval/3 + rand.N(s.Interval*2/3)
+			if i < initialAdverts && wait > initialInterval {
+				wait = initialInterval
+			}
+			time.Sleep(wait)
+		}
+	}()
+
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			log.Printf("[RA] Read error: %v", err)
+			continue
+		}
+		if n < 8 || buf[0] != typeRouterSolicit || buf[1] != 0 {
+			continue
+		}
+		// Answer on the all-nodes group like most routers; a burst of
+		// solicitations shares one advertisement
+		s.mu.Lock()
+		recent := time.Since(s.last) < minDelayBetweenRA
+		s.mu.Unlock()
+		if !recent {
+			log.Printf("[RA] Solicitation from %s", from)
+			s.send(pc, ra, dst)
+		}
+	}
+}
+
+func (s *Server) send(pc net.PacketConn, ra []byte, dst net.Addr) {
+	s.mu.Lock()
+	s.last = time.Now()
+	s.mu.Unlock()
+	if _, err := pc.WriteTo(ra, dst); err != nil {
+		log.Printf("[RA] Send error: %v", err)
+	}
+}
+
+// advert builds the router advertisement. Router lifetime is zero: go-pxe
+// doesn't route IPv6, it only hands out the prefix and resolvers.
+func (s *Server) advert(mac net.HardwareAddr) []byte {
+	var flags byte
+	if s.Managed {
+		flags |= flagManaged
+	}
+	if s.Other {
+		flags |= flagOther
+	}
+	// type, code, checksum (filled in by the kernel), hop limit, flags,
+	// router lifetime, reachable time, retrans timer
+	b := []byte{typeRouterAdvert, 0, 0, 0, 64, flags, 0, 0}
+	b = binary.BigEndian.AppendUint32(b, 0)
+	b = binary.BigEndian.AppendUint32(b, 0)
+
+	if len(mac) == 6 {
+		b = append(b, optSourceLinkAddr, 1)
+		b = append(b, mac...)
+	}
+
+	b = append(b, optPrefixInfo, 4, 64, flagOnLink|flagAutonomous)
+	b = binary.BigEndian.AppendUint32(b, 86400) // valid lifetime
+	b = binary.BigEndian.AppendUint32(b, 14400) // preferred lifetime
+	b = binary.BigEndian.AppendUint32(b, 0)
+	b = append(b, s.Prefix.IP.To16()...)
+
+	if len(s.DNS) > 0 {
+		b = append(b, optRDNSS, byte(1+2*len(s.DNS)), 0, 0)
+		b = binary.BigEndian.AppendUint32(b, uint32(3*s.Interval/time.Second))
+		for _, ip := range s.DNS {
+			b = append(b, ip.To16()...)
+		}
+	}
+	return b
+}
+
+func linkLocalAddr(ifi *net.Interface) (net.IP, error) {
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range addrs {
+		if ipn, ok := a.(*net.IPNet); ok && ipn.IP.To4() == nil && ipn.IP.IsLinkLocalUnicast() {
+			return ipn.IP, nil
+		}
+	}
+	return nil, fmt.Errorf("no IPv6 link-local address on %s", ifi.Name)
+}
+
+// setSocketOptions sends with the hop limit of 255 receivers require,
+// pins multicast to ifi and joins all-routers to hear solicitations
+func setSocketOptions(fd int, ifi *net.Interface) error {
+	for _, o := range []struct {
+		name string
+		opt  int
+		v    int
+	}{
+		{"IPV6_MULTICAST_HOPS", syscall.IPV6_MULTICAST_HOPS, 255},
+		{"IPV6_UNICAST_HOPS", syscall.IPV6_UNICAST_HOPS, 255},
+		{"IPV6_MULTICAST_IF", syscall.IPV6_MULTICAST_IF, ifi.Index},
+		{"IPV6_MULTICAST_LOOP", syscall.IPV6_MULTICAST_LOOP, 0},
+	} {
+		if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, o.opt, o.v); err != nil {
+			return &net.OpError{Op: o.name, Err: err}
+		}
+	}
+	mreq := &syscall.IPv6Mreq{Interface: uint32(ifi.Index)}
+	copy(mreq.Multiaddr[:], allRouters)
+	if err := syscall.SetsockoptIPv6Mreq(fd, syscall.IPPROTO_IPV6, syscall.IPV6_JOIN_GROUP, mreq); err != nil {
+		return &net.OpError{Op: "IPV6_JOIN_GROUP", Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package ra
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAdvert(t *testing.T) {
+	_, prefix, _ := net.ParseCIDR("2001:db8:1::/64")
+	mac := net.HardwareAddr{0x52, 0x54, 0, 0x12, 0x34, 0x56}
+	tests := []struct {
+		name      string
+		managed   bool
+		other     bool
+		dns       []net.IP
+		mac       net.HardwareAddr
+		wantFlags byte
+		wantOpts  []byte
+	}{
+		{"SLAAC only", false, false, nil, mac, 0, []byte{optSourceLinkAddr, optPrefixInfo}},
+		{"stateless DHCPv6", false, true, nil, mac, flagOther, []byte{optSourceLinkAddr, optPrefixInfo}},
+		{"stateful DHCPv6", true, true, nil, mac, flagManaged | flagOther, []byte{optSourceLinkAddr, optPrefixInfo}},
+		{"resolvers", false, false, []net.IP{net.ParseIP("2001:db8:1::1"), net.ParseIP("2001:db8:1::2")}, mac, 0, []byte{optSourceLinkAddr, optPrefixInfo, optRDNSS}},
+		{"no MAC", false, false, nil, nil, 0, []byte{optPrefixInfo}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer("eth0", prefix)
+			s.Managed, s.Other, s.DNS = tt.managed, tt.other, tt.dns
+			b := s.advert(tt.mac)
+
+			if b[0] != typeRouterAdvert || b[1] != 0 || b[4] != 64 || b[5] != tt.wantFlags {
+				t.Fatalf("header % x", b[:8])
+			}
+			if lifetime := binary.BigEndian.Uint16(b[6:]); lifetime != 0 {
+				t.Errorf("router lifetime %d, want 0", lifetime)
+			}
+
+			var opts []byte
+			for o := b[16:]; len(o) > 0; {
+				if len(o) < 2 || o[1] == 0 || len(o) < int(o[1])*8 {
+					t.Fatalf("malformed option % x", o)
+				}
+				body := o[:int(o[1])*8]
+				switch o[0] {
+				case optSourceLinkAddr:
+					if net.HardwareAddr(body[2:8]).String() != tt.mac.String() {
+						t.Errorf("link address % x", body[2:8])
+					}
+				case optPrefixInfo:
+					if body[2] != 64 || body[3] != flagOnLink|flagAutonomous || !net.IP(body[16:32]).Equal(prefix.IP) {
+						t.Errorf("prefix option % x", body)
+					}
+				case optRDNSS:
+					if lifetime := binary.BigEndian.Uint32(body[4:]); lifetime != 1800 {
+						t.Errorf("RDNSS lifetime %d, want 1800", lifetime)
+					}
+					for i, ip := range tt.dns {
+						if got := net.IP(body[8+16*i : 24+16*i]); !got.Equal(ip) {
+							t.Errorf("resolver %d = %s, want %s", i, got, ip)
+						}
+					}
+				}
+				opts = append(opts, o[0])
+				o = o[len(body):]
+			}
+			if string(opts) != string(tt.wantOpts) {
+				t.Errorf("options %v, want %v", opts, tt.wantOpts)
+			}
+		})
+	}
+}
+
+func TestListenAndServe(t *testing.T) {
+	_, wide, _ := net.ParseCIDR("2001:db8::/48")
+	_, prefix, _ := net.ParseCIDR("2001:db8:1::/64")
+	tests := []struct {
+		name     string
+		prefix   *net.IPNet
+		interval time.Duration
+	}{
+		{"prefix not a /64", wide, 600 * time.Second},
+		{"zero interval", prefix, 0},
+		{"interval too short", prefix, time.Second},
+		{"interval too long", prefix, time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer("gopxe-missing0", tt.prefix)
+			s.Interval = tt.interval
+			if err := s.ListenAndServe(); err == nil {
+				t.Error("started")
+			}
+		})
+	}
+}
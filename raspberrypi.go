@@ -0,0 +1,111 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/ars1364/go-pxe/httpserver"
+	"github.com/ars1364/go-pxe/inventory"
+)
+
+// piOUIs are the MAC address prefixes of Raspberry Pis
+var piOUIs = []string{"b8:27:eb", "dc:a6:32", "e4:5f:01", "28:cd:c1", "d8:3a:dd", "2c:cf:67", "88:a2:9e"}
+
+// piDir matches the directory a Pi's bootloader asks for its files in: its
+// serial number or, with TFTP_PREFIX=2 in its EEPROM, its MAC address
+var piDir = regexp.MustCompile(`^([0-9a-f]{8}|[0-9a-f]{2}(-[0-9a-f]{2}){5})/`)
+
+// raspberryPi reports whether the client with mac is a Raspberry Pi, by
+// its address or its host definition
+func (d *domain) raspberryPi(mac net.HardwareAddr) bool {
+	if len(mac) == 6 && slices.Contains(piOUIs, mac[:3].String()) {
+		return true
+	}
+	h, ok := d.store.HostByMAC(mac)
+	return ok && h.RaspberryPi != nil
+}
+
+// generateRaspberryPi backs the <serial>/ directories Raspberry Pis boot
+// from with their profile's boot partition: config.txt with the host's
+// lines added, the host's cmdline.txt if it has one, and any file that is
+// only there as <name>.tmpl rendered for the Pi. A Pi without such a
+// profile, or kept from being provisioned, finds nothing and goes on to
+// the TFTP root or its next boot device.
+func (d *domain) generateRaspberryPi(name string, ip net.IP) ([]byte, bool) {
+	dir, file, _ := strings.Cut(name, "/")
+	h, p := d.piAt(dir, ip)
+	if p.RaspberryPi == nil || diskBoot(h, p) != "" {
+		return nil, false
+	}
+	who := cmp.Or(h.Name, "unknown Pi "+dir)
+	pi := h.RaspberryPi
+	if pi == nil {
+		pi = &inventory.RaspberryPiHost{}
+	}
+	switch {
+	case file == "cmdline.txt" && pi.Cmdline != "":
+		return []byte(pi.Cmdline + "\n"), true
+	case file == "config.txt" && len(pi.Config) > 0:
+		data, err := d.piFile(p, file, ip)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("[TFTP] %s: %s for %s: %v", d.cfg.Name, name, who, err)
+			return nil, false
+		}
+		if len(data) > 0 && !strings.HasSuffix(string(data), "\n") {
+			data = append(data, '\n')
+		}
+		data = fmt.Appendf(data, "\n# %s (added by go-pxe)\n[all]\n%s\n", who, strings.Join(pi.Config, "\n"))
+		return data, true
+	}
+	data, err := d.piFile(p, file, ip)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("[TFTP] %s: %s for %s: %v", d.cfg.Name, name, who, err)
+		}
+		return nil, false
+	}
+	return data, true
+}
+
+// piAt is the Pi asking for its files in dir from ip, and its profile: the
+// discovery profile if it is unknown
+func (d *domain) piAt(dir string, ip net.IP) (inventory.Host, inventory.Profile) {
+	var mac net.HardwareAddr
+	if h, ok := d.store.HostBySerial(dir); ok {
+		mac, _ = net.ParseMAC(h.MAC)
+	} else if m, err := net.ParseMAC(strings.ReplaceAll(dir, "-", ":")); err == nil {
+		mac = m
+	} else {
+		mac = d.leaseMAC(ip)
+	}
+	h, p, _ := d.store.ProfileFor(mac)
+	if h.Name == "" {
+		p, _ = d.store.Profile(d.cfg.Discovery)
+	}
+	return h, p
+}
+
+// piFile reads name from the profile's boot partition or, if only
+// <name>.tmpl exists there, renders that for the Pi at ip
+func (d *domain) piFile(p inventory.Profile, name string, ip net.IP) ([]byte, error) {
+	full := filepath.Join(d.cfg.TFTPRoot, filepath.FromSlash(p.RaspberryPi.Dir), filepath.FromSlash(path.Clean("/"+name)))
+	data, err := os.ReadFile(full)
+	if !errors.Is(err, fs.ErrNotExist) {
+		return data, err
+	}
+	text, terr := os.ReadFile(full + httpserver.TemplateSuffix)
+	if terr != nil {
+		return nil, err
+	}
+	return d.render(name, text, ip)
+}
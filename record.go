@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ars1364/go-pxe/recording"
+)
+
+// recordingAddrs are the addresses mac is leased or fixed to
+func (d *domain) recordingAddrs(mac net.HardwareAddr) []net.IP {
+	var ips []net.IP
+	if ip := d.leaseIP(mac); ip != nil {
+		ips = append(ips, ip)
+	}
+	if ip := d.store.AddressFor(mac); ip != nil {
+		ips = append(ips, ip)
+	}
+	return ips
+}
+
+// recordingExtra adds what the inventory and DHCP know of mac to its
+// recording's bundle
+func (d *domain) recordingExtra(mac string) map[string][]byte {
+	hw, _ := net.ParseMAC(mac)
+	h, p, _ := d.store.ProfileFor(hw)
+	state := map[string]any{"domain": d.cfg.Name, "revision": d.store.Revision()}
+	if h.Name != "" {
+		state["host"], state["profile"] = h, p
+	}
+	for _, l := range d.dhcp.Leases() {
+		if strings.EqualFold(l.MAC, mac) {
+			state["lease"] = l
+		}
+	}
+	data, _ := json.MarshalIndent(state, "", "  ")
+	return map[string][]byte{"inventory.json": data}
+}
+
+// recordRender renders a template for the client at ip, keeping the
+// result if the client is being recorded
+func (d *domain) recordRender(name string, text []byte, ip net.IP) ([]byte, error) {
+	out, err := d.render(name, text, ip)
+	if err == nil {
+		d.recorder.File(ip, name, out)
+	}
+	return out, err
+}
+
+// recordGenerate generates a file for the client at ip, keeping it if the
+// client is being recorded
+func (d *domain) recordGenerate(name string, ip net.IP) ([]byte, bool) {
+	out, ok := d.generate(name, ip)
+	if ok {
+		d.recorder.File(ip, name, out)
+	}
+	return out, ok
+}
+
+// runRecord records one machine through a running server's management
+// API, until the recording ends or is interrupted, and downloads the
+// bundle:
+//
+//	go-pxe record -mac 52:54:00:12:34:56 [-for 30m] [-o bundle.tar.gz]
+//
+// With -get it only downloads the machine's latest recording.
+func runRecord(args []string) {
+	fs := flag.NewFlagSet("record", flag.ExitOnError)
+	apiURL := fs.String("api", "http://127.0.0.1:9090", "Management API of the server")
+	token := fs.String("token", os.Getenv("GOPXE_API_TOKEN"), "API bearer token (default from GOPXE_API_TOKEN)")
+	domain := fs.String("domain", "default", "Provisioning domain the machine boots in")
+	macFlag := fs.String("mac", "", "MAC address of the machine to record (required)")
+	dur := fs.Duration("for", recording.DefaultDuration, "How long to record; interrupt to stop early")
+	out := fs.String("o", "", "Bundle file to write (default gopxe-<mac>.tar.gz)")
+	get := fs.Bool("get", false, "Download the latest recording instead of starting one")
+	fs.Parse(args)
+
+	mac, err := net.ParseMAC(*macFlag)
+	if err != nil {
+		log.Fatalf("-mac: %v", err)
+	}
+	if *out == "" {
+		*out = "gopxe-" + strings.ReplaceAll(mac.String(), ":", "") + ".tar.gz"
+	}
+	c := newAPIClient(*apiURL, *domain, *token, time.Minute)
+	path := "/recordings/" + url.PathEscape(mac.String())
+
+	if !*get {
+		var info recording.Info
+		if err := c.post(path+"?duration="+dur.String(), &info); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Recording %s until %s; boot it now, or interrupt to stop\n", mac, info.Until.Local().Format(time.TimeOnly))
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		tick := time.NewTicker(5 * time.Second)
+		for info.Active {
+			select {
+			case <-sig:
+				if err := c.do("DELETE", path, &info); err != nil {
+					log.Fatal(err)
+				}
+			case <-tick.C:
+				if err := c.get(path, &info); err != nil {
+					log.Fatal(err)
+				}
+			}
+		}
+		tick.Stop()
+		signal.Stop(sig)
+		fmt.Printf("Recorded %d packets, %d events, %d log lines and %d files\n", info.Packets, info.Events, info.Lines, info.Files)
+	}
+
+	f, err := os.Create(*out)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := c.download(path+"/bundle", f); err != nil {
+		f.Close()
+		os.Remove(*out)
+		log.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("Wrote", *out)
+}
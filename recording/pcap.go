@@ -0,0 +1,70 @@
+package recording
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+// snapLen is how much of each packet is kept; TFTP data blocks fit whole
+const snapLen = 1600
+
+// linkTypeRaw marks packets that start with their IP header
+const linkTypeRaw = 101
+
+// pcapHeader is the global header of a classic pcap file
+func pcapHeader() []byte {
+	h := make([]byte, 24)
+	binary.LittleEndian.PutUint32(h[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(h[4:], 2)
+	binary.LittleEndian.PutUint16(h[6:], 4)
+	binary.LittleEndian.PutUint32(h[16:], snapLen)
+	binary.LittleEndian.PutUint32(h[20:], linkTypeRaw)
+	return h
+}
+
+// pcapRecord frames a UDP payload from src to dst as an IPv4 packet in a
+// pcap record. Packets go-pxe sends and receives through sockets have no
+// headers left to capture, so they are made up from the addresses.
+func pcapRecord(t time.Time, src, dst *net.UDPAddr, payload []byte) []byte {
+	pkt := make([]byte, 28+len(payload))
+	pkt[0] = 0x45 // IPv4, 20-byte header
+	binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)))
+	pkt[8] = 64 // TTL
+	pkt[9] = 17 // UDP
+	copy(pkt[12:16], ipv4(src.IP))
+	copy(pkt[16:20], ipv4(dst.IP))
+	binary.BigEndian.PutUint16(pkt[10:], checksum(pkt[:20]))
+	binary.BigEndian.PutUint16(pkt[20:], uint16(src.Port))
+	binary.BigEndian.PutUint16(pkt[22:], uint16(dst.Port))
+	binary.BigEndian.PutUint16(pkt[24:], uint16(8+len(payload)))
+	copy(pkt[28:], payload)
+
+	kept := min(len(pkt), snapLen)
+	rec := make([]byte, 16+kept)
+	binary.LittleEndian.PutUint32(rec[0:], uint32(t.Unix()))
+	binary.LittleEndian.PutUint32(rec[4:], uint32(t.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(rec[8:], uint32(kept))
+	binary.LittleEndian.PutUint32(rec[12:], uint32(len(pkt)))
+	copy(rec[16:], pkt[:kept])
+	return rec
+}
+
+func ipv4(ip net.IP) net.IP {
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+	return net.IPv4zero.To4()
+}
+
+// checksum is the Internet checksum of an IP header
+func checksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,57 @@
+package recording
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPcapRecord(t *testing.T) {
+	when := time.Date(2024, 5, 1, 12, 0, 0, 123456000, time.UTC)
+	src := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 67}
+	dst := &net.UDPAddr{IP: net.IPv4bcast, Port: 68}
+	payload := []byte("DHCPOFFER")
+
+	rec := pcapRecord(when, src, dst, payload)
+	le := binary.LittleEndian
+	if le.Uint32(rec[0:]) != uint32(when.Unix()) || le.Uint32(rec[4:]) != 123456 {
+		t.Errorf("timestamp % x", rec[:8])
+	}
+	if kept, orig := le.Uint32(rec[8:]), le.Uint32(rec[12:]); kept != 28+9 || orig != 28+9 {
+		t.Errorf("lengths %d %d", kept, orig)
+	}
+	pkt := rec[16:]
+	if pkt[0] != 0x45 || pkt[9] != 17 || binary.BigEndian.Uint16(pkt[2:]) != 37 {
+		t.Errorf("IP header % x", pkt[:20])
+	}
+	if checksum(pkt[:20]) != 0 {
+		t.Error("IP header checksum does not verify")
+	}
+	if !net.IP(pkt[12:16]).Equal(src.IP) || !net.IP(pkt[16:20]).Equal(dst.IP) {
+		t.Errorf("addresses %v %v", net.IP(pkt[12:16]), net.IP(pkt[16:20]))
+	}
+	if binary.BigEndian.Uint16(pkt[20:]) != 67 || binary.BigEndian.Uint16(pkt[22:]) != 68 || binary.BigEndian.Uint16(pkt[24:]) != 17 {
+		t.Errorf("UDP header % x", pkt[20:28])
+	}
+	if !bytes.Equal(pkt[28:], payload) {
+		t.Errorf("payload %q", pkt[28:])
+	}
+
+	// Long packets are cut at the snap length; IPv6 ends show as 0.0.0.0
+	rec = pcapRecord(when, &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 69}, dst, make([]byte, 4000))
+	if kept, orig := le.Uint32(rec[8:]), le.Uint32(rec[12:]); kept != snapLen || orig != 4028 || len(rec) != 16+snapLen {
+		t.Errorf("long packet lengths %d %d, record %d bytes", kept, orig, len(rec))
+	}
+	if !net.IP(rec[16+12 : 16+16]).Equal(net.IPv4zero) {
+		t.Errorf("IPv6 source recorded as %v", net.IP(rec[16+12:16+16]))
+	}
+}
+
+func TestPcapHeader(t *testing.T) {
+	h := pcapHeader()
+	if len(h) != 24 || binary.LittleEndian.Uint32(h) != 0xa1b2c3d4 || binary.LittleEndian.Uint32(h[20:]) != linkTypeRaw {
+		t.Errorf("header % x", h)
+	}
+}
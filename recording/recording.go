@@ -0,0 +1,406 @@
+// Package recording records everything go-pxe does with one machine into
+// a bundle to debug it from: its DHCP and TFTP packets as a pcap, its HTTP
+// requests and other events, the files rendered and generated for it, and
+// the server's log lines about it, such as the boot file it was offered
+// and why.
+package recording
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ars1364/go-pxe/events"
+)
+
+// DefaultDuration is how long a recording runs unless told otherwise, and
+// MaxDuration the longest one may
+const (
+	DefaultDuration = 30 * time.Minute
+	MaxDuration     = 24 * time.Hour
+)
+
+// Limits on what one recording keeps, so a machine stuck in a boot loop
+// can't fill the server's memory; what is past them is counted as dropped
+const (
+	maxPcap  = 32 << 20
+	maxLog   = 8 << 20
+	maxFile  = 1 << 20 // larger generated files, such as boot loaders, aren't kept
+	maxFiles = 256
+)
+
+// keepDone is how many finished recordings are kept for download
+const keepDone = 16
+
+// ErrNotFound means there is no recording of a MAC address
+var ErrNotFound = errors.New("no recording of that MAC address")
+
+// Info describes a recording
+type Info struct {
+	MAC     string    `json:"mac"`
+	IPs     []string  `json:"ips"` // the client's addresses seen so far
+	Start   time.Time `json:"start"`
+	Until   time.Time `json:"until"`
+	Active  bool      `json:"active"`
+	Packets int       `json:"packets"`
+	Events  int       `json:"events"`
+	Lines   int       `json:"lines"`
+	Files   int       `json:"files"`
+	Dropped int       `json:"dropped,omitempty"` // packets, lines and files past the limits
+}
+
+// Recorder records the clients it is told to, for one domain
+type Recorder struct {
+	// Addresses, if set, returns the addresses a client has when its
+	// recording starts, before DHCP reveals them
+	Addresses func(mac net.HardwareAddr) []net.IP
+
+	// Extra, if set, returns more files for a client's bundle by name,
+	// such as its inventory entry
+	Extra func(mac string) map[string][]byte
+
+	mu   sync.Mutex
+	recs []*rec // oldest first
+}
+
+type rec struct {
+	info   Info
+	pcap   bytes.Buffer
+	events bytes.Buffer
+	log    bytes.Buffer
+	files  []file
+}
+
+type file struct {
+	name string
+	time time.Time
+	data []byte
+}
+
+func NewRecorder() *Recorder {
+	return &Recorder{}
+}
+
+// Start records mac for d, DefaultDuration if 0
+func (r *Recorder) Start(mac net.HardwareAddr, d time.Duration) (Info, error) {
+	if d == 0 {
+		d = DefaultDuration
+	}
+	if d < 0 || d > MaxDuration {
+		return Info{}, fmt.Errorf("duration %s out of range (up to %s)", d, MaxDuration)
+	}
+	var ips []net.IP
+	if r.Addresses != nil {
+		ips = r.Addresses(mac)
+	}
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if rc := r.find(mac.String(), now); rc != nil && rc.info.Active {
+		return Info{}, fmt.Errorf("%s is already being recorded", mac)
+	}
+	rc := &rec{info: Info{MAC: mac.String(), IPs: []string{}, Start: now, Until: now.Add(d), Active: true}}
+	for _, ip := range ips {
+		rc.addIP(ip)
+	}
+	rc.pcap.Write(pcapHeader())
+	r.recs = append(r.recs, rc)
+
+	// Forget the oldest finished recordings
+	done := 0
+	for i := len(r.recs) - 1; i >= 0; i-- {
+		if !r.recs[i].info.Active {
+			if done++; done > keepDone {
+				r.recs = slices.Delete(r.recs, i, i+1)
+			}
+		}
+	}
+	return rc.snapshot(), nil
+}
+
+// Stop ends the recording of mac early
+func (r *Recorder) Stop(mac string) (Info, bool) {
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rc := r.find(mac, now)
+	if rc == nil || !rc.info.Active {
+		return Info{}, false
+	}
+	rc.info.Until, rc.info.Active = now, false
+	return rc.snapshot(), true
+}
+
+// List returns the recordings, newest first
+func (r *Recorder) List() []Info {
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	list := []Info{}
+	for i := len(r.recs) - 1; i >= 0; i-- {
+		r.recs[i].expire(now)
+		list = append(list, r.recs[i].snapshot())
+	}
+	return list
+}
+
+// Get describes the latest recording of mac
+func (r *Recorder) Get(mac string) (Info, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rc := r.find(mac, time.Now())
+	if rc == nil {
+		return Info{}, false
+	}
+	return rc.snapshot(), true
+}
+
+// Bundle writes the latest recording of mac, so far if it is still
+// running, to w as a gzipped tar: recording.json, packets.pcap,
+// events.jsonl, server.log and files/, and the Extra files
+func (r *Recorder) Bundle(w io.Writer, mac string) error {
+	r.mu.Lock()
+	rc := r.find(mac, time.Now())
+	if rc == nil {
+		r.mu.Unlock()
+		return ErrNotFound
+	}
+	info := rc.snapshot()
+	meta, _ := json.MarshalIndent(info, "", "  ")
+	entries := []file{
+		{"recording.json", info.Until, meta},
+		{"packets.pcap", info.Until, bytes.Clone(rc.pcap.Bytes())},
+		{"events.jsonl", info.Until, bytes.Clone(rc.events.Bytes())},
+		{"server.log", info.Until, bytes.Clone(rc.log.Bytes())},
+	}
+	for i, f := range rc.files {
+		name := fmt.Sprintf("files/%03d-%s", i+1, strings.ReplaceAll(strings.TrimPrefix(path.Clean("/"+f.name), "/"), "/", "_"))
+		entries = append(entries, file{name, f.time, f.data})
+	}
+	r.mu.Unlock()
+	var extra map[string][]byte
+	if r.Extra != nil {
+		extra = r.Extra(info.MAC)
+	}
+	for _, name := range slices.Sorted(maps.Keys(extra)) {
+		entries = append(entries, file{name, info.Until, extra[name]})
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	dir := "gopxe-" + strings.ReplaceAll(info.MAC, ":", "") + "-" + info.Start.UTC().Format("20060102T150405Z")
+	for _, f := range entries {
+		hdr := &tar.Header{Name: dir + "/" + f.name, Mode: 0o644, Size: int64(len(f.data)), ModTime: f.time}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(f.data); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// Follow records the events published on bus about clients being recorded
+func (r *Recorder) Follow(bus *events.Bus) {
+	ch, _ := bus.Subscribe(1024)
+	go func() {
+		for e := range ch {
+			r.Record(e)
+		}
+	}()
+}
+
+// Record records e if it is about a client being recorded, whose address
+// it may reveal
+func (r *Recorder) Record(e events.Event) {
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var rc *rec
+	if e.MAC != nil {
+		rc = r.active(now, e.MAC.String())
+		if rc != nil && e.IP != nil {
+			rc.addIP(e.IP)
+		}
+	} else if e.IP != nil {
+		rc = r.active(now, e.IP.String())
+	}
+	if rc == nil {
+		return
+	}
+	line, _ := json.Marshal(e)
+	rc.events.Write(append(line, '\n'))
+	rc.info.Events++
+}
+
+// Packet records a UDP packet from src to dst if it is a DHCP packet of a
+// client being recorded, or to or from one's address. data is only used
+// during the call.
+func (r *Recorder) Packet(src, dst *net.UDPAddr, data []byte) {
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.recording(now) {
+		return
+	}
+	var rc *rec
+	if isDHCP(src, dst) && len(data) >= 34 {
+		rc = r.active(now, net.HardwareAddr(data[28:34]).String())
+	} else if rc = r.active(now, src.IP.String()); rc == nil {
+		rc = r.active(now, dst.IP.String())
+	}
+	if rc == nil {
+		return
+	}
+	record := pcapRecord(now, src, dst, data)
+	if rc.pcap.Len()+len(record) > maxPcap {
+		rc.info.Dropped++
+		return
+	}
+	rc.pcap.Write(record)
+	rc.info.Packets++
+}
+
+// File records a file rendered or generated for the client at ip
+func (r *Recorder) File(ip net.IP, name string, data []byte) {
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rc := r.active(now, ip.String())
+	if rc == nil {
+		return
+	}
+	if len(data) > maxFile || len(rc.files) >= maxFiles {
+		fmt.Fprintf(&rc.log, "%s [RECORD] %s: %d bytes, not kept\n", now.Format("2006/01/02 15:04:05"), name, len(data))
+		rc.info.Dropped++
+		return
+	}
+	rc.files = append(rc.files, file{name, now, bytes.Clone(data)})
+	rc.info.Files++
+}
+
+// Write takes the server's log output, and keeps the lines naming a client
+// being recorded by its MAC or an address. It never fails.
+func (r *Recorder) Write(p []byte) (int, error) {
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.recording(now) {
+		return len(p), nil
+	}
+	line := string(p)
+	for _, rc := range r.recs {
+		if !rc.expire(now) || !rc.mentioned(line) {
+			continue
+		}
+		if rc.log.Len()+len(p) > maxLog {
+			rc.info.Dropped++
+			continue
+		}
+		rc.log.Write(p)
+		rc.info.Lines++
+	}
+	return len(p), nil
+}
+
+// recording reports whether any recording is active; r.mu is held
+func (r *Recorder) recording(now time.Time) bool {
+	for _, rc := range r.recs {
+		if rc.expire(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// active finds the active recording of the client with the MAC address
+// or IP address key; r.mu is held
+func (r *Recorder) active(now time.Time, key string) *rec {
+	for _, rc := range r.recs {
+		if rc.expire(now) && (rc.info.MAC == key || slices.Contains(rc.info.IPs, key)) {
+			return rc
+		}
+	}
+	return nil
+}
+
+// find returns the latest recording of mac; r.mu is held
+func (r *Recorder) find(mac string, now time.Time) *rec {
+	for i := len(r.recs) - 1; i >= 0; i-- {
+		if rc := r.recs[i]; rc.info.MAC == mac {
+			rc.expire(now)
+			return rc
+		}
+	}
+	return nil
+}
+
+// expire ends the recording once its time is up, and reports whether it
+// is still active
+func (rc *rec) expire(now time.Time) bool {
+	if rc.info.Active && !now.Before(rc.info.Until) {
+		rc.info.Active = false
+	}
+	return rc.info.Active
+}
+
+func (rc *rec) addIP(ip net.IP) {
+	if ip.IsUnspecified() {
+		return
+	}
+	if s := ip.String(); !slices.Contains(rc.info.IPs, s) {
+		rc.info.IPs = append(rc.info.IPs, s)
+	}
+}
+
+func (rc *rec) snapshot() Info {
+	info := rc.info
+	info.IPs = slices.Clone(info.IPs)
+	return info
+}
+
+// mentioned reports whether line names the client by its MAC or one of its
+// addresses, not as part of a longer address
+func (rc *rec) mentioned(line string) bool {
+	if strings.Contains(strings.ToLower(line), rc.info.MAC) {
+		return true
+	}
+	for _, ip := range rc.info.IPs {
+		for i := 0; ; {
+			j := strings.Index(line[i:], ip)
+			if j < 0 {
+				break
+			}
+			start, end := i+j, i+j+len(ip)
+			if (start == 0 || !isAddrByte(line[start-1])) && (end == len(line) || !isAddrByte(line[end])) {
+				return true
+			}
+			i = end
+		}
+	}
+	return false
+}
+
+func isAddrByte(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+// isDHCP reports whether a packet between src and dst is DHCP, by port
+func isDHCP(src, dst *net.UDPAddr) bool {
+	return src.Port == 67 || src.Port == 68 || dst.Port == 67 || dst.Port == 68
+}
@@ -0,0 +1,206 @@
+package recording
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ars1364/go-pxe/events"
+)
+
+var (
+	mac   = net.HardwareAddr{0x52, 0x54, 0, 0x12, 0x34, 0x56}
+	other = net.HardwareAddr{0x52, 0x54, 0, 0x12, 0x34, 0x57}
+)
+
+// dhcpPacket is the start of a BOOTP message from chaddr
+func dhcpPacket(chaddr net.HardwareAddr) []byte {
+	b := make([]byte, 240)
+	b[0] = 1
+	copy(b[28:], chaddr)
+	return b
+}
+
+func TestStart(t *testing.T) {
+	r := NewRecorder()
+	r.Addresses = func(m net.HardwareAddr) []net.IP { return []net.IP{net.IPv4(10, 0, 0, 50), net.IPv4zero} }
+	for _, d := range []time.Duration{-time.Second, MaxDuration + 1} {
+		if _, err := r.Start(mac, d); err == nil {
+			t.Errorf("started for %s", d)
+		}
+	}
+	info, err := r.Start(mac, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Active || info.Until.Sub(info.Start) != DefaultDuration || !slices.Equal(info.IPs, []string{"10.0.0.50"}) {
+		t.Errorf("info %+v", info)
+	}
+	if _, err := r.Start(mac, time.Minute); err == nil {
+		t.Error("started a second recording of the same client")
+	}
+	if _, ok := r.Stop(other.String()); ok {
+		t.Error("stopped a recording that does not exist")
+	}
+	if info, ok := r.Stop(mac.String()); !ok || info.Active {
+		t.Errorf("Stop = %+v, %v", info, ok)
+	}
+	if _, ok := r.Stop(mac.String()); ok {
+		t.Error("stopped twice")
+	}
+	if _, err := r.Start(mac, time.Minute); err != nil {
+		t.Errorf("restart after Stop: %v", err)
+	}
+	if list := r.List(); len(list) != 2 || !list[0].Active || list[1].Active {
+		t.Errorf("List = %+v", list)
+	}
+
+	// Starting one forgets all but the newest finished recordings
+	for range keepDone + 5 {
+		r.Start(other, time.Minute)
+		r.Stop(other.String())
+	}
+	r.Start(other, time.Minute)
+	finished := 0
+	for _, info := range r.List() {
+		if !info.Active {
+			finished++
+		}
+	}
+	if finished != keepDone {
+		t.Errorf("%d finished recordings kept, want %d", finished, keepDone)
+	}
+}
+
+func TestExpire(t *testing.T) {
+	r := NewRecorder()
+	r.Start(mac, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	r.Packet(&net.UDPAddr{Port: 68}, &net.UDPAddr{Port: 67}, dhcpPacket(mac))
+	if info, ok := r.Get(mac.String()); !ok || info.Active || info.Packets != 0 {
+		t.Errorf("expired recording %+v", info)
+	}
+}
+
+func TestCapture(t *testing.T) {
+	r := NewRecorder()
+	r.Start(mac, time.Minute)
+	client := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 50), Port: 68}
+	server := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 67}
+	tftp := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 69}
+
+	r.Packet(client, server, dhcpPacket(mac))
+	r.Packet(client, server, dhcpPacket(other))
+	r.Packet(client, server, []byte("short"))
+	r.Packet(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 50), Port: 2000}, tftp, []byte("RRQ")) // address not known yet
+
+	// An event reveals the client's address
+	r.Record(events.Event{Type: events.DHCPAck, MAC: mac, IP: client.IP})
+	r.Record(events.Event{Type: events.DHCPAck, MAC: other, IP: net.IPv4(10, 0, 0, 51)})
+	r.Record(events.Event{Type: events.TFTPComplete, IP: client.IP, Path: "ipxe.efi"})
+	r.Record(events.Event{Type: events.TFTPComplete, IP: net.IPv4(10, 0, 0, 51), Path: "ipxe.efi"})
+	r.Packet(&net.UDPAddr{IP: client.IP, Port: 2000}, tftp, []byte("RRQ"))
+	r.Packet(tftp, &net.UDPAddr{IP: client.IP, Port: 2000}, []byte("DATA"))
+
+	for _, line := range []string{
+		"[DHCP] Offer to " + strings.ToUpper(mac.String()) + "\n",
+		"[TFTP] 10.0.0.50 requested ipxe.efi\n",
+		"[HTTP] 10.0.0.50: GET /boot.ipxe\n",
+		"[TFTP] 10.0.0.5 requested ipxe.efi\n",
+		"[TFTP] 10.0.0.500 is no address\n",
+		"[TFTP] 110.0.0.50 requested ipxe.efi\n",
+		"[DHCP] Offer to " + other.String() + "\n",
+	} {
+		if n, err := r.Write([]byte(line)); n != len(line) || err != nil {
+			t.Fatalf("Write = %d, %v", n, err)
+		}
+	}
+
+	r.File(client.IP, "/menus/../boot.ipxe", []byte("#!ipxe\n"))
+	r.File(client.IP, "huge.efi", make([]byte, maxFile+1))
+	r.File(net.IPv4(10, 0, 0, 51), "other.ipxe", []byte("#!ipxe\n"))
+
+	info, _ := r.Get(mac.String())
+	want := Info{Packets: 3, Events: 2, Lines: 3, Files: 1, Dropped: 1}
+	if info.Packets != want.Packets || info.Events != want.Events || info.Lines != want.Lines || info.Files != want.Files || info.Dropped != want.Dropped {
+		t.Errorf("info %+v, want counts %+v", info, want)
+	}
+
+	r.Extra = func(m string) map[string][]byte { return map[string][]byte{"host.yaml": []byte("name: web01\n")} }
+	var buf bytes.Buffer
+	if err := r.Bundle(&buf, mac.String()); err != nil {
+		t.Fatal(err)
+	}
+	files := untar(t, &buf)
+	dir := "gopxe-525400123456-" + info.Start.UTC().Format("20060102T150405Z") + "/"
+	var names []string
+	for name := range files {
+		names = append(names, strings.TrimPrefix(name, dir))
+	}
+	slices.Sort(names)
+	if want := []string{"events.jsonl", "files/001-boot.ipxe", "host.yaml", "packets.pcap", "recording.json", "server.log"}; !slices.Equal(names, want) {
+		t.Errorf("bundle holds %q, want %q", names, want)
+	}
+	if pcap := files[dir+"packets.pcap"]; len(pcap) != 24+(16+28+240)+(16+28+3)+(16+28+4) { // header, DHCP, RRQ, DATA
+		t.Errorf("pcap of %d bytes", len(pcap))
+	}
+	if log := files[dir+"server.log"]; !strings.Contains(log, "huge.efi: 1048577 bytes, not kept") || strings.Contains(log, "110.0.0.50") || strings.Contains(log, other.String()) {
+		t.Errorf("server.log:\n%s", log)
+	}
+	if ev := files[dir+"events.jsonl"]; strings.Count(ev, "\n") != 2 || strings.Contains(ev, "10.0.0.51") {
+		t.Errorf("events.jsonl:\n%s", ev)
+	}
+
+	if err := r.Bundle(io.Discard, other.String()); err != ErrNotFound {
+		t.Errorf("bundle of an unrecorded client: %v", err)
+	}
+}
+
+func untar(t *testing.T, r io.Reader) map[string]string {
+	t.Helper()
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+	files := make(map[string]string)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(tr)
+		files[hdr.Name] = string(b)
+	}
+}
+
+func TestMentioned(t *testing.T) {
+	rc := &rec{info: Info{MAC: mac.String(), IPs: []string{"10.0.0.5", "fe80::1"}}}
+	tests := map[string]bool{
+		"lease for 10.0.0.5":                 true,
+		"10.0.0.5: GET /":                    true,
+		"from 10.0.0.5:4000":                 true,
+		"from 10.0.0.50":                     false,
+		"from 110.0.0.5":                     false,
+		"from 10.0.0.50 and later 10.0.0.5.": true,
+		"solicit from fe80::1%eth0":          true,
+		"solicit from fe80::1a":              false,
+		"client 52:54:00:12:34:56":           true,
+		"client 52:54:00:12:34:57":           false,
+		"":                                   false,
+	}
+	for line, want := range tests {
+		if got := rc.mentioned(line); got != want {
+			t.Errorf("mentioned(%q) = %v, want %v", line, got, want)
+		}
+	}
+}
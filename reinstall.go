@@ -0,0 +1,47 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// runReinstall flags a host for reinstallation through a running server's
+// management API, or clears the flag with -cancel:
+//
+//	go-pxe reinstall [-api http://127.0.0.1:9090] [-domain default] [-cancel] <host>
+//
+// The host boots its profile on its next network boot, and from its disk
+// again once it reports the install complete.
+func runReinstall(args []string) {
+	fs := flag.NewFlagSet("reinstall", flag.ExitOnError)
+	apiURL := fs.String("api", "http://127.0.0.1:9090", "Management API of the server")
+	token := fs.String("token", os.Getenv("GOPXE_API_TOKEN"), "API bearer token (default from GOPXE_API_TOKEN)")
+	domain := fs.String("domain", "default", "Provisioning domain of the host")
+	cancel := fs.Bool("cancel", false, "Clear the host's reinstallation flag instead")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: go-pxe reinstall [flags] <host>\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	host := fs.Arg(0)
+
+	c := newAPIClient(*apiURL, *domain, *token, 30*time.Second)
+	if *cancel {
+		if err := c.do("DELETE", "/hosts/"+host+"/reinstall", nil); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("%s: will not be reinstalled\n", host)
+		return
+	}
+	if err := c.post("/hosts/"+host+"/reinstall", nil); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("%s: will be reinstalled on its next network boot\n", host)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/ars1364/go-pxe/dhcp"
+)
+
+// relayPool is an address range for clients on a routed subnet, reached
+// through a DHCP relay agent with an address in it or on another
+// interface of the server, and optionally the boot files they get instead
+// of the domain's
+type relayPool struct {
+	Subnet    string `yaml:"subnet"`
+	Interface string `yaml:"interface"` // served directly on it, if set
+	Start     string `yaml:"start"`
+	End       string `yaml:"end"`
+	Router    string `yaml:"router"` // the relay agent or the server on Interface if empty
+
+	BootFile  string            `yaml:"bootFile"`
+	BootFiles map[string]string `yaml:"bootFiles"`
+}
+
+// parseRelayPools parses -relay-pools: comma-separated
+// subnet[@interface]=start-end[=router[=bootfile]]
+func parseRelayPools(s string) ([]relayPool, error) {
+	var list []relayPool
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e == "" {
+			continue
+		}
+		parts := strings.SplitN(e, "=", 4)
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("%q is not subnet[@interface]=start-end[=router[=bootfile]]", e)
+		}
+		start, end, ok := strings.Cut(parts[1], "-")
+		if !ok {
+			return nil, fmt.Errorf("%q is not subnet[@interface]=start-end[=router[=bootfile]]", e)
+		}
+		subnet, iface, _ := strings.Cut(parts[0], "@")
+		p := relayPool{Subnet: subnet, Interface: iface, Start: start, End: end}
+		if len(parts) > 2 {
+			p.Router = parts[2]
+		}
+		if len(parts) > 3 {
+			p.BootFile = parts[3]
+		}
+		list = append(list, p)
+	}
+	_, err := dhcpPools(list)
+	return list, err
+}
+
+// dhcpPools are the relay pools as the DHCP server takes them, checked
+// for valid ranges within their subnets and subnets used once
+func dhcpPools(list []relayPool) ([]dhcp.Pool, error) {
+	var pools []dhcp.Pool
+	for _, rp := range list {
+		_, subnet, err := net.ParseCIDR(rp.Subnet)
+		if err != nil {
+			return nil, fmt.Errorf("relay pool %s: %w", rp.Subnet, err)
+		}
+		p := dhcp.Pool{Subnet: subnet, RangeStart: net.ParseIP(rp.Start), RangeEnd: net.ParseIP(rp.End),
+			Interface: rp.Interface, BootFile: rp.BootFile, BootFiles: rp.BootFiles}
+		if rp.Router != "" {
+			if p.Router = net.ParseIP(rp.Router).To4(); p.Router == nil {
+				return nil, fmt.Errorf("relay pool %s: %q is not an IPv4 address", rp.Subnet, rp.Router)
+			}
+		}
+		if err := dhcp.CheckPool(p); err != nil {
+			return nil, fmt.Errorf("relay pool %s: %w", rp.Subnet, err)
+		}
+		if err := checkBootFiles(rp.BootFiles); err != nil {
+			return nil, fmt.Errorf("relay pool %s: bootFiles: %w", rp.Subnet, err)
+		}
+		for _, other := range pools {
+			if other.Subnet.Contains(subnet.IP) || subnet.Contains(other.Subnet.IP) {
+				return nil, fmt.Errorf("relay pool %s overlaps %s", subnet, other.Subnet)
+			}
+			if p.Interface != "" && other.Interface == p.Interface {
+				return nil, fmt.Errorf("relay pool %s: interface %s serves %s already", subnet, p.Interface, other.Subnet)
+			}
+		}
+		pools = append(pools, p)
+	}
+	return pools, nil
+}
+
+// relayPools are the domain's relay pools as the DHCP server takes them;
+// they are checked already
+func (c domainConfig) relayPools() []dhcp.Pool {
+	pools, _ := dhcpPools(c.RelayPools)
+	return pools
+}
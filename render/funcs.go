@@ -0,0 +1,149 @@
+package render
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Funcs are the functions every template has, named and ordered like
+// their Sprig counterparts so the last argument can come from a pipeline:
+//
+//	{{ .Hostname | upper }}  {{ index .Labels "tz" | default "UTC" }}
+func Funcs() template.FuncMap {
+	return template.FuncMap{
+		// Strings
+		"upper":      strings.ToUpper,
+		"lower":      strings.ToLower,
+		"trim":       strings.TrimSpace,
+		"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+		"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+		"replace":    func(old, new, s string) string { return strings.ReplaceAll(s, old, new) },
+		"contains":   func(sub, s string) bool { return strings.Contains(s, sub) },
+		"hasPrefix":  func(prefix, s string) bool { return strings.HasPrefix(s, prefix) },
+		"hasSuffix":  func(suffix, s string) bool { return strings.HasSuffix(s, suffix) },
+		"repeat":     func(n int, s string) string { return strings.Repeat(s, n) },
+		"splitList":  func(sep, s string) []string { return strings.Split(s, sep) },
+		"join":       join,
+		"quote":      func(s string) string { return fmt.Sprintf("%q", s) },
+		"squote":     func(s string) string { return "'" + s + "'" },
+		"indent":     indent,
+		"nindent":    func(n int, s string) string { return "\n" + indent(n, s) },
+
+		"regexMatch":      func(re, s string) (bool, error) { return regexp.MatchString(re, s) },
+		"regexReplaceAll": regexReplaceAll,
+
+		// Defaults
+		"default":  func(def, v any) any { return cond(empty(v), def, v) },
+		"empty":    empty,
+		"coalesce": coalesce,
+		"ternary":  func(t, f any, c bool) any { return cond(c, t, f) },
+
+		// Encodings
+		"b64enc":       func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) },
+		"b64dec":       b64dec,
+		"toJson":       toJSON,
+		"toPrettyJson": toPrettyJSON,
+		"sha256sum":    func(s string) string { sum := sha256.Sum256([]byte(s)); return hex.EncodeToString(sum[:]) },
+
+		// Collections
+		"list": func(v ...any) []any { return v },
+		"dict": dict,
+
+		// Time
+		"now":  time.Now,
+		"date": func(layout string, t time.Time) string { return t.Format(layout) },
+	}
+}
+
+func cond(c bool, t, f any) any {
+	if c {
+		return t
+	}
+	return f
+}
+
+// empty reports whether v is nil or its type's zero value, or an empty
+// string, slice or map
+func empty(v any) bool {
+	if v == nil {
+		return true
+	}
+	r := reflect.ValueOf(v)
+	switch r.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		return r.Len() == 0
+	}
+	return r.IsZero()
+}
+
+func coalesce(v ...any) any {
+	for _, x := range v {
+		if !empty(x) {
+			return x
+		}
+	}
+	return nil
+}
+
+func join(sep string, v any) string {
+	r := reflect.ValueOf(v)
+	if r.Kind() != reflect.Slice && r.Kind() != reflect.Array {
+		return fmt.Sprint(v)
+	}
+	parts := make([]string, r.Len())
+	for i := range parts {
+		parts[i] = fmt.Sprint(r.Index(i).Interface())
+	}
+	return strings.Join(parts, sep)
+}
+
+func indent(n int, s string) string {
+	pad := strings.Repeat(" ", n)
+	return pad + strings.ReplaceAll(s, "\n", "\n"+pad)
+}
+
+func regexReplaceAll(re, s, repl string) (string, error) {
+	r, err := regexp.Compile(re)
+	if err != nil {
+		return "", err
+	}
+	return r.ReplaceAllString(s, repl), nil
+}
+
+func b64dec(s string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	return string(b), err
+}
+
+func toJSON(v any) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+func toPrettyJSON(v any) (string, error) {
+	b, err := json.MarshalIndent(v, "", "  ")
+	return string(b), err
+}
+
+func dict(kv ...any) (map[string]any, error) {
+	if len(kv)%2 != 0 {
+		return nil, fmt.Errorf("dict: odd number of arguments")
+	}
+	m := make(map[string]any, len(kv)/2)
+	for i := 0; i < len(kv); i += 2 {
+		k, ok := kv[i].(string)
+		if !ok {
+			return nil, fmt.Errorf("dict: key %v is not a string", kv[i])
+		}
+		m[k] = kv[i+1]
+	}
+	return m, nil
+}
@@ -0,0 +1,73 @@
+package render
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+)
+
+func TestFuncs(t *testing.T) {
+	tests := []struct {
+		text, want string
+	}{
+		{`{{ .Hostname | upper }}`, "WEB01"},
+		{`{{ "  x " | trim | lower }}`, "x"},
+		{`{{ .Hostname | trimPrefix "web" }}{{ "a.cfg" | trimSuffix ".cfg" }}`, "01a"},
+		{`{{ .MAC | replace ":" "-" }}`, "aa-bb-cc-dd-ee-01"},
+		{`{{ contains "eb" .Hostname }} {{ hasPrefix "web" .Hostname }} {{ hasSuffix "x" .Hostname }}`, "true true false"},
+		{`{{ repeat 3 "ab" }}`, "ababab"},
+		{`{{ splitList "," "a,b,c" | join "|" }}`, "a|b|c"},
+		{`{{ .Initrd | join "," }}`, "/alma/initrd.img,/alma/extra.img"},
+		{`{{ join "," .Hostname }}`, "web01"},
+		{`{{ quote "a\"b" }} {{ squote "c" }}`, `"a\"b" 'c'`},
+		{`{{ indent 2 "a\nb" }}`, "  a\n  b"},
+		{`x:{{ nindent 2 "a" }}`, "x:\n  a"},
+		{`{{ regexMatch "^web[0-9]+$" .Hostname }}`, "true"},
+		{`{{ regexReplaceAll "[0-9]+" .Hostname "N" }}`, "webN"},
+		{`{{ index .Labels "tz" | default "UTC" }} {{ index .Labels "dc" | default "fra1" }}`, "Europe/Berlin fra1"},
+		{`{{ empty "" }} {{ empty 0 }} {{ empty .Labels }} {{ empty .Initrd }} {{ empty .IP }}`, "true true false false false"},
+		{`{{ coalesce .UUID .Serial .Hostname }}`, "web01"},
+		{`{{ coalesce .UUID .Serial }}`, "<no value>"},
+		{`{{ ternary "uefi" "bios" (hasSuffix "efi" .Arch) }}`, "bios"},
+		{`{{ "hi" | b64enc }} {{ "aGk=" | b64dec }}`, "aGk= hi"},
+		{`{{ sha256sum "abc" }}`, "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		{`{{ dict "role" .Labels.role "n" 2 | toJson }}`, `{"n":2,"role":"web"}`},
+		{`{{ list 1 "a" | toPrettyJson }}`, "[\n  1,\n  \"a\"\n]"},
+		{`{{ list .Hostname .IP | join " " }}`, "web01 10.0.0.5"},
+		{`{{ now | date "2006" }}`, strconv.Itoa(time.Now().Year())},
+	}
+	for _, tt := range tests {
+		out, err := Execute("t", []byte(tt.text), vars, nil)
+		if err != nil || string(out) != tt.want {
+			t.Errorf("%s = %q, %v; want %q", tt.text, out, err, tt.want)
+		}
+	}
+}
+
+func TestFuncErrors(t *testing.T) {
+	tests := []struct {
+		text, err string
+	}{
+		{`{{ dict "a" }}`, "odd number of arguments"},
+		{`{{ dict 1 2 }}`, "key 1 is not a string"},
+		{`{{ b64dec "!!" }}`, "illegal base64 data"},
+		{`{{ regexMatch "(" .Hostname }}`, "missing closing )"},
+		{`{{ regexReplaceAll "[" .Hostname "x" }}`, "missing closing ]"},
+		{`{{ repeat -1 "x" }}`, "negative Repeat count"},
+	}
+	for _, tt := range tests {
+		if out, err := Execute("t", []byte(tt.text), vars, nil); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s = %q, %v; want error %q", tt.text, out, err, tt.err)
+		}
+	}
+}
+
+func TestFuncsOverridden(t *testing.T) {
+	funcs := template.FuncMap{"upper": func(s string) string { return "custom " + s }}
+	out, err := Execute("t", []byte(`{{ .Hostname | upper }}`), vars, funcs)
+	if err != nil || string(out) != "custom web01" {
+		t.Errorf("Execute = %q, %v", out, err)
+	}
+}
@@ -0,0 +1,48 @@
+// Package render fills in per-host templates, such as kickstarts, preseeds,
+// cloud-init and Ignition files, for the client requesting them.
+package render
+
+import (
+	"bytes"
+	"text/template"
+)
+
+// Vars is what a template knows about the requesting client. Every
+// template, whether served over HTTP or TFTP, gets the same set.
+type Vars struct {
+	MAC      string
+	IP       string
+	Hostname string // inventory host name, empty for unknown clients
+	UUID     string // machine UUID, from DHCP or a hardware report
+	Serial   string // from a hardware or inspection report
+	Arch     string // firmware architecture from DHCP, such as "x86_64-efi"
+	Profile  string
+	Labels   map[string]string
+	ServerIP string // the domain's address, for URLs back to go-pxe
+	Domain   string
+
+	// The fields of the profile the client boots
+	Kernel   string
+	Initrd   []string
+	Cmdline  string
+	BootFile string // the host's own, if it overrides the profile's
+
+	// Token is a provisioning token for the client to present when it
+	// fetches its templates, if the domain requires them
+	Token string
+}
+
+// Execute renders text for vars with Funcs and funcs, which take
+// precedence. Missing map keys are errors rather than empty strings, so a
+// typo never ships a blank password.
+func Execute(name string, text []byte, vars Vars, funcs template.FuncMap) ([]byte, error) {
+	t, err := template.New(name).Funcs(Funcs()).Funcs(funcs).Option("missingkey=error").Parse(string(text))
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, vars); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
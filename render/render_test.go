@@ -0,0 +1,58 @@
+package render
+
+import (
+	"strings"
+	"testing"
+	"text/template"
+)
+
+var vars = Vars{
+	MAC:      "aa:bb:cc:dd:ee:01",
+	IP:       "10.0.0.5",
+	Hostname: "web01",
+	Profile:  "alma9",
+	Labels:   map[string]string{"role": "web", "tz": "Europe/Berlin"},
+	ServerIP: "10.0.0.1",
+	Domain:   "lab",
+	Initrd:   []string{"/alma/initrd.img", "/alma/extra.img"},
+}
+
+func TestExecute(t *testing.T) {
+	text := `network --hostname={{ .Hostname }} --ip={{ .IP }}
+timezone {{ .Labels.tz }}
+url --url=http://{{ .ServerIP }}/{{ .Profile }}/
+rootpw --iscrypted {{ secret "pxe/root" }}
+`
+	funcs := template.FuncMap{"secret": func(path string) string { return "$6$" + path }}
+	out, err := Execute("ks.cfg", []byte(text), vars, funcs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `network --hostname=web01 --ip=10.0.0.5
+timezone Europe/Berlin
+url --url=http://10.0.0.1/alma9/
+rootpw --iscrypted $6$pxe/root
+`
+	if string(out) != want {
+		t.Errorf("got:\n%s\nwant:\n%s", out, want)
+	}
+}
+
+func TestExecuteErrors(t *testing.T) {
+	tests := []struct {
+		name, text, err string
+	}{
+		{"missing label", "{{ .Labels.timezone }}", `map has no entry for key "timezone"`},
+		{"unknown field", "{{ .Password }}", "can't evaluate field Password"},
+		{"unknown function", "{{ secret `x` }}", `function "secret" not defined`},
+		{"syntax", "{{ .Hostname ", "unclosed action"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := Execute("t", []byte(tt.text), vars, nil)
+			if err == nil || !strings.Contains(err.Error(), tt.err) || out != nil {
+				t.Errorf("Execute = %q, %v; want error %q", out, err, tt.err)
+			}
+		})
+	}
+}
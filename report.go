@@ -0,0 +1,105 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"maps"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/ars1364/go-pxe/bootlog"
+)
+
+// runReport summarizes the boot history of a running server through its
+// management API: success and failure rates, install times, the hosts
+// failing most and the files served most:
+//
+//	go-pxe report [-api http://127.0.0.1:9090] [-domain default] [-since 7d] [-until date] [-top 10] [-json]
+func runReport(args []string) {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	apiURL := fs.String("api", "http://127.0.0.1:9090", "Management API of the server")
+	token := fs.String("token", os.Getenv("GOPXE_API_TOKEN"), "API bearer token (default from GOPXE_API_TOKEN)")
+	domain := fs.String("domain", "default", "Provisioning domain to report on")
+	since := fs.String("since", "7d", "Boots started from then: a date, RFC 3339 time or duration ago; empty for all")
+	until := fs.String("until", "", "Boots started before then, like -since")
+	top := fs.Int("top", 10, "How many failing hosts and served files to list")
+	asJSON := fs.Bool("json", false, "Print the report as JSON")
+	fs.Parse(args)
+
+	q := url.Values{"top": {strconv.Itoa(*top)}}
+	for name, v := range map[string]string{"since": *since, "until": *until} {
+		if v == "" {
+			continue
+		}
+		t, err := parseWhen(v, time.Now())
+		if err != nil {
+			log.Fatalf("-%s: %v", name, err)
+		}
+		q.Set(name, t.Format(time.RFC3339))
+	}
+	c := newAPIClient(*apiURL, *domain, *token, 5*time.Minute)
+	var rep bootlog.Report
+	if err := c.get("/report?"+q.Encode(), &rep); err != nil {
+		log.Fatal(err)
+	}
+	if *asJSON {
+		json.NewEncoder(os.Stdout).Encode(rep)
+		return
+	}
+
+	from, to := "the start of the history", "now"
+	if !rep.Since.IsZero() {
+		from = rep.Since.Local().Format(time.DateTime)
+	}
+	if !rep.Until.IsZero() {
+		to = rep.Until.Local().Format(time.DateTime)
+	}
+	fmt.Printf("Boots in %s from %s to %s\n\n", *domain, from, to)
+	if rep.Boots == 0 {
+		fmt.Println("No boots recorded.")
+		return
+	}
+	fmt.Printf("%d boots: %d succeeded, %d failed", rep.Boots, rep.Succeeded, rep.Failed)
+	if rep.Succeeded+rep.Failed > 0 {
+		fmt.Printf(", %.1f%% success", rep.SuccessRate*100)
+	}
+	fmt.Println()
+	outcomes := slices.SortedFunc(maps.Keys(rep.Outcomes), func(a, b string) int {
+		return cmp.Or(cmp.Compare(rep.Outcomes[b], rep.Outcomes[a]), cmp.Compare(a, b))
+	})
+	for _, o := range outcomes {
+		fmt.Printf("  %-28s %6d\n", o, rep.Outcomes[o])
+	}
+	if rep.Installs > 0 {
+		fmt.Printf("\n%d installs reported, boot to install median %s, 90th percentile %s\n",
+			rep.Installs, rep.InstallMedian.Round(time.Second), rep.InstallP90.Round(time.Second))
+	} else {
+		fmt.Println("\nNo installs reported (installers POST /installed when done)")
+	}
+
+	if len(rep.FailingHosts) > 0 {
+		fmt.Println("\nFailing most:")
+		for _, h := range rep.FailingHosts {
+			fmt.Printf("  %-20s  %-17s  %3d of %3d boots failed, last %s %s\n", cmp.Or(h.Host, "-"), h.MAC,
+				h.Failures, h.Boots, h.Last, h.LastTime.Local().Format(time.DateTime))
+		}
+	}
+	if len(rep.Assets) > 0 {
+		fmt.Println("\nServed most:")
+		for _, a := range rep.Assets {
+			fmt.Printf("  %-4s  %-52s  %6d times  %10d KiB\n", a.Proto, a.Path, a.Count, a.Bytes>>10)
+		}
+	}
+	if len(rep.Days) > 1 {
+		fmt.Println("\nPer day (UTC):")
+		for _, d := range rep.Days {
+			fmt.Printf("  %s  %5d boots  %5d succeeded  %5d failed\n", d.Day, d.Boots, d.Succeeded, d.Failed)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/ars1364/go-pxe/dhcp"
+)
+
+// reservation fixes a machine's DHCP address without an inventory entry,
+// and optionally its boot file and host name
+type reservation struct {
+	MAC      string `yaml:"mac"`
+	IP       string `yaml:"ip"`
+	BootFile string `yaml:"bootFile"`
+	HostName string `yaml:"hostname"`
+}
+
+// parseReservations parses -reservations: comma-separated
+// mac=ip[=hostname[=bootfile]]
+func parseReservations(s string) ([]reservation, error) {
+	var list []reservation
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e == "" {
+			continue
+		}
+		parts := strings.SplitN(e, "=", 4)
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("%q is not mac=ip[=hostname[=bootfile]]", e)
+		}
+		r := reservation{MAC: parts[0], IP: parts[1]}
+		if len(parts) > 2 {
+			r.HostName = parts[2]
+		}
+		if len(parts) > 3 {
+			r.BootFile = parts[3]
+		}
+		list = append(list, r)
+	}
+	return list, checkReservations(list)
+}
+
+// checkReservations checks that reservations name valid MAC and IPv4
+// addresses, each once
+func checkReservations(list []reservation) error {
+	macs, ips := make(map[string]bool), make(map[string]bool)
+	for _, r := range list {
+		mac, err := net.ParseMAC(r.MAC)
+		if err != nil {
+			return fmt.Errorf("reservation %s: %w", r.MAC, err)
+		}
+		ip := net.ParseIP(r.IP).To4()
+		if ip == nil {
+			return fmt.Errorf("reservation %s: %q is not an IPv4 address", r.MAC, r.IP)
+		}
+		if macs[mac.String()] {
+			return fmt.Errorf("reservation %s: MAC reserved twice", r.MAC)
+		}
+		if ips[ip.String()] {
+			return fmt.Errorf("reservation %s: %s reserved twice", r.MAC, ip)
+		}
+		macs[mac.String()], ips[ip.String()] = true, true
+	}
+	return nil
+}
+
+// reservations are the domain's reservations as the DHCP server takes
+// them, by MAC address; they are checked already
+func (c domainConfig) reservations() map[string]dhcp.Reservation {
+	m := make(map[string]dhcp.Reservation, len(c.Reservations))
+	for _, r := range c.Reservations {
+		mac, _ := net.ParseMAC(r.MAC)
+		m[mac.String()] = dhcp.Reservation{IP: net.ParseIP(r.IP).To4(), BootFile: r.BootFile, HostName: r.HostName}
+	}
+	return m
+}
+
+// reservedName is the host name reserved for mac, if any
+func (c domainConfig) reservedName(mac net.HardwareAddr) string {
+	for _, r := range c.Reservations {
+		if m, err := net.ParseMAC(r.MAC); err == nil && m.String() == mac.String() {
+			return r.HostName
+		}
+	}
+	return ""
+}
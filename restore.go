@@ -0,0 +1,123 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/ars1364/go-pxe/backup"
+	"github.com/ars1364/go-pxe/events"
+)
+
+// runRestore starts the server seeded from a backup snapshot:
+//
+//	go-pxe restore [server flags] <snapshot.json | s3://bucket/key>
+func runRestore(args []string) {
+	var opts options
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	opts.register(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: go-pxe restore [server flags] <snapshot.json | s3://bucket/key>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	opts.restoreFrom = fs.Arg(0)
+	serve(&opts)
+}
+
+func restoreSnapshot(src string, domains []*domain, history *events.History) error {
+	snap, err := backup.Load(src)
+	if err != nil {
+		return err
+	}
+	log.Printf("[BACKUP] Restoring snapshot from %s (%s)", snap.Time.Format("2006-01-02 15:04:05"), src)
+	history.Load(snap.History)
+
+	for _, d := range domains {
+		ds, ok := snap.Domain(d.cfg.Name)
+		if !ok {
+			log.Printf("[BACKUP] Snapshot has no domain %s, starting it empty", d.cfg.Name)
+			continue
+		}
+		d.dhcp.LoadLeases(ds.Leases)
+		d.logs.Load(ds.Logs)
+		d.consoles.Load(ds.Consoles)
+		d.inspected.Load(ds.Inspections)
+		d.hardware.Load(ds.Hardware)
+		d.attested.Load(ds.Attestations)
+		d.certs.Load(ds.Certificates)
+		d.pending.Load(ds.Pending)
+		d.clusters.Load(ds.Clusters)
+		for _, r := range ds.Rollouts {
+			if err := d.store.PutRollout(r); err != nil {
+				log.Printf("[BACKUP] %s: %v", d.cfg.Name, err)
+			}
+		}
+
+		// Definitions managed by defs/defsGit are the source of truth there;
+		// restoring them too would resurrect entries deleted since the backup.
+		if d.cfg.Defs != "" || d.cfg.DefsGit.URL != "" {
+			log.Printf("[BACKUP] %s: skipping %d hosts/%d profiles, definitions come from files", d.cfg.Name, len(ds.Hosts), len(ds.Profiles))
+			continue
+		}
+		for _, p := range ds.Profiles {
+			if err := d.store.PutProfile(p); err != nil {
+				log.Printf("[BACKUP] %s: %v", d.cfg.Name, err)
+			}
+		}
+		for _, h := range ds.Hosts {
+			if err := d.store.PutHost(h); err != nil {
+				log.Printf("[BACKUP] %s: %v", d.cfg.Name, err)
+			}
+		}
+		d.store.SetRevision(ds.Revision)
+		d.audit.Record("restore", d.cfg.Name, "snapshot.restore", src, nil,
+			map[string]int{"hosts": len(ds.Hosts), "profiles": len(ds.Profiles)})
+	}
+	return nil
+}
+
+func newBackupScheduler(opts *options, domains []*domain, history *events.History) (*backup.Scheduler, error) {
+	sched := &backup.Scheduler{
+		Dir:      opts.backupDir,
+		Keep:     opts.backupKeep,
+		Interval: opts.backupInterval,
+		Collect: func() backup.Snapshot {
+			snap := backup.Snapshot{History: history.Events()}
+			for _, d := range domains {
+				snap.Domains = append(snap.Domains, backup.DomainSnapshot{
+					Name:     d.cfg.Name,
+					Revision: d.store.Revision(),
+					Leases:   d.dhcp.Leases(),
+					Hosts:    d.store.Hosts(),
+					Profiles: d.store.Profiles(),
+					Rollouts: d.store.Rollouts(),
+					Logs:     d.logs.Snapshot(),
+					Consoles: d.consoles.Snapshot(),
+
+					Inspections:  d.inspected.Snapshot(),
+					Hardware:     d.hardware.Snapshot(),
+					Attestations: d.attested.Snapshot(),
+					Certificates: d.certs.Snapshot(),
+					Pending:      d.pending.Snapshot(),
+					Clusters:     d.clusters.Snapshot(),
+				})
+			}
+			return snap
+		},
+	}
+	if opts.backupS3 != "" {
+		s3, prefix, err := backup.ParseS3URL(opts.backupS3)
+		if err != nil {
+			return nil, err
+		}
+		s3.Prefix = prefix
+		sched.S3 = s3
+	}
+	return sched, nil
+}
@@ -0,0 +1,398 @@
+// Package sessions correlates DHCP, TFTP and HTTP events into boot
+// sessions: one per client boot, with a timeline, the furthest stage reached
+// and an outcome, so nobody has to join three log streams by hand.
+package sessions
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ars1364/go-pxe/events"
+)
+
+// Boot stages, in order
+const (
+	StageDHCP       = "dhcp"
+	StageBootloader = "bootloader"
+	StageKernel     = "kernel"
+	StageInitrd     = "initrd"
+)
+
+// Outcomes
+const (
+	InProgress         = "in_progress"
+	Succeeded          = "succeeded"
+	NoBootloader       = "never_requested_bootloader"
+	StalledBootloader  = "stalled_at_bootloader"
+	StalledKernel      = "stalled_at_kernel"
+	StalledInitrd      = "stalled_at_initrd"
+	Panicked           = "kernel_panic"
+	MulticastFailed    = "multicast_failed"
+	Interrupted        = "interrupted" // still active at shutdown
+	maxTimeline        = 200
+	maxConsole         = 2000
+	maxFinished        = 1000
+	defaultIdleTimeout = 10 * time.Minute
+	defaultStall       = 2 * time.Minute
+)
+
+// Plan is what a client is expected to boot. Files match by base name, so
+// kernel "vmlinuz" matches /almalinux97/images/pxeboot/vmlinuz.
+type Plan struct {
+	Host     string
+	Profile  string
+	BootFile string
+	Kernel   string   // guessed from the file name if empty
+	Initrd   []string // guessed from the file name if empty
+}
+
+// Session is one client boot
+type Session struct {
+	ID       string         `json:"id"`
+	Domain   string         `json:"domain"`
+	MAC      string         `json:"mac"`
+	IP       string         `json:"ip,omitempty"`
+	Host     string         `json:"host,omitempty"`
+	Profile  string         `json:"profile,omitempty"`
+	Start    time.Time      `json:"start"`
+	Last     time.Time      `json:"last"`
+	Stage    string         `json:"stage"` // furthest stage completed
+	Outcome  string         `json:"outcome"`
+	Timeline []events.Event `json:"timeline,omitempty"`
+	Omitted  int            `json:"omitted,omitempty"` // events beyond the timeline cap
+
+	// Console holds the last kernel messages the client sent over
+	// netconsole; Panic is the first panic among them
+	Console []ConsoleLine `json:"console,omitempty"`
+	Panic   string        `json:"panic,omitempty"`
+
+	// Multicast is the state of the client's multicast image transfer:
+	// receiving, done, or failed with the reason
+	Multicast string `json:"multicast,omitempty"`
+
+	// Installed is when the installer reported completion, by its POST
+	// to /installed
+	Installed time.Time `json:"installed,omitzero"`
+
+	plan      Plan
+	requested bool // any attempt at the bootloader
+	initrds   map[string]bool
+	done      bool
+}
+
+// ConsoleLine is one kernel message
+type ConsoleLine struct {
+	Time time.Time `json:"time"`
+	Text string    `json:"text"`
+}
+
+// Tracker follows the event bus and keeps open and recently finished
+// sessions
+type Tracker struct {
+	// Plan, if set, returns what the client with mac in domain should boot
+	Plan func(domain string, mac net.HardwareAddr) Plan
+
+	// Idle ends a session after this long without activity from the
+	// client. The next DHCP exchange starts a new one.
+	Idle time.Duration
+
+	// Stall reports an open session that has been quiet this long as
+	// stalled rather than in progress
+	Stall time.Duration
+
+	// Finished, if set, is called with every session as it ends
+	Finished func(Session)
+
+	// Booted, if set, is called in its own goroutine with every session
+	// that reaches the initrd stage, without its timeline
+	Booted func(Session)
+
+	mu       sync.Mutex
+	open     map[string]*Session // by domain and MAC
+	clients  map[string]string   // domain and IP to open session key
+	finished []*Session
+}
+
+func NewTracker() *Tracker {
+	return &Tracker{
+		Idle:    defaultIdleTimeout,
+		Stall:   defaultStall,
+		open:    make(map[string]*Session),
+		clients: make(map[string]string),
+	}
+}
+
+// Follow correlates every event published on bus
+func (t *Tracker) Follow(bus *events.Bus) {
+	ch, _ := bus.Subscribe(1024)
+	go func() {
+		for e := range ch {
+			t.Record(e)
+		}
+	}()
+	go func() {
+		for range time.Tick(30 * time.Second) {
+			t.expire(time.Now())
+		}
+	}()
+}
+
+// Record adds e to its client's session
+func (t *Tracker) Record(e events.Event) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var s *Session
+	switch e.Type {
+	case events.DHCPOffer, events.DHCPAck:
+		key := e.Domain + "|" + e.MAC.String()
+		if s = t.open[key]; s == nil {
+			s = &Session{ID: newID(), Domain: e.Domain, MAC: e.MAC.String(), Start: e.Time, Stage: StageDHCP,
+				initrds: make(map[string]bool)}
+			if t.Plan != nil {
+				s.plan = t.Plan(e.Domain, e.MAC)
+			}
+			s.Host, s.Profile = s.plan.Host, s.plan.Profile
+			t.open[key] = s
+		}
+		s.IP = e.IP.String()
+		t.clients[e.Domain+"|"+s.IP] = key
+	case events.TFTPComplete, events.TFTPFailed, events.HTTPRequest:
+		if s = t.open[t.clients[e.Domain+"|"+e.IP.String()]]; s == nil {
+			return
+		}
+		stage := s.Stage
+		s.fetched(e)
+		if e.Type == events.HTTPRequest && e.Path == "/installed" && e.Status/100 == 2 {
+			s.Installed = e.Time
+		}
+		if s.Stage == StageInitrd && stage != StageInitrd && t.Booted != nil {
+			c := *s
+			c.Timeline, c.Console = nil, nil
+			go t.Booted(c)
+		}
+	case events.MulticastJoin, events.MulticastDone, events.MulticastFailed:
+		if s = t.open[t.clients[e.Domain+"|"+e.IP.String()]]; s == nil {
+			return
+		}
+		switch e.Type {
+		case events.MulticastJoin:
+			s.Multicast = "receiving"
+		case events.MulticastDone:
+			s.Multicast = "done"
+		default:
+			s.Multicast = "failed: " + e.Err
+		}
+	default:
+		return
+	}
+
+	s.Last = e.Time
+	if len(s.Timeline) < maxTimeline {
+		s.Timeline = append(s.Timeline, e)
+	} else {
+		s.Omitted++
+	}
+}
+
+// Console attaches a kernel message from the client at ip to its open
+// session in domain, if it has one. Messages don't keep a session open: a
+// machine that booted fine may log for days.
+func (t *Tracker) Console(domain string, ip net.IP, text string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := t.open[t.clients[domain+"|"+ip.String()]]
+	if s == nil {
+		return
+	}
+	s.Console = append(s.Console, ConsoleLine{Time: time.Now(), Text: text})
+	if len(s.Console) > maxConsole {
+		s.Console = s.Console[len(s.Console)-maxConsole:]
+	}
+	if s.Panic == "" && strings.Contains(text, "Kernel panic") {
+		s.Panic = text
+	}
+}
+
+// fetched advances the session's stage for a file transfer
+func (s *Session) fetched(e events.Event) {
+	ok := e.Type == events.TFTPComplete || e.Type == events.HTTPRequest && e.Status < 400
+	name := path.Base(e.Path)
+	switch {
+	case s.plan.BootFile != "" && name == path.Base(s.plan.BootFile) ||
+		s.plan.BootFile == "" && s.Stage == StageDHCP && e.Type != events.HTTPRequest:
+		s.requested = true
+		if ok && s.Stage == StageDHCP {
+			s.Stage = StageBootloader
+		}
+	case s.isKernel(name):
+		if ok && (s.Stage == StageDHCP || s.Stage == StageBootloader) {
+			s.Stage = StageKernel
+		}
+	case s.isInitrd(name):
+		if ok && s.Stage == StageKernel {
+			s.initrds[name] = true
+			if len(s.plan.Initrd) == 0 || len(s.initrds) == len(s.plan.Initrd) {
+				s.Stage = StageInitrd
+			}
+		}
+	}
+}
+
+func (s *Session) isKernel(name string) bool {
+	if s.plan.Kernel != "" {
+		return name == path.Base(s.plan.Kernel)
+	}
+	return strings.HasPrefix(name, "vmlinuz") || strings.HasPrefix(name, "bzImage") || name == "linux" || name == "kernel"
+}
+
+func (s *Session) isInitrd(name string) bool {
+	for _, f := range s.plan.Initrd {
+		if name == path.Base(f) {
+			return true
+		}
+	}
+	return len(s.plan.Initrd) == 0 && (strings.HasPrefix(name, "initrd") || strings.HasPrefix(name, "initramfs"))
+}
+
+// outcome classifies the session; open sessions that haven't booted yet
+// are in progress unless quiet for longer than stall
+func (s *Session) outcome(stall time.Duration) string {
+	switch {
+	case s.Panic != "":
+		return Panicked
+	case strings.HasPrefix(s.Multicast, "failed"):
+		return MulticastFailed
+	case s.Multicast == "receiving" && !s.done:
+		return InProgress
+	case s.Stage == StageInitrd:
+		return Succeeded
+	case !s.done && time.Since(s.Last) < stall:
+		return InProgress
+	case s.Stage == StageKernel:
+		return StalledInitrd
+	case s.Stage == StageBootloader:
+		return StalledKernel
+	case s.requested:
+		return StalledBootloader
+	}
+	return NoBootloader
+}
+
+// expire ends every session idle since before now-Idle. Sessions still
+// receiving a multicast image are quiet by design and kept open.
+func (t *Tracker) expire(now time.Time) {
+	t.mu.Lock()
+	var ended []Session
+	for key, s := range t.open {
+		if now.Sub(s.Last) >= t.Idle && s.Multicast != "receiving" {
+			ended = append(ended, t.end(key, s, s.outcome(0)))
+		}
+	}
+	t.mu.Unlock()
+	t.report(ended)
+}
+
+// Close ends every open session. Those active within Stall are
+// interrupted rather than stalled.
+func (t *Tracker) Close() {
+	t.mu.Lock()
+	var ended []Session
+	for key, s := range t.open {
+		outcome := s.outcome(t.Stall)
+		if outcome == InProgress {
+			outcome = Interrupted
+		}
+		ended = append(ended, t.end(key, s, outcome))
+	}
+	t.mu.Unlock()
+	t.report(ended)
+}
+
+func (t *Tracker) end(key string, s *Session, outcome string) Session {
+	s.done = true
+	s.Outcome = outcome
+	delete(t.open, key)
+	if t.clients[s.Domain+"|"+s.IP] == key {
+		delete(t.clients, s.Domain+"|"+s.IP)
+	}
+	t.finished = append(t.finished, s)
+	if len(t.finished) > maxFinished {
+		t.finished = t.finished[len(t.finished)-maxFinished:]
+	}
+	c := *s
+	c.Timeline = append([]events.Event(nil), s.Timeline...)
+	c.Console = append([]ConsoleLine(nil), s.Console...)
+	return c
+}
+
+func (t *Tracker) report(ended []Session) {
+	if t.Finished == nil {
+		return
+	}
+	for _, s := range ended {
+		t.Finished(s)
+	}
+}
+
+func (t *Tracker) snapshot(s *Session) Session {
+	c := *s
+	if !s.done {
+		c.Outcome = s.outcome(t.Stall)
+	}
+	c.Timeline = append([]events.Event(nil), s.Timeline...)
+	c.Console = append([]ConsoleLine(nil), s.Console...)
+	return c
+}
+
+// List returns the domain's sessions, newest first, without timelines or
+// console messages
+func (t *Tracker) List(domain string) []Session {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var list []Session
+	add := func(s *Session) {
+		if s.Domain == domain {
+			c := t.snapshot(s)
+			c.Timeline, c.Omitted, c.Console = nil, 0, nil
+			list = append(list, c)
+		}
+	}
+	for _, s := range t.open {
+		add(s)
+	}
+	for _, s := range t.finished {
+		add(s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Start.After(list[j].Start) })
+	return list
+}
+
+// Get returns one of the domain's sessions with its timeline
+func (t *Tracker) Get(domain, id string) (Session, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, s := range t.open {
+		if s.ID == id && s.Domain == domain {
+			return t.snapshot(s), true
+		}
+	}
+	for _, s := range t.finished {
+		if s.ID == id && s.Domain == domain {
+			return t.snapshot(s), true
+		}
+	}
+	return Session{}, false
+}
+
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,240 @@
+package sessions
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ars1364/go-pxe/events"
+)
+
+var (
+	mac, _ = net.ParseMAC("aa:bb:cc:dd:ee:01")
+	ip     = net.IPv4(10, 0, 0, 5)
+	start  = time.Now().Add(-time.Hour)
+)
+
+// boot replays a client's boot: a DHCP ack and then each transfer, one
+// second apart
+func boot(t *Tracker, transfers ...events.Event) {
+	at := start
+	t.Record(events.Event{Type: events.DHCPAck, Time: at, MAC: mac, IP: ip, Domain: "lab"})
+	for _, e := range transfers {
+		at = at.Add(time.Second)
+		e.Time, e.IP, e.Domain = at, ip, "lab"
+		t.Record(e)
+	}
+}
+
+func tftp(path string) events.Event {
+	return events.Event{Type: events.TFTPComplete, Path: path}
+}
+
+func TestStages(t *testing.T) {
+	tests := []struct {
+		name      string
+		plan      Plan
+		transfers []events.Event
+		stage     string
+		outcome   string
+	}{
+		{"dhcp only", Plan{}, nil, StageDHCP, NoBootloader},
+		{"bootloader failed", Plan{}, []events.Event{{Type: events.TFTPFailed, Path: "pxelinux.0"}}, StageDHCP, StalledBootloader},
+		{"bootloader", Plan{}, []events.Event{tftp("pxelinux.0")}, StageBootloader, StalledKernel},
+		{"kernel", Plan{}, []events.Event{tftp("pxelinux.0"), tftp("/alma/vmlinuz")}, StageKernel, StalledInitrd},
+		{"booted", Plan{}, []events.Event{tftp("pxelinux.0"), tftp("/alma/vmlinuz"), tftp("/alma/initrd.img")}, StageInitrd, Succeeded},
+		{"over http", Plan{BootFile: "ipxe.efi"}, []events.Event{
+			tftp("ipxe.efi"),
+			{Type: events.HTTPRequest, Path: "/alma/vmlinuz", Status: 200},
+			{Type: events.HTTPRequest, Path: "/alma/initrd.img", Status: 404},
+		}, StageKernel, StalledInitrd},
+		{"initrd before kernel", Plan{}, []events.Event{tftp("pxelinux.0"), tftp("initrd.img")}, StageBootloader, StalledKernel},
+		{"planned files", Plan{BootFile: "grubx64.efi", Kernel: "/k/linux64", Initrd: []string{"/k/a.img", "/k/b.img"}}, []events.Event{
+			tftp("grubx64.efi"), tftp("linux64"), tftp("a.img"),
+		}, StageKernel, StalledInitrd},
+		{"all planned initrds", Plan{BootFile: "grubx64.efi", Kernel: "/k/linux64", Initrd: []string{"/k/a.img", "/k/b.img"}}, []events.Event{
+			tftp("grubx64.efi"), tftp("linux64"), tftp("a.img"), tftp("b.img"),
+		}, StageInitrd, Succeeded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := NewTracker()
+			tr.Plan = func(domain string, m net.HardwareAddr) Plan {
+				if domain != "lab" || m.String() != mac.String() {
+					t.Errorf("plan asked for %s %s", domain, m)
+				}
+				return tt.plan
+			}
+			var ended []Session
+			tr.Finished = func(s Session) { ended = append(ended, s) }
+			boot(tr, tt.transfers...)
+			tr.expire(time.Now())
+
+			if len(ended) != 1 {
+				t.Fatalf("ended %d sessions", len(ended))
+			}
+			s := ended[0]
+			if s.Stage != tt.stage || s.Outcome != tt.outcome || len(s.Timeline) != len(tt.transfers)+1 {
+				t.Errorf("stage %s, outcome %s, %d events; want %s, %s", s.Stage, s.Outcome, len(s.Timeline), tt.stage, tt.outcome)
+			}
+		})
+	}
+}
+
+func TestOutcomes(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       Session
+		stall   time.Duration
+		outcome string
+	}{
+		{"panic wins", Session{Stage: StageInitrd, Panic: "Kernel panic", done: true}, 0, Panicked},
+		{"multicast failed", Session{Stage: StageInitrd, Multicast: "failed: timeout", done: true}, 0, MulticastFailed},
+		{"receiving", Session{Multicast: "receiving", Last: start}, 0, InProgress},
+		{"recent", Session{Stage: StageKernel, Last: time.Now()}, time.Minute, InProgress},
+		{"quiet", Session{Stage: StageKernel, Last: start}, time.Minute, StalledInitrd},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.s.outcome(tt.stall); got != tt.outcome {
+				t.Errorf("outcome = %s, want %s", got, tt.outcome)
+			}
+		})
+	}
+}
+
+func TestExpire(t *testing.T) {
+	tr := NewTracker()
+	boot(tr, tftp("pxelinux.0"))
+	tr.expire(start.Add(time.Minute))
+	if list := tr.List("lab"); len(list) != 1 || list[0].Outcome != StalledKernel {
+		t.Fatalf("List = %+v", list)
+	}
+	if got := tr.List("other"); len(got) != 0 {
+		t.Errorf("other domain lists %+v", got)
+	}
+
+	// Open but quiet: kept until Idle passes, then stalled
+	tr.expire(start.Add(tr.Idle - time.Second))
+	if len(tr.open) != 1 {
+		t.Fatal("session ended before Idle")
+	}
+
+	// Quiet while receiving multicast: kept open
+	tr.Record(events.Event{Type: events.MulticastJoin, Time: start, IP: ip, Domain: "lab"})
+	tr.expire(time.Now())
+	if len(tr.open) != 1 {
+		t.Fatal("session receiving multicast expired")
+	}
+	tr.Record(events.Event{Type: events.MulticastDone, Time: start, IP: ip, Domain: "lab"})
+	tr.expire(time.Now())
+	if len(tr.open) != 0 || len(tr.clients) != 0 {
+		t.Errorf("open %v, clients %v after expiry", tr.open, tr.clients)
+	}
+
+	// The next DHCP exchange starts a new session
+	boot(tr)
+	if list := tr.List("lab"); len(list) != 2 || list[0].ID == list[1].ID {
+		t.Errorf("List = %+v", list)
+	}
+}
+
+func TestClose(t *testing.T) {
+	tr := NewTracker()
+	var ended []Session
+	tr.Finished = func(s Session) { ended = append(ended, s) }
+	tr.Record(events.Event{Type: events.DHCPOffer, Time: time.Now(), MAC: mac, IP: ip, Domain: "lab"})
+	tr.Close()
+	if len(ended) != 1 || ended[0].Outcome != Interrupted {
+		t.Errorf("ended %+v", ended)
+	}
+}
+
+func TestUnknownClient(t *testing.T) {
+	tr := NewTracker()
+	for _, typ := range []string{events.TFTPComplete, events.HTTPRequest, events.MulticastJoin, "bogus"} {
+		tr.Record(events.Event{Type: typ, Time: start, IP: ip, Domain: "lab", Path: "vmlinuz"})
+	}
+	tr.Console("lab", ip, "Kernel panic")
+	if len(tr.open) != 0 || len(tr.List("lab")) != 0 {
+		t.Errorf("events from an unknown client opened a session")
+	}
+
+	// The same IP in another domain is another client
+	boot(tr)
+	tr.Record(events.Event{Type: events.TFTPComplete, Time: start, IP: ip, Domain: "other", Path: "pxelinux.0"})
+	if s := tr.List("lab")[0]; s.Stage != StageDHCP {
+		t.Errorf("other domain's transfer counted: %+v", s)
+	}
+}
+
+func TestConsole(t *testing.T) {
+	tr := NewTracker()
+	boot(tr)
+	for range maxConsole + 10 {
+		tr.Console("lab", ip, "line")
+	}
+	tr.Console("lab", ip, "Kernel panic - not syncing: VFS")
+	tr.Console("lab", ip, "Kernel panic - second")
+
+	s := tr.List("lab")[0]
+	if s.Console != nil || s.Outcome != Panicked {
+		t.Errorf("listed session = %+v", s)
+	}
+	s, ok := tr.Get("lab", s.ID)
+	if !ok || len(s.Console) != maxConsole || s.Panic != "Kernel panic - not syncing: VFS" {
+		t.Errorf("Get = %d lines, panic %q, %v", len(s.Console), s.Panic, ok)
+	}
+	if _, ok := tr.Get("other", s.ID); ok {
+		t.Error("session found in another domain")
+	}
+}
+
+func TestTimelineCap(t *testing.T) {
+	tr := NewTracker()
+	boot(tr)
+	for range maxTimeline + 5 {
+		tr.Record(events.Event{Type: events.HTTPRequest, Time: start, IP: ip, Domain: "lab", Path: "/x", Status: 200})
+	}
+	s, _ := tr.Get("lab", tr.List("lab")[0].ID)
+	if len(s.Timeline) != maxTimeline || s.Omitted != 6 {
+		t.Errorf("timeline %d, omitted %d", len(s.Timeline), s.Omitted)
+	}
+}
+
+func TestBootedAndInstalled(t *testing.T) {
+	tr := NewTracker()
+	booted := make(chan Session, 2)
+	tr.Booted = func(s Session) { booted <- s }
+	boot(tr, tftp("pxelinux.0"), tftp("vmlinuz"), tftp("initrd.img"), tftp("initrd.img"),
+		events.Event{Type: events.HTTPRequest, Path: "/installed", Status: 204})
+
+	select {
+	case s := <-booted:
+		if s.Timeline != nil || s.Stage != StageInitrd {
+			t.Errorf("booted %+v", s)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Booted not called")
+	}
+	select {
+	case <-booted:
+		t.Error("Booted called twice")
+	case <-time.After(10 * time.Millisecond):
+	}
+	if s := tr.List("lab")[0]; s.Installed.IsZero() {
+		t.Error("installation not recorded")
+	}
+}
+
+func TestFinishedCap(t *testing.T) {
+	tr := NewTracker()
+	for i := range maxFinished + 3 {
+		m := net.HardwareAddr{0xaa, 0, 0, 0, byte(i >> 8), byte(i)}
+		tr.Record(events.Event{Type: events.DHCPAck, Time: start, MAC: m, IP: ip, Domain: "lab"})
+		tr.expire(time.Now())
+	}
+	if len(tr.finished) != maxFinished {
+		t.Errorf("kept %d finished sessions", len(tr.finished))
+	}
+}
@@ -0,0 +1,221 @@
+// Package sshkeys generates SSH host keys for inventory hosts before they
+// are installed, so templates can hand each host the same keys on every
+// reimage and clients can know them in advance instead of trusting the
+// first key they see.
+package sshkeys
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Types are the key types generated, in the order they are listed
+var Types = []string{"ed25519", "ecdsa"}
+
+var namePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// Key is one host key
+type Key struct {
+	Type        string `json:"type"`        // "ed25519" or "ecdsa"
+	Public      string `json:"public"`      // authorized_keys form: "ssh-ed25519 AAAA..."
+	Fingerprint string `json:"fingerprint"` // as ssh-keygen -l shows it
+	private     []byte // OpenSSH PEM
+}
+
+// Store keeps each host's keys as ssh_host_<type>_key files in a
+// directory per host, generating them on first use
+type Store struct {
+	dir string
+	mu  sync.Mutex
+}
+
+// NewStore creates a store keeping keys under dir
+func NewStore(dir string) *Store {
+	return &Store{dir: dir}
+}
+
+// Keys returns the host's keys, generating any that are missing
+func (s *Store) Keys(host string) ([]Key, error) {
+	if !namePattern.MatchString(host) {
+		return nil, fmt.Errorf("ssh keys: invalid host name %q", host)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []Key
+	for _, typ := range Types {
+		k, err := s.load(host, typ)
+		if os.IsNotExist(err) {
+			k, err = s.generate(host, typ)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("ssh keys: %s: %w", host, err)
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// Key returns the host's key of type typ
+func (s *Store) Key(host, typ string) (Key, error) {
+	keys, err := s.Keys(host)
+	if err != nil {
+		return Key{}, err
+	}
+	for _, k := range keys {
+		if k.Type == typ {
+			return k, nil
+		}
+	}
+	return Key{}, fmt.Errorf("ssh keys: unknown key type %q (want %s)", typ, strings.Join(Types, " or "))
+}
+
+// Private returns the private key in OpenSSH format, as sshd expects it
+// in /etc/ssh/ssh_host_<type>_key
+func (k Key) Private() string {
+	return string(k.private)
+}
+
+// Delete removes the host's keys, so new ones are generated on next use.
+// It reports whether there were any.
+func (s *Store) Delete(host string) bool {
+	if !namePattern.MatchString(host) {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dir := filepath.Join(s.dir, host)
+	if _, err := os.Stat(dir); err != nil {
+		return false
+	}
+	os.RemoveAll(dir)
+	return true
+}
+
+func (s *Store) path(host, typ string) string {
+	return filepath.Join(s.dir, host, "ssh_host_"+typ+"_key")
+}
+
+func (s *Store) load(host, typ string) (Key, error) {
+	priv, err := os.ReadFile(s.path(host, typ))
+	if err != nil {
+		return Key{}, err
+	}
+	pub, err := os.ReadFile(s.path(host, typ) + ".pub")
+	if err != nil {
+		return Key{}, err
+	}
+	fields := strings.Fields(string(pub))
+	if len(fields) < 2 {
+		return Key{}, fmt.Errorf("%s.pub: not a public key", s.path(host, typ))
+	}
+	blob, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return Key{}, fmt.Errorf("%s.pub: %w", s.path(host, typ), err)
+	}
+	return Key{Type: typ, Public: fields[0] + " " + fields[1], Fingerprint: fingerprint(blob), private: priv}, nil
+}
+
+func (s *Store) generate(host, typ string) (Key, error) {
+	var pub, priv []byte
+	switch typ {
+	case "ed25519":
+		pk, sk, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return Key{}, err
+		}
+		pub = sshString(nil, []byte("ssh-ed25519"))
+		pub = sshString(pub, pk)
+		priv = sshString(nil, []byte("ssh-ed25519"))
+		priv = sshString(priv, pk)
+		priv = sshString(priv, sk)
+	case "ecdsa":
+		sk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return Key{}, err
+		}
+		ek, err := sk.PublicKey.ECDH()
+		if err != nil {
+			return Key{}, err
+		}
+		point := ek.Bytes() // uncompressed, as SSH sends it
+		pub = sshString(nil, []byte("ecdsa-sha2-nistp256"))
+		pub = sshString(pub, []byte("nistp256"))
+		pub = sshString(pub, point)
+		priv = sshString(nil, []byte("ecdsa-sha2-nistp256"))
+		priv = sshString(priv, []byte("nistp256"))
+		priv = sshString(priv, point)
+		priv = sshMPInt(priv, sk.D)
+	default:
+		return Key{}, fmt.Errorf("unknown key type %q", typ)
+	}
+	comment := "root@" + host
+	privPEM := pem.EncodeToMemory(&pem.Block{Type: "OPENSSH PRIVATE KEY", Bytes: openSSHPrivate(pub, priv, comment)})
+	algo := string(pub[4 : 4+binary.BigEndian.Uint32(pub)])
+	line := algo + " " + base64.StdEncoding.EncodeToString(pub)
+
+	if err := os.MkdirAll(filepath.Join(s.dir, host), 0700); err != nil {
+		return Key{}, err
+	}
+	if err := os.WriteFile(s.path(host, typ), privPEM, 0600); err != nil {
+		return Key{}, err
+	}
+	if err := os.WriteFile(s.path(host, typ)+".pub", []byte(line+" "+comment+"\n"), 0644); err != nil {
+		return Key{}, err
+	}
+	return Key{Type: typ, Public: line, Fingerprint: fingerprint(pub), private: privPEM}, nil
+}
+
+// openSSHPrivate encodes an unencrypted openssh-key-v1 private key
+// (PROTOCOL.key in the OpenSSH sources)
+func openSSHPrivate(pub, priv []byte, comment string) []byte {
+	var check [4]byte
+	rand.Read(check[:])
+	inner := append(append([]byte(nil), check[:]...), check[:]...)
+	inner = append(inner, priv...)
+	inner = sshString(inner, []byte(comment))
+	for i := byte(1); len(inner)%8 != 0; i++ {
+		inner = append(inner, i)
+	}
+
+	out := []byte("openssh-key-v1\x00")
+	out = sshString(out, []byte("none")) // cipher
+	out = sshString(out, []byte("none")) // KDF
+	out = sshString(out, nil)            // KDF options
+	out = binary.BigEndian.AppendUint32(out, 1)
+	out = sshString(out, pub)
+	return sshString(out, inner)
+}
+
+// sshString appends b as an SSH wire string: a 32-bit length and the bytes
+func sshString(out, b []byte) []byte {
+	out = binary.BigEndian.AppendUint32(out, uint32(len(b)))
+	return append(out, b...)
+}
+
+// sshMPInt appends a non-negative n as an SSH mpint
+func sshMPInt(out []byte, n *big.Int) []byte {
+	b := n.Bytes()
+	if len(b) > 0 && b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	}
+	return sshString(out, b)
+}
+
+// fingerprint formats a public key blob as ssh-keygen -l does
+func fingerprint(blob []byte) string {
+	sum := sha256.Sum256(blob)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
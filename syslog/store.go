@@ -0,0 +1,95 @@
+package syslog
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Store keeps the most recent messages of every client, keyed by client ID
+type Store struct {
+	mu   sync.Mutex
+	keep int
+	logs map[string][]Message
+}
+
+// ClientLog summarises one client's stored messages
+type ClientLog struct {
+	Client   string    `json:"client"`
+	Messages int       `json:"messages"`
+	Last     time.Time `json:"last"`
+}
+
+// NewStore creates a store holding up to keep messages per client
+func NewStore(keep int) *Store {
+	return &Store{keep: keep, logs: make(map[string][]Message)}
+}
+
+// Add appends m to client's log, dropping its oldest message when full.
+// A zero m.Time is set to now, keeping each log in time order.
+func (s *Store) Add(client string, m Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if m.Time.IsZero() {
+		m.Time = time.Now()
+	}
+	l := append(s.logs[client], m)
+	if len(l) > s.keep {
+		l = l[len(l)-s.keep:]
+	}
+	s.logs[client] = l
+}
+
+// Messages returns client's messages received after since, oldest first
+func (s *Store) Messages(client string, since time.Time) []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l := s.logs[client]
+	i := sort.Search(len(l), func(i int) bool { return l[i].Time.After(since) })
+	return append([]Message{}, l[i:]...)
+}
+
+// Clients lists every client with stored messages, most recently heard first
+func (s *Store) Clients() []ClientLog {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]ClientLog, 0, len(s.logs))
+	for c, l := range s.logs {
+		list = append(list, ClientLog{Client: c, Messages: len(l), Last: l[len(l)-1].Time})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Last.After(list[j].Last) })
+	return list
+}
+
+// Delete forgets client's messages, reporting whether there were any
+func (s *Store) Delete(client string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.logs[client]
+	delete(s.logs, client)
+	return ok
+}
+
+// Snapshot returns a copy of every client's log for backups
+func (s *Store) Snapshot() map[string][]Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snap := make(map[string][]Message, len(s.logs))
+	for c, l := range s.logs {
+		snap[c] = append([]Message(nil), l...)
+	}
+	return snap
+}
+
+// Load replaces every client's log with snap, as a backup restores them,
+// keeping the newest messages of logs longer than the store holds
+func (s *Store) Load(snap map[string][]Message) {
+	s.mu.Lock()
+	s.logs = make(map[string][]Message, len(snap))
+	s.mu.Unlock()
+	for c, l := range snap {
+		for _, m := range l {
+			s.Add(c, m)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+// Package syslog receives remote syslog from installing clients (Anaconda's
+// inst.syslog=, debian-installer's log_host=) over UDP and TCP and keeps it
+// per client, so a failed install can be diagnosed after the fact.
+package syslog
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxMessage bounds a single message; longer TCP lines are split
+const maxMessage = 65536
+
+// Message is one received log line
+type Message struct {
+	Time     time.Time `json:"time"` // when it was received; installer clocks are often wrong
+	Facility int       `json:"facility"`
+	Severity int       `json:"severity"`
+	Host     string    `json:"host,omitempty"` // hostname claimed by the sender
+	App      string    `json:"app,omitempty"`
+	Text     string    `json:"text"`
+}
+
+// Server stores every message it receives in Store
+type Server struct {
+	Store *Store
+
+	// ClientID, if set, names the client a message came from. Defaults to
+	// its IP address.
+	ClientID func(net.IP) string
+
+	mu   sync.Mutex
+	seen map[string]bool
+}
+
+func NewServer(store *Store) *Server {
+	return &Server{Store: store, seen: make(map[string]bool)}
+}
+
+// ListenAndServe receives syslog on addr (normally <ip>:514) over both UDP
+// and TCP
+func (s *Server) ListenAndServe(addr string) error {
+	udpAddr, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return err
+	}
+	udp, err := net.ListenUDP("udp4", udpAddr)
+	if err != nil {
+		return fmt.Errorf("syslog listen: %w", err)
+	}
+	tcp, err := net.Listen("tcp4", addr)
+	if err != nil {
+		udp.Close()
+		return fmt.Errorf("syslog listen: %w", err)
+	}
+	log.Printf("[SYSLOG] Listening on %s (udp+tcp)", addr)
+
+	go func() {
+		defer udp.Close()
+		buf := make([]byte, maxMessage)
+		for {
+			n, remote, err := udp.ReadFromUDP(buf)
+			if err != nil {
+				log.Printf("[SYSLOG] Read error: %v", err)
+				continue
+			}
+			s.receive(remote.IP, buf[:n])
+		}
+	}()
+
+	defer tcp.Close()
+	for {
+		conn, err := tcp.Accept()
+		if err != nil {
+			log.Printf("[SYSLOG] Accept error: %v", err)
+			continue
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// serveConn reads messages framed by octet counting or by newlines
+// (RFC 6587), whichever each message uses
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+	remote := conn.RemoteAddr().(*net.TCPAddr).IP
+	r := bufio.NewReaderSize(conn, maxMessage)
+	for {
+		msg, err := readFrame(r)
+		if len(msg) > 0 {
+			s.receive(remote, msg)
+		}
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				log.Printf("[SYSLOG] %s: %v", remote, err)
+			}
+			return
+		}
+	}
+}
+
+func readFrame(r *bufio.Reader) ([]byte, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if b[0] >= '1' && b[0] <= '9' {
+		prefix, err := r.ReadSlice(' ')
+		if err != nil {
+			return nil, err
+		}
+		n, err := strconv.Atoi(string(prefix[:len(prefix)-1]))
+		if err != nil || n > maxMessage {
+			return nil, fmt.Errorf("bad frame length %q", prefix)
+		}
+		msg := make([]byte, n)
+		n, err = io.ReadFull(r, msg)
+		return msg[:n], err
+	}
+	line, err := r.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		err = nil
+	}
+	return append([]byte(nil), line...), err
+}
+
+func (s *Server) receive(remote net.IP, data []byte) {
+	data = bytes.Trim(data, "\r\n\x00") // frames may end in NUL as well as newlines
+	if len(data) == 0 {
+		return
+	}
+	client := remote.String()
+	if s.ClientID != nil {
+		client = s.ClientID(remote)
+	}
+	s.mu.Lock()
+	if !s.seen[client] {
+		s.seen[client] = true
+		log.Printf("[SYSLOG] Receiving logs from %s (%s)", client, remote)
+	}
+	s.mu.Unlock()
+
+	s.Store.Add(client, Parse(string(data)))
+}
+
+// Parse decodes an RFC 5424 or BSD-style (RFC 3164) message. Anything that
+// doesn't look like either is kept whole as user.notice text.
+func Parse(line string) Message {
+	m := Message{Facility: 1, Severity: 5}
+	if rest, pri, ok := parsePRI(line); ok {
+		m.Facility, m.Severity = pri/8, pri%8
+		line = rest
+	}
+
+	if rest, ok := strings.CutPrefix(line, "1 "); ok {
+		// TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG
+		f := strings.SplitN(rest, " ", 6)
+		if len(f) == 6 {
+			m.Host, m.App = nilValue(f[1]), nilValue(f[2])
+			m.Text = strings.TrimPrefix(skipStructuredData(f[5]), "\ufeff")
+			return m
+		}
+	}
+
+	// [Mmm dd hh:mm:ss] [HOSTNAME] [TAG[pid]:] MSG
+	stamped := false
+	if len(line) > len(time.Stamp) && line[len(time.Stamp)] == ' ' {
+		if _, err := time.Parse(time.Stamp, line[:len(time.Stamp)]); err == nil {
+			line, stamped = line[len(time.Stamp)+1:], true
+		}
+	}
+	word, rest, _ := strings.Cut(line, " ")
+	if stamped && !isTag(word) && rest != "" {
+		m.Host = word
+		line = rest
+		word, rest, _ = strings.Cut(line, " ")
+	}
+	if isTag(word) {
+		m.App = strings.TrimSuffix(word, ":")
+		if i := strings.IndexByte(m.App, '['); i > 0 {
+			m.App = m.App[:i]
+		}
+		line = rest
+	}
+	m.Text = line
+	return m
+}
+
+func parsePRI(line string) (string, int, bool) {
+	end := strings.IndexByte(line, '>')
+	if !strings.HasPrefix(line, "<") || end < 2 || end > 4 {
+		return line, 0, false
+	}
+	pri, err := strconv.Atoi(line[1:end])
+	if err != nil || pri < 0 || pri > 191 {
+		return line, 0, false
+	}
+	return line[end+1:], pri, true
+}
+
+// isTag reports whether word looks like "app:" or "app[123]:"
+func isTag(word string) bool {
+	return len(word) > 1 && strings.HasSuffix(word, ":")
+}
+
+func nilValue(s string) string {
+	if s == "-" {
+		return ""
+	}
+	return s
+}
+
+// skipStructuredData drops the leading "-" or [id param="value"]... blocks
+func skipStructuredData(s string) string {
+	if rest, ok := strings.CutPrefix(s, "-"); ok {
+		return strings.TrimPrefix(rest, " ")
+	}
+	for strings.HasPrefix(s, "[") {
+		end := elementEnd(s)
+		if end < 0 {
+			return ""
+		}
+		s = s[end+1:]
+	}
+	return strings.TrimPrefix(s, " ")
+}
+
+// elementEnd returns the index of the "]" closing the SD-ELEMENT at the
+// start of s, skipping any inside quoted parameter values, or -1
+func elementEnd(s string) int {
+	quoted := false
+	for i := 1; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && quoted:
+			i++
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == ']' && !quoted:
+			return i
+		}
+	}
+	return -1
+}
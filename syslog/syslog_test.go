@@ -0,0 +1,144 @@
+package syslog
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want Message
+	}{
+		{"RFC 5424", `<134>1 2026-01-02T03:04:05Z web01 anaconda 123 - - Installing bash`,
+			Message{Facility: 16, Severity: 6, Host: "web01", App: "anaconda", Text: "Installing bash"}},
+		{"RFC 5424 structured data", `<13>1 - - - - - [meta x="a]b" y="\"q\""][other] text`,
+			Message{Facility: 1, Severity: 5, Text: "text"}},
+		{"RFC 5424 with BOM", "<13>1 - host app - - - \ufeffhello",
+			Message{Facility: 1, Severity: 5, Host: "host", App: "app", Text: "hello"}},
+		{"RFC 5424 unterminated structured data", `<13>1 - - - - - [meta x="a`,
+			Message{Facility: 1, Severity: 5}},
+		{"BSD", "<30>Jan  2 03:04:05 web01 systemd[1]: Started sshd",
+			Message{Facility: 3, Severity: 6, Host: "web01", App: "systemd", Text: "Started sshd"}},
+		{"BSD without host", "<30>Jan  2 03:04:05 kernel: oops",
+			Message{Facility: 3, Severity: 6, App: "kernel", Text: "oops"}},
+		{"tag only", "<11>anaconda: step 3",
+			Message{Facility: 1, Severity: 3, App: "anaconda", Text: "step 3"}},
+		{"plain", "just text", Message{Facility: 1, Severity: 5, Text: "just text"}},
+		{"PRI too large", "<192>text", Message{Facility: 1, Severity: 5, Text: "<192>text"}},
+		{"negative PRI", "<-1>text", Message{Facility: 1, Severity: 5, Text: "<-1>text"}},
+		{"unclosed PRI", "<13 text", Message{Facility: 1, Severity: 5, Text: "<13 text"}},
+		{"empty PRI", "<>text", Message{Facility: 1, Severity: 5, Text: "<>text"}},
+		{"PRI only", "<13>", Message{Facility: 1, Severity: 5}},
+		{"short 5424", "<13>1 - -", Message{Facility: 1, Severity: 5, Text: "1 - -"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Parse(tt.line); got != tt.want {
+				t.Errorf("Parse = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadFrame(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		frames []string
+		err    bool // after the frames
+	}{
+		{"newlines", "one\ntwo\n", []string{"one\n", "two\n"}, false},
+		{"octet counting", "3 one4 two\n", []string{"one", "two\n"}, false},
+		{"mixed", "3 one<13>two\n", []string{"one", "<13>two\n"}, false},
+		{"unterminated", "last", []string{"last"}, false},
+		{"bad length", "3x one", nil, true},
+		{"huge length", "99999999 x", nil, true},
+		{"short frame", "10 abc", []string{"abc"}, true},
+		{"length without space", "123", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReaderSize(strings.NewReader(tt.input), 64)
+			var frames []string
+			var err error
+			for err == nil {
+				var msg []byte
+				msg, err = readFrame(r)
+				if len(msg) > 0 {
+					frames = append(frames, string(msg))
+				}
+			}
+			if strings.Join(frames, "|") != strings.Join(tt.frames, "|") {
+				t.Errorf("frames %q, want %q", frames, tt.frames)
+			}
+			if gotErr := err.Error() != "EOF"; gotErr != tt.err {
+				t.Errorf("ended with %v", err)
+			}
+		})
+	}
+}
+
+func TestServeConn(t *testing.T) {
+	store := NewStore(2)
+	s := NewServer(store)
+	s.ClientID = func(ip net.IP) string { return "web01" }
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	done := make(chan struct{})
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			s.serveConn(conn)
+		}
+		close(done)
+	}()
+	conn, err := net.Dial("tcp4", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("<13>first\n\n12 <13>second\r\n\x00<13>third\n"))
+	conn.Close()
+	<-done
+
+	msgs := store.Messages("web01", time.Time{})
+	if len(msgs) != 2 || msgs[0].Text != "second" || msgs[1].Text != "third" {
+		t.Errorf("stored %+v, want the last two messages", msgs)
+	}
+}
+
+func TestStore(t *testing.T) {
+	store := NewStore(2)
+	start := time.Now()
+	for i, text := range []string{"a", "b", "c"} {
+		store.Add("web01", Message{Time: start.Add(time.Duration(i) * time.Second), Text: text})
+	}
+	store.Add("web02", Message{Time: start.Add(time.Hour), Text: "x"})
+	if msgs := store.Messages("web01", start); len(msgs) != 2 || msgs[0].Text != "b" {
+		t.Errorf("messages %+v, want b and c", msgs)
+	}
+	if msgs := store.Messages("web01", start.Add(time.Second)); len(msgs) != 1 || msgs[0].Text != "c" {
+		t.Errorf("messages since b %+v, want c", msgs)
+	}
+	if clients := store.Clients(); len(clients) != 2 || clients[0].Client != "web02" {
+		t.Errorf("clients %+v, want web02 first", clients)
+	}
+
+	snap := store.Snapshot()
+	snap["web03"] = []Message{{Text: "1"}, {Text: "2"}, {Text: "3"}}
+	restored := NewStore(2)
+	restored.Load(snap)
+	if msgs := restored.Messages("web03", time.Time{}); len(msgs) != 2 || msgs[1].Text != "3" {
+		t.Errorf("restored %+v, want the newest two", msgs)
+	}
+	if !restored.Delete("web01") || restored.Delete("web01") {
+		t.Error("Delete did not report the log once")
+	}
+}
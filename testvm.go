@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"runtime"
+	"time"
+
+	"github.com/ars1364/go-pxe/events"
+)
+
+// Common OVMF firmware locations (Debian/Ubuntu, Fedora, Homebrew)
+var ovmfCandidates = []string{
+	"/usr/share/OVMF/OVMF_CODE.fd",
+	"/usr/share/OVMF/OVMF_CODE_4M.fd",
+	"/usr/share/edk2/ovmf/OVMF_CODE.fd",
+	"/usr/share/qemu/OVMF.fd",
+	"/opt/homebrew/share/qemu/edk2-x86_64-code.fd",
+	"/usr/local/share/qemu/edk2-x86_64-code.fd",
+}
+
+// runTestVM starts the full stack, boots a throwaway QEMU VM bridged to the
+// PXE interface and reports whether it fetched the bootloader and kernel.
+func runTestVM(args []string) {
+	var opts options
+	fs := flag.NewFlagSet("test-vm", flag.ExitOnError)
+	opts.register(fs)
+	firmware := fs.String("firmware", "uefi", "VM firmware: bios or uefi")
+	ovmf := fs.String("ovmf", "", "OVMF firmware image for -firmware uefi (auto-detected if empty)")
+	qemuBin := fs.String("qemu", "qemu-system-x86_64", "QEMU binary")
+	netdev := fs.String("netdev", "", "QEMU -netdev backend (default: vmnet-bridged on macOS, bridge elsewhere)")
+	memory := fs.Int("memory", 2048, "VM memory in MB")
+	kernel := fs.String("kernel", "vmlinuz", "Kernel filename the VM is expected to download")
+	timeout := fs.Duration("timeout", 5*time.Minute, "Give up after this long")
+	fs.Parse(args)
+
+	mac := randomMAC()
+	qemuArgs, err := qemuArgs(*firmware, *ovmf, *netdev, opts.iface, mac, *memory)
+	if err != nil {
+		log.Fatalf("[TEST] %v", err)
+	}
+
+	bus := events.NewBus()
+	sub, unsubscribe := bus.Subscribe(256)
+	defer unsubscribe()
+
+	_, cleanup, err := startServices(&opts, bus)
+	if err != nil {
+		cleanup()
+		log.Fatal(err)
+	}
+	defer cleanup()
+
+	log.Printf("[TEST] Starting %s (firmware=%s, mac=%s)", *qemuBin, *firmware, mac)
+	cmd := exec.Command(*qemuBin, qemuArgs...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		log.Fatalf("[TEST] Failed to start QEMU: %v", err)
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	var vmIP net.IP
+	gotLease, gotBootloader, gotKernel := false, false, false
+	deadline := time.After(*timeout)
+
+wait:
+	for !gotKernel {
+		select {
+		case e := <-sub:
+			switch e.Type {
+			case events.DHCPAck:
+				if e.MAC.String() == mac.String() {
+					vmIP = e.IP
+					gotLease = true
+					log.Printf("[TEST] VM leased %s", vmIP)
+				}
+			case events.TFTPComplete, events.HTTPRequest:
+				if vmIP == nil || !vmIP.Equal(e.IP) || (e.Type == events.HTTPRequest && e.Status != 200) {
+					continue
+				}
+				switch path.Base(e.Path) {
+				case path.Base(opts.bootFile):
+					gotBootloader = true
+					log.Printf("[TEST] VM downloaded bootloader %s", e.Path)
+				case path.Base(*kernel):
+					gotKernel = true
+					log.Printf("[TEST] VM downloaded kernel %s", e.Path)
+				}
+			}
+		case err := <-exited:
+			log.Printf("[TEST] QEMU exited early: %v", err)
+			exited = nil
+			break wait
+		case <-deadline:
+			log.Printf("[TEST] Timed out after %s", *timeout)
+			break wait
+		}
+	}
+
+	if exited != nil {
+		cmd.Process.Kill()
+		<-exited
+	}
+
+	fmt.Println()
+	fmt.Println("=== test-vm result ===")
+	fmt.Printf("DHCP lease:  %s\n", passFail(gotLease))
+	fmt.Printf("Bootloader:  %s (%s)\n", passFail(gotBootloader), opts.bootFile)
+	fmt.Printf("Kernel:      %s (%s)\n", passFail(gotKernel), *kernel)
+	if !gotLease || !gotBootloader || !gotKernel {
+		cleanup()
+		os.Exit(1)
+	}
+}
+
+func qemuArgs(firmware, ovmf, netdev, iface string, mac net.HardwareAddr, memory int) ([]string, error) {
+	if netdev == "" {
+		if runtime.GOOS == "darwin" {
+			netdev = "vmnet-bridged,ifname=" + iface
+		} else {
+			// Requires iface to be a bridge permitted in qemu-bridge-helper's ACL
+			netdev = "bridge,br=" + iface
+		}
+	}
+
+	args := []string{
+		"-m", fmt.Sprint(memory),
+		"-display", "none",
+		"-serial", "null",
+		"-monitor", "none",
+		"-boot", "n",
+		"-netdev", netdev + ",id=pxe0",
+		"-device", "e1000,netdev=pxe0,mac=" + mac.String(),
+	}
+
+	switch firmware {
+	case "bios":
+	case "uefi":
+		if ovmf == "" {
+			for _, c := range ovmfCandidates {
+				if _, err := os.Stat(c); err == nil {
+					ovmf = c
+					break
+				}
+			}
+		}
+		if ovmf == "" {
+			return nil, fmt.Errorf("no OVMF firmware found, pass -ovmf")
+		}
+		args = append(args, "-drive", "if=pflash,format=raw,readonly=on,file="+ovmf)
+	default:
+		return nil, fmt.Errorf("unknown firmware %q (want bios or uefi)", firmware)
+	}
+	return args, nil
+}
+
+// randomMAC returns a locally administered address in QEMU's 52:54:00 space
+func randomMAC() net.HardwareAddr {
+	mac := net.HardwareAddr{0x52, 0x54, 0x00, 0, 0, 0}
+	rand.Read(mac[3:])
+	return mac
+}
+
+func passFail(ok bool) string {
+	if ok {
+		return "PASS"
+	}
+	return "FAIL"
+}
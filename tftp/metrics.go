@@ -0,0 +1,24 @@
+package tftp
+
+import (
+	"github.com/ars1364/go-pxe/metrics"
+)
+
+var (
+	mTransfers   = metrics.Default.Counter("gopxe_tftp_transfers_total", "TFTP read requests, by result (complete, failed, not_found, rejected, busy).", "domain", "result")
+	mActive      = metrics.Default.Gauge("gopxe_tftp_active_transfers", "TFTP transfers in progress.", "domain")
+	mRetransmits = metrics.Default.Counter("gopxe_tftp_retransmits_total", "TFTP DATA and OACK packets resent because no matching ACK arrived.", "domain")
+	mNegotiation = metrics.Default.Counter("gopxe_tftp_negotiation_failures_total", "TFTP transfers aborted because the client never acknowledged the option negotiation (OACK).", "domain")
+	mBytesSent   = metrics.Default.Counter("gopxe_tftp_sent_bytes_total", "File bytes acknowledged by TFTP clients.", "domain")
+)
+
+// instrument starts the server's series at zero
+func (s *Server) instrument() {
+	for _, r := range []string{"complete", "failed", "not_found", "rejected", "busy"} {
+		mTransfers.With(s.Domain, r)
+	}
+	mActive.With(s.Domain)
+	mRetransmits.With(s.Domain)
+	mNegotiation.With(s.Domain)
+	mBytesSent.With(s.Domain)
+}
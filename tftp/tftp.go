@@ -1,6 +1,7 @@
 package tftp
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"log"
@@ -10,6 +11,12 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/ars1364/go-pxe/events"
+	"github.com/ars1364/go-pxe/memory"
+	"github.com/ars1364/go-pxe/qos"
+	"github.com/ars1364/go-pxe/quirks"
+	"github.com/ars1364/go-pxe/transfers"
 )
 
 const (
@@ -26,25 +33,66 @@ const (
 
 type Server struct {
 	root string
+
+	// Events, if set, receives transfer completion and failure events
+	Events *events.Bus
+
+	// Domain labels this server's metrics
+	Domain string
+
+	// Transfers, if set, tracks the progress of transfers in flight
+	Transfers *transfers.Table
+
+	// QoS, if set, caps each client's transfers and bandwidth, shared
+	// with its HTTP downloads
+	QoS *qos.Shaper
+
+	// Files, if set, keeps the files sent in memory for the next transfers
+	// of them, and streams large ones from disk rather than read them
+	// whole; without it every transfer reads its file whole
+	Files *memory.Files
+
+	// Capture, if set, is given every packet received and sent, such as
+	// to record one client's; data is only valid during the call
+	Capture func(src, dst *net.UDPAddr, data []byte)
+
+	// Render, if set, fills in templates for the requesting client, as
+	// over HTTP: a file that only exists as <name>.tmpl is sent rendered,
+	// and the .tmpl files themselves are never sent
+	Render func(name string, text []byte, client net.IP) ([]byte, error)
+
+	// TemplatesNeedToken refuses templates rather than render them, as when
+	// HTTP only renders them for clients presenting a provisioning token,
+	// which TFTP can't carry
+	TemplatesNeedToken bool
+
+	// Generate, if set, is asked for files missing from the root and its
+	// templates, such as boot menus built for the requesting client
+	Generate func(name string, client net.IP) ([]byte, bool)
 }
 
+// TemplateSuffix marks a template in the root
+const TemplateSuffix = ".tmpl"
+
 func NewServer(root string) *Server {
 	return &Server{root: root}
 }
 
 func (s *Server) ListenAndServe(addr string) error {
-	udpAddr, err := net.ResolveUDPAddr("udp4", addr)
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
 	if err != nil {
 		return err
 	}
 
-	conn, err := net.ListenUDP("udp4", udpAddr)
+	conn, err := net.ListenUDP("udp", udpAddr)
 	if err != nil {
 		return fmt.Errorf("TFTP listen: %w", err)
 	}
 	defer conn.Close()
 
 	log.Printf("[TFTP] Listening on %s, root: %s", addr, s.root)
+	s.instrument()
+	s.QoS.Instrument(s.Domain)
 
 	buf := make([]byte, 1500)
 	for {
@@ -60,24 +108,44 @@ func (s *Server) ListenAndServe(addr string) error {
 
 		opcode := binary.BigEndian.Uint16(buf[:2])
 		if opcode == opRRQ {
-			filename, options := parseRRQ(buf[2:n])
+			s.capture(remote, conn.LocalAddr(), buf[:n])
+			filename, options, ok := s.parseRRQ(buf[2:n], remote)
+			if !ok {
+				mTransfers.With(s.Domain, "rejected").Inc()
+				s.sendError(remote, 4, "Malformed request")
+				continue
+			}
 			log.Printf("[TFTP] RRQ: %s from %s (options: %v)", filename, remote, options)
 			go s.handleRead(filename, options, remote)
 		}
 	}
 }
 
-// parseRRQ parses filename, mode, and options from RRQ packet
-func parseRRQ(data []byte) (string, map[string]string) {
+// parseRRQ parses filename, mode, and options from RRQ packet, and
+// reports whether it is well-formed enough to answer
+func (s *Server) parseRRQ(data []byte, remote *net.UDPAddr) (string, map[string]string, bool) {
 	options := make(map[string]string)
 	parts := splitNullTerminated(data)
-
-	if len(parts) < 2 {
-		return "", options
+	if n := len(data); n > 0 && data[n-1] != 0 {
+		if !quirks.Default.Allow(s.Domain, "tftp", quirks.Unterminated, remote.String(), "request without its final NUL") {
+			return "", options, false
+		}
+		parts = append(parts, string(data[bytes.LastIndexByte(data, 0)+1:]))
 	}
 
+	if len(parts) < 1 {
+		return "", options, false
+	}
 	filename := parts[0]
-	// parts[1] is the mode (octet/netascii) - we ignore it
+	// Files are sent as they are, netascii ones included
+	mode := ""
+	if len(parts) > 1 {
+		mode = strings.ToLower(parts[1])
+	}
+	if mode != "octet" && mode != "netascii" &&
+		!quirks.Default.Allow(s.Domain, "tftp", quirks.TransferMode, remote.String(), fmt.Sprintf("mode %q", mode)) {
+		return "", options, false
+	}
 
 	// Parse options (key-value pairs after mode)
 	for i := 2; i+1 < len(parts); i += 2 {
@@ -86,7 +154,7 @@ func parseRRQ(data []byte) (string, map[string]string) {
 		options[key] = value
 	}
 
-	return filename, options
+	return filename, options, true
 }
 
 func splitNullTerminated(data []byte) []string {
@@ -106,35 +174,71 @@ func (s *Server) handleRead(filename string, options map[string]string, remote *
 	clean = strings.TrimPrefix(clean, "/")
 	if strings.Contains(clean, "..") {
 		log.Printf("[TFTP] Rejected path traversal: %s", filename)
+		mTransfers.With(s.Domain, "rejected").Inc()
 		return
 	}
 
 	fullPath := filepath.Join(s.root, clean)
-	data, err := os.ReadFile(fullPath)
+	content, err := s.Files.Open(fullPath)
+	generate := s.Generate != nil
+	if s.Render != nil && strings.HasSuffix(clean, TemplateSuffix) {
+		if err == nil {
+			content.Close()
+		}
+		content, err, generate = nil, os.ErrNotExist, false
+	} else if err != nil && s.Render != nil {
+		if text, terr := os.ReadFile(fullPath + TemplateSuffix); terr == nil {
+			if s.TemplatesNeedToken {
+				log.Printf("[TFTP] Refusing template %s to %s: it needs a token, over HTTP", clean, remote)
+				mTransfers.With(s.Domain, "rejected").Inc()
+				s.sendError(remote, 2, fmt.Sprintf("Access violation: %s is only served over HTTP", filename))
+				return
+			}
+			// A broken template is an error, not a cue to generate
+			generate = false
+			var out []byte
+			if out, err = s.Render(clean, text, remote.IP); err != nil {
+				log.Printf("[TFTP] Render %s for %s: %v", clean, remote.IP, err)
+			}
+			content = memory.Bytes(out)
+		}
+	}
+	if err != nil && generate {
+		if gen, ok := s.Generate(clean, remote.IP); ok {
+			content, err = memory.Bytes(gen), nil
+		}
+	}
 	if err != nil {
 		log.Printf("[TFTP] File not found: %s (%v)", fullPath, err)
-		conn, err2 := net.DialUDP("udp4", nil, remote)
-		if err2 != nil {
-			return
-		}
-		defer conn.Close()
-		errMsg := fmt.Sprintf("File not found: %s", filename)
-		pkt := make([]byte, 5+len(errMsg))
-		binary.BigEndian.PutUint16(pkt[:2], opERR)
-		binary.BigEndian.PutUint16(pkt[2:4], 1)
-		copy(pkt[4:], errMsg)
-		conn.Write(pkt)
+		mTransfers.With(s.Domain, "not_found").Inc()
+		s.sendError(remote, 1, fmt.Sprintf("File not found: %s", filename))
 		return
 	}
+	defer content.Close()
+	size := content.Size()
+	slot, ok := s.QoS.Acquire(s.Domain, "tftp", remote.IP)
+	if !ok {
+		log.Printf("[TFTP] Refusing %s to %s: too many transfers in flight", filename, remote)
+		mTransfers.With(s.Domain, "busy").Inc()
+		s.sendError(remote, 0, "Server busy, too many transfers in flight")
+		return
+	}
+	defer slot.Release()
 
-	log.Printf("[TFTP] Sending %s (%d bytes) to %s", filename, len(data), remote)
+	log.Printf("[TFTP] Sending %s (%d bytes) to %s", filename, size, remote)
+	start := time.Now()
+	mActive.With(s.Domain).Inc()
+	defer mActive.With(s.Domain).Dec()
+	progress := s.Transfers.Start("tftp", remote.IP, filename, size)
+	defer progress.Done()
 
-	conn, err := net.DialUDP("udp4", nil, remote)
+	t, err := s.open(remote)
 	if err != nil {
 		log.Printf("[TFTP] Dial error: %v", err)
+		mTransfers.With(s.Domain, "failed").Inc()
 		return
 	}
-	defer conn.Close()
+	defer t.conn.Close()
 
 	// Determine block size - negotiate if client requested it
 	blkSize := defaultBlockSize
@@ -142,6 +246,11 @@ func (s *Server) handleRead(filename string, options map[string]string, remote *
 
 	if val, ok := options["blksize"]; ok {
 		requested, err := strconv.Atoi(val)
+		if err == nil && (requested < 8 || requested > 65464) && requested > 0 &&
+			!quirks.Default.Allow(s.Domain, "tftp", quirks.BlockSize, remote.String(), "blksize "+val) {
+			// RFC 2348 allows 8 to 65464; the option is ignored
+			requested = 0
+		}
 		if err == nil && requested > 0 {
 			if requested > maxBlockSize {
 				requested = maxBlockSize
@@ -152,83 +261,161 @@ func (s *Server) handleRead(filename string, options map[string]string, remote *
 	}
 
 	if _, ok := options["tsize"]; ok {
-		oackOptions = append(oackOptions, "tsize", strconv.Itoa(len(data)))
+		oackOptions = append(oackOptions, "tsize", strconv.FormatInt(size, 10))
 	}
 
 	// If client requested options, send OACK and wait for ACK 0
 	if len(oackOptions) > 0 {
 		oack := buildOACK(oackOptions)
-		log.Printf("[TFTP] Sending OACK (blksize=%d, tsize=%d) to %s", blkSize, len(data), remote)
-
-		acked := false
-		for retries := 0; retries < 5; retries++ {
-			conn.Write(oack)
-			ackBuf := make([]byte, 4)
-			conn.SetReadDeadline(time.Now().Add(3 * time.Second))
-			n, err := conn.Read(ackBuf)
-			if err != nil {
-				continue
-			}
-			if n >= 4 && binary.BigEndian.Uint16(ackBuf[:2]) == opACK {
-				ackBlock := binary.BigEndian.Uint16(ackBuf[2:4])
-				if ackBlock == 0 {
-					acked = true
-					break
-				}
-			}
-		}
-		if !acked {
+		log.Printf("[TFTP] Sending OACK (blksize=%d, tsize=%d) to %s", blkSize, size, remote)
+
+		if !t.send(oack, 0) {
 			log.Printf("[TFTP] OACK not acknowledged by %s, aborting", remote)
+			mNegotiation.With(s.Domain).Inc()
+			mTransfers.With(s.Domain, "failed").Inc()
 			return
 		}
 	}
 
 	// Send file data
 	block := uint16(1)
-	offset := 0
+	var offset int64
 
 	for {
-		end := offset + blkSize
-		if end > len(data) {
-			end = len(data)
+		chunk, err := content.Chunk(offset, blkSize)
+		if err != nil {
+			log.Printf("[TFTP] Reading %s for %s: %v", filename, remote, err)
+			s.sendError(remote, 0, "Read error")
+			mTransfers.With(s.Domain, "failed").Inc()
+			return
 		}
-		chunk := data[offset:end]
 
 		pkt := make([]byte, 4+len(chunk))
 		binary.BigEndian.PutUint16(pkt[:2], opDATA)
 		binary.BigEndian.PutUint16(pkt[2:4], block)
 		copy(pkt[4:], chunk)
+		slot.Wait(len(chunk))
 
-		acked := false
-		for retries := 0; retries < 5; retries++ {
-			conn.Write(pkt)
-			ackBuf := make([]byte, 4)
-			conn.SetReadDeadline(time.Now().Add(3 * time.Second))
-			n, err := conn.Read(ackBuf)
-			if err != nil {
-				continue
-			}
-			if n >= 4 && binary.BigEndian.Uint16(ackBuf[:2]) == opACK {
-				ackBlock := binary.BigEndian.Uint16(ackBuf[2:4])
-				if ackBlock == block {
-					acked = true
-					break
-				}
-			}
-		}
-
-		if !acked {
+		if !t.send(pkt, block) {
 			log.Printf("[TFTP] Transfer failed at block %d for %s", block, filename)
+			s.Events.Publish(events.Event{Type: events.TFTPFailed, IP: remote.IP, Path: filename, Bytes: offset,
+				Err: fmt.Sprintf("no ACK for block %d", block), Duration: time.Since(start)})
+			mTransfers.With(s.Domain, "failed").Inc()
 			return
 		}
+		mBytesSent.With(s.Domain).Add(float64(len(chunk)))
+		progress.Add(int64(len(chunk)))
 
 		if len(chunk) < blkSize {
 			log.Printf("[TFTP] Transfer complete: %s (%d blocks, blksize=%d)", filename, block, blkSize)
+			s.Events.Publish(events.Event{Type: events.TFTPComplete, IP: remote.IP, Path: filename, Bytes: size,
+				Duration: time.Since(start)})
+			mTransfers.With(s.Domain, "complete").Inc()
 			return
 		}
 
 		block++
-		offset += blkSize
+		offset += int64(blkSize)
+	}
+}
+
+// transfer is the exchange of one RRQ, from a port of the server's own,
+// its transfer ID, with the port the client sent the RRQ from
+type transfer struct {
+	s     *Server
+	conn  *net.UDPConn
+	local *net.UDPAddr
+	peer  *net.UDPAddr
+}
+
+// open opens a transfer with remote, on the address it reaches the server
+// at
+func (s *Server) open(remote *net.UDPAddr) (*transfer, error) {
+	// A connected socket's address is the one the route to remote takes
+	probe, err := net.DialUDP("udp", nil, remote)
+	if err != nil {
+		return nil, err
+	}
+	local := probe.LocalAddr().(*net.UDPAddr)
+	probe.Close()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP, Zone: local.Zone})
+	if err != nil {
+		return nil, err
+	}
+	return &transfer{s: s, conn: conn, local: conn.LocalAddr().(*net.UDPAddr), peer: remote}, nil
+}
+
+// send sends pkt until the client acknowledges block, sending it again
+// after a timeout or any other packet, up to 5 times in all
+func (t *transfer) send(pkt []byte, block uint16) bool {
+	ackBuf := make([]byte, 4)
+	for retries := 0; retries < 5; retries++ {
+		if retries > 0 {
+			mRetransmits.With(t.s.Domain).Inc()
+		}
+		t.conn.WriteToUDP(pkt, t.peer)
+		t.s.capture(t.local, t.peer, pkt)
+		t.conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		n, from, err := t.conn.ReadFromUDP(ackBuf)
+		if err != nil {
+			continue
+		}
+		t.s.capture(from, t.local, ackBuf[:n])
+		if (!from.IP.Equal(t.peer.IP) || from.Port != t.peer.Port) && !t.stray(from) {
+			continue
+		}
+		if n >= 4 && binary.BigEndian.Uint16(ackBuf[:2]) == opACK && binary.BigEndian.Uint16(ackBuf[2:4]) == block {
+			return true
+		}
+	}
+	return false
+}
+
+// stray decides on a packet from another transfer ID than the client's:
+// if from is another port of the client, and that quirk is tolerated, the
+// transfer moves to it; otherwise it is answered with an error, as RFC
+// 1350 says, and the transfer carries on
+func (t *transfer) stray(from *net.UDPAddr) bool {
+	if from.IP.Equal(t.peer.IP) && quirks.Default.Allow(t.s.Domain, "tftp", quirks.WrongTID, t.peer.String(),
+		fmt.Sprintf("answered from port %d", from.Port)) {
+		t.peer = from
+		return true
+	}
+	pkt := errorPacket(5, "Unknown transfer ID")
+	t.conn.WriteToUDP(pkt, from)
+	t.s.capture(t.local, from, pkt)
+	return false
+}
+
+// sendError sends remote an ERROR packet with code and msg
+func (s *Server) sendError(remote *net.UDPAddr, code uint16, msg string) {
+	conn, err := net.DialUDP("udp", nil, remote)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	pkt := errorPacket(code, msg)
+	conn.Write(pkt)
+	s.capture(conn.LocalAddr(), remote, pkt)
+}
+
+func errorPacket(code uint16, msg string) []byte {
+	pkt := make([]byte, 5+len(msg))
+	binary.BigEndian.PutUint16(pkt[:2], opERR)
+	binary.BigEndian.PutUint16(pkt[2:4], code)
+	copy(pkt[4:], msg)
+	return pkt
+}
+
+// capture hands a packet between src and dst to Capture
+func (s *Server) capture(src, dst net.Addr, data []byte) {
+	if s.Capture == nil {
+		return
+	}
+	from, _ := src.(*net.UDPAddr)
+	to, _ := dst.(*net.UDPAddr)
+	if from != nil && to != nil {
+		s.Capture(from, to, data)
 	}
 }
 
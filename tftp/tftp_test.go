@@ -0,0 +1,86 @@
+package tftp
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTemplates(t *testing.T) {
+	root := t.TempDir()
+	for name, text := range map[string]string{
+		"user-data.tmpl": "secret {{.Host}}",
+		"plain.txt":      "plain",
+	} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(text), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		file     string
+		needs    bool   // TemplatesNeedToken
+		data     string // the file sent, if any
+		errCode  uint16 // else the error sent
+		rendered bool
+	}{
+		{"rendered", "user-data", false, "rendered user-data", 0, true},
+		{"refused for a token", "user-data", true, "", 2, false},
+		{"raw template", "user-data.tmpl", false, "", 1, false},
+		{"raw template with tokens", "user-data.tmpl", true, "", 1, false},
+		{"plain file with tokens", "plain.txt", true, "plain", 0, false},
+		{"generated with tokens", "grub.cfg", true, "generated grub.cfg", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rendered := false
+			s := NewServer(root)
+			s.TemplatesNeedToken = tt.needs
+			s.Render = func(name string, text []byte, client net.IP) ([]byte, error) {
+				rendered = true
+				return []byte("rendered " + name), nil
+			}
+			s.Generate = func(name string, client net.IP) ([]byte, bool) {
+				return []byte("generated " + name), name == "grub.cfg"
+			}
+
+			client, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			done := make(chan struct{})
+			go func() {
+				s.handleRead(tt.file, map[string]string{}, client.LocalAddr().(*net.UDPAddr))
+				close(done)
+			}()
+
+			buf := make([]byte, 1024)
+			client.SetReadDeadline(time.Now().Add(5 * time.Second))
+			n, from, err := client.ReadFromUDP(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			op := binary.BigEndian.Uint16(buf[:2])
+			if tt.data != "" {
+				if op != opDATA || string(buf[4:n]) != tt.data {
+					t.Fatalf("got opcode %d %q, want data %q", op, buf[4:n], tt.data)
+				}
+				ack := make([]byte, 4)
+				binary.BigEndian.PutUint16(ack[:2], opACK)
+				copy(ack[2:], buf[2:4])
+				client.WriteToUDP(ack, from)
+			} else if op != opERR || binary.BigEndian.Uint16(buf[2:4]) != tt.errCode {
+				t.Fatalf("got opcode %d %q, want error %d", op, buf[4:n], tt.errCode)
+			}
+			<-done
+			if rendered != tt.rendered {
+				t.Errorf("rendered %v, want %v", rendered, tt.rendered)
+			}
+		})
+	}
+}
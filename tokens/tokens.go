@@ -0,0 +1,71 @@
+// Package tokens issues short-lived provisioning tokens: handed to a
+// client's installer on its kernel command line as it boots, and required
+// for its rendered templates, so a kickstart URL that leaks is useless
+// once the boot window has closed.
+package tokens
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+var (
+	ErrMissing   = errors.New("no token")
+	ErrMalformed = errors.New("malformed token")
+	ErrExpired   = errors.New("token expired")
+	ErrForeign   = errors.New("token not issued to this client")
+)
+
+// Issuer issues tokens and checks them. Tokens carry their expiry and a
+// MAC over it and the client they were issued to, so nothing is stored;
+// they don't outlive the issuer, whose key is only in memory.
+type Issuer struct {
+	key []byte
+	ttl time.Duration
+}
+
+// NewIssuer creates an issuer of tokens valid for ttl, with a random key
+func NewIssuer(ttl time.Duration) *Issuer {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return &Issuer{key: key, ttl: ttl}
+}
+
+// Issue returns a token for client, such as its inventory host name,
+// valid from now for the issuer's TTL
+func (i *Issuer) Issue(client string, now time.Time) string {
+	var buf [8 + 16]byte
+	binary.BigEndian.PutUint64(buf[:8], uint64(now.Add(i.ttl).Unix()))
+	copy(buf[8:], i.sum(buf[:8], client))
+	return base64.RawURLEncoding.EncodeToString(buf[:])
+}
+
+// Verify checks that token was issued to client and is still valid
+func (i *Issuer) Verify(token, client string, now time.Time) error {
+	if token == "" {
+		return ErrMissing
+	}
+	buf, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(buf) != 8+16 {
+		return ErrMalformed
+	}
+	if !hmac.Equal(buf[8:], i.sum(buf[:8], client)) {
+		return ErrForeign
+	}
+	if now.Unix() > int64(binary.BigEndian.Uint64(buf[:8])) {
+		return ErrExpired
+	}
+	return nil
+}
+
+func (i *Issuer) sum(expiry []byte, client string) []byte {
+	m := hmac.New(sha256.New, i.key)
+	m.Write(expiry)
+	m.Write([]byte(client))
+	return m.Sum(nil)[:16]
+}
@@ -0,0 +1,43 @@
+package tokens
+
+import (
+	"encoding/base64"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	i := NewIssuer(time.Hour)
+	token := i.Issue("web01", now)
+	buf, _ := base64.RawURLEncoding.DecodeString(token)
+	buf[7]++ // a later expiry
+	tampered := base64.RawURLEncoding.EncodeToString(buf)
+
+	tests := []struct {
+		name   string
+		issuer *Issuer
+		token  string
+		client string
+		now    time.Time
+		want   error
+	}{
+		{"valid", i, token, "web01", now, nil},
+		{"at expiry", i, token, "web01", now.Add(time.Hour), nil},
+		{"expired", i, token, "web01", now.Add(time.Hour + time.Second), ErrExpired},
+		{"other client", i, token, "web02", now, ErrForeign},
+		{"other issuer", NewIssuer(time.Hour), token, "web01", now, ErrForeign},
+		{"tampered", i, tampered, "web01", now, ErrForeign},
+		{"missing", i, "", "web01", now, ErrMissing},
+		{"not base64", i, "!!!", "web01", now, ErrMalformed},
+		{"truncated", i, token[:len(token)-4], "web01", now, ErrMalformed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.issuer.Verify(tt.token, tt.client, tt.now); !errors.Is(err, tt.want) {
+				t.Errorf("Verify = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ars1364/go-pxe/dhcp"
+	"github.com/ars1364/go-pxe/events"
+	"github.com/ars1364/go-pxe/inventory"
+	"github.com/ars1364/go-pxe/transfers"
+)
+
+// runTop shows a live terminal dashboard of a running server's leases,
+// transfers and events, read from its management API:
+//
+//	go-pxe top [-api http://127.0.0.1:9090] [-domain default]
+func runTop(args []string) {
+	fs := flag.NewFlagSet("top", flag.ExitOnError)
+	apiURL := fs.String("api", "http://127.0.0.1:9090", "Management API of the server to watch")
+	token := fs.String("token", os.Getenv("GOPXE_API_TOKEN"), "API bearer token (default from GOPXE_API_TOKEN)")
+	domain := fs.String("domain", "default", "Provisioning domain to show")
+	interval := fs.Duration("interval", time.Second, "Refresh interval")
+	fs.Parse(args)
+
+	t := &topClient{newAPIClient(*apiURL, *domain, *token, 5*time.Second)}
+
+	// Alternate screen, cursor hidden; both restored on exit
+	fmt.Print("\x1b[?1049h\x1b[?25l")
+	restore := func() { fmt.Print("\x1b[?25h\x1b[?1049l") }
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+
+	tick := time.NewTicker(*interval)
+	defer tick.Stop()
+	for {
+		width, height := termSize()
+		fmt.Print(t.render(*apiURL, *domain, width, height))
+		select {
+		case <-sig:
+			restore()
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+// topClient polls one domain of the management API
+type topClient struct {
+	*apiClient
+}
+
+// render draws one frame, sized to the terminal
+func (t *topClient) render(apiURL, domain string, width, height int) string {
+	var (
+		leases    []dhcp.Lease
+		hosts     []inventory.Host
+		inFlight  []transfers.Transfer
+		recent    []events.Event
+		problems  []string
+		lines     []string
+		leaseRows = max(3, height/3)
+		xferRows  = max(2, height/4)
+	)
+	for _, q := range []struct {
+		path string
+		v    any
+	}{{"/leases", &leases}, {"/hosts", &hosts}, {"/transfers", &inFlight}, {"/events?limit=" + strconv.Itoa(height), &recent}} {
+		if err := t.get(q.path, q.v); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	lines = append(lines, fmt.Sprintf("\x1b[1mgo-pxe top\x1b[0m  domain %s  %s  %s", domain, apiURL, time.Now().Format("15:04:05")))
+	for _, p := range problems {
+		lines = append(lines, "\x1b[31m"+p+"\x1b[0m")
+	}
+
+	names := make(map[string]string)
+	for _, h := range hosts {
+		names[h.MAC] = h.Name
+	}
+	sort.Slice(leases, func(i, j int) bool { return ipLess(leases[i].IP, leases[j].IP) })
+	lines = append(lines, "", fmt.Sprintf("\x1b[1mLEASES (%d)\x1b[0m", len(leases)),
+		fmt.Sprintf("  %-17s  %-15s  %s", "MAC", "IP", "HOST"))
+	for i, l := range leases {
+		if i == leaseRows {
+			lines = append(lines, fmt.Sprintf("  ... %d more", len(leases)-i))
+			break
+		}
+		lines = append(lines, fmt.Sprintf("  %-17s  %-15s  %s", l.MAC, l.IP, names[l.MAC]))
+	}
+
+	pathWidth := max(10, width-76)
+	lines = append(lines, "", fmt.Sprintf("\x1b[1mTRANSFERS (%d)\x1b[0m", len(inFlight)),
+		fmt.Sprintf("  %-4s  %-15s  %-*s  %-31s  %11s", "", "CLIENT", pathWidth, "FILE", "PROGRESS", "RATE"))
+	for i, x := range inFlight {
+		if i == xferRows {
+			lines = append(lines, fmt.Sprintf("  ... %d more", len(inFlight)-i))
+			break
+		}
+		rate := float64(x.Sent) / max(time.Since(x.Start).Seconds(), 0.001)
+		lines = append(lines, fmt.Sprintf("  %-4s  %-15s  %-*s  %s  %9s/s",
+			x.Proto, x.Client, pathWidth, clip(x.Path, pathWidth), progressBar(x.Sent, x.Size, 24), formatBytes(int64(rate))))
+	}
+
+	lines = append(lines, "", "\x1b[1mEVENTS\x1b[0m")
+	for _, e := range recent {
+		if len(lines) >= height-1 {
+			break
+		}
+		lines = append(lines, "  "+formatEvent(e))
+	}
+
+	var b strings.Builder
+	b.WriteString("\x1b[H")
+	for i, l := range lines {
+		if i == height {
+			break
+		}
+		b.WriteString(clip(l, width))
+		b.WriteString("\x1b[K\r\n")
+	}
+	b.WriteString("\x1b[J")
+	return b.String()
+}
+
+// formatEvent renders an event as one dashboard line
+func formatEvent(e events.Event) string {
+	s := fmt.Sprintf("%s  %-13s  %-15s  ", e.Time.Local().Format("15:04:05"), e.Type, e.IP)
+	switch e.Type {
+	case events.DHCPOffer, events.DHCPAck:
+		return s + e.MAC.String()
+	case events.TFTPComplete:
+		return fmt.Sprintf("%s%s  %s in %s", s, e.Path, formatBytes(e.Bytes), e.Duration.Round(time.Millisecond))
+	case events.TFTPFailed:
+		return fmt.Sprintf("%s%s  \x1b[31m%s\x1b[0m", s, e.Path, e.Err)
+	case events.HTTPRequest:
+		status := strconv.Itoa(e.Status)
+		if e.Status >= 400 {
+			status = "\x1b[31m" + status + "\x1b[0m"
+		}
+		return fmt.Sprintf("%s%s  %s  %s", s, e.Path, status, formatBytes(e.Bytes))
+	}
+	return s + e.Path
+}
+
+// progressBar draws sent/size as a bar of width cells and a percentage,
+// or just the bytes sent when the size is unknown
+func progressBar(sent, size int64, width int) string {
+	if size <= 0 {
+		return fmt.Sprintf("%-*s", width+7, formatBytes(sent))
+	}
+	filled := int(float64(width) * float64(sent) / float64(size))
+	filled = min(max(filled, 0), width)
+	return fmt.Sprintf("[%s%s] %3d%%", strings.Repeat("#", filled), strings.Repeat(".", width-filled), sent*100/size)
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// clip cuts s to n visible bytes, not counting ANSI escape sequences
+func clip(s string, n int) string {
+	visible := 0
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\x1b' {
+			for i < len(s) && s[i] != 'm' {
+				i++
+			}
+			continue
+		}
+		if visible == n {
+			return s[:i] + "\x1b[0m"
+		}
+		visible++
+	}
+	return s
+}
+
+func ipLess(a, b string) bool {
+	pa, pb := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(pa) && i < len(pb); i++ {
+		x, _ := strconv.Atoi(pa[i])
+		y, _ := strconv.Atoi(pb[i])
+		if x != y {
+			return x < y
+		}
+	}
+	return len(pa) < len(pb)
+}
+
+// termSize returns the terminal's columns and rows, falling back to
+// $COLUMNS/$LINES and then 80x24
+func termSize() (width, height int) {
+	width, height = 80, 24
+	if v, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil {
+		width = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("LINES")); err == nil {
+		height = v
+	}
+	cmd := exec.Command("stty", "size")
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	if err != nil {
+		return width, height
+	}
+	if f := strings.Fields(string(out)); len(f) == 2 {
+		h, err1 := strconv.Atoi(f[0])
+		w, err2 := strconv.Atoi(f[1])
+		if err1 == nil && err2 == nil && w > 0 && h > 0 {
+			return w, h
+		}
+	}
+	return width, height
+}
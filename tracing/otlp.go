@@ -0,0 +1,107 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// exporter posts spans to a collector using OTLP/HTTP with JSON encoding
+type exporter struct {
+	endpoint string
+	headers  map[string]string
+}
+
+var client = &http.Client{Timeout: 10 * time.Second}
+
+func (x *exporter) export(spans []span) error {
+	out := make([]map[string]any, 0, len(spans))
+	for _, s := range spans {
+		js := map[string]any{
+			"traceId":           hex.EncodeToString(s.traceID[:]),
+			"spanId":            hex.EncodeToString(s.id[:]),
+			"name":              s.name,
+			"kind":              s.kind,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        attributes(s.attrs),
+		}
+		if s.parent != [8]byte{} {
+			js["parentSpanId"] = hex.EncodeToString(s.parent[:])
+		}
+		if s.err != "" {
+			js["status"] = map[string]any{"code": 2, "message": s.err}
+		}
+		out = append(out, js)
+	}
+	body, err := json.Marshal(map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{"attributes": attributes(map[string]any{"service.name": "go-pxe"})},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": "github.com/ars1364/go-pxe/tracing"},
+				"spans": out,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", strings.TrimSuffix(x.endpoint, "/")+"/v1/traces", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range x.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// attributes encodes a map as OTLP KeyValues, sorted by key
+func attributes(m map[string]any) []any {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	list := make([]any, 0, len(m))
+	for _, k := range keys {
+		var v map[string]any
+		switch x := m[k].(type) {
+		case int64:
+			v = map[string]any{"intValue": strconv.FormatInt(x, 10)}
+		default:
+			v = map[string]any{"stringValue": fmt.Sprint(x)}
+		}
+		list = append(list, map[string]any{"key": k, "value": v})
+	}
+	return list
+}
+
+// ParseHeaders reads the OTEL_EXPORTER_OTLP_HEADERS format: k1=v1,k2=v2
+func ParseHeaders(s string) map[string]string {
+	h := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			h[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+	}
+	return h
+}
@@ -0,0 +1,224 @@
+// Package tracing turns boot events into OpenTelemetry traces: one trace per
+// client boot, with a span for the DHCP exchange and for every TFTP transfer
+// and HTTP request, exported to an OTLP/HTTP collector.
+package tracing
+
+import (
+	"crypto/rand"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ars1364/go-pxe/events"
+)
+
+// Spans buffered while the collector is unreachable; older ones are dropped
+const maxPending = 10000
+
+// Tracer groups events by client into boot traces
+type Tracer struct {
+	exp *exporter
+
+	// Idle ends a boot trace after this long without activity from the
+	// client. The next DHCP exchange starts a new one.
+	Idle time.Duration
+
+	mu      sync.Mutex
+	boots   map[string]*boot  // by domain and MAC
+	clients map[string]string // domain and IP to boot key
+	pending []span
+}
+
+// boot is an open trace
+type boot struct {
+	traceID     [16]byte
+	root        [8]byte
+	mac         net.HardwareAddr
+	ip          net.IP
+	domain      string
+	revision    string
+	start, last time.Time
+	offered     time.Time // pending DHCP exchange, zero if none
+	failed      bool
+}
+
+type span struct {
+	traceID    [16]byte
+	id, parent [8]byte
+	name       string
+	kind       int
+	start, end time.Time
+	attrs      map[string]any
+	err        string
+}
+
+// Span kinds (OTLP)
+const (
+	kindInternal = 1
+	kindServer   = 2
+)
+
+// NewTracer exports to the OTLP/HTTP collector at endpoint (e.g.
+// http://localhost:4318), sending headers with every request
+func NewTracer(endpoint string, headers map[string]string) *Tracer {
+	return &Tracer{
+		exp:     &exporter{endpoint: endpoint, headers: headers},
+		Idle:    10 * time.Minute,
+		boots:   make(map[string]*boot),
+		clients: make(map[string]string),
+	}
+}
+
+// Follow traces every event published on bus and exports in the background
+func (t *Tracer) Follow(bus *events.Bus) {
+	ch, _ := bus.Subscribe(1024)
+	go func() {
+		for e := range ch {
+			t.Record(e)
+		}
+	}()
+	go func() {
+		for range time.Tick(5 * time.Second) {
+			t.expire(time.Now())
+			t.Flush()
+		}
+	}()
+}
+
+// Record adds e to its client's boot trace
+func (t *Tracer) Record(e events.Event) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch e.Type {
+	case events.DHCPOffer, events.DHCPAck:
+		key := e.Domain + "|" + e.MAC.String()
+		b := t.boots[key]
+		if b == nil {
+			b = &boot{traceID: newTraceID(), root: newSpanID(), mac: e.MAC, domain: e.Domain, start: e.Time}
+			t.boots[key] = b
+		}
+		b.ip, b.last, b.revision = e.IP, e.Time, e.Revision
+		t.clients[e.Domain+"|"+e.IP.String()] = key
+		if e.Type == events.DHCPOffer {
+			if b.offered.IsZero() {
+				b.offered = e.Time
+			}
+			return
+		}
+		start := b.offered
+		if start.IsZero() {
+			start = e.Time // renewal without a DISCOVER
+		}
+		b.offered = time.Time{}
+		t.add(b, "dhcp", kindServer, start, e.Time, map[string]any{"client.address": e.IP.String()}, "")
+
+	case events.TFTPComplete, events.TFTPFailed:
+		b := t.client(e)
+		if b == nil {
+			return
+		}
+		attrs := map[string]any{"tftp.file": e.Path, "tftp.bytes": e.Bytes}
+		t.add(b, "tftp "+e.Path, kindServer, e.Time.Add(-e.Duration), e.Time, attrs, e.Err)
+
+	case events.HTTPRequest:
+		b := t.client(e)
+		if b == nil {
+			return
+		}
+		attrs := map[string]any{"url.path": e.Path, "http.response.status_code": int64(e.Status), "http.response.body.size": e.Bytes}
+		var err string
+		if e.Status >= 400 {
+			err = "HTTP " + strconv.Itoa(e.Status)
+		}
+		t.add(b, "http "+e.Path, kindServer, e.Time.Add(-e.Duration), e.Time, attrs, err)
+	}
+}
+
+// client returns the open boot of the client at e.IP, if any
+func (t *Tracer) client(e events.Event) *boot {
+	b := t.boots[t.clients[e.Domain+"|"+e.IP.String()]]
+	if b != nil {
+		b.last = e.Time
+	}
+	return b
+}
+
+func (t *Tracer) add(b *boot, name string, kind int, start, end time.Time, attrs map[string]any, err string) {
+	if err != "" {
+		b.failed = true
+	}
+	t.queue(span{traceID: b.traceID, id: newSpanID(), parent: b.root, name: name, kind: kind,
+		start: start, end: end, attrs: attrs, err: err})
+}
+
+func (t *Tracer) queue(s span) {
+	t.pending = append(t.pending, s)
+	if len(t.pending) > maxPending {
+		t.pending = t.pending[len(t.pending)-maxPending:]
+	}
+}
+
+// expire ends the root span of every boot idle since before now-Idle
+func (t *Tracer) expire(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for key, b := range t.boots {
+		if now.Sub(b.last) >= t.Idle {
+			t.end(key, b)
+		}
+	}
+}
+
+func (t *Tracer) end(key string, b *boot) {
+	attrs := map[string]any{"client.mac": b.mac.String(), "client.address": b.ip.String(), "gopxe.domain": b.domain}
+	if b.revision != "" {
+		attrs["gopxe.revision"] = b.revision
+	}
+	var err string
+	if b.failed {
+		err = "a transfer or request failed"
+	}
+	t.queue(span{traceID: b.traceID, id: b.root, name: "boot " + b.mac.String(), kind: kindInternal,
+		start: b.start, end: b.last, attrs: attrs, err: err})
+	delete(t.boots, key)
+	if t.clients[b.domain+"|"+b.ip.String()] == key {
+		delete(t.clients, b.domain+"|"+b.ip.String())
+	}
+}
+
+// Flush exports every finished span
+func (t *Tracer) Flush() {
+	t.mu.Lock()
+	batch := t.pending
+	t.pending = nil
+	t.mu.Unlock()
+	if len(batch) == 0 {
+		return
+	}
+	if err := t.exp.export(batch); err != nil {
+		log.Printf("[TRACE] Dropped %d spans: %v", len(batch), err)
+	}
+}
+
+// Close ends every open boot trace and exports what is left
+func (t *Tracer) Close() {
+	t.mu.Lock()
+	for key, b := range t.boots {
+		t.end(key, b)
+	}
+	t.mu.Unlock()
+	t.Flush()
+}
+
+func newTraceID() (id [16]byte) {
+	rand.Read(id[:])
+	return id
+}
+
+func newSpanID() (id [8]byte) {
+	rand.Read(id[:])
+	return id
+}
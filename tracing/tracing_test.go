@@ -0,0 +1,188 @@
+package tracing
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ars1364/go-pxe/events"
+)
+
+type otlpSpan struct {
+	TraceID      string `json:"traceId"`
+	SpanID       string `json:"spanId"`
+	ParentSpanID string `json:"parentSpanId"`
+	Name         string `json:"name"`
+	Kind         int    `json:"kind"`
+	Start        string `json:"startTimeUnixNano"`
+	End          string `json:"endTimeUnixNano"`
+	Attributes   []struct {
+		Key   string         `json:"key"`
+		Value map[string]any `json:"value"`
+	} `json:"attributes"`
+	Status *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"status"`
+}
+
+func (s otlpSpan) attr(key string) any {
+	for _, a := range s.Attributes {
+		if a.Key == key {
+			for _, v := range a.Value {
+				return v
+			}
+		}
+	}
+	return nil
+}
+
+// collector is a fake OTLP/HTTP collector
+type collector struct {
+	*httptest.Server
+	mu      sync.Mutex
+	spans   []otlpSpan
+	headers http.Header
+	status  int
+}
+
+func newCollector(t *testing.T) *collector {
+	c := &collector{status: http.StatusOK}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("%s %s", r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		var body struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []otlpSpan `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.headers = r.Header
+		for _, rs := range body.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				c.spans = append(c.spans, ss.Spans...)
+			}
+		}
+		w.WriteHeader(c.status)
+	}))
+	t.Cleanup(c.Close)
+	return c
+}
+
+func TestTrace(t *testing.T) {
+	c := newCollector(t)
+	tr := NewTracer(c.URL+"/", map[string]string{"Authorization": "Bearer x"})
+	mac, _ := net.ParseMAC("aa:bb:cc:dd:ee:01")
+	ip := net.IPv4(10, 0, 0, 5)
+	at := time.Now().Add(-time.Hour)
+
+	tr.Record(events.Event{Type: events.DHCPOffer, Time: at, MAC: mac, IP: ip, Domain: "lab"})
+	tr.Record(events.Event{Type: events.DHCPAck, Time: at.Add(time.Second), MAC: mac, IP: ip, Domain: "lab", Revision: "abc123"})
+	tr.Record(events.Event{Type: events.TFTPComplete, Time: at.Add(3 * time.Second), IP: ip, Domain: "lab",
+		Path: "pxelinux.0", Bytes: 42, Duration: time.Second})
+	tr.Record(events.Event{Type: events.HTTPRequest, Time: at.Add(4 * time.Second), IP: ip, Domain: "lab",
+		Path: "/initrd.img", Status: 404})
+	// Another domain's client at the same address has no trace
+	tr.Record(events.Event{Type: events.TFTPComplete, Time: at, IP: ip, Domain: "other", Path: "x"})
+
+	tr.expire(at.Add(time.Minute)) // not idle long enough
+	tr.Flush()
+	if len(c.spans) != 3 {
+		t.Fatalf("exported %d spans before the boot ended, want 3", len(c.spans))
+	}
+	tr.expire(time.Now())
+	tr.Flush()
+
+	if c.headers.Get("Authorization") != "Bearer x" {
+		t.Errorf("headers = %v", c.headers)
+	}
+	if len(c.spans) != 4 {
+		t.Fatalf("exported %d spans", len(c.spans))
+	}
+	dhcp, tftp, web, root := c.spans[0], c.spans[1], c.spans[2], c.spans[3]
+	for _, s := range []otlpSpan{dhcp, tftp, web} {
+		if s.TraceID != root.TraceID || s.ParentSpanID != root.SpanID || s.Kind != kindServer {
+			t.Errorf("span %s: trace %s parent %s kind %d; root %s %s", s.Name, s.TraceID, s.ParentSpanID, s.Kind, root.TraceID, root.SpanID)
+		}
+	}
+	if len(root.TraceID) != 32 || len(root.SpanID) != 16 || root.ParentSpanID != "" {
+		t.Errorf("root = %+v", root)
+	}
+	if dhcp.Name != "dhcp" || dhcp.Start != ns(at) || dhcp.End != ns(at.Add(time.Second)) {
+		t.Errorf("dhcp = %+v", dhcp)
+	}
+	if tftp.Name != "tftp pxelinux.0" || tftp.Start != ns(at.Add(2*time.Second)) || tftp.attr("tftp.bytes") != "42" || tftp.Status != nil {
+		t.Errorf("tftp = %+v", tftp)
+	}
+	if web.attr("http.response.status_code") != "404" || web.Status == nil || web.Status.Code != 2 {
+		t.Errorf("http = %+v", web)
+	}
+	if root.Name != "boot aa:bb:cc:dd:ee:01" || root.attr("gopxe.revision") != "abc123" || root.attr("gopxe.domain") != "lab" ||
+		root.Status == nil || root.Start != ns(at) || root.End != ns(at.Add(4*time.Second)) {
+		t.Errorf("root = %+v", root)
+	}
+	if len(tr.boots) != 0 || len(tr.clients) != 0 {
+		t.Errorf("boots %v, clients %v left open", tr.boots, tr.clients)
+	}
+}
+
+func ns(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func TestClose(t *testing.T) {
+	c := newCollector(t)
+	tr := NewTracer(c.URL, nil)
+	mac, _ := net.ParseMAC("aa:bb:cc:dd:ee:01")
+	// A renewal without an offer is a zero-length exchange
+	tr.Record(events.Event{Type: events.DHCPAck, Time: time.Now(), MAC: mac, IP: net.IPv4(10, 0, 0, 5)})
+	tr.Close()
+	if len(c.spans) != 2 || c.spans[0].Start != c.spans[0].End || c.spans[1].Status != nil {
+		t.Errorf("spans = %+v", c.spans)
+	}
+}
+
+func TestExportFailure(t *testing.T) {
+	c := newCollector(t)
+	c.status = http.StatusBadRequest
+	x := &exporter{endpoint: c.URL}
+	if err := x.export([]span{{name: "x"}}); err == nil {
+		t.Error("rejected export reported success")
+	}
+	x.endpoint = "http://127.0.0.1:0"
+	if err := x.export(nil); err == nil {
+		t.Error("unreachable collector reported success")
+	}
+}
+
+func TestPendingCap(t *testing.T) {
+	tr := NewTracer("http://127.0.0.1:0", nil)
+	for range maxPending + 10 {
+		tr.queue(span{name: "x"})
+	}
+	if len(tr.pending) != maxPending {
+		t.Errorf("%d spans pending", len(tr.pending))
+	}
+}
+
+func TestParseHeaders(t *testing.T) {
+	h := ParseHeaders(" api-key = secret ,x=a=b,,novalue")
+	if len(h) != 2 || h["api-key"] != "secret" || h["x"] != "a=b" {
+		t.Errorf("ParseHeaders = %v", h)
+	}
+	if h := ParseHeaders(""); len(h) != 0 {
+		t.Errorf("ParseHeaders(\"\") = %v", h)
+	}
+}
@@ -0,0 +1,96 @@
+// Package transfers tracks the TFTP and HTTP downloads in flight, so their
+// progress can be watched while a kernel or image is still on the wire.
+package transfers
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Transfer is a snapshot of one download in flight
+type Transfer struct {
+	Proto  string    `json:"proto"` // "tftp" or "http"
+	Client string    `json:"client"`
+	Path   string    `json:"path"`
+	Size   int64     `json:"size"` // -1 if unknown
+	Sent   int64     `json:"sent"`
+	Start  time.Time `json:"start"`
+}
+
+// Table holds the transfers in flight. A nil *Table tracks nothing, so
+// servers can report progress unconditionally.
+type Table struct {
+	mu     sync.Mutex
+	active map[*Progress]struct{}
+}
+
+func NewTable() *Table {
+	return &Table{active: make(map[*Progress]struct{})}
+}
+
+// Progress reports on one transfer. A nil *Progress ignores everything.
+type Progress struct {
+	t     *Table
+	proto string
+	ip    string
+	path  string
+	start time.Time
+	size  atomic.Int64
+	sent  atomic.Int64
+}
+
+// Start registers a transfer of path to ip; size is -1 if not yet known
+func (t *Table) Start(proto string, ip net.IP, path string, size int64) *Progress {
+	if t == nil {
+		return nil
+	}
+	p := &Progress{t: t, proto: proto, ip: ip.String(), path: path, start: time.Now()}
+	p.size.Store(size)
+	t.mu.Lock()
+	t.active[p] = struct{}{}
+	t.mu.Unlock()
+	return p
+}
+
+// SetSize records the transfer's total size once it is known
+func (p *Progress) SetSize(n int64) {
+	if p != nil {
+		p.size.Store(n)
+	}
+}
+
+// Add counts n more bytes sent
+func (p *Progress) Add(n int64) {
+	if p != nil {
+		p.sent.Add(n)
+	}
+}
+
+// Done removes the transfer from its table
+func (p *Progress) Done() {
+	if p == nil {
+		return
+	}
+	p.t.mu.Lock()
+	delete(p.t.active, p)
+	p.t.mu.Unlock()
+}
+
+// List returns the transfers in flight, oldest first
+func (t *Table) List() []Transfer {
+	list := []Transfer{}
+	if t == nil {
+		return list
+	}
+	t.mu.Lock()
+	for p := range t.active {
+		list = append(list, Transfer{Proto: p.proto, Client: p.ip, Path: p.path, Size: p.size.Load(),
+			Sent: p.sent.Load(), Start: p.start})
+	}
+	t.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Start.Before(list[j].Start) })
+	return list
+}
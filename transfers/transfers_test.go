@@ -0,0 +1,44 @@
+package transfers
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTable(t *testing.T) {
+	var none *Table
+	p := none.Start("tftp", net.IPv4(10, 0, 0, 5), "pxelinux.0", 100)
+	p.SetSize(5)
+	p.Add(5)
+	p.Done()
+	if list := none.List(); list == nil || len(list) != 0 {
+		t.Errorf("nil table lists %v", list)
+	}
+
+	tab := NewTable()
+	kernel := tab.Start("tftp", net.IPv4(10, 0, 0, 5), "vmlinuz", -1)
+	time.Sleep(time.Millisecond)
+	initrd := tab.Start("http", net.IPv4(10, 0, 0, 6), "/initrd.img", 1000)
+	kernel.SetSize(500)
+	kernel.Add(100)
+	kernel.Add(50)
+	initrd.Add(1000)
+
+	list := tab.List()
+	if len(list) != 2 {
+		t.Fatalf("List = %+v", list)
+	}
+	if k := list[0]; k.Proto != "tftp" || k.Client != "10.0.0.5" || k.Path != "vmlinuz" || k.Size != 500 || k.Sent != 150 {
+		t.Errorf("kernel = %+v", k)
+	}
+	if i := list[1]; i.Proto != "http" || i.Size != 1000 || i.Sent != 1000 || !i.Start.After(list[0].Start) {
+		t.Errorf("initrd = %+v", i)
+	}
+
+	kernel.Done()
+	kernel.Done()
+	if list := tab.List(); len(list) != 1 || list[0].Path != "/initrd.img" {
+		t.Errorf("after Done = %+v", list)
+	}
+}
@@ -0,0 +1,188 @@
+// Package vault reads secrets from HashiCorp Vault for templates, logging
+// in with a token or AppRole.
+package vault
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Client reads secrets from one Vault server. Set either Token or RoleID
+// and SecretID.
+type Client struct {
+	Addr      string
+	Token     string
+	RoleID    string
+	SecretID  string
+	Mount     string // AppRole auth mount, "approle" by default
+	Namespace string // Vault Enterprise namespace, if any
+
+	// CacheTTL is how long a secret read is reused, so a rack booting at
+	// once doesn't read the same secret a hundred times
+	CacheTTL time.Duration
+
+	http *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time // of an AppRole token; zero for a static one
+	cache   map[string]cached
+}
+
+type cached struct {
+	data    map[string]any
+	expires time.Time
+}
+
+// New creates a client for the Vault server at addr
+func New(addr string) *Client {
+	return &Client{
+		Addr:     strings.TrimSuffix(addr, "/"),
+		Mount:    "approle",
+		CacheTTL: time.Minute,
+		http:     &http.Client{Timeout: 10 * time.Second},
+		cache:    make(map[string]cached),
+	}
+}
+
+// Secret returns field key of the secret at path, e.g. path
+// "secret/data/pxe/root" (KV v2) or "secret/pxe/root" (KV v1)
+func (c *Client) Secret(path, key string) (string, error) {
+	data, err := c.Read(path)
+	if err != nil {
+		return "", err
+	}
+	v, ok := data[key]
+	if !ok {
+		return "", fmt.Errorf("vault: %s has no field %q", path, key)
+	}
+	if s, ok := v.(string); ok {
+		return s, nil
+	}
+	return fmt.Sprint(v), nil
+}
+
+// Read returns the fields of the secret at path, unwrapping KV v2
+// responses
+func (c *Client) Read(path string) (map[string]any, error) {
+	path = strings.Trim(path, "/")
+	c.mu.Lock()
+	if e, ok := c.cache[path]; ok && time.Now().Before(e.expires) {
+		c.mu.Unlock()
+		return e.data, nil
+	}
+	c.mu.Unlock()
+
+	var resp struct {
+		Data map[string]any `json:"data"`
+	}
+	if err := c.do("GET", "/v1/"+path, nil, &resp); err != nil {
+		return nil, fmt.Errorf("vault: read %s: %w", path, err)
+	}
+	data := resp.Data
+	if inner, ok := data["data"].(map[string]any); ok {
+		if _, v2 := data["metadata"]; v2 {
+			data = inner
+		}
+	}
+
+	c.mu.Lock()
+	c.cache[path] = cached{data: data, expires: time.Now().Add(c.CacheTTL)}
+	c.mu.Unlock()
+	return data, nil
+}
+
+// do sends an authenticated request, logging in again once if an AppRole
+// token was rejected
+func (c *Client) do(method, path string, body, out any) error {
+	token, err := c.authToken()
+	if err != nil {
+		return err
+	}
+	status, err := c.send(method, path, token, body, out)
+	if status == http.StatusForbidden && c.RoleID != "" {
+		c.mu.Lock()
+		c.token = ""
+		c.mu.Unlock()
+		if token, err = c.authToken(); err != nil {
+			return err
+		}
+		_, err = c.send(method, path, token, body, out)
+	}
+	return err
+}
+
+// authToken returns a valid token, logging in with AppRole when there is
+// none or it is about to expire
+func (c *Client) authToken() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.RoleID == "" {
+		if c.Token == "" {
+			return "", fmt.Errorf("no token or AppRole configured")
+		}
+		return c.Token, nil
+	}
+	if c.token != "" && (c.expires.IsZero() || time.Until(c.expires) > 30*time.Second) {
+		return c.token, nil
+	}
+	var resp struct {
+		Auth struct {
+			ClientToken   string `json:"client_token"`
+			LeaseDuration int    `json:"lease_duration"`
+		} `json:"auth"`
+	}
+	login := map[string]string{"role_id": c.RoleID, "secret_id": c.SecretID}
+	if _, err := c.send("POST", "/v1/auth/"+c.Mount+"/login", "", login, &resp); err != nil {
+		return "", fmt.Errorf("AppRole login: %w", err)
+	}
+	c.token = resp.Auth.ClientToken
+	c.expires = time.Time{}
+	if resp.Auth.LeaseDuration > 0 {
+		c.expires = time.Now().Add(time.Duration(resp.Auth.LeaseDuration) * time.Second)
+	}
+	return c.token, nil
+}
+
+func (c *Client) send(method, path, token string, body, out any) (int, error) {
+	var rd io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		rd = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, c.Addr+path, rd)
+	if err != nil {
+		return 0, err
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if c.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", c.Namespace)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		var e struct {
+			Errors []string `json:"errors"`
+		}
+		json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&e)
+		if len(e.Errors) > 0 {
+			return resp.StatusCode, fmt.Errorf("%s: %s", resp.Status, strings.Join(e.Errors, "; "))
+		}
+		return resp.StatusCode, fmt.Errorf("%s", resp.Status)
+	}
+	return resp.StatusCode, json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,175 @@
+package vault
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeVault serves secrets to requests bearing a token it issued, or the
+// root token
+type fakeVault struct {
+	*httptest.Server
+	mu        sync.Mutex
+	secrets   map[string]string // JSON responses by path
+	tokens    map[string]bool
+	reads     int
+	logins    int
+	lease     int
+	revoked   bool // reject issued tokens until the next login
+	namespace string
+}
+
+func newFakeVault(t *testing.T) *fakeVault {
+	v := &fakeVault{
+		secrets: map[string]string{
+			"/v1/secret/data/pxe/root": `{"data": {"data": {"password": "hunter2", "uid": 0}, "metadata": {"version": 3}}}`,
+			"/v1/kv/pxe/root":          `{"data": {"password": "v1", "data": {"nested": true}}}`,
+			"/v1/kv/broken":            `{"data": `,
+		},
+		tokens: map[string]bool{"root": true},
+		lease:  3600,
+	}
+	v.Server = httptest.NewServer(http.HandlerFunc(v.serve))
+	t.Cleanup(v.Close)
+	return v
+}
+
+func (v *fakeVault) serve(w http.ResponseWriter, r *http.Request) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.namespace = r.Header.Get("X-Vault-Namespace")
+	if r.Method == "POST" && r.URL.Path == "/v1/auth/approle/login" {
+		var login map[string]string
+		json.NewDecoder(r.Body).Decode(&login)
+		if login["role_id"] != "role" || login["secret_id"] != "secret" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"errors": ["invalid role or secret ID"]}`))
+			return
+		}
+		v.logins++
+		v.revoked = false
+		token := "s." + string(rune('a'+v.logins))
+		v.tokens[token] = true
+		json.NewEncoder(w).Encode(map[string]any{"auth": map[string]any{"client_token": token, "lease_duration": v.lease}})
+		return
+	}
+	token := r.Header.Get("X-Vault-Token")
+	if !v.tokens[token] || (v.revoked && token != "root") {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"errors": ["permission denied"]}`))
+		return
+	}
+	data, ok := v.secrets[r.URL.Path]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"errors": []}`))
+		return
+	}
+	v.reads++
+	w.Write([]byte(data))
+}
+
+func TestSecret(t *testing.T) {
+	v := newFakeVault(t)
+	c := New(v.URL + "/")
+	c.Token = "root"
+	c.Namespace = "ops"
+
+	tests := []struct {
+		path, key, want string
+	}{
+		{"secret/data/pxe/root", "password", "hunter2"},
+		{"/secret/data/pxe/root/", "uid", "0"},
+		{"kv/pxe/root", "password", "v1"},
+		{"kv/pxe/root", "data", "map[nested:true]"}, // KV v1 field named data
+	}
+	for _, tt := range tests {
+		got, err := c.Secret(tt.path, tt.key)
+		if err != nil || got != tt.want {
+			t.Errorf("Secret(%s, %s) = %q, %v; want %q", tt.path, tt.key, got, err, tt.want)
+		}
+	}
+	if v.reads != 2 {
+		t.Errorf("read %d times, want once per path", v.reads)
+	}
+	if v.namespace != "ops" {
+		t.Errorf("namespace = %q", v.namespace)
+	}
+
+	for _, tt := range []struct{ path, key, err string }{
+		{"secret/data/pxe/root", "missing", `has no field "missing"`},
+		{"secret/data/pxe/other", "password", "404 Not Found"},
+		{"kv/broken", "password", "vault: read kv/broken"},
+	} {
+		if _, err := c.Secret(tt.path, tt.key); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("Secret(%s, %s) error = %v, want %q", tt.path, tt.key, err, tt.err)
+		}
+	}
+
+	c.Token = "wrong"
+	c.cache = make(map[string]cached)
+	if _, err := c.Secret("kv/pxe/root", "password"); err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Errorf("bad token: %v", err)
+	}
+	c.Token = ""
+	if _, err := c.Secret("kv/pxe/root", "password"); err == nil {
+		t.Error("read without credentials")
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	v := newFakeVault(t)
+	c := New(v.URL)
+	c.Token = "root"
+	c.CacheTTL = 0
+	c.Secret("kv/pxe/root", "password")
+	c.Secret("kv/pxe/root", "password")
+	if v.reads != 2 {
+		t.Errorf("read %d times without a cache", v.reads)
+	}
+}
+
+func TestAppRole(t *testing.T) {
+	v := newFakeVault(t)
+	c := New(v.URL)
+	c.RoleID, c.SecretID = "role", "secret"
+	c.CacheTTL = 0
+
+	for range 3 {
+		if got, err := c.Secret("kv/pxe/root", "password"); err != nil || got != "v1" {
+			t.Fatalf("Secret = %q, %v", got, err)
+		}
+	}
+	if v.logins != 1 {
+		t.Errorf("logged in %d times", v.logins)
+	}
+
+	// A revoked token is replaced once
+	v.revoked = true
+	if _, err := c.Secret("kv/pxe/root", "password"); err != nil || v.logins != 2 {
+		t.Errorf("after revocation: %v, %d logins", err, v.logins)
+	}
+
+	// A token about to expire is renewed before use
+	v.lease = 10
+	c.token = ""
+	c.Secret("kv/pxe/root", "password")
+	c.Secret("kv/pxe/root", "password")
+	if v.logins != 4 {
+		t.Errorf("%d logins with a short lease", v.logins)
+	}
+	if time.Until(c.expires) > 10*time.Second {
+		t.Errorf("token expires %s", c.expires)
+	}
+
+	c.SecretID = "wrong"
+	c.token = ""
+	if _, err := c.Secret("kv/pxe/root", "password"); err == nil || !strings.Contains(err.Error(), "AppRole login: 400 Bad Request: invalid role or secret ID") {
+		t.Errorf("bad secret ID: %v", err)
+	}
+}
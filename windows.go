@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/ars1364/go-pxe/httpserver"
+	"github.com/ars1364/go-pxe/inventory"
+)
+
+// winpeFiles are added to a Windows profile's initrds; wimboot places them
+// in WinPE's System32, where winpeshl.ini has WinPE run install.cmd
+var winpeFiles = []string{"windows/winpeshl.ini", "windows/install.cmd"}
+
+// generateWindows backs the files under windows/ for the WinPE client at ip
+func (d *domain) generateWindows(name string, ip net.IP) ([]byte, bool) {
+	who, p := d.profileAt(ip)
+	w := p.WinPE
+	if w == nil {
+		return nil, false
+	}
+	var data []byte
+	var err error
+	switch name {
+	case "windows/winpeshl.ini":
+		return []byte("[LaunchApps]\r\n\"install.cmd\"\r\n"), true
+	case "windows/install.cmd":
+		data = installCmd(who, p)
+	case "windows/unattend.xml":
+		if w.Unattend == "" {
+			return nil, false
+		}
+		data, err = d.rootFile(w.Unattend, ip)
+	case "windows/postinstall.ps1":
+		data, err = d.postInstall(who, p, ip)
+	default:
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("[HTTP] %s: %s for %s: %v", d.cfg.Name, name, who, err)
+		return nil, false
+	}
+	return data, true
+}
+
+// installCmd is the script WinPE runs: it waits for the network, mounts
+// the installation media and runs Setup with the host's answer file
+func installCmd(who string, p inventory.Profile) []byte {
+	lines := []string{
+		"@echo off",
+		fmt.Sprintf("rem %s, profile %s (generated by go-pxe)", who, p.Name),
+		"wpeinit",
+		"set tries=0",
+		":mount",
+		"net use I: " + p.WinPE.Source + " && goto setup",
+		"set /a tries+=1",
+		"if %tries% lss 12 (ping -n 6 127.0.0.1 >nul & goto mount)",
+		"echo Cannot mount " + p.WinPE.Source,
+		"exit /b 1",
+		":setup",
+	}
+	if p.WinPE.Unattend != "" {
+		lines = append(lines, `I:\setup.exe /unattend:X:\Windows\System32\unattend.xml`)
+	} else {
+		lines = append(lines, `I:\setup.exe`)
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+// postInstall is the hook the answer file runs in the installed system: the
+// profile's script, then the completion callback
+func (d *domain) postInstall(who string, p inventory.Profile, ip net.IP) ([]byte, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s, profile %s (generated by go-pxe)\n$ErrorActionPreference = 'Stop'\n\n", who, p.Name)
+	if p.WinPE.PostInstall != "" {
+		hook, err := d.rootFile(p.WinPE.PostInstall, ip)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&b, "%s\n\n", strings.TrimRight(string(hook), "\r\n"))
+	}
+	fmt.Fprintf(&b, "Invoke-RestMethod -Method Post -Uri '%s/installed'\n", d.cfg.httpURL())
+	return []byte(b.String()), nil
+}
+
+// rootFile reads name from the HTTP root or, if only <name>.tmpl exists
+// there, renders that for the client at ip
+func (d *domain) rootFile(name string, ip net.IP) ([]byte, error) {
+	full := filepath.Join(d.cfg.HTTPRoot, filepath.FromSlash(path.Clean("/"+name)))
+	data, err := os.ReadFile(full)
+	if !errors.Is(err, fs.ErrNotExist) {
+		return data, err
+	}
+	text, terr := os.ReadFile(full + httpserver.TemplateSuffix)
+	if terr != nil {
+		return nil, err
+	}
+	return d.render(name, text, ip)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/ars1364/go-pxe/netsetup"
+)
+
+// autoConfigure implements -auto: reuse a private /24 already on the
+// interface, or pick an unused one and assign it, then derive the server
+// address and DHCP pool from it. The returned cleanup removes any address
+// that was added.
+func autoConfigure(opts *options) (func(), error) {
+	cleanup := func() {}
+
+	subnet, err := netsetup.InterfaceIPv4(opts.iface)
+	if err != nil {
+		return cleanup, fmt.Errorf("interface %s: %w", opts.iface, err)
+	}
+
+	var serverIP net.IP
+	if subnet != nil && subnet.IP.IsPrivate() && isSlash24(subnet) {
+		serverIP = subnet.IP
+		subnet = &net.IPNet{IP: subnet.IP.Mask(subnet.Mask), Mask: subnet.Mask}
+		log.Printf("[AUTO] Reusing %s already configured on %s", serverIP, opts.iface)
+	} else {
+		subnet, err = netsetup.PickFreeSubnet()
+		if err != nil {
+			return cleanup, err
+		}
+		serverIP = netsetup.HostAddr(subnet, 1)
+		addr := &net.IPNet{IP: serverIP, Mask: subnet.Mask}
+		if err := netsetup.AddAddress(opts.iface, addr); err != nil {
+			return cleanup, err
+		}
+		cleanup = func() {
+			if err := netsetup.RemoveAddress(opts.iface, addr); err != nil {
+				log.Printf("[AUTO] %v", err)
+			}
+		}
+		log.Printf("[AUTO] Selected %s, assigned %s to %s", subnet, serverIP, opts.iface)
+	}
+
+	opts.serverIP = serverIP.String()
+	opts.dhcpStart = netsetup.HostAddr(subnet, 100).String()
+	opts.dhcpEnd = netsetup.HostAddr(subnet, 200).String()
+	return cleanup, nil
+}
+
+func isSlash24(n *net.IPNet) bool {
+	ones, bits := n.Mask.Size()
+	return ones == 24 && bits == 32
+}